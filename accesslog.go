@@ -0,0 +1,100 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogTimeFormat is the time format of the Common Log Format.
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+type accessUserKey struct{}
+
+// setAccessUser records subject as the user of the access log line of the
+// request of ctx, if it has one. contextWithClaims calls it, since the
+// access log writes its line outside the middleware that authenticates.
+func setAccessUser(ctx context.Context, subject string) {
+	if u, ok := ctx.Value(accessUserKey{}).(*string); ok {
+		*u = subject
+	}
+}
+
+// AccessLog writes one line per request to w in the Common Log Format or,
+// if combined is set, the Combined Log Format, which adds the referer and
+// user agent, for tools such as GoAccess or Logstash that read them. It
+// must run inside RealIP for lines to carry the address of clients behind
+// proxies.
+func AccessLog(w io.Writer, combined bool) Middleware {
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			user := ""
+			rec := newResponseRecorder(rw)
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessUserKey{}, &user)))
+
+			size := "-"
+			if rec.bytes > 0 {
+				size = strconv.FormatInt(rec.bytes, 10)
+			}
+			line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+				clientAddr(r), cmp.Or(user, "-"), start.Format(accessLogTimeFormat),
+				accessLogQuote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto), rec.status, size)
+			if combined {
+				line += " " + accessLogQuote(r.Referer()) + " " + accessLogQuote(r.UserAgent())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			io.WriteString(w, line+"\n")
+		})
+	}
+}
+
+// accessLogQuote quotes s for an access log line, escaping quotes,
+// backslashes and control characters so that a client cannot forge lines
+// or fields.
+func accessLogQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// accessLogOutput returns the writer of cfg.Output, closing files when lc
+// stops.
+func accessLogOutput(cfg AccessLogConfig, lc *Lifecycle) (io.Writer, error) {
+	switch cfg.Output {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	rf, err := openRotatingFile(cfg.Output, cfg.MaxBytes, cfg.MaxAge.Duration, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(Hook{Name: "access log", OnStop: rf.Close})
+	return rf, nil
+}
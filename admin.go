@@ -0,0 +1,169 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// adminAPI serves the admin endpoints of the API that show how the server
+// is put together and change its behaviour at runtime: the route table,
+// the configuration in effect, the log level, the feature flags and, when
+// it is enabled, fault injection. Unlike
+// the admin listener they are authenticated, so that operators can reach
+// them from outside the host. The changes they make last until the next
+// restart, or for the log level until a reload changes log.level.
+type adminAPI struct {
+	rt    *Router
+	perms map[string]Permission
+	// middleware names the middleware every request passes through before
+	// it is routed, once the server is built.
+	middleware func() []string
+	config     func() Config
+	logLevel   *slog.LevelVar
+	flags      *FeatureFlags
+	chaos      *Chaos
+}
+
+// adminRoute is a route of GET /admin/routes.
+type adminRoute struct {
+	Method     string     `json:"method"`
+	Path       string     `json:"path"`
+	Summary    string     `json:"summary,omitempty"`
+	Permission Permission `json:"permission,omitempty"`
+	Middleware []string   `json:"middleware"`
+}
+
+// adminRoutesResponse is the body of GET /admin/routes. Middleware runs
+// for every request, outermost first, before the middleware of its route.
+type adminRoutesResponse struct {
+	Middleware []string     `json:"middleware"`
+	Routes     []adminRoute `json:"routes"`
+}
+
+// logLevelState is the body of GET and PUT /admin/log-level.
+type logLevelState struct {
+	Level string `json:"level" validate:"required"`
+}
+
+// adminFlagsResponse is the body of GET /admin/flags: the flags in effect
+// and those of them overridden at runtime.
+type adminFlagsResponse struct {
+	Flags     map[string]Flag `json:"flags"`
+	Overrides map[string]Flag `json:"overrides"`
+}
+
+func (api *adminAPI) register(rt *Router) {
+	rt.Get("/admin/routes", api.routes)
+	rt.Get("/admin/config", func(w http.ResponseWriter, r *http.Request) error {
+		respond(w, r, http.StatusOK, api.config().Redacted())
+		return nil
+	})
+	rt.Get("/admin/log-level", func(w http.ResponseWriter, r *http.Request) error {
+		respond(w, r, http.StatusOK, logLevelState{Level: strings.ToLower(api.logLevel.Level().String())})
+		return nil
+	})
+	rt.Put("/admin/log-level", api.setLogLevel)
+	rt.Get("/admin/flags", func(w http.ResponseWriter, r *http.Request) error {
+		respond(w, r, http.StatusOK, adminFlagsResponse{Flags: api.flags.Flags(), Overrides: api.flags.Overrides()})
+		return nil
+	})
+	rt.Put("/admin/flags/{name}", api.overrideFlag)
+	rt.Delete("/admin/flags/{name}", api.clearFlag)
+
+	rt.Document("GET", "/admin/routes", Operation{Summary: "List the routes with their permissions and middleware", Tag: "admin", Response: adminRoutesResponse{}})
+	rt.Document("GET", "/admin/config", Operation{Summary: "Show the configuration in effect, with secrets redacted", Tag: "admin", Response: Config{}})
+	rt.Document("GET", "/admin/log-level", Operation{Summary: "Show the log level", Tag: "admin", Response: logLevelState{}})
+	rt.Document("PUT", "/admin/log-level", Operation{Summary: "Change the log level", Tag: "admin", Request: logLevelState{}, Response: logLevelState{}})
+	rt.Document("GET", "/admin/flags", Operation{Summary: "Show the feature flags and their runtime overrides", Tag: "admin", Response: adminFlagsResponse{}})
+	rt.Document("PUT", "/admin/flags/{name}", Operation{Summary: "Override a feature flag", Tag: "admin", Request: Flag{}, Response: Flag{}})
+	rt.Document("DELETE", "/admin/flags/{name}", Operation{Summary: "Clear the override of a feature flag", Tag: "admin", Status: http.StatusNoContent})
+
+	if api.chaos == nil {
+		return
+	}
+	rt.Get("/admin/chaos", func(w http.ResponseWriter, r *http.Request) error {
+		respond(w, r, http.StatusOK, chaosState{Rules: api.chaos.Rules()})
+		return nil
+	})
+	rt.Put("/admin/chaos", api.setChaos)
+	rt.Delete("/admin/chaos", func(w http.ResponseWriter, r *http.Request) error {
+		api.chaos.SetRules(nil)
+		slog.InfoContext(r.Context(), "fault injection stopped")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+	rt.Document("GET", "/admin/chaos", Operation{Summary: "Show the fault injection rules", Tag: "admin", Response: chaosState{}})
+	rt.Document("PUT", "/admin/chaos", Operation{Summary: "Replace the fault injection rules", Tag: "admin", Request: chaosState{}, Response: chaosState{}})
+	rt.Document("DELETE", "/admin/chaos", Operation{Summary: "Stop injecting faults", Tag: "admin", Status: http.StatusNoContent})
+}
+
+func (api *adminAPI) routes(w http.ResponseWriter, r *http.Request) error {
+	resp := adminRoutesResponse{Middleware: api.middleware(), Routes: []adminRoute{}}
+	for _, route := range api.rt.Routes() {
+		resp.Routes = append(resp.Routes, adminRoute{
+			Method:     route.Method,
+			Path:       route.Path,
+			Summary:    route.Doc.Summary,
+			Permission: api.perms[route.Method+" "+route.Path],
+			Middleware: append([]string{}, route.Middleware...),
+		})
+	}
+	// By path, each path's methods in the order they were registered.
+	slices.SortStableFunc(resp.Routes, func(a, b adminRoute) int { return cmp.Compare(a.Path, b.Path) })
+	respond(w, r, http.StatusOK, resp)
+	return nil
+}
+
+func (api *adminAPI) setLogLevel(w http.ResponseWriter, r *http.Request) error {
+	var in logLevelState
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	level, err := LogConfig{Level: in.Level}.SlogLevel()
+	if err != nil {
+		return Invalid(ValidationErrors{{Field: "level", Message: "must be debug, info, warn or error"}}, "invalid request body")
+	}
+	api.logLevel.Set(level)
+	slog.InfoContext(r.Context(), "log level changed", "level", level)
+	respond(w, r, http.StatusOK, logLevelState{Level: strings.ToLower(level.String())})
+	return nil
+}
+
+func (api *adminAPI) setChaos(w http.ResponseWriter, r *http.Request) error {
+	var in chaosState
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	if errs := validateChaosRules(in.Rules); errs != nil {
+		return Invalid(errs, "invalid request body")
+	}
+	api.chaos.SetRules(in.Rules)
+	slog.InfoContext(r.Context(), "fault injection rules changed", "rules", len(in.Rules))
+	respond(w, r, http.StatusOK, chaosState{Rules: api.chaos.Rules()})
+	return nil
+}
+
+func (api *adminAPI) overrideFlag(w http.ResponseWriter, r *http.Request) error {
+	var in Flag
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	name := r.PathValue("name")
+	api.flags.Override(name, in)
+	slog.InfoContext(r.Context(), "feature flag overridden", "flag", name, "enabled", in.Enabled, "percentage", in.Percentage)
+	respond(w, r, http.StatusOK, in)
+	return nil
+}
+
+func (api *adminAPI) clearFlag(w http.ResponseWriter, r *http.Request) error {
+	name := r.PathValue("name")
+	if !api.flags.ClearOverride(name) {
+		return NotFound("feature flag %q is not overridden", name)
+	}
+	slog.InfoContext(r.Context(), "feature flag override cleared", "flag", name)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
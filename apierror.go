@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Error codes returned in the code field of error responses. Clients can
+// rely on these staying the same.
+const (
+	CodeInvalid  = "invalid"
+	CodeNotFound = "not_found"
+	CodeConflict = "conflict"
+	CodeInternal = "internal"
+)
+
+// APIError is an error that is reported to the client with a specific
+// status and code. Err is the underlying cause; it is logged but never
+// sent to the client.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Details any
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func NewAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func NotFound(format string, args ...any) *APIError {
+	return NewAPIError(http.StatusNotFound, CodeNotFound, fmt.Sprintf(format, args...))
+}
+
+// Invalid reports a request that cannot be processed as sent. details, if
+// not nil, describes the individual problems.
+func Invalid(details any, format string, args ...any) *APIError {
+	e := NewAPIError(http.StatusBadRequest, CodeInvalid, fmt.Sprintf(format, args...))
+	e.Details = details
+	return e
+}
+
+func Conflict(format string, args ...any) *APIError {
+	return NewAPIError(http.StatusConflict, CodeConflict, fmt.Sprintf(format, args...))
+}
+
+// Internal wraps an unexpected error. The client only sees a generic
+// message. An error from a deadline running out is reported as a 504
+// timeout instead, since the request only failed for lack of time, and one
+// from an open circuit breaker as a 503, since the request may succeed
+// once the service it needs is back.
+func Internal(err error) *APIError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		e := NewAPIError(http.StatusGatewayTimeout, CodeTimeout, "request timed out")
+		e.Err = err
+		return e
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		e := NewAPIError(http.StatusServiceUnavailable, CodeUnavailable, "a service the request needs is unavailable")
+		e.Err = err
+		return e
+	}
+	e := NewAPIError(http.StatusInternalServerError, CodeInternal, "internal error")
+	e.Err = err
+	return e
+}
+
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteError writes err as an error response. Errors that are not an
+// *APIError are treated as internal errors. Internal errors with a cause
+// are logged.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err)
+	}
+	if apiErr.Status >= 500 && apiErr.Err != nil {
+		slog.ErrorContext(r.Context(), "request failed", "method", r.Method, "path", r.URL.Path, "error", apiErr.Err)
+	}
+	resp := errorResponse{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		Details:   apiErr.Details,
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+	if l := localeFromContext(r.Context()); l != nil {
+		localize(r.Context(), &resp)
+		w.Header().Set("Content-Language", l.tag)
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	respond(w, r, apiErr.Status, resp)
+}
+
+// APIHandlerFunc is a handler that reports failure by returning an error,
+// which is written to the client by WriteError.
+type APIHandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+func (f APIHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f(w, r); err != nil {
+		WriteError(w, r, err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// APIKey is a credential for the X-API-Key header. Only a hash of the key
+// is stored; the key itself is shown once when it is created. A key with a
+// SigningSecret may also sign requests instead of sending the key, and the
+// secret is kept as it is to check them. A key with a Tenant can only act
+// for that tenant.
+type APIKey struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Prefix        string     `json:"prefix"`
+	Hash          string     `json:"-"`
+	SigningSecret string     `json:"-"`
+	Scopes        []string   `json:"scopes"`
+	CreatedAt     time.Time  `json:"created_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	Tenant        string     `json:"tenant,omitempty"`
+}
+
+// APIKeyStore persists API keys. GetAPIKey, GetAPIKeyByHash and
+// RevokeAPIKey return ErrNotFound for unknown keys.
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, k APIKey) error
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	GetAPIKey(ctx context.Context, id string) (APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+// generateAPIKey returns a new random key. The prefix identifies the key
+// in listings without revealing it.
+func generateAPIKey() (key, prefix string) {
+	b := make([]byte, 24)
+	rand.Read(b)
+	key = "pbl_" + hex.EncodeToString(b)
+	return key, key[:12]
+}
+
+// hashAPIKey hashes a key for storage. Keys are long and random, so a fast
+// hash is enough to make a leaked table useless.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyAuth authenticates requests with the X-API-Key header.
+type apiKeyAuth struct {
+	store APIKeyStore
+}
+
+func (a apiKeyAuth) Authenticate(r *http.Request) (*Claims, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	k, err := a.store.GetAPIKeyByHash(r.Context(), hashAPIKey(key))
+	if errors.Is(err, ErrNotFound) {
+		return nil, Unauthorized("unknown API key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.RevokedAt != nil {
+		return nil, Unauthorized("API key has been revoked")
+	}
+	return &Claims{Subject: "apikey:" + k.ID, Scopes: k.Scopes, Tenant: k.Tenant}, nil
+}
+
+func (a apiKeyAuth) Challenge() string {
+	return `APIKey header="` + apiKeyHeader + `"`
+}
+
+// bootstrapAPIKey makes sure the configured bootstrap key exists with the
+// admin role, so that the first real keys can be created through the API.
+// A key it creates is dated by clock.
+func bootstrapAPIKey(ctx context.Context, store APIKeyStore, key string, clock Clock) error {
+	hash := hashAPIKey(key)
+	if _, err := store.GetAPIKeyByHash(ctx, hash); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return store.CreateAPIKey(ctx, APIKey{
+		ID:        newUUID(),
+		Name:      "bootstrap",
+		Prefix:    key[:min(len(key), 12)],
+		Hash:      hash,
+		Scopes:    []string{roleAdmin},
+		CreatedAt: clock.Now().UTC(),
+	})
+}
+
+// apiKeysAPI serves the admin endpoints for managing API keys.
+type apiKeysAPI struct {
+	store APIKeyStore
+	clock Clock
+}
+
+func (api *apiKeysAPI) register(rt *Router) {
+	rt.Get("/admin/api-keys", api.list)
+	rt.Post("/admin/api-keys", api.create)
+	rt.Delete("/admin/api-keys/{id}", api.revoke)
+
+	rt.Document("GET", "/admin/api-keys", Operation{Summary: "List API keys", Tag: "admin", Response: listResponse[APIKey]{}})
+	rt.Document("POST", "/admin/api-keys", Operation{Summary: "Create an API key", Tag: "admin", Request: createAPIKeyRequest{}, Response: createAPIKeyResponse{}, Status: http.StatusCreated})
+	rt.Document("DELETE", "/admin/api-keys/{id}", Operation{Summary: "Revoke an API key", Tag: "admin", Status: http.StatusNoContent})
+}
+
+func (api *apiKeysAPI) list(w http.ResponseWriter, r *http.Request) error {
+	keys, err := api.store.ListAPIKeys(r.Context())
+	if err != nil {
+		return Internal(err)
+	}
+	respond(w, r, http.StatusOK, listResponse[APIKey]{Items: keys})
+	return nil
+}
+
+// createAPIKeyRequest is the body of POST /admin/api-keys. Signing gives
+// the key a secret to sign requests with.
+type createAPIKeyRequest struct {
+	Name    string   `json:"name" validate:"required,max=100"`
+	Scopes  []string `json:"scopes"`
+	Tenant  string   `json:"tenant"`
+	Signing bool     `json:"signing"`
+}
+
+type createAPIKeyResponse struct {
+	APIKey
+	Key           string `json:"key"`
+	SigningSecret string `json:"signing_secret,omitempty"`
+}
+
+func (api *apiKeysAPI) create(w http.ResponseWriter, r *http.Request) error {
+	var in createAPIKeyRequest
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	for _, s := range in.Scopes {
+		if s == "" || strings.ContainsAny(s, " \t\n") {
+			return ValidationErrors{{Field: "scopes", Message: "must not be empty or contain spaces"}}.apiError()
+		}
+	}
+	if in.Scopes == nil {
+		in.Scopes = []string{}
+	}
+	if in.Tenant != "" && !validTenant(in.Tenant) {
+		return ValidationErrors{{Field: "tenant", Message: tenantIDRule}}.apiError()
+	}
+	key, prefix := generateAPIKey()
+	k := APIKey{
+		ID:        newUUID(),
+		Name:      in.Name,
+		Prefix:    prefix,
+		Hash:      hashAPIKey(key),
+		Scopes:    in.Scopes,
+		CreatedAt: api.clock.Now().UTC(),
+		Tenant:    in.Tenant,
+	}
+	if in.Signing {
+		k.SigningSecret = generateSigningSecret()
+	}
+	if err := api.store.CreateAPIKey(r.Context(), k); err != nil {
+		return Internal(err)
+	}
+	respond(w, r, http.StatusCreated, createAPIKeyResponse{APIKey: k, Key: key, SigningSecret: k.SigningSecret})
+	return nil
+}
+
+func (api *apiKeysAPI) revoke(w http.ResponseWriter, r *http.Request) error {
+	id, err := PathUUID(r, "id")
+	if err != nil {
+		return err
+	}
+	err = api.store.RevokeAPIKey(r.Context(), id, api.clock.Now().UTC())
+	if errors.Is(err, ErrNotFound) {
+		return NotFound("API key not found")
+	}
+	if err != nil {
+		return Internal(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
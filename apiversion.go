@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CodeUnsupportedVersion is the error code of requests for an API version
+// the server does not have.
+const CodeUnsupportedVersion = "unsupported_version"
+
+// apiVersionNames are the versions of the resource API, oldest first. A
+// new version starts out with the handlers of the one before it; those
+// that change tell the versions apart with RequestAPIVersion.
+var apiVersionNames = []string{"v1", "v2"}
+
+// APIVersion is a version of the resource API, served under
+// /api/<Name>. Deprecated and Sunset are zero until the version is
+// deprecated and until its removal is scheduled.
+type APIVersion struct {
+	Name       string
+	Deprecated time.Time
+	Sunset     time.Time
+}
+
+// apiVersionPath matches the paths of versioned routes.
+var apiVersionPath = regexp.MustCompile(`^/api/v[0-9]+(/|$)`)
+
+// apiVersionMediaType matches the media types that ask for a version in
+// an Accept header, such as application/vnd.pebble.v2+json.
+var apiVersionMediaType = regexp.MustCompile(`^application/vnd\.pebble\.(v[0-9]+)\+json$`)
+
+// parseAPIVersions returns the versions, oldest first, with the dates that
+// cfg gives them, and the version served to clients that ask for none.
+func parseAPIVersions(cfg APIConfig) ([]APIVersion, APIVersion, error) {
+	versions := make([]APIVersion, len(apiVersionNames))
+	for i, name := range apiVersionNames {
+		versions[i].Name = name
+	}
+	for _, dates := range []struct {
+		key     string
+		entries []string
+		set     func(v *APIVersion, t time.Time)
+	}{
+		{"api.deprecated", cfg.Deprecated, func(v *APIVersion, t time.Time) { v.Deprecated = t }},
+		{"api.sunset", cfg.Sunset, func(v *APIVersion, t time.Time) { v.Sunset = t }},
+	} {
+		for _, e := range dates.entries {
+			name, date, ok := strings.Cut(e, "=")
+			i := slices.Index(apiVersionNames, name)
+			if !ok || i < 0 {
+				return nil, APIVersion{}, fmt.Errorf("%s: %q is not a version=date entry for one of %s", dates.key, e, strings.Join(apiVersionNames, ", "))
+			}
+			t, err := time.Parse(time.DateOnly, date)
+			if err != nil {
+				return nil, APIVersion{}, fmt.Errorf("%s: %q is not a date such as 2026-10-14", dates.key, date)
+			}
+			dates.set(&versions[i], t)
+		}
+	}
+	i := slices.Index(apiVersionNames, cfg.DefaultVersion)
+	if i < 0 {
+		return nil, APIVersion{}, fmt.Errorf("api.default_version: %q is not one of %s", cfg.DefaultVersion, strings.Join(apiVersionNames, ", "))
+	}
+	return versions, versions[i], nil
+}
+
+type apiVersionKey struct{}
+
+type requestVersion struct {
+	version APIVersion
+	prefix  string
+}
+
+// RequestAPIVersion returns the version of the API serving the request
+// with context ctx. It is zero outside the resource API.
+func RequestAPIVersion(ctx context.Context) APIVersion {
+	rv, _ := ctx.Value(apiVersionKey{}).(requestVersion)
+	return rv.version
+}
+
+// APIPath returns the absolute path of the resource at path in the
+// version of the API serving the request with context ctx, with the
+// version prefix the request used, for links such as Location headers.
+func APIPath(ctx context.Context, path string) string {
+	rv, _ := ctx.Value(apiVersionKey{}).(requestVersion)
+	if rv.prefix != "" {
+		return rv.prefix + path
+	}
+	return BasePath(ctx) + path
+}
+
+// announce sets the headers telling clients that v is deprecated, as of
+// when, and when it goes away.
+func (v APIVersion) announce(h http.Header) {
+	if !v.Deprecated.IsZero() {
+		h.Set("Deprecation", fmt.Sprintf("@%d", v.Deprecated.Unix()))
+	}
+	if !v.Sunset.IsZero() {
+		h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+	}
+}
+
+func withVersion(w http.ResponseWriter, r *http.Request, next http.Handler, v APIVersion, prefix string) {
+	v.announce(w.Header())
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, requestVersion{version: v, prefix: prefix})))
+}
+
+// registerVersions calls register with a router for every API version, all
+// under /api/<version>, and one for the same routes without a prefix, whose
+// version is negotiated from the Accept header. Versioned routes require
+// the permission in perms of the unprefixed route.
+func registerVersions(rt *Router, perms map[string]Permission, versions []APIVersion, def APIVersion, register func(*Router)) {
+	for _, v := range versions {
+		prefix := "/api/" + v.Name
+		start := len(rt.Routes())
+		register(rt.Group(prefix).With("api_version", func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				withVersion(w, r, next, v, prefix)
+			})
+		}))
+		for _, route := range rt.Routes()[start:] {
+			if p, ok := perms[route.Method+" "+strings.TrimPrefix(route.Path, prefix)]; ok {
+				perms[route.Method+" "+route.Path] = p
+			}
+		}
+	}
+	register(rt.With("api_version", NegotiateVersion(versions, def)))
+}
+
+// NegotiateVersion serves each request with the version of the API named
+// by its Accept header, or def if it names none. Requests for a version
+// that does not exist get a 406 response.
+func NegotiateVersion(versions []APIVersion, def APIVersion) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+			v, err := acceptedVersion(r, versions, def)
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			withVersion(w, r, next, v, "")
+		})
+	}
+}
+
+// acceptedVersion returns the version named by the first media type in
+// the Accept headers of r that names one.
+func acceptedVersion(r *http.Request, versions []APIVersion, def APIVersion) (APIVersion, error) {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, media := range strings.Split(accept, ",") {
+			mt, _, err := mime.ParseMediaType(strings.TrimSpace(media))
+			if err != nil {
+				continue
+			}
+			m := apiVersionMediaType.FindStringSubmatch(mt)
+			if m == nil {
+				continue
+			}
+			if i := slices.IndexFunc(versions, func(v APIVersion) bool { return v.Name == m[1] }); i >= 0 {
+				return versions[i], nil
+			}
+			return APIVersion{}, NewAPIError(http.StatusNotAcceptable, CodeUnsupportedVersion, fmt.Sprintf("API version %s does not exist", m[1]))
+		}
+	}
+	return def, nil
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// app is the server with all its components wired together but not yet
+// started.
+type app struct {
+	lc     *Lifecycle
+	router *Router
+	grpc   *GRPCServer
+	// perms is the permission each route requires, routePermissions with
+	// the routes of the configuration added.
+	perms map[string]Permission
+	// middleware names the middleware every HTTP request passes through
+	// before it is routed, outermost first.
+	middleware []string
+}
+
+// newApp builds the server described by cfg. configPath is the file cfg
+// was loaded from, which is read again on reload, and logLevel the level
+// of logger, which reloads adjust. The timeouts, TTLs and schedules of
+// its components are measured by clock.
+func newApp(cfg Config, configPath string, clock Clock, logger *slog.Logger, logLevel *slog.LevelVar) (*app, error) {
+	lc := NewLifecycle(logger, cfg.ShutdownTimeout.Duration)
+	reloader := NewReloader(configPath, cfg, logger)
+	lc.Append(BackgroundHook("config reload", reloader.run))
+	reloader.OnChange(func(cfg Config) {
+		l, _ := cfg.Log.SlogLevel()
+		logLevel.Set(l)
+	}, "log.level")
+	health := NewHealth(cfg.HealthTimeout.Duration)
+	var reg *Registry
+	if cfg.Metrics.Enabled {
+		b := buildInfo()
+		reg = NewRegistry(map[string]string{"version": b.Version, "commit": b.Commit, "build_date": b.BuildDate})
+		reg.RegisterRuntimeMetrics()
+	}
+
+	var tracer *Tracer
+	if t := cfg.Tracing; t.Endpoint != "" {
+		exporter, err := newOTLPExporter(t.Endpoint, t.Headers, t.ServiceName, t.BatchSize, t.ExportInterval.Duration, logger)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create span exporter: %w", err)
+		}
+		// Appended before the servers so that it stops after them and
+		// exports their last spans.
+		lc.Append(BackgroundHook("tracing", exporter.run))
+		tracer = NewTracer(exporter, t.SampleRatio)
+	}
+
+	store, err := newStore(cfg.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create store: %w", err)
+	}
+	var outbox Outbox
+	db, _ := store.(*sqlStore)
+	if db != nil {
+		outbox = db
+		health.Register("database", db)
+		lc.Append(Hook{
+			Name: "database",
+			OnStart: func(ctx context.Context) error {
+				if err := waitForDependency(ctx, cfg.Startup, logger, "database", db.Check); err != nil {
+					return err
+				}
+				if !cfg.Storage.AutoMigrate {
+					return nil
+				}
+				m, err := db.Migrator(logger)
+				if err != nil {
+					return err
+				}
+				return m.Up(ctx)
+			},
+			OnStop: func(context.Context) error { return db.Close() },
+		})
+	}
+	if d := cfg.Storage.Timeout.Duration; d > 0 {
+		store = timeoutStore{Store: store, timeout: d, clock: clock}
+	}
+	var breakers *Breakers
+	var retry RetryPolicy
+	if r := cfg.Resilience; r.Enabled {
+		breakers = NewBreakers(r, clock, reg)
+		retry = RetryPolicy{Retries: r.Retries, Backoff: r.RetryBackoff.Duration, Clock: clock}
+		// Outside the timeout, so that every attempt gets all of it.
+		store = resilientStore{Store: store, breaker: breakers.Get("storage"), retry: retry}
+	}
+
+	// Started before and stopped after the servers, so that requests can
+	// enqueue jobs until the last one has been served.
+	jobs := NewJobQueue(cfg.Jobs, clock, logger, reg)
+	lc.Append(jobs.Hook())
+	// Jobs are added as the components running them are set up, and the
+	// scheduler is started once they all are.
+	locker, err := newJobLocker(cfg.Scheduler, db, cfg.Cache.Redis, logger)
+	if err != nil {
+		return nil, fmt.Errorf("cannot set up scheduler locks: %w", err)
+	}
+	if rl, ok := locker.(*redisLocker); ok {
+		lc.Append(Hook{Name: "scheduler locks", OnStop: rl.Close})
+	}
+	scheduler := NewScheduler(cfg.Scheduler, locker, clock, logger, reg)
+
+	external := []Publisher{NewWebhooks(cfg.Webhooks, store, jobs, breakers, retry, clock, logger)}
+	if cfg.Events.Publisher == "nats" {
+		n := cfg.Events.NATS
+		nats, err := newNATSPublisher(n.URL, n.SubjectPrefix, n.QueueSize, logger)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create event publisher: %w", err)
+		}
+		health.Register("nats", nats)
+		lc.Append(BackgroundHook("nats", nats.run))
+		external = append(external, nats)
+	}
+	hub := NewHub(cfg.Events.History, clock, external...)
+	if tracer != nil {
+		store = tracingStore{Store: store, tracer: tracer, backend: cfg.Storage.Backend}
+	}
+	cache, err := newCache(cfg.Cache, clock)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cache: %w", err)
+	}
+	switch c := cache.(type) {
+	case *memoryCache:
+		lc.Append(BackgroundHook("cache", func(ctx context.Context) { c.run(ctx, time.Minute) }))
+	case *redisCache:
+		// Not a readiness check: reads go to the store while Redis is
+		// down, so the instance can keep serving, and starts without it
+		// once the wait is over.
+		lc.Append(Hook{
+			Name: "cache",
+			OnStart: func(ctx context.Context) error {
+				if err := waitForDependency(ctx, cfg.Startup, logger, "redis", c.Check); err != nil {
+					if ctx.Err() != nil {
+						return err
+					}
+					logger.Warn("starting without the cache", "error", err)
+				}
+				return nil
+			},
+			OnStop: c.Close,
+		})
+	}
+	if cache != nil {
+		pebbleCache := cache
+		if reg != nil {
+			pebbleCache = newMeteredCache(cache, reg, cfg.Cache.Backend)
+		}
+		// Inside publishingStore, so that a change is out of the cache by
+		// the time its event is published.
+		store = cachingStore{Store: store, cache: pebbleCache, ttl: cfg.Cache.TTL.Duration}
+	}
+	if cfg.Fixtures.Load {
+		// Inside publishingStore or outboxStore, so that seeding raises no
+		// events.
+		lc.Append(fixturesHook(store, cfg.Fixtures.Files, cfg.Tenancy.seedTenant(), clock, logger))
+	}
+	if cfg.Events.Outbox.Enabled && outbox != nil {
+		relay := NewOutboxRelay(outbox, hub, cfg.Events.Outbox, logger)
+		lc.Append(BackgroundHook("outbox", relay.run))
+		store = outboxStore{Store: store, outbox: outbox, relay: relay, clock: clock}
+	} else {
+		store = publishingStore{Store: store, pub: hub, logger: logger}
+	}
+	if cfg.Audit.Enabled {
+		// Outside the cache, so that the reads of pebbles about to
+		// change are answered by it.
+		store = auditingStore{Store: store}
+	}
+	if cfg.Tenancy.Enabled {
+		// Outside the cache, which holds the pebbles of every tenant.
+		store = tenantStore{Store: store}
+	}
+
+	rt := NewRouter()
+	// A copy, since the versioned, gateway and proxy routes of this
+	// configuration are added to it.
+	perms := maps.Clone(routePermissions)
+	rt.Get("/{$}", func(w http.ResponseWriter, r *http.Request) error {
+		fmt.Fprint(w, "Hello, world!")
+		return nil
+	})
+
+	versions, defaultVersion, err := parseAPIVersions(cfg.API)
+	if err != nil {
+		return nil, err
+	}
+	svc := &PebbleService{store: store, clock: clock}
+	flags, err := setupFlags(cfg.Flags, reloader, lc, health, logger)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Demo {
+		lc.Append(demoHook(svc, cfg.Port, cfg.Tenancy.seedTenant(), logger))
+	}
+	pebbles := &pebblesAPI{svc: svc, maxBatch: cfg.Batch.MaxOperations}
+	webhooks := &webhooksAPI{store: store, clock: clock}
+	changes := &changesAPI{hub: hub, timeout: cfg.Events.LongPollTimeout.Duration, clock: clock}
+	var attachments *attachmentsAPI
+	if a := cfg.Attachments; a.Enabled {
+		blobs, err := newBlobStore(a)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create blob store: %w", err)
+		}
+		attachments = newAttachmentsAPI(a, svc, store, blobs, clock, logger)
+	}
+	registerVersions(rt, perms, versions, defaultVersion, func(api *Router) {
+		pebbles.register(api)
+		// Long polls wait for changes rather than work on them.
+		changes.register(api.Without("load_shed", "slow_requests"))
+		webhooks.register(api)
+		if attachments != nil {
+			attachments.register(api)
+		}
+	})
+	if sd := cfg.SoftDelete; sd.Retention.Duration > 0 {
+		var purged func(ctx context.Context, id string)
+		if attachments != nil {
+			purged = attachments.removeAll
+		}
+		scheduler.AddExclusive(jobPurgeDeleted, "@every "+sd.PurgeInterval.String(), func(ctx context.Context) error {
+			return purgeDeleted(ctx, store, sd.Retention.Duration, clock, logger, purged)
+		})
+	}
+	webhooks.registerAdmin(rt)
+	if in := cfg.InboundWebhooks; in.Enabled {
+		// Shared through Redis with the cache, so that a delivery sent
+		// again to another instance is known there too.
+		seen, _ := cache.(addingCache)
+		if seen == nil {
+			m := newMemoryCache(clock)
+			lc.Append(BackgroundHook("inbound webhooks", func(ctx context.Context) { m.run(ctx, time.Minute) }))
+			seen = m
+		}
+		NewInboundWebhooks(in, seen, jobs, clock, logger, reg).register(rt)
+	}
+	flags.register(rt)
+	var cors atomic.Pointer[CORSPolicies]
+	cors.Store(new(corsPolicies(cfg.CORS)))
+	reloader.OnChange(func(cfg Config) { cors.Store(new(corsPolicies(cfg.CORS))) }, "cors")
+	allowsOrigin := func(origin string) bool { return cors.Load().Default.allowsOrigin(origin) }
+	// The streams outlive any request timeout and flush as they go.
+	streams := rt.Without("compress", "timeout", "load_shed", "slow_requests")
+	streams.Handle(http.MethodGet, "/ws", WebSocketHandler(hub, allowsOrigin, logger))
+	streams.Document("GET", "/ws", Operation{Summary: "Stream pebble changes over WebSocket", Tag: "events", Status: http.StatusSwitchingProtocols})
+	streams.Handle(http.MethodGet, "/events", EventsHandler(hub, logger))
+	streams.Document("GET", "/events", Operation{Summary: "Stream pebble changes as Server-Sent Events", Tag: "events"})
+	var sessions SessionStore
+	if o := cfg.Auth.OIDC; o.Enabled {
+		revocations := cache
+		if revocations == nil {
+			m := newMemoryCache(clock)
+			lc.Append(BackgroundHook("session revocations", func(ctx context.Context) { m.run(ctx, time.Minute) }))
+			revocations = m
+		}
+		if sessions, err = newSessionStore(o, cfg.Cache.Redis, revocations, clock); err != nil {
+			return nil, fmt.Errorf("cannot create session store: %w", err)
+		}
+		if rs, ok := sessions.(*redisSessionStore); ok {
+			// Not a readiness check, like the cache: requests with other
+			// credentials are served while Redis is down.
+			lc.Append(Hook{Name: "sessions", OnStop: rs.Close})
+		}
+	}
+	auth, authenticator := setupAuth(cfg.Auth, cfg.Startup, store, sessions, rt, perms, clock, logger, lc, health, scheduler)
+
+	grpcSrv := NewGRPCServer(authenticator, perms, logger)
+	(&pebblesGRPC{svc: svc}).register(grpcSrv)
+	rootPaths := slices.Clone(opsPaths)
+	if cfg.Auth.OIDC.Enabled {
+		// The provider redirects the browser to /auth/callback.
+		rootPaths = append(rootPaths, "/auth/")
+	}
+	if cfg.InboundWebhooks.Enabled {
+		rootPaths = append(rootPaths, "/hooks/")
+	}
+	if cfg.GRPC.Gateway {
+		gw, err := NewGateway(pebblesProto, grpcSrv)
+		if err == nil {
+			err = gw.register(rt, perms)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up the gRPC gateway: %w", err)
+		}
+		// With the frontend, the gateway stays at the root, since under
+		// /api its /v1 routes would clash with the versioned ones.
+		rootPaths = append(rootPaths, gw.pathPrefixes()...)
+	}
+
+	if cfg.OpenAPI.Enabled {
+		rt.Handle(http.MethodGet, "/openapi.json", OpenAPIHandler(rt, perms, "Pebble API", "1.0.0", cfg.Auth.Mode, rootPaths))
+		rt.Get("/schemas", SchemasHandler(NewSchemaRegistry(rt)))
+		rt.Document("GET", "/schemas", Operation{Summary: "List the JSON Schemas of the request and response bodies of each route", Tag: "meta", Response: schemasResponse{}})
+		if cfg.OpenAPI.Docs {
+			rt.Handle(http.MethodGet, "/docs", swaggerUIHandler())
+		}
+	}
+	var httpCache *HTTPCache
+	if hc := cfg.HTTPCache; hc.Enabled {
+		c := cache
+		if c == nil {
+			m := newMemoryCache(clock)
+			lc.Append(BackgroundHook("http cache", func(ctx context.Context) { m.run(ctx, time.Minute) }))
+			c = m
+		}
+		httpCache = NewHTTPCache(c, hc.MaxBodyBytes, clock, reg)
+		rt.Delete("/admin/http-cache", httpCache.PurgeHandler())
+		rt.Document("DELETE", "/admin/http-cache", Operation{Summary: "Purge the cached responses for ?path", Tag: "admin", Status: http.StatusNoContent})
+	}
+	maintenance := NewMaintenance(cfg.Maintenance, clock)
+	reloader.OnChange(func(cfg Config) { maintenance.Configure(cfg.Maintenance) }, "maintenance")
+	maintenance.register(rt)
+	if cfg.Audit.Enabled {
+		rt.Get("/admin/audit", AuditHandler(store))
+		rt.Document("GET", "/admin/audit", Operation{Summary: "List the audit log, newest first", Tag: "admin", Response: listResponse[AuditEntry]{}})
+	}
+	if cfg.GraphQL.Enabled {
+		gql, err := newGraphQLAPI(cfg.GraphQL, svc, attachments)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up GraphQL: %w", err)
+		}
+		gql.register(rt)
+	}
+	proxyRetry := RetryPolicy{Retries: cfg.Proxy.Retries, Backoff: cfg.Proxy.RetryBackoff.Duration, Clock: clock}
+	for _, route := range cfg.Proxy.routes() {
+		proxy, err := NewProxy(route, proxyRetry, breakers.Get("proxy:"+route.Upstream), logger)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up the proxy for %s: %w", route.Prefix, err)
+		}
+		group := rt
+		if d := route.Timeout.Duration; d > 0 {
+			group = rt.Without("timeout").With("timeout", Timeout(d, clock))
+		}
+		group.Handle("", route.Prefix, proxy)
+		switch {
+		case route.Public:
+		case route.Permission != "":
+			perms[route.Prefix] = Permission(route.Permission)
+		default:
+			perms[route.Prefix] = PermProxy
+		}
+	}
+	if breakers != nil {
+		breakers.register(rt)
+	}
+	rt.Get("/admin/jobs", JobsHandler(jobs))
+	rt.Document("GET", "/admin/jobs", Operation{Summary: "Show the state of the background job queue", Tag: "admin", Response: JobStats{}})
+	rt.Get("/admin/scheduler", SchedulerHandler(scheduler))
+	rt.Document("GET", "/admin/scheduler", Operation{Summary: "Show the state of the scheduled jobs", Tag: "admin", Response: []ScheduledJobStatus{}})
+	if db != nil {
+		if snaps, err := newSnapshots(cfg.Storage, db); err != nil {
+			logger.Warn("database snapshots are not available", "error", err)
+		} else {
+			// Snapshots are streamed, and take as long as the database needs.
+			rt.Without("timeout", "slow_requests").Post("/admin/snapshot", SnapshotHandler(snaps, clock, logger))
+			rt.Document("POST", "/admin/snapshot", Operation{Summary: "Download a consistent snapshot of the database", Tag: "admin"})
+		}
+	}
+	rt.Get("/version", VersionHandler(clock))
+	rt.Document("GET", "/version", Operation{Summary: "Show the version, time and uptime of the server", Tag: "meta", Response: versionResponse{}})
+	// Probes get through however loaded the server is.
+	ops := rt.Without("load_shed")
+	ops.Handle(http.MethodGet, "/healthz", health.LiveHandler())
+	ops.Handle(http.MethodGet, "/readyz", health.ReadyHandler())
+
+	trusted, err := ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	// The middleware in mws sees every request, routed or not; that added
+	// to rt with Use wraps the routes, except those of groups leaving it
+	// out, such as the event streams.
+	var mws []Middleware
+	var global []string
+	use := func(name string, mw Middleware) {
+		mws = append(mws, mw)
+		global = append(global, name)
+	}
+	var chaos *Chaos
+	if ch := cfg.Chaos; ch.Enabled {
+		chaos = NewChaos(ch.Rules, rt, reg, logger)
+		reloader.OnChange(func(cfg Config) { chaos.SetRules(cfg.Chaos.Rules) }, "chaos.rules")
+		logger.Warn("fault injection is enabled", "rules", len(ch.Rules))
+	}
+	(&adminAPI{
+		rt:    rt,
+		perms: perms,
+		// Complete by the time requests are served.
+		middleware: func() []string { return global },
+		config:     reloader.Config,
+		logLevel:   logLevel,
+		flags:      flags,
+		chaos:      chaos,
+	}).register(rt)
+	use("real_ip", RealIP(trusted))
+	if a := cfg.Log.Access; a.Enabled {
+		w, err := accessLogOutput(a, lc)
+		if err != nil {
+			return nil, err
+		}
+		// Outside the rest, so that every response is logged as sent.
+		use("access_log", AccessLog(w, a.Format == "combined"))
+	}
+	use("request_id", RequestID())
+	if cfg.I18n.Enabled {
+		tr, err := NewTranslator(cfg.I18n.DefaultLocale)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load message catalogs: %w", err)
+		}
+		use("i18n", Localize(tr))
+	}
+	// Always installed, so that the headers can be changed by a reload.
+	var apiHeaders, frontendHeaders atomic.Pointer[SecurityHeaders]
+	setSecurityHeaders := func(cfg Config) {
+		apiHeaders.Store(new(securityHeaders(cfg.SecurityHeaders, cfg.Development, false)))
+		frontendHeaders.Store(new(securityHeaders(cfg.SecurityHeaders, cfg.Development, true)))
+	}
+	setSecurityHeaders(cfg)
+	reloader.OnChange(setSecurityHeaders, "security_headers")
+	use("security_headers", SecureHeaders(func() SecurityHeaders { return *apiHeaders.Load() }))
+	if tracer != nil {
+		use("trace", Trace(tracer, routeSpanName(rt)))
+	}
+	use("logging", Logging(logger))
+	var metrics *httpMetrics
+	if reg != nil {
+		ops.Handle(http.MethodGet, "/metrics", reg.Handler())
+		metrics = newHTTPMetrics(reg)
+		use("instrument", Instrument(metrics, rt))
+	}
+	if o := cfg.SLO; o.Enabled {
+		slos, err := NewSLOs(o, rt, clock, reg, logger)
+		if err != nil {
+			return nil, err
+		}
+		lc.Append(BackgroundHook("slo", slos.run))
+		slos.register(rt)
+		// Outside recover, so that panics count as the 500s they get.
+		use("slo", slos.Middleware())
+	}
+	use("recover", Recover(logger, metrics, cfg.Development))
+	var proxied []string
+	for _, route := range cfg.Proxy.routes() {
+		proxied = append(proxied, route.Prefix)
+	}
+	use("negotiate", Negotiate(cfg.API.Formats, proxied))
+	var ipFilter *IPFilter
+	if f := cfg.IPFilter; len(f.Allow) > 0 || len(f.Deny) > 0 {
+		ipFilter, err = NewIPFilter(f.Allow, f.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up IP filter: %w", err)
+		}
+		use("ip_filter", ipFilter.Middleware())
+	}
+	// Always installed, so that origins can be allowed by a reload.
+	use("cors", CORS(func() CORSPolicies { return *cors.Load() }))
+	// Inside CORS, so that browsers can read the 503 response.
+	use("maintenance", maintenance.Middleware(append(slices.Clone(opsPaths), "/admin/")))
+	if sr := cfg.SlowRequests; sr.Enabled {
+		// Outside the load shedder, so that queueing for it counts too.
+		rt.Use("slow_requests", NewSlowRequests(sr, rt, reg, logger).Middleware())
+	}
+	if chaos != nil {
+		// Inside the slow request log, so that injected latency shows in it.
+		rt.Use("chaos", chaos.Middleware())
+	}
+	if cfg.LoadShed.Enabled {
+		// Outside the rest, so that shed requests cost as little as possible.
+		rt.Use("load_shed", NewLoadShedder(cfg.LoadShed, clock, reg).Middleware())
+	}
+	if c := cfg.Compression; c.Enabled {
+		rt.Use("compress", Compress(c.MinSize, c.ContentTypes))
+	}
+	if rl := cfg.RateLimit; rl.Enabled {
+		limiter := newMemoryLimiter(rl.Rate, rl.Burst, rl.IdleTTL.Duration, clock)
+		lc.Append(BackgroundHook("rate limiter", limiter.run))
+		reloader.OnChange(func(cfg Config) {
+			rl := cfg.RateLimit
+			limiter.SetLimits(rl.Rate, rl.Burst, rl.IdleTTL.Duration)
+		}, "rate_limit.rate", "rate_limit.burst", "rate_limit.idle_ttl")
+		rt.Use("rate_limit", RateLimit(limiter, rateLimitKey))
+	}
+	// Bodies in the other formats are accepted as soon as they are enabled.
+	bodyCfg := cfg.RequestBody
+	for _, mt := range mediaTypes(slices.DeleteFunc(slices.Clone(cfg.API.Formats), func(f string) bool { return f == "json" })) {
+		if !slices.Contains(bodyCfg.ContentTypes, mt) {
+			bodyCfg.ContentTypes = append(slices.Clone(bodyCfg.ContentTypes), mt)
+		}
+	}
+	bodyPolicy := NewBodyPolicy(bodyCfg)
+	// Imports are read as they stream in, and take NDJSON and CSV.
+	bodyPolicy.Allow("POST /pebbles/import", importMaxBytes)
+	if attachments != nil {
+		bodyPolicy.Allow("POST /pebbles/{id}/attachments", attachments.uploadLimit())
+	}
+	if in := cfg.InboundWebhooks; in.Enabled {
+		// Providers send JSON or forms, and signatures are checked on the
+		// body as sent.
+		bodyPolicy.Allow("POST /hooks/{provider}", in.MaxBytes)
+	}
+	for _, route := range cfg.Proxy.routes() {
+		// The upstream decides what it accepts.
+		bodyPolicy.Allow(route.Prefix, cfg.RequestBody.MaxBytes)
+	}
+	if cp := cfg.Capture; cp.Enabled {
+		f, err := openRotatingFile(cp.File, cp.MaxBytes, 0, cp.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open capture file: %w", err)
+		}
+		lc.Append(Hook{Name: "capture", OnStop: f.Close})
+		// Outside the body policy and auth, so that the requests they
+		// reject are captured too.
+		rt.Use("capture", NewTrafficCapture(cp, cfg.Log.Body.RedactFields, f).Middleware())
+	}
+	rt.Use("body_policy", bodyPolicy.Middleware(rt))
+	// Inside Compress, so that bodies are logged before they are gzipped.
+	bodies := NewBodyLogger(cfg.Log.Body, logger)
+	reloader.OnChange(func(cfg Config) { bodies.Configure(cfg.Log.Body) }, "log.body")
+	rt.Use("body_log", bodies.Middleware())
+	rt.Use("auth", auth)
+	if t := cfg.Tenancy; t.Enabled {
+		var limiter LimiterStore
+		if t.Rate > 0 {
+			l := newMemoryLimiter(t.Rate, t.Burst, cfg.RateLimit.IdleTTL.Duration, clock)
+			lc.Append(BackgroundHook("tenant rate limiter", l.run))
+			limiter = l
+		}
+		tenancy := NewTenancy(t, limiter, reg)
+		grpcSrv.UseTenancy(tenancy)
+		// Outside Idempotency, so that keys are scoped to the tenant.
+		rt.Use("tenant", tenancy.Middleware(perms, rt))
+	}
+	// After auth and tenant, which name the caller flags are resolved for.
+	rt.Use("flags", flags.Middleware())
+	if cfg.Idempotency.Enabled {
+		idem := newMemoryIdempotencyStore(cfg.Idempotency.TTL.Duration, clock)
+		lc.Append(BackgroundHook("idempotency", idem.run))
+		rt.Use("idempotency", Idempotency(idem, rt))
+	}
+	if httpCache != nil {
+		rt.Use("http_cache", httpCache.Middleware())
+	}
+	if d := cfg.RequestTimeout.Duration; d > 0 {
+		rt.Use("timeout", Timeout(d, clock))
+	}
+	rt.Use("deadline", Deadline(clock))
+	if cfg.Audit.Enabled {
+		rt.Use("audit", Audit(store, clock, logger))
+	}
+
+	handler := Chain(rt, mws...)
+	if f := cfg.Frontend; f.Enabled {
+		var fsys fs.FS
+		if f.Dir != "" {
+			if info, err := os.Stat(f.Dir); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("cannot serve frontend: %s is not a directory", f.Dir)
+			}
+			fsys = os.DirFS(f.Dir)
+		} else {
+			fsys, _ = fs.Sub(webFiles, "web")
+		}
+		feMws := []Middleware{RealIP(trusted), RequestID(), SecureHeaders(func() SecurityHeaders { return *frontendHeaders.Load() }), Logging(logger), Recover(logger, nil, cfg.Development)}
+		if ipFilter != nil {
+			feMws = append(feMws, ipFilter.Middleware())
+		}
+		if c := cfg.Compression; c.Enabled {
+			feMws = append(feMws, Compress(c.MinSize, c.ContentTypes))
+		}
+		handler = withFrontend(handler, Chain(FrontendHandler(fsys), feMws...), rootPaths)
+	}
+	grpcMws := []Middleware{RealIP(trusted), RequestID()}
+	if tracer != nil {
+		grpcMws = append(grpcMws, Trace(tracer, grpcSpanName))
+	}
+	grpcMws = append(grpcMws, Logging(logger))
+	grpcHandler := Chain(grpcSrv, grpcMws...)
+	if cfg.H2C {
+		handler = withGRPC(handler, grpcHandler)
+	}
+
+	// gauge counts the requests each server is serving, up to the end of
+	// its drain at shutdown, if metrics are enabled.
+	gauge := func(string) Option { return func(*Server) {} }
+	if reg != nil {
+		inFlight := reg.NewGaugeVec("http_server_requests_in_flight",
+			"Number of requests being served by each server, including those being drained at shutdown.", "server")
+		gauge = func(name string) Option { return WithInFlightGauge(inFlight, name) }
+	}
+	srv := NewServer(
+		WithConfig(cfg),
+		WithHandler(handler),
+		WithLogger(logger),
+		WithBeforeShutdown(health.SetShuttingDown),
+		gauge("http"),
+	)
+
+	// After what its jobs use and before the servers, so that it stops
+	// once they have drained and before what its jobs use.
+	lc.Append(scheduler.Hook())
+	adminMws := []Middleware{RealIP(trusted), RequestID(), Logging(logger)}
+	if f := cfg.IPFilter; len(f.AdminAllow) > 0 || len(f.AdminDeny) > 0 {
+		adminFilter, err := NewIPFilter(f.AdminAllow, f.AdminDeny)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up admin IP filter: %w", err)
+		}
+		adminMws = append(adminMws, adminFilter.Middleware())
+	}
+	adminHandler := Chain(DebugHandler(reloader.Config, bodies), adminMws...)
+	// listeners appends the hooks of the extra listeners serving what
+	// serve names, all stopped with the server of the same kind.
+	listeners := func(serve string) {
+		for _, l := range cfg.Listeners {
+			if l.Serve != serve {
+				continue
+			}
+			opts := []Option{WithConfig(cfg), l.option(), WithRedirectPort(0), WithShutdownDelay(0), WithLogger(logger.With("server", l.Name)), gauge(l.Name)}
+			switch serve {
+			case "api":
+				opts = append(opts, WithHandler(handler))
+			case "admin":
+				opts = append(opts, WithTLS("", ""), WithWriteTimeout(0), WithProxyProtocol(nil, 0), WithHandler(adminHandler))
+			case "grpc":
+				opts = append(opts, WithH2C(), WithHandler(grpcHandler))
+			}
+			lc.Append(ServerHook(l.Name, NewServer(opts...), lc))
+		}
+	}
+	if cfg.Admin.Port != 0 {
+		// Appended before the other servers so that profiles can still be
+		// taken while they drain.
+		lc.Append(ServerHook("admin", NewServer(
+			WithConfig(cfg),
+			WithHost("127.0.0.1"),
+			WithAddressFamily("ipv4"),
+			WithPort(cfg.Admin.Port),
+			WithRedirectPort(0),
+			WithTLS("", ""),
+			WithProxyProtocol(nil, 0),
+			WithShutdownDelay(0),
+			// CPU profiles and execution traces stream for as long as
+			// the client asks.
+			WithWriteTimeout(0),
+			WithHandler(adminHandler),
+			WithLogger(logger.With("server", "admin")),
+			gauge("admin"),
+		), lc))
+	}
+	listeners("admin")
+	listeners("grpc")
+	if cfg.GRPC.Port != 0 {
+		// Appended before the HTTP server so that it stops after it, once
+		// the shutdown delay has taken the instance out of rotation.
+		lc.Append(ServerHook("grpc", NewServer(
+			WithConfig(cfg),
+			WithPort(cfg.GRPC.Port),
+			WithRedirectPort(0),
+			WithShutdownDelay(0),
+			WithH2C(),
+			WithHandler(grpcHandler),
+			WithLogger(logger.With("server", "grpc")),
+			gauge("grpc"),
+		), lc))
+	}
+	// Like the gRPC servers, the extra API listeners stop after the main
+	// one has waited out the shutdown delay.
+	listeners("api")
+	lc.Append(ServerHook("http", srv, lc))
+	// Stopped before the HTTP server, so streaming clients are told the
+	// server is going away instead of having their connections cut.
+	lc.Append(Hook{Name: "events", OnStop: hub.Close})
+
+	return &app{lc: lc, router: rt, grpc: grpcSrv, perms: perms, middleware: global}, nil
+}
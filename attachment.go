@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Attachment is a file attached to a pebble. Its content is kept in a
+// BlobStore under the key returned by blobKey; ContentType is the media
+// type sniffed from the content, not the one the client claimed.
+type Attachment struct {
+	ID          string    `json:"id"`
+	PebbleID    string    `json:"pebble_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (a Attachment) blobKey() string {
+	return "pebbles/" + a.PebbleID + "/" + a.ID
+}
+
+// AttachmentStore keeps the metadata of attachments. GetAttachment and
+// DeleteAttachment return ErrNotFound for unknown IDs. ListAttachments
+// returns the attachments of the given pebbles oldest first, so that those
+// of many pebbles can be loaded at once.
+type AttachmentStore interface {
+	CreateAttachment(ctx context.Context, a Attachment) error
+	ListAttachments(ctx context.Context, pebbleIDs ...string) ([]Attachment, error)
+	GetAttachment(ctx context.Context, id string) (Attachment, error)
+	DeleteAttachment(ctx context.Context, id string) error
+}
+
+// attachmentResponse is an attachment with a signed URL its content can
+// be downloaded from until URLExpiresAt without credentials.
+type attachmentResponse struct {
+	Attachment
+	DownloadURL  string    `json:"download_url"`
+	URLExpiresAt time.Time `json:"url_expires_at"`
+}
+
+// multipartOverhead is how much longer than the file a multipart upload
+// body may be, for its boundaries and part headers.
+const multipartOverhead = 64 << 10
+
+// errAttachmentTooLarge stops an upload once it is over the limit.
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+// attachmentsAPI serves the attachments of pebbles and their signed
+// downloads.
+type attachmentsAPI struct {
+	svc          *PebbleService
+	store        AttachmentStore
+	blobs        BlobStore
+	logger       *slog.Logger
+	maxBytes     int64
+	contentTypes []string
+	signingKey   []byte
+	urlTTL       time.Duration
+	now          func() time.Time
+}
+
+func newAttachmentsAPI(cfg AttachmentsConfig, svc *PebbleService, store AttachmentStore, blobs BlobStore, clock Clock, logger *slog.Logger) *attachmentsAPI {
+	return &attachmentsAPI{
+		svc:          svc,
+		store:        store,
+		blobs:        blobs,
+		logger:       logger,
+		maxBytes:     cfg.MaxBytes,
+		contentTypes: cfg.ContentTypes,
+		signingKey:   []byte(cfg.SigningKey),
+		urlTTL:       cfg.URLTTL.Duration,
+		now:          clock.Now,
+	}
+}
+
+func (api *attachmentsAPI) register(rt *Router) {
+	rt.Get("/pebbles/{id}/attachments", api.list)
+	rt.Post("/pebbles/{id}/attachments", api.upload)
+	rt.Get("/pebbles/{id}/attachments/{attachment_id}", api.get)
+	rt.Delete("/pebbles/{id}/attachments/{attachment_id}", api.delete)
+	rt.Get("/attachments/{attachment_id}/content", api.download)
+
+	rt.Document("GET", "/pebbles/{id}/attachments", Operation{Summary: "List the attachments of a pebble", Tag: "attachments", Response: listResponse[attachmentResponse]{}})
+	rt.Document("POST", "/pebbles/{id}/attachments", Operation{Summary: "Upload an attachment, as multipart/form-data or as the raw body", Tag: "attachments", Response: attachmentResponse{}, Status: http.StatusCreated})
+	rt.Document("GET", "/pebbles/{id}/attachments/{attachment_id}", Operation{Summary: "Fetch an attachment with a fresh download URL", Tag: "attachments", Response: attachmentResponse{}})
+	rt.Document("DELETE", "/pebbles/{id}/attachments/{attachment_id}", Operation{Summary: "Delete an attachment", Tag: "attachments", Status: http.StatusNoContent})
+	rt.Document("GET", "/attachments/{attachment_id}/content", Operation{Summary: "Download an attachment, or a byte range of it, through its signed URL", Tag: "attachments"})
+}
+
+// uploadLimit is the body size limit of the upload route.
+func (api *attachmentsAPI) uploadLimit() int64 {
+	return api.maxBytes + multipartOverhead
+}
+
+// signature returns the signature of a download URL for attachment id
+// that expires at the given Unix time.
+func (api *attachmentsAPI) signature(id string, expires int64) string {
+	return hex.EncodeToString(hmacSHA256(api.signingKey, id+"."+strconv.FormatInt(expires, 10)))
+}
+
+func (api *attachmentsAPI) response(ctx context.Context, a Attachment) attachmentResponse {
+	expires := api.now().Add(api.urlTTL).Truncate(time.Second).UTC()
+	u := fmt.Sprintf("%s?expires=%d&signature=%s", APIPath(ctx, "/attachments/"+a.ID+"/content"), expires.Unix(), api.signature(a.ID, expires.Unix()))
+	return attachmentResponse{Attachment: a, DownloadURL: u, URLExpiresAt: expires}
+}
+
+// pebble checks that the pebble of the request exists and returns its ID.
+func (api *attachmentsAPI) pebble(r *http.Request) (string, error) {
+	id, err := PathUUID(r, "id")
+	if err != nil {
+		return "", err
+	}
+	if _, err := api.svc.Get(r.Context(), id, false); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// attachment returns the attachment of the request, which must belong to
+// its pebble.
+func (api *attachmentsAPI) attachment(r *http.Request) (Attachment, error) {
+	pebbleID, err := api.pebble(r)
+	if err != nil {
+		return Attachment{}, err
+	}
+	id, err := PathUUID(r, "attachment_id")
+	if err != nil {
+		return Attachment{}, err
+	}
+	a, err := api.store.GetAttachment(r.Context(), id)
+	if errors.Is(err, ErrNotFound) || err == nil && a.PebbleID != pebbleID {
+		return Attachment{}, NotFound("attachment not found")
+	}
+	if err != nil {
+		return Attachment{}, Internal(err)
+	}
+	return a, nil
+}
+
+func (api *attachmentsAPI) list(w http.ResponseWriter, r *http.Request) error {
+	pebbleID, err := api.pebble(r)
+	if err != nil {
+		return err
+	}
+	list, err := api.store.ListAttachments(r.Context(), pebbleID)
+	if err != nil {
+		return Internal(err)
+	}
+	items := make([]attachmentResponse, len(list))
+	for i, a := range list {
+		items[i] = api.response(r.Context(), a)
+	}
+	respond(w, r, http.StatusOK, listResponse[attachmentResponse]{Items: items})
+	return nil
+}
+
+func (api *attachmentsAPI) get(w http.ResponseWriter, r *http.Request) error {
+	a, err := api.attachment(r)
+	if err != nil {
+		return err
+	}
+	respond(w, r, http.StatusOK, api.response(r.Context(), a))
+	return nil
+}
+
+// upload stores the file sent as the file part of a multipart/form-data
+// body, or as the whole body with its name in the filename parameter or a
+// Content-Disposition header. The content is streamed to the blob store,
+// and its type is sniffed from its first bytes.
+func (api *attachmentsAPI) upload(w http.ResponseWriter, r *http.Request) error {
+	pebbleID, err := api.pebble(r)
+	if err != nil {
+		return err
+	}
+	src, filename, size, err := uploadSource(r)
+	if err != nil {
+		return err
+	}
+	if filename = cleanFilename(filename); filename == "" {
+		return ValidationErrors{{Field: "filename", Message: "is required"}}.apiError()
+	}
+	if size > api.maxBytes {
+		return api.tooLarge()
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return bodyError(err)
+	}
+	if n == 0 {
+		return Invalid(nil, "the file is empty")
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !slices.Contains(api.contentTypes, contentType) {
+		return NewAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+			fmt.Sprintf("the file is %s, but attachments must be one of %s", contentType, strings.Join(api.contentTypes, ", ")))
+	}
+
+	a := Attachment{ID: newUUID(), PebbleID: pebbleID, Filename: filename, ContentType: contentType, CreatedAt: api.now().UTC()}
+	body := &uploadReader{r: io.MultiReader(bytes.NewReader(head[:n]), src), max: api.maxBytes, hash: sha256.New()}
+	if err := api.blobs.Put(r.Context(), a.blobKey(), body, size, contentType); err != nil {
+		if errors.Is(err, errAttachmentTooLarge) {
+			return api.tooLarge()
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return bodyError(err)
+		}
+		return Internal(fmt.Errorf("cannot store attachment: %w", err))
+	}
+	a.Size = body.n
+	a.SHA256 = hex.EncodeToString(body.hash.Sum(nil))
+	if err := api.store.CreateAttachment(r.Context(), a); err != nil {
+		api.removeBlob(r.Context(), a)
+		return Internal(err)
+	}
+	w.Header().Set("Location", APIPath(r.Context(), "/pebbles/"+pebbleID+"/attachments/"+a.ID))
+	respond(w, r, http.StatusCreated, api.response(r.Context(), a))
+	return nil
+}
+
+func (api *attachmentsAPI) tooLarge() *APIError {
+	return NewAPIError(http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("attachments must be at most %d bytes", api.maxBytes))
+}
+
+// uploadSource returns the file of an upload request, its name and its
+// size, or -1 if it is not known before reading it.
+func uploadSource(r *http.Request) (io.Reader, string, int64, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		filename := r.URL.Query().Get("filename")
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil && filename == "" {
+			filename = params["filename"]
+		}
+		return r.Body, filename, r.ContentLength, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", 0, Invalid(nil, "invalid multipart body: %v", err)
+	}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, "", 0, ValidationErrors{{Field: "file", Message: "is required"}}.apiError()
+		}
+		if err != nil {
+			return nil, "", 0, bodyError(err)
+		}
+		if part.FormName() == "file" {
+			return part, part.FileName(), -1, nil
+		}
+	}
+}
+
+// cleanFilename keeps the last element of a client's file name, without
+// control characters, and at most 255 bytes of it.
+func cleanFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// uploadReader counts and hashes an upload as it is read, and fails once
+// it is longer than max.
+type uploadReader struct {
+	r    io.Reader
+	n    int64
+	max  int64
+	hash hash.Hash
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.n += int64(n)
+	u.hash.Write(p[:n])
+	if u.n > u.max {
+		return n, errAttachmentTooLarge
+	}
+	return n, err
+}
+
+func (api *attachmentsAPI) delete(w http.ResponseWriter, r *http.Request) error {
+	a, err := api.attachment(r)
+	if err != nil {
+		return err
+	}
+	if err := api.store.DeleteAttachment(r.Context(), a.ID); err != nil && !errors.Is(err, ErrNotFound) {
+		return Internal(err)
+	}
+	api.removeBlob(r.Context(), a)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// removeBlob deletes the content of a, logging a failure, which leaves an
+// unreferenced blob behind but no broken attachment.
+func (api *attachmentsAPI) removeBlob(ctx context.Context, a Attachment) {
+	if err := api.blobs.Delete(context.WithoutCancel(ctx), a.blobKey()); err != nil {
+		api.logger.WarnContext(ctx, "cannot delete attachment content", "attachment_id", a.ID, "error", err)
+	}
+}
+
+// removeAll deletes the attachments of pebble id, for when it is purged.
+func (api *attachmentsAPI) removeAll(ctx context.Context, pebbleID string) {
+	list, err := api.store.ListAttachments(ctx, pebbleID)
+	if err != nil {
+		api.logger.ErrorContext(ctx, "cannot list attachments of purged pebble", "pebble_id", pebbleID, "error", err)
+		return
+	}
+	for _, a := range list {
+		if err := api.store.DeleteAttachment(ctx, a.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			api.logger.ErrorContext(ctx, "cannot delete attachment of purged pebble", "attachment_id", a.ID, "error", err)
+			continue
+		}
+		api.removeBlob(ctx, a)
+	}
+}
+
+// download serves the content of an attachment to whoever has a signed
+// URL for it that has not expired. It serves the byte range a request
+// asks for, so that an interrupted download can be resumed, and a HEAD
+// request gets the size and ETag without the content.
+func (api *attachmentsAPI) download(w http.ResponseWriter, r *http.Request) error {
+	id := r.PathValue("attachment_id")
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || api.now().Unix() > expires ||
+		!hmac.Equal([]byte(q.Get("signature")), []byte(api.signature(id, expires))) {
+		return Forbidden("the download URL is invalid or has expired")
+	}
+	a, err := api.store.GetAttachment(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		return NotFound("attachment not found")
+	}
+	if err != nil {
+		return Internal(err)
+	}
+	etag := `"` + a.SHA256 + `"`
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "private, no-store")
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	rng, partial, err := requestRange(r, a.Size, etag)
+	if err != nil {
+		h.Set("Content-Range", unsatisfiableRange(a.Size))
+		return err
+	}
+	status, length := http.StatusOK, a.Size
+	if partial {
+		status, length = http.StatusPartialContent, rng.length
+	}
+	var content io.ReadCloser = http.NoBody
+	if r.Method != http.MethodHead {
+		if partial {
+			content, err = api.blobs.GetRange(r.Context(), a.blobKey(), rng.start, rng.length)
+		} else {
+			content, err = api.blobs.Get(r.Context(), a.blobKey())
+		}
+		if err != nil {
+			return Internal(fmt.Errorf("cannot read attachment content: %w", err))
+		}
+	}
+	defer content.Close()
+	if partial {
+		h.Set("Content-Range", rng.contentRange(a.Size))
+	}
+	h.Set("Content-Type", a.ContentType)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, content); err != nil {
+		api.logger.WarnContext(r.Context(), "cannot send attachment content", "attachment_id", a.ID, "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a request that changed something: who made it, to
+// what, when and with what result, and for pebbles the fields it changed.
+// Actor is the subject of the caller's credentials, or empty if it sent
+// none.
+type AuditEntry struct {
+	ID        string                 `json:"id"`
+	Time      time.Time              `json:"time"`
+	RequestID string                 `json:"request_id"`
+	Actor     string                 `json:"actor"`
+	Method    string                 `json:"method"`
+	Resource  string                 `json:"resource"`
+	Status    int                    `json:"status"`
+	Changes   map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange is the value of a field before and after a change, null on
+// the side where the resource did not exist.
+type AuditChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// AuditQuery selects audit entries: those by Actor and to Resource if they
+// are set, made at or after Since and before Until if they are set, at
+// most Limit of them.
+type AuditQuery struct {
+	Actor    string
+	Resource string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// AuditStore keeps the audit log. Entries are only ever appended, never
+// changed or removed. ListAuditEntries returns the newest entries first.
+type AuditStore interface {
+	AppendAuditEntry(ctx context.Context, e AuditEntry) error
+	ListAuditEntries(ctx context.Context, q AuditQuery) ([]AuditEntry, error)
+}
+
+type auditRecordKey struct{}
+
+// auditRecord collects the changes made while serving a request, for its
+// audit entry.
+type auditRecord struct {
+	mu      sync.Mutex
+	changes map[string]AuditChange
+}
+
+func auditRecordFromContext(ctx context.Context) *auditRecord {
+	rec, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return rec
+}
+
+// add records the fields that differ between before and after, either of
+// which is nil if the resource did not exist on that side.
+func (rec *auditRecord) add(before, after any) {
+	b, a := auditFields(before), auditFields(after)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.changes == nil {
+		rec.changes = make(map[string]AuditChange)
+	}
+	for name, v := range b {
+		if !reflect.DeepEqual(v, a[name]) {
+			rec.changes[name] = AuditChange{Before: v, After: a[name]}
+		}
+	}
+	for name, v := range a {
+		if _, ok := b[name]; !ok {
+			rec.changes[name] = AuditChange{After: v}
+		}
+	}
+}
+
+// auditFields returns the JSON fields of v, which is nil or a pointer to a
+// struct.
+func auditFields(v any) map[string]any {
+	if reflect.ValueOf(v).IsNil() {
+		return nil
+	}
+	b, _ := json.Marshal(v)
+	var fields map[string]any
+	json.Unmarshal(b, &fields)
+	return fields
+}
+
+// Audit appends an entry to store for every POST, PUT, PATCH and DELETE
+// request once it has been served. It must run inside Authenticate for
+// entries to name the caller, and inside Timeout so that the entry is
+// written once the handler is done rather than when the client is told it
+// took too long. Requests refused before reaching it are not audited; the
+// request log records them. If the store fails the error is logged.
+// Entries are timed by clock.
+func Audit(store AuditStore, clock Clock, logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			default:
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := clock.Now().UTC()
+			rec := &auditRecord{}
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, rec)))
+
+			e := AuditEntry{
+				ID:        newUUID(),
+				Time:      start,
+				RequestID: RequestIDFromContext(r.Context()),
+				Method:    r.Method,
+				Resource:  BasePath(r.Context()) + r.URL.Path,
+				Status:    rw.status,
+			}
+			if c := ClaimsFromContext(r.Context()); c != nil {
+				e.Actor = c.Subject
+			}
+			rec.mu.Lock()
+			e.Changes = rec.changes
+			rec.mu.Unlock()
+			if err := store.AppendAuditEntry(context.WithoutCancel(r.Context()), e); err != nil {
+				logger.ErrorContext(r.Context(), "cannot write audit entry", "method", e.Method, "resource", e.Resource, "error", err)
+			}
+		})
+	}
+}
+
+// auditingStore records the pebble changes made while serving a request
+// in its audit entry. Updates and deletes read the pebble first, which the
+// cache, if there is one, usually answers.
+type auditingStore struct {
+	Store
+}
+
+func (s auditingStore) Create(ctx context.Context, p Pebble) error {
+	if err := s.Store.Create(ctx, p); err != nil {
+		return err
+	}
+	if rec := auditRecordFromContext(ctx); rec != nil {
+		afterCommit(ctx, func() { rec.add((*Pebble)(nil), &p) })
+	}
+	return nil
+}
+
+func (s auditingStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	rec := auditRecordFromContext(ctx)
+	if rec == nil {
+		return s.Store.Update(ctx, p, prev)
+	}
+	before, err := s.Store.Get(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Update(ctx, p, prev); err != nil {
+		return err
+	}
+	afterCommit(ctx, func() { rec.add(&before, &p) })
+	return nil
+}
+
+func (s auditingStore) Delete(ctx context.Context, id string, at time.Time) error {
+	rec := auditRecordFromContext(ctx)
+	if rec == nil {
+		return s.Store.Delete(ctx, id, at)
+	}
+	before, err := s.Store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Delete(ctx, id, at); err != nil {
+		return err
+	}
+	after := before
+	after.DeletedAt = &at
+	afterCommit(ctx, func() { rec.add(&before, &after) })
+	return nil
+}
+
+func (s auditingStore) Restore(ctx context.Context, id string) error {
+	rec := auditRecordFromContext(ctx)
+	if rec == nil {
+		return s.Store.Restore(ctx, id)
+	}
+	before, err := s.Store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Restore(ctx, id); err != nil {
+		return err
+	}
+	after := before
+	after.DeletedAt = nil
+	afterCommit(ctx, func() { rec.add(&before, &after) })
+	return nil
+}
+
+// AuditHandler serves the admin endpoint listing audit entries, newest
+// first, filtered by the actor, resource, since and until parameters.
+func AuditHandler(store AuditStore) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		q := AuditQuery{Limit: 50}
+		var errs ValidationErrors
+		for name, vs := range r.URL.Query() {
+			switch v := vs[0]; name {
+			case "actor":
+				q.Actor = v
+			case "resource":
+				q.Resource = v
+			case "since", "until":
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					errs = append(errs, FieldError{Field: name, Message: "must be an RFC 3339 time"})
+				}
+				if name == "since" {
+					q.Since = t
+				} else {
+					q.Until = t
+				}
+			case "limit":
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 || n > 500 {
+					errs = append(errs, FieldError{Field: "limit", Message: "must be a number from 1 to 500"})
+				}
+				q.Limit = n
+			default:
+				errs = append(errs, FieldError{Field: name, Message: "is not a known parameter"})
+			}
+		}
+		if errs != nil {
+			return Invalid(errs, "invalid list parameters")
+		}
+		list, err := store.ListAuditEntries(r.Context(), q)
+		if err != nil {
+			return Internal(err)
+		}
+		respond(w, r, http.StatusOK, listResponse[AuditEntry]{Items: list})
+		return nil
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+)
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims of the authenticated caller, or nil
+// if the request was not authenticated.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	c, _ := ctx.Value(claimsKey{}).(*Claims)
+	return c
+}
+
+func contextWithClaims(ctx context.Context, c *Claims) context.Context {
+	setAccessUser(ctx, c.Subject)
+	return context.WithValue(ctx, claimsKey{}, c)
+}
+
+func Unauthorized(message string) *APIError {
+	return NewAPIError(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+func Forbidden(format string, args ...any) *APIError {
+	return NewAPIError(http.StatusForbidden, CodeForbidden, fmt.Sprintf(format, args...))
+}
+
+// Authenticator turns the credentials carried by a request into claims. It
+// returns (nil, nil) when the request carries no credentials, and an
+// *APIError, usually from Unauthorized, when they are not valid; any other
+// error means they could not be checked, such as when the store of API
+// keys fails. Challenge is sent in the WWW-Authenticate header of 401
+// responses.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Claims, error)
+	Challenge() string
+}
+
+// bearerAuth authenticates requests with a JWT in the Authorization header.
+type bearerAuth struct {
+	verifier *JWTVerifier
+}
+
+func (a bearerAuth) Authenticate(r *http.Request) (*Claims, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return nil, nil
+	}
+	scheme, token, ok := strings.Cut(h, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, Unauthorized("authorization header must use the Bearer scheme")
+	}
+	claims, err := a.verifier.Verify(strings.TrimSpace(token))
+	if err != nil {
+		return nil, Unauthorized(err.Error())
+	}
+	return claims, nil
+}
+
+func (a bearerAuth) Challenge() string {
+	return "Bearer"
+}
+
+// firstAuth authenticates a request with the first of its Authenticators
+// whose credentials it carries.
+type firstAuth []Authenticator
+
+func (a firstAuth) Authenticate(r *http.Request) (*Claims, error) {
+	for _, auth := range a {
+		if claims, err := auth.Authenticate(r); claims != nil || err != nil {
+			return claims, err
+		}
+	}
+	return nil, nil
+}
+
+// Challenge lists the challenges of the Authenticators that have one.
+func (a firstAuth) Challenge() string {
+	var challenges []string
+	for _, auth := range a {
+		if c := auth.Challenge(); c != "" {
+			challenges = append(challenges, c)
+		}
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// Authenticate puts the claims of requests with valid credentials in the
+// request context. Requests with invalid credentials get the error of the
+// Authenticator, a 401 with the challenge for most, and those whose
+// credentials cannot be checked a 503, as authFailure says; requests
+// without credentials pass through unauthenticated, and Authorize decides
+// whether the route needs a caller.
+func Authenticate(a Authenticator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, err := a.Authenticate(r)
+			if err != nil {
+				apiErr := authFailure(err)
+				if c := a.Challenge(); c != "" && apiErr.Status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", c)
+				}
+				WriteError(w, r, apiErr)
+				return
+			}
+			if claims != nil {
+				r = r.WithContext(contextWithClaims(r.Context(), claims))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authFailure returns the error response for an error of an
+// Authenticator: the *APIError of invalid credentials as it is, and for any
+// other error, which only means they could not be checked, a 503 or 504
+// whose cause is logged rather than shown to the client.
+func authFailure(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	e := Internal(err)
+	if e.Status == http.StatusInternalServerError {
+		e = NewAPIError(http.StatusServiceUnavailable, CodeUnavailable, "the credentials cannot be checked now")
+		e.Err = err
+	}
+	return e
+}
+
+// newJWTVerifier builds a verifier using a JWKS URL or, for local
+// development, an HS256 shared secret, which checks the times of tokens
+// against clock.
+func newJWTVerifier(cfg JWTConfig, keys *jwkSet, clock Clock) *JWTVerifier {
+	v := &JWTVerifier{
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		leeway:   cfg.Leeway.Duration,
+		now:      clock.Now,
+	}
+	if keys != nil {
+		v.keys = keys.Key
+	} else {
+		secret := []byte(cfg.Secret)
+		v.keys = func(alg, kid string) (any, error) {
+			if alg != "HS256" {
+				return nil, errors.New("only HS256 tokens are accepted with a shared secret")
+			}
+			return secret, nil
+		}
+	}
+	return v
+}
+
+// setupAuth returns the middleware that authenticates requests and enforces
+// perms, as selected by cfg.Mode, and the Authenticator it uses, which is
+// nil in mode none. Background components are added to lc and, in api_key
+// mode, the key management endpoints to rt. A JWKS URL is waited for as
+// startup says and refreshed by scheduler. With OIDC, whose sessions are
+// kept in sessions, the login and session endpoints are added to rt and
+// session cookies authenticate requests too, in mode none without
+// enforcing anything.
+func setupAuth(cfg AuthConfig, startup StartupConfig, store APIKeyStore, sessions SessionStore, rt *Router, perms map[string]Permission, clock Clock, logger *slog.Logger, lc *Lifecycle, health *Health, scheduler *Scheduler) (Middleware, Authenticator) {
+	var manager *sessionManager
+	if cfg.OIDC.Enabled {
+		login := newOIDCLogin(cfg.OIDC, sessions, clock, logger)
+		login.register(rt)
+		(&sessionsAPI{store: sessions}).register(rt)
+		manager = login.sessions
+	}
+	var a Authenticator
+	switch cfg.Mode {
+	case "none":
+		if manager != nil {
+			return func(h http.Handler) http.Handler {
+				return Chain(h, manager.Middleware(), Authenticate(manager))
+			}, nil
+		}
+		return func(h http.Handler) http.Handler { return h }, nil
+	case "api_key":
+		a = firstAuth{apiKeyAuth{store: store}, newSignedRequestAuth(store, cfg.APIKey.ClockSkew.Duration, clock)}
+		if key := cfg.APIKey.BootstrapKey; key != "" {
+			lc.Append(Hook{
+				Name:    "bootstrap api key",
+				OnStart: func(ctx context.Context) error { return bootstrapAPIKey(ctx, store, key, clock) },
+			})
+		}
+		keysAPI := &apiKeysAPI{store: store, clock: clock}
+		keysAPI.register(rt)
+	case "jwt":
+		var keys *jwkSet
+		if cfg.JWT.JWKSURL != "" {
+			keys = newJWKSet(cfg.JWT.JWKSURL, clock, logger)
+			health.Register("jwks", keys)
+			// The first load is waited for or, without a wait, made in the
+			// background; the scheduler refreshes them from then on.
+			lc.Append(Hook{
+				Name: "jwks",
+				OnStart: func(ctx context.Context) error {
+					if startup.WaitTimeout.Duration > 0 {
+						return waitForDependency(ctx, startup, logger, "jwks", keys.refresh)
+					}
+					go keys.load()
+					return nil
+				},
+			})
+			scheduler.Add(jobJWKSRefresh, "@every "+cfg.JWT.RefreshInterval.String(), keys.refresh)
+		}
+		a = bearerAuth{newJWTVerifier(cfg.JWT, keys, clock)}
+	}
+	if manager == nil {
+		authorize := Authorize(perms, rt, a.Challenge())
+		return func(h http.Handler) http.Handler {
+			return Chain(h, Authenticate(a), authorize)
+		}, a
+	}
+	a = firstAuth{a, manager}
+	authorize := Authorize(perms, rt, a.Challenge())
+	return func(h http.Handler) http.Handler {
+		return Chain(h, manager.Middleware(), Authenticate(a), authorize)
+	}, a
+}
+
+// runToken implements the token command, which prints an HS256 token
+// signed with the configured shared secret for local development.
+func runToken(cfg Config, args []string) error {
+	if cfg.Auth.JWT.Secret == "" {
+		return errors.New("token requires auth.jwt.secret to be set")
+	}
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	sub := fs.String("sub", "dev", "subject of the token")
+	scope := fs.String("scope", "", "space separated scopes")
+	ttl := fs.Duration("ttl", time.Hour, "how long the token is valid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	now := time.Now()
+	claims := map[string]any{
+		"sub": *sub,
+		"iat": now.Unix(),
+		"exp": now.Add(*ttl).Unix(),
+	}
+	if *scope != "" {
+		claims["scope"] = *scope
+	}
+	if cfg.Auth.JWT.Issuer != "" {
+		claims["iss"] = cfg.Auth.JWT.Issuer
+	}
+	if cfg.Auth.JWT.Audience != "" {
+		claims["aud"] = cfg.Auth.JWT.Audience
+	}
+	token, err := signHS256([]byte(cfg.Auth.JWT.Secret), claims)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// failingKeyStore is an APIKeyStore whose lookups fail with err.
+type failingKeyStore struct {
+	*memoryStore
+	err error
+}
+
+func (s failingKeyStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	return APIKey{}, s.err
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	const key = "pbl_0123456789abcdef"
+	store := newMemoryStore()
+	if err := bootstrapAPIKey(context.Background(), store, key, systemClock{}); err != nil {
+		t.Fatal(err)
+	}
+	dbErr := errors.New("dial tcp 10.0.0.7:5432: connection refused")
+
+	tests := []struct {
+		name      string
+		store     APIKeyStore
+		key       string
+		want      int
+		challenge bool
+		message   string
+	}{
+		{name: "valid key", store: store, key: key, want: http.StatusNoContent},
+		{name: "unknown key", store: store, key: "pbl_unknown", want: http.StatusUnauthorized, challenge: true, message: "unknown API key"},
+		{name: "store failing", store: failingKeyStore{store, dbErr}, key: key, want: http.StatusServiceUnavailable, message: "the credentials cannot be checked now"},
+		{name: "store timing out", store: failingKeyStore{store, context.DeadlineExceeded}, key: key, want: http.StatusGatewayTimeout, message: "request timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+			h := Authenticate(apiKeyAuth{store: tt.store})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/pebbles", nil)
+			r.Header.Set(apiKeyHeader, tt.key)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d; body: %s", w.Code, tt.want, w.Body)
+			}
+			if got := w.Header().Get("WWW-Authenticate") != ""; got != tt.challenge {
+				t.Errorf("got a WWW-Authenticate header %t, want %t", got, tt.challenge)
+			}
+			if !strings.Contains(w.Body.String(), tt.message) {
+				t.Errorf("the body does not say %q: %s", tt.message, w.Body)
+			}
+			if strings.Contains(w.Body.String(), "10.0.0.7") {
+				t.Errorf("the body reveals the store error: %s", w.Body)
+			}
+			if tt.want == http.StatusServiceUnavailable && !strings.Contains(logs.String(), dbErr.Error()) {
+				t.Errorf("the store error was not logged: %s", logs.String())
+			}
+		})
+	}
+}
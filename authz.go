@@ -0,0 +1,154 @@
+package main
+
+import "net/http"
+
+// Permission is an action a caller may be allowed to perform.
+type Permission string
+
+const (
+	PermPebblesRead    Permission = "pebbles:read"
+	PermPebblesWrite   Permission = "pebbles:write"
+	PermAPIKeysManage  Permission = "api_keys:manage"
+	PermJobsRead       Permission = "jobs:read"
+	PermWebhooksManage Permission = "webhooks:manage"
+	PermHTTPCachePurge Permission = "http_cache:purge"
+	PermMaintenance    Permission = "maintenance:manage"
+	PermAuditRead      Permission = "audit:read"
+	PermPebblesAdmin   Permission = "pebbles:admin"
+	PermProxy          Permission = "proxy:access"
+	PermConfigRead     Permission = "config:read"
+	PermConfigManage   Permission = "config:manage"
+	PermSessionsManage Permission = "sessions:manage"
+)
+
+// routePermissions is the permission each route requires, keyed by its
+// router pattern. gRPC methods are keyed by the POST request that carries
+// them. Routes that are not listed are public. Each app adds the routes of
+// its configuration to a copy.
+var routePermissions = map[string]Permission{
+	"GET /pebbles":         PermPebblesRead,
+	"GET /pebbles/{id}":    PermPebblesRead,
+	"GET /pebbles/search":  PermPebblesRead,
+	"GET /pebbles/export":  PermPebblesRead,
+	"POST /pebbles":        PermPebblesWrite,
+	"PUT /pebbles/{id}":    PermPebblesWrite,
+	"PATCH /pebbles/{id}":  PermPebblesWrite,
+	"DELETE /pebbles/{id}": PermPebblesWrite,
+	"POST /pebbles/{id}":   PermPebblesAdmin,
+	"POST /pebbles:batch":  PermPebblesWrite,
+	"POST /pebbles/import": PermPebblesWrite,
+
+	"GET /pebbles/{id}/attachments":                    PermPebblesRead,
+	"POST /pebbles/{id}/attachments":                   PermPebblesWrite,
+	"GET /pebbles/{id}/attachments/{attachment_id}":    PermPebblesRead,
+	"DELETE /pebbles/{id}/attachments/{attachment_id}": PermPebblesWrite,
+
+	"GET /graphql":        PermPebblesRead,
+	"POST /graphql":       PermPebblesRead,
+	"GET /graphql/schema": PermPebblesRead,
+
+	"GET /ws":              PermPebblesRead,
+	"GET /events":          PermPebblesRead,
+	"GET /pebbles/changes": PermPebblesRead,
+
+	"POST /pebbles.v1.PebbleService/ListPebbles":   PermPebblesRead,
+	"POST /pebbles.v1.PebbleService/GetPebble":     PermPebblesRead,
+	"POST /pebbles.v1.PebbleService/CreatePebble":  PermPebblesWrite,
+	"POST /pebbles.v1.PebbleService/ReplacePebble": PermPebblesWrite,
+	"POST /pebbles.v1.PebbleService/UpdatePebble":  PermPebblesWrite,
+	"POST /pebbles.v1.PebbleService/DeletePebble":  PermPebblesWrite,
+
+	"GET /admin/api-keys":              PermAPIKeysManage,
+	"POST /admin/api-keys":             PermAPIKeysManage,
+	"DELETE /admin/api-keys/{id}":      PermAPIKeysManage,
+	"GET /admin/jobs":                  PermJobsRead,
+	"GET /admin/scheduler":             PermJobsRead,
+	"POST /admin/snapshot":             PermSnapshot,
+	"DELETE /admin/sessions/{subject}": PermSessionsManage,
+	"GET /admin/circuit-breakers":      PermBreakersRead,
+	"GET /admin/slo":                   PermSLORead,
+
+	"GET /webhooks":                       PermWebhooksManage,
+	"POST /webhooks":                      PermWebhooksManage,
+	"DELETE /webhooks/{id}":               PermWebhooksManage,
+	"GET /admin/webhooks/{id}/deliveries": PermWebhooksManage,
+	"DELETE /admin/http-cache":            PermHTTPCachePurge,
+	"GET /admin/maintenance":              PermMaintenance,
+	"PUT /admin/maintenance":              PermMaintenance,
+	"GET /admin/audit":                    PermAuditRead,
+	"GET /admin/routes":                   PermConfigRead,
+	"GET /admin/config":                   PermConfigRead,
+	"GET /admin/log-level":                PermConfigRead,
+	"PUT /admin/log-level":                PermConfigManage,
+	"GET /admin/flags":                    PermConfigRead,
+	"PUT /admin/flags/{name}":             PermConfigManage,
+	"DELETE /admin/flags/{name}":          PermConfigManage,
+	"GET /admin/chaos":                    PermConfigRead,
+	"PUT /admin/chaos":                    PermConfigManage,
+	"DELETE /admin/chaos":                 PermConfigManage,
+}
+
+// graphqlPermissions is the permission each GraphQL field requires, keyed
+// as Type.field, on top of the pebbles:read that /graphql requires.
+var graphqlPermissions = map[string]Permission{
+	"Mutation.createPebble":  PermPebblesWrite,
+	"Mutation.replacePebble": PermPebblesWrite,
+	"Mutation.updatePebble":  PermPebblesWrite,
+	"Mutation.deletePebble":  PermPebblesWrite,
+	"Mutation.restorePebble": PermPebblesAdmin,
+}
+
+const roleAdmin = "admin"
+
+// rolePermissions lists the permissions granted by role scopes. Any other
+// scope grants the permission of the same name.
+var rolePermissions = map[string][]Permission{
+	"reader":  {PermPebblesRead},
+	"editor":  {PermPebblesRead, PermPebblesWrite},
+	roleAdmin: {PermPebblesRead, PermPebblesWrite, PermAPIKeysManage, PermJobsRead, PermWebhooksManage, PermHTTPCachePurge, PermMaintenance, PermAuditRead, PermPebblesAdmin, PermProxy, PermTenantsAny, PermBreakersRead, PermSLORead, PermConfigRead, PermConfigManage, PermSessionsManage, PermSnapshot},
+}
+
+// hasPermission reports whether the scopes in c grant p.
+func hasPermission(c *Claims, p Permission) bool {
+	for _, s := range c.Scopes {
+		if Permission(s) == p {
+			return true
+		}
+		for _, granted := range rolePermissions[s] {
+			if granted == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorize enforces perms for the route pattern that routes resolves for
+// each request. Callers without credentials get a 401 response asking for
+// them with challenge, and callers lacking the permission get a 403
+// response naming it. It must run after Authenticate.
+func Authorize(perms map[string]Permission, routes routeMatcher, challenge string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pattern := routes.Handler(r)
+			perm, ok := perms[pattern]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			claims := ClaimsFromContext(r.Context())
+			if claims == nil {
+				w.Header().Set("WWW-Authenticate", challenge)
+				WriteError(w, r, Unauthorized("authentication required"))
+				return
+			}
+			if !hasPermission(claims, perm) {
+				err := Forbidden("missing permission %q", perm)
+				err.Details = []string{"required permission: " + string(perm)}
+				WriteError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+const CodeBatchAborted = "batch_aborted"
+
+// BatchOperation is one operation of a batch: create, replace, update or
+// delete. All but create name the pebble by ID and send its ETag in
+// IfMatch, and all but delete send a Body with the fields the
+// single-pebble endpoints take. Body is decoded as a partial update so
+// that it can be in any request format; create and replace still require
+// every field they would.
+type BatchOperation struct {
+	Method  string       `json:"method" validate:"required,oneof=create replace update delete"`
+	ID      string       `json:"id"`
+	IfMatch string       `json:"if_match"`
+	Body    *pebblePatch `json:"body"`
+}
+
+// BatchResult is the outcome of one operation of a batch: the status the
+// single-pebble endpoint would have responded with, and the pebble with
+// its ETag or the error.
+type BatchResult struct {
+	Status int            `json:"status"`
+	Pebble *Pebble        `json:"pebble,omitempty"`
+	ETag   string         `json:"etag,omitempty"`
+	Error  *errorResponse `json:"error,omitempty"`
+}
+
+// errBatchAborted rolls back an atomic batch once an operation fails.
+var errBatchAborted = errors.New("batch operation failed")
+
+// Batch runs ops in order and returns their results. Without atomic each
+// operation stands on its own. With atomic they run in one transaction
+// that stops at the first failure, and then every other operation is
+// reported as aborted with a 424 status. The error is only set if the
+// transaction itself fails.
+func (s *PebbleService) Batch(ctx context.Context, ops []BatchOperation, atomic bool) ([]BatchResult, error) {
+	results := make([]BatchResult, len(ops))
+	if !atomic {
+		for i, op := range ops {
+			results[i] = s.batchOperation(ctx, op)
+		}
+		return results, nil
+	}
+	failed := -1
+	err := transact(ctx, s.store, func(ctx context.Context) error {
+		for i, op := range ops {
+			results[i] = s.batchOperation(ctx, op)
+			if results[i].Error != nil {
+				failed = i
+				return errBatchAborted
+			}
+		}
+		return nil
+	})
+	if !errors.Is(err, errBatchAborted) {
+		if err != nil {
+			return nil, storeError(err)
+		}
+		return results, nil
+	}
+	aborted := batchError(ctx, NewAPIError(http.StatusFailedDependency, CodeBatchAborted, "not applied because another operation of the batch failed"))
+	for i := range results {
+		if i != failed {
+			results[i] = aborted
+		}
+	}
+	return results, nil
+}
+
+// batchOperation runs op through the same rules as the single-pebble
+// endpoints.
+func (s *PebbleService) batchOperation(ctx context.Context, op BatchOperation) BatchResult {
+	if errs := Validate(op); errs != nil {
+		return batchError(ctx, errs.apiError())
+	}
+	if op.Method == "create" {
+		in, err := batchInput(op)
+		if err != nil {
+			return batchError(ctx, err)
+		}
+		p, err := s.Create(ctx, in)
+		return batchPebble(ctx, http.StatusCreated, p, err)
+	}
+	id, err := parseUUID(op.ID)
+	if err != nil {
+		return batchError(ctx, ValidationErrors{{Field: "id", Message: "must be a UUID"}}.apiError())
+	}
+	switch op.Method {
+	case "replace":
+		in, err := batchInput(op)
+		if err != nil {
+			return batchError(ctx, err)
+		}
+		p, err := s.Replace(ctx, id, in, op.IfMatch)
+		return batchPebble(ctx, http.StatusOK, p, err)
+	case "update":
+		if op.Body == nil {
+			return batchError(ctx, errBatchBodyRequired)
+		}
+		p, err := s.Update(ctx, id, *op.Body, op.IfMatch)
+		return batchPebble(ctx, http.StatusOK, p, err)
+	default:
+		if err := s.Delete(ctx, id, op.IfMatch); err != nil {
+			return batchError(ctx, err)
+		}
+		return BatchResult{Status: http.StatusNoContent}
+	}
+}
+
+var errBatchBodyRequired = ValidationErrors{{Field: "body", Message: "is required"}}.apiError()
+
+// batchInput returns the body of a create or replace operation as the
+// single-pebble endpoints take it, with the fields it leaves out empty.
+func batchInput(op BatchOperation) (pebbleInput, error) {
+	if op.Body == nil {
+		return pebbleInput{}, errBatchBodyRequired
+	}
+	var p Pebble
+	op.Body.apply(&p)
+	return pebbleInput{Name: p.Name, Color: p.Color, WeightGrams: p.WeightGrams}, nil
+}
+
+func batchPebble(ctx context.Context, status int, p Pebble, err error) BatchResult {
+	if err != nil {
+		return batchError(ctx, err)
+	}
+	return BatchResult{Status: status, Pebble: &p, ETag: computeETag(p)}
+}
+
+// batchError reports err in a result, logging server errors and
+// translating the message as WriteError does.
+func batchError(ctx context.Context, err error) BatchResult {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err)
+	}
+	if apiErr.Status >= 500 && apiErr.Err != nil {
+		slog.ErrorContext(ctx, "batch operation failed", "error", apiErr.Err)
+	}
+	e := &errorResponse{Code: apiErr.Code, Message: apiErr.Message, Details: apiErr.Details}
+	localize(ctx, e)
+	return BatchResult{Status: apiErr.Status, Error: e}
+}
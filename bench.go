@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchRoute is a request of the mix the bench command sends, picked in
+// proportion to its weight.
+type benchRoute struct {
+	weight int
+	method string
+	path   string
+	body   string
+}
+
+func (r benchRoute) String() string { return r.method + " " + r.path }
+
+// routeFlag is a repeatable flag of "weight METHOD path [body]" routes.
+type routeFlag []benchRoute
+
+func (f *routeFlag) String() string { return "" }
+
+func (f *routeFlag) Set(s string) error {
+	fields := strings.SplitN(s, " ", 4)
+	if len(fields) < 3 {
+		return errors.New(`must be "weight METHOD path [body]"`)
+	}
+	weight, err := strconv.Atoi(fields[0])
+	if err != nil || weight < 1 {
+		return errors.New("weight must be a positive number")
+	}
+	if !strings.HasPrefix(fields[2], "/") {
+		return errors.New("path must start with /")
+	}
+	r := benchRoute{weight: weight, method: strings.ToUpper(fields[1]), path: fields[2]}
+	if len(fields) == 4 {
+		r.body = fields[3]
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// benchSample is the outcome of one request of the bench command.
+type benchSample struct {
+	route   int
+	status  int
+	latency time.Duration
+	err     error
+}
+
+// runBench implements the bench command, which sends a mix of requests to
+// a server for a while, at a steady rate or as fast as it answers, and
+// reports the latencies by route.
+func runBench(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8080", "URL of the server to send the requests to")
+	rps := fs.Float64("rps", 0, "requests to start every second; 0 sends them as fast as the concurrency allows")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send requests for")
+	concurrency := fs.Int("concurrency", 10, "most requests in flight at once")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long each request may take")
+	headers := headerFlag{}
+	fs.Var(headers, "header", `header to send with every request, such as "X-API-Key: key"; can be repeated`)
+	var routes routeFlag
+	fs.Var(&routes, "route", `request of the mix as "weight METHOD path [body]", such as "9 GET /pebbles"; can be repeated, GET /pebbles if not given`)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *concurrency < 1 || *rps < 0 || *duration <= 0 {
+		return errors.New("usage: bench [-target url] [-rps n] [-duration d] [-concurrency n] [-timeout d] [-header 'Name: value']... [-route 'weight METHOD path [body]']...")
+	}
+	if u, err := url.Parse(*target); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid target %q", *target)
+	}
+	if len(routes) == 0 {
+		routes = routeFlag{{weight: 1, method: http.MethodGet, path: "/pebbles"}}
+	}
+	var total int
+	for _, r := range routes {
+		total += r.weight
+	}
+	pick := func() int {
+		n := rand.IntN(total)
+		for i, r := range routes {
+			if n -= r.weight; n < 0 {
+				return i
+			}
+		}
+		return len(routes) - 1
+	}
+
+	client := &http.Client{Timeout: *timeout, Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+	base := strings.TrimSuffix(*target, "/")
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	next := make(chan int)
+	samples := make([][]benchSample, *concurrency)
+	var wg sync.WaitGroup
+	for i := range samples {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for route := range next {
+				samples[i] = append(samples[i], benchRequest(client, base, http.Header(headers), routes[route], route))
+			}
+		}()
+	}
+	start := time.Now()
+send:
+	for i := 0; ; i++ {
+		if *rps > 0 {
+			at := start.Add(time.Duration(float64(i) / *rps * float64(time.Second)))
+			t := time.NewTimer(time.Until(at))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				break send
+			case <-t.C:
+			}
+		}
+		select {
+		case next <- pick():
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// By route, and for all of them last.
+	type routeStats struct {
+		requests, failed int
+		latencies        []time.Duration
+	}
+	stats := make([]routeStats, len(routes)+1)
+	statuses := make(map[int]int)
+	var sent, unanswered int
+	var firstErr error
+	for _, s := range slices.Concat(samples...) {
+		sent++
+		if s.err != nil {
+			unanswered++
+			firstErr = cmp.Or(firstErr, s.err)
+		} else {
+			statuses[s.status]++
+		}
+		for _, st := range []*routeStats{&stats[s.route], &stats[len(routes)]} {
+			st.requests++
+			if s.err != nil || s.status >= 500 {
+				st.failed++
+			}
+			if s.err == nil {
+				st.latencies = append(st.latencies, s.latency)
+			}
+		}
+	}
+	rate := fmt.Sprintf("%.1f/s", float64(sent)/elapsed.Seconds())
+	if *rps > 0 {
+		rate += fmt.Sprintf(", aiming at %g/s", *rps)
+	}
+	fmt.Fprintf(w, "%d requests in %s (%s), %d without an answer\n", sent, elapsed.Round(time.Millisecond), rate, unanswered)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tREQUESTS\tFAILED\tP50\tP90\tP99\tMAX")
+	for i, st := range stats {
+		name := "all"
+		if i < len(routes) {
+			name = routes[i].String()
+		} else if len(routes) == 1 {
+			break
+		}
+		d := st.latencies
+		if len(d) == 0 {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t-\t-\t-\t-\n", name, st.requests, st.failed)
+			continue
+		}
+		slices.Sort(d)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", name, st.requests, st.failed, percentile(d, 0.5), percentile(d, 0.9), percentile(d, 0.99), percentile(d, 1))
+	}
+	tw.Flush()
+	var counts []string
+	for _, status := range slices.Sorted(maps.Keys(statuses)) {
+		counts = append(counts, fmt.Sprintf("%d=%d", status, statuses[status]))
+	}
+	fmt.Fprintf(w, "statuses: %s\n", strings.Join(counts, " "))
+	if firstErr != nil {
+		fmt.Fprintf(w, "first error: %v\n", firstErr)
+	}
+	if unanswered == sent {
+		return errors.New("no request got an answer")
+	}
+	return nil
+}
+
+// benchRequest sends r, the route at index route of the mix, to base.
+func benchRequest(client *http.Client, base string, headers http.Header, r benchRoute, route int) benchSample {
+	req, err := http.NewRequest(r.method, base+r.path, strings.NewReader(r.body))
+	if err != nil {
+		return benchSample{route: route, err: err}
+	}
+	for k, vs := range headers {
+		req.Header[k] = vs
+	}
+	if r.body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchSample{route: route, err: err}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return benchSample{route: route, status: resp.StatusCode, latency: time.Since(start)}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// BodyLogger logs the bodies of requests and responses for troubleshooting.
+// It is off by default and can be switched on and off while the server
+// runs. Bodies longer than the size limit are not logged, and JSON and
+// form fields whose names are in the redaction list are replaced, so
+// secrets sent to or returned by the API do not end up in the logs.
+type BodyLogger struct {
+	logger  *slog.Logger
+	enabled atomic.Bool
+	opts    atomic.Pointer[bodyLogOptions]
+}
+
+type bodyLogOptions struct {
+	maxBytes int
+	// redact holds the lower-cased field names to redact.
+	redact map[string]bool
+}
+
+func NewBodyLogger(cfg BodyLogConfig, logger *slog.Logger) *BodyLogger {
+	b := &BodyLogger{logger: logger}
+	b.Configure(cfg)
+	return b
+}
+
+// Configure applies the settings in cfg, including whether logging is on.
+func (b *BodyLogger) Configure(cfg BodyLogConfig) {
+	opts := &bodyLogOptions{maxBytes: cfg.MaxBytes, redact: make(map[string]bool)}
+	for _, f := range cfg.RedactFields {
+		opts.redact[strings.ToLower(f)] = true
+	}
+	b.opts.Store(opts)
+	b.enabled.Store(cfg.Enabled)
+}
+
+func (b *BodyLogger) SetEnabled(on bool) {
+	b.enabled.Store(on)
+}
+
+func (b *BodyLogger) Enabled() bool {
+	return b.enabled.Load()
+}
+
+// Middleware logs one line per request with its request and response
+// bodies while logging is on. It must run inside RequestID for the line to
+// carry the request ID.
+func (b *BodyLogger) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !b.enabled.Load() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			opts := b.opts.Load()
+			req := &capture{max: opts.maxBytes}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(r.Body, req), r.Body}
+			}
+			rw := &bodyRecorder{responseRecorder: newResponseRecorder(w), body: capture{max: opts.maxBytes}}
+			next.ServeHTTP(rw, r)
+			b.logger.LogAttrs(r.Context(), slog.LevelInfo, "request bodies",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rw.status),
+				opts.attr("request_body", req, r.Header.Get("Content-Type")),
+				opts.attr("response_body", &rw.body, rw.Header().Get("Content-Type")),
+			)
+		})
+	}
+}
+
+// capture keeps the first max bytes written to it and counts the rest.
+type capture struct {
+	max   int
+	buf   bytes.Buffer
+	total int64
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	if room := c.max - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// bodyRecorder is a responseRecorder that also captures the body.
+type bodyRecorder struct {
+	*responseRecorder
+	body capture
+}
+
+func (rw *bodyRecorder) Write(p []byte) (int, error) {
+	n, err := rw.responseRecorder.Write(p)
+	rw.body.Write(p[:n])
+	return n, err
+}
+
+// attr returns the log attribute for a captured body of the given content
+// type. Bodies that were cut off at the size limit are left out, since a
+// partial document cannot be redacted reliably.
+func (o *bodyLogOptions) attr(key string, c *capture, contentType string) slog.Attr {
+	switch {
+	case c.total == 0:
+		return slog.Attr{Key: key, Value: slog.StringValue("")}
+	case c.total > int64(c.buf.Len()):
+		return slog.Group(key, slog.Int64("bytes", c.total), slog.Bool("truncated", true))
+	}
+	body, err := o.redactBody(c.buf.Bytes(), contentType)
+	switch {
+	case errors.Is(err, errBodyType):
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		return slog.Group(key, slog.Int64("bytes", c.total), slog.String("content_type", mediaType))
+	case err != nil:
+		return slog.Group(key, slog.Int64("bytes", c.total), slog.String("error", err.Error()))
+	}
+	return slog.String(key, body)
+}
+
+// errBodyType reports a body that is neither JSON, a form nor text, and so
+// cannot be redacted.
+var errBodyType = errors.New("body cannot be redacted")
+
+// redactBody returns body, of the given content type, with the redacted
+// fields of JSON and forms replaced. It fails for JSON and forms that do
+// not parse, and with errBodyType for bodies of any other type but text.
+func (o *bodyLogOptions) redactBody(body []byte, contentType string) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var v any
+		if err := json.Unmarshal(body, &v); err != nil {
+			return "", errors.New("invalid JSON")
+		}
+		out, _ := json.Marshal(o.redactJSON(v))
+		return string(out), nil
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", errors.New("invalid form")
+		}
+		for k, vs := range values {
+			if o.redact[strings.ToLower(k)] {
+				for i := range vs {
+					vs[i] = redactedValue
+				}
+			}
+		}
+		return values.Encode(), nil
+	case strings.HasPrefix(mediaType, "text/"):
+		return string(body), nil
+	}
+	return "", errBodyType
+}
+
+// redactJSON replaces the values of redacted fields anywhere in v.
+func (o *bodyLogOptions) redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, x := range v {
+			if o.redact[strings.ToLower(k)] {
+				v[k] = redactedValue
+			} else {
+				v[k] = o.redactJSON(x)
+			}
+		}
+	case []any:
+		for i, x := range v {
+			v[i] = o.redactJSON(x)
+		}
+	}
+	return v
+}
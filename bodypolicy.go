@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	CodeBodyTooLarge         = "body_too_large"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeLengthRequired       = "length_required"
+)
+
+// BodyPolicy decides which request bodies reach the handlers: how long
+// they may be, per route, and which media types they may have.
+type BodyPolicy struct {
+	maxBytes     int64
+	routes       map[string]int64
+	contentTypes []string
+	anyType      map[string]bool
+	maxDepth     int
+	allowUnknown map[string]bool
+}
+
+// NewBodyPolicy returns the policy set by cfg, which must already have
+// been validated.
+func NewBodyPolicy(cfg RequestBodyConfig) *BodyPolicy {
+	routes, _ := parseBodyRoutes(cfg.Routes)
+	p := &BodyPolicy{maxBytes: cfg.MaxBytes, routes: routes, contentTypes: cfg.ContentTypes, anyType: make(map[string]bool),
+		maxDepth: cfg.MaxDepth, allowUnknown: make(map[string]bool)}
+	for _, pattern := range cfg.AllowUnknownFields {
+		p.allowUnknown[pattern] = true
+	}
+	return p
+}
+
+// Allow lets the bodies of requests to the route with pattern have any
+// media type, and be up to maxBytes long unless the configuration sets
+// another limit, for handlers that check their bodies themselves.
+func (p *BodyPolicy) Allow(pattern string, maxBytes int64) {
+	if _, ok := p.routes[pattern]; !ok {
+		p.routes[pattern] = maxBytes
+	}
+	p.anyType[pattern] = true
+}
+
+// parseBodyRoutes parses entries such as "POST /pebbles=65536" into the
+// body size limits of route patterns.
+func parseBodyRoutes(entries []string) (map[string]int64, error) {
+	routes := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		pattern, size, ok := strings.Cut(e, "=")
+		method, path, hasMethod := strings.Cut(pattern, " ")
+		n, err := strconv.ParseInt(size, 10, 64)
+		if !ok || !hasMethod || method == "" || !strings.HasPrefix(path, "/") || err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is not a route=bytes entry such as \"POST /pebbles=65536\"", e)
+		}
+		routes[pattern] = n
+	}
+	return routes, nil
+}
+
+// routeSetting returns the setting in m for the route with pattern.
+// Settings for a route apply to it in every API version.
+func routeSetting[V any](m map[string]V, pattern string) (V, bool) {
+	if v, ok := m[pattern]; ok {
+		return v, true
+	}
+	if method, path, ok := strings.Cut(pattern, " "); ok {
+		if loc := apiVersionPath.FindStringIndex(path); loc != nil {
+			v, ok := m[method+" /"+path[loc[1]:]]
+			return v, ok
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// decodeRules returns the rules Bind decodes the bodies of requests to
+// the route with pattern by.
+func (p *BodyPolicy) decodeRules(pattern string) decodeRules {
+	allow, _ := routeSetting(p.allowUnknown, pattern)
+	return decodeRules{maxDepth: p.maxDepth, allowUnknown: allow}
+}
+
+// limit returns the most bytes the body of a request to the route with
+// pattern may have.
+func (p *BodyPolicy) limit(pattern string) int64 {
+	if n, ok := routeSetting(p.routes, pattern); ok {
+		return n
+	}
+	return p.maxBytes
+}
+
+// Middleware enforces the policy for the routes that routes resolves.
+// POST, PUT and PATCH requests over HTTP/1 must say how long their body is,
+// with Content-Length or chunked encoding, or get a 411 response; other
+// methods, which need not have a body, are left to go without. Bodies with
+// a media type outside the policy get a 415 response, unless their route
+// was allowed any, and those over the limit of their route a 413 response,
+// straight away if Content-Length gives them away and otherwise from Bind
+// once the limit is read. Bind then decodes them by the depth limit and
+// unknown field rule of their route.
+func (p *BodyPolicy) Middleware(routes routeMatcher) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+				if r.ProtoMajor == 1 && r.Header.Get("Content-Length") == "" && len(r.TransferEncoding) == 0 {
+					WriteError(w, r, NewAPIError(http.StatusLengthRequired, CodeLengthRequired, "the request body must have a Content-Length or use chunked encoding"))
+					return
+				}
+			}
+			if r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			_, pattern := routes.Handler(r)
+			mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if anyType, _ := routeSetting(p.anyType, pattern); !anyType && !slices.Contains(p.contentTypes, mt) {
+				WriteError(w, r, NewAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+					fmt.Sprintf("the request body must be one of %s", strings.Join(p.contentTypes, ", "))))
+				return
+			}
+			limit := p.limit(pattern)
+			if r.ContentLength > limit {
+				WriteError(w, r, bodyTooLarge(limit))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r.WithContext(withDecodeRules(r.Context(), p.decodeRules(pattern))))
+		})
+	}
+}
+
+func bodyTooLarge(limit int64) *APIError {
+	return NewAPIError(http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("the request body must be at most %d bytes", limit))
+}
+
+// bodyError turns an error reading or decoding a request body into a 413
+// error if the body was over its limit and a 400 error otherwise, whose
+// details list the members at fault if decoding found any.
+func bodyError(err error) *APIError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return bodyTooLarge(tooLarge.Limit)
+	}
+	var fields bodyFieldErrors
+	if errors.As(err, &fields) {
+		return Invalid(ValidationErrors(fields), "invalid request body: %v", err)
+	}
+	return Invalid(nil, "invalid request body: %v", err)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyPolicyLengthRequired(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pebbles", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	h := NewBodyPolicy(DefaultConfig().RequestBody).Middleware(mux)(mux)
+
+	tests := []struct {
+		name   string
+		method string
+		proto  int
+		header map[string]string
+		chunk  bool
+		want   int
+	}{
+		{name: "POST without framing", method: http.MethodPost, proto: 1, want: http.StatusLengthRequired},
+		{name: "PUT without framing", method: http.MethodPut, proto: 1, want: http.StatusLengthRequired},
+		{name: "PATCH without framing", method: http.MethodPatch, proto: 1, want: http.StatusLengthRequired},
+		{name: "POST with Content-Length 0", method: http.MethodPost, proto: 1, header: map[string]string{"Content-Length": "0"}, want: http.StatusNoContent},
+		{name: "POST chunked", method: http.MethodPost, proto: 1, chunk: true, header: map[string]string{"Content-Type": "application/json"}, want: http.StatusNoContent},
+		{name: "POST over HTTP/2", method: http.MethodPost, proto: 2, want: http.StatusNoContent},
+		{name: "GET without framing", method: http.MethodGet, proto: 1, want: http.StatusNoContent},
+		{name: "custom method without framing", method: "PURGE", proto: 1, want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/pebbles", nil)
+			r.ProtoMajor = tt.proto
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if tt.chunk {
+				r.Body, r.ContentLength, r.TransferEncoding = http.NoBody, -1, []string{"chunked"}
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d; body: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusLengthRequired && !strings.Contains(w.Body.String(), CodeLengthRequired) {
+				t.Errorf("the 411 response has no %s code: %s", CodeLengthRequired, w.Body)
+			}
+		})
+	}
+}
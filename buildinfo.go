@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When version or commit is not set, the module version and the VCS
+// revision the Go toolchain records are used instead.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// BuildInfo identifies the build of the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildInfo() BuildInfo {
+	b := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && info.Main.Version != "" {
+			b.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && b.Commit == "" {
+				b.Commit = s.Value
+			}
+		}
+	}
+	if b.Version == "" {
+		b.Version = "(devel)"
+	}
+	return b
+}
+
+// versionResponse is the body of GET /version: the build, and the time on
+// the server's clock with how long it has been up, to tell clock drift
+// between instances and their clients.
+type versionResponse struct {
+	BuildInfo
+	ServerTime    time.Time `json:"server_time"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+}
+
+// VersionHandler serves the build information as JSON, with the time of
+// clock and the uptime counted from when it was called.
+func VersionHandler(clock Clock) APIHandlerFunc {
+	b, started := buildInfo(), clock.Now()
+	return func(w http.ResponseWriter, r *http.Request) error {
+		now := clock.Now()
+		w.Header().Set("Cache-Control", "no-store")
+		respond(w, r, http.StatusOK, versionResponse{
+			BuildInfo:     b,
+			ServerTime:    now.UTC(),
+			StartedAt:     started.UTC(),
+			UptimeSeconds: now.Sub(started).Seconds(),
+		})
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const CodeRangeNotSatisfiable = "range_not_satisfiable"
+
+// byteRange is the part of a representation from start, length bytes
+// long.
+type byteRange struct {
+	start, length int64
+}
+
+// contentRange returns the Content-Range header of r in a representation
+// of size bytes.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// header returns the Range header asking for r.
+func (r byteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.start, r.start+r.length-1)
+}
+
+// requestRange returns the byte range a GET request asks for of the
+// representation with the given size and strong etag, so that clients can
+// resume interrupted downloads. ok is false when the whole representation
+// is to be sent: the request has no Range header, one the server ignores,
+// as it does those with several ranges or other units, or an If-Range
+// that does not match etag. A range starting past the end is an error,
+// whose response must carry the Content-Range of unsatisfiableRange.
+func requestRange(r *http.Request, size int64, etag string) (byteRange, bool, error) {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok || r.Method != http.MethodGet && r.Method != http.MethodHead || strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+	// A date in If-Range is ignored with the rest, as the entity tag is
+	// the only validator guaranteed to change with the content.
+	if ir := r.Header.Get("If-Range"); ir != "" && strings.TrimSpace(ir) != etag {
+		return byteRange{}, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false, nil
+	}
+	unsatisfiable := NewAPIError(http.StatusRequestedRangeNotSatisfiable, CodeRangeNotSatisfiable,
+		fmt.Sprintf("the range must start before byte %d", size))
+	if first == "" {
+		// A suffix range: the last bytes of the representation.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, false, unsatisfiable
+		}
+		n = min(n, size)
+		return byteRange{start: size - n, length: n}, true, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return byteRange{}, false, unsatisfiable
+	}
+	return byteRange{start: start, length: end - start + 1}, true, nil
+}
+
+// unsatisfiableRange is the Content-Range header of the error response to
+// a range beyond the end of a representation of size bytes.
+func unsatisfiableRange(size int64) string {
+	return "bytes */" + strconv.FormatInt(size, 10)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var ErrCacheMiss = errors.New("cache: miss")
+
+// Cache holds values for a while. Get returns ErrCacheMiss for keys that
+// are not set or have expired. Values are forgotten ttl after they are
+// set, and may be forgotten earlier.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// addingCache is a Cache that can set a key only if it is not set, as the
+// memory and Redis caches can, for remembering what has been seen once.
+type addingCache interface {
+	Cache
+	// Add sets key as Set does unless it is set, and reports whether it
+	// did.
+	Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+}
+
+// newCache returns the Cache selected by cfg.Backend, or nil for "none".
+func newCache(cfg CacheConfig, clock Clock) (Cache, error) {
+	switch cfg.Backend {
+	case "memory":
+		return newMemoryCache(clock), nil
+	case "redis":
+		r := cfg.Redis
+		return newRedisCache(r.URL, r.MaxIdleConns, r.Timeout.Duration)
+	}
+	return nil, nil
+}
+
+// memoryCache is a Cache in the memory of one server instance.
+type memoryCache struct {
+	clock Clock
+
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryCache(clock Clock) *memoryCache {
+	return &memoryCache{clock: clock, entries: make(map[string]memoryCacheEntry)}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !c.clock.Now().Before(e.expires) {
+		return nil, ErrCacheMiss
+	}
+	return e.value, nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = memoryCacheEntry{value: value, expires: c.clock.Now().Add(ttl)}
+	return nil
+}
+
+func (c *memoryCache) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && c.clock.Now().Before(e.expires) {
+		return false, nil
+	}
+	c.entries[key] = memoryCacheEntry{value: value, expires: c.clock.Now().Add(ttl)}
+	return true, nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+// run removes expired entries every interval until ctx is done.
+func (c *memoryCache) run(ctx context.Context, interval time.Duration) {
+	every(ctx, c.clock, interval, func(now time.Time) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for key, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, key)
+			}
+		}
+	})
+}
+
+// meteredCache counts the lookups in the wrapped cache by result: hit,
+// miss or error.
+type meteredCache struct {
+	Cache
+	backend string
+	lookups *CounterVec
+}
+
+func newMeteredCache(c Cache, reg *Registry, backend string) meteredCache {
+	return meteredCache{Cache: c, backend: backend, lookups: reg.NewCounterVec("cache_lookups_total",
+		"Number of cache lookups, by backend and result.", "backend", "result")}
+}
+
+func (c meteredCache) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := c.Cache.Get(ctx, key)
+	switch {
+	case err == nil:
+		c.lookups.Inc(c.backend, "hit")
+	case errors.Is(err, ErrCacheMiss):
+		c.lookups.Inc(c.backend, "miss")
+	default:
+		c.lookups.Inc(c.backend, "error")
+	}
+	return v, err
+}
+
+// cacheAside returns the value cached under key, or else loads it, caches
+// it for ttl and returns it. The cache only speeds things up: when it
+// fails, the error is logged and the value loaded.
+func cacheAside[T any](ctx context.Context, c Cache, key string, ttl time.Duration, load func() (T, error)) (T, error) {
+	if b, err := c.Get(ctx, key); err == nil {
+		var v T
+		if err := json.Unmarshal(b, &v); err == nil {
+			return v, nil
+		}
+	} else if !errors.Is(err, ErrCacheMiss) {
+		slog.WarnContext(ctx, "cannot read from cache", "key", key, "error", err)
+	}
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+	if b, err := json.Marshal(v); err == nil {
+		if err := c.Set(ctx, key, b, ttl); err != nil {
+			slog.WarnContext(ctx, "cannot write to cache", "key", key, "error", err)
+		}
+	}
+	return v, nil
+}
+
+// invalidate removes key from the cache. A failure is logged, since the
+// change it follows has been made; the stale value expires with its TTL.
+func invalidate(ctx context.Context, c Cache, key string) {
+	if err := c.Delete(ctx, key); err != nil {
+		slog.ErrorContext(ctx, "cannot invalidate cache entry", "key", key, "error", err)
+	}
+}
+
+// cachingStore serves single pebble reads from a cache and removes a
+// pebble from it when it changes. A read racing with a change can put the
+// old pebble back in the cache, so a short TTL bounds how long it may be
+// served. Lists are always read from the wrapped store.
+type cachingStore struct {
+	Store
+	cache Cache
+	ttl   time.Duration
+}
+
+func pebbleCacheKey(id string) string {
+	return "pebble:" + id
+}
+
+// invalidate removes key from the cache once the change to it commits.
+func (s cachingStore) invalidate(ctx context.Context, key string) {
+	afterCommit(ctx, func() { invalidate(ctx, s.cache, key) })
+}
+
+// Get goes straight to the store in a transaction, which may see changes
+// that are not to be cached until it commits.
+func (s cachingStore) Get(ctx context.Context, id string) (Pebble, error) {
+	if inTransaction(ctx) {
+		return s.Store.Get(ctx, id)
+	}
+	return cacheAside(ctx, s.cache, pebbleCacheKey(id), s.ttl, func() (Pebble, error) {
+		return s.Store.Get(ctx, id)
+	})
+}
+
+// Update also invalidates the pebble when the update is stale, since the
+// caller may have read the old version from the cache.
+func (s cachingStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	err := s.Store.Update(ctx, p, prev)
+	if err == nil || errors.Is(err, ErrStale) {
+		s.invalidate(ctx, pebbleCacheKey(p.ID))
+	}
+	return err
+}
+
+func (s cachingStore) Delete(ctx context.Context, id string, at time.Time) error {
+	err := s.Store.Delete(ctx, id, at)
+	if err == nil {
+		s.invalidate(ctx, pebbleCacheKey(id))
+	}
+	return err
+}
+
+func (s cachingStore) Restore(ctx context.Context, id string) error {
+	err := s.Store.Restore(ctx, id)
+	if err == nil {
+		s.invalidate(ctx, pebbleCacheKey(id))
+	}
+	return err
+}
+
+func (s cachingStore) Purge(ctx context.Context, before time.Time) ([]string, error) {
+	ids, err := s.Store.Purge(ctx, before)
+	for _, id := range ids {
+		s.invalidate(ctx, pebbleCacheKey(id))
+	}
+	return ids, err
+}
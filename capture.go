@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CapturedRequest is a line of a capture file: a request as it was sent,
+// with its secrets redacted, and the status it got.
+type CapturedRequest struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method"`
+	// URL is the path and query of the request.
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	// BodyOmitted is set for a request whose body was not recorded, for
+	// being too long, of a type that cannot be redacted or not read by
+	// the server, which cannot be replayed.
+	BodyOmitted bool    `json:"body_omitted,omitempty"`
+	Status      int     `json:"status"`
+	LatencyMS   float64 `json:"latency_ms"`
+}
+
+// capturedHeaderSkip are the headers a capture leaves out, since the
+// client sending the request again sets its own.
+var capturedHeaderSkip = map[string]bool{"Content-Length": true, "Connection": true, "Accept-Encoding": true}
+
+// TrafficCapture records the requests it serves to a writer as
+// CapturedRequest lines.
+type TrafficCapture struct {
+	opts    *bodyLogOptions
+	headers map[string]bool
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewTrafficCapture returns a capture of requests to w, redacting the
+// headers of cfg and the body fields in redactFields.
+func NewTrafficCapture(cfg CaptureConfig, redactFields []string, w io.Writer) *TrafficCapture {
+	t := &TrafficCapture{
+		opts:    &bodyLogOptions{maxBytes: cfg.MaxBodyBytes, redact: make(map[string]bool)},
+		headers: make(map[string]bool),
+		w:       w,
+	}
+	for _, f := range redactFields {
+		t.opts.redact[strings.ToLower(f)] = true
+	}
+	for _, h := range cfg.RedactHeaders {
+		t.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	return t
+}
+
+// Middleware records each request once it has been served. It must run
+// inside RequestID for the line to carry the request ID.
+func (t *TrafficCapture) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			body := &capture{max: t.opts.maxBytes}
+			hasBody := r.Body != nil && r.Body != http.NoBody
+			if hasBody {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(r.Body, body), r.Body}
+			}
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r)
+
+			rec := CapturedRequest{
+				Time:      start.UTC(),
+				RequestID: RequestIDFromContext(r.Context()),
+				Method:    r.Method,
+				URL:       r.URL.RequestURI(),
+				Header:    make(http.Header),
+				Status:    rw.status,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			for k, vs := range r.Header {
+				switch {
+				case capturedHeaderSkip[k]:
+				case t.headers[k]:
+					rec.Header[k] = []string{redactedValue}
+				default:
+					rec.Header[k] = vs
+				}
+			}
+			if hasBody {
+				complete := body.total > 0 && body.total == int64(body.buf.Len()) && (r.ContentLength < 0 || body.total == r.ContentLength)
+				var err error
+				if complete {
+					rec.Body, err = t.opts.redactBody(body.buf.Bytes(), r.Header.Get("Content-Type"))
+				}
+				rec.BodyOmitted = !complete && r.ContentLength != 0 || err != nil
+			}
+			line, _ := json.Marshal(rec)
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.w.Write(append(line, '\n'))
+		})
+	}
+}
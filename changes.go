@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// changesBuffer bounds the events collected for one long-poll response
+// once the first has arrived.
+const changesBuffer = 64
+
+// changesResponse is the body of GET /pebbles/changes. Cursor is the since
+// parameter of the next request. Resync is set if some changes after the
+// cursor sent are no longer remembered, or it came from another run of the
+// server, and the client should fetch the pebbles again.
+type changesResponse struct {
+	Changes []Event `json:"changes"`
+	Cursor  string  `json:"cursor"`
+	Resync  bool    `json:"resync,omitempty"`
+}
+
+// changesAPI serves GET /pebbles/changes, a long-polling fallback for
+// clients that can use neither the WebSocket nor the SSE stream.
+type changesAPI struct {
+	hub     *Hub
+	timeout time.Duration
+	clock   Clock
+}
+
+func (api *changesAPI) register(rt *Router) {
+	rt.Get("/pebbles/changes", api.changes)
+	rt.Document("GET", "/pebbles/changes", Operation{Summary: "Wait for pebble changes after a cursor", Tag: "events", Response: changesResponse{}})
+}
+
+// changes responds with the events after the since cursor as soon as there
+// are any, or with none once the timeout has passed. Without since it
+// responds straight away with the cursor of the latest event.
+func (api *changesAPI) changes(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	v := r.URL.Query().Get("since")
+	if v == "" {
+		respond(w, r, http.StatusOK, changesResponse{Changes: []Event{}, Cursor: strconv.FormatUint(api.hub.LastID(), 10)})
+		return nil
+	}
+	since, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return Invalid(ValidationErrors{{Field: "since", Message: "must be a cursor from an earlier response"}}, "invalid parameters")
+	}
+	if since > api.hub.LastID() {
+		respond(w, r, http.StatusOK, changesResponse{Changes: []Event{}, Cursor: strconv.FormatUint(api.hub.LastID(), 10), Resync: true})
+		return nil
+	}
+	missed, complete, sub := api.hub.SubscribeAfter(since, changesBuffer)
+	defer sub.Close()
+	// The cursor moves past the events of other tenants too, which are
+	// left out.
+	changes := []Event{}
+	cursor := since
+	add := func(e Event) {
+		cursor = e.ID
+		if tenantSees(r.Context(), e) {
+			changes = append(changes, e)
+		}
+	}
+	for _, e := range missed {
+		add(e)
+	}
+	if len(changes) == 0 {
+		timer := api.clock.NewTimer(api.timeout)
+		defer timer.Stop()
+	wait:
+		for len(changes) == 0 {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					break wait
+				}
+				add(e)
+			case <-timer.C():
+				break wait
+			case <-r.Context().Done():
+				return nil
+			}
+		}
+	}
+	// Take whatever else has arrived in the meantime.
+drain:
+	for len(changes) < changesBuffer {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				break drain
+			}
+			add(e)
+		default:
+			break drain
+		}
+	}
+	respond(w, r, http.StatusOK, changesResponse{Changes: changes, Cursor: strconv.FormatUint(cursor, 10), Resync: !complete})
+	return nil
+}
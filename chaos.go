@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const CodeInjectedFault = "injected_fault"
+
+// ChaosRule injects faults into a share of the requests to a route, to
+// exercise the retry logic of clients. Route is a route as GET
+// /admin/routes lists it, such as "GET /pebbles/{id}", or empty for every
+// route, and Rate the share of its requests that get the fault, from 0 to
+// 1. Latency delays them by that long; Status then answers them with that
+// 5xx status instead of serving them, and Drop closes their connection
+// without an answer.
+type ChaosRule struct {
+	Route   string   `json:"route"`
+	Rate    float64  `json:"rate" validate:"min=0,max=1"`
+	Latency Duration `json:"latency"`
+	Status  int      `json:"status"`
+	Drop    bool     `json:"drop"`
+}
+
+// chaosState is the body of GET and PUT /admin/chaos.
+type chaosState struct {
+	Rules []ChaosRule `json:"rules"`
+}
+
+// validateChaosRules returns the problems of rules, with fields named
+// after their index in rules.
+func validateChaosRules(rules []ChaosRule) ValidationErrors {
+	var errs ValidationErrors
+	for i, rule := range rules {
+		key := fmt.Sprintf("rules[%d]", i)
+		for _, e := range Validate(rule) {
+			errs = append(errs, FieldError{Field: key + "." + e.Field, Message: e.Message})
+		}
+		switch {
+		case rule.Latency.Duration < 0:
+			errs = append(errs, FieldError{Field: key + ".latency", Message: "must not be negative"})
+		case rule.Status != 0 && (rule.Status < 500 || rule.Status > 599):
+			errs = append(errs, FieldError{Field: key + ".status", Message: "must be a 5xx status"})
+		case rule.Status != 0 && rule.Drop:
+			errs = append(errs, FieldError{Field: key + ".drop", Message: "cannot be combined with status"})
+		case rule.Latency.Duration == 0 && rule.Status == 0 && !rule.Drop:
+			errs = append(errs, FieldError{Field: key, Message: "must set latency, status or drop"})
+		}
+	}
+	return errs
+}
+
+// Chaos injects the faults of its rules into the requests it serves. The
+// first rule matching the route of a request applies, so rules for single
+// routes go before one for every route.
+type Chaos struct {
+	rules    atomic.Pointer[[]ChaosRule]
+	routes   routeMatcher
+	logger   *slog.Logger
+	injected *CounterVec
+}
+
+// NewChaos returns a fault injector starting with rules for the routes of
+// routes. reg, if not nil, gets its metrics.
+func NewChaos(rules []ChaosRule, routes routeMatcher, reg *Registry, logger *slog.Logger) *Chaos {
+	c := &Chaos{routes: routes, logger: logger}
+	c.SetRules(rules)
+	if reg != nil {
+		c.injected = reg.NewCounterVec("chaos_faults_injected_total", "Number of faults injected into HTTP requests.", "route", "fault")
+	}
+	return c
+}
+
+// Rules returns the rules in effect.
+func (c *Chaos) Rules() []ChaosRule {
+	return *c.rules.Load()
+}
+
+// SetRules replaces the rules, which must be valid.
+func (c *Chaos) SetRules(rules []ChaosRule) {
+	rules = append([]ChaosRule{}, rules...)
+	c.rules.Store(&rules)
+}
+
+func (c *Chaos) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rules := c.Rules()
+			if len(rules) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			_, route := c.routes.Handler(r)
+			i := 0
+			for i < len(rules) && rules[i].Route != "" && rules[i].Route != route {
+				i++
+			}
+			if i == len(rules) || rand.Float64() >= rules[i].Rate {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rule := rules[i]
+			fault := "latency"
+			switch {
+			case rule.Drop:
+				fault = "drop"
+			case rule.Status != 0:
+				fault = "status"
+			}
+			if c.injected != nil {
+				c.injected.Inc(route, fault)
+			}
+			c.logger.DebugContext(r.Context(), "injecting fault", "route", route, "fault", fault, "latency", rule.Latency.Duration, "status", rule.Status)
+
+			if d := rule.Latency.Duration; d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-r.Context().Done():
+					t.Stop()
+					return
+				case <-t.C:
+				}
+			}
+			switch {
+			case rule.Drop:
+				// Makes the server close the connection, or reset the
+				// stream with HTTP/2, without logging a panic.
+				panic(http.ErrAbortHandler)
+			case rule.Status != 0:
+				WriteError(w, r, NewAPIError(rule.Status, CodeInjectedFault, "fault injected for resilience testing"))
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Package client is a Go client for the pebbles API served by pebble-api.
+//
+//	c, err := client.New("http://localhost:8080", client.WithAPIKey(key))
+//	p, err := c.CreatePebble(ctx, client.PebbleInput{Name: "Flint", Color: "grey"})
+//	for p, err := range c.Pebbles(ctx, client.ListOptions{Sort: "name"}) {
+//		...
+//	}
+//
+// Failed requests return an *Error, which errors.Is matches against the
+// Err values of its code.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the pebbles API. It is safe for concurrent use.
+type Client struct {
+	base       *url.URL
+	prefix     string
+	http       *http.Client
+	header     http.Header
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// signingKey and signingSecret sign each request, when set.
+	signingKey    string
+	signingSecret string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends the requests with hc instead of a client with a
+// 30 second timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithAPIKey authenticates the requests with an API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.header.Set("X-API-Key", key) }
+}
+
+// WithSigningKey authenticates the requests by signing them with the
+// signing secret of the API key with the given ID, instead of sending the
+// key. Each attempt of a request is signed anew, since a server accepts a
+// signature once.
+func WithSigningKey(id, secret string) Option {
+	return func(c *Client) { c.signingKey, c.signingSecret = id, secret }
+}
+
+// WithToken authenticates the requests with a JWT bearer token.
+func WithToken(token string) Option {
+	return func(c *Client) { c.header.Set("Authorization", "Bearer "+token) }
+}
+
+// WithAPIVersion calls the given version of the API, such as "v1", instead
+// of the server's default one.
+func WithAPIVersion(version string) Option {
+	return func(c *Client) { c.prefix = "/api/" + version }
+}
+
+// WithRetries sets how many times a request that failed for a reason that
+// may pass is tried again, 3 by default, waiting a random time of up to
+// minWait doubled for every attempt, but at most maxWait, before each. A
+// server asking for a longer wait with Retry-After gets it, up to maxWait;
+// beyond that, the error is returned at once, as it is when the wait would
+// outlast the context's deadline.
+func WithRetries(n int, minWait, maxWait time.Duration) Option {
+	return func(c *Client) { c.retries, c.minBackoff, c.maxBackoff = n, minWait, maxWait }
+}
+
+// New returns a client of the server at baseURL, such as
+// "https://pebbles.example.com".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid base URL: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("client: base URL %q is not http or https", baseURL)
+	}
+	c := &Client{
+		base:       base,
+		http:       &http.Client{Timeout: 30 * time.Second},
+		header:     http.Header{"Accept": {"application/json"}, "User-Agent": {"pebble-api-client"}},
+		retries:    3,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// request is one call to the API.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   any
+}
+
+// do sends req, trying it again while it may succeed, and decodes the
+// response body into out unless it is nil. It returns the response, whose
+// body is closed, or an *Error for a response with an error status.
+func (c *Client) do(ctx context.Context, req request, out any) (*http.Response, error) {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return nil, fmt.Errorf("client: cannot encode request body: %w", err)
+		}
+	}
+	u := c.base.JoinPath(c.prefix, req.path)
+	u.RawQuery = req.query.Encode()
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req, u.String(), body, out)
+		if attempt >= c.retries || !retryable(req, resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+		wait := c.backoff(attempt)
+		if e, ok := err.(*Error); ok && e.RetryAfter > wait {
+			if e.RetryAfter > c.maxBackoff {
+				return resp, err
+			}
+			wait = e.RetryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return resp, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request, u string, body []byte, out any) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, req.method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	for k, v := range c.header {
+		r.Header[k] = v
+	}
+	for k, v := range req.header {
+		r.Header[k] = v
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if c.signingKey != "" {
+		c.sign(r, body)
+	}
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return resp, responseError(resp)
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("client: cannot decode %s %s response: %w", req.method, req.path, err)
+		}
+	}
+	return resp, nil
+}
+
+// sign adds the headers of a signed request to r, whose body is body.
+func (c *Client) sign(r *http.Request, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	b := make([]byte, 16)
+	crand.Read(b)
+	nonce := hex.EncodeToString(b)
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(c.signingSecret))
+	mac.Write([]byte(ts + "\n" + nonce + "\n" + r.Method + "\n" + r.URL.RequestURI() + "\n" + hex.EncodeToString(sum[:])))
+	r.Header.Set("Pebble-Key-ID", c.signingKey)
+	r.Header.Set("Pebble-Timestamp", ts)
+	r.Header.Set("Pebble-Nonce", nonce)
+	r.Header.Set("Pebble-Signature", "v1="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// retryable reports whether req may succeed if it is sent again. Requests
+// turned away before they were handled, for their rate or because the
+// server is in maintenance, always can. Other failures may have happened
+// after the change was made, so the request is only sent again if doing so
+// is harmless: if its method is idempotent or it has an Idempotency-Key.
+func retryable(req request, resp *http.Response, err error) bool {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		return true
+	}
+	switch req.method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		if req.header.Get("Idempotency-Key") == "" {
+			return false
+		}
+	}
+	if resp == nil {
+		// A network error, unless the context ended.
+		return err != nil
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout
+}
+
+// backoff returns a random wait before retry attempt+1, with full jitter so
+// that clients failing together do not retry together.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.maxBackoff
+	if attempt < 30 {
+		d = min(c.minBackoff<<attempt, c.maxBackoff)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d) + 1
+}
+
+// retryAfter parses a Retry-After header in seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// newIdempotencyKey returns a random key for the Idempotency-Key header.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
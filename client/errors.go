@@ -0,0 +1,130 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Codes of the errors the server returns, as in its error responses.
+const (
+	CodeInvalid              = "invalid"
+	CodeValidation           = "validation_failed"
+	CodeNotFound             = "not_found"
+	CodeConflict             = "conflict"
+	CodeInternal             = "internal"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+	CodeRateLimited          = "rate_limited"
+	CodeMaintenance          = "maintenance"
+	CodeTimeout              = "timeout"
+	CodeBodyTooLarge         = "body_too_large"
+	CodeIdempotencyMismatch  = "idempotency_key_reused"
+)
+
+// Values to match errors against with errors.Is, one per code:
+//
+//	if errors.Is(err, client.ErrNotFound) {
+var (
+	ErrInvalid              = &Error{Code: CodeInvalid}
+	ErrValidation           = &Error{Code: CodeValidation}
+	ErrNotFound             = &Error{Code: CodeNotFound}
+	ErrConflict             = &Error{Code: CodeConflict}
+	ErrInternal             = &Error{Code: CodeInternal}
+	ErrUnauthorized         = &Error{Code: CodeUnauthorized}
+	ErrForbidden            = &Error{Code: CodeForbidden}
+	ErrPreconditionFailed   = &Error{Code: CodePreconditionFailed}
+	ErrPreconditionRequired = &Error{Code: CodePreconditionRequired}
+	ErrRateLimited          = &Error{Code: CodeRateLimited}
+	ErrMaintenance          = &Error{Code: CodeMaintenance}
+	ErrTimeout              = &Error{Code: CodeTimeout}
+	ErrBodyTooLarge         = &Error{Code: CodeBodyTooLarge}
+	ErrIdempotencyMismatch  = &Error{Code: CodeIdempotencyMismatch}
+)
+
+// Error is an error response of the server. Details is the details field
+// as sent; FieldErrors decodes it for validation errors.
+type Error struct {
+	Status     int
+	Code       string
+	Message    string
+	Details    json.RawMessage
+	RequestID  string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pebble-api: %s (%d %s)", e.Message, e.Status, e.Code)
+}
+
+// Is reports whether target is an *Error with the same code, so that
+// errors.Is(err, ErrNotFound) matches every not found error.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// FieldErrors returns the problems with the fields of the request, for
+// validation and invalid errors that list them.
+func (e *Error) FieldErrors() []FieldError {
+	var fields []FieldError
+	if json.Unmarshal(e.Details, &fields) != nil {
+		return nil
+	}
+	return fields
+}
+
+// responseError reads the error response resp into an *Error. A response
+// that is not one, such as from a proxy, gets a code from its status.
+func responseError(resp *http.Response) *Error {
+	e := &Error{Status: resp.StatusCode, RetryAfter: retryAfter(resp)}
+	var body struct {
+		Code      string          `json:"code"`
+		Message   string          `json:"message"`
+		Details   json.RawMessage `json:"details"`
+		RequestID string          `json:"request_id"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(data, &body) == nil && body.Code != "" {
+		e.Code, e.Message, e.Details, e.RequestID = body.Code, body.Message, body.Details, body.RequestID
+		return e
+	}
+	e.Code = statusCode(resp.StatusCode)
+	e.Message = http.StatusText(resp.StatusCode)
+	e.RequestID = resp.Header.Get("X-Request-ID")
+	return e
+}
+
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalid
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return CodeBodyTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusGatewayTimeout:
+		return CodeTimeout
+	}
+	return CodeInternal
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Pebble is a pebble as the server returns it. ETag identifies this
+// version of it, for the ifMatch arguments of the methods changing it.
+type Pebble struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Color       string     `json:"color"`
+	WeightGrams int        `json:"weight_grams"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	ETag        string     `json:"-"`
+}
+
+// PebbleInput has the fields of a pebble to create or replace.
+type PebbleInput struct {
+	Name        string `json:"name"`
+	Color       string `json:"color"`
+	WeightGrams int    `json:"weight_grams"`
+}
+
+// PebblePatch has the fields of a pebble to change; nil fields are left
+// as they are.
+type PebblePatch struct {
+	Name        *string `json:"name,omitempty"`
+	Color       *string `json:"color,omitempty"`
+	WeightGrams *int    `json:"weight_grams,omitempty"`
+}
+
+// ListOptions select and order the pebbles of a list. Sort is a field,
+// optionally followed by :asc or :desc; Filters map fields to the value
+// they must have. Limit is the size of a page, the server's default if 0.
+type ListOptions struct {
+	Sort           string
+	Filters        map[string]string
+	Limit          int
+	IncludeDeleted bool
+	Cursor         string
+}
+
+// PebblePage is one page of a list. NextCursor is empty on the last page.
+type PebblePage struct {
+	Items      []Pebble
+	NextCursor string
+}
+
+func (o ListOptions) values() url.Values {
+	v := url.Values{}
+	for field, value := range o.Filters {
+		v.Set(field, value)
+	}
+	if o.Sort != "" {
+		v.Set("sort", o.Sort)
+	}
+	if o.Limit > 0 {
+		v.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.IncludeDeleted {
+		v.Set("include_deleted", "true")
+	}
+	if o.Cursor != "" {
+		v.Set("cursor", o.Cursor)
+	}
+	return v
+}
+
+// ListPebbles returns the page of pebbles starting at opts.Cursor.
+func (c *Client) ListPebbles(ctx context.Context, opts ListOptions) (PebblePage, error) {
+	var body struct {
+		Items []Pebble `json:"items"`
+		Page  struct {
+			NextCursor string `json:"next_cursor"`
+		} `json:"page"`
+	}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/pebbles", query: opts.values()}, &body); err != nil {
+		return PebblePage{}, err
+	}
+	return PebblePage{Items: body.Items, NextCursor: body.Page.NextCursor}, nil
+}
+
+// Pebbles iterates over every pebble of the list, fetching the pages as
+// they are needed. It stops after the first error.
+func (c *Client) Pebbles(ctx context.Context, opts ListOptions) iter.Seq2[Pebble, error] {
+	return func(yield func(Pebble, error) bool) {
+		for {
+			page, err := c.ListPebbles(ctx, opts)
+			if err != nil {
+				yield(Pebble{}, err)
+				return
+			}
+			for _, p := range page.Items {
+				if !yield(p, nil) {
+					return
+				}
+			}
+			if page.NextCursor == "" {
+				return
+			}
+			opts.Cursor = page.NextCursor
+		}
+	}
+}
+
+// GetPebble returns pebble id. includeDeleted returns it even if it has
+// been deleted, which needs the pebbles:admin permission.
+func (c *Client) GetPebble(ctx context.Context, id string, includeDeleted bool) (Pebble, error) {
+	var q url.Values
+	if includeDeleted {
+		q = url.Values{"include_deleted": {"true"}}
+	}
+	return c.pebble(ctx, request{method: http.MethodGet, path: "/pebbles/" + url.PathEscape(id), query: q})
+}
+
+// CreatePebble creates a pebble. It is sent with an Idempotency-Key, so
+// that retrying it cannot create two when the server has idempotency
+// enabled.
+func (c *Client) CreatePebble(ctx context.Context, in PebbleInput) (Pebble, error) {
+	return c.pebble(ctx, request{
+		method: http.MethodPost,
+		path:   "/pebbles",
+		header: http.Header{"Idempotency-Key": {newIdempotencyKey()}},
+		body:   in,
+	})
+}
+
+// ReplacePebble sets every field of pebble id. ifMatch, if not empty, is
+// the ETag of the version the change is based on; the change fails with
+// ErrPreconditionFailed if the pebble has changed since.
+func (c *Client) ReplacePebble(ctx context.Context, id string, in PebbleInput, ifMatch string) (Pebble, error) {
+	return c.pebble(ctx, request{method: http.MethodPut, path: "/pebbles/" + url.PathEscape(id), header: ifMatchHeader(ifMatch), body: in})
+}
+
+// UpdatePebble changes the fields of pebble id that are set in patch.
+// ifMatch is as for ReplacePebble.
+func (c *Client) UpdatePebble(ctx context.Context, id string, patch PebblePatch, ifMatch string) (Pebble, error) {
+	return c.pebble(ctx, request{method: http.MethodPatch, path: "/pebbles/" + url.PathEscape(id), header: ifMatchHeader(ifMatch), body: patch})
+}
+
+// DeletePebble deletes pebble id. ifMatch is as for ReplacePebble.
+func (c *Client) DeletePebble(ctx context.Context, id, ifMatch string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/pebbles/" + url.PathEscape(id), header: ifMatchHeader(ifMatch)}, nil)
+	return err
+}
+
+// RestorePebble brings back deleted pebble id, which needs the
+// pebbles:admin permission. ifMatch is the ETag of the deleted pebble, or
+// empty.
+func (c *Client) RestorePebble(ctx context.Context, id, ifMatch string) (Pebble, error) {
+	return c.pebble(ctx, request{method: http.MethodPost, path: "/pebbles/" + url.PathEscape(id) + ":restore", header: ifMatchHeader(ifMatch)})
+}
+
+// pebble sends req and returns the pebble it responds with.
+func (c *Client) pebble(ctx context.Context, req request) (Pebble, error) {
+	var p Pebble
+	resp, err := c.do(ctx, req, &p)
+	if err != nil {
+		return Pebble{}, err
+	}
+	p.ETag = resp.Header.Get("ETag")
+	return p, nil
+}
+
+func ifMatchHeader(etag string) http.Header {
+	if etag == "" {
+		return nil
+	}
+	return http.Header{"If-Match": {etag}}
+}
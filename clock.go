@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock tells the time, and runs the timers and timeouts measured by it.
+// The components that expire entries, give up on requests or schedule
+// work take one rather than calling the time package, so that tests can
+// drive them with a FakeClock.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a timer that fires once d has passed.
+	NewTimer(d time.Duration) Timer
+	// WithTimeout returns a copy of ctx that is cancelled with
+	// context.DeadlineExceeded once d has passed, as context.WithTimeout
+	// does.
+	WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc)
+}
+
+// Timer is a timer of a Clock, which sends the time on C when it fires.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, and reports whether it did.
+	Stop() bool
+}
+
+// every calls fn with the time every interval of clock until ctx is
+// done.
+func every(ctx context.Context, clock Clock, interval time.Duration, fn func(now time.Time)) {
+	for {
+		t := clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case now := <-t.C():
+			fn(now)
+		}
+	}
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+func (systemClock) WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d)
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+
+func (t systemTimer) Stop() bool { return t.t.Stop() }
+
+// FakeClock is a Clock whose time only moves when Advance moves it, which
+// fires the timers and timeouts that come due, earliest first.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a timer or timeout of a FakeClock, which calls fire when
+// the clock reaches at.
+type fakeWaiter struct {
+	at   time.Time
+	fire func(now time.Time)
+}
+
+// NewFakeClock returns a FakeClock showing now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*fakeWaiter
+	c.waiters = slices.DeleteFunc(c.waiters, func(w *fakeWaiter) bool {
+		if w.at.After(now) {
+			return false
+		}
+		due = append(due, w)
+		return true
+	})
+	c.mu.Unlock()
+	slices.SortStableFunc(due, func(a, b *fakeWaiter) int { return a.at.Compare(b.at) })
+	for _, w := range due {
+		w.fire(now)
+	}
+}
+
+// Waiting returns the number of timers and timeouts yet to fire, so that
+// a test can tell when the component it drives has started waiting.
+func (c *FakeClock) Waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// wait calls fire once d has passed, straight away if it is not positive.
+// The function it returns stops the wait, reporting whether it had not
+// fired yet.
+func (c *FakeClock) wait(d time.Duration, fire func(now time.Time)) func() bool {
+	c.mu.Lock()
+	if d <= 0 {
+		now := c.now
+		c.mu.Unlock()
+		fire(now)
+		return func() bool { return false }
+	}
+	w := &fakeWaiter{at: c.now.Add(d), fire: fire}
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		n := len(c.waiters)
+		c.waiters = slices.DeleteFunc(c.waiters, func(o *fakeWaiter) bool { return o == w })
+		return len(c.waiters) < n
+	}
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{ch: make(chan time.Time, 1)}
+	t.stop = c.wait(d, func(now time.Time) { t.ch <- now })
+	return t
+}
+
+type fakeTimer struct {
+	ch   chan time.Time
+	stop func() bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool { return t.stop() }
+
+func (c *FakeClock) WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	fc := &fakeDeadlineContext{Context: ctx, deadline: c.Now().Add(d), done: make(chan struct{})}
+	if parent, ok := ctx.Deadline(); ok && parent.Before(fc.deadline) {
+		fc.deadline = parent
+	}
+	stopParent := context.AfterFunc(ctx, func() { fc.cancel(ctx.Err()) })
+	stopWait := c.wait(d, func(time.Time) { fc.cancel(context.DeadlineExceeded) })
+	return fc, func() {
+		stopParent()
+		stopWait()
+		fc.cancel(context.Canceled)
+	}
+}
+
+// fakeDeadlineContext is a context whose deadline is measured by a
+// FakeClock.
+type fakeDeadlineContext struct {
+	context.Context
+	deadline time.Time
+	done     chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *fakeDeadlineContext) Deadline() (time.Time, bool) { return c.deadline, true }
+
+func (c *fakeDeadlineContext) Done() <-chan struct{} { return c.done }
+
+func (c *fakeDeadlineContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *fakeDeadlineContext) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const CodeNotAcceptable = "not_acceptable"
+
+// Codec encodes response bodies in one format and decodes request bodies
+// from it. The first of mediaTypes is the one responses are labelled with;
+// the others are accepted as aliases.
+type Codec struct {
+	mediaTypes []string
+	encode     func(w io.Writer, v any) error
+	decode     func(r io.Reader, v any, rules decodeRules) error
+}
+
+func (c *Codec) MediaType() string {
+	return c.mediaTypes[0]
+}
+
+// Encode writes v. Whatever the format, values are laid out as they are
+// in JSON, with the field names of their json tags.
+func (c *Codec) Encode(w io.Writer, v any) error {
+	return c.encode(w, v)
+}
+
+// Decode reads the body r into v, refusing fields v does not have as the
+// JSON codec does.
+func (c *Codec) Decode(r io.Reader, v any) error {
+	return c.decode(r, v, strictDecoding)
+}
+
+// decodeBody reads the request body r into v by rules.
+func (c *Codec) decodeBody(r io.Reader, v any, rules decodeRules) error {
+	return c.decode(r, v, rules)
+}
+
+var (
+	jsonCodec = &Codec{
+		mediaTypes: []string{"application/json"},
+		encode:     func(w io.Writer, v any) error { return json.NewEncoder(w).Encode(v) },
+		decode:     decodeJSON,
+	}
+	xmlCodec = &Codec{
+		mediaTypes: []string{"application/xml", "text/xml"},
+		encode:     encodeXML,
+		decode:     decodeXML,
+	}
+	msgpackCodec = &Codec{
+		mediaTypes: []string{"application/msgpack", "application/vnd.msgpack", "application/x-msgpack"},
+		encode:     encodeMsgpack,
+		decode:     decodeMsgpack,
+	}
+)
+
+// codecs are the formats that api.formats can name.
+var codecs = map[string]*Codec{"json": jsonCodec, "xml": xmlCodec, "msgpack": msgpackCodec}
+
+// mediaTypes returns the media types of request bodies that formats can
+// decode.
+func mediaTypes(formats []string) []string {
+	var types []string
+	for _, f := range formats {
+		types = append(types, codecs[f].mediaTypes...)
+	}
+	return types
+}
+
+type codecsKey struct{}
+
+// negotiated is what Negotiate decided for a request.
+type negotiated struct {
+	response *Codec
+	all      []*Codec
+}
+
+// Negotiate picks the format of the response to each request from its
+// Accept header among the named formats, the first of which is served to
+// clients that accept anything, for respond, and lets Bind decode request
+// bodies in any of them. Requests that accept none of them get a 406
+// response, except those under the paths in exempt, which end in /, whose
+// responses come from elsewhere.
+func Negotiate(formats []string, exempt []string) Middleware {
+	all := make([]*Codec, len(formats))
+	for i, f := range formats {
+		all[i] = codecs[f]
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(all) > 1 {
+				w.Header().Add("Vary", "Accept")
+			}
+			c := acceptedCodec(r.Header.Values("Accept"), all)
+			if c == nil && slices.ContainsFunc(exempt, func(p string) bool { return strings.HasPrefix(r.URL.Path, p) }) {
+				c = all[0]
+			}
+			if c == nil {
+				WriteError(w, r, NewAPIError(http.StatusNotAcceptable, CodeNotAcceptable,
+					fmt.Sprintf("responses can only be one of %s", strings.Join(mediaTypes(formats), ", "))))
+				return
+			}
+			ctx := context.WithValue(r.Context(), codecsKey{}, negotiated{response: c, all: all})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// acceptedCodec returns the codec among all that the Accept headers
+// accept with the highest quality, the first if they accept anything or
+// are missing, and nil if they accept none. Media types with a +json or
+// +xml suffix, such as those naming an API version, count as JSON or XML.
+func acceptedCodec(accept []string, all []*Codec) *Codec {
+	if len(accept) == 0 {
+		return all[0]
+	}
+	var best *Codec
+	bestQ := 0.0
+	for _, header := range accept {
+		for _, media := range strings.Split(header, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(media))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			if q <= bestQ {
+				continue
+			}
+			var c *Codec
+			switch {
+			case mt == "*/*" || mt == "application/*":
+				c = all[0]
+			case strings.HasSuffix(mt, "+json"):
+				c = findCodec(all, "application/json")
+			case strings.HasSuffix(mt, "+xml"):
+				c = findCodec(all, "application/xml")
+			default:
+				c = findCodec(all, mt)
+			}
+			if c != nil {
+				best, bestQ = c, q
+			}
+		}
+	}
+	return best
+}
+
+func findCodec(all []*Codec, mediaType string) *Codec {
+	for _, c := range all {
+		if slices.Contains(c.mediaTypes, mediaType) {
+			return c
+		}
+	}
+	return nil
+}
+
+// responseCodec returns the codec Negotiate picked for the request of
+// ctx, or the JSON codec if it has not seen it.
+func responseCodec(ctx context.Context) *Codec {
+	if n, ok := ctx.Value(codecsKey{}).(negotiated); ok {
+		return n.response
+	}
+	return jsonCodec
+}
+
+// requestCodec returns the codec for the body of r by its Content-Type,
+// among those Negotiate allows, or the JSON codec if none matches.
+func requestCodec(r *http.Request) *Codec {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if n, ok := r.Context().Value(codecsKey{}).(negotiated); ok {
+		if c := findCodec(n.all, mt); c != nil {
+			return c
+		}
+	}
+	return jsonCodec
+}
+
+// jsonObject is a JSON object with its members in order.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	Key   string
+	Value any
+}
+
+// MarshalJSON encodes o with its members in order.
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, m := range o {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		key, err := json.Marshal(m.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(append(buf, key...), ':'), value...)
+	}
+	return append(buf, '}'), nil
+}
+
+// jsonTree returns v as the tree of jsonObject, []any, string,
+// json.Number, bool and nil values that its JSON encoding forms.
+func jsonTree(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return readJSONTree(dec)
+}
+
+func readJSONTree(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := jsonObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := readJSONTree(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, jsonMember{Key: key.(string), Value: v})
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			v, err := readJSONTree(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// decodeTree decodes tree, whose objects are map[string]any, into v
+// through its JSON encoding, so that v is filled as jsonCodec would.
+func decodeTree(tree any, v any, rules decodeRules) error {
+	b, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(bytes.NewReader(b), v, rules)
+}
+
+// XML documents have a response element holding an element per field, by
+// its JSON name, and an item element per element of an array. Null fields
+// are left empty.
+
+func encodeXML(w io.Writer, v any) error {
+	tree, err := jsonTree(v)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	if err := writeXMLElement(enc, "response", tree); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func writeXMLElement(enc *xml.Encoder, name string, v any) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !validXMLName(name) {
+		start = xml.StartElement{Name: xml.Name{Local: "entry"}, Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}}}
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case jsonObject:
+		for _, m := range v {
+			if err := writeXMLElement(enc, m.Key, m.Value); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if err := writeXMLElement(enc, "item", item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(fmt.Sprint(v))); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// validXMLName reports whether s can be used as an element name as it is.
+func validXMLName(s string) bool {
+	if s == "" || strings.HasPrefix(strings.ToLower(s), "xml") {
+		return false
+	}
+	for i, c := range s {
+		letter := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+		if !letter && (i == 0 || !('0' <= c && c <= '9' || c == '-' || c == '.')) {
+			return false
+		}
+	}
+	return true
+}
+
+// xmlNode is an element of a decoded XML document.
+type xmlNode struct {
+	name     string
+	text     string
+	children []*xmlNode
+}
+
+func decodeXML(r io.Reader, v any, rules decodeRules) error {
+	dec := xml.NewDecoder(r)
+	var stack []*xmlNode
+	var root *xmlNode
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name.Local}
+			for _, a := range t.Attr {
+				if n.name == "entry" && a.Name.Local == "key" {
+					n.name = a.Value
+				}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			} else {
+				return errors.New("XML document has more than one root element")
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return errors.New("XML document has no root element")
+	}
+	return decodeTree(xmlValue(reflect.TypeOf(v).Elem(), root), v, rules)
+}
+
+// xmlValue returns the value of n as a tree for decodeTree, using t, the
+// type n is decoded into, to tell arrays, numbers and booleans from
+// strings, none of which XML distinguishes.
+func xmlValue(t reflect.Type, n *xmlNode) any {
+	if t.Kind() == reflect.Pointer {
+		if len(n.children) == 0 && strings.TrimSpace(n.text) == "" {
+			return nil
+		}
+		t = t.Elem()
+	}
+	if t == timeType {
+		return strings.TrimSpace(n.text)
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj := make(map[string]any, len(n.children))
+		for _, c := range n.children {
+			if f, ok := jsonField(t, c.name); ok {
+				obj[c.name] = xmlValue(f.Type, c)
+			} else {
+				obj[c.name] = xmlUntyped(c)
+			}
+		}
+		return obj
+	case reflect.Map:
+		obj := make(map[string]any, len(n.children))
+		for _, c := range n.children {
+			obj[c.name] = xmlValue(t.Elem(), c)
+		}
+		return obj
+	case reflect.Slice, reflect.Array:
+		list := make([]any, len(n.children))
+		for i, c := range n.children {
+			list[i] = xmlValue(t.Elem(), c)
+		}
+		return list
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(strings.TrimSpace(n.text)); err == nil {
+			return b
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		s := strings.TrimSpace(n.text)
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case reflect.String:
+		return n.text
+	default:
+		return xmlUntyped(n)
+	}
+	return n.text
+}
+
+// xmlUntyped returns the value of n without a type to go by: an object if
+// it has children, an array if they are all items, and its text if not.
+func xmlUntyped(n *xmlNode) any {
+	if len(n.children) == 0 {
+		return n.text
+	}
+	if !slices.ContainsFunc(n.children, func(c *xmlNode) bool { return c.name != "item" }) {
+		list := make([]any, len(n.children))
+		for i, c := range n.children {
+			list[i] = xmlUntyped(c)
+		}
+		return list
+	}
+	obj := make(map[string]any, len(n.children))
+	for _, c := range n.children {
+		obj[c.name] = xmlUntyped(c)
+	}
+	return obj
+}
+
+// jsonField returns the field of struct type t, or of a struct embedded
+// in it, with the JSON name name.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		// The fields of embedded structs are promoted even when the type
+		// embedded is unexported, as encoding/json does.
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			if sf, ok := jsonField(f.Type, name); ok {
+				return sf, true
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if jsonFieldName(f) == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func encodeMsgpack(w io.Writer, v any) error {
+	tree, err := jsonTree(v)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	b, err = appendMsgpack(b, tree)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func appendMsgpack(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f)), nil
+	case string:
+		b = appendMsgpackHeader(b, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		return append(b, v...), nil
+	case []any:
+		b = appendMsgpackHeader(b, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			var err error
+			if b, err = appendMsgpack(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case jsonObject:
+		b = appendMsgpackHeader(b, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, m := range v {
+			var err error
+			if b, err = appendMsgpack(b, m.Key); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, m.Value); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("msgpack: cannot encode %T", v)
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 127, n >= -32 && n < 0:
+		return append(b, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+// appendMsgpackHeader appends the header of a string, array or map of n
+// elements: a fix format of prefix if n is at most fixMax, and otherwise
+// the 8-bit (if there is one), 16-bit or 32-bit format.
+func appendMsgpackHeader(b []byte, n int, prefix byte, fixMax int, f8, f16, f32 byte) []byte {
+	switch {
+	case n <= fixMax:
+		return append(b, prefix|byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		return append(b, f8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, f16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, f32), uint32(n))
+}
+
+func decodeMsgpack(r io.Reader, v any, rules decodeRules) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	d := &msgpackDecoder{b: b}
+	tree, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	if d.off != len(d.b) {
+		return errors.New("msgpack: data after the top-level value")
+	}
+	return decodeTree(tree, v, rules)
+}
+
+// maxMsgpackDepth bounds the nesting of decoded values.
+const maxMsgpackDepth = 64
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+type msgpackDecoder struct {
+	b   []byte
+	off int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.b)-d.off < n {
+		return nil, errMsgpackShort
+	}
+	p := d.b[d.off : d.off+n]
+	d.off += n
+	return p, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	p, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range p {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *msgpackDecoder) value(depth int) (any, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack: values nested too deeply")
+	}
+	p, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := p[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return d.object(int(c&0x0f), depth)
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2, c == 0xc3:
+		return c == 0xc3, nil
+	case c == 0xcc, c == 0xcd, c == 0xce, c == 0xcf:
+		return d.uint(1 << (c - 0xcc))
+	case c == 0xd0, c == 0xd1, c == 0xd2, c == 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		// Sign-extend from the size of the value.
+		return int64(n<<(64-8*size)) >> (64 - 8*size), err
+	case c == 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case c == 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case c == 0xd9, c == 0xda, c == 0xdb, c == 0xc4, c == 0xc5, c == 0xc6:
+		size := map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4, 0xc4: 1, 0xc5: 2, 0xc6: 4}[c]
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case c == 0xdc, c == 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case c == 0xde, c == 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", p[0])
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	p, err := d.next(n)
+	return string(p), err
+}
+
+func (d *msgpackDecoder) array(n, depth int) (any, error) {
+	if n > len(d.b)-d.off {
+		return nil, errMsgpackShort
+	}
+	list := make([]any, n)
+	for i := range list {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+func (d *msgpackDecoder) object(n, depth int) (any, error) {
+	if n > len(d.b)-d.off {
+		return nil, errMsgpackShort
+	}
+	obj := make(map[string]any, n)
+	for range n {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key is %T, not a string", k)
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = v
+	}
+	return obj, nil
+}
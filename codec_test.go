@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type codecItem struct {
+	ID    int     `json:"id"`
+	Price float64 `json:"price"`
+}
+
+type codecSample struct {
+	Name    string            `json:"name"`
+	Count   int               `json:"count"`
+	Big     int64             `json:"big"`
+	Ratio   float64           `json:"ratio"`
+	OK      bool              `json:"ok"`
+	Note    *string           `json:"note"`
+	Missing *int              `json:"missing"`
+	Tags    []string          `json:"tags"`
+	Labels  map[string]string `json:"labels"`
+	Items   []codecItem       `json:"items"`
+	At      time.Time         `json:"at"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	note := "a note"
+	in := codecSample{
+		Name:   `<Flint & "Chalk"> é`,
+		Count:  -40000,
+		Big:    math.MaxInt64,
+		Ratio:  0.25,
+		OK:     true,
+		Note:   &note,
+		Tags:   []string{"grey", "", "round"},
+		Labels: map[string]string{"colour": "grey", "2nd key": "not an element name", "xmlns": "reserved"},
+		Items:  []codecItem{{ID: 1, Price: 1.5}, {ID: 200, Price: 3}},
+		At:     time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC),
+	}
+	for _, c := range []*Codec{jsonCodec, xmlCodec, msgpackCodec} {
+		t.Run(c.MediaType(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := c.Encode(&buf, in); err != nil {
+				t.Fatal(err)
+			}
+			var out codecSample
+			if err := c.Decode(&buf, &out); err != nil {
+				t.Fatalf("decoding %q: %v", buf.Bytes(), err)
+			}
+			if !reflect.DeepEqual(out, in) {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+func TestEncodeXML(t *testing.T) {
+	var buf bytes.Buffer
+	v := map[string]any{"name": "Flint", "tags": []string{"a"}, "note": nil, "2nd": 1}
+	if err := xmlCodec.Encode(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	want := xml.Header +
+		`<response><entry key="2nd">1</entry><name>Flint</name><note></note><tags><item>a</item></tags></response>`
+	if buf.String() != want {
+		t.Errorf("got %s, want %s", buf.String(), want)
+	}
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	tests := []struct {
+		v    any
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{-1, []byte{0xff}},
+		{-32, []byte{0xe0}},
+		{-33, []byte{0xd0, 0xdf}},
+		{128, []byte{0xd1, 0x00, 0x80}},
+		{-32768, []byte{0xd1, 0x80, 0x00}},
+		{32768, []byte{0xd2, 0x00, 0x00, 0x80, 0x00}},
+		{int64(1) << 31, []byte{0xd3, 0, 0, 0, 0, 0x80, 0, 0, 0}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{nil, []byte{0xc0}},
+		{false, []byte{0xc2}},
+		{true, []byte{0xc3}},
+		{"", []byte{0xa0}},
+		{strings.Repeat("a", 31), append([]byte{0xbf}, strings.Repeat("a", 31)...)},
+		{strings.Repeat("a", 32), append([]byte{0xd9, 32}, strings.Repeat("a", 32)...)},
+		{strings.Repeat("a", 256), append([]byte{0xda, 0x01, 0x00}, strings.Repeat("a", 256)...)},
+		{[]int{}, []byte{0x90}},
+		{make([]bool, 16), append([]byte{0xdc, 0x00, 0x10}, bytes.Repeat([]byte{0xc2}, 16)...)},
+		{map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := msgpackCodec.Encode(&buf, tt.v); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), tt.want) {
+			t.Errorf("%v: got % x, want % x", tt.v, buf.Bytes(), tt.want)
+		}
+	}
+}
+
+func TestDecodeMsgpackFormats(t *testing.T) {
+	// Formats this server does not write but other encoders do.
+	tests := []struct {
+		b    []byte
+		want any
+	}{
+		{[]byte{0xcc, 0xff}, uint64(255)},
+		{[]byte{0xcd, 0xff, 0xff}, uint64(65535)},
+		{[]byte{0xce, 0xff, 0xff, 0xff, 0xff}, uint64(math.MaxUint32)},
+		{[]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(math.MaxUint64)},
+		{[]byte{0xd0, 0x80}, int64(-128)},
+		{[]byte{0xd2, 0xff, 0xff, 0xff, 0xfe}, int64(-2)},
+		{[]byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, 1.5},
+		{[]byte{0xc4, 0x02, 'h', 'i'}, "hi"},
+		{[]byte{0xdb, 0, 0, 0, 0x02, 'h', 'i'}, "hi"},
+		{[]byte{0xdd, 0, 0, 0, 0x01, 0xc0}, []any{nil}},
+		{[]byte{0xde, 0x00, 0x01, 0xa1, 'a', 0xc3}, map[string]any{"a": true}},
+	}
+	for _, tt := range tests {
+		d := &msgpackDecoder{b: tt.b}
+		v, err := d.value(0)
+		if err != nil || !reflect.DeepEqual(v, tt.want) || d.off != len(tt.b) {
+			t.Errorf("% x: got %#v, %v after %d bytes, want %#v", tt.b, v, err, d.off, tt.want)
+		}
+	}
+}
+
+func TestDecodeMsgpackErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{name: "empty", b: nil, want: errMsgpackShort.Error()},
+		{name: "cut in a string", b: []byte{0xa5, 'h', 'i'}, want: errMsgpackShort.Error()},
+		{name: "cut in a length", b: []byte{0xda, 0x01}, want: errMsgpackShort.Error()},
+		{name: "cut in a map", b: []byte{0x82, 0xa4, 'n', 'a', 'm', 'e', 0xa1, 'x'}, want: errMsgpackShort.Error()},
+		{name: "array longer than the data", b: []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0}, want: errMsgpackShort.Error()},
+		{name: "map longer than the data", b: []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xc0}, want: errMsgpackShort.Error()},
+		{name: "string longer than the data", b: []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}, want: errMsgpackShort.Error()},
+		{name: "data after the value", b: []byte{0x80, 0xc0}, want: "msgpack: data after the top-level value"},
+		{name: "never used", b: []byte{0xc1}, want: "msgpack: unsupported type byte 0xc1"},
+		{name: "extension", b: []byte{0xd4, 0x01, 0x00}, want: "msgpack: unsupported type byte 0xd4"},
+		{name: "integer key", b: []byte{0x81, 0x01, 0x02}, want: "msgpack: map key is int64, not a string"},
+		{name: "null key", b: []byte{0x81, 0xc0, 0x02}, want: "msgpack: map key is <nil>, not a string"},
+		{name: "nested too deeply", b: append(bytes.Repeat([]byte{0x91}, maxMsgpackDepth+1), 0xc0), want: "msgpack: values nested too deeply"},
+		{name: "not a number", b: []byte{0x81, 0xa5, 'r', 'a', 't', 'i', 'o', 0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1}, want: "unsupported value: NaN"},
+		{name: "wrong type", b: []byte{0x81, 0xa5, 'c', 'o', 'u', 'n', 't', 0xa4, 'm', 'a', 'n', 'y'}, want: "body.count: expected integer"},
+		{name: "unknown field", b: []byte{0x81, 0xa6, 'c', 'o', 'l', 'o', 'u', 'r', 0x01}, want: "body.colour: unknown field"},
+		{name: "not an object", b: []byte{0x91, 0x01}, want: "body: expected object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v codecSample
+			err := msgpackCodec.Decode(bytes.NewReader(tt.b), &v)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error saying %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeXMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{name: "empty", doc: "", want: "XML document has no root element"},
+		{name: "only a declaration", doc: xml.Header, want: "XML document has no root element"},
+		{name: "two roots", doc: "<response></response><response></response>", want: "XML document has more than one root element"},
+		{name: "unclosed element", doc: "<response><name>Flint</response>", want: "element <name> closed by </response>"},
+		{name: "cut short", doc: "<response><name>Flint</name>", want: "unexpected EOF"},
+		{name: "undefined entity", doc: "<response><name>&bogus;</name></response>", want: "invalid character entity &bogus;"},
+		{name: "wrong type", doc: "<response><count>many</count></response>", want: "body.count: expected integer"},
+		{name: "not a boolean", doc: "<response><ok>yes</ok></response>", want: "body.ok: expected boolean"},
+		{name: "unknown field", doc: "<response><colour>grey</colour></response>", want: "body.colour: unknown field"},
+		{name: "unknown field in an item", doc: "<response><items><item><sku>1</sku></item></items></response>", want: "body.items[0].sku: unknown field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v codecSample
+			err := xmlCodec.Decode(strings.NewReader(tt.doc), &v)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error saying %q", err, tt.want)
+			}
+		})
+	}
+
+	// Bodies of other encoders, with attributes, comments and
+	// whitespace, decode as the same document would without them.
+	doc := xml.Header + `<!-- a pebble -->
+<pebble xmlns="urn:example">
+  <name>Flint</name>
+  <count> 3 </count>
+  <ok>true</ok>
+  <note/>
+  <labels><entry key="2nd key">x</entry></labels>
+</pebble>`
+	var v codecSample
+	if err := xmlCodec.Decode(strings.NewReader(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "Flint" || v.Count != 3 || !v.OK || v.Note != nil || v.Labels["2nd key"] != "x" {
+		t.Errorf("got %+v", v)
+	}
+	// Decoding needs a type to tell numbers from strings; where there is
+	// none, as in an untyped map, the text is kept.
+	var m map[string]any
+	if err := xmlCodec.Decode(strings.NewReader("<response><n>1</n><list><item>a</item></list></response>"), &m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]any{"n": "1", "list": []any{"a"}}; !reflect.DeepEqual(m, want) {
+		t.Errorf("got %#v, want %#v", m, want)
+	}
+}
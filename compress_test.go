@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"gzip;Q=0", false},
+		{"br, deflate", false},
+		{"identity", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"br;q=1, *;q=0.1", true},
+		// The most specific member applies, whatever its order.
+		{"*, gzip;q=0", false},
+		{"gzip;q=0, *", false},
+		{"*;q=0, gzip", true},
+		{"gzip, *;q=0", true},
+		{"*;q=0, gzip;q=0", false},
+		// Members that cannot be parsed are ignored.
+		{"gzip;q=high", false},
+		{"gzip;q=2", false},
+		{"gzip;q=high, *", true},
+		{"gzip;level=9;q=0", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", tt.header, got, tt.want)
+		}
+	}
+}
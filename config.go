@@ -0,0 +1,1992 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings used to run the server. Values start from
+// DefaultConfig, are overridden by an optional JSON config file and finally
+// by environment variables named in the env struct tags. The values tags
+// list the values of the settings that take one of a few.
+type Config struct {
+	Port              int      `json:"port" env:"PORT"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout" env:"READ_HEADER_TIMEOUT"`
+	ReadTimeout       Duration `json:"read_timeout" env:"READ_TIMEOUT"`
+	WriteTimeout      Duration `json:"write_timeout" env:"WRITE_TIMEOUT"`
+	IdleTimeout       Duration `json:"idle_timeout" env:"IDLE_TIMEOUT"`
+	MaxHeaderBytes    int      `json:"max_header_bytes" env:"MAX_HEADER_BYTES"`
+	RequestTimeout    Duration `json:"request_timeout" env:"REQUEST_TIMEOUT"`
+	ShutdownTimeout   Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	ShutdownDelay     Duration `json:"shutdown_delay" env:"SHUTDOWN_DELAY"`
+	HealthTimeout     Duration `json:"health_timeout" env:"HEALTH_TIMEOUT"`
+
+	// H2C makes the HTTP listener accept HTTP/2 without TLS, as proxies
+	// forwarding gRPC send it, and serve gRPC requests arriving on it.
+	H2C bool `json:"h2c" env:"H2C"`
+
+	// ReusePort binds the TCP listeners with SO_REUSEPORT, so that a new
+	// instance, such as one running an upgraded binary, can listen on the
+	// same ports while this one drains.
+	ReusePort bool `json:"reuse_port" env:"REUSE_PORT"`
+
+	// Development enables behaviour that helps while working on the
+	// server but is unsuitable for production, such as re-raising panics.
+	Development bool `json:"development" env:"DEVELOPMENT"`
+
+	// Demo runs the server with in-memory fakes of everything it depends
+	// on and sample data, overriding the settings that would reach
+	// outside the process. The -demo flag sets it.
+	Demo bool `json:"demo" env:"DEMO"`
+
+	// TrustedProxies are the addresses and CIDR prefixes of the proxies
+	// in front of the server, whose forwarding headers are believed, and
+	// unix for proxies connecting over a Unix socket.
+	TrustedProxies []string `json:"trusted_proxies" env:"TRUSTED_PROXIES"`
+
+	Listen      ListenConfig      `json:"listen"`
+	Listeners   []ListenerConfig  `json:"listeners"`
+	Log         LogConfig         `json:"log"`
+	TLS         TLSConfig         `json:"tls"`
+	Metrics     MetricsConfig     `json:"metrics"`
+	Storage     StorageConfig     `json:"storage"`
+	Auth        AuthConfig        `json:"auth"`
+	RateLimit   RateLimitConfig   `json:"rate_limit"`
+	IPFilter    IPFilterConfig    `json:"ip_filter"`
+	RequestBody RequestBodyConfig `json:"request_body"`
+	CORS        CORSConfig        `json:"cors"`
+	Compression CompressionConfig `json:"compression"`
+	OpenAPI     OpenAPIConfig     `json:"openapi"`
+	Events      EventsConfig      `json:"events"`
+	GRPC        GRPCConfig        `json:"grpc"`
+	Tracing     TracingConfig     `json:"tracing"`
+	Admin       AdminConfig       `json:"admin"`
+	Idempotency IdempotencyConfig `json:"idempotency"`
+	Jobs        JobsConfig        `json:"jobs"`
+	Scheduler   SchedulerConfig   `json:"scheduler"`
+	Webhooks    WebhooksConfig    `json:"webhooks"`
+	Cache       CacheConfig       `json:"cache"`
+	HTTPCache   HTTPCacheConfig   `json:"http_cache"`
+	Frontend    FrontendConfig    `json:"frontend"`
+	API         APIConfig         `json:"api"`
+	Maintenance MaintenanceConfig `json:"maintenance"`
+	Audit       AuditConfig       `json:"audit"`
+	SoftDelete  SoftDeleteConfig  `json:"soft_delete"`
+	Batch       BatchConfig       `json:"batch"`
+	Attachments AttachmentsConfig `json:"attachments"`
+	Fixtures    FixturesConfig    `json:"fixtures"`
+	Proxy       ProxyConfig       `json:"proxy"`
+	GraphQL     GraphQLConfig     `json:"graphql"`
+	Tenancy     TenancyConfig     `json:"tenancy"`
+	LoadShed    LoadShedConfig    `json:"load_shed"`
+	Resilience  ResilienceConfig  `json:"resilience"`
+	Flags       FlagsConfig       `json:"feature_flags"`
+
+	SlowRequests SlowRequestsConfig `json:"slow_requests"`
+	Startup      StartupConfig      `json:"startup"`
+	Chaos        ChaosConfig        `json:"chaos"`
+	Capture      CaptureConfig      `json:"capture"`
+
+	SecurityHeaders SecurityHeadersConfig `json:"security_headers"`
+
+	InboundWebhooks InboundWebhooksConfig `json:"inbound_webhooks"`
+
+	I18n I18nConfig `json:"i18n"`
+
+	SLO SLOConfig `json:"slo"`
+
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol"`
+}
+
+// ListenConfig selects what the HTTP server listens on. Network is "tcp"
+// for port, on the address Host or on every interface if it is empty,
+// "unix" for a Unix socket at Path created with the octal permissions in
+// Mode, or "systemd" for a socket passed by systemd socket activation, the
+// one named Name if several are passed. Family picks the IP version of the
+// TCP listeners: "ipv4" or "ipv6" only, or "any" for both, as a wildcard
+// address with "any" is dual-stack. The admin and gRPC listeners always
+// use TCP.
+type ListenConfig struct {
+	Network string `json:"network" env:"LISTEN_NETWORK" values:"tcp,unix,systemd"`
+	Host    string `json:"host" env:"LISTEN_HOST"`
+	Family  string `json:"family" env:"LISTEN_FAMILY" values:"any,ipv4,ipv6"`
+	Path    string `json:"path" env:"LISTEN_SOCKET_PATH"`
+	Mode    string `json:"mode" env:"LISTEN_SOCKET_MODE"`
+	Name    string `json:"name" env:"LISTEN_SYSTEMD_NAME"`
+}
+
+// checkBindable reports an error unless a TCP listener can be bound on
+// Host in Family, trying it on a port of the system's choosing so that a
+// running server holding port does not fail the check.
+func (c ListenConfig) checkBindable() error {
+	if ip := net.ParseIP(c.Host); ip != nil {
+		switch {
+		case c.Family == "ipv4" && ip.To4() == nil:
+			return fmt.Errorf("%q is not an IPv4 address", c.Host)
+		case c.Family == "ipv6" && ip.To4() != nil:
+			return fmt.Errorf("%q is not an IPv6 address", c.Host)
+		}
+	}
+	ln, err := net.Listen(tcpNetwork(c.Family), net.JoinHostPort(c.Host, "0"))
+	if err != nil {
+		return fmt.Errorf("cannot bind %q: %w", c.Host, err)
+	}
+	return ln.Close()
+}
+
+// FileMode returns Mode parsed as octal permissions.
+func (c ListenConfig) FileMode() (fs.FileMode, error) {
+	return parseFileMode(c.Mode)
+}
+
+func parseFileMode(s string) (fs.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n&^uint64(fs.ModePerm) != 0 {
+		return 0, fmt.Errorf("%q is not octal permissions such as 0660", s)
+	}
+	return fs.FileMode(n), nil
+}
+
+// ListenerConfig is an extra listener serving what Serve names: "api" for
+// the HTTP API, with the same middleware and TLS settings as the main
+// listener, "admin" for the admin endpoints or "grpc" for the gRPC
+// transport. Address is a host:port for the tcp Network, the socket path
+// for unix and the socket's name for systemd. Mode is the octal
+// permissions of a Unix socket, 0660 if empty. Listeners can only be set
+// in the config file.
+type ListenerConfig struct {
+	Name    string `json:"name"`
+	Serve   string `json:"serve" values:"api,admin,grpc"`
+	Network string `json:"network" values:"tcp,unix,systemd"`
+	Address string `json:"address"`
+	Mode    string `json:"mode"`
+}
+
+type LogConfig struct {
+	Level  string          `json:"level" env:"LOG_LEVEL" values:"debug,info,warn,error"`
+	Format string          `json:"format" env:"LOG_FORMAT" values:"text,json"`
+	Body   BodyLogConfig   `json:"body"`
+	Access AccessLogConfig `json:"access"`
+	Sinks  []LogSinkConfig `json:"sinks"`
+}
+
+// LogSinkConfig is one of the destinations of the log, which receives
+// every record at or above its Level, log.level if empty, in its Format,
+// log.format if empty. Type is stdout, stderr, file, syslog or journald.
+// A file sink writes to Path, rotated like the access log file by
+// MaxBytes, MaxAge and MaxBackups. Address is the syslog server as
+// udp://host:port, tcp://host:port or unix:///path, the local syslog
+// daemon if empty, or for journald the socket of the journal, and Tag
+// names the program to them, pebble-api if empty. Sinks can only be set
+// in the config file; without any the log goes to stderr.
+type LogSinkConfig struct {
+	Type       string   `json:"type" values:"stdout,stderr,file,syslog,journald"`
+	Level      string   `json:"level" values:"debug,info,warn,error"`
+	Format     string   `json:"format" values:"text,json"`
+	Path       string   `json:"path"`
+	MaxBytes   int64    `json:"max_bytes"`
+	MaxAge     Duration `json:"max_age"`
+	MaxBackups int      `json:"max_backups"`
+	Address    string   `json:"address"`
+	Tag        string   `json:"tag"`
+}
+
+// AccessLogConfig writes an access log in the Common or Combined Log
+// Format, besides the structured log. Output is stdout, stderr or the path
+// of a file, which is rotated once it grows past MaxBytes or is MaxAge
+// old, keeping MaxBackups rotated files; a zero limit disables it.
+type AccessLogConfig struct {
+	Enabled    bool     `json:"enabled" env:"LOG_ACCESS_ENABLED"`
+	Format     string   `json:"format" env:"LOG_ACCESS_FORMAT" values:"common,combined"`
+	Output     string   `json:"output" env:"LOG_ACCESS_OUTPUT"`
+	MaxBytes   int64    `json:"max_bytes" env:"LOG_ACCESS_MAX_BYTES"`
+	MaxAge     Duration `json:"max_age" env:"LOG_ACCESS_MAX_AGE"`
+	MaxBackups int      `json:"max_backups" env:"LOG_ACCESS_MAX_BACKUPS"`
+}
+
+// BodyLogConfig configures logging of request and response bodies for
+// troubleshooting. Bodies over MaxBytes are not logged, and JSON and form
+// fields named in RedactFields, compared without case, are hidden.
+type BodyLogConfig struct {
+	Enabled      bool     `json:"enabled" env:"LOG_BODY_ENABLED"`
+	MaxBytes     int      `json:"max_bytes" env:"LOG_BODY_MAX_BYTES"`
+	RedactFields []string `json:"redact_fields" env:"LOG_BODY_REDACT_FIELDS"`
+}
+
+type TLSConfig struct {
+	CertFile       string   `json:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile        string   `json:"key_file" env:"TLS_KEY_FILE"`
+	ReloadInterval Duration `json:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+	RedirectPort   int      `json:"redirect_port" env:"TLS_REDIRECT_PORT"`
+}
+
+type MetricsConfig struct {
+	Enabled bool `json:"enabled" env:"METRICS_ENABLED"`
+}
+
+// RateLimitConfig limits every client, identified by its API key or IP
+// address, to Rate requests per second with bursts of up to Burst.
+type RateLimitConfig struct {
+	Enabled bool     `json:"enabled" env:"RATE_LIMIT_ENABLED"`
+	Rate    float64  `json:"rate" env:"RATE_LIMIT_RATE"`
+	Burst   int      `json:"burst" env:"RATE_LIMIT_BURST"`
+	IdleTTL Duration `json:"idle_ttl" env:"RATE_LIMIT_IDLE_TTL"`
+}
+
+// IPFilterConfig restricts which client addresses may make requests to
+// the HTTP API, with Allow and Deny, and to the admin endpoints, with
+// AdminAllow and AdminDeny. Entries are IP addresses or CIDR prefixes.
+// Clients in a deny list are refused, and so are clients outside an allow
+// list that is not empty.
+type IPFilterConfig struct {
+	Allow      []string `json:"allow" env:"IP_FILTER_ALLOW"`
+	Deny       []string `json:"deny" env:"IP_FILTER_DENY"`
+	AdminAllow []string `json:"admin_allow" env:"IP_FILTER_ADMIN_ALLOW"`
+	AdminDeny  []string `json:"admin_deny" env:"IP_FILTER_ADMIN_DENY"`
+}
+
+// RequestBodyConfig limits request bodies to MaxBytes, or to the size
+// given for a route in Routes with entries such as "POST /pebbles=65536",
+// and to the media types in ContentTypes. Their objects and arrays may
+// nest at most MaxDepth deep, and members the route does not know are
+// refused, except by the routes in AllowUnknownFields, such as
+// "PUT /pebbles/{id}", which ignore them.
+type RequestBodyConfig struct {
+	MaxBytes           int64    `json:"max_bytes" env:"REQUEST_BODY_MAX_BYTES"`
+	Routes             []string `json:"routes" env:"REQUEST_BODY_ROUTES"`
+	ContentTypes       []string `json:"content_types" env:"REQUEST_BODY_CONTENT_TYPES"`
+	MaxDepth           int      `json:"max_depth" env:"REQUEST_BODY_MAX_DEPTH"`
+	AllowUnknownFields []string `json:"allow_unknown_fields" env:"REQUEST_BODY_ALLOW_UNKNOWN_FIELDS"`
+}
+
+// CORSConfig configures cross-origin requests from browsers, which are
+// refused unless AllowedOrigins is set. The routes under /admin/ only
+// accept the origins in Admin.
+type CORSConfig struct {
+	AllowedOrigins   []string        `json:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods   []string        `json:"allowed_methods" env:"CORS_ALLOWED_METHODS"`
+	AllowedHeaders   []string        `json:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	ExposedHeaders   []string        `json:"exposed_headers" env:"CORS_EXPOSED_HEADERS"`
+	AllowCredentials bool            `json:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	MaxAge           Duration        `json:"max_age" env:"CORS_MAX_AGE"`
+	Admin            CORSAdminConfig `json:"admin"`
+}
+
+type CORSAdminConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins" env:"CORS_ADMIN_ALLOWED_ORIGINS"`
+	AllowCredentials bool     `json:"allow_credentials" env:"CORS_ADMIN_ALLOW_CREDENTIALS"`
+}
+
+// CompressionConfig enables gzip for responses of at least MinSize bytes
+// whose media type is listed in ContentTypes.
+type CompressionConfig struct {
+	Enabled      bool     `json:"enabled" env:"COMPRESSION_ENABLED"`
+	MinSize      int      `json:"min_size" env:"COMPRESSION_MIN_SIZE"`
+	ContentTypes []string `json:"content_types" env:"COMPRESSION_CONTENT_TYPES"`
+}
+
+// OpenAPIConfig controls serving the generated API description at
+// /openapi.json and, with Docs set, Swagger UI at /docs.
+type OpenAPIConfig struct {
+	Enabled bool `json:"enabled" env:"OPENAPI_ENABLED"`
+	Docs    bool `json:"docs" env:"OPENAPI_DOCS"`
+}
+
+// EventsConfig configures the change events published when pebbles are
+// created, updated or deleted. History events are kept for clients that
+// reconnect. Publisher selects where events are sent besides the
+// in-process streams: "none" or "nats". LongPollTimeout is how long GET
+// /pebbles/changes waits for a change before responding without one.
+type EventsConfig struct {
+	History         int          `json:"history" env:"EVENTS_HISTORY"`
+	Publisher       string       `json:"publisher" env:"EVENTS_PUBLISHER" values:"none,nats"`
+	NATS            NATSConfig   `json:"nats"`
+	LongPollTimeout Duration     `json:"long_poll_timeout" env:"EVENTS_LONG_POLL_TIMEOUT"`
+	Outbox          OutboxConfig `json:"outbox"`
+}
+
+// OutboxConfig makes a database storage backend keep the events of
+// changes in an outbox table, written in the transaction of the change,
+// from which a relay publishes them, BatchSize at a time, as soon as they
+// commit and at least every PollInterval.
+type OutboxConfig struct {
+	Enabled      bool     `json:"enabled" env:"EVENTS_OUTBOX_ENABLED"`
+	PollInterval Duration `json:"poll_interval" env:"EVENTS_OUTBOX_POLL_INTERVAL"`
+	BatchSize    int      `json:"batch_size" env:"EVENTS_OUTBOX_BATCH_SIZE"`
+}
+
+// GRPCConfig configures the gRPC transport, which serves the same pebble
+// operations as the REST API on its own port. A Port of 0 disables it.
+// Gateway serves the google.api.http rules of the proto definitions as
+// JSON endpoints on the main port, whether or not Port is set.
+type GRPCConfig struct {
+	Port    int  `json:"port" env:"GRPC_PORT"`
+	Gateway bool `json:"gateway" env:"GRPC_GATEWAY"`
+}
+
+// TracingConfig configures OpenTelemetry tracing. Spans are exported with
+// OTLP over HTTP to Endpoint, such as http://localhost:4318, and an empty
+// Endpoint disables tracing. The environment variables are the standard
+// OpenTelemetry ones where there is one.
+type TracingConfig struct {
+	Endpoint       string   `json:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	Headers        []string `json:"headers" env:"OTEL_EXPORTER_OTLP_HEADERS"`
+	ServiceName    string   `json:"service_name" env:"OTEL_SERVICE_NAME"`
+	SampleRatio    float64  `json:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+	BatchSize      int      `json:"batch_size" env:"TRACING_BATCH_SIZE"`
+	ExportInterval Duration `json:"export_interval" env:"TRACING_EXPORT_INTERVAL"`
+}
+
+// IdempotencyConfig controls replaying the responses to POST requests
+// that carry an Idempotency-Key header. Responses are kept in memory for
+// TTL.
+type IdempotencyConfig struct {
+	Enabled bool     `json:"enabled" env:"IDEMPOTENCY_ENABLED"`
+	TTL     Duration `json:"ttl" env:"IDEMPOTENCY_TTL"`
+}
+
+// JobsConfig configures the background job queue. Failed jobs are retried
+// up to MaxAttempts times in all, waiting InitialBackoff after the first
+// failure and twice as long after each further one, up to MaxBackoff.
+type JobsConfig struct {
+	Workers        int      `json:"workers" env:"JOBS_WORKERS"`
+	QueueSize      int      `json:"queue_size" env:"JOBS_QUEUE_SIZE"`
+	MaxAttempts    int      `json:"max_attempts" env:"JOBS_MAX_ATTEMPTS"`
+	InitialBackoff Duration `json:"initial_backoff" env:"JOBS_INITIAL_BACKOFF"`
+	MaxBackoff     Duration `json:"max_backoff" env:"JOBS_MAX_BACKOFF"`
+}
+
+// SchedulerConfig sets when the scheduled jobs run. Jobs holds a schedule
+// by job name, purge_deleted or jwks_refresh, overriding the interval of
+// the job's own settings: a cron expression such as "0 3 * * *", a macro
+// such as @daily, "@every" and a duration or "off". Cron expressions are
+// in Timezone, an IANA name such as Europe/Paris, UTC or Local.
+//
+// Lock keeps the instances sharing a database from running a job at once:
+// "local" only keeps the runs of this instance apart, "postgres" takes
+// advisory locks in the postgres storage backend and "redis" takes locks,
+// expiring after LockTTL unless their holder extends them, on the server
+// of cache.redis. A lock is kept at least LockMinHold. Instance names this
+// instance as the holder of its locks, its host name and process ID if
+// empty.
+type SchedulerConfig struct {
+	Timezone    string            `json:"timezone" env:"SCHEDULER_TIMEZONE"`
+	Lock        string            `json:"lock" env:"SCHEDULER_LOCK" values:"local,postgres,redis"`
+	LockTTL     Duration          `json:"lock_ttl" env:"SCHEDULER_LOCK_TTL"`
+	LockMinHold Duration          `json:"lock_min_hold" env:"SCHEDULER_LOCK_MIN_HOLD"`
+	Instance    string            `json:"instance" env:"SCHEDULER_INSTANCE"`
+	Jobs        map[string]string `json:"jobs"`
+}
+
+// WebhooksConfig configures delivering events to webhooks. A delivery is
+// given up as dead after MaxAttempts attempts, each of which may take up
+// to Timeout.
+type WebhooksConfig struct {
+	MaxAttempts int      `json:"max_attempts" env:"WEBHOOKS_MAX_ATTEMPTS"`
+	Timeout     Duration `json:"timeout" env:"WEBHOOKS_TIMEOUT"`
+}
+
+// InboundWebhooksConfig configures receiving webhooks from other services
+// at POST /hooks/{provider}. Providers holds them by the name in the path,
+// and can only be set in the config file. A delivery whose ID was received
+// within DedupTTL is acknowledged without being processed again, and one
+// whose signature carries a time more than Tolerance from the server's is
+// rejected. Bodies may be up to MaxBytes long.
+type InboundWebhooksConfig struct {
+	Enabled   bool                             `json:"enabled" env:"INBOUND_WEBHOOKS_ENABLED"`
+	Providers map[string]InboundProviderConfig `json:"providers"`
+	Tolerance Duration                         `json:"tolerance" env:"INBOUND_WEBHOOKS_TOLERANCE"`
+	DedupTTL  Duration                         `json:"dedup_ttl" env:"INBOUND_WEBHOOKS_DEDUP_TTL"`
+	MaxBytes  int64                            `json:"max_bytes" env:"INBOUND_WEBHOOKS_MAX_BYTES"`
+}
+
+// InboundProviderConfig is a service sending webhooks. Type is how it signs
+// them with Secret: "github" as GitHub does, "stripe" as Stripe does or
+// "pebble" as the webhooks of this server are.
+type InboundProviderConfig struct {
+	Type   string `json:"type" values:"github,stripe,pebble"`
+	Secret string `json:"secret"`
+}
+
+// CacheConfig configures caching pebble reads. Backend is "none",
+// "memory" for a cache in each server instance or "redis" for one shared
+// through Redis. Cached pebbles are served for up to TTL.
+type CacheConfig struct {
+	Backend string      `json:"backend" env:"CACHE_BACKEND" values:"none,memory,redis"`
+	TTL     Duration    `json:"ttl" env:"CACHE_TTL"`
+	Redis   RedisConfig `json:"redis"`
+}
+
+type RedisConfig struct {
+	URL          string   `json:"url" env:"CACHE_REDIS_URL"`
+	MaxIdleConns int      `json:"max_idle_conns" env:"CACHE_REDIS_MAX_IDLE_CONNS"`
+	Timeout      Duration `json:"timeout" env:"CACHE_REDIS_TIMEOUT"`
+}
+
+// HTTPCacheConfig controls caching GET responses that their handlers
+// allow shared caches to keep. Responses are kept in the cache selected by
+// cache.backend, or in memory if there is none, and only if their body is
+// at most MaxBodyBytes long.
+type HTTPCacheConfig struct {
+	Enabled      bool `json:"enabled" env:"HTTP_CACHE_ENABLED"`
+	MaxBodyBytes int  `json:"max_body_bytes" env:"HTTP_CACHE_MAX_BODY_BYTES"`
+}
+
+// MaintenanceConfig puts the API into maintenance mode at start-up and on
+// reload, answering requests with a 503 response carrying Message and
+// telling clients to retry after RetryAfter. The mode can also be switched
+// at runtime through /admin/maintenance.
+type MaintenanceConfig struct {
+	Enabled    bool     `json:"enabled" env:"MAINTENANCE_ENABLED"`
+	Message    string   `json:"message" env:"MAINTENANCE_MESSAGE"`
+	RetryAfter Duration `json:"retry_after" env:"MAINTENANCE_RETRY_AFTER"`
+}
+
+// AuditConfig enables the audit log, which records every POST, PUT, PATCH
+// and DELETE request in the store, and /admin/audit, which lists it.
+type AuditConfig struct {
+	Enabled bool `json:"enabled" env:"AUDIT_ENABLED"`
+}
+
+// SoftDeleteConfig sets how long deleted pebbles can still be restored.
+// Every PurgeInterval, or on the purge_deleted schedule of
+// scheduler.jobs, the pebbles deleted more than Retention ago are removed
+// for good; a zero Retention keeps them forever.
+type SoftDeleteConfig struct {
+	Retention     Duration `json:"retention" env:"SOFT_DELETE_RETENTION"`
+	PurgeInterval Duration `json:"purge_interval" env:"SOFT_DELETE_PURGE_INTERVAL"`
+}
+
+// BatchConfig limits POST /pebbles:batch to MaxOperations operations per
+// request.
+type BatchConfig struct {
+	MaxOperations int `json:"max_operations" env:"BATCH_MAX_OPERATIONS"`
+}
+
+// AttachmentsConfig enables file attachments on pebbles, whose content is
+// kept in a blob store: a directory on local disk at Dir, or a bucket of an
+// S3-compatible service. Files may be at most MaxBytes long and must be of
+// one of ContentTypes, as told from their content. Download URLs are
+// signed with SigningKey and expire after URLTTL.
+type AttachmentsConfig struct {
+	Enabled      bool     `json:"enabled" env:"ATTACHMENTS_ENABLED"`
+	Backend      string   `json:"backend" env:"ATTACHMENTS_BACKEND" values:"local,s3"`
+	Dir          string   `json:"dir" env:"ATTACHMENTS_DIR"`
+	S3           S3Config `json:"s3"`
+	MaxBytes     int64    `json:"max_bytes" env:"ATTACHMENTS_MAX_BYTES"`
+	ContentTypes []string `json:"content_types" env:"ATTACHMENTS_CONTENT_TYPES"`
+	SigningKey   string   `json:"signing_key" env:"ATTACHMENTS_SIGNING_KEY"`
+	URLTTL       Duration `json:"url_ttl" env:"ATTACHMENTS_URL_TTL"`
+}
+
+// FixturesConfig lists the YAML or JSON fixture files of seed pebbles that
+// the seed command loads, and that are loaded at startup if Load is set.
+type FixturesConfig struct {
+	Load  bool     `json:"load" env:"FIXTURES_LOAD"`
+	Files []string `json:"files" env:"FIXTURES_FILES"`
+}
+
+// ProxyConfig turns on the reverse proxy if Upstream is set or Routes
+// lists any: requests under Prefix, which must end in /, go through the
+// route middleware, such as authentication and rate limiting, and are then
+// forwarded to Upstream, and those under the prefix of a route to its
+// upstream. Failed idempotent requests are tried up to Retries more times,
+// waiting a random time of up to RetryBackoff doubled for every attempt.
+// Routes can only be set in the config file.
+type ProxyConfig struct {
+	Upstream     string       `json:"upstream" env:"PROXY_UPSTREAM"`
+	Prefix       string       `json:"prefix" env:"PROXY_PREFIX"`
+	Retries      int          `json:"retries" env:"PROXY_RETRIES"`
+	RetryBackoff Duration     `json:"retry_backoff" env:"PROXY_RETRY_BACKOFF"`
+	Routes       []ProxyRoute `json:"routes"`
+}
+
+// ProxyRoute forwards the requests under Prefix to Upstream. Callers need
+// Permission, proxy:access if it is empty, unless the route is Public.
+// The path after the prefix is rewritten by the first of Rewrite whose
+// Match it matches, and a Timeout replaces request_timeout for the route.
+type ProxyRoute struct {
+	Prefix     string         `json:"prefix"`
+	Upstream   string         `json:"upstream"`
+	Permission string         `json:"permission"`
+	Public     bool           `json:"public"`
+	Timeout    Duration       `json:"timeout"`
+	Rewrite    []ProxyRewrite `json:"rewrite"`
+}
+
+// ProxyRewrite replaces the path of a proxied request, from the / after
+// its route's prefix, with Replace if it matches the regular expression
+// Match, which Replace can refer to the groups of as $1 or ${name}.
+type ProxyRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// routes returns the routes of the proxy, that of Upstream and Prefix
+// first if Upstream is set.
+func (p ProxyConfig) routes() []ProxyRoute {
+	var routes []ProxyRoute
+	if p.Upstream != "" {
+		routes = append(routes, ProxyRoute{Prefix: p.Prefix, Upstream: p.Upstream})
+	}
+	return append(routes, p.Routes...)
+}
+
+func validUpstream(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func validProxyPrefix(prefix string) bool {
+	return strings.HasPrefix(prefix, "/") && strings.HasSuffix(prefix, "/") && prefix != "/"
+}
+
+// GraphQLConfig enables the GraphQL endpoint at /graphql. Operations
+// may nest fields at most MaxDepth deep and cost at most MaxComplexity,
+// where every field costs 1 and those under a list field taking a first
+// argument cost first times over.
+type GraphQLConfig struct {
+	Enabled       bool `json:"enabled" env:"GRAPHQL_ENABLED"`
+	MaxDepth      int  `json:"max_depth" env:"GRAPHQL_MAX_DEPTH"`
+	MaxComplexity int  `json:"max_complexity" env:"GRAPHQL_MAX_COMPLEXITY"`
+}
+
+// TenancyConfig scopes the pebbles to tenants. The tenant of a request is
+// that of its API key or the Claim of its token, or else the one named by
+// Header, which only callers without a tenant of their own may send, or
+// else Default; without a default such requests are refused. Each tenant
+// may make Rate requests per second with bursts of up to Burst, unless
+// Rate is 0.
+type TenancyConfig struct {
+	Enabled bool    `json:"enabled" env:"TENANCY_ENABLED"`
+	Header  string  `json:"header" env:"TENANCY_HEADER"`
+	Claim   string  `json:"claim" env:"TENANCY_CLAIM"`
+	Default string  `json:"default" env:"TENANCY_DEFAULT"`
+	Rate    float64 `json:"rate" env:"TENANCY_RATE"`
+	Burst   int     `json:"burst" env:"TENANCY_BURST"`
+}
+
+// LoadShedConfig caps the requests the API serves at once. The cap moves
+// between MinInFlight and MaxInFlight, growing while requests finish
+// within TargetLatency and shrinking when they take longer; with a zero
+// TargetLatency it stays at MaxInFlight. Requests over the cap wait in a
+// queue of up to QueueSize for at most QueueTimeout, and are otherwise
+// refused with a 503 response asking clients to retry after RetryAfter.
+type LoadShedConfig struct {
+	Enabled       bool     `json:"enabled" env:"LOAD_SHED_ENABLED"`
+	MinInFlight   int      `json:"min_in_flight" env:"LOAD_SHED_MIN_IN_FLIGHT"`
+	MaxInFlight   int      `json:"max_in_flight" env:"LOAD_SHED_MAX_IN_FLIGHT"`
+	TargetLatency Duration `json:"target_latency" env:"LOAD_SHED_TARGET_LATENCY"`
+	QueueSize     int      `json:"queue_size" env:"LOAD_SHED_QUEUE_SIZE"`
+	QueueTimeout  Duration `json:"queue_timeout" env:"LOAD_SHED_QUEUE_TIMEOUT"`
+	RetryAfter    Duration `json:"retry_after" env:"LOAD_SHED_RETRY_AFTER"`
+}
+
+// ResilienceConfig guards the calls the server makes to the storage
+// backend, webhook endpoints and the proxy upstream with a circuit breaker
+// per target, which opens after FailureThreshold failures in a row and
+// lets a call through again after OpenTimeout. Reads from the store and
+// webhook deliveries that fail are also sent again up to Retries times,
+// after a random wait of up to RetryBackoff doubled for every attempt.
+type ResilienceConfig struct {
+	Enabled          bool     `json:"enabled" env:"RESILIENCE_ENABLED"`
+	FailureThreshold int      `json:"failure_threshold" env:"RESILIENCE_FAILURE_THRESHOLD"`
+	OpenTimeout      Duration `json:"open_timeout" env:"RESILIENCE_OPEN_TIMEOUT"`
+	Retries          int      `json:"retries" env:"RESILIENCE_RETRIES"`
+	RetryBackoff     Duration `json:"retry_backoff" env:"RESILIENCE_RETRY_BACKOFF"`
+}
+
+// SlowRequestsConfig logs the requests that take Threshold or longer at
+// warn level. With TraceDir set, a request still running when it crosses
+// the threshold also gets an execution trace of up to TraceDuration
+// written there, at most one a minute.
+type SlowRequestsConfig struct {
+	Enabled       bool     `json:"enabled" env:"SLOW_REQUESTS_ENABLED"`
+	Threshold     Duration `json:"threshold" env:"SLOW_REQUESTS_THRESHOLD"`
+	TraceDir      string   `json:"trace_dir" env:"SLOW_REQUESTS_TRACE_DIR"`
+	TraceDuration Duration `json:"trace_duration" env:"SLOW_REQUESTS_TRACE_DURATION"`
+}
+
+// StartupConfig makes the server wait for the database, Redis and the
+// JWKS URL to become reachable as it starts, rather than give up at the
+// first failure: it tries again after InitialBackoff, twice as long after
+// each further failure up to MaxBackoff, and gives up after WaitTimeout in
+// all. A zero WaitTimeout turns the wait off.
+type StartupConfig struct {
+	WaitTimeout    Duration `json:"wait_timeout" env:"STARTUP_WAIT_TIMEOUT"`
+	InitialBackoff Duration `json:"initial_backoff" env:"STARTUP_INITIAL_BACKOFF"`
+	MaxBackoff     Duration `json:"max_backoff" env:"STARTUP_MAX_BACKOFF"`
+}
+
+// ChaosConfig injects faults into API requests as Rules say, to test how
+// clients cope with them. The rules take new values on reload and can be
+// changed through the admin API. It can only be enabled together with
+// development or demo, so that it is never on in production.
+type ChaosConfig struct {
+	Enabled bool        `json:"enabled" env:"CHAOS_ENABLED"`
+	Rules   []ChaosRule `json:"rules"`
+}
+
+// CaptureConfig records the API requests to File, a JSON line each, for
+// the replay command to send again. The headers in RedactHeaders and the
+// body fields in log.body.redact_fields are replaced, and bodies longer
+// than MaxBodyBytes, or that cannot be redacted, are left out. The file is
+// rotated like the access log file once it grows past MaxBytes, keeping
+// MaxBackups rotated files.
+type CaptureConfig struct {
+	Enabled       bool     `json:"enabled" env:"CAPTURE_ENABLED"`
+	File          string   `json:"file" env:"CAPTURE_FILE"`
+	MaxBodyBytes  int      `json:"max_body_bytes" env:"CAPTURE_MAX_BODY_BYTES"`
+	RedactHeaders []string `json:"redact_headers" env:"CAPTURE_REDACT_HEADERS"`
+	MaxBytes      int64    `json:"max_bytes" env:"CAPTURE_MAX_BYTES"`
+	MaxBackups    int      `json:"max_backups" env:"CAPTURE_MAX_BACKUPS"`
+}
+
+// SecurityHeadersConfig sets the security headers of the responses of
+// the API and the frontend, whose pages get FrontendContentSecurityPolicy
+// rather than ContentSecurityPolicy. An empty setting leaves its header
+// out. With development set, the settings in Development, by name,
+// override the others; by default it leaves out Strict-Transport-Security,
+// so that browsers do not insist on HTTPS for localhost.
+type SecurityHeadersConfig struct {
+	Enabled                       bool              `json:"enabled" env:"SECURITY_HEADERS_ENABLED"`
+	StrictTransportSecurity       string            `json:"strict_transport_security" env:"SECURITY_HEADERS_STRICT_TRANSPORT_SECURITY"`
+	ContentSecurityPolicy         string            `json:"content_security_policy" env:"SECURITY_HEADERS_CONTENT_SECURITY_POLICY"`
+	FrontendContentSecurityPolicy string            `json:"frontend_content_security_policy" env:"SECURITY_HEADERS_FRONTEND_CONTENT_SECURITY_POLICY"`
+	ContentTypeOptions            string            `json:"content_type_options" env:"SECURITY_HEADERS_CONTENT_TYPE_OPTIONS"`
+	ReferrerPolicy                string            `json:"referrer_policy" env:"SECURITY_HEADERS_REFERRER_POLICY"`
+	PermissionsPolicy             string            `json:"permissions_policy" env:"SECURITY_HEADERS_PERMISSIONS_POLICY"`
+	Development                   map[string]string `json:"development"`
+}
+
+// I18nConfig sets the languages of error messages. With it enabled, each
+// request's errors are given in the language of its Accept-Language
+// header that has messages, and in DefaultLocale if none does.
+type I18nConfig struct {
+	Enabled       bool   `json:"enabled" env:"I18N_ENABLED"`
+	DefaultLocale string `json:"default_locale" env:"I18N_DEFAULT_LOCALE"`
+}
+
+// ProxyProtocolConfig makes the API and gRPC listeners take the client
+// of each connection from the PROXY protocol header, version 1 or 2, that
+// load balancers in TCP mode start it with. Only the connections from
+// TrustedSources, addresses and CIDR prefixes, are read for one, and
+// must send it within HeaderTimeout; those of other peers are served as
+// they come.
+type ProxyProtocolConfig struct {
+	Enabled        bool     `json:"enabled" env:"PROXY_PROTOCOL_ENABLED"`
+	TrustedSources []string `json:"trusted_sources" env:"PROXY_PROTOCOL_TRUSTED_SOURCES"`
+	HeaderTimeout  Duration `json:"header_timeout" env:"PROXY_PROTOCOL_HEADER_TIMEOUT"`
+}
+
+// SLOConfig sets the service level objectives of routes. Objectives holds
+// them by route pattern, as /admin/routes lists it, such as
+// "GET /pebbles/{id}". Compliance and error budgets are measured over the
+// requests of the last Window, and an objective alerts while its budget
+// burns AlertBurnRate times faster than Window allows, or more, over both
+// AlertWindow and its last twelfth.
+type SLOConfig struct {
+	Enabled       bool                    `json:"enabled" env:"SLO_ENABLED"`
+	Window        Duration                `json:"window" env:"SLO_WINDOW"`
+	AlertWindow   Duration                `json:"alert_window" env:"SLO_ALERT_WINDOW"`
+	AlertBurnRate float64                 `json:"alert_burn_rate" env:"SLO_ALERT_BURN_RATE"`
+	Objectives    map[string]SLOObjective `json:"objectives"`
+}
+
+// SLOObjective is the objectives of a route: Availability is the share of
+// its requests that are to get a response other than 5xx, and
+// LatencyTarget the share that are to be served within Latency. Either
+// can be left out.
+type SLOObjective struct {
+	Availability  float64  `json:"availability"`
+	Latency       Duration `json:"latency"`
+	LatencyTarget float64  `json:"latency_target"`
+}
+
+// FlagsConfig sets the feature flags. Flags holds the flags by name, and
+// takes new values on reload. With the file provider, the flags in the
+// JSON file at File override them, read again when it changes; with the
+// remote provider, those fetched from URL do. Both look for changes every
+// RefreshInterval.
+type FlagsConfig struct {
+	Provider        string          `json:"provider" env:"FLAGS_PROVIDER" values:"static,file,remote"`
+	Flags           map[string]Flag `json:"flags"`
+	File            string          `json:"file" env:"FLAGS_FILE"`
+	URL             string          `json:"url" env:"FLAGS_URL"`
+	RefreshInterval Duration        `json:"refresh_interval" env:"FLAGS_REFRESH_INTERVAL"`
+}
+
+// S3Config locates a bucket of an S3-compatible service, addressed by
+// path under Endpoint, and the credentials requests to it are signed with.
+type S3Config struct {
+	Endpoint        string `json:"endpoint" env:"ATTACHMENTS_S3_ENDPOINT"`
+	Region          string `json:"region" env:"ATTACHMENTS_S3_REGION"`
+	Bucket          string `json:"bucket" env:"ATTACHMENTS_S3_BUCKET"`
+	AccessKeyID     string `json:"access_key_id" env:"ATTACHMENTS_S3_ACCESS_KEY_ID"`
+	SecretAccessKey string `json:"secret_access_key" env:"ATTACHMENTS_S3_SECRET_ACCESS_KEY"`
+}
+
+// FrontendConfig controls serving a single-page application at /, which
+// moves the API under /api. Dir is the directory holding the built
+// frontend; if it is empty the bundle embedded from web/ is served.
+type FrontendConfig struct {
+	Enabled bool   `json:"enabled" env:"FRONTEND_ENABLED"`
+	Dir     string `json:"dir" env:"FRONTEND_DIR"`
+}
+
+// APIConfig configures the versions of the resource API. DefaultVersion
+// serves the requests that name no version in their path or Accept
+// header. Deprecated and Sunset hold version=date entries, such as
+// v1=2026-10-14, announcing when a version was deprecated and when it is
+// to be removed. Formats names the formats, of json, xml and msgpack,
+// that responses can be negotiated in and request bodies sent in; the
+// first is served to clients that accept any.
+type APIConfig struct {
+	DefaultVersion string   `json:"default_version" env:"API_DEFAULT_VERSION"`
+	Deprecated     []string `json:"deprecated" env:"API_DEPRECATED"`
+	Sunset         []string `json:"sunset" env:"API_SUNSET"`
+	Formats        []string `json:"formats" env:"API_FORMATS" values:"json,xml,msgpack"`
+}
+
+// AdminConfig configures the admin listener, which serves the pprof,
+// expvar and configuration debugging endpoints on Port of the loopback
+// interface only. A Port of 0 disables it.
+type AdminConfig struct {
+	Port int `json:"port" env:"ADMIN_PORT"`
+}
+
+type NATSConfig struct {
+	URL           string `json:"url" env:"EVENTS_NATS_URL"`
+	SubjectPrefix string `json:"subject_prefix" env:"EVENTS_NATS_SUBJECT_PREFIX"`
+	QueueSize     int    `json:"queue_size" env:"EVENTS_NATS_QUEUE_SIZE"`
+}
+
+// StorageConfig selects where pebbles are kept. The sqlite and postgres
+// backends need the matching database/sql driver linked into the binary.
+type StorageConfig struct {
+	Backend         string   `json:"backend" env:"STORAGE_BACKEND" values:"memory,sqlite,postgres"`
+	Driver          string   `json:"driver" env:"STORAGE_DRIVER"`
+	DSN             string   `json:"dsn" env:"STORAGE_DSN"`
+	MaxOpenConns    int      `json:"max_open_conns" env:"STORAGE_MAX_OPEN_CONNS"`
+	MaxIdleConns    int      `json:"max_idle_conns" env:"STORAGE_MAX_IDLE_CONNS"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime" env:"STORAGE_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime Duration `json:"conn_max_idle_time" env:"STORAGE_CONN_MAX_IDLE_TIME"`
+	AutoMigrate     bool     `json:"auto_migrate" env:"STORAGE_AUTO_MIGRATE"`
+	// Timeout bounds every store operation, or is unlimited if zero.
+	Timeout Duration `json:"timeout" env:"STORAGE_TIMEOUT"`
+
+	// PgDump and PgRestore are the commands snapshots of a postgres
+	// database are taken and restored with.
+	PgDump    string `json:"pg_dump" env:"STORAGE_PG_DUMP"`
+	PgRestore string `json:"pg_restore" env:"STORAGE_PG_RESTORE"`
+}
+
+type AuthConfig struct {
+	// Mode is "none", "jwt" or "api_key".
+	Mode   string       `json:"mode" env:"AUTH_MODE" values:"none,jwt,api_key"`
+	JWT    JWTConfig    `json:"jwt"`
+	APIKey APIKeyConfig `json:"api_key"`
+	OIDC   OIDCConfig   `json:"oidc"`
+}
+
+// OIDCConfig configures logging users of the frontend in at an OIDC
+// provider, whose discovery document is under Issuer. RedirectURL is the
+// address of /auth/callback as the browser reaches it, and must be
+// registered with the provider. Scopes are requested from the provider,
+// while SessionScopes are granted to every logged in user, on top of any
+// the ID token carries. Sessions last SessionTTL from their last use, but
+// at most SessionMaxAge, and SessionStore is "cookie" to keep them in a
+// cookie encrypted with a key derived from SessionKey or "redis" to keep
+// them on the server of cache.redis.
+type OIDCConfig struct {
+	Enabled       bool     `json:"enabled" env:"AUTH_OIDC_ENABLED"`
+	Issuer        string   `json:"issuer" env:"AUTH_OIDC_ISSUER"`
+	ClientID      string   `json:"client_id" env:"AUTH_OIDC_CLIENT_ID"`
+	ClientSecret  string   `json:"client_secret" env:"AUTH_OIDC_CLIENT_SECRET"`
+	RedirectURL   string   `json:"redirect_url" env:"AUTH_OIDC_REDIRECT_URL"`
+	Scopes        []string `json:"scopes" env:"AUTH_OIDC_SCOPES"`
+	SessionScopes []string `json:"session_scopes" env:"AUTH_OIDC_SESSION_SCOPES"`
+	SessionKey    string   `json:"session_key" env:"AUTH_OIDC_SESSION_KEY"`
+	SessionTTL    Duration `json:"session_ttl" env:"AUTH_OIDC_SESSION_TTL"`
+	SessionMaxAge Duration `json:"session_max_age" env:"AUTH_OIDC_SESSION_MAX_AGE"`
+	SessionStore  string   `json:"session_store" env:"AUTH_OIDC_SESSION_STORE" values:"cookie,redis"`
+}
+
+type APIKeyConfig struct {
+	// BootstrapKey, if set, is stored at startup as a key with the admin
+	// scope so the first keys can be created through the API.
+	BootstrapKey string `json:"bootstrap_key" env:"AUTH_BOOTSTRAP_API_KEY"`
+	// ClockSkew is how far from the server's time the timestamp of a signed
+	// request may be.
+	ClockSkew Duration `json:"clock_skew" env:"AUTH_SIGNATURE_CLOCK_SKEW"`
+}
+
+// JWTConfig configures bearer token verification. Tokens are verified with
+// the keys published at JWKSURL or, for local development, with the HS256
+// shared Secret.
+type JWTConfig struct {
+	JWKSURL         string   `json:"jwks_url" env:"AUTH_JWKS_URL"`
+	RefreshInterval Duration `json:"refresh_interval" env:"AUTH_JWKS_REFRESH_INTERVAL"`
+	Secret          string   `json:"secret" env:"AUTH_JWT_SECRET"`
+	Issuer          string   `json:"issuer" env:"AUTH_JWT_ISSUER"`
+	Audience        string   `json:"audience" env:"AUTH_JWT_AUDIENCE"`
+	Leeway          Duration `json:"leeway" env:"AUTH_JWT_LEEWAY"`
+}
+
+// Enabled reports whether a certificate and key have been configured.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// Duration is a time.Duration that is written as a string such as "10s" in
+// config files and environment variables.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:              8080,
+		ReadHeaderTimeout: Duration{5 * time.Second},
+		ReadTimeout:       Duration{15 * time.Second},
+		WriteTimeout:      Duration{30 * time.Second},
+		IdleTimeout:       Duration{2 * time.Minute},
+		MaxHeaderBytes:    64 << 10,
+		RequestTimeout:    Duration{20 * time.Second},
+		ShutdownTimeout:   Duration{10 * time.Second},
+		HealthTimeout:     Duration{2 * time.Second},
+		Listen: ListenConfig{
+			Network: "tcp",
+			Family:  "any",
+			Mode:    "0660",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+			Body: BodyLogConfig{
+				MaxBytes:     4096,
+				RedactFields: []string{"password", "secret", "token", "access_token", "refresh_token", "api_key", "key", "authorization"},
+			},
+			Access: AccessLogConfig{
+				Format:     "combined",
+				Output:     "stdout",
+				MaxBytes:   100 << 20,
+				MaxAge:     Duration{24 * time.Hour},
+				MaxBackups: 7,
+			},
+		},
+		TLS: TLSConfig{
+			ReloadInterval: Duration{time.Minute},
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+		},
+		Storage: StorageConfig{
+			Backend:         "memory",
+			MaxOpenConns:    10,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: Duration{30 * time.Minute},
+			ConnMaxIdleTime: Duration{5 * time.Minute},
+			AutoMigrate:     true,
+			Timeout:         Duration{5 * time.Second},
+			PgDump:          "pg_dump",
+			PgRestore:       "pg_restore",
+		},
+		Auth: AuthConfig{
+			Mode: "none",
+			JWT: JWTConfig{
+				RefreshInterval: Duration{time.Hour},
+				Leeway:          Duration{time.Minute},
+			},
+			APIKey: APIKeyConfig{
+				ClockSkew: Duration{5 * time.Minute},
+			},
+			OIDC: OIDCConfig{
+				Scopes:        []string{"openid", "profile", "email"},
+				SessionScopes: []string{"pebbles:read", "pebbles:write"},
+				SessionTTL:    Duration{8 * time.Hour},
+				SessionMaxAge: Duration{7 * 24 * time.Hour},
+				SessionStore:  "cookie",
+			},
+		},
+		RateLimit: RateLimitConfig{
+			Rate:    10,
+			Burst:   20,
+			IdleTTL: Duration{10 * time.Minute},
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "Idempotency-Key", "If-Match", "If-None-Match", "X-API-Key", "X-Request-ID", "X-Request-Timeout"},
+			ExposedHeaders: []string{"ETag", "Idempotent-Replayed", "Location", "Retry-After", "X-Request-ID"},
+			MaxAge:         Duration{10 * time.Minute},
+		},
+		Compression: CompressionConfig{
+			Enabled:      true,
+			MinSize:      1024,
+			ContentTypes: []string{"application/json", "text/plain", "text/html", "application/x-ndjson", "text/csv"},
+		},
+		OpenAPI: OpenAPIConfig{
+			Enabled: true,
+		},
+		Events: EventsConfig{
+			History:         1000,
+			Publisher:       "none",
+			LongPollTimeout: Duration{15 * time.Second},
+			NATS: NATSConfig{
+				URL:           "nats://localhost:4222",
+				SubjectPrefix: "pebbles",
+				QueueSize:     1024,
+			},
+			Outbox: OutboxConfig{
+				PollInterval: Duration{time.Second},
+				BatchSize:    100,
+			},
+		},
+		Idempotency: IdempotencyConfig{
+			Enabled: true,
+			TTL:     Duration{24 * time.Hour},
+		},
+		Jobs: JobsConfig{
+			Workers:        4,
+			QueueSize:      1000,
+			MaxAttempts:    5,
+			InitialBackoff: Duration{time.Second},
+			MaxBackoff:     Duration{5 * time.Minute},
+		},
+		Scheduler: SchedulerConfig{
+			Timezone:    "UTC",
+			Lock:        "local",
+			LockTTL:     Duration{time.Minute},
+			LockMinHold: Duration{30 * time.Second},
+		},
+		Webhooks: WebhooksConfig{
+			MaxAttempts: 8,
+			Timeout:     Duration{10 * time.Second},
+		},
+		InboundWebhooks: InboundWebhooksConfig{
+			Tolerance: Duration{5 * time.Minute},
+			DedupTTL:  Duration{24 * time.Hour},
+			MaxBytes:  1 << 20,
+		},
+		Cache: CacheConfig{
+			Backend: "none",
+			TTL:     Duration{30 * time.Second},
+			Redis: RedisConfig{
+				URL:          "redis://localhost:6379/0",
+				MaxIdleConns: 10,
+				Timeout:      Duration{500 * time.Millisecond},
+			},
+		},
+		HTTPCache: HTTPCacheConfig{
+			MaxBodyBytes: 1 << 20,
+		},
+		RequestBody: RequestBodyConfig{
+			MaxBytes:     1 << 20,
+			ContentTypes: []string{"application/json"},
+			MaxDepth:     defaultMaxBodyDepth,
+		},
+		Maintenance: MaintenanceConfig{
+			RetryAfter: Duration{5 * time.Minute},
+		},
+		SoftDelete: SoftDeleteConfig{
+			Retention:     Duration{30 * 24 * time.Hour},
+			PurgeInterval: Duration{time.Hour},
+		},
+		Batch: BatchConfig{
+			MaxOperations: 100,
+		},
+		Attachments: AttachmentsConfig{
+			Backend:      "local",
+			Dir:          "attachments",
+			S3:           S3Config{Region: "us-east-1"},
+			MaxBytes:     10 << 20,
+			ContentTypes: []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"},
+			URLTTL:       Duration{15 * time.Minute},
+		},
+		Proxy: ProxyConfig{
+			Prefix:       "/proxy/",
+			Retries:      2,
+			RetryBackoff: Duration{100 * time.Millisecond},
+		},
+		Tenancy: TenancyConfig{
+			Header: "X-Tenant-ID",
+			Claim:  "tenant",
+			Burst:  20,
+		},
+		GraphQL: GraphQLConfig{
+			MaxDepth:      10,
+			MaxComplexity: 5000,
+		},
+		Resilience: ResilienceConfig{
+			FailureThreshold: 5,
+			OpenTimeout:      Duration{30 * time.Second},
+			Retries:          2,
+			RetryBackoff:     Duration{50 * time.Millisecond},
+		},
+		SlowRequests: SlowRequestsConfig{
+			Threshold:     Duration{time.Second},
+			TraceDuration: Duration{time.Second},
+		},
+		Startup: StartupConfig{
+			WaitTimeout:    Duration{time.Minute},
+			InitialBackoff: Duration{500 * time.Millisecond},
+			MaxBackoff:     Duration{10 * time.Second},
+		},
+		Capture: CaptureConfig{
+			File:          "capture.jsonl",
+			MaxBodyBytes:  64 << 10,
+			RedactHeaders: []string{"Authorization", "Proxy-Authorization", "Cookie", "X-API-Key"},
+			MaxBytes:      100 << 20,
+			MaxBackups:    3,
+		},
+		SecurityHeaders: SecurityHeadersConfig{
+			Enabled:                       true,
+			StrictTransportSecurity:       "max-age=31536000; includeSubDomains",
+			ContentSecurityPolicy:         "default-src 'none'; frame-ancestors 'none'",
+			FrontendContentSecurityPolicy: "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'",
+			ContentTypeOptions:            "nosniff",
+			ReferrerPolicy:                "strict-origin-when-cross-origin",
+			PermissionsPolicy:             "camera=(), microphone=(), geolocation=(), payment=()",
+			Development:                   map[string]string{"strict_transport_security": ""},
+		},
+		I18n: I18nConfig{
+			Enabled:       true,
+			DefaultLocale: sourceLocale,
+		},
+		ProxyProtocol: ProxyProtocolConfig{
+			HeaderTimeout: Duration{5 * time.Second},
+		},
+		SLO: SLOConfig{
+			Window:        Duration{24 * time.Hour},
+			AlertWindow:   Duration{time.Hour},
+			AlertBurnRate: 6,
+		},
+		Flags: FlagsConfig{
+			Provider: "static",
+			Flags: map[string]Flag{
+				flagPebblesSearch: {Enabled: true},
+			},
+			RefreshInterval: Duration{30 * time.Second},
+		},
+		LoadShed: LoadShedConfig{
+			MinInFlight:   10,
+			MaxInFlight:   100,
+			TargetLatency: Duration{500 * time.Millisecond},
+			QueueSize:     100,
+			QueueTimeout:  Duration{100 * time.Millisecond},
+			RetryAfter:    Duration{time.Second},
+		},
+		API: APIConfig{
+			DefaultVersion: "v1",
+			Formats:        []string{"json"},
+		},
+		Tracing: TracingConfig{
+			ServiceName:    "pebble-api",
+			SampleRatio:    1,
+			BatchSize:      512,
+			ExportInterval: Duration{5 * time.Second},
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the JSON or YAML
+// file at path (if path is not empty) and the environment, with the demo
+// overrides if they ask for demo mode, and validates the result.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		data, err := readConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := checkConfigJSON(data); err != nil {
+			return Config{}, fmt.Errorf("cannot parse config file %s: %w", path, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return Config{}, fmt.Errorf("cannot parse config file %s: %w", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), "", os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+	if cfg.Demo {
+		cfg.applyDemo()
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// checkConfig reports every problem of the configuration LoadConfig would
+// build from path, for the config validate command: the unknown keys and
+// mistyped values of the file and, unless it cannot be parsed at all, what
+// Validate finds in the values it does set. LoadConfig stops at the first
+// of these steps that fails.
+func checkConfig(path string) error {
+	cfg := DefaultConfig()
+	var errs []error
+	if path != "" {
+		data, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		if err := checkConfigJSON(data); err != nil {
+			errs = append(errs, fmt.Errorf("cannot parse config file %s: %w", path, err))
+		}
+		// Without DisallowUnknownFields, and past values of the wrong type,
+		// which keep their defaults.
+		var syntaxErr *json.SyntaxError
+		if err := json.Unmarshal(data, &cfg); errors.As(err, &syntaxErr) {
+			return errors.Join(errs...)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), "", os.LookupEnv); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Demo {
+		cfg.applyDemo()
+	}
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid config: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// readConfigFile returns the config file at path as JSON: a .yaml or .yml
+// file converted from YAML, and any other file without its // comments.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("cannot parse config file %s: %w", path, err)
+		}
+		return data, nil
+	}
+	return stripJSONComments(data), nil
+}
+
+// Validate checks that the configuration is usable and returns all problems
+// found joined into a single error.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d is out of range 1-65535", c.Port))
+	}
+	switch l := c.Listen; l.Network {
+	case "tcp":
+		if l.Family != "any" && l.Family != "ipv4" && l.Family != "ipv6" {
+			errs = append(errs, fmt.Errorf("listen.family: %q is not one of any, ipv4, ipv6", l.Family))
+		} else if err := l.checkBindable(); err != nil {
+			errs = append(errs, fmt.Errorf("listen.host: %w", err))
+		}
+	case "systemd":
+	case "unix":
+		if l.Path == "" {
+			errs = append(errs, errors.New("listen.path: is required for the unix network"))
+		}
+		if _, err := l.FileMode(); err != nil {
+			errs = append(errs, fmt.Errorf("listen.mode: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("listen.network: %q is not one of tcp, unix, systemd", l.Network))
+	}
+	for name, d := range map[string]Duration{
+		"read_header_timeout":     c.ReadHeaderTimeout,
+		"read_timeout":            c.ReadTimeout,
+		"write_timeout":           c.WriteTimeout,
+		"idle_timeout":            c.IdleTimeout,
+		"request_timeout":         c.RequestTimeout,
+		"shutdown_timeout":        c.ShutdownTimeout,
+		"shutdown_delay":          c.ShutdownDelay,
+		"storage.timeout":         c.Storage.Timeout,
+		"maintenance.retry_after": c.Maintenance.RetryAfter,
+		"soft_delete.retention":   c.SoftDelete.Retention,
+	} {
+		if d.Duration < 0 {
+			errs = append(errs, fmt.Errorf("%s: must not be negative", name))
+		}
+	}
+	if c.MaxHeaderBytes < 0 {
+		errs = append(errs, errors.New("max_header_bytes: must not be negative"))
+	}
+	if c.RequestTimeout.Duration > 0 && c.WriteTimeout.Duration > 0 && c.RequestTimeout.Duration >= c.WriteTimeout.Duration {
+		errs = append(errs, errors.New("request_timeout: must be shorter than write_timeout so the 504 response can be sent"))
+	}
+	if c.SoftDelete.Retention.Duration > 0 && c.SoftDelete.PurgeInterval.Duration <= 0 {
+		errs = append(errs, errors.New("soft_delete.purge_interval: must be greater than zero"))
+	}
+	if c.ReusePort && !reusePortSupported {
+		errs = append(errs, errors.New("reuse_port: is not supported on this system"))
+	}
+	if c.ShutdownTimeout.Duration == 0 {
+		errs = append(errs, errors.New("shutdown_timeout: must be greater than zero"))
+	}
+	if c.HealthTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("health_timeout: must be greater than zero"))
+	}
+	if _, err := c.Log.SlogLevel(); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %q is not one of debug, info, warn, error", c.Log.Level))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format: %q is not one of text, json", c.Log.Format))
+	}
+	for i, sink := range c.Log.Sinks {
+		key := fmt.Sprintf("log.sinks[%d]", i)
+		switch sink.Type {
+		case "stdout", "stderr", "journald":
+		case "file":
+			if sink.Path == "" {
+				errs = append(errs, fmt.Errorf("%s.path: is required for a file sink", key))
+			}
+			if sink.MaxBytes < 0 || sink.MaxAge.Duration < 0 || sink.MaxBackups < 0 {
+				errs = append(errs, fmt.Errorf("%s: max_bytes, max_age and max_backups must not be negative", key))
+			}
+		case "syslog":
+			if sink.Address != "" {
+				if _, _, err := parseSyslogAddress(sink.Address); err != nil {
+					errs = append(errs, fmt.Errorf("%s.address: %w", key, err))
+				}
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.type: %q is not one of stdout, stderr, file, syslog, journald", key, sink.Type))
+		}
+		if sink.Level != "" {
+			if _, err := (LogConfig{Level: sink.Level}).SlogLevel(); err != nil {
+				errs = append(errs, fmt.Errorf("%s.level: %q is not one of debug, info, warn, error", key, sink.Level))
+			}
+		}
+		if sink.Format != "" && sink.Format != "text" && sink.Format != "json" {
+			errs = append(errs, fmt.Errorf("%s.format: %q is not one of text, json", key, sink.Format))
+		}
+	}
+	if c.Log.Body.MaxBytes < 1 {
+		errs = append(errs, errors.New("log.body.max_bytes: must be at least 1"))
+	}
+	if c.TLS.Enabled() {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			errs = append(errs, errors.New("tls: cert_file and key_file must be set together"))
+		}
+		for _, p := range []string{c.TLS.CertFile, c.TLS.KeyFile} {
+			if p == "" {
+				continue
+			}
+			if _, err := os.Stat(p); err != nil {
+				errs = append(errs, fmt.Errorf("tls: %w", err))
+			}
+		}
+		if c.TLS.ReloadInterval.Duration <= 0 {
+			errs = append(errs, errors.New("tls.reload_interval: must be greater than zero"))
+		}
+	}
+	if c.TLS.RedirectPort != 0 {
+		switch {
+		case !c.TLS.Enabled():
+			errs = append(errs, errors.New("tls.redirect_port: requires cert_file and key_file"))
+		case c.TLS.RedirectPort < 1 || c.TLS.RedirectPort > 65535:
+			errs = append(errs, fmt.Errorf("tls.redirect_port: %d is out of range 1-65535", c.TLS.RedirectPort))
+		case c.TLS.RedirectPort == c.Port:
+			errs = append(errs, errors.New("tls.redirect_port: must differ from port"))
+		case c.Listen.Network != "tcp":
+			errs = append(errs, errors.New("tls.redirect_port: requires listen.network tcp, since it redirects to port"))
+		}
+	}
+	switch c.Storage.Backend {
+	case "memory":
+	case "sqlite", "postgres":
+		if c.Storage.DSN == "" {
+			errs = append(errs, fmt.Errorf("storage.dsn: is required for the %s backend", c.Storage.Backend))
+		}
+		if c.Storage.Backend == "postgres" && (c.Storage.PgDump == "" || c.Storage.PgRestore == "") {
+			errs = append(errs, errors.New("storage: pg_dump and pg_restore are required for the postgres backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.backend: %q is not one of memory, sqlite, postgres", c.Storage.Backend))
+	}
+	if c.Storage.MaxOpenConns < 0 || c.Storage.MaxIdleConns < 0 {
+		errs = append(errs, errors.New("storage: connection limits must not be negative"))
+	}
+	switch c.Auth.Mode {
+	case "none":
+	case "jwt":
+		jwt := c.Auth.JWT
+		if (jwt.JWKSURL == "") == (jwt.Secret == "") {
+			errs = append(errs, errors.New("auth.jwt: exactly one of jwks_url and secret must be set"))
+		}
+		if jwt.Secret != "" && len(jwt.Secret) < 32 {
+			errs = append(errs, errors.New("auth.jwt.secret: must be at least 32 characters"))
+		}
+		if jwt.JWKSURL != "" && jwt.RefreshInterval.Duration <= 0 {
+			errs = append(errs, errors.New("auth.jwt.refresh_interval: must be greater than zero"))
+		}
+	case "api_key":
+		if k := c.Auth.APIKey.BootstrapKey; k != "" && len(k) < 32 {
+			errs = append(errs, errors.New("auth.api_key.bootstrap_key: must be at least 32 characters"))
+		}
+		if c.Auth.APIKey.ClockSkew.Duration <= 0 {
+			errs = append(errs, errors.New("auth.api_key.clock_skew: must be greater than zero"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("auth.mode: %q is not one of none, jwt, api_key", c.Auth.Mode))
+	}
+	if o := c.Auth.OIDC; o.Enabled {
+		if u, err := url.Parse(o.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, errors.New("auth.oidc.issuer: must be an http or https URL"))
+		}
+		if o.ClientID == "" {
+			errs = append(errs, errors.New("auth.oidc.client_id: must be set"))
+		}
+		if u, err := url.Parse(o.RedirectURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, errors.New("auth.oidc.redirect_url: must be the http or https URL of /auth/callback"))
+		}
+		if !slices.Contains(o.Scopes, "openid") {
+			errs = append(errs, errors.New("auth.oidc.scopes: must include openid"))
+		}
+		if len(o.SessionKey) < 32 {
+			errs = append(errs, errors.New("auth.oidc.session_key: must be at least 32 characters"))
+		}
+		if o.SessionTTL.Duration <= 0 {
+			errs = append(errs, errors.New("auth.oidc.session_ttl: must be greater than zero"))
+		}
+		if o.SessionMaxAge.Duration < o.SessionTTL.Duration {
+			errs = append(errs, errors.New("auth.oidc.session_max_age: must be at least auth.oidc.session_ttl"))
+		}
+		switch o.SessionStore {
+		case "cookie":
+		case "redis":
+			if c.Cache.Redis.URL == "" {
+				errs = append(errs, errors.New("auth.oidc.session_store: redis requires cache.redis.url"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("auth.oidc.session_store: %q is not one of cookie, redis", o.SessionStore))
+		}
+	}
+	if c.RateLimit.Enabled {
+		if c.RateLimit.Rate <= 0 {
+			errs = append(errs, errors.New("rate_limit.rate: must be greater than zero"))
+		}
+		if c.RateLimit.Burst < 1 {
+			errs = append(errs, errors.New("rate_limit.burst: must be at least 1"))
+		}
+		if c.RateLimit.IdleTTL.Duration <= 0 {
+			errs = append(errs, errors.New("rate_limit.idle_ttl: must be greater than zero"))
+		}
+	}
+	if _, err := ParseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	for _, set := range []struct {
+		key     string
+		entries []string
+	}{
+		{"ip_filter.allow", c.IPFilter.Allow},
+		{"ip_filter.deny", c.IPFilter.Deny},
+		{"ip_filter.admin_allow", c.IPFilter.AdminAllow},
+		{"ip_filter.admin_deny", c.IPFilter.AdminDeny},
+	} {
+		if _, err := parseIPSet(set.entries); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", set.key, err))
+		}
+	}
+	if c.RequestBody.MaxBytes < 1 {
+		errs = append(errs, errors.New("request_body.max_bytes: must be at least 1"))
+	}
+	if _, err := parseBodyRoutes(c.RequestBody.Routes); err != nil {
+		errs = append(errs, fmt.Errorf("request_body.routes: %w", err))
+	}
+	if c.RequestBody.MaxDepth < 1 {
+		errs = append(errs, errors.New("request_body.max_depth: must be at least 1"))
+	}
+	for _, pattern := range c.RequestBody.AllowUnknownFields {
+		if method, path, ok := strings.Cut(pattern, " "); !ok || method == "" || !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("request_body.allow_unknown_fields: %q is not a route such as \"PUT /pebbles/{id}\"", pattern))
+		}
+	}
+	if len(c.RequestBody.ContentTypes) == 0 {
+		errs = append(errs, errors.New("request_body.content_types: must not be empty"))
+	}
+	if c.Events.History < 0 {
+		errs = append(errs, errors.New("events.history: must not be negative"))
+	}
+	// The wait must end before the request times out and the response can
+	// no longer be written.
+	for name, d := range map[string]Duration{"request_timeout": c.RequestTimeout, "write_timeout": c.WriteTimeout} {
+		if d.Duration > 0 && c.Events.LongPollTimeout.Duration >= d.Duration {
+			errs = append(errs, fmt.Errorf("events.long_poll_timeout: must be shorter than %s", name))
+		}
+	}
+	if c.Events.LongPollTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("events.long_poll_timeout: must be positive"))
+	}
+	switch c.Events.Publisher {
+	case "none":
+	case "nats":
+		if c.Events.NATS.SubjectPrefix == "" {
+			errs = append(errs, errors.New("events.nats.subject_prefix: is required"))
+		}
+		if c.Events.NATS.QueueSize < 1 {
+			errs = append(errs, errors.New("events.nats.queue_size: must be at least 1"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("events.publisher: %q is not one of none, nats", c.Events.Publisher))
+	}
+	if p := c.GRPC.Port; p != 0 {
+		switch {
+		case p < 1 || p > 65535:
+			errs = append(errs, fmt.Errorf("grpc.port: %d is out of range 1-65535", p))
+		case p == c.Port || p == c.TLS.RedirectPort:
+			errs = append(errs, errors.New("grpc.port: must differ from port and tls.redirect_port"))
+		}
+	}
+	names := map[string]bool{}
+	for i, l := range c.Listeners {
+		key := fmt.Sprintf("listeners[%d]", i)
+		switch {
+		case l.Name == "":
+			errs = append(errs, fmt.Errorf("%s.name: is required", key))
+		case names[l.Name]:
+			errs = append(errs, fmt.Errorf("%s.name: %q is used by another listener", key, l.Name))
+		}
+		names[l.Name] = true
+		if l.Serve != "api" && l.Serve != "admin" && l.Serve != "grpc" {
+			errs = append(errs, fmt.Errorf("%s.serve: %q is not one of api, admin, grpc", key, l.Serve))
+		}
+		switch l.Network {
+		case "tcp":
+			if _, port, err := net.SplitHostPort(l.Address); err != nil {
+				errs = append(errs, fmt.Errorf("%s.address: %q is not a host:port", key, l.Address))
+			} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				errs = append(errs, fmt.Errorf("%s.address: port %q is out of range 1-65535", key, port))
+			}
+		case "unix":
+			if l.Address == "" {
+				errs = append(errs, fmt.Errorf("%s.address: must be the socket path", key))
+			}
+			if l.Mode != "" {
+				if _, err := parseFileMode(l.Mode); err != nil {
+					errs = append(errs, fmt.Errorf("%s.mode: %w", key, err))
+				}
+			}
+		case "systemd":
+		default:
+			errs = append(errs, fmt.Errorf("%s.network: %q is not one of tcp, unix, systemd", key, l.Network))
+		}
+	}
+	if p := c.Admin.Port; p != 0 {
+		switch {
+		case p < 1 || p > 65535:
+			errs = append(errs, fmt.Errorf("admin.port: %d is out of range 1-65535", p))
+		case p == c.Port || p == c.TLS.RedirectPort || p == c.GRPC.Port:
+			errs = append(errs, errors.New("admin.port: must differ from port, tls.redirect_port and grpc.port"))
+		}
+	}
+	if t := c.Tracing; t.Endpoint != "" {
+		if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint: %q is not an http or https URL", t.Endpoint))
+		}
+		if t.ServiceName == "" {
+			errs = append(errs, errors.New("tracing.service_name: is required"))
+		}
+		if t.SampleRatio < 0 || t.SampleRatio > 1 {
+			errs = append(errs, errors.New("tracing.sample_ratio: must be between 0 and 1"))
+		}
+		if t.BatchSize < 1 {
+			errs = append(errs, errors.New("tracing.batch_size: must be at least 1"))
+		}
+		if t.ExportInterval.Duration <= 0 {
+			errs = append(errs, errors.New("tracing.export_interval: must be greater than zero"))
+		}
+	}
+	if c.Idempotency.Enabled && c.Idempotency.TTL.Duration <= 0 {
+		errs = append(errs, errors.New("idempotency.ttl: must be greater than zero"))
+	}
+	if j := c.Jobs; j.Workers < 1 || j.QueueSize < 1 || j.MaxAttempts < 1 {
+		errs = append(errs, errors.New("jobs: workers, queue_size and max_attempts must be at least 1"))
+	}
+	if j := c.Jobs; j.InitialBackoff.Duration <= 0 || j.MaxBackoff.Duration < j.InitialBackoff.Duration {
+		errs = append(errs, errors.New("jobs: initial_backoff must be greater than zero and max_backoff at least as long"))
+	}
+	if loc, err := time.LoadLocation(c.Scheduler.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("scheduler.timezone: %q is not a known time zone", c.Scheduler.Timezone))
+	} else {
+		for _, name := range slices.Sorted(maps.Keys(c.Scheduler.Jobs)) {
+			spec := c.Scheduler.Jobs[name]
+			if !slices.Contains(scheduledJobNames, name) {
+				errs = append(errs, fmt.Errorf("scheduler.jobs.%s: is not one of %s", name, strings.Join(scheduledJobNames, ", ")))
+			} else if _, err := parseSchedule(spec, loc); err != nil && spec != scheduleOff {
+				errs = append(errs, fmt.Errorf("scheduler.jobs.%s: %w", name, err))
+			}
+		}
+	}
+	switch sc := c.Scheduler; sc.Lock {
+	case "local":
+	case "postgres":
+		if c.Storage.Backend != "postgres" {
+			errs = append(errs, errors.New("scheduler.lock: postgres requires the postgres storage backend"))
+		}
+	case "redis":
+		if c.Cache.Redis.URL == "" {
+			errs = append(errs, errors.New("scheduler.lock: redis requires cache.redis.url"))
+		}
+		if sc.LockTTL.Duration < time.Second {
+			errs = append(errs, errors.New("scheduler.lock_ttl: must be at least 1s"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("scheduler.lock: %q is not one of local, postgres, redis", sc.Lock))
+	}
+	if c.Scheduler.LockMinHold.Duration < 0 {
+		errs = append(errs, errors.New("scheduler.lock_min_hold: must not be negative"))
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		errs = append(errs, errors.New("webhooks.max_attempts: must be at least 1"))
+	}
+	if c.Webhooks.Timeout.Duration <= 0 {
+		errs = append(errs, errors.New("webhooks.timeout: must be greater than zero"))
+	}
+	if in := c.InboundWebhooks; in.Enabled {
+		for _, name := range slices.Sorted(maps.Keys(in.Providers)) {
+			p, key := in.Providers[name], "inbound_webhooks.providers."+name
+			if name == "" || strings.ContainsAny(name, "/?#%") {
+				errs = append(errs, fmt.Errorf("%s: %q cannot be part of a path", key, name))
+			}
+			if !slices.Contains(inboundProviderTypes, p.Type) {
+				errs = append(errs, fmt.Errorf("%s.type: %q is not one of %s", key, p.Type, strings.Join(inboundProviderTypes, ", ")))
+			}
+			if p.Secret == "" {
+				errs = append(errs, fmt.Errorf("%s.secret: is required", key))
+			}
+		}
+		if in.Tolerance.Duration <= 0 {
+			errs = append(errs, errors.New("inbound_webhooks.tolerance: must be greater than zero"))
+		}
+		if in.DedupTTL.Duration <= 0 {
+			errs = append(errs, errors.New("inbound_webhooks.dedup_ttl: must be greater than zero"))
+		}
+		if in.MaxBytes < 1 {
+			errs = append(errs, errors.New("inbound_webhooks.max_bytes: must be at least 1"))
+		}
+	}
+	switch c.Cache.Backend {
+	case "none":
+	case "memory", "redis":
+		if c.Cache.TTL.Duration <= 0 {
+			errs = append(errs, errors.New("cache.ttl: must be greater than zero"))
+		}
+		if r := c.Cache.Redis; c.Cache.Backend == "redis" {
+			if r.MaxIdleConns < 0 {
+				errs = append(errs, errors.New("cache.redis.max_idle_conns: must not be negative"))
+			}
+			if r.Timeout.Duration <= 0 {
+				errs = append(errs, errors.New("cache.redis.timeout: must be greater than zero"))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache.backend: %q is not one of none, memory, redis", c.Cache.Backend))
+	}
+	if a := c.Attachments; a.Enabled {
+		switch a.Backend {
+		case "local":
+			if a.Dir == "" {
+				errs = append(errs, errors.New("attachments.dir: is required for the local backend"))
+			}
+		case "s3":
+			if u, err := url.Parse(a.S3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("attachments.s3.endpoint: %q is not an http or https URL", a.S3.Endpoint))
+			}
+			if a.S3.Region == "" || a.S3.Bucket == "" || a.S3.AccessKeyID == "" || a.S3.SecretAccessKey == "" {
+				errs = append(errs, errors.New("attachments.s3: region, bucket, access_key_id and secret_access_key are required"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("attachments.backend: %q is not one of local, s3", a.Backend))
+		}
+		if a.MaxBytes < 1 {
+			errs = append(errs, errors.New("attachments.max_bytes: must be at least 1"))
+		}
+		if len(a.ContentTypes) == 0 {
+			errs = append(errs, errors.New("attachments.content_types: must not be empty"))
+		}
+		if len(a.SigningKey) < 32 {
+			errs = append(errs, errors.New("attachments.signing_key: must be at least 32 characters"))
+		}
+		if a.URLTTL.Duration <= 0 {
+			errs = append(errs, errors.New("attachments.url_ttl: must be greater than zero"))
+		}
+	}
+	if c.Fixtures.Load && len(c.Fixtures.Files) == 0 {
+		errs = append(errs, errors.New("fixtures.files: must name at least one file when fixtures.load is set"))
+	}
+	for _, f := range c.Fixtures.Files {
+		if _, err := fixtureFormat(f); err != nil {
+			errs = append(errs, fmt.Errorf("fixtures.files: %w", err))
+		}
+	}
+	if p := c.Proxy; p.Upstream != "" || len(p.Routes) > 0 {
+		prefixes := map[string]bool{}
+		if p.Upstream != "" {
+			if !validUpstream(p.Upstream) {
+				errs = append(errs, fmt.Errorf("proxy.upstream: %q is not an http or https URL", p.Upstream))
+			}
+			if !validProxyPrefix(p.Prefix) {
+				errs = append(errs, fmt.Errorf("proxy.prefix: %q must start and end with / and not be /", p.Prefix))
+			}
+			prefixes[p.Prefix] = true
+		}
+		for i, route := range p.Routes {
+			key := fmt.Sprintf("proxy.routes[%d]", i)
+			switch {
+			case !validProxyPrefix(route.Prefix):
+				errs = append(errs, fmt.Errorf("%s.prefix: %q must start and end with / and not be /", key, route.Prefix))
+			case prefixes[route.Prefix]:
+				errs = append(errs, fmt.Errorf("%s.prefix: %q is used by another proxy route", key, route.Prefix))
+			}
+			prefixes[route.Prefix] = true
+			if !validUpstream(route.Upstream) {
+				errs = append(errs, fmt.Errorf("%s.upstream: %q is not an http or https URL", key, route.Upstream))
+			}
+			if route.Public && route.Permission != "" {
+				errs = append(errs, fmt.Errorf("%s.permission: must not be set on a public route", key))
+			}
+			if d := route.Timeout.Duration; d < 0 {
+				errs = append(errs, fmt.Errorf("%s.timeout: must not be negative", key))
+			} else if d > 0 && c.WriteTimeout.Duration > 0 && d >= c.WriteTimeout.Duration {
+				errs = append(errs, fmt.Errorf("%s.timeout: must be shorter than write_timeout so the 504 response can be sent", key))
+			}
+			for j, rw := range route.Rewrite {
+				if _, err := regexp.Compile(rw.Match); err != nil {
+					errs = append(errs, fmt.Errorf("%s.rewrite[%d].match: %w", key, j, err))
+				}
+			}
+		}
+		if p.Retries < 0 {
+			errs = append(errs, errors.New("proxy.retries: must not be negative"))
+		}
+		if p.Retries > 0 && p.RetryBackoff.Duration <= 0 {
+			errs = append(errs, errors.New("proxy.retry_backoff: must be greater than zero"))
+		}
+	}
+	if g := c.GraphQL; g.Enabled {
+		if g.MaxDepth < 1 {
+			errs = append(errs, errors.New("graphql.max_depth: must be at least 1"))
+		}
+		if g.MaxComplexity < 1 {
+			errs = append(errs, errors.New("graphql.max_complexity: must be at least 1"))
+		}
+	}
+	if t := c.Tenancy; t.Enabled {
+		if t.Header == "" {
+			errs = append(errs, errors.New("tenancy.header: must not be empty"))
+		}
+		if t.Claim == "" {
+			errs = append(errs, errors.New("tenancy.claim: must not be empty"))
+		}
+		if t.Default != "" && !validTenant(t.Default) {
+			errs = append(errs, fmt.Errorf("tenancy.default: %s", tenantIDRule))
+		}
+		if t.Rate < 0 {
+			errs = append(errs, errors.New("tenancy.rate: must not be negative"))
+		}
+		if t.Rate > 0 && t.Burst < 1 {
+			errs = append(errs, errors.New("tenancy.burst: must be at least 1"))
+		}
+	}
+	if l := c.LoadShed; l.Enabled {
+		if l.MinInFlight < 1 {
+			errs = append(errs, errors.New("load_shed.min_in_flight: must be at least 1"))
+		}
+		if l.MaxInFlight < l.MinInFlight {
+			errs = append(errs, errors.New("load_shed.max_in_flight: must be at least load_shed.min_in_flight"))
+		}
+		if l.TargetLatency.Duration < 0 {
+			errs = append(errs, errors.New("load_shed.target_latency: must not be negative"))
+		}
+		if l.QueueSize < 0 {
+			errs = append(errs, errors.New("load_shed.queue_size: must not be negative"))
+		}
+		if l.QueueTimeout.Duration < 0 {
+			errs = append(errs, errors.New("load_shed.queue_timeout: must not be negative"))
+		}
+		if l.RetryAfter.Duration < time.Second {
+			errs = append(errs, errors.New("load_shed.retry_after: must be at least 1s"))
+		}
+	}
+	if o := c.Events.Outbox; o.Enabled {
+		if c.Storage.Backend == "memory" {
+			errs = append(errs, errors.New("events.outbox.enabled: needs a database storage backend"))
+		}
+		if o.PollInterval.Duration <= 0 {
+			errs = append(errs, errors.New("events.outbox.poll_interval: must be greater than zero"))
+		}
+		if o.BatchSize < 1 {
+			errs = append(errs, errors.New("events.outbox.batch_size: must be at least 1"))
+		}
+	}
+	if r := c.Resilience; r.Enabled {
+		if r.FailureThreshold < 1 {
+			errs = append(errs, errors.New("resilience.failure_threshold: must be at least 1"))
+		}
+		if r.OpenTimeout.Duration <= 0 {
+			errs = append(errs, errors.New("resilience.open_timeout: must be greater than zero"))
+		}
+		if r.Retries < 0 {
+			errs = append(errs, errors.New("resilience.retries: must not be negative"))
+		}
+		if r.RetryBackoff.Duration < 0 {
+			errs = append(errs, errors.New("resilience.retry_backoff: must not be negative"))
+		}
+	}
+	if a := c.Log.Access; a.Enabled {
+		if a.Format != "common" && a.Format != "combined" {
+			errs = append(errs, fmt.Errorf("log.access.format: %q is not common or combined", a.Format))
+		}
+		if a.Output == "" {
+			errs = append(errs, errors.New("log.access.output: must be stdout, stderr or a file path"))
+		}
+		if a.MaxBytes < 0 || a.MaxAge.Duration < 0 || a.MaxBackups < 0 {
+			errs = append(errs, errors.New("log.access: max_bytes, max_age and max_backups must not be negative"))
+		}
+	}
+	if sr := c.SlowRequests; sr.Enabled {
+		if sr.Threshold.Duration <= 0 {
+			errs = append(errs, errors.New("slow_requests.threshold: must be greater than zero"))
+		}
+		if sr.TraceDir != "" && sr.TraceDuration.Duration <= 0 {
+			errs = append(errs, errors.New("slow_requests.trace_duration: must be greater than zero"))
+		}
+	}
+	if st := c.Startup; st.WaitTimeout.Duration < 0 {
+		errs = append(errs, errors.New("startup.wait_timeout: must not be negative"))
+	} else if st.WaitTimeout.Duration > 0 && (st.InitialBackoff.Duration <= 0 || st.MaxBackoff.Duration < st.InitialBackoff.Duration) {
+		errs = append(errs, errors.New("startup: initial_backoff must be greater than zero and max_backoff at least as long"))
+	}
+	if ch := c.Chaos; ch.Enabled {
+		if !c.Development && !c.Demo {
+			errs = append(errs, errors.New("chaos.enabled: requires development or demo"))
+		}
+		for _, e := range validateChaosRules(ch.Rules) {
+			errs = append(errs, fmt.Errorf("chaos.%s: %s", e.Field, e.Message))
+		}
+	}
+	if cp := c.Capture; cp.Enabled {
+		if cp.File == "" {
+			errs = append(errs, errors.New("capture.file: must be set"))
+		}
+		if cp.MaxBodyBytes < 1 {
+			errs = append(errs, errors.New("capture.max_body_bytes: must be at least 1"))
+		}
+		if cp.MaxBytes < 0 || cp.MaxBackups < 0 {
+			errs = append(errs, errors.New("capture: max_bytes and max_backups must not be negative"))
+		}
+	}
+	if v := c.SecurityHeaders.ContentTypeOptions; v != "" && v != "nosniff" {
+		errs = append(errs, fmt.Errorf("security_headers.content_type_options: %q is not nosniff or empty", v))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.SecurityHeaders.Development)) {
+		if _, ok := securityHeaderSettings[name]; !ok {
+			errs = append(errs, fmt.Errorf("security_headers.development.%s: is not a security header setting", name))
+		}
+	}
+	if l := c.I18n; l.Enabled && !slices.Contains(availableLocales(), strings.ToLower(l.DefaultLocale)) {
+		errs = append(errs, fmt.Errorf("i18n.default_locale: %q is not one of %s", l.DefaultLocale, strings.Join(availableLocales(), ", ")))
+	}
+	if pp := c.ProxyProtocol; pp.Enabled {
+		if len(pp.TrustedSources) == 0 {
+			errs = append(errs, errors.New("proxy_protocol.trusted_sources: must not be empty"))
+		} else if _, err := parseIPSet(pp.TrustedSources); err != nil {
+			errs = append(errs, fmt.Errorf("proxy_protocol.trusted_sources: %w", err))
+		}
+		if pp.HeaderTimeout.Duration <= 0 {
+			errs = append(errs, errors.New("proxy_protocol.header_timeout: must be greater than zero"))
+		}
+	}
+	if o := c.SLO; o.Enabled {
+		if o.AlertWindow.Duration < time.Minute || o.Window.Duration < o.AlertWindow.Duration {
+			errs = append(errs, errors.New("slo: alert_window must be at least 1m and window at least as long"))
+		}
+		if o.AlertBurnRate <= 0 {
+			errs = append(errs, errors.New("slo.alert_burn_rate: must be greater than zero"))
+		}
+		if len(o.Objectives) == 0 {
+			errs = append(errs, errors.New("slo.objectives: must have at least one route"))
+		}
+		for _, route := range slices.Sorted(maps.Keys(o.Objectives)) {
+			obj := o.Objectives[route]
+			key := "slo.objectives." + route
+			if obj.Availability < 0 || obj.Availability >= 1 || obj.LatencyTarget < 0 || obj.LatencyTarget >= 1 {
+				errs = append(errs, fmt.Errorf("%s: availability and latency_target must be at least 0 and less than 1", key))
+			}
+			if (obj.LatencyTarget > 0) != (obj.Latency.Duration > 0) {
+				errs = append(errs, fmt.Errorf("%s: latency and latency_target must be set together", key))
+			}
+			if obj.Availability == 0 && obj.LatencyTarget == 0 {
+				errs = append(errs, fmt.Errorf("%s: must set availability or latency_target", key))
+			}
+		}
+	}
+	switch f := c.Flags; f.Provider {
+	case "static":
+	case "file":
+		if f.File == "" {
+			errs = append(errs, errors.New("feature_flags.file: must be set for the file provider"))
+		}
+	case "remote":
+		if u, err := url.Parse(f.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("feature_flags.url: must be an http or https URL for the remote provider"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("feature_flags.provider: %q is not static, file or remote", f.Provider))
+	}
+	if f := c.Flags; f.Provider != "static" && f.RefreshInterval.Duration <= 0 {
+		errs = append(errs, errors.New("feature_flags.refresh_interval: must be greater than zero"))
+	}
+	if err := validateFlags(c.Flags.Flags); err != nil {
+		errs = append(errs, fmt.Errorf("feature_flags.flags: %w", err))
+	}
+	if c.Batch.MaxOperations < 1 {
+		errs = append(errs, errors.New("batch.max_operations: must be at least 1"))
+	}
+	if c.HTTPCache.Enabled && c.HTTPCache.MaxBodyBytes < 1 {
+		errs = append(errs, errors.New("http_cache.max_body_bytes: must be at least 1"))
+	}
+	if _, _, err := parseAPIVersions(c.API); err != nil {
+		errs = append(errs, err)
+	}
+	if len(c.API.Formats) == 0 {
+		errs = append(errs, errors.New("api.formats: must name at least one format"))
+	}
+	for i, f := range c.API.Formats {
+		if codecs[f] == nil {
+			errs = append(errs, fmt.Errorf("api.formats: %q is not json, xml or msgpack", f))
+		} else if slices.Contains(c.API.Formats[:i], f) {
+			errs = append(errs, fmt.Errorf("api.formats: %q is listed twice", f))
+		}
+	}
+	if c.Compression.MinSize < 0 {
+		errs = append(errs, errors.New("compression.min_size: must not be negative"))
+	}
+	for _, cors := range []struct {
+		key              string
+		origins          []string
+		allowCredentials bool
+	}{
+		{"cors", c.CORS.AllowedOrigins, c.CORS.AllowCredentials},
+		{"cors.admin", c.CORS.Admin.AllowedOrigins, c.CORS.Admin.AllowCredentials},
+	} {
+		if cors.allowCredentials && slices.Contains(cors.origins, "*") {
+			errs = append(errs, fmt.Errorf("%s.allow_credentials: cannot be combined with origin *", cors.key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c LogConfig) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.Level))
+	return level, err
+}
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// applyEnv walks the struct v and sets every field carrying an env tag whose
+// variable is present according to lookup.
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := v.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		name, ok := field.Tag.Lookup("env")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct {
+				if err := applyEnv(fv, prefix+key+".", lookup); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		s, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setField(fv, s); err != nil {
+			return fmt.Errorf("invalid value for $%s (%s%s): must be %s, not %q", name, prefix, key, describeSetting(field.Type, field.Tag.Get("values")), s)
+		}
+	}
+	return nil
+}
+
+func setField(fv reflect.Value, s string) error {
+	if fv.Addr().Type().Implements(textUnmarshalerType) {
+		return fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", fv.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		fv.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	for _, name := range []string{"pebbles.yaml", "pebbles.yml", "PEBBLES.YAML"} {
+		path := writeConfig(t, name, `
+# the port the API listens on
+port: 9090
+read_timeout: 7s
+log:
+  level: debug
+cors:
+  allowed_origins:
+    - https://app.example.com
+`)
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if cfg.Port != 9090 || cfg.ReadTimeout.Duration != 7*time.Second || cfg.Log.Level != "debug" {
+			t.Errorf("%s: got port %d, read timeout %s and log level %q", name, cfg.Port, cfg.ReadTimeout, cfg.Log.Level)
+		}
+		if got := cfg.CORS.AllowedOrigins; len(got) != 1 || got[0] != "https://app.example.com" {
+			t.Errorf("%s: got allowed origins %q", name, got)
+		}
+	}
+}
+
+func TestLoadConfigJSONIsNotYAML(t *testing.T) {
+	path := writeConfig(t, "pebbles.json", "port: 9090\n")
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("a .json file was read as YAML")
+	}
+}
+
+func TestCheckConfigYAML(t *testing.T) {
+	path := writeConfig(t, "pebbles.yaml", "port: 70000\nlog:\n  levle: debug\n  format: 3\n")
+	err := checkConfig(path)
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	for _, want := range []string{"log.levle", "log.format", "port: 70000"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("the error does not mention %s: %v", want, err)
+		}
+	}
+
+	path = writeConfig(t, "broken.yml", "log:\n  level: [debug]\n")
+	if err := checkConfig(path); err == nil || !strings.Contains(err.Error(), "broken.yml") {
+		t.Errorf("got error %v for unsupported YAML, want one naming the file", err)
+	}
+}
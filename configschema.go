@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// durationType is the type of the duration settings, whose values are
+// strings such as "30s".
+var durationType = reflect.TypeFor[Duration]()
+
+// describeSetting says what values a setting of type t takes, with the
+// allowed values of its values tag, for error messages and the sample
+// configuration.
+func describeSetting(t reflect.Type, values string) string {
+	choices := strings.ReplaceAll(values, ",", ", ")
+	switch {
+	case t == durationType:
+		return "a duration such as 30s or 1m30s"
+	case t.Kind() == reflect.String && values != "":
+		return "one of " + choices
+	case t.Kind() == reflect.String:
+		return "a string"
+	case t.Kind() == reflect.Int || t.Kind() == reflect.Int64:
+		return "a whole number"
+	case t.Kind() == reflect.Float64:
+		return "a number"
+	case t.Kind() == reflect.Bool:
+		return "true or false"
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String && values != "":
+		return "a list of " + choices
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		return "a list of strings"
+	case t.Kind() == reflect.Slice:
+		return "a list of objects"
+	}
+	return "an object"
+}
+
+// configFields returns the settings of the struct type t by JSON name.
+func configFields(t reflect.Type) (names []string, fields map[string]reflect.StructField) {
+	fields = make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		names = append(names, name)
+		fields[name] = f
+	}
+	return names, fields
+}
+
+// isConfigLeaf reports whether settings of type t hold a single value
+// rather than other settings.
+func isConfigLeaf(t reflect.Type) bool {
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return false
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Struct
+	}
+	return true
+}
+
+// checkConfigJSON checks a config file against the settings of Config,
+// returning every key it does not know and every value of the wrong type
+// with the path of its key, which the JSON decoder would only report one
+// at a time and sometimes without saying where.
+func checkConfigJSON(data []byte) error {
+	if err := json.Unmarshal(data, new(any)); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := textPosition(data, syntaxErr.Offset)
+			return fmt.Errorf("line %d, column %d: %w", line, column, err)
+		}
+		return err
+	}
+	return errors.Join(checkConfigValue("", data, reflect.TypeFor[Config](), "")...)
+}
+
+func checkConfigValue(key string, raw json.RawMessage, t reflect.Type, values string) []error {
+	if isConfigLeaf(t) {
+		if err := json.Unmarshal(raw, reflect.New(t).Interface()); err != nil {
+			return []error{fmt.Errorf("%s: must be %s, not %s", key, describeSetting(t, values), abbreviate(raw))}
+		}
+		return nil
+	}
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return nil
+	}
+	var errs []error
+	switch t.Kind() {
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			return []error{fmt.Errorf("%s: must be %s, not %s", key, describeSetting(t, values), abbreviate(raw))}
+		}
+		for i, item := range items {
+			errs = append(errs, checkConfigValue(fmt.Sprintf("%s[%d]", key, i), item, t.Elem(), "")...)
+		}
+	case reflect.Map:
+		var entries map[string]json.RawMessage
+		if json.Unmarshal(raw, &entries) != nil {
+			return []error{fmt.Errorf("%s: must be an object, not %s", key, abbreviate(raw))}
+		}
+		for _, name := range slices.Sorted(maps.Keys(entries)) {
+			errs = append(errs, checkConfigValue(key+"."+name, entries[name], t.Elem(), "")...)
+		}
+	default:
+		var entries map[string]json.RawMessage
+		if json.Unmarshal(raw, &entries) != nil {
+			if key == "" {
+				return []error{fmt.Errorf("the file must hold an object, not %s", abbreviate(raw))}
+			}
+			return []error{fmt.Errorf("%s: must be an object, not %s", key, abbreviate(raw))}
+		}
+		names, fields := configFields(t)
+		prefix := ""
+		if key != "" {
+			prefix = key + "."
+		}
+		for _, name := range slices.Sorted(maps.Keys(entries)) {
+			f, ok := fields[name]
+			if !ok {
+				err := fmt.Errorf("%s%s: is not a known setting", prefix, name)
+				if similar := closestName(name, names); similar != "" {
+					err = fmt.Errorf("%s%s: is not a known setting; did you mean %s%s?", prefix, name, prefix, similar)
+				}
+				errs = append(errs, err)
+				continue
+			}
+			errs = append(errs, checkConfigValue(prefix+name, entries[name], f.Type, f.Tag.Get("values"))...)
+		}
+	}
+	return errs
+}
+
+// abbreviate returns the JSON value raw for an error message, cut short
+// if it is long.
+func abbreviate(raw json.RawMessage) string {
+	s := string(bytes.TrimSpace(raw))
+	if len(s) > 40 {
+		s = s[:37] + "..."
+	}
+	return s
+}
+
+// textPosition returns the line and column of the byte at offset in data,
+// counting from 1.
+func textPosition(data []byte, offset int64) (line, column int) {
+	offset = min(offset, int64(len(data)))
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// closestName returns the one of names that name is most likely a typo of,
+// or "" if none is close.
+func closestName(name string, names []string) string {
+	best, bestDistance := "", min(3, len(name))
+	for _, n := range names {
+		if d := editDistance(name, n); d < bestDistance {
+			best, bestDistance = n, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// stripJSONComments replaces the // comments of data, from the slashes
+// to the end of their line, with spaces, so that a config file may explain
+// itself and errors still point at the right column.
+func stripJSONComments(data []byte) []byte {
+	out := slices.Clone(data)
+	inString := false
+	for i := 0; i < len(out); i++ {
+		switch c := out[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case !inString && c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		}
+	}
+	return out
+}
+
+// writeConfigSample writes cfg as a config file in which each setting is
+// preceded by a comment saying what values it takes and the environment
+// variable that overrides it, if any.
+func writeConfigSample(w io.Writer, cfg Config) error {
+	var b bytes.Buffer
+	if err := writeConfigObject(&b, reflect.ValueOf(cfg), "    "); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func writeConfigObject(b *bytes.Buffer, v reflect.Value, indent string) error {
+	names, fields := configFields(v.Type())
+	b.WriteString("{\n")
+	for i, name := range names {
+		f := fields[name]
+		fv := v.FieldByIndex(f.Index)
+		if isConfigLeaf(f.Type) || f.Type.Kind() != reflect.Struct {
+			comment := describeSetting(f.Type, f.Tag.Get("values"))
+			if env, ok := f.Tag.Lookup("env"); ok {
+				comment = "$" + env + ": " + comment
+			} else {
+				comment += ", in the config file only"
+			}
+			fmt.Fprintf(b, "%s// %s\n", indent, comment)
+		}
+		fmt.Fprintf(b, "%s%q: ", indent, name)
+		switch {
+		case !isConfigLeaf(f.Type) && f.Type.Kind() == reflect.Struct:
+			if err := writeConfigObject(b, fv, indent+"    "); err != nil {
+				return err
+			}
+		case fv.Kind() == reflect.Slice && fv.Len() == 0:
+			b.WriteString("[]")
+		case fv.Kind() == reflect.Map && fv.Len() == 0:
+			b.WriteString("{}")
+		case isConfigLeaf(f.Type):
+			value, err := json.Marshal(fv.Interface())
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			b.Write(value)
+		default:
+			value, err := json.MarshalIndent(fv.Interface(), indent, "    ")
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			b.Write(value)
+		}
+		if i < len(names)-1 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString(indent[4:] + "}")
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// connTracker keeps the state of the connections of one or more
+// http.Servers, as reported to their ConnState hooks, so that a shutdown
+// that runs out of time can say how many were still open. Hijacked
+// connections, such as WebSockets, are no longer the server's and are not
+// counted.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]http.ConnState)}
+}
+
+func (t *connTracker) track(c net.Conn, st http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch st {
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+	default:
+		t.conns[c] = st
+	}
+}
+
+// counts returns how many connections are serving or about to serve a
+// request, and how many are idle between requests.
+func (t *connTracker) counts() (active, idle int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, st := range t.conns {
+		if st == http.StateIdle {
+			idle++
+		} else {
+			active++
+		}
+	}
+	return active, idle
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CORSPolicy says which cross-origin browser requests are allowed.
+type CORSPolicy struct {
+	// AllowedOrigins lists the origins such as https://app.example.com
+	// that may call the API; "*" allows any origin.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+}
+
+func (p CORSPolicy) allowsOrigin(origin string) bool {
+	return slices.Contains(p.AllowedOrigins, "*") || slices.Contains(p.AllowedOrigins, origin)
+}
+
+// CORSPolicies is the policy for most routes together with the ones for
+// path prefixes such as /admin/.
+type CORSPolicies struct {
+	Default  CORSPolicy
+	ByPrefix map[string]CORSPolicy
+}
+
+// corsPolicies returns the policy for most routes and the stricter one
+// for the admin routes.
+func corsPolicies(cfg CORSConfig) CORSPolicies {
+	def := CORSPolicy{
+		AllowedOrigins:   cfg.AllowedOrigins,
+		AllowedMethods:   cfg.AllowedMethods,
+		AllowedHeaders:   cfg.AllowedHeaders,
+		ExposedHeaders:   cfg.ExposedHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           int(cfg.MaxAge.Seconds()),
+	}
+	admin := def
+	admin.AllowedOrigins = cfg.Admin.AllowedOrigins
+	admin.AllowCredentials = cfg.Admin.AllowCredentials
+	return CORSPolicies{Default: def, ByPrefix: map[string]CORSPolicy{"/admin/": admin}}
+}
+
+// CORS answers preflight requests and adds the CORS response headers. The
+// policy is chosen by the longest prefix in ByPrefix that matches the
+// request path, falling back to Default. policies is called for every
+// request, so the policies can be replaced while the server runs.
+func CORS(policies func() CORSPolicies) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ps := policies()
+			policy, best := ps.Default, ""
+			for prefix, p := range ps.ByPrefix {
+				if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > len(best) {
+					policy, best = p, prefix
+				}
+			}
+
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if !policy.allowsOrigin(origin) {
+				if preflight {
+					WriteError(w, r, Forbidden("origin %q is not allowed", origin))
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if policy.AllowCredentials || !slices.Contains(policy.AllowedOrigins, "*") {
+				h.Set("Access-Control-Allow-Origin", origin)
+			} else {
+				h.Set("Access-Control-Allow-Origin", "*")
+			}
+			if policy.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if !preflight {
+				if len(policy.ExposedHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			method := r.Header.Get("Access-Control-Request-Method")
+			if !slices.Contains(policy.AllowedMethods, method) {
+				WriteError(w, r, Forbidden("method %s is not allowed", method))
+				return
+			}
+			h.Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+			if len(policy.AllowedHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+			}
+			if policy.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
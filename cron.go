@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule says when a scheduled job runs next.
+type Schedule interface {
+	// Next returns the first time the job runs after t.
+	Next(t time.Time) time.Time
+}
+
+// everySchedule runs a job every interval, counting from the previous run.
+type everySchedule time.Duration
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSchedule runs a job at the minutes its fields match, as cron does:
+// each field holds a bit for every value it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// anyDay is set if the day of the month or the day of the week is *,
+	// so that a day must match both; otherwise it may match either.
+	anyDay bool
+	loc    *time.Location
+}
+
+// cronField is the range of the values of a cron field and the names of
+// some of them.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = [5]cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of the month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of the week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// cronMacros are the shorthands for common cron expressions.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseSchedule parses spec, a cron expression of five fields such as
+// "30 3 * * mon-fri" or one of the macros such as @daily, whose times are
+// in loc, or "@every" and a duration such as "@every 15m".
+func parseSchedule(spec string, loc *time.Location) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("%q is not @every and a positive duration such as 15m", spec)
+		}
+		return everySchedule(interval), nil
+	}
+	expr := spec
+	if strings.HasPrefix(spec, "@") {
+		var ok bool
+		if expr, ok = cronMacros[spec]; !ok {
+			return nil, fmt.Errorf("%q is not one of @yearly, @monthly, @weekly, @daily, @hourly or @every", spec)
+		}
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%q has %d fields rather than minute, hour, day of the month, month and day of the week", spec, len(fields))
+	}
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", spec, err)
+		}
+		bits[i] = b
+	}
+	// Sunday is both 0 and 7.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	cs := &cronSchedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		anyDay: fields[2] == "*" || fields[4] == "*",
+		loc:    loc,
+	}
+	if cs.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q matches no day", spec)
+	}
+	return cs, nil
+}
+
+// parseCronField returns the bits of the values s matches: a list of *,
+// values and ranges separated by commas, each optionally followed by a
+// step such as /15.
+func parseCronField(s string, f cronField) (uint64, error) {
+	var bits uint64
+	for item := range strings.SplitSeq(s, ",") {
+		rng, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("%s step %q is not a positive number", f.name, stepText)
+			}
+			step = n
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(loText); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(hiText); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("%s range %q ends before it starts", f.name, rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value parses a value of the field, a number or one of its names.
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return i + f.min, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("%s %q is not a number from %d to %d", f.name, s, f.min, f.max)
+	}
+	return n, nil
+}
+
+// Next returns the zero time if no time matches within five years, as for
+// "0 0 31 2 *", which parseSchedule rejects.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	after := t.In(s.loc)
+	t = after.Truncate(time.Minute).Add(time.Minute)
+	// Matching times are at most a few years apart, as for February 29.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		next := t
+		switch {
+		case s.month&(1<<uint(m)) == 0:
+			next = time.Date(y, m+1, 1, 0, 0, 0, 0, s.loc)
+		case !s.matchesDay(t):
+			next = time.Date(y, m, d+1, 0, 0, 0, 0, s.loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			// Added rather than built with time.Date, which turns the hour
+			// skipped when clocks go forward into the one before it.
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			next = t.Add(time.Minute)
+		case sameMinute(t, after):
+			// The hour repeated when clocks go back runs once.
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// A midnight skipped by a clock change can also take a day back.
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// sameMinute reports whether a and b read the same on a wall clock, to
+// the minute.
+func sameMinute(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd && a.Hour() == b.Hour() && a.Minute() == b.Minute()
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
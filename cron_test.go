@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	// A Wednesday.
+	from := time.Date(2026, 10, 14, 9, 7, 30, 0, time.UTC)
+	at := func(loc *time.Location, s ...string) []time.Time {
+		var times []time.Time
+		for _, v := range s {
+			tm, err := time.ParseInLocation("2006-01-02 15:04", v, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			times = append(times, tm)
+		}
+		return times
+	}
+	tests := []struct {
+		spec string
+		from time.Time
+		want []time.Time
+	}{
+		{"*/15 * * * *", from, at(time.UTC, "2026-10-14 09:15", "2026-10-14 09:30", "2026-10-14 09:45", "2026-10-14 10:00")},
+		{"7 9 * * *", from, at(time.UTC, "2026-10-15 09:07", "2026-10-16 09:07")},
+		{"30 3 * * mon-fri", from, at(time.UTC, "2026-10-15 03:30", "2026-10-16 03:30", "2026-10-19 03:30")},
+		{"0 12 * * 7", from, at(time.UTC, "2026-10-18 12:00", "2026-10-25 12:00")},
+		{"0 12 * * SUN", from, at(time.UTC, "2026-10-18 12:00", "2026-10-25 12:00")},
+		{"5 4-6 1 Jan,oct *", from, at(time.UTC, "2027-01-01 04:05", "2027-01-01 05:05", "2027-01-01 06:05", "2027-10-01 04:05")},
+		{"0 0 */10 * *", from, at(time.UTC, "2026-10-21 00:00", "2026-10-31 00:00", "2026-11-01 00:00")},
+		// With both days restricted either may match.
+		{"0 0 1,15 * mon", from, at(time.UTC, "2026-10-15 00:00", "2026-10-19 00:00", "2026-10-26 00:00", "2026-11-01 00:00")},
+		{"0 0 29 2 *", from, at(time.UTC, "2028-02-29 00:00", "2032-02-29 00:00")},
+		{"@hourly", from, at(time.UTC, "2026-10-14 10:00", "2026-10-14 11:00")},
+		{"@daily", from, at(time.UTC, "2026-10-15 00:00", "2026-10-16 00:00")},
+		{"@weekly", from, at(time.UTC, "2026-10-18 00:00", "2026-10-25 00:00")},
+		{"@monthly", from, at(time.UTC, "2026-11-01 00:00", "2026-12-01 00:00")},
+		{"@yearly", from, at(time.UTC, "2027-01-01 00:00", "2028-01-01 00:00")},
+		{"@every 90m", from, []time.Time{from.Add(90 * time.Minute), from.Add(180 * time.Minute)}},
+		{"  @every 1h30m  ", from, []time.Time{from.Add(90 * time.Minute)}},
+		// 01:30 does not happen on 28 March 2027, when clocks go forward.
+		{"30 1 * * *", time.Date(2027, 3, 27, 12, 0, 0, 0, london), at(london, "2027-03-29 01:30", "2027-03-30 01:30")},
+		// It happens twice on 25 October 2026, and runs the first time.
+		{"30 1 * * *", time.Date(2026, 10, 24, 12, 0, 0, 0, london), []time.Time{
+			time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC),
+			time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC),
+		}},
+		{"0 * * * *", time.Date(2026, 10, 25, 0, 30, 0, 0, london), []time.Time{
+			time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 10, 25, 2, 0, 0, 0, time.UTC),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := parseSchedule(tt.spec, tt.from.Location())
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := tt.from
+			for _, want := range tt.want {
+				next = s.Next(next)
+				if !next.Equal(want) {
+					t.Fatalf("got %s, want %s", next, want.In(tt.from.Location()))
+				}
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct{ spec, want string }{
+		{"", "has 0 fields"},
+		{"* * * *", "has 4 fields"},
+		{"* * * * * *", "has 6 fields"},
+		{"60 * * * *", `minute "60" is not a number from 0 to 59`},
+		{"* 24 * * *", `hour "24" is not a number from 0 to 23`},
+		{"* * 0 * *", `day of the month "0" is not a number from 1 to 31`},
+		{"* * * 13 *", `month "13" is not a number from 1 to 12`},
+		{"* * * * 8", `day of the week "8" is not a number from 0 to 7`},
+		{"mon * * * *", `minute "mon" is not a number`},
+		{"* * * * monday", `day of the week "monday" is not a number`},
+		{"1,,2 * * * *", `minute "" is not a number`},
+		{"-5 * * * *", `minute "" is not a number`},
+		{"30-10 * * * *", `minute range "30-10" ends before it starts`},
+		{"* * * * fri-mon", `day of the week range "fri-mon" ends before it starts`},
+		{"*/0 * * * *", `minute step "0" is not a positive number`},
+		{"*/x * * * *", `minute step "x" is not a positive number`},
+		{"0 0 31 2 *", "matches no day"},
+		{"0 0 30 feb *", "matches no day"},
+		{"@fortnightly", "is not one of @yearly"},
+		{"@every", "is not one of @yearly"},
+		{"@every soon", "is not @every and a positive duration"},
+		{"@every 0s", "is not @every and a positive duration"},
+		{"@every -5m", "is not @every and a positive duration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := parseSchedule(tt.spec, time.UTC)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, %v, want an error saying %q", s, err, tt.want)
+			}
+		})
+	}
+}
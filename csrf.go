@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+)
+
+// CodeCSRF is the error code of requests that change something with a
+// session cookie but without its CSRF token.
+const CodeCSRF = "csrf_token_invalid"
+
+// csrfHeader is the header carrying the CSRF token of a session.
+const csrfHeader = "X-CSRF-Token"
+
+// csrfToken is the body of GET /auth/csrf.
+type csrfToken struct {
+	Token  string `json:"token"`
+	Header string `json:"header"`
+}
+
+// csrfTokens derives the CSRF tokens of sessions from a key, so that a
+// token is the same for the whole of a session, however it is stored, and
+// cannot be guessed from the session cookie, which scripts cannot read
+// anyway.
+type csrfTokens struct {
+	key []byte
+}
+
+func newCSRFTokens(secret string) *csrfTokens {
+	sum := sha256.Sum256([]byte("csrf\n" + secret))
+	return &csrfTokens{key: sum[:]}
+}
+
+// token returns the CSRF token of the session s.
+func (c *csrfTokens) token(s Session) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(s.ID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// check returns an error unless r carries the CSRF token of s in
+// csrfHeader. Other sites can make a browser send the session cookie but
+// cannot read the token nor, without CORS allowing them, set the header.
+func (c *csrfTokens) check(r *http.Request, s Session) error {
+	got := r.Header.Get(csrfHeader)
+	if got == "" {
+		return NewAPIError(http.StatusForbidden, CodeCSRF, "requests changing something with a session cookie need its CSRF token in "+csrfHeader+"; get it from GET /auth/csrf")
+	}
+	if !hmac.Equal([]byte(got), []byte(c.token(s))) {
+		return NewAPIError(http.StatusForbidden, CodeCSRF, "the CSRF token is not that of the session")
+	}
+	return nil
+}
+
+// csrf serves the CSRF token of the session, for single page apps to send
+// with the requests that change something.
+func (o *oidcLogin) csrf(w http.ResponseWriter, r *http.Request) error {
+	s := o.sessions.session(r.Context())
+	if s == nil {
+		return Unauthorized("not logged in")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respond(w, r, http.StatusOK, csrfToken{Token: o.sessions.csrf.token(s.Session), Header: csrfHeader})
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Loader batches the loads of values by key that the resolvers of a
+// GraphQL request make, such as of the attachments of every pebble of a
+// list, into one call of fetch for all the keys asked for until a value
+// is needed, and keeps the values for the rest of the request. Keys that
+// fetch leaves out of its map get the zero value.
+type Loader[K comparable, V any] struct {
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)
+
+	mu      sync.Mutex
+	pending []K
+	queued  map[K]bool
+	values  map[K]V
+	errs    map[K]error
+}
+
+func NewLoader[K comparable, V any](fetch func(ctx context.Context, keys []K) (map[K]V, error)) *Loader[K, V] {
+	return &Loader[K, V]{
+		fetch:  fetch,
+		queued: make(map[K]bool),
+		values: make(map[K]V),
+		errs:   make(map[K]error),
+	}
+}
+
+// Load queues key and returns a function returning its value, which on
+// its first call fetches every key queued by then that is not loaded.
+func (l *Loader[K, V]) Load(ctx context.Context, key K) func() (V, error) {
+	l.mu.Lock()
+	if _, done := l.values[key]; !done && l.errs[key] == nil && !l.queued[key] {
+		l.pending = append(l.pending, key)
+		l.queued[key] = true
+	}
+	l.mu.Unlock()
+	return func() (V, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.queued[key] {
+			keys := l.pending
+			l.pending = nil
+			clear(l.queued)
+			values, err := l.fetch(ctx, keys)
+			for _, k := range keys {
+				if err != nil {
+					l.errs[k] = err
+				} else {
+					l.values[k] = values[k]
+				}
+			}
+		}
+		return l.values[key], l.errs[key]
+	}
+}
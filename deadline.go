@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// requestTimeoutHeader lets a client give a request less time than the
+// server would, as grpc-timeout does for gRPC calls.
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// Deadline gives requests that carry an X-Request-Timeout header, such as
+// 1.5s or 200ms, a context with that deadline, so that the store calls
+// they make give up once the client has stopped waiting. A timeout beyond
+// the deadline the request already has changes nothing.
+func Deadline(clock Clock) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			v := r.Header.Get(requestTimeoutHeader)
+			if v == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				WriteError(w, r, Invalid(nil, "%s must be a positive duration such as 1.5s", requestTimeoutHeader))
+				return
+			}
+			ctx, cancel := clock.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// timeoutStore gives every call to the wrapped store at most timeout, or
+// less if its context has an earlier deadline. A call that runs out of
+// time fails with context.DeadlineExceeded, which handlers report as a
+// 504 response.
+type timeoutStore struct {
+	Store
+	timeout time.Duration
+	clock   Clock
+}
+
+func (s timeoutStore) List(ctx context.Context, q ListQuery) ([]Pebble, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.List(ctx, q)
+}
+
+func (s timeoutStore) Search(ctx context.Context, q SearchQuery) ([]SearchHit, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Search(ctx, q)
+}
+
+func (s timeoutStore) Get(ctx context.Context, id string) (Pebble, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Get(ctx, id)
+}
+
+func (s timeoutStore) Create(ctx context.Context, p Pebble) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Create(ctx, p)
+}
+
+func (s timeoutStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Update(ctx, p, prev)
+}
+
+func (s timeoutStore) Delete(ctx context.Context, id string, at time.Time) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Delete(ctx, id, at)
+}
+
+func (s timeoutStore) Restore(ctx context.Context, id string) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Restore(ctx, id)
+}
+
+func (s timeoutStore) Purge(ctx context.Context, before time.Time) ([]string, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Purge(ctx, before)
+}
+
+func (s timeoutStore) CreateAPIKey(ctx context.Context, k APIKey) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.CreateAPIKey(ctx, k)
+}
+
+func (s timeoutStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.ListAPIKeys(ctx)
+}
+
+func (s timeoutStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.GetAPIKey(ctx, id)
+}
+
+func (s timeoutStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.GetAPIKeyByHash(ctx, hash)
+}
+
+func (s timeoutStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.RevokeAPIKey(ctx, id, at)
+}
+
+func (s timeoutStore) CreateWebhook(ctx context.Context, w Webhook) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.CreateWebhook(ctx, w)
+}
+
+func (s timeoutStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.ListWebhooks(ctx)
+}
+
+func (s timeoutStore) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.GetWebhook(ctx, id)
+}
+
+func (s timeoutStore) DeleteWebhook(ctx context.Context, id string) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.DeleteWebhook(ctx, id)
+}
+
+func (s timeoutStore) SaveWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.SaveWebhookDelivery(ctx, d)
+}
+
+func (s timeoutStore) ListWebhookDeliveries(ctx context.Context, webhookID, status string, limit int) ([]WebhookDelivery, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.ListWebhookDeliveries(ctx, webhookID, status, limit)
+}
+
+func (s timeoutStore) AppendAuditEntry(ctx context.Context, e AuditEntry) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AppendAuditEntry(ctx, e)
+}
+
+func (s timeoutStore) ListAuditEntries(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.ListAuditEntries(ctx, q)
+}
+
+func (s timeoutStore) CreateAttachment(ctx context.Context, a Attachment) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.CreateAttachment(ctx, a)
+}
+
+func (s timeoutStore) ListAttachments(ctx context.Context, pebbleIDs ...string) ([]Attachment, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.ListAttachments(ctx, pebbleIDs...)
+}
+
+func (s timeoutStore) GetAttachment(ctx context.Context, id string) (Attachment, error) {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.GetAttachment(ctx, id)
+}
+
+func (s timeoutStore) DeleteAttachment(ctx context.Context, id string) error {
+	ctx, cancel := s.clock.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.DeleteAttachment(ctx, id)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strings"
+)
+
+// DebugHandler serves the runtime debugging endpoints: the pprof profiles
+// under /debug/pprof/, the expvar variables at /debug/vars, the running
+// configuration, with secrets redacted, at /debug/config and the switch
+// for bodies at /debug/body-logging. It has no authentication and must only
+// be served on the admin listener.
+func DebugHandler(config func() Config, bodies *BodyLogger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("GET /debug/config", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, http.StatusOK, config().Redacted())
+	})
+	mux.HandleFunc("GET /debug/body-logging", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, http.StatusOK, bodyLoggingState{Enabled: bodies.Enabled()})
+	})
+	mux.HandleFunc("PUT /debug/body-logging", func(w http.ResponseWriter, r *http.Request) {
+		var st bodyLoggingState
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&st); err != nil {
+			WriteError(w, r, Invalid(nil, "invalid request body: %v", err))
+			return
+		}
+		bodies.SetEnabled(st.Enabled)
+		slog.InfoContext(r.Context(), "body logging switched", "enabled", st.Enabled)
+		respond(w, r, http.StatusOK, st)
+	})
+	return mux
+}
+
+type bodyLoggingState struct {
+	Enabled bool `json:"enabled"`
+}
+
+const redactedValue = "REDACTED"
+
+// Redacted returns a copy of c with secrets replaced, so that it can be
+// shown to operators. Credentials in URLs are removed and the values of
+// exporter headers, which usually carry tokens, are hidden.
+func (c Config) Redacted() Config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	redact(&c.Auth.JWT.Secret)
+	redact(&c.Auth.APIKey.BootstrapKey)
+	redact(&c.Auth.OIDC.ClientSecret)
+	redact(&c.Auth.OIDC.SessionKey)
+	redact(&c.Attachments.SigningKey)
+	redact(&c.Attachments.S3.SecretAccessKey)
+	providers := make(map[string]InboundProviderConfig, len(c.InboundWebhooks.Providers))
+	for name, p := range c.InboundWebhooks.Providers {
+		redact(&p.Secret)
+		providers[name] = p
+	}
+	c.InboundWebhooks.Providers = providers
+	// A DSN may be a URL or a list of key=value pairs, either of which
+	// can hold a password.
+	redact(&c.Storage.DSN)
+	if u, err := url.Parse(c.Events.NATS.URL); err == nil {
+		c.Events.NATS.URL = u.Redacted()
+	}
+	if u, err := url.Parse(c.Cache.Redis.URL); err == nil {
+		c.Cache.Redis.URL = u.Redacted()
+	}
+	if u, err := url.Parse(c.Proxy.Upstream); err == nil {
+		c.Proxy.Upstream = u.Redacted()
+	}
+	headers := make([]string, len(c.Tracing.Headers))
+	for i, h := range c.Tracing.Headers {
+		k, _, _ := strings.Cut(h, "=")
+		headers[i] = k + "=" + redactedValue
+	}
+	c.Tracing.Headers = headers
+	return c
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxBodyDepth is how deeply the objects and arrays of request
+// bodies may nest unless request_body.max_depth says otherwise.
+const defaultMaxBodyDepth = 32
+
+// decodeRules are the rules request bodies are decoded by: how deeply
+// they may nest, and whether members that the type decoded into has no
+// field for are ignored rather than refused.
+type decodeRules struct {
+	maxDepth     int
+	allowUnknown bool
+}
+
+// strictDecoding refuses unknown fields, as bodies are decoded unless
+// their route is configured otherwise.
+var strictDecoding = decodeRules{maxDepth: defaultMaxBodyDepth}
+
+type decodeRulesKey struct{}
+
+// withDecodeRules returns a copy of ctx whose request bodies Bind decodes
+// by rules.
+func withDecodeRules(ctx context.Context, rules decodeRules) context.Context {
+	return context.WithValue(ctx, decodeRulesKey{}, rules)
+}
+
+// requestDecodeRules returns the rules the body of r is decoded by.
+func requestDecodeRules(r *http.Request) decodeRules {
+	if rules, ok := r.Context().Value(decodeRulesKey{}).(decodeRules); ok {
+		return rules
+	}
+	return strictDecoding
+}
+
+// bodyFieldErrors lists the members of a request body that do not fit the
+// type it is decoded into, by their path from "body", such as
+// "body.items[2].name".
+type bodyFieldErrors ValidationErrors
+
+func (e bodyFieldErrors) Error() string {
+	return ValidationErrors(e).Error()
+}
+
+// decodeJSON decodes the JSON document read from r into v by rules. The
+// document is read whole and checked against the type of v before it is
+// decoded, so that every member of the wrong type, and every unknown one
+// unless rules allow them, is reported as a bodyFieldErrors with its path,
+// rather than only the first, and without one.
+func decodeJSON(r io.Reader, v any, rules decodeRules) error {
+	return decodeJSONAt(r, v, rules, "body")
+}
+
+// decodeJSONAt is decodeJSON for a document at root rather than "body",
+// such as a row of an import, whose members are reported by their path
+// alone when root is empty.
+func decodeJSONAt(r io.Reader, v any, rules decodeRules, root string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	tree, err := readBodyTree(dec, root, 0, rules.maxDepth)
+	if err != nil {
+		return err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("data after the top-level value")
+	}
+	var errs bodyFieldErrors
+	checkBodyTree(reflect.TypeOf(v), tree, root, rules, &errs)
+	if errs != nil {
+		return errs
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		// Left for the types that decode themselves, such as durations.
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return bodyFieldErrors{{Field: memberPath(root, typeErr.Field), Message: "expected " + typeErr.Type.String()}}
+		}
+		return err
+	}
+	return nil
+}
+
+// readBodyTree reads the next value of dec as a tree of jsonObject, []any,
+// string, json.Number, bool and nil values, refusing objects and arrays
+// nested more than maxDepth deep.
+func readBodyTree(dec *json.Decoder, path string, depth, maxDepth int) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		if errors.Is(err, io.EOF) && depth > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	d, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	if depth >= maxDepth {
+		return nil, bodyFieldErrors{{Field: path, Message: fmt.Sprintf("must not nest objects and arrays more than %d deep", maxDepth)}}
+	}
+	if d == '[' {
+		list := []any{}
+		for dec.More() {
+			v, err := readBodyTree(dec, path+"["+strconv.Itoa(len(list))+"]", depth+1, maxDepth)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	obj := jsonObject{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+		v, err := readBodyTree(dec, memberPath(path, key), depth+1, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		obj = append(obj, jsonMember{Key: key, Value: v})
+	}
+	_, err = dec.Token()
+	return obj, err
+}
+
+// memberPath returns the path of member key of the object at path.
+func memberPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var jsonUnmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+// checkBodyTree appends to errs the members of tree, at path, that
+// json.Unmarshal could not decode into a value of type t, or would drop
+// as unknown.
+func checkBodyTree(t reflect.Type, tree any, path string, rules decodeRules, errs *bodyFieldErrors) {
+	if tree == nil {
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	fail := func(msg string) { *errs = append(*errs, FieldError{Field: path, Message: msg}) }
+	pt := reflect.PointerTo(t)
+	if pt.Implements(jsonUnmarshalerType) {
+		return
+	}
+	if pt.Implements(textUnmarshalerType) {
+		if _, ok := tree.(string); !ok {
+			fail("expected string")
+		}
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := tree.(jsonObject)
+		if !ok {
+			fail("expected object")
+			return
+		}
+		for _, m := range obj {
+			f, ok := bodyField(t, m.Key)
+			if !ok {
+				if !rules.allowUnknown {
+					*errs = append(*errs, FieldError{Field: memberPath(path, m.Key), Message: "unknown field"})
+				}
+				continue
+			}
+			checkBodyTree(f.Type, m.Value, memberPath(path, m.Key), rules, errs)
+		}
+	case reflect.Map:
+		obj, ok := tree.(jsonObject)
+		if !ok {
+			fail("expected object")
+			return
+		}
+		for _, m := range obj {
+			checkBodyTree(t.Elem(), m.Value, memberPath(path, m.Key), rules, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			// Bytes are sent as base64 strings.
+			if _, ok := tree.(string); !ok {
+				fail("expected string")
+			}
+			return
+		}
+		list, ok := tree.([]any)
+		if !ok {
+			fail("expected array")
+			return
+		}
+		for i, item := range list {
+			checkBodyTree(t.Elem(), item, path+"["+strconv.Itoa(i)+"]", rules, errs)
+		}
+	case reflect.String:
+		if _, ok := tree.(string); !ok {
+			fail("expected string")
+		}
+	case reflect.Bool:
+		if _, ok := tree.(bool); !ok {
+			fail("expected boolean")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := tree.(json.Number)
+		if !ok {
+			fail("expected integer")
+		} else if _, err := strconv.ParseInt(string(n), 10, t.Bits()); err != nil {
+			fail(numberProblem(err, "expected integer"))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := tree.(json.Number)
+		if !ok {
+			fail("expected integer")
+		} else if _, err := strconv.ParseUint(string(n), 10, t.Bits()); err != nil {
+			fail(numberProblem(err, "expected integer"))
+		}
+	case reflect.Float32, reflect.Float64:
+		n, ok := tree.(json.Number)
+		if !ok {
+			fail("expected number")
+		} else if _, err := strconv.ParseFloat(string(n), t.Bits()); err != nil {
+			fail(numberProblem(err, "expected number"))
+		}
+	}
+}
+
+// numberProblem describes the error of parsing a number: one out of the
+// range of its type, or otherwise the message expected.
+func numberProblem(err error, expected string) string {
+	if errors.Is(err, strconv.ErrRange) {
+		return "is out of range"
+	}
+	return expected
+}
+
+// bodyField returns the field of the struct type t that json.Unmarshal
+// fills from the member name: the one named that, or else one whose name
+// only differs from it in case.
+func bodyField(t reflect.Type, name string) (reflect.StructField, bool) {
+	if f, ok := jsonField(t, name); ok {
+		return f, true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			if sf, ok := bodyField(f.Type, name); ok {
+				return sf, true
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if n := jsonFieldName(f); n != "-" && strings.EqualFold(n, name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// demoAPIKey is the API key demo mode accepts, with the admin role. It is
+// published in the README, so demo mode must never hold real data.
+const demoAPIKey = "pebble-demo-key-not-for-production"
+
+// demoSigningKey signs the attachment download URLs of demo mode.
+const demoSigningKey = "pebble-demo-signing-key-not-for-production"
+
+// applyDemo replaces the settings that reach outside the process with
+// in-memory fakes, so that the whole API can be tried without a database,
+// cache, message broker or identity provider. Settings that stay in the
+// process, such as the port and timeouts, keep their values.
+func (c *Config) applyDemo() {
+	c.Storage.Backend = "memory"
+	c.Storage.DSN = ""
+	c.Cache.Backend = "memory"
+	c.Events.Publisher = "none"
+	c.Tracing.Endpoint = ""
+	c.Auth.Mode = "api_key"
+	c.Auth.APIKey.BootstrapKey = demoAPIKey
+	c.Attachments.Enabled = true
+	c.Attachments.Backend = "local"
+	c.Attachments.Dir = filepath.Join(os.TempDir(), "pebble-demo-attachments")
+	c.Attachments.SigningKey = demoSigningKey
+	c.OpenAPI.Enabled = true
+	c.OpenAPI.Docs = true
+	c.Metrics.Enabled = true
+}
+
+// demoPebbles are the pebbles demo mode starts with.
+var demoPebbles = []pebbleInput{
+	{Name: "Flint", Color: "grey", WeightGrams: 30},
+	{Name: "Jasper", Color: "red", WeightGrams: 45},
+	{Name: "Obsidian", Color: "black", WeightGrams: 22},
+	{Name: "Moonstone", Color: "white", WeightGrams: 12},
+	{Name: "Agate", Color: "blue", WeightGrams: 38},
+	{Name: "Pumice", Color: "grey", WeightGrams: 5},
+}
+
+// demoHook seeds the demo pebbles through svc, so that they raise events
+// like any other, and tells the user how to call the API. The pebbles
+// belong to tenant, if it is not empty.
+func demoHook(svc *PebbleService, port int, tenant string, logger *slog.Logger) Hook {
+	return Hook{
+		Name: "demo data",
+		OnStart: func(ctx context.Context) error {
+			if tenant != "" {
+				ctx = contextWithTenant(ctx, tenant)
+			}
+			for _, in := range demoPebbles {
+				if _, err := svc.Create(ctx, in); err != nil {
+					return err
+				}
+			}
+			logger.Warn("running in demo mode: everything is kept in memory and lost on exit",
+				"pebbles", len(demoPebbles), "api_key", demoAPIKey, "docs", fmt.Sprintf("http://localhost:%d/docs", port))
+			return nil
+		},
+	}
+}
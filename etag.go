@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+)
+
+// computeETag returns a strong entity tag for the JSON representation of
+// v, so it changes whenever any field the client can see changes.
+func computeETag(v any) string {
+	buf := getResponseBuffer()
+	defer putResponseBuffer(buf)
+	buf.json.Encode(v)
+	return etagOf(buf.Bytes())
+}
+
+// etagOf returns the entity tag of the JSON representation b, as written
+// by a json.Encoder.
+func etagOf(b []byte) string {
+	// Without the newline that Encode ends with, as json.Marshal would.
+	sum := sha256.Sum256(bytes.TrimSuffix(b, []byte("\n")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagListMatches reports whether the If-Match or If-None-Match header
+// value list contains etag. Weak tags only match when weak is set, since
+// If-Match requires the strong comparison.
+func etagListMatches(list, etag string, weak bool) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether the client already has the representation
+// with the given etag according to If-None-Match.
+func notModified(r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	return inm != "" && etagListMatches(inm, etag, true)
+}
+
+// checkIfMatch implements optimistic concurrency for requests that change
+// a resource: the client must send the ETag of the representation it
+// based the change on in If-Match (or the etag field of a gRPC request),
+// and gets a 412 error if the resource has changed since.
+func checkIfMatch(ifMatch, etag string) error {
+	if ifMatch == "" {
+		return NewAPIError(http.StatusPreconditionRequired, CodePreconditionRequired,
+			"the current ETag must be sent in If-Match, or in the etag field of gRPC and /v1 requests")
+	}
+	if !etagListMatches(ifMatch, etag, false) {
+		return NewAPIError(http.StatusPreconditionFailed, CodePreconditionFailed,
+			"resource has changed since it was fetched")
+	}
+	return nil
+}
+
+// writeResource writes v with its ETag, or a 304 response for GET and
+// HEAD requests whose If-None-Match already matches it.
+func writeResource(w http.ResponseWriter, r *http.Request, status int, v any) {
+	// The JSON the tag is computed from is the body of JSON responses.
+	buf := getResponseBuffer()
+	defer putResponseBuffer(buf)
+	buf.json.Encode(v)
+	etag := etagOf(buf.Bytes())
+	w.Header().Set("ETag", etag)
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if c := responseCodec(r.Context()); c == jsonCodec {
+		writeBody(w, c, status, buf.Bytes())
+		return
+	}
+	respond(w, r, status, v)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Event types published when pebbles change.
+const (
+	EventPebbleCreated  = "pebble.created"
+	EventPebbleUpdated  = "pebble.updated"
+	EventPebbleDeleted  = "pebble.deleted"
+	EventPebbleRestored = "pebble.restored"
+)
+
+// Event is a change notification sent to subscribers. ID increases by one
+// for every event published by a Hub.
+type Event struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	PebbleID string    `json:"pebble_id"`
+	Pebble   *Pebble   `json:"pebble,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+}
+
+// Publisher sends events somewhere. Implementations must not block for
+// long, since events are published while serving requests.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Hub is the in-process Publisher. It fans events out to subscribers,
+// such as the WebSocket and SSE streams, and forwards them to external
+// publishers. Publishing never blocks: a subscriber whose buffer is full
+// is dropped and can reconnect. The most recent events are kept so that
+// reconnecting clients can catch up.
+type Hub struct {
+	mu       sync.Mutex
+	seq      uint64
+	subs     map[*Subscription]struct{}
+	history  []Event
+	keep     int
+	closed   bool
+	clock    Clock
+	external []Publisher
+}
+
+// NewHub returns a hub remembering the last keep events, stamping those
+// without a time with that of clock, and forwarding every event to
+// external.
+func NewHub(keep int, clock Clock, external ...Publisher) *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{}), keep: keep, clock: clock, external: external}
+}
+
+// Subscription receives events on C until it is closed, after which C is
+// closed too. Lagged reports whether that happened because the subscriber
+// fell behind.
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	hub    *Hub
+	lagged bool
+}
+
+// Subscribe returns a subscription buffering up to buffer events. If the
+// hub has been closed the subscription is closed already.
+func (h *Hub) Subscribe(buffer int) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.subscribe(buffer)
+}
+
+// subscribe must be called with h.mu held.
+func (h *Hub) subscribe(buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, hub: h}
+	if h.closed {
+		close(c)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// SubscribeAfter is like Subscribe but also returns the remembered events
+// with IDs greater than after, which the subscription will not receive
+// again. complete is false if some of those events have been forgotten.
+func (h *Hub) SubscribeAfter(after uint64, buffer int) (missed []Event, complete bool, s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	complete = after >= h.seq || (len(h.history) > 0 && h.history[0].ID <= after+1)
+	for _, e := range h.history {
+		if e.ID > after {
+			missed = append(missed, e)
+		}
+	}
+	return missed, complete, h.subscribe(buffer)
+}
+
+// LastID returns the ID of the last event published, or 0 if there has
+// been none.
+func (h *Hub) LastID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seq
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// Lagged reports whether the hub dropped the subscription because its
+// buffer was full. It is only meaningful once C has been closed.
+func (s *Subscription) Lagged() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.lagged
+}
+
+// remove must be called with h.mu held.
+func (h *Hub) remove(s *Subscription) {
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
+
+// errHubClosed is returned for events published once the hub is closed.
+var errHubClosed = errors.New("event hub is closed")
+
+// Publish stamps e with the next ID and, unless it has a time already,
+// the current time, delivers it to every subscriber and forwards it to the
+// external publishers.
+func (h *Hub) Publish(ctx context.Context, e Event) error {
+	e, ok := h.deliver(e)
+	if !ok {
+		return errHubClosed
+	}
+	var errs []error
+	for _, p := range h.external {
+		if err := p.Publish(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *Hub) deliver(e Event) (Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return e, false
+	}
+	h.seq++
+	e.ID = h.seq
+	if e.Time.IsZero() {
+		e.Time = h.clock.Now().UTC()
+	}
+	if h.keep > 0 {
+		if len(h.history) == h.keep {
+			h.history = append(h.history[:0], h.history[1:]...)
+		}
+		h.history = append(h.history, e)
+	}
+	for s := range h.subs {
+		select {
+		case s.c <- e:
+		default:
+			s.lagged = true
+			h.remove(s)
+		}
+	}
+	return e, true
+}
+
+// Close closes every subscription and stops accepting new ones, so
+// streaming connections end when the server shuts down.
+func (h *Hub) Close(context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.remove(s)
+	}
+	return nil
+}
+
+// publishingStore publishes an event after every successful change to
+// the pebbles in the wrapped store. The change has already been made, so
+// publishing errors are logged rather than returned.
+type publishingStore struct {
+	Store
+	pub    Publisher
+	logger *slog.Logger
+}
+
+// publish publishes e once the change it reports commits.
+func (s publishingStore) publish(ctx context.Context, e Event) {
+	afterCommit(ctx, func() {
+		if err := s.pub.Publish(ctx, e); err != nil {
+			s.logger.WarnContext(ctx, "cannot publish event", "type", e.Type, "pebble_id", e.PebbleID, "error", err)
+		}
+	})
+}
+
+func (s publishingStore) Create(ctx context.Context, p Pebble) error {
+	if err := s.Store.Create(ctx, p); err != nil {
+		return err
+	}
+	s.publish(ctx, Event{Type: EventPebbleCreated, PebbleID: p.ID, Pebble: &p, Tenant: p.Tenant})
+	return nil
+}
+
+func (s publishingStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	if err := s.Store.Update(ctx, p, prev); err != nil {
+		return err
+	}
+	s.publish(ctx, Event{Type: EventPebbleUpdated, PebbleID: p.ID, Pebble: &p, Tenant: p.Tenant})
+	return nil
+}
+
+func (s publishingStore) Delete(ctx context.Context, id string, at time.Time) error {
+	if err := s.Store.Delete(ctx, id, at); err != nil {
+		return err
+	}
+	s.publish(ctx, Event{Type: EventPebbleDeleted, PebbleID: id, Tenant: TenantFromContext(ctx)})
+	return nil
+}
+
+func (s publishingStore) Restore(ctx context.Context, id string) error {
+	if err := s.Store.Restore(ctx, id); err != nil {
+		return err
+	}
+	p, err := s.Store.Get(ctx, id)
+	if err != nil {
+		s.logger.WarnContext(ctx, "cannot read restored pebble", "pebble_id", id, "error", err)
+		return nil
+	}
+	s.publish(ctx, Event{Type: EventPebbleRestored, PebbleID: id, Pebble: &p, Tenant: p.Tenant})
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// exportPageSize is the number of pebbles GET /pebbles/export reads from
+// the store at a time, and writes between flushes.
+const exportPageSize = 500
+
+// exportWriteTimeout is how long GET /pebbles/export waits for a client to
+// take a page before it gives up on it.
+const exportWriteTimeout = 30 * time.Second
+
+// exportFormats are the media types of the formats of GET /pebbles/export.
+var exportFormats = map[string]string{
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv; charset=utf-8",
+}
+
+// exportColumns is the header row of CSV exports, named as the JSON
+// fields are.
+var exportColumns = []string{"id", "name", "color", "weight_grams", "created_at", "updated_at", "deleted_at", "tenant"}
+
+// exportRecord returns the CSV row of p.
+func exportRecord(p Pebble) []string {
+	deleted := ""
+	if p.DeletedAt != nil {
+		deleted = p.DeletedAt.Format(time.RFC3339Nano)
+	}
+	return []string{p.ID, p.Name, p.Color, strconv.Itoa(p.WeightGrams),
+		p.CreatedAt.Format(time.RFC3339Nano), p.UpdatedAt.Format(time.RFC3339Nano), deleted, p.Tenant}
+}
+
+// exportHeaders sets the headers of an export in format, whose media type
+// is mediaType.
+func exportHeaders(h http.Header, mediaType, format string) {
+	h.Set("Content-Type", mediaType)
+	h.Set("Content-Disposition", `attachment; filename="pebbles.`+format+`"`)
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("X-Accel-Buffering", "no")
+}
+
+// exportEncoder returns the functions writing the pebbles of an export in
+// format to w, and flushing what they wrote.
+func exportEncoder(w io.Writer, format string) (write func(p Pebble) error, flush func() error) {
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		return func(p Pebble) error { return cw.Write(exportRecord(p)) }, func() error { cw.Flush(); return cw.Error() }
+	}
+	enc := json.NewEncoder(w)
+	return func(p Pebble) error { return enc.Encode(p) }, func() error { return nil }
+}
+
+// writeExport writes the pebbles of q, from page on, to w in format, and
+// calls sent once each page has been written. It stops at the first error
+// of reading the pebbles, which it returns, or of writing or sent, which
+// it returns wrapped in errExportWrite.
+func (api *pebblesAPI) writeExport(ctx context.Context, w io.Writer, format string, q ListQuery, page PebblePage, sent func() error) error {
+	write, flush := exportEncoder(w, format)
+	for {
+		for _, p := range page.Items {
+			if err := write(p); err != nil {
+				return fmt.Errorf("%w: %w", errExportWrite, err)
+			}
+		}
+		if err := flush(); err != nil {
+			return fmt.Errorf("%w: %w", errExportWrite, err)
+		}
+		if err := sent(); err != nil {
+			return fmt.Errorf("%w: %w", errExportWrite, err)
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		last := page.Items[len(page.Items)-1]
+		q.After = &Cursor{Value: last.field(q.Sort.Field), ID: last.ID}
+		var err error
+		if page, err = api.svc.List(ctx, q); err != nil {
+			return err
+		}
+	}
+}
+
+// errExportWrite reports that an export could not be written out.
+var errExportWrite = errors.New("cannot write export")
+
+// export streams all the pebbles that GET /pebbles would list, a page at
+// a time, so that neither the server nor the client holds them all. Once
+// the first page is out an error can only cut the response short, which
+// the client sees as a broken stream rather than a complete export.
+//
+// The bytes of an export only change with the pebbles, so a HEAD request
+// makes the export without sending it to give its Content-Length and an
+// ETag hashing it, and a request with a Range header, best made with
+// If-Range set to that ETag, writes it to a temporary file and sends the
+// range asked for from there, or the whole export if it has changed.
+func (api *pebblesAPI) export(w http.ResponseWriter, r *http.Request) error {
+	values := r.URL.Query()
+	format := cmp.Or(values.Get("format"), "ndjson")
+	mediaType, ok := exportFormats[format]
+	if !ok {
+		return Invalid(ValidationErrors{{Field: "format", Message: "must be ndjson or csv"}}, "invalid export parameters")
+	}
+	include, err := includeDeleted(r)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"limit", "cursor"} {
+		if values.Has(name) {
+			return Invalid(ValidationErrors{{Field: name, Message: "is not a known parameter"}}, "invalid export parameters")
+		}
+	}
+	values.Del("format")
+	values.Del("include_deleted")
+	q, err := parseListValues(values, pebbleListParams)
+	if err != nil {
+		return err
+	}
+	q.IncludeDeleted = include
+	q.Limit = exportPageSize
+	page, err := api.svc.List(r.Context(), q)
+	if err != nil {
+		return err
+	}
+	if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+		return api.exportSnapshot(w, r, format, mediaType, q, page)
+	}
+
+	exportHeaders(w.Header(), mediaType, format)
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	// A client that stops reading holds up the export, and is dropped once
+	// it has not taken a page for exportWriteTimeout.
+	rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+	err = api.writeExport(r.Context(), w, format, q, page, func() error {
+		if err := rc.Flush(); err != nil {
+			return err
+		}
+		rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+		return nil
+	})
+	if err != nil && !errors.Is(err, errExportWrite) {
+		slog.ErrorContext(r.Context(), "export failed", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// exportSnapshot serves a HEAD request for an export, or a GET request for
+// a range of one, which it makes in full first, starting from its first
+// page, to know its size and ETag.
+func (api *pebblesAPI) exportSnapshot(w http.ResponseWriter, r *http.Request, format, mediaType string, q ListQuery, page PebblePage) error {
+	sum := sha256.New()
+	var out io.Writer = sum
+	var file *os.File
+	if r.Method != http.MethodHead {
+		var err error
+		if file, err = os.CreateTemp("", "pebbles-export-*"); err != nil {
+			return Internal(err)
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		out = io.MultiWriter(file, sum)
+	}
+	counted := &countingWriter{w: out}
+	bw := bufio.NewWriter(counted)
+	if err := api.writeExport(r.Context(), bw, format, q, page, func() error { return nil }); err != nil {
+		return Internal(err)
+	}
+	if err := bw.Flush(); err != nil {
+		return Internal(err)
+	}
+	size := counted.n
+	etag := `"` + hex.EncodeToString(sum.Sum(nil)[:16]) + `"`
+
+	h := w.Header()
+	exportHeaders(h, mediaType, format)
+	h.Set("ETag", etag)
+	rng, partial, err := requestRange(r, size, etag)
+	if err != nil {
+		h.Set("Content-Range", unsatisfiableRange(size))
+		return err
+	}
+	status := http.StatusOK
+	if !partial {
+		rng = byteRange{start: 0, length: size}
+	} else {
+		status = http.StatusPartialContent
+		h.Set("Content-Range", rng.contentRange(size))
+	}
+	h.Set("Content-Length", strconv.FormatInt(rng.length, 10))
+	w.WriteHeader(status)
+	if file != nil {
+		if _, err := io.Copy(w, io.NewSectionReader(file, rng.start, rng.length)); err != nil {
+			slog.WarnContext(r.Context(), "cannot send export", "error", err)
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
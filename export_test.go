@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExportRanges(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	svc := &PebbleService{store: newMemoryStore(), clock: clock}
+	// More than a page, so that ranges cross the pages of the store.
+	for i := range exportPageSize + 20 {
+		if _, err := svc.Create(context.Background(), pebbleInput{Name: fmt.Sprintf("Pebble %04d", i), Color: "grey", WeightGrams: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &pebblesAPI{svc: svc}
+	get := func(method string, header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, "/pebbles/export?format=csv&sort=name", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		if err := api.export(w, r); err != nil {
+			WriteError(w, r, err)
+		}
+		return w
+	}
+
+	full := get(http.MethodGet, nil)
+	if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("got status %d and Accept-Ranges %q, want 200 and bytes", full.Code, full.Header().Get("Accept-Ranges"))
+	}
+	body := full.Body.String()
+
+	head := get(http.MethodHead, nil)
+	etag := head.Header().Get("ETag")
+	if got := head.Header().Get("Content-Length"); got != strconv.Itoa(len(body)) || etag == "" || head.Body.Len() != 0 {
+		t.Fatalf("HEAD got Content-Length %s, ETag %q and %d bytes, want %d, an ETag and none", got, etag, head.Body.Len(), len(body))
+	}
+
+	start := len(body) / 2
+	part := get(http.MethodGet, map[string]string{"Range": fmt.Sprintf("bytes=%d-", start), "If-Range": etag})
+	if part.Code != http.StatusPartialContent {
+		t.Fatalf("got status %d for a range, want 206", part.Code)
+	}
+	if want := fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)); part.Header().Get("Content-Range") != want {
+		t.Errorf("got Content-Range %q, want %q", part.Header().Get("Content-Range"), want)
+	}
+	if body[:start]+part.Body.String() != body {
+		t.Error("the resumed export does not continue the interrupted one")
+	}
+
+	if _, err := svc.Create(context.Background(), pebbleInput{Name: "Pebble 0000a", Color: "red", WeightGrams: 1}); err != nil {
+		t.Fatal(err)
+	}
+	changed := get(http.MethodGet, map[string]string{"Range": fmt.Sprintf("bytes=%d-", start), "If-Range": etag})
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Errorf("got status %d and ETag %s once the pebbles changed, want the whole new export", changed.Code, changed.Header().Get("ETag"))
+	}
+
+	past := get(http.MethodGet, map[string]string{"Range": fmt.Sprintf("bytes=%d-", 10*len(body))})
+	if past.Code != http.StatusRequestedRangeNotSatisfiable || past.Header().Get("Content-Range") == "" {
+		t.Errorf("got status %d and Content-Range %q past the end, want 416 with the size", past.Code, past.Header().Get("Content-Range"))
+	}
+}
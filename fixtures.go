@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fixtureNamespace is the namespace of the UUIDs of fixture pebbles that
+// have no id, which are derived from their name so that loading a file
+// again finds the pebbles it created.
+const fixtureNamespace = "6f1c2b7e-4d3a-5e89-9b0f-2a7c51d08e43"
+
+// fixtureFile is the content of a fixture file, in YAML or JSON:
+//
+//	pebbles:
+//	  - name: Flint
+//	    color: grey
+//	    weight_grams: 30
+type fixtureFile struct {
+	Pebbles []fixturePebble `json:"pebbles"`
+}
+
+// fixturePebble is a pebble of a fixture file. ID is optional, and so is
+// Tenant, which is the tenant of the pebble when it is created.
+type fixturePebble struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	pebbleInput
+}
+
+// FixtureStats counts what loading fixtures did to the pebbles in them.
+type FixtureStats struct {
+	Created   int
+	Updated   int
+	Unchanged int
+}
+
+// fixtureFormat returns the format of the fixture file at path, told from
+// its extension.
+func fixtureFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".json":
+		return "json", nil
+	}
+	return "", fmt.Errorf("%s is not a .yaml, .yml or .json file", path)
+}
+
+// readFixtures reads and checks the fixture files at paths, returning
+// their pebbles with their ids filled in, and those without a tenant in
+// tenant. A pebble found in several files is taken from the last.
+func readFixtures(paths []string, tenant string) ([]Pebble, error) {
+	var pebbles []Pebble
+	index := make(map[string]int)
+	for _, path := range paths {
+		format, err := fixtureFormat(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var f fixtureFile
+		if format == "yaml" {
+			err = decodeYAML(data, &f)
+		} else {
+			err = jsonCodec.Decode(bytes.NewReader(data), &f)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for i, fp := range f.Pebbles {
+			if errs := Validate(fp.pebbleInput); errs != nil {
+				return nil, fmt.Errorf("%s: pebbles[%d]: %w", path, i, errs)
+			}
+			if fp.Tenant == "" {
+				fp.Tenant = tenant
+			} else if !validTenant(fp.Tenant) {
+				return nil, fmt.Errorf("%s: pebbles[%d].tenant: %s", path, i, tenantIDRule)
+			}
+			// Pebbles of the same name in different tenants are different
+			// pebbles.
+			key := fp.Name
+			if fp.Tenant != "" {
+				key = fp.Tenant + "/" + fp.Name
+			}
+			id := nameUUID(fixtureNamespace, key)
+			if fp.ID != "" {
+				if id, err = parseUUID(fp.ID); err != nil {
+					return nil, fmt.Errorf("%s: pebbles[%d].id: %w", path, i, err)
+				}
+			}
+			p := Pebble{ID: id, Tenant: fp.Tenant}
+			fp.apply(&p)
+			if j, ok := index[id]; ok {
+				pebbles[j] = p
+				continue
+			}
+			index[id] = len(pebbles)
+			pebbles = append(pebbles, p)
+		}
+	}
+	return pebbles, nil
+}
+
+// loadFixtures upserts the pebbles of the fixture files at paths into
+// store in one transaction, so that loading the same files again changes
+// nothing. Pebbles that were deleted are restored; pebbles of the store
+// that are not in the files are left alone. Those without a tenant are
+// created in tenant, and the times they are created and updated are those
+// of clock.
+func loadFixtures(ctx context.Context, store PebbleStore, paths []string, tenant string, clock Clock) (FixtureStats, error) {
+	pebbles, err := readFixtures(paths, tenant)
+	if err != nil {
+		return FixtureStats{}, err
+	}
+	var stats FixtureStats
+	err = transact(ctx, store, func(ctx context.Context) error {
+		stats = FixtureStats{}
+		for _, p := range pebbles {
+			now := clock.Now().UTC()
+			existing, err := store.Get(ctx, p.ID)
+			if errors.Is(err, ErrNotFound) {
+				p.CreatedAt, p.UpdatedAt = now, now
+				if err := store.Create(ctx, p); err != nil {
+					return fmt.Errorf("pebble %s: %w", p.ID, err)
+				}
+				stats.Created++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("pebble %s: %w", p.ID, err)
+			}
+			changed := existing.DeletedAt != nil
+			if existing.DeletedAt != nil {
+				if err := store.Restore(ctx, p.ID); err != nil {
+					return fmt.Errorf("pebble %s: %w", p.ID, err)
+				}
+			}
+			if existing.Name != p.Name || existing.Color != p.Color || existing.WeightGrams != p.WeightGrams {
+				prev := existing.UpdatedAt
+				existing.Name, existing.Color, existing.WeightGrams = p.Name, p.Color, p.WeightGrams
+				existing.DeletedAt = nil
+				existing.UpdatedAt = now
+				if err := store.Update(ctx, existing, prev); err != nil {
+					return fmt.Errorf("pebble %s: %w", p.ID, err)
+				}
+				changed = true
+			}
+			if changed {
+				stats.Updated++
+			} else {
+				stats.Unchanged++
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// fixturesHook loads the fixture files at paths into store at startup,
+// with tenant and clock as for loadFixtures.
+func fixturesHook(store PebbleStore, paths []string, tenant string, clock Clock, logger *slog.Logger) Hook {
+	return Hook{
+		Name: "fixtures",
+		OnStart: func(ctx context.Context) error {
+			stats, err := loadFixtures(ctx, store, paths, tenant, clock)
+			if err != nil {
+				return fmt.Errorf("cannot load fixtures: %w", err)
+			}
+			logger.Info("loaded fixtures", "files", len(paths), "created", stats.Created, "updated", stats.Updated, "unchanged", stats.Unchanged)
+			return nil
+		},
+	}
+}
+
+// runSeed implements the seed command, which loads the fixture files given
+// as arguments, or those of fixtures.files, into the database.
+func runSeed(ctx context.Context, cfg Config, logger *slog.Logger, args []string) error {
+	if cfg.Storage.Backend == "memory" {
+		return fmt.Errorf("seed requires a sqlite or postgres storage backend")
+	}
+	paths := args
+	if len(paths) == 0 {
+		paths = cfg.Fixtures.Files
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no fixture files given and fixtures.files is empty")
+	}
+	db, err := newSQLStore(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if cfg.Storage.AutoMigrate {
+		m, err := db.Migrator(logger)
+		if err != nil {
+			return err
+		}
+		err = m.Up(ctx)
+	} else {
+		err = db.Check(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return fixturesHook(db, paths, cfg.Tenancy.seedTenant(), systemClock{}, logger).OnStart(ctx)
+}
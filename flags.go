@@ -0,0 +1,432 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flag is the rule deciding whether a feature flag is on for a request.
+// It is on for the subjects and tenants listed, then for Percentage
+// percent of the other callers with a subject or tenant, picked by a hash
+// of it so that every caller keeps its answer as the percentage grows,
+// and otherwise if Enabled is set.
+type Flag struct {
+	Enabled    bool     `json:"enabled"`
+	Subjects   []string `json:"subjects,omitempty"`
+	Tenants    []string `json:"tenants,omitempty"`
+	Percentage int      `json:"percentage,omitempty" validate:"min=0,max=100"`
+}
+
+// on reports whether flag name is on for subject and tenant, either of
+// which may be empty.
+func (f Flag) on(name, subject, tenant string) bool {
+	if subject != "" && slices.Contains(f.Subjects, subject) || tenant != "" && slices.Contains(f.Tenants, tenant) {
+		return true
+	}
+	if key := cmp.Or(subject, tenant); key != "" && f.Percentage > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(name + "/" + key))
+		if int(h.Sum32()%100) < f.Percentage {
+			return true
+		}
+	}
+	return f.Enabled
+}
+
+// validateFlags checks the flags of the feature_flags.flags setting or of
+// a provider.
+func validateFlags(flags map[string]Flag) error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(flags)) {
+		if name == "" {
+			errs = append(errs, errors.New("flag names must not be empty"))
+		}
+		if p := flags[name].Percentage; p < 0 || p > 100 {
+			errs = append(errs, fmt.Errorf("flag %q: percentage must be from 0 to 100", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FlagProvider supplies feature flags by name. Flags is called for every
+// request, so it must answer from memory, and callers must not change the
+// map it returns.
+type FlagProvider interface {
+	Flags() map[string]Flag
+}
+
+// staticFlags are the flags of the configuration.
+type staticFlags struct {
+	flags atomic.Pointer[map[string]Flag]
+}
+
+func newStaticFlags(flags map[string]Flag) *staticFlags {
+	s := &staticFlags{}
+	s.set(flags)
+	return s
+}
+
+func (s *staticFlags) Flags() map[string]Flag { return *s.flags.Load() }
+
+func (s *staticFlags) set(flags map[string]Flag) { s.flags.Store(&flags) }
+
+// overrideFlags are the flags set at runtime through the admin API, kept
+// in memory until the server stops.
+type overrideFlags struct {
+	mu    sync.RWMutex
+	flags map[string]Flag
+}
+
+func (o *overrideFlags) Flags() map[string]Flag {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.flags
+}
+
+func (o *overrideFlags) set(name string, f Flag) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// Copied, since callers may hold the map Flags returned.
+	flags := maps.Clone(o.flags)
+	if flags == nil {
+		flags = map[string]Flag{}
+	}
+	flags[name] = f
+	o.flags = flags
+}
+
+func (o *overrideFlags) clear(name string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.flags[name]; !ok {
+		return false
+	}
+	flags := maps.Clone(o.flags)
+	delete(flags, name)
+	o.flags = flags
+	return true
+}
+
+// fileFlags are the flags in a JSON file, read again whenever its
+// modification time changes. A file that cannot be read or parsed is
+// logged and the flags read last are kept.
+type fileFlags struct {
+	path     string
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu      sync.RWMutex
+	flags   map[string]Flag
+	modTime time.Time
+}
+
+// newFileFlags reads the flags at path, failing if it cannot.
+func newFileFlags(path string, interval time.Duration, logger *slog.Logger) (*fileFlags, error) {
+	f := &fileFlags{path: path, interval: interval, logger: logger}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileFlags) Flags() map[string]Flag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.flags
+}
+
+// load reads the file if it has changed since it was last read.
+func (f *fileFlags) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("cannot read flags file: %w", err)
+	}
+	f.mu.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("cannot read flags file: %w", err)
+	}
+	flags, err := decodeFlags(data)
+	if err != nil {
+		return fmt.Errorf("cannot parse flags file %s: %w", f.path, err)
+	}
+	f.mu.Lock()
+	f.flags, f.modTime = flags, info.ModTime()
+	f.mu.Unlock()
+	f.logger.Info("loaded feature flags", "path", f.path, "flags", len(flags))
+	return nil
+}
+
+// run checks the file for changes every interval until ctx is done.
+func (f *fileFlags) run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.load(); err != nil {
+				f.logger.Warn("cannot reload feature flags, keeping the current ones", "error", err)
+			}
+		}
+	}
+}
+
+// maxFlagsBytes bounds the flags fetched from a remote provider.
+const maxFlagsBytes = 1 << 20
+
+// remoteFlags are the flags served as JSON at a URL, fetched in the
+// background. Until the first fetch succeeds there are none, and a fetch
+// that fails is logged and the flags fetched last are kept.
+type remoteFlags struct {
+	url      string
+	client   *http.Client
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu    sync.RWMutex
+	flags map[string]Flag
+}
+
+func newRemoteFlags(url string, interval time.Duration, logger *slog.Logger) *remoteFlags {
+	return &remoteFlags{
+		url:      url,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+func (r *remoteFlags) Flags() map[string]Flag {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.flags
+}
+
+func (r *remoteFlags) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot fetch feature flags: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot fetch feature flags: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFlagsBytes))
+	if err != nil {
+		return fmt.Errorf("cannot fetch feature flags: %w", err)
+	}
+	flags, err := decodeFlags(data)
+	if err != nil {
+		return fmt.Errorf("cannot decode feature flags: %w", err)
+	}
+	r.mu.Lock()
+	r.flags = flags
+	r.mu.Unlock()
+	r.logger.Debug("refreshed feature flags", "flags", len(flags))
+	return nil
+}
+
+// Check reports whether the flags have been fetched, for use as a
+// readiness check.
+func (r *remoteFlags) Check(ctx context.Context) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.flags == nil {
+		return errors.New("feature flags not fetched yet")
+	}
+	return nil
+}
+
+// run fetches the flags every interval until ctx is done.
+func (r *remoteFlags) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.refresh(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Warn("cannot refresh feature flags", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// decodeFlags parses a JSON object of flags by name.
+func decodeFlags(data []byte) (map[string]Flag, error) {
+	flags := map[string]Flag{}
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return nil, err
+	}
+	if err := validateFlags(flags); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// FeatureFlags resolves the flags of requests from a list of providers,
+// in which a flag is taken from the last provider that has it, and from
+// the overrides set with Override before any of them.
+type FeatureFlags struct {
+	providers []FlagProvider
+	overrides overrideFlags
+}
+
+// NewFeatureFlags returns the flags of providers, later ones overriding
+// earlier ones.
+func NewFeatureFlags(providers ...FlagProvider) *FeatureFlags {
+	f := &FeatureFlags{}
+	f.providers = append(slices.Clone(providers), &f.overrides)
+	return f
+}
+
+// Flags returns the flags in effect, overrides included.
+func (f *FeatureFlags) Flags() map[string]Flag {
+	flags := map[string]Flag{}
+	for _, p := range f.providers {
+		maps.Copy(flags, p.Flags())
+	}
+	return flags
+}
+
+// Overrides returns the flags set with Override.
+func (f *FeatureFlags) Overrides() map[string]Flag {
+	flags := map[string]Flag{}
+	maps.Copy(flags, f.overrides.Flags())
+	return flags
+}
+
+// Override sets flag name to flag until the server stops or the override
+// is cleared, whatever the providers say.
+func (f *FeatureFlags) Override(name string, flag Flag) {
+	f.overrides.set(name, flag)
+}
+
+// ClearOverride goes back to the providers' flag name, reporting whether
+// it was overridden.
+func (f *FeatureFlags) ClearOverride(name string) bool {
+	return f.overrides.clear(name)
+}
+
+// setupFlags builds the flags of cfg: those of the configuration, which
+// reloads update, overridden by those of the file or remote provider.
+func setupFlags(cfg FlagsConfig, reloader *Reloader, lc *Lifecycle, health *Health, logger *slog.Logger) (*FeatureFlags, error) {
+	static := newStaticFlags(cfg.Flags)
+	reloader.OnChange(func(cfg Config) { static.set(cfg.Flags.Flags) }, "feature_flags.flags")
+	switch cfg.Provider {
+	case "file":
+		f, err := newFileFlags(cfg.File, cfg.RefreshInterval.Duration, logger)
+		if err != nil {
+			return nil, err
+		}
+		lc.Append(BackgroundHook("feature flags", f.run))
+		return NewFeatureFlags(static, f), nil
+	case "remote":
+		r := newRemoteFlags(cfg.URL, cfg.RefreshInterval.Duration, logger)
+		health.Register("feature_flags", r)
+		lc.Append(BackgroundHook("feature flags", r.run))
+		return NewFeatureFlags(static, r), nil
+	}
+	return NewFeatureFlags(static), nil
+}
+
+type flagsKey struct{}
+
+// requestFlags are the flags of one request, fixed when it starts so that
+// it sees the same answers throughout.
+type requestFlags struct {
+	flags   map[string]Flag
+	subject string
+	tenant  string
+}
+
+func (f *requestFlags) enabled(name string) bool {
+	flag, ok := f.flags[name]
+	return ok && flag.on(name, f.subject, f.tenant)
+}
+
+// Middleware resolves the flags for each request from its caller's
+// subject and tenant. It must run after Authenticate and the tenant
+// middleware.
+func (f *FeatureFlags) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rf := &requestFlags{flags: f.Flags(), tenant: TenantFromContext(r.Context())}
+			if c := ClaimsFromContext(r.Context()); c != nil {
+				rf.subject = c.Subject
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), flagsKey{}, rf)))
+		})
+	}
+}
+
+// FlagEnabled reports whether flag name is on for the request of ctx.
+// Unknown flags, and every flag outside the flags middleware, are off.
+// Since flags can be on for some callers only, the response is marked as
+// depending on the caller for the HTTP cache.
+func FlagEnabled(ctx context.Context, name string) bool {
+	VaryByCaller(ctx)
+	rf, _ := ctx.Value(flagsKey{}).(*requestFlags)
+	return rf != nil && rf.enabled(name)
+}
+
+// WithFlag serves requests with on while flag name is on for them and with
+// off otherwise, or with a 404 response if off is nil, so that a new
+// endpoint or behaviour can be rolled out to some callers before others.
+func WithFlag(name string, on, off APIHandlerFunc) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if FlagEnabled(r.Context(), name) {
+			return on(w, r)
+		}
+		if off == nil {
+			return NotFound("not found")
+		}
+		return off(w, r)
+	}
+}
+
+// flagsResponse is the body of GET /flags.
+type flagsResponse struct {
+	Flags map[string]bool `json:"flags"`
+}
+
+// register adds GET /flags, which tells callers, such as a frontend
+// deciding what to show, which flags are on for them.
+func (f *FeatureFlags) register(rt *Router) {
+	rt.Get("/flags", func(w http.ResponseWriter, r *http.Request) error {
+		resp := flagsResponse{Flags: map[string]bool{}}
+		if rf, _ := r.Context().Value(flagsKey{}).(*requestFlags); rf != nil {
+			for name := range rf.flags {
+				resp.Flags[name] = rf.enabled(name)
+			}
+		}
+		respond(w, r, http.StatusOK, resp)
+		return nil
+	})
+	rt.Document("GET", "/flags", Operation{Summary: "List the feature flags and whether they are on for the caller", Tag: "flags", Response: flagsResponse{}})
+}
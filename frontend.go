@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// webFiles is the frontend bundle built into the binary. Replace the
+// contents of web/ with the output of the frontend build to ship it.
+//
+//go:embed web
+var webFiles embed.FS
+
+// apiPrefix is where the API is served when the frontend is served at /.
+const apiPrefix = "/api"
+
+// opsPaths are served by the API at the root even with the frontend
+// mounted there, so that probes and scrapers need no changes.
+var opsPaths = []string{"/healthz", "/readyz", "/metrics"}
+
+type basePathKey struct{}
+
+// BasePath returns the prefix the API is mounted under for the request
+// with context ctx, or "" if it is served at the root. Absolute links to
+// API resources must start with it.
+func BasePath(ctx context.Context) string {
+	p, _ := ctx.Value(basePathKey{}).(string)
+	return p
+}
+
+// withFrontend serves api under /api, with the prefix removed so that the
+// routes and their permissions are unchanged, and frontend everywhere
+// else. The versioned routes, which are under /api already, and the paths
+// in rootPaths are passed to api as they are.
+func withFrontend(api, frontend http.Handler, rootPaths []string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(apiPrefix+"/", http.StripPrefix(apiPrefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), basePathKey{}, apiPrefix)))
+	})))
+	for _, v := range apiVersionNames {
+		mux.Handle(apiPrefix+"/"+v+"/", api)
+	}
+	for _, p := range rootPaths {
+		mux.Handle(p, api)
+	}
+	mux.Handle("/", frontend)
+	return mux
+}
+
+var registerFrontendTypes = sync.OnceFunc(func() {
+	// Types the frontend builds produce that are missing from some
+	// systems' MIME tables.
+	for ext, typ := range map[string]string{
+		".js":          "text/javascript; charset=utf-8",
+		".mjs":         "text/javascript; charset=utf-8",
+		".map":         "application/json",
+		".webmanifest": "application/manifest+json",
+		".wasm":        "application/wasm",
+		".woff":        "font/woff",
+		".woff2":       "font/woff2",
+		".ico":         "image/x-icon",
+	} {
+		mime.AddExtensionType(ext, typ)
+	}
+})
+
+// FrontendHandler serves a single-page application from fsys. Files whose
+// names carry a content hash, such as assets/index-4f3a2b1c.js, may be
+// cached by clients forever, while everything else, index.html in
+// particular, is revalidated on every use. Paths that name no file and
+// have no extension are client-side routes and get index.html.
+func FrontendHandler(fsys fs.FS) http.Handler {
+	registerFrontendTypes()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" {
+			name = "index.html"
+		}
+		if info, err := fs.Stat(fsys, name); err != nil || info.IsDir() {
+			if path.Ext(name) != "" {
+				http.NotFound(w, r)
+				return
+			}
+			name = "index.html"
+		}
+		if fingerprinted(path.Base(name)) {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		http.ServeFileFS(w, r, fsys, name)
+	})
+}
+
+// fingerprinted reports whether a file name carries a content hash, as
+// the part before the extension following the last dot or dash: hex of at
+// least 8 digits, as webpack writes, or 8 URL-safe base64 characters
+// including a digit, as Vite and Rollup write.
+func fingerprinted(name string) bool {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	i := strings.LastIndexAny(stem, ".-")
+	if i < 0 {
+		return false
+	}
+	hash := stem[i+1:]
+	hex, digit, base64 := len(hash) >= 8, false, len(hash) == 8
+	for _, c := range hash {
+		switch {
+		case c >= '0' && c <= '9':
+			digit = true
+		case c >= 'a' && c <= 'f':
+		case c >= 'A' && c <= 'Z', c >= 'g' && c <= 'z', c == '_':
+			hex = false
+		default:
+			hex, base64 = false, false
+		}
+	}
+	return hex && digit || base64 && digit
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//go:embed proto/pebbles/v1/pebbles.proto
+var pebblesProto string
+
+// Gateway serves the google.api.http rules of the services in a .proto
+// file as JSON endpoints. Each request is transcoded to the RPC's request
+// message and handed to the method registered on a GRPCServer, so the
+// REST surface follows the proto definitions without code of its own.
+//
+// JSON uses the proto3 mapping: field names in lowerCamelCase (the proto
+// names are accepted too), 64-bit integers as strings and fields with
+// their zero value left out.
+type Gateway struct {
+	file *protoFile
+	grpc *GRPCServer
+}
+
+// NewGateway parses the .proto source src. The RPCs it defines must be
+// registered on grpc before the gateway is registered on a router.
+func NewGateway(src string, grpc *GRPCServer) (*Gateway, error) {
+	f, err := parseProtoFile(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Gateway{file: f, grpc: grpc}, nil
+}
+
+// register adds a route to rt for every RPC with an HTTP rule. Each route
+// is given the permission of its gRPC method in perms, so Authorize treats
+// both the same.
+func (g *Gateway) register(rt *Router, perms map[string]Permission) error {
+	for _, svc := range g.file.Services {
+		for _, rpc := range svc.RPCs {
+			if rpc.HTTP == nil {
+				continue
+			}
+			name := "/" + g.file.Package + "." + svc.Name + "/" + rpc.Name
+			m, ok := g.grpc.methods[name]
+			if !ok {
+				return fmt.Errorf("gateway: %s is not implemented", name)
+			}
+			in := g.file.Messages[rpc.Input]
+			vars, err := templateVars(rpc.HTTP.Path, in)
+			if err != nil {
+				return fmt.Errorf("gateway: %s: %w", name, err)
+			}
+			rule := rpc.HTTP
+			rt.Handle(rule.Method, rule.Path, g.handler(m, rule, in, g.file.Messages[rpc.Output], vars))
+			rt.Document(rule.Method, rule.Path, Operation{Summary: "Transcoded to " + name, Tag: "gateway"})
+			if p, ok := perms[http.MethodPost+" "+name]; ok {
+				perms[rule.Method+" "+rule.Path] = p
+			}
+		}
+	}
+	return nil
+}
+
+// pathPrefixes returns the distinct first segments of the paths of the
+// HTTP rules, such as /v1/.
+func (g *Gateway) pathPrefixes() []string {
+	var prefixes []string
+	for _, svc := range g.file.Services {
+		for _, rpc := range svc.RPCs {
+			if rpc.HTTP == nil {
+				continue
+			}
+			seg, _, _ := strings.Cut(strings.TrimPrefix(rpc.HTTP.Path, "/"), "/")
+			if p := "/" + seg + "/"; !slices.Contains(prefixes, p) {
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	return prefixes
+}
+
+// templateVars returns the fields of in named by the {field} segments of
+// a path template.
+func templateVars(path string, in *protoMessage) ([]*protoFieldDesc, error) {
+	var vars []*protoFieldDesc
+	for _, seg := range strings.Split(path, "/") {
+		if !strings.HasPrefix(seg, "{") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(seg, "{"), "}")
+		fd := in.field(name)
+		if fd == nil || fd.Repeated || !protoScalars[fd.Type] || strings.ContainsAny(name, ".=*") {
+			return nil, fmt.Errorf("path variable %s is not a scalar field of %s", seg, in.Name)
+		}
+		vars = append(vars, fd)
+	}
+	return vars, nil
+}
+
+func (g *Gateway) handler(m grpcMethod, rule *httpRule, in, out *protoMessage, vars []*protoFieldDesc) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		values := make(map[*protoFieldDesc][]json.RawMessage)
+		if rule.Body == "*" {
+			var body map[string]json.RawMessage
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				return bodyError(err)
+			}
+			for name, v := range body {
+				fd := in.field(name)
+				if fd == nil {
+					return Invalid(nil, "invalid request body: unknown field %q", name)
+				}
+				values[fd] = []json.RawMessage{v}
+			}
+		}
+		for name, vs := range r.URL.Query() {
+			fd := in.field(name)
+			if rule.Body == "*" || fd == nil || !protoScalars[fd.Type] {
+				return Invalid([]FieldError{{Field: name, Message: "is not a known parameter"}}, "invalid query parameters")
+			}
+			for _, v := range vs {
+				values[fd] = append(values[fd], quoteJSON(v))
+			}
+		}
+		for _, fd := range vars {
+			values[fd] = []json.RawMessage{quoteJSON(r.PathValue(fd.Name))}
+		}
+
+		req, err := g.encode(in, values)
+		if err != nil {
+			return Invalid(nil, "invalid request: %v", err)
+		}
+		resp, err := m(r.Context(), req)
+		if err != nil {
+			return err
+		}
+		body, err := g.decode(out, resp)
+		if err != nil {
+			return Internal(err)
+		}
+		writeJSON(w, http.StatusOK, json.RawMessage(body))
+		return nil
+	}
+}
+
+func quoteJSON(s string) json.RawMessage {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// encode builds message m from JSON values, given per field.
+func (g *Gateway) encode(m *protoMessage, values map[*protoFieldDesc][]json.RawMessage) ([]byte, error) {
+	var e protoEncoder
+	for _, fd := range m.Fields {
+		vs := values[fd]
+		if len(vs) == 1 && fd.Repeated && bytes.HasPrefix(bytes.TrimSpace(vs[0]), []byte("[")) {
+			var items []json.RawMessage
+			if err := json.Unmarshal(vs[0], &items); err != nil {
+				return nil, fmt.Errorf("%s: %v", fd.JSONName(), err)
+			}
+			vs = items
+		}
+		if len(vs) > 1 && !fd.Repeated {
+			return nil, fmt.Errorf("%s: must not be repeated", fd.JSONName())
+		}
+		for _, v := range vs {
+			if string(v) == "null" {
+				continue
+			}
+			if err := g.encodeValue(&e, fd, v); err != nil {
+				return nil, fmt.Errorf("%s: %v", fd.JSONName(), err)
+			}
+		}
+	}
+	return e.b, nil
+}
+
+func (g *Gateway) encodeValue(e *protoEncoder, fd *protoFieldDesc, v json.RawMessage) error {
+	// Fields that are declared optional or repeated keep their zero
+	// values, since they are distinguishable from unset ones.
+	keep := fd.Optional || fd.Repeated
+	switch fd.Type {
+	case "string":
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return fmt.Errorf("must be a string")
+		}
+		if keep || s != "" {
+			e.optString(fd.Number, s)
+		}
+	case "bool":
+		b, err := strconv.ParseBool(strings.Trim(string(v), `"`))
+		if err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+		if keep || b {
+			n := uint64(0)
+			if b {
+				n = 1
+			}
+			e.optVarint(fd.Number, n)
+		}
+	case "int32", "int64", "uint32", "uint64":
+		// Numbers may be quoted, as the JSON mapping allows and path and
+		// query values are.
+		s := strings.Trim(string(v), `"`)
+		bits := 64
+		if strings.HasSuffix(fd.Type, "32") {
+			bits = 32
+		}
+		var n uint64
+		if strings.HasPrefix(fd.Type, "u") {
+			u, err := strconv.ParseUint(s, 10, bits)
+			if err != nil {
+				return fmt.Errorf("must be a %d-bit unsigned integer", bits)
+			}
+			n = u
+		} else {
+			i, err := strconv.ParseInt(s, 10, bits)
+			if err != nil {
+				return fmt.Errorf("must be a %d-bit integer", bits)
+			}
+			n = uint64(i)
+		}
+		if keep || n != 0 {
+			e.optVarint(fd.Number, n)
+		}
+	default:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(v, &obj); err != nil {
+			return fmt.Errorf("must be an object")
+		}
+		sub := g.file.Messages[fd.Type]
+		values := make(map[*protoFieldDesc][]json.RawMessage)
+		for name, v := range obj {
+			f := sub.field(name)
+			if f == nil {
+				return fmt.Errorf("unknown field %q", name)
+			}
+			values[f] = []json.RawMessage{v}
+		}
+		b, err := g.encode(sub, values)
+		if err != nil {
+			return err
+		}
+		e.message(fd.Number, b)
+	}
+	return nil
+}
+
+// decode converts the encoded message b of type m to JSON, with the
+// fields in the order they are declared.
+func (g *Gateway) decode(m *protoMessage, b []byte) ([]byte, error) {
+	byNum := make(map[int]*protoFieldDesc)
+	for _, fd := range m.Fields {
+		byNum[fd.Number] = fd
+	}
+	values := make(map[*protoFieldDesc][]any)
+	err := decodeProto(b, func(f protoField) error {
+		fd := byNum[f.Num]
+		if fd == nil {
+			return nil
+		}
+		v, err := g.decodeValue(fd, f)
+		if err != nil {
+			return err
+		}
+		values[fd] = append(values[fd], v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.WriteByte('{')
+	for _, fd := range m.Fields {
+		vs, ok := values[fd]
+		if !ok {
+			continue
+		}
+		if out.Len() > 1 {
+			out.WriteByte(',')
+		}
+		var v any = vs[len(vs)-1]
+		if fd.Repeated {
+			v = vs
+		}
+		name, _ := json.Marshal(fd.JSONName())
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(name)
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+func (g *Gateway) decodeValue(fd *protoFieldDesc, f protoField) (any, error) {
+	if protoScalars[fd.Type] && fd.Type != "string" && f.Type != wireVarint {
+		return nil, f.wrongType()
+	}
+	switch fd.Type {
+	case "string":
+		return f.string()
+	case "bool":
+		return f.Varint != 0, nil
+	case "int32":
+		return int32(f.Varint), nil
+	case "uint32":
+		return uint32(f.Varint), nil
+	case "int64":
+		return strconv.FormatInt(int64(f.Varint), 10), nil
+	case "uint64":
+		return strconv.FormatUint(f.Varint, 10), nil
+	}
+	if f.Type != wireBytes {
+		return nil, f.wrongType()
+	}
+	b, err := g.decode(g.file.Messages[fd.Type], f.Bytes)
+	return json.RawMessage(b), err
+}
@@ -0,0 +1,1010 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// gqlResolver returns the value of a field of source, the value its
+// parent field resolved to, given its arguments. It may return a gqlThunk
+// to put the work off until the field has been resolved on every object of
+// its level, so that a Loader can do it for all of them at once.
+type gqlResolver func(ctx context.Context, source any, args map[string]any) (any, error)
+
+// gqlThunk computes a field value put off by its resolver.
+type gqlThunk func() (any, error)
+
+// gqlScalar converts the values of a scalar type: serialize turns what
+// resolvers return into a JSON value, and parse turns an input value,
+// decoded from JSON or a literal that would decode the same way, with
+// numbers as json.Number or float64, into what resolvers take.
+type gqlScalar struct {
+	serialize func(v any) (any, error)
+	parse     func(v any) (any, error)
+}
+
+// gqlType is a type of a schema: a scalar, an object type, an input
+// object type or an enum.
+type gqlType struct {
+	kind   string
+	name   string
+	fields []*gqlField
+	values []string
+	scalar *gqlScalar
+}
+
+type gqlField struct {
+	*gqlFieldDefinition
+	resolve gqlResolver
+}
+
+func (t *gqlType) field(name string) *gqlField {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// gqlSchema is a GraphQL schema defined by its SDL, whose Query and
+// Mutation types are the roots of operations, with a resolver for every
+// field of its object types. Permissions maps fields, as Type.field, to
+// the permission they need.
+type gqlSchema struct {
+	sdl         string
+	types       map[string]*gqlType
+	permissions map[string]Permission
+}
+
+var gqlBuiltinScalars = map[string]gqlScalar{
+	"Int": {serialize: serializeGQLInt, parse: func(v any) (any, error) {
+		f, err := gqlNumber(v)
+		if err != nil || f != math.Trunc(f) || f < math.MinInt32 || f > math.MaxInt32 {
+			return nil, errors.New("must be a 32-bit integer")
+		}
+		return int(f), nil
+	}},
+	"Float": {serialize: func(v any) (any, error) {
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+		return serializeGQLInt(v)
+	}, parse: func(v any) (any, error) {
+		f, err := gqlNumber(v)
+		if err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return f, nil
+	}},
+	"String": {serialize: serializeGQLString, parse: func(v any) (any, error) {
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return nil, errors.New("must be a string")
+	}},
+	"Boolean": {serialize: func(v any) (any, error) {
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("%T is not a Boolean", v)
+	}, parse: func(v any) (any, error) {
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		return nil, errors.New("must be true or false")
+	}},
+	"ID": {serialize: serializeGQLString, parse: func(v any) (any, error) {
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				return v.String(), nil
+			}
+		case float64:
+			if v == math.Trunc(v) {
+				return strconv.FormatFloat(v, 'f', -1, 64), nil
+			}
+		}
+		return nil, errors.New("must be a string or an integer")
+	}},
+}
+
+func serializeGQLInt(v any) (any, error) {
+	var n int64
+	switch v := v.(type) {
+	case int:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	default:
+		return nil, fmt.Errorf("%T is not an Int", v)
+	}
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return nil, fmt.Errorf("%d does not fit in an Int", n)
+	}
+	return n, nil
+}
+
+func serializeGQLString(v any) (any, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("%T is not a String", v)
+}
+
+func gqlNumber(v any) (float64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	}
+	return 0, errors.New("not a number")
+}
+
+// newGQLSchema builds the schema defined by sdl, with its custom scalars
+// converted by scalars. Every field of its object types still needs a
+// resolver, set with Resolve.
+func newGQLSchema(sdl string, scalars map[string]gqlScalar, permissions map[string]Permission) (*gqlSchema, error) {
+	doc, err := parseGQL(sdl, true)
+	if err != nil {
+		var se *gqlSyntaxError
+		if errors.As(err, &se) {
+			loc := gqlLocate(sdl, se.pos)
+			return nil, fmt.Errorf("schema: %d:%d: %s", loc.Line, loc.Column, se.msg)
+		}
+		return nil, err
+	}
+	s := &gqlSchema{sdl: sdl, types: make(map[string]*gqlType), permissions: permissions}
+	for name, sc := range gqlBuiltinScalars {
+		s.types[name] = &gqlType{kind: "scalar", name: name, scalar: &sc}
+	}
+	for _, d := range doc.types {
+		t := s.types[d.name]
+		switch {
+		case d.extend && (t == nil || t.kind != "type"):
+			return nil, fmt.Errorf("schema: cannot extend %s, which is not a type", d.name)
+		case !d.extend && t != nil:
+			return nil, fmt.Errorf("schema: %s is defined twice", d.name)
+		case !d.extend:
+			t = &gqlType{kind: d.kind, name: d.name, values: d.values}
+			if d.kind == "scalar" {
+				sc, ok := scalars[d.name]
+				if !ok {
+					return nil, fmt.Errorf("schema: scalar %s has no conversions", d.name)
+				}
+				t.scalar = &sc
+			}
+			s.types[d.name] = t
+		}
+		for _, fd := range d.fields {
+			if t.field(fd.name) != nil {
+				return nil, fmt.Errorf("schema: %s.%s is defined twice", d.name, fd.name)
+			}
+			t.fields = append(t.fields, &gqlField{gqlFieldDefinition: fd})
+		}
+	}
+	if q := s.types["Query"]; q == nil || q.kind != "type" {
+		return nil, errors.New("schema: there is no Query type")
+	}
+	for _, t := range s.types {
+		for _, f := range t.fields {
+			if err := s.checkType(f.typ, t.kind == "type"); err != nil {
+				return nil, fmt.Errorf("schema: %s.%s: %w", t.name, f.name, err)
+			}
+			for _, a := range f.args {
+				if err := s.checkType(a.typ, false); err != nil {
+					return nil, fmt.Errorf("schema: %s.%s(%s): %w", t.name, f.name, a.name, err)
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// checkType checks that the type of a field exists and is an output type,
+// if output is set, or an input type.
+func (s *gqlSchema) checkType(ref *gqlTypeRef, output bool) error {
+	for ref.elem != nil {
+		ref = ref.elem
+	}
+	t := s.types[ref.name]
+	switch {
+	case t == nil:
+		return fmt.Errorf("unknown type %s", ref.name)
+	case output && t.kind == "input":
+		return fmt.Errorf("input type %s cannot be returned", t.name)
+	case !output && t.kind == "type":
+		return fmt.Errorf("object type %s cannot be an input", t.name)
+	}
+	return nil
+}
+
+// Resolve sets the resolver of field of the object type typeName. It
+// panics if there is no such field, as a mistake in the program.
+func (s *gqlSchema) Resolve(typeName, field string, fn gqlResolver) {
+	t := s.types[typeName]
+	if t == nil || t.kind != "type" || t.field(field) == nil {
+		panic("graphql: no field " + typeName + "." + field + " to resolve")
+	}
+	t.field(field).resolve = fn
+}
+
+// check reports the fields that have no resolver.
+func (s *gqlSchema) check() error {
+	var missing []string
+	for _, t := range s.types {
+		for _, f := range t.fields {
+			if t.kind == "type" && f.resolve == nil {
+				missing = append(missing, t.name+"."+f.name)
+			}
+		}
+	}
+	if missing != nil {
+		slices.Sort(missing)
+		return fmt.Errorf("graphql: no resolver for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// gqlRequest is a GraphQL request, as the body of a POST request or the
+// parameters of a GET one. Extensions are accepted for clients that send
+// them and ignored.
+type gqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	Extensions    map[string]any `json:"extensions,omitempty"`
+}
+
+// gqlResponse is the result of a request. Data is left out if the request
+// failed before it could be executed.
+type gqlResponse struct {
+	Data   any         `json:"data,omitempty"`
+	Errors []*gqlError `json:"errors,omitempty"`
+}
+
+type gqlError struct {
+	Message    string         `json:"message"`
+	Locations  []gqlLocation  `json:"locations,omitempty"`
+	Path       []any          `json:"path,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// gqlLimits bound the operations a schema executes. An operation may nest
+// fields at most MaxDepth deep and cost at most MaxComplexity, where every
+// field costs 1 and the fields under one with a first argument cost as
+// many times over.
+type gqlLimits struct {
+	MaxDepth      int
+	MaxComplexity int
+	// ReadOnly rejects mutations, for GET requests.
+	ReadOnly bool
+}
+
+// execute runs the operation of req and returns the response with the
+// HTTP status it calls for: 200 once the operation has been executed, even
+// if some fields failed, 400 if the request is invalid and 405 for a
+// mutation when lim.ReadOnly is set.
+func (s *gqlSchema) execute(ctx context.Context, req gqlRequest, lim gqlLimits) (gqlResponse, int) {
+	fail := func(status int, code string, pos int, format string, args ...any) (gqlResponse, int) {
+		e := &gqlError{Message: fmt.Sprintf(format, args...), Extensions: map[string]any{"code": code}}
+		if pos >= 0 {
+			e.Locations = []gqlLocation{gqlLocate(req.Query, pos)}
+		}
+		return gqlResponse{Errors: []*gqlError{e}}, status
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return fail(http.StatusBadRequest, CodeInvalid, -1, "the request has no query")
+	}
+	doc, err := parseGQL(req.Query, false)
+	if err != nil {
+		var se *gqlSyntaxError
+		errors.As(err, &se)
+		return fail(http.StatusBadRequest, CodeInvalid, se.pos, "%s", se.Error())
+	}
+	var op *gqlOperation
+	for _, o := range doc.operations {
+		if req.OperationName == "" && len(doc.operations) > 1 {
+			return fail(http.StatusBadRequest, CodeInvalid, -1, "operationName is required for a document with several operations")
+		}
+		if req.OperationName == "" || o.name == req.OperationName {
+			op = o
+			break
+		}
+	}
+	switch {
+	case op == nil:
+		return fail(http.StatusBadRequest, CodeInvalid, -1, "there is no operation named %q", req.OperationName)
+	case op.kind == "subscription":
+		return fail(http.StatusBadRequest, CodeInvalid, op.pos, "subscriptions are not supported; use /events or /ws")
+	case op.kind == "mutation" && lim.ReadOnly:
+		return fail(http.StatusMethodNotAllowed, CodeInvalid, op.pos, "mutations must be sent with POST")
+	case op.kind == "mutation" && s.types["Mutation"] == nil:
+		return fail(http.StatusBadRequest, CodeInvalid, op.pos, "the schema has no mutations")
+	}
+	e := &gqlExecution{ctx: ctx, s: s, doc: doc, op: op, src: req.Query, vars: make(map[string]any)}
+	e.coerceVariables(op, req.Variables)
+	if e.errors == nil {
+		v := &gqlValidator{gqlExecution: e, seen: make(map[string]bool)}
+		cost := v.selections(e.rootType(op), op.selections, 1, make(map[string]bool))
+		switch {
+		case v.errors != nil:
+		case lim.MaxDepth > 0 && v.depth > lim.MaxDepth:
+			return fail(http.StatusBadRequest, CodeInvalid, op.pos, "the query is %d levels deep, more than the limit of %d", v.depth, lim.MaxDepth)
+		case lim.MaxComplexity > 0 && cost > lim.MaxComplexity:
+			return fail(http.StatusBadRequest, CodeInvalid, op.pos, "the query has a complexity of %d, more than the limit of %d", cost, lim.MaxComplexity)
+		}
+	}
+	if e.errors != nil {
+		return gqlResponse{Errors: e.errors}, http.StatusBadRequest
+	}
+	data := e.executeSet(e.rootType(op), op.selections, []gqlSource{{}})[0]
+	if data == nil {
+		data = json.RawMessage("null")
+	}
+	return gqlResponse{Data: data, Errors: e.errors}, http.StatusOK
+}
+
+// gqlExecution is the state of one request.
+type gqlExecution struct {
+	ctx    context.Context
+	s      *gqlSchema
+	doc    *gqlDocument
+	op     *gqlOperation
+	src    string
+	vars   map[string]any
+	errors []*gqlError
+}
+
+func (e *gqlExecution) rootType(op *gqlOperation) *gqlType {
+	if op.kind == "mutation" {
+		return e.s.types["Mutation"]
+	}
+	return e.s.types["Query"]
+}
+
+// errorAt records a request error at pos.
+func (e *gqlExecution) errorAt(pos int, format string, args ...any) {
+	e.errors = append(e.errors, &gqlError{
+		Message:    fmt.Sprintf(format, args...),
+		Locations:  []gqlLocation{gqlLocate(e.src, pos)},
+		Extensions: map[string]any{"code": CodeInvalid},
+	})
+}
+
+// fieldError records the failure of the field sel at path, as the API
+// error it is or an internal error.
+func (e *gqlExecution) fieldError(sel *gqlSelection, path []any, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err)
+	}
+	if apiErr.Status >= 500 && apiErr.Err != nil {
+		slog.ErrorContext(e.ctx, "graphql field failed", "path", gqlPathString(path), "error", apiErr.Err)
+	}
+	ext := map[string]any{"code": apiErr.Code}
+	if apiErr.Details != nil {
+		ext["details"] = apiErr.Details
+	}
+	e.errors = append(e.errors, &gqlError{
+		Message:    apiErr.Message,
+		Locations:  []gqlLocation{gqlLocate(e.src, sel.pos)},
+		Path:       slices.Clone(path),
+		Extensions: ext,
+	})
+}
+
+func gqlPathString(path []any) string {
+	parts := make([]string, len(path))
+	for i, p := range path {
+		parts[i] = fmt.Sprint(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (e *gqlExecution) coerceVariables(op *gqlOperation, values map[string]any) {
+	for _, d := range op.vars {
+		if _, dup := e.vars[d.name]; dup {
+			e.errorAt(d.pos, "variable $%s is declared twice", d.name)
+			continue
+		}
+		if err := e.s.checkType(d.typ, false); err != nil {
+			e.errorAt(d.pos, "variable $%s: %v", d.name, err)
+			continue
+		}
+		raw, given := values[d.name]
+		var v any
+		var err error
+		switch {
+		case given:
+			v, err = e.s.coerceJSON(raw, d.typ)
+		case d.def != nil:
+			v, err = e.s.coerceLiteral(d.def, d.typ, nil)
+		case d.typ.nonNull:
+			err = errors.New("is required")
+		default:
+			continue
+		}
+		if err != nil {
+			e.errorAt(d.pos, "variable $%s: %v", d.name, err)
+			continue
+		}
+		e.vars[d.name] = v
+	}
+}
+
+// coerceJSON converts the variable value v, decoded from JSON, to type t.
+func (s *gqlSchema) coerceJSON(v any, t *gqlTypeRef) (any, error) {
+	if v == nil {
+		if t.nonNull {
+			return nil, errors.New("must not be null")
+		}
+		return nil, nil
+	}
+	if t.elem != nil {
+		list, ok := v.([]any)
+		if !ok {
+			list = []any{v}
+		}
+		out := make([]any, len(list))
+		for i, item := range list {
+			c, err := s.coerceJSON(item, t.elem)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	typ := s.types[t.name]
+	switch typ.kind {
+	case "input":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("must be a %s object", typ.name)
+		}
+		out := make(map[string]any)
+		for name := range obj {
+			if typ.field(name) == nil {
+				return nil, fmt.Errorf("%s has no field %q", typ.name, name)
+			}
+		}
+		for _, f := range typ.fields {
+			raw, given := obj[f.name]
+			var c any
+			var err error
+			switch {
+			case given:
+				c, err = s.coerceJSON(raw, f.typ)
+			case f.def != nil:
+				c, err = s.coerceLiteral(f.def, f.typ, nil)
+			case f.typ.nonNull:
+				err = errors.New("is required")
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.name, err)
+			}
+			out[f.name] = c
+		}
+		return out, nil
+	case "enum":
+		if str, ok := v.(string); ok && slices.Contains(typ.values, str) {
+			return str, nil
+		}
+		return nil, fmt.Errorf("must be one of %s", strings.Join(typ.values, ", "))
+	}
+	return typ.scalar.parse(v)
+}
+
+// coerceLiteral converts the literal v, which may name a variable of
+// vars, to type t.
+func (s *gqlSchema) coerceLiteral(v *gqlValue, t *gqlTypeRef, vars map[string]any) (any, error) {
+	switch v.kind {
+	case gqlVariable:
+		val, ok := vars[v.raw]
+		if val == nil && t.nonNull {
+			if !ok {
+				return nil, fmt.Errorf("variable $%s is not given", v.raw)
+			}
+			return nil, fmt.Errorf("variable $%s must not be null", v.raw)
+		}
+		return val, nil
+	case gqlNullValue:
+		if t.nonNull {
+			return nil, errors.New("must not be null")
+		}
+		return nil, nil
+	}
+	if t.elem != nil {
+		if v.kind != gqlListValue {
+			c, err := s.coerceLiteral(v, t.elem, vars)
+			return []any{c}, err
+		}
+		out := make([]any, len(v.list))
+		for i, item := range v.list {
+			c, err := s.coerceLiteral(item, t.elem, vars)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	typ := s.types[t.name]
+	switch typ.kind {
+	case "input":
+		if v.kind != gqlObjectValue {
+			return nil, fmt.Errorf("must be a %s object", typ.name)
+		}
+		given := make(map[string]*gqlValue)
+		for _, f := range v.fields {
+			if typ.field(f.name) == nil {
+				return nil, fmt.Errorf("%s has no field %q", typ.name, f.name)
+			}
+			given[f.name] = f.value
+		}
+		out := make(map[string]any)
+		for _, f := range typ.fields {
+			fv := given[f.name]
+			if fv != nil && fv.kind == gqlVariable {
+				if _, ok := vars[fv.raw]; !ok && f.def != nil {
+					fv = nil
+				}
+			}
+			var c any
+			var err error
+			switch {
+			case fv != nil:
+				c, err = s.coerceLiteral(fv, f.typ, vars)
+			case f.def != nil:
+				c, err = s.coerceLiteral(f.def, f.typ, nil)
+			case f.typ.nonNull:
+				err = errors.New("is required")
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.name, err)
+			}
+			out[f.name] = c
+		}
+		return out, nil
+	case "enum":
+		if v.kind == gqlEnumValue && slices.Contains(typ.values, v.raw) {
+			return v.raw, nil
+		}
+		return nil, fmt.Errorf("must be one of %s", strings.Join(typ.values, ", "))
+	}
+	var raw any
+	switch v.kind {
+	case gqlIntValue, gqlFloatValue:
+		raw = json.Number(v.raw)
+	case gqlStringValue:
+		raw = v.raw
+	case gqlBooleanValue:
+		raw = v.raw == "true"
+	default:
+		return nil, fmt.Errorf("must be a %s", typ.name)
+	}
+	return typ.scalar.parse(raw)
+}
+
+// gqlValidator checks an operation against the schema before it runs,
+// and measures its depth and complexity.
+type gqlValidator struct {
+	*gqlExecution
+	depth int
+	seen  map[string]bool
+}
+
+// selections checks sels on type t at depth, returning their cost.
+// visiting holds the fragments being spread, to catch cycles.
+func (v *gqlValidator) selections(t *gqlType, sels []gqlSelection, depth int, visiting map[string]bool) int {
+	cost := 0
+	for i := range sels {
+		sel := &sels[i]
+		for _, d := range sel.directives {
+			if d.name != "skip" && d.name != "include" {
+				v.errorAt(d.pos, "unknown directive @%s", d.name)
+			} else if _, err := v.directiveIf(d); err != nil {
+				v.errorAt(d.pos, "@%s: %v", d.name, err)
+			}
+		}
+		switch {
+		case sel.spread != "":
+			f := v.doc.fragments[sel.spread]
+			switch {
+			case f == nil:
+				v.errorAt(sel.pos, "unknown fragment %q", sel.spread)
+			case visiting[f.name]:
+				v.errorAt(sel.pos, "fragment %q spreads itself", f.name)
+			case f.on != t.name:
+				v.errorAt(sel.pos, "fragment %q on %s cannot be spread on %s", f.name, f.on, t.name)
+			default:
+				visiting[f.name] = true
+				cost += v.selections(t, f.selections, depth, visiting)
+				delete(visiting, f.name)
+			}
+		case sel.inline:
+			if sel.on != "" && sel.on != t.name {
+				v.errorAt(sel.pos, "a fragment on %s cannot be spread on %s", sel.on, t.name)
+				continue
+			}
+			cost += v.selections(t, sel.selections, depth, visiting)
+		default:
+			cost += v.field(t, sel, depth, visiting)
+		}
+	}
+	return cost
+}
+
+func (v *gqlValidator) field(t *gqlType, sel *gqlSelection, depth int, visiting map[string]bool) int {
+	v.depth = max(v.depth, depth)
+	if sel.name == "__typename" {
+		if sel.selections != nil {
+			v.errorAt(sel.pos, "__typename has no fields")
+		}
+		return 0
+	}
+	f := t.field(sel.name)
+	if f == nil {
+		v.errorAt(sel.pos, "%s has no field %q", t.name, sel.name)
+		return 0
+	}
+	args, err := v.arguments(f, sel)
+	if err != nil {
+		v.errorAt(sel.pos, "%s.%s: %v", t.name, f.name, err)
+		return 0
+	}
+	ref := f.typ
+	for ref.elem != nil {
+		ref = ref.elem
+	}
+	inner := v.s.types[ref.name]
+	if inner.kind != "type" {
+		if sel.selections != nil {
+			v.errorAt(sel.pos, "%s.%s is a %s and has no fields", t.name, f.name, inner.name)
+		}
+		return 1
+	}
+	if sel.selections == nil {
+		v.errorAt(sel.pos, "%s.%s is a %s, whose fields must be selected", t.name, f.name, inner.name)
+		return 1
+	}
+	times := 1
+	if n, ok := args["first"].(int); ok && n > 1 {
+		times = n
+	}
+	return 1 + times*v.selections(inner, sel.selections, depth+1, visiting)
+}
+
+// arguments coerces the arguments of sel for field f.
+func (e *gqlExecution) arguments(f *gqlField, sel *gqlSelection) (map[string]any, error) {
+	given := make(map[string]*gqlValue)
+	for _, a := range sel.args {
+		if _, dup := given[a.name]; dup {
+			return nil, fmt.Errorf("argument %q is given twice", a.name)
+		}
+		if !slices.ContainsFunc(f.args, func(d *gqlFieldDefinition) bool { return d.name == a.name }) {
+			return nil, fmt.Errorf("unknown argument %q", a.name)
+		}
+		given[a.name] = a.value
+	}
+	args := make(map[string]any)
+	for _, d := range f.args {
+		v := given[d.name]
+		if v != nil && v.kind == gqlVariable {
+			if !slices.ContainsFunc(e.op.vars, func(d *gqlVariableDef) bool { return d.name == v.raw }) {
+				return nil, fmt.Errorf("argument %q: variable $%s is not declared", d.name, v.raw)
+			}
+			if _, ok := e.vars[v.raw]; !ok && d.def != nil {
+				v = nil
+			}
+		}
+		var c any
+		var err error
+		switch {
+		case v != nil:
+			c, err = e.s.coerceLiteral(v, d.typ, e.vars)
+		case d.def != nil:
+			c, err = e.s.coerceLiteral(d.def, d.typ, nil)
+		case d.typ.nonNull:
+			err = errors.New("is required")
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("argument %q: %w", d.name, err)
+		}
+		args[d.name] = c
+	}
+	return args, nil
+}
+
+// directiveIf returns the if argument of a @skip or @include directive.
+func (e *gqlExecution) directiveIf(d gqlDirective) (bool, error) {
+	if len(d.args) != 1 || d.args[0].name != "if" {
+		return false, errors.New("takes only an if argument")
+	}
+	v, err := e.s.coerceLiteral(d.args[0].value, &gqlTypeRef{name: "Boolean", nonNull: true}, e.vars)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// included reports whether the directives of a selection let it run.
+func (e *gqlExecution) included(ds []gqlDirective) bool {
+	for _, d := range ds {
+		cond, _ := e.directiveIf(d)
+		if d.name == "skip" && cond || d.name == "include" && !cond {
+			return false
+		}
+	}
+	return true
+}
+
+// gqlSource is an object whose fields are being resolved, and the path of
+// the field it is the value of.
+type gqlSource struct {
+	value any
+	path  []any
+}
+
+// gqlCollected is the fields of a selection set under one response key,
+// which are merged.
+type gqlCollected struct {
+	key    string
+	fields []*gqlSelection
+}
+
+// collect gathers the fields of sels that run on type t, in order, with
+// those of the fragments they spread.
+func (e *gqlExecution) collect(t *gqlType, sels []gqlSelection, out []*gqlCollected) []*gqlCollected {
+	for i := range sels {
+		sel := &sels[i]
+		if !e.included(sel.directives) {
+			continue
+		}
+		switch {
+		case sel.spread != "":
+			out = e.collect(t, e.doc.fragments[sel.spread].selections, out)
+		case sel.inline:
+			out = e.collect(t, sel.selections, out)
+		default:
+			key := sel.name
+			if sel.alias != "" {
+				key = sel.alias
+			}
+			if j := slices.IndexFunc(out, func(c *gqlCollected) bool { return c.key == key }); j >= 0 {
+				out[j].fields = append(out[j].fields, sel)
+			} else {
+				out = append(out, &gqlCollected{key: key, fields: []*gqlSelection{sel}})
+			}
+		}
+	}
+	return out
+}
+
+// executeSet resolves sels on every object of sources, all of type t,
+// field by field, so that the resolvers of a field run for all of them
+// before any of their thunks. The result of an object is a jsonObject, or
+// nil if one of its non-null fields failed.
+func (e *gqlExecution) executeSet(t *gqlType, sels []gqlSelection, sources []gqlSource) []any {
+	results := make([]jsonObject, len(sources))
+	failed := make([]bool, len(sources))
+	for _, c := range e.collect(t, sels, nil) {
+		sel := c.fields[0]
+		if sel.name == "__typename" {
+			for i := range results {
+				results[i] = append(results[i], jsonMember{Key: c.key, Value: t.name})
+			}
+			continue
+		}
+		f := t.field(sel.name)
+		paths := make([][]any, len(sources))
+		for i, src := range sources {
+			paths[i] = append(slices.Clone(src.path), c.key)
+		}
+		values := make([]any, len(sources))
+		errored := make([]bool, len(sources))
+		fail := func(i int, err error) {
+			e.fieldError(sel, paths[i], err)
+			values[i], errored[i] = nil, true
+		}
+		args, err := e.arguments(f, sel)
+		if err == nil {
+			err = e.authorize(t.name + "." + f.name)
+		} else {
+			err = Invalid(nil, "%v", err)
+		}
+		for i, src := range sources {
+			if failed[i] {
+				continue
+			}
+			if err != nil {
+				fail(i, err)
+				continue
+			}
+			v, rerr := f.resolve(e.ctx, src.value, args)
+			if rerr != nil {
+				fail(i, rerr)
+				continue
+			}
+			values[i] = v
+		}
+		for i, v := range values {
+			if thunk, ok := v.(gqlThunk); ok {
+				if values[i], err = thunk(); err != nil {
+					fail(i, err)
+				}
+			}
+		}
+		var subs []gqlSelection
+		for _, fs := range c.fields {
+			subs = append(subs, fs.selections...)
+		}
+		done, doneErr := e.complete(f.typ, sel, subs, values, paths, errored)
+		for i := range sources {
+			if failed[i] {
+				continue
+			}
+			if done[i] == nil && f.typ.nonNull {
+				if !doneErr[i] {
+					e.fieldError(sel, paths[i], fmt.Errorf("%s.%s returned null", t.name, f.name))
+				}
+				failed[i] = true
+				continue
+			}
+			results[i] = append(results[i], jsonMember{Key: c.key, Value: done[i]})
+		}
+	}
+	out := make([]any, len(sources))
+	for i := range sources {
+		if !failed[i] {
+			if results[i] == nil {
+				results[i] = jsonObject{}
+			}
+			out[i] = results[i]
+		}
+	}
+	return out
+}
+
+// authorize checks that the caller has the permission the field named
+// Type.field needs, if authentication is on.
+func (e *gqlExecution) authorize(field string) error {
+	p, ok := e.s.permissions[field]
+	if !ok {
+		return nil
+	}
+	if c := ClaimsFromContext(e.ctx); c != nil && !hasPermission(c, p) {
+		return Forbidden("missing permission %q", p)
+	}
+	return nil
+}
+
+// complete turns the resolved values of a field of type t into the values
+// of the response, resolving the fields of objects. It returns them with
+// whether an error was recorded for each. A value that is nil but must
+// not be null is reported by the caller, which nulls its parent.
+func (e *gqlExecution) complete(t *gqlTypeRef, sel *gqlSelection, subs []gqlSelection, values []any, paths [][]any, errored []bool) ([]any, []bool) {
+	out := make([]any, len(values))
+	outErr := slices.Clone(errored)
+	if t.elem != nil {
+		var items []any
+		var itemPaths [][]any
+		var owners []int
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			rv := reflect.ValueOf(v)
+			if rv.Kind() != reflect.Slice {
+				e.fieldError(sel, paths[i], fmt.Errorf("%s returned %T, not a list", sel.name, v))
+				outErr[i] = true
+				continue
+			}
+			out[i] = []any{}
+			for j := 0; j < rv.Len(); j++ {
+				items = append(items, rv.Index(j).Interface())
+				itemPaths = append(itemPaths, append(slices.Clone(paths[i]), j))
+				owners = append(owners, i)
+			}
+		}
+		done, doneErr := e.complete(t.elem, sel, subs, items, itemPaths, make([]bool, len(items)))
+		nulled := make([]bool, len(values))
+		for k, item := range done {
+			i := owners[k]
+			if doneErr[k] {
+				outErr[i] = true
+			}
+			if nulled[i] {
+				continue
+			}
+			if item == nil && t.elem.nonNull {
+				if !doneErr[k] {
+					e.fieldError(sel, itemPaths[k], fmt.Errorf("%s returned a null item", sel.name))
+				}
+				nulled[i], outErr[i], out[i] = true, true, nil
+				continue
+			}
+			out[i] = append(out[i].([]any), item)
+		}
+		return out, outErr
+	}
+	typ := e.s.types[t.name]
+	switch typ.kind {
+	case "type":
+		var sources []gqlSource
+		var owners []int
+		for i, v := range values {
+			if v != nil {
+				sources = append(sources, gqlSource{value: v, path: paths[i]})
+				owners = append(owners, i)
+			}
+		}
+		for k, obj := range e.executeSet(typ, subs, sources) {
+			i := owners[k]
+			if obj == nil {
+				outErr[i] = true
+				continue
+			}
+			out[i] = obj
+		}
+	case "enum":
+		for i, v := range values {
+			if s, ok := v.(string); ok && slices.Contains(typ.values, s) {
+				out[i] = s
+			} else if v != nil {
+				e.fieldError(sel, paths[i], fmt.Errorf("%v is not a %s", v, typ.name))
+				outErr[i] = true
+			}
+		}
+	default:
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			s, err := typ.scalar.serialize(v)
+			if err != nil {
+				e.fieldError(sel, paths[i], err)
+				outErr[i] = true
+				continue
+			}
+			out[i] = s
+		}
+	}
+	return out, outErr
+}
+
+// gqlIntArg returns the Int argument name of args, or def without it.
+func gqlIntArg(args map[string]any, name string, def int) int {
+	if n, ok := args[name].(int); ok {
+		return n
+	}
+	return def
+}
+
+// gqlStringArg returns the String argument name of args, or "" without
+// it.
+func gqlStringArg(args map[string]any, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
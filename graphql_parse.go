@@ -0,0 +1,683 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file parses GraphQL documents: executable ones, with operations and
+// fragments, and the type definitions of a schema, as in the October 2021
+// edition of the specification.
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlNameToken
+	gqlIntToken
+	gqlFloatToken
+	gqlStringToken
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	pos   int
+}
+
+// gqlSyntaxError is a problem with the text of a document at byte offset
+// pos.
+type gqlSyntaxError struct {
+	pos int
+	msg string
+}
+
+func (e *gqlSyntaxError) Error() string {
+	return "syntax error: " + e.msg
+}
+
+// gqlLocation is a position in a document, counted from 1.
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func gqlLocate(src string, pos int) gqlLocation {
+	before := src[:min(pos, len(src))]
+	line := strings.Count(before, "\n") + 1
+	col := utf8.RuneCountInString(before[strings.LastIndexByte(before, '\n')+1:]) + 1
+	return gqlLocation{Line: line, Column: col}
+}
+
+// The nodes of a parsed document.
+type (
+	gqlDocument struct {
+		operations []*gqlOperation
+		fragments  map[string]*gqlFragment
+		types      []*gqlTypeDefinition
+	}
+
+	gqlOperation struct {
+		kind       string // query, mutation or subscription
+		name       string
+		vars       []*gqlVariableDef
+		selections []gqlSelection
+		pos        int
+	}
+
+	gqlVariableDef struct {
+		name string
+		typ  *gqlTypeRef
+		def  *gqlValue
+		pos  int
+	}
+
+	gqlFragment struct {
+		name       string
+		on         string
+		selections []gqlSelection
+		pos        int
+	}
+
+	// gqlSelection is a field, a fragment spread, which has spread set,
+	// or an inline fragment, which has selections but no name.
+	gqlSelection struct {
+		alias      string
+		name       string
+		args       []gqlArgument
+		directives []gqlDirective
+		selections []gqlSelection
+		spread     string
+		on         string
+		inline     bool
+		pos        int
+	}
+
+	gqlArgument struct {
+		name  string
+		value *gqlValue
+	}
+
+	gqlDirective struct {
+		name string
+		args []gqlArgument
+		pos  int
+	}
+
+	// gqlTypeRef is a named type, or a list of elem, possibly non-null.
+	gqlTypeRef struct {
+		name    string
+		elem    *gqlTypeRef
+		nonNull bool
+	}
+
+	// gqlTypeDefinition is a scalar, type, input or enum definition of a
+	// schema, or an extension of a type.
+	gqlTypeDefinition struct {
+		kind        string
+		name        string
+		description string
+		extend      bool
+		fields      []*gqlFieldDefinition
+		values      []string
+		pos         int
+	}
+
+	// gqlFieldDefinition is a field of a type, or of an input with a
+	// default value.
+	gqlFieldDefinition struct {
+		name        string
+		description string
+		args        []*gqlFieldDefinition
+		typ         *gqlTypeRef
+		def         *gqlValue
+	}
+)
+
+func (t *gqlTypeRef) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+type gqlValueKind int
+
+const (
+	gqlVariable gqlValueKind = iota
+	gqlIntValue
+	gqlFloatValue
+	gqlStringValue
+	gqlBooleanValue
+	gqlNullValue
+	gqlEnumValue
+	gqlListValue
+	gqlObjectValue
+)
+
+// gqlValue is a literal value, or a variable named by raw.
+type gqlValue struct {
+	kind   gqlValueKind
+	raw    string
+	list   []*gqlValue
+	fields []gqlArgument
+	pos    int
+}
+
+// gqlParser parses a document. Its methods panic with a *gqlSyntaxError,
+// which parseGQL recovers.
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+}
+
+// parseGQL parses src, which is a schema if sdl is set and an executable
+// document otherwise.
+func parseGQL(src string, sdl bool) (doc *gqlDocument, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			e, ok := v.(*gqlSyntaxError)
+			if !ok {
+				panic(v)
+			}
+			doc, err = nil, e
+		}
+	}()
+	p := &gqlParser{src: src}
+	p.next()
+	doc = &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	if p.tok.kind == gqlEOF {
+		p.fail("the document is empty")
+	}
+	for p.tok.kind != gqlEOF {
+		if sdl {
+			doc.types = append(doc.types, p.typeDefinition())
+			continue
+		}
+		switch {
+		case p.is("{") || p.is("query") || p.is("mutation") || p.is("subscription"):
+			doc.operations = append(doc.operations, p.operation())
+		case p.is("fragment"):
+			f := p.fragment()
+			if doc.fragments[f.name] != nil {
+				p.failAt(f.pos, "fragment %q is defined twice", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			p.fail("expected an operation or a fragment, found %s", p.describe())
+		}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) fail(format string, args ...any) {
+	p.failAt(p.tok.pos, format, args...)
+}
+
+func (p *gqlParser) failAt(pos int, format string, args ...any) {
+	panic(&gqlSyntaxError{pos: pos, msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *gqlParser) describe() string {
+	switch p.tok.kind {
+	case gqlEOF:
+		return "the end of the document"
+	case gqlStringToken:
+		return "a string"
+	}
+	return strconv.Quote(p.tok.value)
+}
+
+// is reports whether the current token is the punctuator or name s.
+func (p *gqlParser) is(s string) bool {
+	return (p.tok.kind == gqlPunct || p.tok.kind == gqlNameToken) && p.tok.value == s
+}
+
+func (p *gqlParser) expect(s string) {
+	if !p.is(s) {
+		p.fail("expected %q, found %s", s, p.describe())
+	}
+	p.next()
+}
+
+func (p *gqlParser) skip(s string) bool {
+	if p.is(s) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) name() string {
+	if p.tok.kind != gqlNameToken {
+		p.fail("expected a name, found %s", p.describe())
+	}
+	s := p.tok.value
+	p.next()
+	return s
+}
+
+// next reads the next token, skipping white space, commas and comments.
+func (p *gqlParser) next() {
+	src := p.src
+ignored:
+	for p.pos < len(src) {
+		switch c := src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(src) && src[p.pos] != '\n' && src[p.pos] != '\r' {
+				p.pos++
+			}
+		case strings.HasPrefix(src[p.pos:], "\ufeff"):
+			p.pos += len("\ufeff")
+		default:
+			break ignored
+		}
+	}
+	start := p.pos
+	if p.pos >= len(src) {
+		p.tok = gqlToken{kind: gqlEOF, pos: start}
+		return
+	}
+	c := src[p.pos]
+	switch {
+	case strings.HasPrefix(src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{kind: gqlPunct, value: "...", pos: start}
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = gqlToken{kind: gqlPunct, value: string(c), pos: start}
+	case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		for p.pos < len(src) && isGQLNameChar(src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: gqlNameToken, value: src[start:p.pos], pos: start}
+	case c == '-' || c >= '0' && c <= '9':
+		p.number()
+	case strings.HasPrefix(src[p.pos:], `"""`):
+		p.blockString()
+	case c == '"':
+		p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(src[p.pos:])
+		p.failAt(start, "unexpected character %q", r)
+	}
+}
+
+func isGQLNameChar(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+func (p *gqlParser) number() {
+	src, start := p.src, p.pos
+	digits := func() int {
+		n := 0
+		for p.pos < len(src) && src[p.pos] >= '0' && src[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	if src[p.pos] == '-' {
+		p.pos++
+	}
+	intStart := p.pos
+	if digits() == 0 || src[intStart] == '0' && p.pos-intStart > 1 {
+		p.failAt(start, "invalid number")
+	}
+	kind := gqlIntToken
+	if p.pos < len(src) && src[p.pos] == '.' {
+		p.pos++
+		if digits() == 0 {
+			p.failAt(start, "invalid number")
+		}
+		kind = gqlFloatToken
+	}
+	if p.pos < len(src) && (src[p.pos] == 'e' || src[p.pos] == 'E') {
+		p.pos++
+		if p.pos < len(src) && (src[p.pos] == '+' || src[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			p.failAt(start, "invalid number")
+		}
+		kind = gqlFloatToken
+	}
+	if p.pos < len(src) && (isGQLNameChar(src[p.pos]) || src[p.pos] == '.') {
+		p.failAt(start, "invalid number")
+	}
+	p.tok = gqlToken{kind: kind, value: src[start:p.pos], pos: start}
+}
+
+func (p *gqlParser) string() {
+	src, start := p.src, p.pos
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(src) || src[p.pos] == '\n' || src[p.pos] == '\r' {
+			p.failAt(start, "unterminated string")
+		}
+		c := src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			p.tok = gqlToken{kind: gqlStringToken, value: b.String(), pos: start}
+			return
+		case c == '\\':
+			if p.pos+1 >= len(src) {
+				p.failAt(start, "unterminated string")
+			}
+			esc := src[p.pos+1]
+			p.pos += 2
+			switch esc {
+			case '"', '\\', '/':
+				b.WriteByte(esc)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(src) {
+					p.failAt(p.pos-2, "invalid escape sequence")
+				}
+				n, err := strconv.ParseUint(src[p.pos:p.pos+4], 16, 16)
+				if err != nil {
+					p.failAt(p.pos-2, "invalid escape sequence")
+				}
+				b.WriteRune(rune(n))
+				p.pos += 4
+			default:
+				p.failAt(p.pos-2, "invalid escape sequence \\%c", esc)
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// blockString reads a """ string, removing the indentation its lines
+// share and its leading and trailing blank lines.
+func (p *gqlParser) blockString() {
+	src, start := p.src, p.pos
+	p.pos += 3
+	end := -1
+	for i := p.pos; i+3 <= len(src); i++ {
+		if strings.HasPrefix(src[i:], `\"""`) {
+			i += 3
+			continue
+		}
+		if strings.HasPrefix(src[i:], `"""`) {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		p.failAt(start, "unterminated string")
+	}
+	raw := strings.ReplaceAll(src[p.pos:end], `\"""`, `"""`)
+	p.pos = end + 3
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\r", "\n"), "\n")
+	indent := -1
+	for _, l := range lines[1:] {
+		trimmed := strings.TrimLeft(l, " \t")
+		if trimmed != "" && (indent < 0 || len(l)-len(trimmed) < indent) {
+			indent = len(l) - len(trimmed)
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			lines[i] = lines[i][min(indent, len(lines[i])):]
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	p.tok = gqlToken{kind: gqlStringToken, value: strings.Join(lines, "\n"), pos: start}
+}
+
+func (p *gqlParser) operation() *gqlOperation {
+	op := &gqlOperation{kind: "query", pos: p.tok.pos}
+	if !p.is("{") {
+		op.kind = p.name()
+		if p.tok.kind == gqlNameToken {
+			op.name = p.name()
+		}
+		if p.skip("(") {
+			for !p.skip(")") {
+				v := &gqlVariableDef{pos: p.tok.pos}
+				p.expect("$")
+				v.name = p.name()
+				p.expect(":")
+				v.typ = p.typeRef()
+				if p.skip("=") {
+					v.def = p.value(true)
+				}
+				p.directives()
+				op.vars = append(op.vars, v)
+			}
+		}
+		p.directives()
+	}
+	op.selections = p.selectionSet()
+	return op
+}
+
+func (p *gqlParser) fragment() *gqlFragment {
+	f := &gqlFragment{pos: p.tok.pos}
+	p.expect("fragment")
+	f.name = p.name()
+	if f.name == "on" {
+		p.failAt(f.pos, "a fragment cannot be named on")
+	}
+	p.expect("on")
+	f.on = p.name()
+	p.directives()
+	f.selections = p.selectionSet()
+	return f
+}
+
+func (p *gqlParser) selectionSet() []gqlSelection {
+	start := p.tok.pos
+	p.expect("{")
+	var sels []gqlSelection
+	for !p.skip("}") {
+		sels = append(sels, p.selection())
+	}
+	if len(sels) == 0 {
+		p.failAt(start, "a selection set cannot be empty")
+	}
+	return sels
+}
+
+func (p *gqlParser) selection() gqlSelection {
+	s := gqlSelection{pos: p.tok.pos}
+	if p.skip("...") {
+		if p.tok.kind == gqlNameToken && p.tok.value != "on" {
+			s.spread = p.name()
+			s.directives = p.directives()
+			return s
+		}
+		s.inline = true
+		if p.skip("on") {
+			s.on = p.name()
+		}
+		s.directives = p.directives()
+		s.selections = p.selectionSet()
+		return s
+	}
+	s.name = p.name()
+	if p.skip(":") {
+		s.alias, s.name = s.name, p.name()
+	}
+	s.args = p.arguments(false)
+	s.directives = p.directives()
+	if p.is("{") {
+		s.selections = p.selectionSet()
+	}
+	return s
+}
+
+func (p *gqlParser) arguments(constant bool) []gqlArgument {
+	if !p.skip("(") {
+		return nil
+	}
+	var args []gqlArgument
+	for !p.skip(")") {
+		name := p.name()
+		p.expect(":")
+		args = append(args, gqlArgument{name: name, value: p.value(constant)})
+	}
+	return args
+}
+
+func (p *gqlParser) directives() []gqlDirective {
+	var ds []gqlDirective
+	for p.is("@") {
+		d := gqlDirective{pos: p.tok.pos}
+		p.next()
+		d.name = p.name()
+		d.args = p.arguments(false)
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+func (p *gqlParser) typeRef() *gqlTypeRef {
+	var t *gqlTypeRef
+	if p.skip("[") {
+		t = &gqlTypeRef{elem: p.typeRef()}
+		p.expect("]")
+	} else {
+		t = &gqlTypeRef{name: p.name()}
+	}
+	t.nonNull = p.skip("!")
+	return t
+}
+
+// value parses a value, which may not use variables if constant is set.
+func (p *gqlParser) value(constant bool) *gqlValue {
+	v := &gqlValue{pos: p.tok.pos, raw: p.tok.value}
+	switch p.tok.kind {
+	case gqlIntToken:
+		v.kind = gqlIntValue
+	case gqlFloatToken:
+		v.kind = gqlFloatValue
+	case gqlStringToken:
+		v.kind = gqlStringValue
+	case gqlNameToken:
+		switch p.tok.value {
+		case "true", "false":
+			v.kind = gqlBooleanValue
+		case "null":
+			v.kind = gqlNullValue
+		default:
+			v.kind = gqlEnumValue
+		}
+	case gqlPunct:
+		switch p.tok.value {
+		case "$":
+			if constant {
+				p.fail("variables cannot be used here")
+			}
+			p.next()
+			v.kind, v.raw = gqlVariable, p.name()
+			return v
+		case "[":
+			p.next()
+			v.kind = gqlListValue
+			for !p.skip("]") {
+				v.list = append(v.list, p.value(constant))
+			}
+			return v
+		case "{":
+			p.next()
+			v.kind = gqlObjectValue
+			for !p.skip("}") {
+				name := p.name()
+				p.expect(":")
+				v.fields = append(v.fields, gqlArgument{name: name, value: p.value(constant)})
+			}
+			return v
+		}
+		p.fail("expected a value, found %s", p.describe())
+	default:
+		p.fail("expected a value, found %s", p.describe())
+	}
+	p.next()
+	return v
+}
+
+func (p *gqlParser) description() string {
+	if p.tok.kind != gqlStringToken {
+		return ""
+	}
+	s := p.tok.value
+	p.next()
+	return s
+}
+
+func (p *gqlParser) typeDefinition() *gqlTypeDefinition {
+	d := &gqlTypeDefinition{description: p.description(), pos: p.tok.pos}
+	d.extend = p.skip("extend")
+	d.kind = p.name()
+	switch d.kind {
+	case "scalar", "type", "input", "enum":
+	default:
+		p.failAt(d.pos, "expected a scalar, type, input or enum definition, found %q", d.kind)
+	}
+	d.name = p.name()
+	p.directives()
+	switch d.kind {
+	case "type", "input":
+		p.expect("{")
+		for !p.skip("}") {
+			d.fields = append(d.fields, p.fieldDefinition(d.kind == "type"))
+		}
+	case "enum":
+		p.expect("{")
+		for !p.skip("}") {
+			p.description()
+			d.values = append(d.values, p.name())
+			p.directives()
+		}
+	}
+	return d
+}
+
+// fieldDefinition parses a field of a type, with arguments, or an input
+// value, with a default.
+func (p *gqlParser) fieldDefinition(withArgs bool) *gqlFieldDefinition {
+	f := &gqlFieldDefinition{description: p.description()}
+	f.name = p.name()
+	if withArgs && p.skip("(") {
+		for !p.skip(")") {
+			f.args = append(f.args, p.fieldDefinition(false))
+		}
+	}
+	p.expect(":")
+	f.typ = p.typeRef()
+	if !withArgs && p.skip("=") {
+		f.def = p.value(true)
+	}
+	p.directives()
+	return f
+}
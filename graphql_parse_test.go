@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseGQLErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+		loc  gqlLocation
+	}{
+		{"", "the document is empty", gqlLocation{1, 1}},
+		{"# only a comment\n", "the document is empty", gqlLocation{2, 1}},
+		{"{", "expected a name, found the end of the document", gqlLocation{1, 2}},
+		{"{ }", "a selection set cannot be empty", gqlLocation{1, 1}},
+		{"{ node { } }", "a selection set cannot be empty", gqlLocation{1, 8}},
+		{"{ node { id } ", "expected a name, found the end of the document", gqlLocation{1, 15}},
+		{"{ node { id } } }", `expected an operation or a fragment, found "}"`, gqlLocation{1, 17}},
+		{"type Node { id: Int }", `expected an operation or a fragment, found "type"`, gqlLocation{1, 1}},
+		{"{\n  node(first: ) { id }\n}", `expected a value, found ")"`, gqlLocation{2, 15}},
+		{"{ node(first: $) { id } }", `expected a name, found ")"`, gqlLocation{1, 16}},
+		{"{ node(first: 01) { id } }", "invalid number", gqlLocation{1, 15}},
+		{"{ node(first: 1.2.3) { id } }", "invalid number", gqlLocation{1, 15}},
+		{`{ node(name: "open) { id } }`, "unterminated string", gqlLocation{1, 14}},
+		{`{ node(name: """open) { id } }`, "unterminated string", gqlLocation{1, 14}},
+		{`{ node(name: "\q") { id } }`, `invalid escape sequence \q`, gqlLocation{1, 15}},
+		{"{ node\u00a0{ id } }", `unexpected character '\u00a0'`, gqlLocation{1, 7}},
+		{"{ node @ { id } }", `expected a name, found "{"`, gqlLocation{1, 10}},
+		{"{ ...on }", `expected a name, found "}"`, gqlLocation{1, 9}},
+		{"query Q($v: ) { id }", `expected a name, found ")"`, gqlLocation{1, 13}},
+		{"fragment F on Node", `expected "{", found the end of the document`, gqlLocation{1, 19}},
+		{"fragment F on Node { id }\nfragment F on Node { id }", `fragment "F" is defined twice`, gqlLocation{2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			doc, err := parseGQL(tt.src, false)
+			var se *gqlSyntaxError
+			if !errors.As(err, &se) {
+				t.Fatalf("got %v, %v, want a syntax error", doc, err)
+			}
+			if se.msg != tt.want {
+				t.Errorf("got %q, want %q", se.msg, tt.want)
+			}
+			if loc := gqlLocate(tt.src, se.pos); loc != tt.loc {
+				t.Errorf("got the error at %d:%d, want %d:%d", loc.Line, loc.Column, tt.loc.Line, tt.loc.Column)
+			}
+		})
+	}
+}
+
+func TestParseGQLDocument(t *testing.T) {
+	src := `
+# Comments and commas are ignored.
+query Nodes($first: Int = 2, $name: String!) @cached {
+  node(name: $name) {
+    ...Fields, children(first: $first) { ... on Node { id } }
+  }
+}
+fragment Fields on Node { id name: label(text: """a "block" string""") }
+`
+	doc, err := parseGQL(src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 1 || len(doc.fragments) != 1 {
+		t.Fatalf("got %d operations and %d fragments, want 1 of each", len(doc.operations), len(doc.fragments))
+	}
+	op := doc.operations[0]
+	if op.kind != "query" || op.name != "Nodes" || len(op.vars) != 2 || op.vars[0].def.raw != "2" {
+		t.Errorf("got operation %s %s with %d variables", op.kind, op.name, len(op.vars))
+	}
+	node := op.selections[0]
+	if node.name != "node" || len(node.args) != 1 || len(node.selections) != 2 {
+		t.Fatalf("got selection %s with %d arguments and %d selections", node.name, len(node.args), len(node.selections))
+	}
+	if node.selections[0].spread != "Fields" || !node.selections[1].selections[0].inline {
+		t.Errorf("the fragment spreads were not parsed")
+	}
+	label := doc.fragments["Fields"].selections[1]
+	if label.alias != "name" || label.name != "label" || label.args[0].value.raw != `a "block" string` {
+		t.Errorf("got field %s: %s(%s)", label.alias, label.name, label.args[0].value.raw)
+	}
+}
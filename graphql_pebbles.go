@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// pebblesSchema is the GraphQL schema of the pebbles, served by the same
+// PebbleService as the REST and gRPC APIs.
+const pebblesSchema = `
+"An instant, as an RFC 3339 string."
+scalar Time
+
+type Query {
+  "Fetches a pebble, or null if there is none. includeDeleted, which needs the pebbles:admin permission, returns it even if it has been deleted."
+  pebble(id: ID!, includeDeleted: Boolean = false): Pebble
+
+  "Lists pebbles like GET /pebbles: first of them from the cursor after, ordered by sort, a field optionally followed by :asc or :desc, and filtered by name, color and weightGrams."
+  pebbles(
+    first: Int = 50
+    after: String
+    sort: String
+    name: String
+    color: String
+    weightGrams: Int
+    includeDeleted: Boolean = false
+  ): PebbleConnection!
+}
+
+type Mutation {
+  createPebble(input: PebbleInput!): Pebble!
+
+  "Sets every field of a pebble. ifMatch is the etag of the version the change is based on; the change fails if the pebble has changed since."
+  replacePebble(id: ID!, input: PebbleInput!, ifMatch: String): Pebble!
+
+  "Changes the fields of a pebble set in patch."
+  updatePebble(id: ID!, patch: PebblePatch!, ifMatch: String): Pebble!
+
+  deletePebble(id: ID!, ifMatch: String): Boolean!
+
+  "Brings back a deleted pebble, which needs the pebbles:admin permission."
+  restorePebble(id: ID!, ifMatch: String): Pebble!
+}
+
+type Pebble {
+  id: ID!
+  name: String!
+  color: String!
+  weightGrams: Int!
+  createdAt: Time!
+  updatedAt: Time!
+  deletedAt: Time
+  "Identifies this version of the pebble, for the ifMatch arguments, as its ETag header does in the REST API."
+  etag: String!
+}
+
+type PebbleConnection {
+  items: [Pebble!]!
+  "The cursor of the next page, or null on the last one."
+  nextCursor: String
+}
+
+input PebbleInput {
+  name: String!
+  color: String = ""
+  weightGrams: Int = 0
+}
+
+input PebblePatch {
+  name: String
+  color: String
+  weightGrams: Int
+}
+`
+
+// attachmentsSchema extends pebblesSchema when attachments are enabled.
+const attachmentsSchema = `
+extend type Pebble {
+  "The attachments of the pebble, oldest first."
+  attachments: [Attachment!]!
+}
+
+type Attachment {
+  id: ID!
+  filename: String!
+  contentType: String!
+  size: Int!
+  sha256: String!
+  createdAt: Time!
+  "A signed URL the content can be downloaded from without credentials until urlExpiresAt."
+  downloadUrl: String!
+  urlExpiresAt: Time!
+}
+`
+
+var gqlScalars = map[string]gqlScalar{
+	"Time": {
+		serialize: func(v any) (any, error) {
+			t, ok := v.(time.Time)
+			if !ok {
+				return nil, errors.New("not a time")
+			}
+			return t.UTC().Format(time.RFC3339Nano), nil
+		},
+		parse: func(v any) (any, error) {
+			s, _ := v.(string)
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, errors.New("must be an RFC 3339 time")
+			}
+			return t, nil
+		},
+	},
+}
+
+// graphqlAPI serves the pebbles schema at /graphql. Within a request, the
+// attachments of pebbles are loaded once for all the pebbles of a level.
+type graphqlAPI struct {
+	schema      *gqlSchema
+	svc         *PebbleService
+	attachments *attachmentsAPI
+	limits      gqlLimits
+}
+
+type graphqlLoadersKey struct{}
+
+// graphqlLoaders are the loaders of one request.
+type graphqlLoaders struct {
+	attachments *Loader[string, []Attachment]
+}
+
+// newGraphQLAPI builds the schema, with the attachments of pebbles if
+// attachments is not nil.
+func newGraphQLAPI(cfg GraphQLConfig, svc *PebbleService, attachments *attachmentsAPI) (*graphqlAPI, error) {
+	sdl := pebblesSchema
+	if attachments != nil {
+		sdl += attachmentsSchema
+	}
+	s, err := newGQLSchema(sdl, gqlScalars, graphqlPermissions)
+	if err != nil {
+		return nil, err
+	}
+	api := &graphqlAPI{
+		schema:      s,
+		svc:         svc,
+		attachments: attachments,
+		limits:      gqlLimits{MaxDepth: cfg.MaxDepth, MaxComplexity: cfg.MaxComplexity},
+	}
+	s.Resolve("Query", "pebble", api.pebble)
+	s.Resolve("Query", "pebbles", api.pebbles)
+	s.Resolve("Mutation", "createPebble", api.createPebble)
+	s.Resolve("Mutation", "replacePebble", api.replacePebble)
+	s.Resolve("Mutation", "updatePebble", api.updatePebble)
+	s.Resolve("Mutation", "deletePebble", api.deletePebble)
+	s.Resolve("Mutation", "restorePebble", api.restorePebble)
+
+	pebbleFields := map[string]func(p Pebble) any{
+		"id":          func(p Pebble) any { return p.ID },
+		"name":        func(p Pebble) any { return p.Name },
+		"color":       func(p Pebble) any { return p.Color },
+		"weightGrams": func(p Pebble) any { return p.WeightGrams },
+		"createdAt":   func(p Pebble) any { return p.CreatedAt },
+		"updatedAt":   func(p Pebble) any { return p.UpdatedAt },
+		"deletedAt": func(p Pebble) any {
+			if p.DeletedAt == nil {
+				return nil
+			}
+			return *p.DeletedAt
+		},
+		"etag": func(p Pebble) any { return computeETag(p) },
+	}
+	for name, get := range pebbleFields {
+		s.Resolve("Pebble", name, func(_ context.Context, source any, _ map[string]any) (any, error) {
+			return get(source.(Pebble)), nil
+		})
+	}
+	s.Resolve("PebbleConnection", "items", func(_ context.Context, source any, _ map[string]any) (any, error) {
+		return source.(PebblePage).Items, nil
+	})
+	s.Resolve("PebbleConnection", "nextCursor", func(_ context.Context, source any, _ map[string]any) (any, error) {
+		if c := source.(PebblePage).NextCursor; c != "" {
+			return c, nil
+		}
+		return nil, nil
+	})
+
+	if attachments != nil {
+		s.Resolve("Pebble", "attachments", api.pebbleAttachments)
+		attachmentFields := map[string]func(a attachmentResponse) any{
+			"id":           func(a attachmentResponse) any { return a.ID },
+			"filename":     func(a attachmentResponse) any { return a.Filename },
+			"contentType":  func(a attachmentResponse) any { return a.ContentType },
+			"size":         func(a attachmentResponse) any { return a.Size },
+			"sha256":       func(a attachmentResponse) any { return a.SHA256 },
+			"createdAt":    func(a attachmentResponse) any { return a.CreatedAt },
+			"downloadUrl":  func(a attachmentResponse) any { return a.DownloadURL },
+			"urlExpiresAt": func(a attachmentResponse) any { return a.URLExpiresAt },
+		}
+		for name, get := range attachmentFields {
+			s.Resolve("Attachment", name, func(_ context.Context, source any, _ map[string]any) (any, error) {
+				return get(source.(attachmentResponse)), nil
+			})
+		}
+	}
+	return api, s.check()
+}
+
+func (api *graphqlAPI) register(rt *Router) {
+	rt.Get("/graphql", api.serve)
+	rt.Post("/graphql", api.serve)
+	rt.Get("/graphql/schema", api.serveSchema)
+
+	rt.Document("POST", "/graphql", Operation{Summary: "Run a GraphQL query or mutation", Tag: "graphql", Request: gqlRequest{}, Response: gqlResponse{}})
+	rt.Document("GET", "/graphql", Operation{Summary: "Run a GraphQL query given by the query, operationName and variables parameters", Tag: "graphql", Response: gqlResponse{}})
+	rt.Document("GET", "/graphql/schema", Operation{Summary: "Fetch the GraphQL schema in SDL", Tag: "graphql"})
+}
+
+// serve runs the operation of a POST body, or of the query parameters of a
+// GET request, which cannot run mutations.
+func (api *graphqlAPI) serve(w http.ResponseWriter, r *http.Request) error {
+	var req gqlRequest
+	lim := api.limits
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return Invalid(ValidationErrors{{Field: "variables", Message: "must be a JSON object"}}, "invalid parameters")
+			}
+		}
+		lim.ReadOnly = true
+	} else if err := Bind(r, &req); err != nil {
+		return err
+	}
+	loaders := &graphqlLoaders{}
+	if api.attachments != nil {
+		loaders.attachments = NewLoader(api.loadAttachments)
+	}
+	ctx := context.WithValue(r.Context(), graphqlLoadersKey{}, loaders)
+	resp, status := api.schema.execute(ctx, req, lim)
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", "POST")
+	}
+	writeJSON(w, status, resp)
+	return nil
+}
+
+func (api *graphqlAPI) serveSchema(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := w.Write([]byte(api.schema.sdl))
+	return err
+}
+
+// gqlFieldNames maps the fields that the errors of the service name, as
+// the REST API calls them, to the arguments and input fields of the
+// schema.
+var gqlFieldNames = map[string]string{
+	"limit":           "first",
+	"cursor":          "after",
+	"weight_grams":    "weightGrams",
+	"include_deleted": "includeDeleted",
+}
+
+// graphqlError renames the fields of the validation errors in err for the
+// schema.
+func graphqlError(err error) error {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	errs, ok := apiErr.Details.(ValidationErrors)
+	if !ok {
+		return err
+	}
+	renamed := *apiErr
+	details := make(ValidationErrors, len(errs))
+	for i, fe := range errs {
+		if name, ok := gqlFieldNames[fe.Field]; ok {
+			fe.Field = name
+		}
+		details[i] = fe
+	}
+	renamed.Details = details
+	return &renamed
+}
+
+func gqlIncludeDeleted(ctx context.Context, args map[string]any) (bool, error) {
+	include, _ := args["includeDeleted"].(bool)
+	if include {
+		return true, checkIncludeDeleted(ctx)
+	}
+	return false, nil
+}
+
+func (api *graphqlAPI) pebble(ctx context.Context, _ any, args map[string]any) (any, error) {
+	include, err := gqlIncludeDeleted(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	id, err := requestUUID(args["id"].(string))
+	if err != nil {
+		return nil, err
+	}
+	p, err := api.svc.Get(ctx, id, include)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// pebbles lists pebbles by turning its arguments into the parameters of
+// GET /pebbles, so both are parsed by parseListValues.
+func (api *graphqlAPI) pebbles(ctx context.Context, _ any, args map[string]any) (any, error) {
+	include, err := gqlIncludeDeleted(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	values.Set("limit", strconv.Itoa(gqlIntArg(args, "first", pebbleListParams.DefaultLimit)))
+	for arg, param := range map[string]string{"after": "cursor", "sort": "sort", "name": "name", "color": "color"} {
+		if s, ok := args[arg].(string); ok {
+			values.Set(param, s)
+		}
+	}
+	if n, ok := args["weightGrams"].(int); ok {
+		values.Set("weight_grams", strconv.Itoa(n))
+	}
+	q, err := parseListValues(values, pebbleListParams)
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	q.IncludeDeleted = include
+	return api.svc.List(ctx, q)
+}
+
+func gqlPebbleInput(args map[string]any) pebbleInput {
+	in := args["input"].(map[string]any)
+	color, _ := in["color"].(string)
+	weight, _ := in["weightGrams"].(int)
+	return pebbleInput{Name: in["name"].(string), Color: color, WeightGrams: weight}
+}
+
+func (api *graphqlAPI) createPebble(ctx context.Context, _ any, args map[string]any) (any, error) {
+	p, err := api.svc.Create(ctx, gqlPebbleInput(args))
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	return p, nil
+}
+
+func (api *graphqlAPI) replacePebble(ctx context.Context, _ any, args map[string]any) (any, error) {
+	id, err := requestUUID(args["id"].(string))
+	if err != nil {
+		return nil, err
+	}
+	p, err := api.svc.Replace(ctx, id, gqlPebbleInput(args), gqlStringArg(args, "ifMatch"))
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	return p, nil
+}
+
+// updatePebble changes the fields set in the patch; those set to null
+// are left as they are, like those left out.
+func (api *graphqlAPI) updatePebble(ctx context.Context, _ any, args map[string]any) (any, error) {
+	id, err := requestUUID(args["id"].(string))
+	if err != nil {
+		return nil, err
+	}
+	in := args["patch"].(map[string]any)
+	var patch pebblePatch
+	if v, ok := in["name"].(string); ok {
+		patch.Name = &v
+	}
+	if v, ok := in["color"].(string); ok {
+		patch.Color = &v
+	}
+	if v, ok := in["weightGrams"].(int); ok {
+		patch.WeightGrams = &v
+	}
+	p, err := api.svc.Update(ctx, id, patch, gqlStringArg(args, "ifMatch"))
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	return p, nil
+}
+
+func (api *graphqlAPI) deletePebble(ctx context.Context, _ any, args map[string]any) (any, error) {
+	id, err := requestUUID(args["id"].(string))
+	if err != nil {
+		return nil, err
+	}
+	if err := api.svc.Delete(ctx, id, gqlStringArg(args, "ifMatch")); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func (api *graphqlAPI) restorePebble(ctx context.Context, _ any, args map[string]any) (any, error) {
+	id, err := requestUUID(args["id"].(string))
+	if err != nil {
+		return nil, err
+	}
+	p, err := api.svc.Restore(ctx, id, gqlStringArg(args, "ifMatch"))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// pebbleAttachments queues the pebble on the attachments loader, so that
+// the attachments of every pebble of a list are listed at once.
+func (api *graphqlAPI) pebbleAttachments(ctx context.Context, source any, _ map[string]any) (any, error) {
+	load := ctx.Value(graphqlLoadersKey{}).(*graphqlLoaders).attachments.Load(ctx, source.(Pebble).ID)
+	return gqlThunk(func() (any, error) {
+		list, err := load()
+		if err != nil {
+			return nil, Internal(err)
+		}
+		items := make([]attachmentResponse, len(list))
+		for i, a := range list {
+			items[i] = api.attachments.response(ctx, a)
+		}
+		return items, nil
+	}), nil
+}
+
+func (api *graphqlAPI) loadAttachments(ctx context.Context, pebbleIDs []string) (map[string][]Attachment, error) {
+	list, err := api.attachments.store.ListAttachments(ctx, pebbleIDs...)
+	if err != nil {
+		return nil, err
+	}
+	byPebble := make(map[string][]Attachment, len(pebbleIDs))
+	for _, a := range list {
+		byPebble[a.PebbleID] = append(byPebble[a.PebbleID], a)
+	}
+	return byPebble, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// nodeSchema is a schema whose nodes nest without end, to measure the
+// depth and complexity of queries with.
+func nodeSchema(t *testing.T) *gqlSchema {
+	t.Helper()
+	s, err := newGQLSchema(`
+type Query { node: Node }
+type Node { id: Int  children(first: Int): [Node] }
+`, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type node struct{}
+	s.Resolve("Query", "node", func(ctx context.Context, source any, args map[string]any) (any, error) { return node{}, nil })
+	s.Resolve("Node", "id", func(ctx context.Context, source any, args map[string]any) (any, error) { return 1, nil })
+	s.Resolve("Node", "children", func(ctx context.Context, source any, args map[string]any) (any, error) {
+		return make([]node, gqlIntArg(args, "first", 1)), nil
+	})
+	if err := s.check(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestGQLLimits(t *testing.T) {
+	s := nodeSchema(t)
+	lim := gqlLimits{MaxDepth: 3, MaxComplexity: 20}
+	tests := []struct {
+		name  string
+		query string
+		want  string // the error, or "" to execute
+	}{
+		{name: "shallow", query: "{ node { id } }"},
+		{name: "at the depth limit", query: "{ node { children { id } } }"},
+		{name: "too deep", query: "{ node { children { children { id } } } }", want: "the query is 4 levels deep, more than the limit of 3"},
+		{name: "too deep through a fragment", query: "{ node { ...Deep } } fragment Deep on Node { children { children { id } } }", want: "the query is 4 levels deep, more than the limit of 3"},
+		{name: "too deep through an inline fragment", query: "{ node { ... on Node { children { children { id } } } } }", want: "the query is 4 levels deep, more than the limit of 3"},
+		// node and children cost 1 each, and id 1 for each of the
+		// children first asks for.
+		{name: "at the complexity limit", query: "{ node { children(first: 18) { id } } }"},
+		{name: "too complex", query: "{ node { children(first: 19) { id } } }", want: "the query has a complexity of 21, more than the limit of 20"},
+		{name: "too complex by aliases", query: "{ a: node { id } b: node { id } c: node { id } d: node { id } e: node { id } f: node { id } g: node { id } h: node { id } i: node { id } j: node { id } k: node { id } }", want: "the query has a complexity of 22, more than the limit of 20"},
+		{name: "too complex through a variable", query: "query($n: Int = 50) { node { children(first: $n) { id } } }", want: "the query has a complexity of 52, more than the limit of 20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, status := s.execute(context.Background(), gqlRequest{Query: tt.query}, lim)
+			if tt.want == "" {
+				if status != http.StatusOK || resp.Errors != nil {
+					t.Fatalf("got status %d and errors %v, want the query executed", status, resp.Errors)
+				}
+				return
+			}
+			if status != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Message != tt.want {
+				t.Fatalf("got status %d and errors %+v, want 400 saying %q", status, resp.Errors, tt.want)
+			}
+			if resp.Data != nil {
+				t.Errorf("got data %s for a query over the limits", resp.Data)
+			}
+		})
+	}
+}
+
+func TestGQLFragmentErrors(t *testing.T) {
+	s := nodeSchema(t)
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "spreading itself", query: "{ node { ...A } } fragment A on Node { id ...A }", want: `fragment "A" spreads itself`},
+		{name: "a cycle of two", query: "{ node { ...A } } fragment A on Node { children { ...B } } fragment B on Node { children { ...A } }", want: `fragment "A" spreads itself`},
+		{name: "unknown", query: "{ node { ...Missing } }", want: `unknown fragment "Missing"`},
+		{name: "on another type", query: "{ ...A } fragment A on Node { id }", want: `fragment "A" on Node cannot be spread on Query`},
+		{name: "inline on another type", query: "{ ... on Node { id } }", want: "a fragment on Node cannot be spread on Query"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No limits, so that a cycle would run until the stack ran out.
+			resp, status := s.execute(context.Background(), gqlRequest{Query: tt.query}, gqlLimits{})
+			if status != http.StatusBadRequest || len(resp.Errors) == 0 || resp.Errors[0].Message != tt.want {
+				t.Fatalf("got status %d and errors %+v, want 400 saying %q", status, resp.Errors, tt.want)
+			}
+		})
+	}
+	// A fragment spread twice side by side is not a cycle.
+	resp, status := s.execute(context.Background(), gqlRequest{Query: "{ node { ...A children { ...A } } } fragment A on Node { id }"}, gqlLimits{})
+	if status != http.StatusOK || resp.Errors != nil {
+		t.Errorf("got status %d and errors %+v for a fragment spread twice, want 200", status, resp.Errors)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcCode is a gRPC status code.
+type grpcCode int
+
+const (
+	grpcOK                 grpcCode = 0
+	grpcCanceled           grpcCode = 1
+	grpcInvalidArgument    grpcCode = 3
+	grpcDeadlineExceeded   grpcCode = 4
+	grpcNotFound           grpcCode = 5
+	grpcAlreadyExists      grpcCode = 6
+	grpcPermissionDenied   grpcCode = 7
+	grpcResourceExhausted  grpcCode = 8
+	grpcFailedPrecondition grpcCode = 9
+	grpcUnimplemented      grpcCode = 12
+	grpcInternal           grpcCode = 13
+	grpcUnavailable        grpcCode = 14
+	grpcUnauthenticated    grpcCode = 16
+)
+
+// grpcCodes maps the codes of APIError to gRPC status codes. Codes that
+// are not listed become Internal.
+var grpcCodes = map[string]grpcCode{
+	CodeInvalid:              grpcInvalidArgument,
+	CodeValidation:           grpcInvalidArgument,
+	CodeNotFound:             grpcNotFound,
+	CodeConflict:             grpcAlreadyExists,
+	CodeUnauthorized:         grpcUnauthenticated,
+	CodeForbidden:            grpcPermissionDenied,
+	CodePreconditionFailed:   grpcFailedPrecondition,
+	CodePreconditionRequired: grpcFailedPrecondition,
+	CodeRateLimited:          grpcResourceExhausted,
+	CodeTimeout:              grpcDeadlineExceeded,
+	CodeTenantRequired:       grpcInvalidArgument,
+	CodeUnavailable:          grpcUnavailable,
+	CodeOverloaded:           grpcUnavailable,
+}
+
+// grpcStatus is the status sent in the grpc-status and grpc-message
+// trailers.
+type grpcStatus struct {
+	Code    grpcCode
+	Message string
+}
+
+// statusFromError converts an error returned by a method to the status
+// sent to the client. Like WriteError, it logs internal errors and never
+// reveals their cause.
+func statusFromError(ctx context.Context, method string, err error) grpcStatus {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcStatus{grpcDeadlineExceeded, "deadline exceeded"}
+	case errors.Is(err, context.Canceled):
+		return grpcStatus{grpcCanceled, "request canceled"}
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err)
+	}
+	code, ok := grpcCodes[apiErr.Code]
+	if !ok {
+		code = grpcInternal
+	}
+	if code == grpcInternal && apiErr.Err != nil {
+		slog.ErrorContext(ctx, "rpc failed", "method", method, "error", apiErr.Err)
+	}
+	msg := apiErr.Message
+	if fields, ok := apiErr.Details.(ValidationErrors); ok {
+		msg += ": " + fields.Error()
+	}
+	return grpcStatus{code, msg}
+}
+
+// grpcMethod implements a unary RPC. It gets the encoded request message
+// and returns the encoded response.
+type grpcMethod func(ctx context.Context, req []byte) ([]byte, error)
+
+// GRPCServer serves unary gRPC methods over HTTP/2 using net/http. Callers
+// are authenticated with the same Authenticator as the REST API, and the
+// methods need the permissions listed for "POST <method path>" in perms.
+type GRPCServer struct {
+	methods map[string]grpcMethod
+	auth    Authenticator
+	perms   map[string]Permission
+	tenancy *Tenancy
+	logger  *slog.Logger
+}
+
+// NewGRPCServer returns a server without methods. A nil auth serves every
+// method without checking credentials.
+func NewGRPCServer(auth Authenticator, perms map[string]Permission, logger *slog.Logger) *GRPCServer {
+	return &GRPCServer{
+		methods: make(map[string]grpcMethod),
+		auth:    auth,
+		perms:   perms,
+		logger:  logger,
+	}
+}
+
+// Handle registers m for the method with the given full name, such as
+// /pebbles.v1.PebbleService/GetPebble.
+func (s *GRPCServer) Handle(name string, m grpcMethod) {
+	s.methods[name] = m
+}
+
+// UseTenancy scopes the calls of tenant-scoped methods to the tenant t
+// resolves for them, as Tenancy.Middleware does for HTTP routes.
+func (s *GRPCServer) UseTenancy(t *Tenancy) {
+	s.tenancy = t
+}
+
+// withGRPC passes the HTTP/2 requests for gRPC methods to grpc and all
+// others to h, so that both can share a listener.
+func withGRPC(h, grpc http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpc.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *GRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "gRPC requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ct := r.Header.Get("Content-Type")
+	if ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	resp, st := s.call(r)
+	span := SpanFromContext(r.Context())
+	span.SetAttr("rpc.system", "grpc")
+	span.SetAttr("rpc.grpc.status_code", int(st.Code))
+	if st.Code == grpcInternal {
+		span.SetError(st.Message)
+	}
+	if st.Code == grpcOK {
+		w.WriteHeader(http.StatusOK)
+		if err := writeGRPCMessage(w, resp); err != nil {
+			return
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(st.Code)))
+	if st.Message != "" {
+		w.Header().Set("Grpc-Message", encodeGRPCMessage(st.Message))
+	}
+}
+
+// call runs the method r asks for and returns its response and status.
+// There is only a response if the status is OK.
+func (s *GRPCServer) call(r *http.Request) (resp []byte, st grpcStatus) {
+	name := r.URL.Path
+	m, ok := s.methods[name]
+	if !ok {
+		return nil, grpcStatus{grpcUnimplemented, "unknown method " + name}
+	}
+	ctx := r.Context()
+	if t := r.Header.Get("Grpc-Timeout"); t != "" {
+		d, err := parseGRPCTimeout(t)
+		if err != nil {
+			return nil, grpcStatus{grpcInvalidArgument, err.Error()}
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	claims, st, ok := s.authorize(r, name)
+	if !ok {
+		return nil, st
+	}
+	if claims != nil {
+		ctx = contextWithClaims(ctx, claims)
+	}
+	if s.tenancy != nil && tenantScoped(s.perms[http.MethodPost+" "+name]) {
+		tenant, err := s.tenancy.Resolve(r, claims)
+		if err != nil {
+			return nil, statusFromError(ctx, name, err)
+		}
+		ctx = contextWithTenant(ctx, tenant)
+	}
+
+	req, err := readGRPCMessage(r.Body, maxBodyBytes)
+	if err != nil {
+		return nil, grpcStatus{grpcInvalidArgument, err.Error()}
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			s.logger.ErrorContext(ctx, "panic serving rpc", "method", name, "panic", v, "stack", string(debug.Stack()))
+			resp, st = nil, grpcStatus{grpcInternal, "internal error"}
+		}
+	}()
+	resp, err = m(ctx, req)
+	if err != nil {
+		return nil, statusFromError(ctx, name, err)
+	}
+	return resp, grpcStatus{Code: grpcOK}
+}
+
+// authorize authenticates the caller and checks they may call the
+// method, as Authenticate and Authorize do for HTTP routes. It returns the
+// caller's claims, or false and the status to fail the call with.
+func (s *GRPCServer) authorize(r *http.Request, name string) (*Claims, grpcStatus, bool) {
+	if s.auth == nil {
+		return nil, grpcStatus{}, true
+	}
+	claims, err := s.auth.Authenticate(r)
+	if err != nil {
+		e := authFailure(err)
+		if e.Err != nil {
+			slog.ErrorContext(r.Context(), "cannot authenticate rpc", "method", name, "error", e.Err)
+		}
+		return nil, statusFromError(r.Context(), name, e), false
+	}
+	perm, ok := s.perms[http.MethodPost+" "+name]
+	if !ok {
+		return claims, grpcStatus{}, true
+	}
+	if claims == nil {
+		return nil, grpcStatus{grpcUnauthenticated, "authentication required"}, false
+	}
+	if !hasPermission(claims, perm) {
+		return nil, grpcStatus{grpcPermissionDenied, fmt.Sprintf("missing permission %q", perm)}, false
+	}
+	return claims, grpcStatus{}, true
+}
+
+// grpcSpanName names the span of a call after its method, such as
+// pebbles.v1.PebbleService/GetPebble.
+func grpcSpanName(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/")
+}
+
+// readGRPCMessage reads the single length-prefixed message of a unary
+// request. Compressed messages are not supported.
+func readGRPCMessage(r io.Reader, limit int) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, errors.New("request message is missing")
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > uint32(limit) {
+		return nil, fmt.Errorf("request message is larger than %d bytes", limit)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, errors.New("request message is truncated")
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// parseGRPCTimeout parses a grpc-timeout header value: up to eight digits
+// followed by a unit, H, M, S, m, u or n.
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// encodeGRPCMessage percent-encodes the bytes of msg that may not appear
+// in the grpc-message trailer.
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
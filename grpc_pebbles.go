@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// pebbleServiceName is the full name of the service defined in
+// proto/pebbles/v1/pebbles.proto.
+const pebbleServiceName = "pebbles.v1.PebbleService"
+
+// pebblesGRPC serves the PebbleService gRPC methods. The messages are
+// encoded and decoded by hand following pebbles.proto.
+type pebblesGRPC struct {
+	svc *PebbleService
+}
+
+func (g *pebblesGRPC) register(s *GRPCServer) {
+	s.Handle("/"+pebbleServiceName+"/ListPebbles", g.list)
+	s.Handle("/"+pebbleServiceName+"/GetPebble", g.get)
+	s.Handle("/"+pebbleServiceName+"/CreatePebble", g.create)
+	s.Handle("/"+pebbleServiceName+"/ReplacePebble", g.replace)
+	s.Handle("/"+pebbleServiceName+"/UpdatePebble", g.update)
+	s.Handle("/"+pebbleServiceName+"/DeletePebble", g.delete)
+}
+
+// listRequestFields maps the fields of ListPebblesRequest to the query
+// parameters of GET /pebbles, so both are parsed by parseListValues.
+var listRequestFields = map[int]string{
+	1: "limit",
+	2: "cursor",
+	3: "sort",
+	4: "name",
+	5: "color",
+	6: "weight_grams",
+}
+
+func (g *pebblesGRPC) list(ctx context.Context, req []byte) ([]byte, error) {
+	values := url.Values{}
+	err := decodeProto(req, func(f protoField) error {
+		name, ok := listRequestFields[f.Num]
+		if !ok {
+			return nil
+		}
+		if name == "limit" || name == "weight_grams" {
+			n, err := f.int32()
+			values.Set(name, strconv.Itoa(int(n)))
+			return err
+		}
+		v, err := f.string()
+		values.Set(name, v)
+		return err
+	})
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	// Unset proto3 fields arrive as zero values, which mean the default.
+	for _, name := range []string{"limit", "cursor", "sort"} {
+		if v := values.Get(name); v == "" || v == "0" {
+			values.Del(name)
+		}
+	}
+	q, err := parseListValues(values, pebbleListParams)
+	if err != nil {
+		return nil, err
+	}
+	page, err := g.svc.List(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var e protoEncoder
+	for _, p := range page.Items {
+		e.message(1, encodePebble(p))
+	}
+	e.string(2, page.NextCursor)
+	return e.b, nil
+}
+
+func (g *pebblesGRPC) get(ctx context.Context, req []byte) ([]byte, error) {
+	var id string
+	err := decodeProto(req, func(f protoField) error {
+		var err error
+		if f.Num == 1 {
+			id, err = f.string()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if id, err = requestUUID(id); err != nil {
+		return nil, err
+	}
+	p, err := g.svc.Get(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	return encodePebble(p), nil
+}
+
+func (g *pebblesGRPC) create(ctx context.Context, req []byte) ([]byte, error) {
+	var in pebbleInput
+	err := decodeProto(req, func(f protoField) error {
+		return decodeInput(f, 1, &in)
+	})
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	p, err := g.svc.Create(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return encodePebble(p), nil
+}
+
+func (g *pebblesGRPC) replace(ctx context.Context, req []byte) ([]byte, error) {
+	var id, etag string
+	var in pebbleInput
+	err := decodeProto(req, func(f protoField) error {
+		var err error
+		switch f.Num {
+		case 1:
+			id, err = f.string()
+		case 2:
+			etag, err = f.string()
+		default:
+			err = decodeInput(f, 3, &in)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if id, err = requestUUID(id); err != nil {
+		return nil, err
+	}
+	p, err := g.svc.Replace(ctx, id, in, etag)
+	if err != nil {
+		return nil, err
+	}
+	return encodePebble(p), nil
+}
+
+func (g *pebblesGRPC) update(ctx context.Context, req []byte) ([]byte, error) {
+	var id, etag string
+	var in pebblePatch
+	err := decodeProto(req, func(f protoField) error {
+		var err error
+		switch f.Num {
+		case 1:
+			id, err = f.string()
+		case 2:
+			etag, err = f.string()
+		case 3:
+			var v string
+			v, err = f.string()
+			in.Name = &v
+		case 4:
+			var v string
+			v, err = f.string()
+			in.Color = &v
+		case 5:
+			var v int32
+			v, err = f.int32()
+			n := int(v)
+			in.WeightGrams = &n
+		}
+		return err
+	})
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if id, err = requestUUID(id); err != nil {
+		return nil, err
+	}
+	p, err := g.svc.Update(ctx, id, in, etag)
+	if err != nil {
+		return nil, err
+	}
+	return encodePebble(p), nil
+}
+
+func (g *pebblesGRPC) delete(ctx context.Context, req []byte) ([]byte, error) {
+	var id, etag string
+	err := decodeProto(req, func(f protoField) error {
+		var err error
+		switch f.Num {
+		case 1:
+			id, err = f.string()
+		case 2:
+			etag, err = f.string()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if id, err = requestUUID(id); err != nil {
+		return nil, err
+	}
+	if err := g.svc.Delete(ctx, id, etag); err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// decodeInput decodes the name, color and weight_grams fields shared by
+// the create and replace requests, which start at field number first.
+func decodeInput(f protoField, first int, in *pebbleInput) error {
+	var err error
+	switch f.Num {
+	case first:
+		in.Name, err = f.string()
+	case first + 1:
+		in.Color, err = f.string()
+	case first + 2:
+		var n int32
+		n, err = f.int32()
+		in.WeightGrams = int(n)
+	}
+	return err
+}
+
+// encodePebble encodes p as a Pebble message, including its ETag.
+func encodePebble(p Pebble) []byte {
+	var e protoEncoder
+	e.string(1, p.ID)
+	e.string(2, p.Name)
+	e.string(3, p.Color)
+	e.int32(4, int32(p.WeightGrams))
+	e.string(5, p.CreatedAt.Format(time.RFC3339Nano))
+	e.string(6, p.UpdatedAt.Format(time.RFC3339Nano))
+	e.string(7, computeETag(p))
+	return e.b
+}
+
+func invalidMessage(err error) error {
+	return Invalid(nil, "invalid request message: %v", err)
+}
+
+// requestUUID is PathUUID for the id field of a request message.
+func requestUUID(id string) (string, error) {
+	id, err := parseUUID(id)
+	if err != nil {
+		return "", Invalid(nil, "field \"id\" must be a UUID")
+	}
+	return id, nil
+}
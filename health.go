@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Checker reports whether a dependency the server relies on is usable.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to the Checker interface.
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Health serves the liveness and readiness endpoints. Readiness runs the
+// registered checks and fails once the server starts shutting down.
+type Health struct {
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks map[string]Checker
+
+	shuttingDown atomic.Bool
+}
+
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{timeout: timeout, checks: make(map[string]Checker)}
+}
+
+// Register adds a readiness check under name, replacing any existing check
+// with the same name.
+func (h *Health) Register(name string, c Checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = c
+}
+
+// SetShuttingDown makes readiness fail so that load balancers stop sending
+// new traffic.
+func (h *Health) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// LiveHandler reports that the process is running. It does not run the
+// dependency checks so a failing dependency does not get the process
+// restarted.
+func (h *Health) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, http.StatusOK, healthResponse{Status: "ok"})
+	})
+}
+
+func (h *Health) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.shuttingDown.Load() {
+			respond(w, r, http.StatusServiceUnavailable, healthResponse{Status: "shutting down"})
+			return
+		}
+		results, ok := h.run(r.Context())
+		resp := healthResponse{Status: "ok", Checks: results}
+		status := http.StatusOK
+		if !ok {
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+		respond(w, r, status, resp)
+	})
+}
+
+// run executes all checks concurrently and reports each result along with
+// whether all of them passed.
+func (h *Health) run(ctx context.Context) (map[string]string, bool) {
+	h.mu.RLock()
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]Checker, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.Check(ctx)
+		}()
+	}
+	wg.Wait()
+
+	results := make(map[string]string, len(names))
+	ok := true
+	for i, name := range names {
+		if errs[i] != nil {
+			results[name] = errs[i].Error()
+			ok = false
+		} else {
+			results[name] = "ok"
+		}
+	}
+	return results, ok
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheStatusHeader tells clients whether a response came from the HTTP
+// cache.
+const cacheStatusHeader = "X-Cache"
+
+// HTTPCache caches GET responses that their handlers mark as cacheable by
+// a shared cache, with s-maxage or with public and max-age, in a Cache.
+// Responses are keyed by tenant, path, query and the request headers named
+// in their Vary header, and by the caller's subject for handlers that call
+// VaryByCaller, and are served with an Age header until they expire.
+// A successful unsafe request to a path drops every cached response for
+// the path and its parent, and so does a purge for the path alone.
+//
+// Entries are found through an index per path holding the Vary headers
+// and a generation that is part of every entry's key, so that a purge only
+// has to delete the index for all of the path's variants to become
+// unreachable.
+type HTTPCache struct {
+	cache   Cache
+	maxBody int
+	clock   Clock
+	metrics *CounterVec
+}
+
+type httpCacheIndex struct {
+	Gen    string   `json:"gen"`
+	Vary   []string `json:"vary"`
+	Caller bool     `json:"caller,omitempty"`
+}
+
+// httpCacheVary records what a response being cached depends on, besides
+// its Vary header.
+type httpCacheVary struct {
+	caller bool
+}
+
+type httpCacheVaryKey struct{}
+
+// VaryByCaller marks the response to the request of ctx as depending on
+// its caller, so that the HTTP cache keeps it for that caller alone.
+// Handlers whose responses change with the caller's permissions or flags
+// must call it before responding.
+func VaryByCaller(ctx context.Context) {
+	if v, ok := ctx.Value(httpCacheVaryKey{}).(*httpCacheVary); ok {
+		v.caller = true
+	}
+}
+
+type httpCacheEntry struct {
+	storedResponse
+	Stored time.Time
+}
+
+// NewHTTPCache returns an HTTP cache keeping responses of up to maxBody
+// bytes in c, whose ages are measured by clock. reg, if not nil, receives
+// its metrics.
+func NewHTTPCache(c Cache, maxBody int, clock Clock, reg *Registry) *HTTPCache {
+	hc := &HTTPCache{cache: c, maxBody: maxBody, clock: clock}
+	if reg != nil {
+		hc.metrics = reg.NewCounterVec("http_cache_requests_total",
+			"Number of GET and HEAD requests seen by the HTTP cache, by result.", "result")
+	}
+	return hc
+}
+
+func httpCacheIndexKey(path string) string {
+	return "httpcache:path:" + path
+}
+
+func (hc *HTTPCache) count(result string) {
+	if hc.metrics != nil {
+		hc.metrics.Inc(result)
+	}
+}
+
+// Purge drops the cached responses for path.
+func (hc *HTTPCache) Purge(ctx context.Context, path string) error {
+	return hc.cache.Delete(ctx, httpCacheIndexKey(path))
+}
+
+// Middleware serves cached responses and caches new ones. It must run
+// inside Authorize, so that only callers allowed to see a response are
+// served it from the cache.
+func (hc *HTTPCache) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				rw := newResponseRecorder(w)
+				next.ServeHTTP(rw, r)
+				if r.Method != http.MethodOptions && r.Method != http.MethodTrace && rw.status < 400 {
+					// The parent is purged too, since collections such as
+					// /pebbles list their items.
+					paths := []string{r.URL.Path}
+					if i := strings.LastIndex(r.URL.Path, "/"); i > 0 {
+						paths = append(paths, r.URL.Path[:i])
+					}
+					for _, p := range paths {
+						if err := hc.Purge(r.Context(), p); err != nil {
+							slog.ErrorContext(r.Context(), "cannot purge HTTP cache", "path", p, "error", err)
+						}
+					}
+				}
+				return
+			}
+			reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+			_, noCache := reqCC["no-cache"]
+			_, noStore := reqCC["no-store"]
+			idx := hc.index(r.Context(), r.URL.Path)
+			if idx != nil && !noCache && !noStore && hc.serve(w, r, idx) {
+				hc.count("hit")
+				return
+			}
+
+			w.Header().Set(cacheStatusHeader, "MISS")
+			before := w.Header().Clone()
+			rw := &bodyRecorder{responseRecorder: newResponseRecorder(w), body: capture{max: hc.maxBody}}
+			varies := &httpCacheVary{}
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), httpCacheVaryKey{}, varies)))
+			ttl := sharedMaxAge(rw.Header())
+			vary := addedValues(before.Values("Vary"), rw.Header().Values("Vary"))
+			if r.Method == http.MethodHead || noStore || rw.status != http.StatusOK || ttl <= 0 ||
+				rw.body.total > int64(rw.body.buf.Len()) || rw.Header().Get("Set-Cookie") != "" || slices.Contains(vary, "*") {
+				hc.count("uncacheable")
+				return
+			}
+			hc.count("miss")
+			if idx == nil || !slices.Equal(idx.Vary, vary) || idx.Caller != varies.caller {
+				idx = &httpCacheIndex{Gen: newUUID(), Vary: vary, Caller: varies.caller}
+			}
+			entry := httpCacheEntry{
+				storedResponse: storedResponse{Status: rw.status, Header: handlerHeaders(before, rw.Header()), Body: rw.body.buf.Bytes()},
+				Stored:         hc.clock.Now(),
+			}
+			if err := hc.store(r.Context(), r, idx, entry, ttl); err != nil {
+				slog.WarnContext(r.Context(), "cannot store response in HTTP cache", "path", r.URL.Path, "error", err)
+			}
+		})
+	}
+}
+
+// index returns the index for path, or nil if there is none.
+func (hc *HTTPCache) index(ctx context.Context, path string) *httpCacheIndex {
+	b, err := hc.cache.Get(ctx, httpCacheIndexKey(path))
+	if err != nil {
+		if !errors.Is(err, ErrCacheMiss) {
+			slog.WarnContext(ctx, "cannot read from HTTP cache", "path", path, "error", err)
+		}
+		return nil
+	}
+	var idx httpCacheIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil
+	}
+	return &idx
+}
+
+// entryKey returns the key of the entry for r. The tenant is part of it
+// whatever the Vary header says, since the tenant middleware adds its Vary
+// before the cache runs and the tenant may come from the caller's claims
+// rather than a header.
+func (hc *HTTPCache) entryKey(r *http.Request, idx *httpCacheIndex) string {
+	var b strings.Builder
+	b.WriteString("httpcache:" + idx.Gen + ":" + TenantFromContext(r.Context()) + "\x00" + r.URL.RawQuery)
+	if idx.Caller {
+		var subject string
+		if c := ClaimsFromContext(r.Context()); c != nil {
+			subject = c.Subject
+		}
+		b.WriteString("\x00" + subject)
+	}
+	for _, h := range idx.Vary {
+		b.WriteString("\x00" + strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// serve writes the cached response for r, reporting false if there is
+// none.
+func (hc *HTTPCache) serve(w http.ResponseWriter, r *http.Request, idx *httpCacheIndex) bool {
+	b, err := hc.cache.Get(r.Context(), hc.entryKey(r, idx))
+	if err != nil {
+		return false
+	}
+	var e httpCacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return false
+	}
+	h := w.Header()
+	for k, vs := range e.Header {
+		h[k] = vs
+	}
+	// handlerHeaders leaves Vary out, since outer middleware sets it too.
+	for _, v := range idx.Vary {
+		h.Add("Vary", v)
+	}
+	h.Set("Age", strconv.Itoa(int(hc.clock.Now().Sub(e.Stored).Seconds())))
+	h.Set(cacheStatusHeader, "HIT")
+	if etag := e.Header.Get("ETag"); etag != "" && notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+	return true
+}
+
+func (hc *HTTPCache) store(ctx context.Context, r *http.Request, idx *httpCacheIndex, e httpCacheEntry, ttl time.Duration) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := hc.cache.Set(ctx, hc.entryKey(r, idx), b, ttl); err != nil {
+		return err
+	}
+	b, err = json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return hc.cache.Set(ctx, httpCacheIndexKey(r.URL.Path), b, ttl)
+}
+
+// PurgeHandler serves the admin endpoint dropping the cached responses for
+// the path in ?path.
+func (hc *HTTPCache) PurgeHandler() APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		path := r.URL.Query().Get("path")
+		if !strings.HasPrefix(path, "/") {
+			return Invalid(ValidationErrors{{Field: "path", Message: "must be a path starting with /"}}, "invalid parameters")
+		}
+		if err := hc.Purge(r.Context(), path); err != nil {
+			return Internal(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// parseCacheControl returns the directives of a Cache-Control header, by
+// lower-cased name, with their unquoted arguments.
+func parseCacheControl(v string) map[string]string {
+	d := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			d[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return d
+}
+
+// sharedMaxAge returns how long a shared cache may keep a response with
+// header h: its s-maxage, or its max-age if it is public. It is zero for
+// responses marked no-store, no-cache or private.
+func sharedMaxAge(h http.Header) time.Duration {
+	d := parseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := d[name]; ok {
+			return 0
+		}
+	}
+	age, ok := d["s-maxage"]
+	if _, public := d["public"]; !ok && public {
+		age = d["max-age"]
+	}
+	n, err := strconv.Atoi(age)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// addedValues returns the comma-separated header values in after that are
+// not in before, canonicalized, in order.
+func addedValues(before, after []string) []string {
+	split := func(vs []string) []string {
+		var out []string
+		for _, v := range vs {
+			for _, f := range strings.Split(v, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					out = append(out, http.CanonicalHeaderKey(f))
+				}
+			}
+		}
+		return out
+	}
+	had := split(before)
+	added := []string{}
+	for _, v := range split(after) {
+		if !slices.Contains(had, v) && !slices.Contains(added, v) {
+			added = append(added, v)
+		}
+	}
+	return added
+}
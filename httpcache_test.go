@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// cachedRequest sends a GET for /pebbles/search through h as subject of
+// tenant, and returns the X-Cache header and the body of the response.
+func cachedRequest(t *testing.T, h http.Handler, tenant, subject string) (string, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/pebbles/search?q=flint", nil)
+	ctx := contextWithTenant(r.Context(), tenant)
+	ctx = contextWithClaims(ctx, &Claims{Subject: subject})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r.WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	return w.Header().Get(cacheStatusHeader), w.Body.String()
+}
+
+func TestHTTPCacheKeysByTenant(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	hc := NewHTTPCache(newMemoryCache(clock), 1<<20, clock, nil)
+	h := hc.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte(TenantFromContext(r.Context())))
+	}))
+
+	tests := []struct {
+		tenant, status string
+	}{
+		{"acme", "MISS"},
+		{"globex", "MISS"},
+		{"acme", "HIT"},
+		{"globex", "HIT"},
+	}
+	for _, tt := range tests {
+		status, body := cachedRequest(t, h, tt.tenant, "ada")
+		if body != tt.tenant {
+			t.Fatalf("tenant %s was served the response of %s", tt.tenant, body)
+		}
+		if status != tt.status {
+			t.Errorf("got %s for tenant %s, want %s", status, tt.tenant, tt.status)
+		}
+	}
+}
+
+func TestHTTPCacheKeysByCaller(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	hc := NewHTTPCache(newMemoryCache(clock), 1<<20, clock, nil)
+	h := hc.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		VaryByCaller(r.Context())
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte(ClaimsFromContext(r.Context()).Subject))
+	}))
+
+	for _, subject := range []string{"ada", "grace"} {
+		if status, body := cachedRequest(t, h, "acme", subject); status != "MISS" || body != subject {
+			t.Fatalf("got %s %q for %s, want a MISS with their own response", status, body, subject)
+		}
+	}
+	if status, body := cachedRequest(t, h, "acme", "ada"); status != "HIT" || body != "ada" {
+		t.Errorf("got %s %q for ada again, want a HIT with their response", status, body)
+	}
+	clock.Advance(time.Minute)
+	if status, _ := cachedRequest(t, h, "acme", "ada"); status != "MISS" {
+		t.Errorf("got %s once the response expired, want MISS", status)
+	}
+}
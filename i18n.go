@@ -0,0 +1,231 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// localeFiles holds the message catalogs, a JSON object per language
+// named by its tag, such as fr.json, mapping English messages to their
+// translations. {1}, {2} and so on stand for the parts of a message that
+// vary, such as a parameter name, and may be reordered in the translation.
+//
+//go:embed locales
+var localeFiles embed.FS
+
+// sourceLocale is the language the messages are written in, which needs
+// no catalog.
+const sourceLocale = "en"
+
+var messagePlaceholder = regexp.MustCompile(`\{(\d+)\}`)
+
+// catalog is the translations of the messages into one language.
+type catalog struct {
+	exact    map[string]string
+	patterns []messagePattern
+}
+
+// messagePattern matches the messages with placeholders. groups are the
+// placeholder numbers of the pattern's capture groups.
+type messagePattern struct {
+	re          *regexp.Regexp
+	groups      []string
+	literal     int
+	translation string
+}
+
+func parseCatalog(data []byte) (*catalog, error) {
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	c := &catalog{exact: map[string]string{}}
+	for msg, translation := range entries {
+		holes := messagePlaceholder.FindAllStringSubmatchIndex(msg, -1)
+		if holes == nil {
+			c.exact[msg] = translation
+			continue
+		}
+		p := messagePattern{translation: translation}
+		var expr strings.Builder
+		expr.WriteString("^")
+		last := 0
+		for _, h := range holes {
+			expr.WriteString(regexp.QuoteMeta(msg[last:h[0]]))
+			expr.WriteString("(.+?)")
+			p.literal += h[0] - last
+			p.groups = append(p.groups, msg[h[2]:h[3]])
+			last = h[1]
+		}
+		expr.WriteString(regexp.QuoteMeta(msg[last:]) + "$")
+		p.literal += len(msg) - last
+		p.re = regexp.MustCompile(expr.String())
+		c.patterns = append(c.patterns, p)
+	}
+	// The most specific pattern wins, as "must be at most {1} characters"
+	// over "must be at most {1}".
+	slices.SortFunc(c.patterns, func(a, b messagePattern) int {
+		return cmp.Or(cmp.Compare(b.literal, a.literal), cmp.Compare(a.re.String(), b.re.String()))
+	})
+	return c, nil
+}
+
+// translate returns the translation of msg, or msg if there is none.
+func (c *catalog) translate(msg string) string {
+	if t, ok := c.exact[msg]; ok {
+		return t
+	}
+	for _, p := range c.patterns {
+		m := p.re.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+		return messagePlaceholder.ReplaceAllStringFunc(p.translation, func(hole string) string {
+			if i := slices.Index(p.groups, hole[1:len(hole)-1]); i >= 0 {
+				return m[i+1]
+			}
+			return hole
+		})
+	}
+	return msg
+}
+
+// Translator translates the messages of error responses into the
+// languages of its catalogs, and leaves those of a request asking for
+// none of them in its fallback language.
+type Translator struct {
+	catalogs map[string]*catalog
+	fallback string
+}
+
+// NewTranslator returns a Translator with the embedded catalogs, falling
+// back to fallback, which must be sourceLocale or one of
+// availableLocales.
+func NewTranslator(fallback string) (*Translator, error) {
+	t := &Translator{catalogs: map[string]*catalog{}, fallback: strings.ToLower(fallback)}
+	files, _ := fs.Glob(localeFiles, "locales/*.json")
+	for _, name := range files {
+		data, err := localeFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		c, err := parseCatalog(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		t.catalogs[strings.TrimSuffix(strings.TrimPrefix(name, "locales/"), ".json")] = c
+	}
+	if _, ok := t.catalogs[t.fallback]; !ok && t.fallback != sourceLocale {
+		return nil, fmt.Errorf("no messages in %s", fallback)
+	}
+	return t, nil
+}
+
+// availableLocales returns the tags of the languages messages can be
+// given in.
+func availableLocales() []string {
+	tags := []string{sourceLocale}
+	files, _ := fs.Glob(localeFiles, "locales/*.json")
+	for _, name := range files {
+		tags = append(tags, strings.TrimSuffix(strings.TrimPrefix(name, "locales/"), ".json"))
+	}
+	return tags
+}
+
+// locale returns the language of the translator that best matches the
+// Accept-Language header accept: the first by weight whose tag, or the
+// language of the tag, has messages.
+func (t *Translator) locale(accept string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for part := range strings.SplitSeq(accept, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				q = n
+			}
+		}
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	slices.SortStableFunc(choices, func(a, b choice) int { return cmp.Compare(b.q, a.q) })
+	for _, c := range choices {
+		if c.tag == "*" {
+			break
+		}
+		base, _, _ := strings.Cut(c.tag, "-")
+		for _, tag := range []string{c.tag, base} {
+			if _, ok := t.catalogs[tag]; ok || tag == sourceLocale {
+				return tag
+			}
+		}
+	}
+	return t.fallback
+}
+
+// translate returns msg in the language locale.
+func (t *Translator) translate(locale, msg string) string {
+	if c, ok := t.catalogs[locale]; ok {
+		return c.translate(msg)
+	}
+	return msg
+}
+
+type localeKey struct{}
+
+// requestLocale is the language the messages of a request's errors are
+// given in.
+type requestLocale struct {
+	translator *Translator
+	tag        string
+}
+
+// Localize picks the language of the errors of each request from its
+// Accept-Language header, for WriteError to translate their messages into.
+func Localize(t *Translator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := &requestLocale{translator: t, tag: t.locale(r.Header.Get("Accept-Language"))}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localeKey{}, l)))
+		})
+	}
+}
+
+// localeFromContext returns the language of the request ctx belongs to,
+// or nil if messages are not translated.
+func localeFromContext(ctx context.Context) *requestLocale {
+	l, _ := ctx.Value(localeKey{}).(*requestLocale)
+	return l
+}
+
+// localize translates the message of e, and those of its validation
+// errors, into the language of the request ctx belongs to. The code is
+// left alone, so that clients can still rely on it.
+func localize(ctx context.Context, e *errorResponse) {
+	l := localeFromContext(ctx)
+	if l == nil {
+		return
+	}
+	e.Message = l.translator.translate(l.tag, e.Message)
+	if v, ok := e.Details.(ValidationErrors); ok {
+		translated := make(ValidationErrors, len(v))
+		for i, fe := range v {
+			translated[i] = FieldError{Field: fe.Field, Message: l.translator.translate(l.tag, fe.Message)}
+		}
+		e.Details = translated
+	}
+}
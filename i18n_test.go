@@ -0,0 +1,241 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// messageConstructors maps the functions that make an *APIError to the
+// position of their message argument, and whether it is a format.
+var messageConstructors = map[string]struct {
+	arg      int
+	isFormat bool
+}{
+	"NewAPIError":  {2, false},
+	"Unauthorized": {0, false},
+	"NotFound":     {0, true},
+	"Conflict":     {0, true},
+	"Forbidden":    {0, true},
+	"Invalid":      {1, true},
+}
+
+var formatVerb = regexp.MustCompile(`%[-+# 0]*\d*(?:\.\d+)?[a-zA-Z%]`)
+
+// sampleMessage returns the message format would give, with a sample
+// value for each of its verbs.
+func sampleMessage(format string) string {
+	return formatVerb.ReplaceAllStringFunc(format, func(verb string) string {
+		switch verb[len(verb)-1] {
+		case '%':
+			return "%"
+		case 'd':
+			return "7"
+		case 'q':
+			return `"x"`
+		}
+		return "x"
+	})
+}
+
+// sourceMessages returns the message formats passed to the error
+// constructors and set as the message of field errors in the package's
+// source, by position. Messages made at run time, such as from an error's
+// text, are left out.
+func sourceMessages(t *testing.T) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	var parsed []*ast.File
+	consts := map[string]string{}
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, f)
+		for _, decl := range f.Decls {
+			if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.CONST {
+				for _, spec := range gd.Specs {
+					vs := spec.(*ast.ValueSpec)
+					for i, v := range vs.Values {
+						if lit, ok := v.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+							consts[vs.Names[i].Name], _ = strconv.Unquote(lit.Value)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// format returns the format e makes a message with, if it is made
+	// from string literals and constants. Those of a format, isFormat, are
+	// formats themselves; other strings have their % escaped.
+	var format func(e ast.Expr, isFormat bool) (string, bool)
+	format = func(e ast.Expr, isFormat bool) (string, bool) {
+		var s string
+		switch e := e.(type) {
+		case *ast.BasicLit:
+			if e.Kind != token.STRING {
+				return "", false
+			}
+			var err error
+			if s, err = strconv.Unquote(e.Value); err != nil {
+				return "", false
+			}
+		case *ast.Ident:
+			var ok bool
+			if s, ok = consts[e.Name]; !ok {
+				return "", false
+			}
+		case *ast.BinaryExpr:
+			left, ok := format(e.X, isFormat)
+			if e.Op != token.ADD || !ok {
+				return "", false
+			}
+			if right, ok := format(e.Y, isFormat); ok {
+				return left + right, true
+			}
+			return left + "%s", true
+		case *ast.CallExpr:
+			if sel, ok := e.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Sprintf" && len(e.Args) > 0 {
+				return format(e.Args[0], true)
+			}
+			return "", false
+		default:
+			return "", false
+		}
+		if !isFormat {
+			s = strings.ReplaceAll(s, "%", "%%")
+		}
+		return s, true
+	}
+
+	msgs := map[string]string{}
+	add := func(e ast.Expr, isFormat bool) {
+		// A format of nothing but verbs, such as "%v" of an error, passes
+		// on a message made elsewhere.
+		if f, ok := format(e, isFormat); ok && strings.TrimSpace(formatVerb.ReplaceAllString(f, "")) != "" {
+			msgs[fset.Position(e.Pos()).String()] = sampleMessage(f)
+		}
+	}
+	// fieldErrors adds the messages of the field errors lit lists, or is,
+	// whose type may be left out inside a list.
+	var fieldErrors func(lit *ast.CompositeLit)
+	fieldErrors = func(lit *ast.CompositeLit) {
+		for _, elt := range lit.Elts {
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				if key, ok := kv.Key.(*ast.Ident); ok && key.Name == "Message" {
+					add(kv.Value, false)
+				}
+			} else if inner, ok := elt.(*ast.CompositeLit); ok && inner.Type == nil {
+				fieldErrors(inner)
+			}
+		}
+	}
+	for _, f := range parsed {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				if fn, ok := n.Fun.(*ast.Ident); ok {
+					if c, ok := messageConstructors[fn.Name]; ok && c.arg < len(n.Args) {
+						add(n.Args[c.arg], c.isFormat)
+					}
+				}
+			case *ast.CompositeLit:
+				switch typ := n.Type.(type) {
+				case *ast.Ident:
+					switch typ.Name {
+					case "FieldError":
+						fieldErrors(n)
+					case "ValidationErrors", "bodyFieldErrors":
+						for _, elt := range n.Elts {
+							if inner, ok := elt.(*ast.CompositeLit); ok {
+								fieldErrors(inner)
+							}
+						}
+					}
+				case *ast.ArrayType:
+					if elt, ok := typ.Elt.(*ast.Ident); ok && elt.Name == "FieldError" {
+						for _, elt := range n.Elts {
+							if inner, ok := elt.(*ast.CompositeLit); ok {
+								fieldErrors(inner)
+							}
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+	return msgs
+}
+
+// covers reports whether c has a translation for msg.
+func (c *catalog) covers(msg string) bool {
+	if _, ok := c.exact[msg]; ok {
+		return true
+	}
+	return slices.ContainsFunc(c.patterns, func(p messagePattern) bool { return p.re.MatchString(msg) })
+}
+
+func TestCatalogsCoverMessages(t *testing.T) {
+	msgs := sourceMessages(t)
+	if len(msgs) < 100 {
+		t.Fatalf("found only %d messages in the source", len(msgs))
+	}
+	// Messages that reach responses other than through a literal.
+	type rules struct {
+		Name  string   `json:"name" validate:"required,max=3"`
+		Email string   `json:"email" validate:"email"`
+		ID    string   `json:"id" validate:"uuid"`
+		Color string   `json:"color" validate:"oneof=red grey"`
+		Tags  []string `json:"tags" validate:"min=1"`
+		Limit int      `json:"limit" validate:"min=2,max=5"`
+	}
+	for _, v := range []rules{{Name: "Pebble", Email: "no", ID: "no", Color: "blue", Limit: 1}, {Limit: 9}} {
+		for _, fe := range Validate(v) {
+			msgs["Validate "+fe.Field] = fe.Message
+		}
+	}
+	msgs["errBadCursor"] = errBadCursor.Error()
+
+	t.Logf("checking %d messages", len(msgs))
+	for _, locale := range availableLocales() {
+		if locale == sourceLocale {
+			continue
+		}
+		t.Run(locale, func(t *testing.T) {
+			data, err := localeFiles.ReadFile("locales/" + locale + ".json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := parseCatalog(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var missing []string
+			for pos, msg := range msgs {
+				if !c.covers(msg) {
+					missing = append(missing, pos+": "+msg)
+				}
+			}
+			slices.Sort(missing)
+			for _, m := range missing {
+				t.Errorf("no translation of %s", m)
+			}
+		})
+	}
+}
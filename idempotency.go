@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// replayedHeader marks a response that was replayed from an earlier
+	// request with the same key.
+	replayedHeader = "Idempotent-Replayed"
+
+	CodeIdempotencyMismatch   = "idempotency_key_reused"
+	CodeIdempotencyInProgress = "idempotency_key_in_use"
+)
+
+// storedResponse is a response kept for replaying.
+type storedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// idempotencyRecord is what an IdempotencyStore holds for a key. Response
+// is nil while the first request is still being handled.
+type idempotencyRecord struct {
+	BodyHash [sha256.Size]byte
+	Response *storedResponse
+}
+
+// IdempotencyStore keeps the responses to requests made with an
+// Idempotency-Key. Reserve claims key for a new request with the given
+// body hash, or returns the existing record if the key is taken. Complete
+// stores the response of a reserved key and Release frees it again, so that
+// the request can be retried. Implementations shared between server
+// instances can be swapped in for the in-memory store.
+type IdempotencyStore interface {
+	Reserve(ctx context.Context, key string, bodyHash [sha256.Size]byte) (existing *idempotencyRecord, err error)
+	Complete(ctx context.Context, key string, resp *storedResponse) error
+	Release(ctx context.Context, key string) error
+}
+
+// memoryIdempotencyStore is an IdempotencyStore in memory. Records are
+// forgotten ttl after they were reserved.
+type memoryIdempotencyStore struct {
+	ttl   time.Duration
+	clock Clock
+
+	mu      sync.Mutex
+	records map[string]*memoryIdempotencyRecord
+}
+
+type memoryIdempotencyRecord struct {
+	idempotencyRecord
+	expires time.Time
+}
+
+func newMemoryIdempotencyStore(ttl time.Duration, clock Clock) *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{ttl: ttl, clock: clock, records: make(map[string]*memoryIdempotencyRecord)}
+}
+
+func (s *memoryIdempotencyStore) Reserve(ctx context.Context, key string, bodyHash [sha256.Size]byte) (*idempotencyRecord, error) {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[key]; ok && now.Before(rec.expires) {
+		r := rec.idempotencyRecord
+		return &r, nil
+	}
+	s.records[key] = &memoryIdempotencyRecord{
+		idempotencyRecord: idempotencyRecord{BodyHash: bodyHash},
+		expires:           now.Add(s.ttl),
+	}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, key string, resp *storedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[key]; ok {
+		rec.Response = resp
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// run removes expired records until ctx is done.
+func (s *memoryIdempotencyStore) run(ctx context.Context) {
+	every(ctx, s.clock, min(s.ttl, time.Minute), func(now time.Time) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for key, rec := range s.records {
+			if !now.Before(rec.expires) {
+				delete(s.records, key)
+			}
+		}
+	})
+}
+
+// Idempotency makes POST requests that carry an Idempotency-Key header
+// safe to retry. The first response for a key is stored and replayed for
+// later requests with the same key, route and body, marked with an
+// Idempotent-Replayed header. Reusing a key with a different body, or
+// while the first request is still running, is answered with 409.
+//
+// Keys are scoped to the authenticated caller and their tenant, so
+// Idempotency must run inside the authentication and tenancy middleware. Server errors are not stored, so
+// that the client can retry them.
+func Idempotency(store IdempotencyStore, routes routeMatcher) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyHeader)
+			if r.Method != http.MethodPost || key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > 255 {
+				WriteError(w, r, Invalid(nil, "%s must be at most 255 characters", idempotencyHeader))
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				WriteError(w, r, bodyError(err))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			_, route := routes.Handler(r)
+			scope := ""
+			if c := ClaimsFromContext(r.Context()); c != nil {
+				scope = c.Subject
+			}
+			storeKey := scope + "\x00" + TenantFromContext(r.Context()) + "\x00" + route + "\x00" + key
+			hash := sha256.Sum256(body)
+			existing, err := store.Reserve(r.Context(), storeKey, hash)
+			if err != nil {
+				WriteError(w, r, Internal(err))
+				return
+			}
+			if existing != nil {
+				switch {
+				case existing.BodyHash != hash:
+					WriteError(w, r, NewAPIError(http.StatusConflict, CodeIdempotencyMismatch,
+						idempotencyHeader+" was already used for a request with a different body"))
+				case existing.Response == nil:
+					WriteError(w, r, NewAPIError(http.StatusConflict, CodeIdempotencyInProgress,
+						"a request with this "+idempotencyHeader+" is still being processed"))
+				default:
+					replay(w, existing.Response)
+				}
+				return
+			}
+
+			before := w.Header().Clone()
+			rw := &bodyRecorder{responseRecorder: newResponseRecorder(w), body: capture{max: maxBodyBytes}}
+			next.ServeHTTP(rw, r)
+			if rw.status >= 500 || rw.body.total > int64(rw.body.buf.Len()) {
+				err = store.Release(r.Context(), storeKey)
+			} else {
+				err = store.Complete(r.Context(), storeKey, &storedResponse{
+					Status: rw.status,
+					Header: handlerHeaders(before, rw.Header()),
+					Body:   rw.body.buf.Bytes(),
+				})
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "cannot store idempotent response", "error", err)
+			}
+		})
+	}
+}
+
+// handlerHeaders returns the headers in after that were not already in
+// before, which are the ones set by the handler rather than by outer
+// middleware such as RequestID. The content coding headers are left out
+// because Compress sets them again for the replay.
+func handlerHeaders(before, after http.Header) http.Header {
+	h := make(http.Header)
+	for k, vs := range after {
+		switch k {
+		case "Content-Encoding", "Content-Length", "Vary":
+			continue
+		}
+		if !slices.Equal(before[k], vs) {
+			h[k] = slices.Clone(vs)
+		}
+	}
+	return h
+}
+
+func replay(w http.ResponseWriter, resp *storedResponse) {
+	h := w.Header()
+	for k, vs := range resp.Header {
+		h[k] = vs
+	}
+	h.Set(replayedHeader, "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
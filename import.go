@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// importBatchSize is the number of pebbles POST /pebbles/import creates
+	// in each transaction.
+	importBatchSize = 100
+	// importMaxBytes is the limit of import bodies unless request_body.routes
+	// sets another.
+	importMaxBytes = 100 << 20
+	// importMaxErrors is the most row errors an import lists; it counts
+	// the others.
+	importMaxErrors = 100
+	// importMaxLine is the longest line of an NDJSON import.
+	importMaxLine = 64 << 10
+)
+
+// importFormats are the formats of import bodies, by media type.
+var importFormats = map[string]string{
+	"application/x-ndjson": "ndjson",
+	"application/jsonl":    "ndjson",
+	"text/csv":             "csv",
+}
+
+// importRow is a line of an NDJSON import: the fields of a new pebble,
+// and the other fields of an export, which are ignored so that an export
+// can be imported into another server.
+type importRow struct {
+	pebbleInput
+	ID        json.RawMessage `json:"id"`
+	CreatedAt json.RawMessage `json:"created_at"`
+	UpdatedAt json.RawMessage `json:"updated_at"`
+	DeletedAt json.RawMessage `json:"deleted_at"`
+	Tenant    json.RawMessage `json:"tenant"`
+}
+
+// importError is the error of one row of an import, found at line of the
+// body.
+type importError struct {
+	Line  int            `json:"line"`
+	Error *errorResponse `json:"error"`
+}
+
+// importResponse is the body of POST /pebbles/import. Errors lists the
+// first importMaxErrors of the Failed rows. Error is set if the import
+// stopped before the end of the body, whose rows up to there were still
+// imported.
+type importResponse struct {
+	Rows     int            `json:"rows"`
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	Errors   []importError  `json:"errors"`
+	Error    *errorResponse `json:"error,omitempty"`
+}
+
+func (resp *importResponse) fail(ctx context.Context, line int, err error) {
+	resp.Failed++
+	if len(resp.Errors) < importMaxErrors {
+		resp.Errors = append(resp.Errors, importError{Line: line, Error: batchError(ctx, err).Error})
+	}
+}
+
+// importRows reads the rows of an import body. It returns the line of the
+// next row and its fields, or an error of that row alone in rowErr, and
+// io.EOF at the end of the body. Any other error ends the import.
+type importRows func() (line int, in pebbleInput, rowErr, err error)
+
+// ndjsonRows returns the rows of an NDJSON body, one JSON object a line.
+// Blank lines are skipped.
+func ndjsonRows(body io.Reader) importRows {
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 0, 4<<10), importMaxLine)
+	// The scanner returns what it has of the last line when reading the
+	// body fails, which is only a line if the body ended.
+	var unterminated []byte
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance > 0 && data[advance-1] != '\n' {
+			unterminated = token
+			return advance, nil, err
+		}
+		return advance, token, err
+	})
+	line := 0
+	return func() (int, pebbleInput, error, error) {
+		for sc.Scan() || unterminated != nil && sc.Err() == nil {
+			line++
+			b := sc.Bytes()
+			if unterminated != nil {
+				b, unterminated = unterminated, nil
+			}
+			b = bytes.TrimSpace(b)
+			if len(b) == 0 {
+				continue
+			}
+			var row importRow
+			if err := decodeJSONAt(bytes.NewReader(b), &row, strictDecoding, ""); err != nil {
+				return line, pebbleInput{}, rowError(err), nil
+			}
+			return line, row.pebbleInput, nil, nil
+		}
+		if err := sc.Err(); errors.Is(err, bufio.ErrTooLong) {
+			return line + 1, pebbleInput{}, nil, Invalid(nil, "line %d is longer than %d bytes", line+1, importMaxLine)
+		} else if err != nil {
+			return line, pebbleInput{}, nil, bodyError(err)
+		}
+		return line, pebbleInput{}, nil, io.EOF
+	}
+}
+
+// rowError turns an error decoding a row of an NDJSON body into the error
+// of the row, listing the fields that do not fit by their path in the row.
+func rowError(err error) *APIError {
+	var fields bodyFieldErrors
+	if errors.As(err, &fields) {
+		return Invalid(ValidationErrors(fields), "invalid row: %v", err)
+	}
+	return Invalid(nil, "invalid row: %v", err)
+}
+
+// csvRows returns the rows of a CSV body, whose header row names the
+// columns: name and any of the others of an export, of which all but
+// color and weight_grams are ignored.
+func csvRows(body io.Reader) (importRows, error) {
+	cr := csv.NewReader(body)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return func() (int, pebbleInput, error, error) { return 0, pebbleInput{}, nil, io.EOF }, nil
+	}
+	if err != nil {
+		return nil, csvError(err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if !slices.Contains(exportColumns, name) {
+			return nil, Invalid(ValidationErrors{{Field: name, Message: "is not a known column"}}, "invalid CSV header")
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, Invalid(ValidationErrors{{Field: "name", Message: "column is required"}}, "invalid CSV header")
+	}
+	return func() (int, pebbleInput, error, error) {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return 0, pebbleInput{}, nil, io.EOF
+		}
+		line, _ := cr.FieldPos(0)
+		if errors.Is(err, csv.ErrFieldCount) {
+			return line, pebbleInput{}, Invalid(nil, "row has %d columns rather than %d", len(record), len(header)), nil
+		}
+		if err != nil {
+			return line, pebbleInput{}, nil, csvError(err)
+		}
+		column := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return record[i]
+			}
+			return ""
+		}
+		in := pebbleInput{Name: column("name"), Color: column("color")}
+		if v := column("weight_grams"); v != "" {
+			if in.WeightGrams, err = strconv.Atoi(v); err != nil {
+				return line, pebbleInput{}, ValidationErrors{{Field: "weight_grams", Message: "must be a number"}}.apiError(), nil
+			}
+		}
+		return line, in, nil, nil
+	}, nil
+}
+
+// csvError turns an error reading a CSV body into the error of the
+// request.
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return Invalid(nil, "invalid CSV: %v", parseErr)
+	}
+	return bodyError(err)
+}
+
+// Import creates a pebble for each of ins in one transaction, so that
+// either all of them are created or none.
+func (s *PebbleService) Import(ctx context.Context, ins []pebbleInput) error {
+	err := transact(ctx, s.store, func(ctx context.Context) error {
+		for _, in := range ins {
+			if _, err := s.Create(ctx, in); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	var apiErr *APIError
+	if err != nil && !errors.As(err, &apiErr) {
+		return storeError(err)
+	}
+	return err
+}
+
+// importPebbles creates a pebble for each row of an NDJSON or CSV body,
+// checking the rows as they are read and creating them importBatchSize at
+// a time, so that a body of any length is never held whole. The rows
+// that fail are reported with their line and left out.
+func (api *pebblesAPI) importPebbles(w http.ResponseWriter, r *http.Request) error {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format, ok := importFormats[mt]
+	if !ok {
+		return NewAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+			"the request body must be one of application/x-ndjson, application/jsonl, text/csv")
+	}
+	next := ndjsonRows(r.Body)
+	if format == "csv" {
+		var err error
+		if next, err = csvRows(r.Body); err != nil {
+			return err
+		}
+	}
+
+	ctx := r.Context()
+	resp := importResponse{Errors: []importError{}}
+	var batch []pebbleInput
+	var lines []int
+	apply := func() {
+		if err := api.svc.Import(ctx, batch); err != nil {
+			for _, line := range lines {
+				resp.fail(ctx, line, err)
+			}
+		} else {
+			resp.Imported += len(batch)
+		}
+		batch, lines = batch[:0], lines[:0]
+	}
+	for {
+		line, in, rowErr, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			resp.Error = batchError(ctx, err).Error
+			break
+		}
+		resp.Rows++
+		if rowErr == nil {
+			if errs := Validate(in); errs != nil {
+				rowErr = errs.apiError()
+			}
+		}
+		if rowErr != nil {
+			resp.fail(ctx, line, rowErr)
+			continue
+		}
+		batch, lines = append(batch, in), append(lines, line)
+		if len(batch) == importBatchSize {
+			apply()
+		}
+	}
+	if len(batch) > 0 {
+		apply()
+	}
+	respond(w, r, http.StatusOK, resp)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNDJSONRowErrors(t *testing.T) {
+	body := strings.Join([]string{
+		`{"name":"Flint","color":"grey","weight_grams":30,"id":"ba0eaa76","created_at":"2026-10-14T09:00:00Z"}`,
+		``,
+		`{"name":"Jasper","weight_grams":"heavy","colour":"red"}`,
+		`{"name":"Agate","tags":{"a":1}}`,
+		`{"name":"Onyx"} {"name":"Opal"}`,
+		`{"name":`,
+		`{"name":"Quartz","weight_grams":12}`,
+	}, "\n")
+	type row struct {
+		line   int
+		name   string
+		fields ValidationErrors
+		msg    string
+	}
+	want := []row{
+		{line: 1, name: "Flint"},
+		{line: 3, fields: ValidationErrors{{Field: "weight_grams", Message: "expected integer"}, {Field: "colour", Message: "unknown field"}}},
+		{line: 4, fields: ValidationErrors{{Field: "tags", Message: "unknown field"}}},
+		{line: 5, msg: "invalid row: data after the top-level value"},
+		{line: 6, msg: "invalid row: unexpected EOF"},
+		{line: 7, name: "Quartz"},
+	}
+
+	next := ndjsonRows(strings.NewReader(body))
+	for _, w := range want {
+		line, in, rowErr, err := next()
+		if err != nil {
+			t.Fatalf("line %d: the import stopped: %v", w.line, err)
+		}
+		if line != w.line {
+			t.Fatalf("got line %d, want %d", line, w.line)
+		}
+		if w.name != "" {
+			if rowErr != nil || in.Name != w.name {
+				t.Errorf("line %d: got %q and error %v, want %q", line, in.Name, rowErr, w.name)
+			}
+			continue
+		}
+		var apiErr *APIError
+		if !errors.As(rowErr, &apiErr) || apiErr.Code != CodeInvalid {
+			t.Fatalf("line %d: got error %v, want an invalid row", line, rowErr)
+		}
+		if w.fields != nil {
+			if got, _ := apiErr.Details.(ValidationErrors); !reflect.DeepEqual(got, w.fields) {
+				t.Errorf("line %d: got fields %v, want %v", line, apiErr.Details, w.fields)
+			}
+		} else if apiErr.Message != w.msg {
+			t.Errorf("line %d: got %q, want %q", line, apiErr.Message, w.msg)
+		}
+	}
+	if _, _, _, err := next(); err != io.EOF {
+		t.Errorf("got %v after the last row, want io.EOF", err)
+	}
+}
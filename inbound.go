@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const jobInboundWebhook = "inbound_webhook.process"
+
+// CodeInvalidSignature is the error code of webhook deliveries whose
+// signature does not check out.
+const CodeInvalidSignature = "invalid_signature"
+
+// inboundProviderTypes are the signature schemes of the providers
+// inbound_webhooks.providers may name.
+var inboundProviderTypes = []string{"github", "stripe", "pebble"}
+
+// InboundDelivery is a webhook delivery received from another service,
+// passed to the job processing it. ID is the provider's ID of the
+// delivery, and Event the type of event it carries, if the provider says.
+type InboundDelivery struct {
+	Provider    string    `json:"provider"`
+	ID          string    `json:"id"`
+	Event       string    `json:"event,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body"`
+	ReceivedAt  time.Time `json:"received_at"`
+}
+
+// InboundHandler processes the deliveries of one provider. A returned
+// error makes the delivery be retried with the job queue's backoff.
+type InboundHandler func(ctx context.Context, d InboundDelivery) error
+
+// InboundWebhooks receives webhooks from other services at
+// POST /hooks/{provider}. A delivery is answered as soon as its signature
+// checks out and it is queued, and processed by a job, so that providers
+// with short timeouts do not send it again. A delivery whose ID was seen
+// within dedupTTL is acknowledged without being queued again, since
+// providers send deliveries that were not acknowledged in time again.
+type InboundWebhooks struct {
+	providers map[string]InboundProviderConfig
+	tolerance time.Duration
+	dedupTTL  time.Duration
+	seen      addingCache
+	jobs      *JobQueue
+	handlers  map[string]InboundHandler
+	logger    *slog.Logger
+	now       func() time.Time
+	received  *CounterVec
+}
+
+// inboundReceipt is the body of the response to a delivery.
+type inboundReceipt struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// NewInboundWebhooks returns the receiver of the providers of cfg, which
+// remembers the deliveries it has seen in seen, and registers the job type
+// processing them with jobs. Signature times are checked against clock.
+// reg, if not nil, receives its metrics.
+func NewInboundWebhooks(cfg InboundWebhooksConfig, seen addingCache, jobs *JobQueue, clock Clock, logger *slog.Logger, reg *Registry) *InboundWebhooks {
+	in := &InboundWebhooks{
+		providers: cfg.Providers,
+		tolerance: cfg.Tolerance.Duration,
+		dedupTTL:  cfg.DedupTTL.Duration,
+		seen:      seen,
+		jobs:      jobs,
+		handlers:  make(map[string]InboundHandler),
+		logger:    logger,
+		now:       clock.Now,
+	}
+	if reg != nil {
+		in.received = reg.NewCounterVec("inbound_webhooks_received_total",
+			"Number of webhook deliveries received, by provider and result.", "provider", "result")
+	}
+	jobs.Register(jobInboundWebhook, in.process)
+	return in
+}
+
+// Handle sets the handler processing the deliveries of provider. Those of
+// providers without one are logged. It must be called before the job
+// queue is started.
+func (in *InboundWebhooks) Handle(provider string, h InboundHandler) {
+	in.handlers[provider] = h
+}
+
+// register adds the receiving route to rt.
+func (in *InboundWebhooks) register(rt *Router) {
+	rt.Post("/hooks/{provider}", in.receive)
+	rt.Document("POST", "/hooks/{provider}", Operation{Summary: "Receive a webhook delivery from a provider", Tag: "webhooks", Response: inboundReceipt{}, Status: http.StatusAccepted})
+}
+
+func (in *InboundWebhooks) receive(w http.ResponseWriter, r *http.Request) error {
+	name := r.PathValue("provider")
+	p, ok := in.providers[name]
+	if !ok {
+		return NewAPIError(http.StatusNotFound, CodeNotFound, fmt.Sprintf("no webhook provider is named %q", name))
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	d, err := verifyInbound(p, r.Header, body, in.now(), in.tolerance)
+	if err != nil {
+		in.count(name, "invalid_signature")
+		in.logger.Warn("rejecting webhook delivery", "provider", name, "error", err)
+		return NewAPIError(http.StatusUnauthorized, CodeInvalidSignature, err.Error())
+	}
+	if d.ID == "" {
+		in.count(name, "invalid")
+		return Invalid(nil, "the delivery has no ID")
+	}
+	d.Provider = name
+	d.ContentType = r.Header.Get("Content-Type")
+	d.Body = body
+	d.ReceivedAt = in.now().UTC()
+
+	key := "inbound_webhooks:" + name + ":" + d.ID
+	added, err := in.seen.Add(r.Context(), key, []byte(d.ReceivedAt.Format(time.RFC3339)), in.dedupTTL)
+	if err != nil {
+		return Internal(fmt.Errorf("cannot record webhook delivery: %w", err))
+	}
+	if !added {
+		in.count(name, "duplicate")
+		in.logger.Info("ignoring webhook delivery already received", "provider", name, "delivery_id", d.ID)
+		respond(w, r, http.StatusOK, inboundReceipt{ID: d.ID, Status: "duplicate"})
+		return nil
+	}
+	if _, err := in.jobs.Enqueue(r.Context(), jobInboundWebhook, d); err != nil {
+		// Forgotten, so that the provider's next attempt is taken.
+		if err := in.seen.Delete(context.WithoutCancel(r.Context()), key); err != nil {
+			in.logger.Error("cannot forget webhook delivery", "provider", name, "delivery_id", d.ID, "error", err)
+		}
+		in.count(name, "unavailable")
+		return NewAPIError(http.StatusServiceUnavailable, CodeUnavailable, "cannot queue the delivery: "+err.Error())
+	}
+	in.count(name, "accepted")
+	respond(w, r, http.StatusAccepted, inboundReceipt{ID: d.ID, Status: "accepted"})
+	return nil
+}
+
+func (in *InboundWebhooks) count(provider, result string) {
+	if in.received != nil {
+		in.received.Inc(provider, result)
+	}
+}
+
+func (in *InboundWebhooks) process(ctx context.Context, job Job) error {
+	var d InboundDelivery
+	if err := json.Unmarshal(job.Payload, &d); err != nil {
+		return Permanent(err)
+	}
+	if h, ok := in.handlers[d.Provider]; ok {
+		return h(ctx, d)
+	}
+	in.logger.Info("received webhook delivery", "provider", d.Provider, "delivery_id", d.ID, "event", d.Event, "bytes", len(d.Body))
+	return nil
+}
+
+// verifyInbound checks the signature of body, sent with header, as the
+// type of p signs it, and returns the delivery with the ID and event the
+// provider gave it. Signatures with a time are accepted for tolerance
+// either side of now.
+func verifyInbound(p InboundProviderConfig, header http.Header, body []byte, now time.Time, tolerance time.Duration) (InboundDelivery, error) {
+	switch p.Type {
+	case "github":
+		// GitHub signs the body alone, as "sha256=<hex HMAC>".
+		sig, ok := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			return InboundDelivery{}, errors.New("the delivery has no X-Hub-Signature-256 header")
+		}
+		if !hmac.Equal([]byte(sig), []byte(webhookMAC(p.Secret, "", body))) {
+			return InboundDelivery{}, errors.New("the delivery's signature does not match")
+		}
+		return InboundDelivery{ID: header.Get("X-GitHub-Delivery"), Event: header.Get("X-GitHub-Event")}, nil
+	case "stripe":
+		if err := verifyTimestamped(header.Get("Stripe-Signature"), p.Secret, body, now, tolerance); err != nil {
+			return InboundDelivery{}, err
+		}
+		// Stripe puts the event's ID and type in the body.
+		var event struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(body, &event); err != nil {
+			return InboundDelivery{}, fmt.Errorf("the delivery is not a JSON event: %w", err)
+		}
+		return InboundDelivery{ID: event.ID, Event: event.Type}, nil
+	default:
+		// As another server running this one signs its webhooks.
+		if err := verifyTimestamped(header.Get(webhookSignatureHeader), p.Secret, body, now, tolerance); err != nil {
+			return InboundDelivery{}, err
+		}
+		return InboundDelivery{ID: header.Get(webhookDeliveryHeader), Event: header.Get(webhookEventHeader)}, nil
+	}
+}
+
+// verifyTimestamped checks a signature header as signWebhook makes them,
+// "t=<Unix time>,v1=<hex HMAC of time.body>", which may hold several v1
+// signatures while the secret is being rotated.
+func verifyTimestamped(sig, secret string, body []byte, now time.Time, tolerance time.Duration) error {
+	if sig == "" {
+		return errors.New("the delivery has no signature header")
+	}
+	var ts string
+	var macs []string
+	for part := range strings.SplitSeq(sig, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			macs = append(macs, v)
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(macs) == 0 {
+		return errors.New("the signature header is not t=<time>,v1=<signature>")
+	}
+	if signed := time.Unix(unix, 0); signed.Before(now.Add(-tolerance)) || signed.After(now.Add(tolerance)) {
+		return fmt.Errorf("the delivery was signed more than %s from the server's time", tolerance)
+	}
+	want := []byte(webhookMAC(secret, ts+".", body))
+	for _, mac := range macs {
+		if hmac.Equal([]byte(mac), want) {
+			return nil
+		}
+	}
+	return errors.New("the delivery's signature does not match")
+}
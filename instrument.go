@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// routeMatcher is implemented by Router and http.ServeMux and reports the
+// pattern that would serve a request.
+type routeMatcher interface {
+	Handler(r *http.Request) (h http.Handler, pattern string)
+}
+
+type httpMetrics struct {
+	requests *CounterVec
+	duration *HistogramVec
+	inFlight *GaugeVec
+	panics   *CounterVec
+}
+
+func newHTTPMetrics(reg *Registry) *httpMetrics {
+	return &httpMetrics{
+		requests: reg.NewCounterVec("http_requests_total",
+			"Number of HTTP requests served.", "route", "status"),
+		duration: reg.NewHistogramVec("http_request_duration_seconds",
+			"Time taken to serve HTTP requests.", DefBuckets, "route", "status"),
+		inFlight: reg.NewGaugeVec("http_requests_in_flight",
+			"Number of HTTP requests currently being served."),
+		panics: reg.NewCounterVec("http_panics_total",
+			"Number of HTTP handlers that panicked."),
+	}
+}
+
+// Instrument records request metrics labelled by the route pattern that
+// routes resolves for each request, so every registered handler is covered.
+func Instrument(m *httpMetrics, routes routeMatcher) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, route := routes.Handler(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			m.inFlight.Inc()
+			defer m.inFlight.Dec()
+
+			start := time.Now()
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r)
+
+			status := statusClass(rw.status)
+			m.requests.Inc(route, status)
+			m.duration.Observe(time.Since(start).Seconds(), route, status)
+		})
+	}
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
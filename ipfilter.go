@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+// IPFilter decides which clients may make requests by their IP address.
+type IPFilter struct {
+	allow ipSet
+	deny  ipSet
+}
+
+// NewIPFilter returns a filter refusing the clients in deny and, if allow
+// is not empty, those outside allow. It must run inside RealIP to see the
+// addresses of clients behind proxies.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	var err error
+	if f.allow, err = parseIPSet(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseIPSet(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Allows reports whether the client at addr may make requests. Clients
+// without an IP address only match an empty allow list.
+func (f *IPFilter) Allows(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return len(f.allow) == 0
+	}
+	if f.deny.contains(addr) {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow.contains(addr)
+}
+
+// Middleware refuses requests from clients the filter does not allow with
+// a 403 response.
+func (f *IPFilter) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !f.Allows(ClientIP(r)) {
+				WriteError(w, r, Forbidden("your address is not allowed to access this server"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
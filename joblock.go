@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrLockHeld is returned by JobLocker.Lock when another instance holds
+// the lock.
+var ErrLockHeld = errors.New("lock is held by another instance")
+
+// JobLocker makes each run of a scheduled job happen on one instance of
+// the server only, when several run against the same database.
+type JobLocker interface {
+	// Lock takes the lock of the job name for the instance, or returns
+	// ErrLockHeld if another instance holds it.
+	Lock(ctx context.Context, name string) (JobLock, error)
+	// Holder returns who holds the lock of the job name, or nil if it is
+	// free.
+	Holder(ctx context.Context, name string) (*LockHolder, error)
+}
+
+// JobLock is a lock taken by JobLocker.Lock.
+type JobLock interface {
+	// Unlock releases the lock at until or, if that has passed, at once,
+	// so that instances whose clocks are a little behind do not run the
+	// job again once this run is done.
+	Unlock(until time.Time)
+}
+
+// LockHolder is the instance holding the lock of a scheduled job.
+type LockHolder struct {
+	Instance string    `json:"instance"`
+	Since    time.Time `json:"since"`
+}
+
+// instanceName returns name or, if it is empty, the host name and the
+// process ID, which tell the instances apart.
+func instanceName(name string) string {
+	if name != "" {
+		return name
+	}
+	host, _ := os.Hostname()
+	return host + ":" + strconv.Itoa(os.Getpid())
+}
+
+// newJobLocker returns the locker selected by cfg.Lock: "postgres" uses
+// the database of db and "redis" the server of redis.
+func newJobLocker(cfg SchedulerConfig, db *sqlStore, redis RedisConfig, logger *slog.Logger) (JobLocker, error) {
+	instance := instanceName(cfg.Instance)
+	switch cfg.Lock {
+	case "postgres":
+		if db == nil {
+			return nil, errors.New("scheduler.lock postgres needs the postgres storage backend")
+		}
+		return &postgresLocker{db: db.db, instance: instance, logger: logger}, nil
+	case "redis":
+		rc, err := newRedisCache(redis.URL, redis.MaxIdleConns, redis.Timeout.Duration)
+		if err != nil {
+			return nil, err
+		}
+		return &redisLocker{redis: rc, instance: instance, ttl: cfg.LockTTL.Duration, logger: logger}, nil
+	}
+	return &localLocker{instance: instance, held: make(map[string]*localLock)}, nil
+}
+
+// localLocker keeps its locks in memory, which only keeps the runs of one
+// instance apart: for a single instance, or for jobs that every instance
+// should run.
+type localLocker struct {
+	instance string
+	mu       sync.Mutex
+	held     map[string]*localLock
+}
+
+type localLock struct {
+	locker *localLocker
+	name   string
+	since  time.Time
+}
+
+func (l *localLocker) Lock(ctx context.Context, name string) (JobLock, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.held[name]; ok {
+		return nil, ErrLockHeld
+	}
+	lock := &localLock{locker: l, name: name, since: time.Now()}
+	l.held[name] = lock
+	return lock, nil
+}
+
+func (l *localLocker) Holder(ctx context.Context, name string) (*LockHolder, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lock, ok := l.held[name]; ok {
+		return &LockHolder{Instance: l.instance, Since: lock.since}, nil
+	}
+	return nil, nil
+}
+
+// Unlock releases the lock at once: runs on one instance are kept apart
+// by the scheduler anyway.
+func (lock *localLock) Unlock(time.Time) {
+	lock.locker.mu.Lock()
+	defer lock.locker.mu.Unlock()
+	delete(lock.locker.held, lock.name)
+}
+
+// jobLockNamespace is the first key of the advisory locks of scheduled
+// jobs, keeping them apart from other users of the database's advisory
+// locks.
+var jobLockNamespace = jobLockKey("pebble-api scheduler")
+
+// jobLockKey returns the advisory lock key of name.
+func jobLockKey(name string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int32(h.Sum32())
+}
+
+// postgresLocker takes session advisory locks on a connection of its own
+// for each lock, so that the lock goes with the connection if the instance
+// dies. The connection's application_name names the instance, which is
+// how Holder finds it.
+type postgresLocker struct {
+	db       *sql.DB
+	instance string
+	logger   *slog.Logger
+}
+
+type postgresLock struct {
+	locker *postgresLocker
+	conn   *sql.Conn
+	name   string
+}
+
+func (l *postgresLocker) Lock(ctx context.Context, name string) (JobLock, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT set_config('application_name', $1, false)", "pebble-api "+l.instance); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var ok bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1::int4, $2::int4)", jobLockNamespace, jobLockKey(name)).Scan(&ok); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !ok {
+		l.release(conn)
+		return nil, ErrLockHeld
+	}
+	return &postgresLock{locker: l, conn: conn, name: name}, nil
+}
+
+func (l *postgresLocker) Holder(ctx context.Context, name string) (*LockHolder, error) {
+	var h LockHolder
+	err := l.db.QueryRowContext(ctx, `SELECT a.application_name, a.query_start
+		FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted AND l.classid = $1::int4::oid AND l.objid = $2::int4::oid AND l.objsubid = 2`,
+		jobLockNamespace, jobLockKey(name)).Scan(&h.Instance, &h.Since)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// release gives conn back to the pool under its usual name.
+func (l *postgresLocker) release(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := conn.ExecContext(ctx, "RESET application_name"); err != nil {
+		l.logger.Warn("cannot reset the name of a lock connection", "error", err)
+		// Closed for good rather than reused under the instance's name.
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	conn.Close()
+}
+
+func (lock *postgresLock) Unlock(until time.Time) {
+	unlock := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := lock.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1::int4, $2::int4)", jobLockNamespace, jobLockKey(lock.name)); err != nil {
+			lock.locker.logger.Warn("cannot release the lock of a scheduled job", "job", lock.name, "error", err)
+			// The lock goes with the connection.
+			lock.conn.Raw(func(any) error { return driver.ErrBadConn })
+			lock.conn.Close()
+			return
+		}
+		lock.locker.release(lock.conn)
+	}
+	if d := time.Until(until); d > 0 {
+		time.AfterFunc(d, unlock)
+		return
+	}
+	unlock()
+}
+
+// redisLockScript runs ARGV[2] on KEYS[1] only if it still holds ARGV[1],
+// the value of this instance's lock: PEXPIRE with ARGV[3] to extend or
+// keep it, or DEL to release it.
+const redisLockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call(ARGV[2], KEYS[1], unpack(ARGV, 3)) else return 0 end`
+
+// redisLocker takes locks with SET NX, expiring after ttl unless they are
+// extended, which they are every third of it while the job runs, so that
+// the lock of an instance that dies is freed.
+type redisLocker struct {
+	redis    *redisCache
+	instance string
+	ttl      time.Duration
+	logger   *slog.Logger
+}
+
+type redisLock struct {
+	locker *redisLocker
+	key    string
+	value  string
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func redisJobLockKey(name string) string {
+	return "scheduler:lock:" + name
+}
+
+func (l *redisLocker) Lock(ctx context.Context, name string) (JobLock, error) {
+	value, err := json.Marshal(struct {
+		LockHolder
+		Token string `json:"token"`
+	}{LockHolder{Instance: l.instance, Since: time.Now().UTC()}, randomToken(16)})
+	if err != nil {
+		return nil, err
+	}
+	key := redisJobLockKey(name)
+	reply, err := l.redis.do(ctx, "SET", key, string(value), "NX", "PX", strconv.FormatInt(l.ttl.Milliseconds(), 10))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrLockHeld
+	}
+	lock := &redisLock{locker: l, key: key, value: string(value), stop: make(chan struct{}), done: make(chan struct{})}
+	go lock.extend()
+	return lock, nil
+}
+
+// extend keeps the lock from expiring until stop is closed.
+func (lock *redisLock) extend() {
+	defer close(lock.done)
+	t := time.NewTicker(lock.locker.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-t.C:
+			if err := lock.run("PEXPIRE", lock.locker.ttl); err != nil {
+				lock.locker.logger.Warn("cannot extend the lock of a scheduled job", "key", lock.key, "error", err)
+			}
+		}
+	}
+}
+
+// run runs command on the key with redisLockScript, PEXPIRE for ttl or
+// DEL.
+func (lock *redisLock) run(command string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	args := []string{"EVAL", redisLockScript, "1", lock.key, lock.value, command}
+	if command == "PEXPIRE" {
+		args = append(args, strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := lock.locker.redis.do(ctx, args...)
+	return err
+}
+
+// Unlock keeps the key until until by letting it expire then, rather than
+// holding on to a connection.
+func (lock *redisLock) Unlock(until time.Time) {
+	close(lock.stop)
+	<-lock.done
+	command := "DEL"
+	if time.Until(until) > 0 {
+		command = "PEXPIRE"
+	}
+	if err := lock.run(command, time.Until(until)); err != nil {
+		lock.locker.logger.Warn("cannot release the lock of a scheduled job", "key", lock.key, "error", err)
+	}
+}
+
+func (l *redisLocker) Holder(ctx context.Context, name string) (*LockHolder, error) {
+	v, err := l.redis.Get(ctx, redisJobLockKey(name))
+	if errors.Is(err, ErrCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var h LockHolder
+	if err := json.Unmarshal(v, &h); err != nil {
+		return nil, fmt.Errorf("cannot read the holder of the lock of %s: %w", name, err)
+	}
+	return &h, nil
+}
+
+func (l *redisLocker) Close(ctx context.Context) error {
+	return l.redis.Close(ctx)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrQueueFull   = errors.New("jobs: queue is full")
+	ErrQueueClosed = errors.New("jobs: queue is closed")
+)
+
+// Job is a unit of background work. Payload is the JSON value given to
+// Enqueue. Attempt counts from 1, and the job is given up after
+// MaxAttempts.
+type Job struct {
+	ID          string
+	Type        string
+	Payload     json.RawMessage
+	Attempt     int
+	MaxAttempts int
+	EnqueuedAt  time.Time
+}
+
+// JobHandler runs jobs of one type. A returned error makes the job be
+// retried with exponential backoff until it has been attempted the
+// configured number of times; wrap it with Permanent to give up at once.
+type JobHandler func(ctx context.Context, job Job) error
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// JobQueue runs jobs in the background on a fixed pool of workers. Jobs
+// are kept in memory, so the ones still queued or waiting for a retry when
+// the process exits are lost.
+type JobQueue struct {
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	clock       Clock
+	logger      *slog.Logger
+	metrics     *jobMetrics
+
+	handlers map[string]jobType
+	queue    chan *Job
+
+	mu       sync.Mutex
+	closed   bool
+	retrying map[*Job]Timer
+	// stopped is closed when the queue stops, ending the waits for
+	// retries.
+	stopped  chan struct{}
+	inFlight int
+	wg       sync.WaitGroup
+	cancel   context.CancelFunc
+	// skipped counts the queued jobs dropped because the queue stopped
+	// before they ran.
+	skipped atomic.Int64
+}
+
+type jobType struct {
+	handler     JobHandler
+	maxAttempts int
+}
+
+type jobMetrics struct {
+	processed *CounterVec
+	duration  *HistogramVec
+}
+
+// NewJobQueue returns a queue configured by cfg, whose retries wait by
+// clock. reg, if not nil, receives the queue's metrics.
+func NewJobQueue(cfg JobsConfig, clock Clock, logger *slog.Logger, reg *Registry) *JobQueue {
+	q := &JobQueue{
+		workers:     cfg.Workers,
+		maxAttempts: cfg.MaxAttempts,
+		backoff:     cfg.InitialBackoff.Duration,
+		maxBackoff:  cfg.MaxBackoff.Duration,
+		clock:       clock,
+		logger:      logger,
+		handlers:    make(map[string]jobType),
+		queue:       make(chan *Job, cfg.QueueSize),
+		retrying:    make(map[*Job]Timer),
+		stopped:     make(chan struct{}),
+	}
+	if reg != nil {
+		reg.NewGaugeFunc("jobs_queue_depth", "Number of jobs waiting for a worker.",
+			func() float64 { return float64(len(q.queue)) })
+		reg.NewGaugeFunc("jobs_retrying", "Number of failed jobs waiting to be retried.",
+			func() float64 { return float64(q.Stats().Retrying) })
+		reg.NewGaugeFunc("jobs_in_flight", "Number of jobs being run.",
+			func() float64 { return float64(q.Stats().InFlight) })
+		q.metrics = &jobMetrics{
+			processed: reg.NewCounterVec("jobs_processed_total",
+				"Number of job attempts, by type and result.", "type", "result"),
+			duration: reg.NewHistogramVec("jobs_duration_seconds",
+				"Time taken to run job attempts.", DefBuckets, "type"),
+		}
+	}
+	return q
+}
+
+// Register sets the handler for jobs of type typ. It must be called before
+// the queue is started.
+func (q *JobQueue) Register(typ string, h JobHandler) {
+	q.RegisterAttempts(typ, h, q.maxAttempts)
+}
+
+// RegisterAttempts is like Register but gives up on jobs of type typ after
+// maxAttempts attempts instead of the configured number.
+func (q *JobQueue) RegisterAttempts(typ string, h JobHandler, maxAttempts int) {
+	q.handlers[typ] = jobType{handler: h, maxAttempts: maxAttempts}
+}
+
+// Enqueue adds a job of type typ with payload encoded as JSON and returns
+// its ID. It does not block: when the queue is full it returns
+// ErrQueueFull.
+func (q *JobQueue) Enqueue(ctx context.Context, typ string, payload any) (string, error) {
+	t, ok := q.handlers[typ]
+	if !ok {
+		return "", fmt.Errorf("jobs: no handler for job type %q", typ)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	job := &Job{ID: newUUID(), Type: typ, Payload: b, MaxAttempts: t.maxAttempts, EnqueuedAt: q.clock.Now()}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return "", ErrQueueClosed
+	}
+	select {
+	case q.queue <- job:
+		return job.ID, nil
+	default:
+		return "", ErrQueueFull
+	}
+}
+
+// JobStats is a snapshot of the queue.
+type JobStats struct {
+	Workers  int `json:"workers"`
+	Queued   int `json:"queued"`
+	Retrying int `json:"retrying"`
+	InFlight int `json:"in_flight"`
+}
+
+func (q *JobQueue) Stats() JobStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return JobStats{Workers: q.workers, Queued: len(q.queue), Retrying: len(q.retrying), InFlight: q.inFlight}
+}
+
+// Hook returns the lifecycle hook that starts the workers and, on stop,
+// refuses new jobs and waits for the queued ones to finish. Jobs waiting
+// for a retry are abandoned.
+func (q *JobQueue) Hook() Hook {
+	return Hook{
+		Name: "jobs",
+		OnStart: func(context.Context) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			q.cancel = cancel
+			for range q.workers {
+				q.wg.Add(1)
+				go q.work(ctx)
+			}
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			q.mu.Lock()
+			q.closed = true
+			for job, t := range q.retrying {
+				t.Stop()
+				q.logger.Warn("abandoning job waiting for a retry", "job_id", job.ID, "job_type", job.Type, "attempt", job.Attempt)
+			}
+			clear(q.retrying)
+			close(q.stopped)
+			close(q.queue)
+			q.mu.Unlock()
+
+			done := make(chan struct{})
+			go func() {
+				q.wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+				q.cancel()
+				return nil
+			case <-ctx.Done():
+				// Cancel the jobs still running and report what was left.
+				running := q.Stats().InFlight
+				q.cancel()
+				<-done
+				return fmt.Errorf("jobs: stopped with %d jobs cancelled while running and %d not started", running, q.skipped.Load())
+			}
+		},
+	}
+}
+
+func (q *JobQueue) work(ctx context.Context) {
+	defer q.wg.Done()
+	for job := range q.queue {
+		if ctx.Err() != nil {
+			q.skipped.Add(1)
+			continue
+		}
+		q.run(ctx, job)
+	}
+}
+
+func (q *JobQueue) run(ctx context.Context, job *Job) {
+	q.mu.Lock()
+	q.inFlight++
+	q.mu.Unlock()
+	job.Attempt++
+	start := q.clock.Now()
+	err := q.call(ctx, job)
+	q.mu.Lock()
+	q.inFlight--
+	q.mu.Unlock()
+
+	result := "success"
+	log := q.logger.With("job_id", job.ID, "job_type", job.Type, "attempt", job.Attempt)
+	if err != nil {
+		var perm permanentError
+		switch {
+		case job.Attempt < job.MaxAttempts && !errors.As(err, &perm) && q.retry(job):
+			result = "retry"
+			log.Warn("job failed, will retry", "error", err)
+		default:
+			result = "failed"
+			log.Error("job failed", "error", err)
+		}
+	} else {
+		log.Debug("job done", "duration", q.clock.Now().Sub(start))
+	}
+	if q.metrics != nil {
+		q.metrics.processed.Inc(job.Type, result)
+		q.metrics.duration.Observe(q.clock.Now().Sub(start).Seconds(), job.Type)
+	}
+}
+
+// call runs the handler for job, turning a panic into an error.
+func (q *JobQueue) call(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return q.handlers[job.Type].handler(ctx, *job)
+}
+
+// retry schedules job to be queued again after its backoff, which doubles
+// with every attempt up to the maximum and is jittered so that jobs that
+// failed together do not all retry together. It reports false if the
+// queue is closed.
+func (q *JobQueue) retry(job *Job) bool {
+	delay := q.backoff << min(job.Attempt-1, 30)
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	delay = delay/2 + rand.N(delay/2+1)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	t := q.clock.NewTimer(delay)
+	q.retrying[job] = t
+	go func() {
+		select {
+		case <-t.C():
+		case <-q.stopped:
+			return
+		}
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if _, ok := q.retrying[job]; !ok {
+			return
+		}
+		delete(q.retrying, job)
+		select {
+		case q.queue <- job:
+		default:
+			q.logger.Error("dropping job retry because the queue is full", "job_id", job.ID, "job_type", job.Type)
+		}
+	}()
+	return true
+}
+
+// JobsHandler serves the queue statistics.
+func JobsHandler(q *JobQueue) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		respond(w, r, http.StatusOK, q.Stats())
+		return nil
+	}
+}
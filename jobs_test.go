@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// waitFor fails the test unless cond holds within a second, for the
+// goroutines of the queue to catch up with the clock.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJobQueueRetriesByClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	cfg := JobsConfig{Workers: 1, QueueSize: 4, MaxAttempts: 3, InitialBackoff: Duration{time.Second}, MaxBackoff: Duration{time.Minute}}
+	q := NewJobQueue(cfg, clock, slog.New(slog.DiscardHandler), nil)
+	attempts := make(chan Job, cfg.MaxAttempts)
+	q.Register("flaky", func(ctx context.Context, job Job) error {
+		attempts <- job
+		if job.Attempt == 1 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	ctx := context.Background()
+	hook := q.Hook()
+	if err := hook.OnStart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hook.OnStop(ctx) })
+
+	if _, err := q.Enqueue(ctx, "flaky", nil); err != nil {
+		t.Fatal(err)
+	}
+	if job := <-attempts; job.Attempt != 1 || !job.EnqueuedAt.Equal(clock.Now()) {
+		t.Fatalf("got attempt %d enqueued at %s, want attempt 1 at %s", job.Attempt, job.EnqueuedAt, clock.Now())
+	}
+	waitFor(t, "the retry to be scheduled", func() bool { return q.Stats().Retrying == 1 })
+
+	// The first retry waits between half the initial backoff and all of it.
+	clock.Advance(cfg.InitialBackoff.Duration/2 - time.Millisecond)
+	if n := clock.Waiting(); n != 1 {
+		t.Fatalf("the retry fired before half its backoff had passed: %d timers waiting", n)
+	}
+	clock.Advance(cfg.InitialBackoff.Duration/2 + time.Millisecond)
+	select {
+	case job := <-attempts:
+		if job.Attempt != 2 {
+			t.Errorf("got attempt %d, want 2", job.Attempt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the job was not retried once its backoff had passed")
+	}
+	waitFor(t, "the retried job to finish", func() bool { s := q.Stats(); return s.Retrying == 0 && s.InFlight == 0 })
+}
+
+func TestJobQueueStopAbandonsRetries(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	cfg := JobsConfig{Workers: 1, QueueSize: 4, MaxAttempts: 3, InitialBackoff: Duration{time.Second}, MaxBackoff: Duration{time.Minute}}
+	q := NewJobQueue(cfg, clock, slog.New(slog.DiscardHandler), nil)
+	q.Register("failing", func(ctx context.Context, job Job) error { return errors.New("no") })
+	ctx := context.Background()
+	hook := q.Hook()
+	if err := hook.OnStart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue(ctx, "failing", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the retry to be scheduled", func() bool { return q.Stats().Retrying == 1 })
+	if err := hook.OnStop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := clock.Waiting(); n != 0 {
+		t.Errorf("%d retry timers still waiting after the queue stopped", n)
+	}
+	// Firing a timer now must not send on the closed queue.
+	clock.Advance(cfg.MaxBackoff.Duration)
+}
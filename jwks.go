@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwkSet caches the public keys published at a JWKS URL. Keys are
+// refreshed by the scheduler and on demand when a token names an unknown
+// key ID, at most once per minRefresh.
+type jwkSet struct {
+	url        string
+	client     *http.Client
+	minRefresh time.Duration
+	clock      Clock
+	logger     *slog.Logger
+
+	mu          sync.RWMutex
+	keys        map[string]any
+	lastRefresh time.Time
+}
+
+func newJWKSet(url string, clock Clock, logger *slog.Logger) *jwkSet {
+	return &jwkSet{
+		url:        url,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		minRefresh: time.Minute,
+		clock:      clock,
+		logger:     logger,
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("bad EC coordinates")
+		}
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (s *jwkSet) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot fetch JWKS: %s", resp.Status)
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("cannot decode JWKS: %w", err)
+	}
+	keys := make(map[string]any, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			s.logger.Warn("skipping JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.lastRefresh = s.clock.Now()
+	s.mu.Unlock()
+	s.logger.Debug("refreshed JWKS", "keys", len(keys))
+	return nil
+}
+
+// Key implements keyLookup.
+func (s *jwkSet) Key(alg, kid string) (any, error) {
+	if alg == "HS256" {
+		return nil, errors.New("HS256 tokens are not accepted with JWKS")
+	}
+	s.mu.RLock()
+	key, ok := s.keys[kid]
+	stale := s.clock.Now().Sub(s.lastRefresh) >= s.minRefresh
+	s.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if stale {
+		ctx, cancel := s.clock.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.refresh(ctx); err != nil {
+			s.logger.Warn("cannot refresh JWKS", "error", err)
+		}
+		s.mu.RLock()
+		key, ok = s.keys[kid]
+		s.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// Check reports whether keys have been loaded, for use as a readiness
+// check.
+func (s *jwkSet) Check(ctx context.Context) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.keys == nil {
+		return errors.New("JWKS not loaded yet")
+	}
+	return nil
+}
+
+// load makes the first refresh of the keys, logging a failure, which the
+// next refresh may make up for.
+func (s *jwkSet) load() {
+	ctx, cancel := s.clock.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.refresh(ctx); err != nil {
+		s.logger.Warn("cannot refresh JWKS", "error", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Claims are the verified claims of a token.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	Scopes    []string
+	// Tenant is the tenant an API key belongs to. The tenant of a token
+	// is read from Raw, under the claim tenancy.claim names.
+	Tenant string
+
+	// Raw holds every claim in the token as decoded from JSON.
+	Raw map[string]any
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// keyLookup returns the key to verify a token signed with alg and key ID
+// kid: a []byte secret for HS256, an *rsa.PublicKey for RS256 or an
+// *ecdsa.PublicKey for ES256.
+type keyLookup func(alg, kid string) (any, error)
+
+// JWTVerifier checks signatures and the registered claims of JSON Web
+// Tokens.
+type JWTVerifier struct {
+	keys     keyLookup
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+func (v *JWTVerifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", errInvalidToken)
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header: %v", errInvalidToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", errInvalidToken)
+	}
+	key, err := v.keys(header.Alg, header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+
+	var raw map[string]any
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, fmt.Errorf("%w: bad claims: %v", errInvalidToken, err)
+	}
+	claims, err := parseClaims(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if err := v.validate(claims, raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) validate(c *Claims, raw map[string]any) error {
+	now := v.now()
+	if c.ExpiresAt.IsZero() {
+		return errors.New("missing exp claim")
+	}
+	if now.After(c.ExpiresAt.Add(v.leeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := raw["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if v.audience != "" && !slices.Contains(c.Audience, v.audience) {
+		return errors.New("token is not intended for this audience")
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func parseClaims(raw map[string]any) (*Claims, error) {
+	c := &Claims{Raw: raw}
+	c.Subject, _ = raw["sub"].(string)
+	c.Issuer, _ = raw["iss"].(string)
+	switch aud := raw["aud"].(type) {
+	case string:
+		c.Audience = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				c.Audience = append(c.Audience, s)
+			}
+		}
+	}
+	if exp, ok := raw["exp"].(float64); ok {
+		c.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	// OAuth2 servers use either a space separated "scope" string or a
+	// "scp" list.
+	if scope, ok := raw["scope"].(string); ok {
+		c.Scopes = strings.Fields(scope)
+	}
+	if scp, ok := raw["scp"].([]any); ok {
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				c.Scopes = append(c.Scopes, s)
+			}
+		}
+	}
+	return c, nil
+}
+
+func verifySignature(alg string, key any, signingInput string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("key is not a shared secret")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig)
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an EC key")
+		}
+		if len(sig) != 64 {
+			return errors.New("bad signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, sum[:], r, s) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// signHS256 creates a token signed with secret. It is used to issue tokens
+// for local development.
+func signHS256(secret []byte, claims map[string]any) (string, error) {
+	header, _ := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken returns a token of claims with header, signed for header's
+// alg with key: a []byte secret, an *rsa.PrivateKey or an
+// *ecdsa.PrivateKey. Any other key leaves the signature empty.
+func signToken(t *testing.T, header map[string]any, claims map[string]any, key any) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	sum := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerifierVerify(t *testing.T) {
+	now := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("a secret of at least thirty-two bytes")
+	// The public key as a client would find it, to sign an HS256 token
+	// with, hoping it is taken for a shared secret.
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The keys are looked up by kid alone, whatever the alg, so that the
+	// verifier itself must refuse a key of the wrong kind.
+	keys := func(alg, kid string) (any, error) {
+		switch kid {
+		case "rsa":
+			return &rsaKey.PublicKey, nil
+		case "ec":
+			return &ecKey.PublicKey, nil
+		case "hmac":
+			return secret, nil
+		}
+		return nil, errors.New("unknown key ID")
+	}
+	v := &JWTVerifier{keys: keys, issuer: "https://issuer.example", audience: "pebbles", leeway: 30 * time.Second, now: func() time.Time { return now }}
+
+	claims := func(change map[string]any) map[string]any {
+		c := map[string]any{"sub": "ada", "iss": "https://issuer.example", "aud": "pebbles", "exp": now.Add(time.Hour).Unix()}
+		for k, val := range change {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+	header := func(alg, kid string) map[string]any { return map[string]any{"alg": alg, "kid": kid, "typ": "JWT"} }
+	valid := signToken(t, header("RS256", "rsa"), claims(nil), rsaKey)
+	parts := strings.Split(valid, ".")
+	hmacHeader := strings.Split(signToken(t, header("HS256", "hmac"), claims(nil), secret), ".")[0]
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{name: "RS256", token: valid},
+		{name: "ES256", token: signToken(t, header("ES256", "ec"), claims(nil), ecKey)},
+		{name: "HS256", token: signToken(t, header("HS256", "hmac"), claims(nil), secret)},
+		{name: "audience in a list", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"aud": []string{"other", "pebbles"}}), rsaKey)},
+		{name: "expired within the leeway", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"exp": now.Add(-20 * time.Second).Unix()}), rsaKey)},
+		{name: "not yet valid within the leeway", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"nbf": now.Add(20 * time.Second).Unix()}), rsaKey)},
+
+		{name: "alg none", token: signToken(t, header("none", "rsa"), claims(nil), nil), want: `unsupported algorithm "none"`},
+		{name: "alg none without a key ID", token: signToken(t, map[string]any{"alg": "none"}, claims(nil), nil), want: "unknown key ID"},
+		{name: "HS256 with an RSA key", token: signToken(t, header("HS256", "rsa"), claims(nil), rsaPublic), want: "key is not a shared secret"},
+		{name: "RS256 with a shared secret", token: signToken(t, header("RS256", "hmac"), claims(nil), rsaKey), want: "key is not an RSA key"},
+		{name: "ES256 with an RSA key", token: signToken(t, header("ES256", "rsa"), claims(nil), ecKey), want: "key is not an EC key"},
+		{name: "claims changed after signing", token: parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"root","exp":4102444800}`)) + "." + parts[2], want: "verification error"},
+		{name: "HS256 with the wrong secret", token: signToken(t, header("HS256", "hmac"), claims(nil), []byte("guessed")), want: "signature mismatch"},
+
+		{name: "two segments", token: parts[0] + "." + parts[1], want: "malformed"},
+		{name: "header not base64", token: "e30*." + parts[1] + "." + parts[2], want: "bad header"},
+		{name: "header not JSON", token: base64.RawURLEncoding.EncodeToString([]byte("{")) + "." + parts[1] + "." + parts[2], want: "bad header"},
+		{name: "claims not base64", token: signedInput(t, hmacHeader+".e30*", secret), want: "bad claims"},
+		{name: "signature not base64", token: parts[0] + "." + parts[1] + ".c2ln!", want: "bad signature encoding"},
+		{name: "padded signature", token: valid + "==", want: "bad signature encoding"},
+
+		{name: "expired", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"exp": now.Add(-31 * time.Second).Unix()}), rsaKey), want: "token has expired"},
+		{name: "no exp", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"exp": nil}), rsaKey), want: "missing exp claim"},
+		{name: "not yet valid", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"nbf": now.Add(31 * time.Second).Unix()}), rsaKey), want: "token is not valid yet"},
+		{name: "other issuer", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"iss": "https://evil.example"}), rsaKey), want: "unexpected issuer"},
+		{name: "no issuer", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"iss": nil}), rsaKey), want: "unexpected issuer"},
+		{name: "other audience", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"aud": "billing"}), rsaKey), want: "not intended for this audience"},
+		{name: "no audience", token: signToken(t, header("RS256", "rsa"), claims(map[string]any{"aud": nil}), rsaKey), want: "not intended for this audience"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := v.Verify(tt.token)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("got error %v, want none", err)
+				}
+				if c.Subject != "ada" {
+					t.Errorf("got subject %q, want ada", c.Subject)
+				}
+				return
+			}
+			if !errors.Is(err, errInvalidToken) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want an invalid token error saying %q", err, tt.want)
+			}
+			if c != nil {
+				t.Errorf("got claims %+v with the error", c)
+			}
+		})
+	}
+}
+
+// signedInput returns signing input with its HS256 signature by secret.
+func signedInput(t *testing.T, input string, secret []byte) string {
+	t.Helper()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestSharedSecretVerifierOnlyAcceptsHS256(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	secret := "a secret of at least thirty-two bytes"
+	v := newJWTVerifier(JWTConfig{Secret: secret}, nil, clock)
+	claims := map[string]any{"sub": "ada", "exp": clock.Now().Add(time.Hour).Unix()}
+
+	if _, err := v.Verify(signToken(t, map[string]any{"alg": "HS256"}, claims, []byte(secret))); err != nil {
+		t.Fatalf("got error %v for an HS256 token, want none", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{
+		signToken(t, map[string]any{"alg": "ES256"}, claims, ecKey),
+		signToken(t, map[string]any{"alg": "none"}, claims, nil),
+	} {
+		if _, err := v.Verify(token); err == nil || !strings.Contains(err.Error(), "only HS256") {
+			t.Errorf("got error %v, want only HS256 tokens accepted", err)
+		}
+	}
+}
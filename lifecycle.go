@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Hook is a component managed by a Lifecycle. OnStart must return once the
+// component is running; long-running work belongs in goroutines that are
+// ended by OnStop. Either function may be nil.
+type Hook struct {
+	Name    string
+	OnStart func(ctx context.Context) error
+	OnStop  func(ctx context.Context) error
+
+	// StopTimeout bounds OnStop. Zero means the lifecycle's default.
+	StopTimeout time.Duration
+}
+
+// Lifecycle starts components in the order they were appended and stops
+// them in reverse order, so a component can rely on everything appended
+// before it while it runs.
+type Lifecycle struct {
+	logger      *slog.Logger
+	stopTimeout time.Duration
+	hooks       []Hook
+	failed      chan error
+}
+
+func NewLifecycle(logger *slog.Logger, stopTimeout time.Duration) *Lifecycle {
+	return &Lifecycle{
+		logger:      logger,
+		stopTimeout: stopTimeout,
+		failed:      make(chan error, 1),
+	}
+}
+
+func (l *Lifecycle) Append(h Hook) {
+	l.hooks = append(l.hooks, h)
+}
+
+// Fail reports that a running component has failed, which makes Run stop
+// all components. Only the first failure is kept.
+func (l *Lifecycle) Fail(err error) {
+	select {
+	case l.failed <- err:
+	default:
+	}
+}
+
+// Run starts every component, waits until ctx is cancelled or a component
+// fails, and then stops the components that were started. If a component
+// fails to start the ones before it are stopped and the error returned.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	var started []Hook
+	var runErr error
+	for _, h := range l.hooks {
+		if h.OnStart != nil {
+			l.logger.Debug("starting", "component", h.Name)
+			if err := h.OnStart(ctx); err != nil {
+				runErr = fmt.Errorf("cannot start %s: %w", h.Name, err)
+				break
+			}
+		}
+		started = append(started, h)
+	}
+
+	if runErr == nil {
+		select {
+		case <-ctx.Done():
+			l.logger.Info("shutting down")
+		case err := <-l.failed:
+			runErr = err
+			l.logger.Error("component failed, shutting down", "error", err)
+		}
+	}
+	return errors.Join(runErr, l.stop(started, len(started) < len(l.hooks)))
+}
+
+type startFailedKey struct{}
+
+// startFailed reports whether ctx is that of an OnStop call made because a
+// later component failed to start, when the process never served and
+// there is nothing to wait for before stopping.
+func startFailed(ctx context.Context) bool {
+	failed, _ := ctx.Value(startFailedKey{}).(bool)
+	return failed
+}
+
+func (l *Lifecycle) stop(hooks []Hook, startFailed bool) error {
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		if h.OnStop == nil {
+			continue
+		}
+		timeout := h.StopTimeout
+		if timeout == 0 {
+			timeout = l.stopTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), startFailedKey{}, startFailed), timeout)
+		start := time.Now()
+		err := h.OnStop(ctx)
+		cancel()
+		if err != nil {
+			l.logger.Error("cannot stop component", "component", h.Name, "error", err)
+			errs = append(errs, fmt.Errorf("cannot stop %s: %w", h.Name, err))
+			continue
+		}
+		l.logger.Debug("stopped", "component", h.Name, "duration", time.Since(start))
+	}
+	return errors.Join(errs...)
+}
+
+// BackgroundHook returns a hook that runs fn in a goroutine from start to
+// stop. On stop the context passed to fn is cancelled and the hook waits
+// for fn to return.
+func BackgroundHook(name string, fn func(ctx context.Context)) Hook {
+	var cancel context.CancelFunc
+	done := make(chan struct{})
+	return Hook{
+		Name: name,
+		OnStart: func(context.Context) error {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			go func() {
+				defer close(done)
+				fn(ctx)
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+// ServerHook returns a hook that starts srv and stops it gracefully. If a
+// listener of srv fails while the lifecycle runs, lc is stopped with the
+// error.
+func ServerHook(name string, srv *Server, lc *Lifecycle) Hook {
+	return Hook{
+		Name: name,
+		OnStart: func(ctx context.Context) error {
+			if err := srv.Start(ctx); err != nil {
+				return err
+			}
+			go func() {
+				if err := <-srv.Err(); err != nil {
+					lc.Fail(err)
+				}
+			}()
+			return nil
+		},
+		OnStop:      srv.Stop,
+		StopTimeout: srv.StopTimeout(),
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets on.
+const listenFDsStart = 3
+
+// option returns the Server option that makes it listen as l says.
+func (l ListenerConfig) option() Option {
+	switch l.Network {
+	case "unix":
+		mode := fs.FileMode(0o660)
+		if l.Mode != "" {
+			mode, _ = parseFileMode(l.Mode)
+		}
+		return WithUnixSocket(l.Address, mode)
+	case "systemd":
+		return WithSystemdSocket(l.Address)
+	}
+	host, port, _ := net.SplitHostPort(l.Address)
+	n, _ := strconv.Atoi(port)
+	return func(s *Server) {
+		// The address says which family to use, if any.
+		WithHost(host)(s)
+		WithAddressFamily("any")(s)
+		WithPort(n)(s)
+	}
+}
+
+// listenUnix listens on a Unix socket at path with the permissions in
+// mode. A socket file left behind by a server that was killed is removed
+// first, but one that a running server still accepts connections on is
+// not.
+func listenUnix(ctx context.Context, path string, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		d := net.Dialer{Timeout: time.Second}
+		if conn, err := d.DialContext(ctx, "unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: socket is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// systemdListener returns a listening socket passed to the process by
+// systemd socket activation: the one named name in LISTEN_FDNAMES, or the
+// only one if name is empty.
+func systemdListener(name string) (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil, errors.New("systemd: no sockets were passed to this process")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("systemd: no sockets were passed to this process")
+	}
+	i := 0
+	switch names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"); {
+	case name != "":
+		if i = slices.Index(names, name); i < 0 || i >= n {
+			return nil, fmt.Errorf("systemd: no socket named %q was passed (FileDescriptorName= in the .socket unit)", name)
+		}
+	case n > 1:
+		return nil, fmt.Errorf("systemd: %d sockets were passed, so the one to use must be named", n)
+	}
+	f := os.NewFile(uintptr(listenFDsStart+i), "systemd:"+name)
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd: socket %d: %w", listenFDsStart+i, err)
+	}
+	return ln, nil
+}
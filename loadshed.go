@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const CodeOverloaded = "overloaded"
+
+// loadShedBackoff is the factor the concurrency limit shrinks by when
+// requests take longer than the target latency.
+const loadShedBackoff = 0.9
+
+// LoadShedder caps the requests served at once with an adaptive limit.
+// The limit grows by one for about every limit requests finishing within
+// the target latency, and shrinks by a tenth, at most once per target
+// latency, when they take longer, so that a server slowing down under load
+// takes on less of it. Requests over the limit wait briefly in a queue,
+// oldest first, and are shed when it is full or they time out.
+type LoadShedder struct {
+	clock Clock
+
+	mu           sync.Mutex
+	limit        float64
+	min, max     float64
+	target       time.Duration
+	lastDecrease time.Time
+	inFlight     int
+	queue        []chan struct{}
+	queueSize    int
+	queueTimeout time.Duration
+	retryAfter   string
+
+	shed *CounterVec
+}
+
+// NewLoadShedder returns the shedder of cfg, starting at the highest limit,
+// which times requests and their waits in the queue by clock. reg, if not
+// nil, gets its metrics.
+func NewLoadShedder(cfg LoadShedConfig, clock Clock, reg *Registry) *LoadShedder {
+	s := &LoadShedder{
+		clock:        clock,
+		limit:        float64(cfg.MaxInFlight),
+		min:          float64(cfg.MinInFlight),
+		max:          float64(cfg.MaxInFlight),
+		target:       cfg.TargetLatency.Duration,
+		queueSize:    cfg.QueueSize,
+		queueTimeout: cfg.QueueTimeout.Duration,
+		retryAfter:   strconv.Itoa(int(cfg.RetryAfter.Seconds())),
+	}
+	if reg != nil {
+		reg.NewGaugeFunc("load_shed_in_flight", "Number of requests being served under the concurrency limit.", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(s.inFlight)
+		})
+		reg.NewGaugeFunc("load_shed_queue_length", "Number of requests waiting for the concurrency limit.", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(len(s.queue))
+		})
+		reg.NewGaugeFunc("load_shed_limit", "Number of requests that may be served at once.", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(int(s.limit))
+		})
+		s.shed = reg.NewCounterVec("load_shed_rejected_total", "Number of requests shed, by reason.", "reason")
+	}
+	return s
+}
+
+// acquire takes a place under the limit, queueing for one if there is
+// none. It returns false and why if the request is shed instead.
+func (s *LoadShedder) acquire(ctx context.Context) (bool, string) {
+	s.mu.Lock()
+	if s.inFlight < int(s.limit) && len(s.queue) == 0 {
+		s.inFlight++
+		s.mu.Unlock()
+		return true, ""
+	}
+	if len(s.queue) >= s.queueSize || s.queueTimeout <= 0 {
+		s.mu.Unlock()
+		return false, "queue_full"
+	}
+	ready := make(chan struct{})
+	s.queue = append(s.queue, ready)
+	s.mu.Unlock()
+
+	t := s.clock.NewTimer(s.queueTimeout)
+	defer t.Stop()
+	var reason string
+	select {
+	case <-ready:
+		return true, ""
+	case <-t.C():
+		reason = "queue_timeout"
+	case <-ctx.Done():
+		reason = "canceled"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(s.queue, ready)
+	if i < 0 {
+		// release handed the place over as the wait ended.
+		return true, ""
+	}
+	s.queue = slices.Delete(s.queue, i, i+1)
+	return false, reason
+}
+
+// release gives up the place of a request that took d, adapting the limit
+// to d, and hands the places free under the limit to queued requests.
+func (s *LoadShedder) release(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	if s.target > 0 {
+		if d <= s.target {
+			s.limit = min(s.max, s.limit+1/s.limit)
+		} else if now := s.clock.Now(); now.Sub(s.lastDecrease) >= s.target {
+			s.limit = max(s.min, s.limit*loadShedBackoff)
+			s.lastDecrease = now
+		}
+	}
+	for s.inFlight < int(s.limit) && len(s.queue) > 0 {
+		s.inFlight++
+		close(s.queue[0])
+		s.queue = s.queue[1:]
+	}
+}
+
+// Middleware serves requests under the limit and answers those that are
+// shed with a 503 response telling clients when to retry. Long-lived
+// requests, such as streams, should skip it: they would take up places
+// for as long as they last and count as slow.
+func (s *LoadShedder) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, reason := s.acquire(r.Context())
+			if !ok {
+				if s.shed != nil {
+					s.shed.Inc(reason)
+				}
+				w.Header().Set("Retry-After", s.retryAfter)
+				WriteError(w, r, NewAPIError(http.StatusServiceUnavailable, CodeOverloaded, "the server is overloaded"))
+				return
+			}
+			start := s.clock.Now()
+			defer func() { s.release(s.clock.Now().Sub(start)) }()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
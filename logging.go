@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// newLogger returns a logger writing to the sinks of cfg, which must
+// already have been validated, or to stderr in the format given by cfg if
+// it has none. level is set to the level in cfg and can be changed later
+// to adjust the sinks without a level of their own.
+func newLogger(cfg LogConfig, level *slog.LevelVar, stderr io.Writer) (*slog.Logger, error) {
+	l, _ := cfg.SlogLevel()
+	level.Set(l)
+	sinks := cfg.Sinks
+	if len(sinks) == 0 {
+		sinks = []LogSinkConfig{{Type: "stderr"}}
+	}
+	handlers := make(teeHandler, 0, len(sinks))
+	for i, sink := range sinks {
+		h, err := newSinkHandler(cfg, sink, level, stderr)
+		if err != nil {
+			return nil, fmt.Errorf("log.sinks[%d]: %w", i, err)
+		}
+		handlers = append(handlers, h)
+	}
+	if len(handlers) == 1 {
+		return slog.New(requestIDHandler{handlers[0]}), nil
+	}
+	return slog.New(requestIDHandler{handlers}), nil
+}
+
+// Logging logs one line per request once the response has been written.
+// It must run inside RequestID for the line to carry the request ID, and
+// inside RealIP for it to carry the address of clients behind proxies.
+func Logging(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r)
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rw.status),
+				slog.Duration("latency", time.Since(start)),
+				slog.Int64("bytes", rw.bytes),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("client_ip", clientAddr(r)),
+			)
+		})
+	}
+}
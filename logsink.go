@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultLogTag names the program to syslog and journald.
+const defaultLogTag = "pebble-api"
+
+// syslogFacility is the facility of the messages sent to syslog, daemon.
+const syslogFacility = 3
+
+// syslogSockets are where the local syslog daemon listens, by system.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// journalSocket is where journald listens for its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// newSinkHandler returns the handler of sink, itself a sink of cfg. The
+// sink follows level unless it has its own.
+func newSinkHandler(cfg LogConfig, sink LogSinkConfig, level *slog.LevelVar, stderr io.Writer) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	if sink.Level != "" {
+		l, _ := LogConfig{Level: sink.Level}.SlogLevel()
+		opts.Level = l
+	}
+	tag := cmp.Or(sink.Tag, defaultLogTag)
+	var w io.Writer
+	var messages *messageWriter
+	switch sink.Type {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = stderr
+	case "file":
+		rf, err := openRotatingFile(sink.Path, sink.MaxBytes, sink.MaxAge.Duration, sink.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = rf
+	case "syslog":
+		s, err := dialSyslog(sink.Address, tag)
+		if err != nil {
+			return nil, err
+		}
+		messages = &messageWriter{send: s.send}
+	case "journald":
+		j, err := dialJournald(sink.Address, tag)
+		if err != nil {
+			return nil, err
+		}
+		messages = &messageWriter{send: j.send}
+	}
+	if messages != nil {
+		w = messages
+		// Syslog and journald time every message themselves.
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if cmp.Or(sink.Format, cfg.Format) == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	if messages != nil {
+		h = messageHandler{h, messages}
+	}
+	return h, nil
+}
+
+// teeHandler passes every record to each of its handlers that is enabled
+// for its level.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slices.ContainsFunc(t, func(h slog.Handler) bool { return h.Enabled(ctx, level) })
+}
+
+func (t teeHandler) Handle(ctx context.Context, rec slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, rec.Level) {
+			errs = append(errs, h.Handle(ctx, rec.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := make(teeHandler, len(t))
+	for i, h := range t {
+		next[i] = h.WithAttrs(attrs)
+	}
+	return next
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	next := make(teeHandler, len(t))
+	for i, h := range t {
+		next[i] = h.WithGroup(name)
+	}
+	return next
+}
+
+// messageWriter sends each record, which handlers write in one go, as a
+// message at the level of the record, which messageHandler sets while the
+// record is written.
+type messageWriter struct {
+	mu    sync.Mutex
+	level slog.Level
+	send  func(level slog.Level, msg []byte) error
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if err := w.send(w.level, bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// messageHandler is a handler writing to a messageWriter.
+type messageHandler struct {
+	slog.Handler
+	w *messageWriter
+}
+
+func (h messageHandler) Handle(ctx context.Context, rec slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.level = rec.Level
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h messageHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return messageHandler{h.Handler.WithAttrs(attrs), h.w}
+}
+
+func (h messageHandler) WithGroup(name string) slog.Handler {
+	return messageHandler{h.Handler.WithGroup(name), h.w}
+}
+
+// syslogSeverity returns the syslog severity of level.
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// parseSyslogAddress splits a syslog server address, such as
+// udp://host:514, into the network and address to dial.
+func parseSyslogAddress(s string) (network, addr string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case (u.Scheme == "udp" || u.Scheme == "tcp") && u.Host != "":
+		return u.Scheme, u.Host, nil
+	case u.Scheme == "unix" && u.Path != "":
+		return "unixgram", u.Path, nil
+	}
+	return "", "", fmt.Errorf("%q is not a udp://host:port, tcp://host:port or unix:///path address", s)
+}
+
+// syslogWriter sends messages in the BSD syslog format, which every syslog
+// daemon reads, to a server or, without one, the local daemon. It dials
+// again once when a message cannot be sent, should the daemon have
+// restarted.
+type syslogWriter struct {
+	network  string
+	addr     string
+	tag      string
+	hostname string
+	conn     net.Conn
+}
+
+func dialSyslog(address, tag string) (*syslogWriter, error) {
+	s := &syslogWriter{tag: tag}
+	if address != "" {
+		s.network, s.addr, _ = parseSyslogAddress(address)
+	}
+	if s.network == "udp" || s.network == "tcp" {
+		s.hostname, _ = os.Hostname()
+	}
+	if err := s.dial(); err != nil {
+		return nil, fmt.Errorf("cannot connect to syslog: %w", err)
+	}
+	return s, nil
+}
+
+func (s *syslogWriter) dial() error {
+	if s.network != "" {
+		conn, err := net.Dial(s.network, s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		return nil
+	}
+	var err error
+	for _, path := range syslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			if conn, err = net.Dial(network, path); err == nil {
+				s.conn = conn
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// send is called by a messageWriter, which serialises the calls.
+func (s *syslogWriter) send(level slog.Level, msg []byte) error {
+	pri := syslogFacility<<3 | syslogSeverity(level)
+	var line string
+	if s.hostname != "" {
+		line = fmt.Sprintf("<%d>%s %s %s[%d]: %s\n", pri, time.Now().Format(time.RFC3339), s.hostname, s.tag, os.Getpid(), msg)
+	} else {
+		line = fmt.Sprintf("<%d>%s %s[%d]: %s\n", pri, time.Now().Format(time.Stamp), s.tag, os.Getpid(), msg)
+	}
+	if s.conn != nil {
+		if _, err := io.WriteString(s.conn, line); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.dial(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(s.conn, line)
+	return err
+}
+
+// journalWriter sends messages to journald in its native protocol, so
+// that they keep their priority and can hold newlines.
+type journalWriter struct {
+	conn net.Conn
+	tag  string
+}
+
+func dialJournald(address, tag string) (*journalWriter, error) {
+	conn, err := net.Dial("unixgram", cmp.Or(address, journalSocket))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to journald: %w", err)
+	}
+	return &journalWriter{conn: conn, tag: tag}, nil
+}
+
+// send writes msg in the binary form of a field, its length and then its
+// bytes, which may hold newlines.
+func (j *journalWriter) send(level slog.Level, msg []byte) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\nMESSAGE\n", syslogSeverity(level), j.tag)
+	binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+	b.Write(msg)
+	b.WriteByte('\n')
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+// rotatingFile is a log file that is rotated once it has grown past
+// maxBytes or was opened maxAge ago: the file is renamed with the time as
+// a suffix, such as access.log.20240501T120000.000, a new one is started,
+// and only the newest maxBackups rotated files are kept. A zero limit
+// disables it.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// openRotatingFile opens the file at path for appending, creating it if
+// needed.
+func openRotatingFile(path string, maxBytes int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, maxAge: maxAge, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot open log file: %w", err)
+	}
+	rf.f, rf.size, rf.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && (rf.maxBytes > 0 && rf.size+int64(len(p)) > rf.maxBytes || rf.maxAge > 0 && time.Since(rf.opened) >= rf.maxAge) {
+		if err := rf.rotate(); err != nil && rf.f == nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and opens a new one. If the file
+// cannot be moved, writing goes on to it.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+	rotated := rf.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	renameErr := os.Rename(rf.path, rotated)
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("cannot rotate log file: %w", renameErr)
+	}
+	if rf.maxBackups > 0 {
+		// The suffixes sort by time, oldest first.
+		backups, _ := filepath.Glob(rf.path + ".[0-9]*")
+		slices.Sort(backups)
+		for len(backups) > rf.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// Close closes the file; writes after it fail.
+func (rf *rotatingFile) Close(context.Context) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
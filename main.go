@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+const usage = `Usage: %s [-config file] <command> [arguments]
+
+Commands:
+  serve                 run the server (the default)
+  migrate [up|down N]   apply or roll back database migrations
+  seed [files]          load fixture files of seed pebbles into the database
+  restore file          load a database snapshot into an empty database
+  token [flags]         print a development JWT signed with auth.jwt.secret
+  routes                print the HTTP routes and gRPC methods
+  replay [flags] file   send the requests of a capture file to a server again
+  bench [flags]         send load to a server and report the latencies
+  config validate       check the configuration and report every problem
+  config print-defaults print a config file of the defaults, commented
+  version               print the version and exit
+
+Flags:
+`
+
+// Exit statuses, so that supervisors and scripts can tell why the server
+// stopped.
+const (
+	exitFailure  = 1 // any error not listed below, such as an invalid configuration
+	exitUsage    = 2 // unknown command or bad arguments
+	exitListen   = 3 // a listener could not be bound, such as a port in use
+	exitShutdown = 4 // in-flight requests outlasted the shutdown timeout
+)
+
+func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON, or .yaml or .yml, config file")
+	showVersion := flag.Bool("version", false, "print the version and exit, like the version command")
+	demo := flag.Bool("demo", false, "run with in-memory storage, a fixed API key and sample pebbles, like DEMO=true")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cmd, args := "serve", flag.Args()
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	if *showVersion {
+		cmd = "version"
+	}
+	if *demo {
+		// Through the environment, so that reloads keep demo mode.
+		os.Setenv("DEMO", "true")
+	}
+
+	switch cmd {
+	case "version":
+		printVersion(os.Stdout)
+		return
+	case "config":
+		if len(args) != 1 || args[0] != "validate" && args[0] != "print-defaults" {
+			fmt.Fprintln(os.Stderr, "usage: config validate|print-defaults")
+			os.Exit(exitUsage)
+		}
+		if args[0] == "print-defaults" {
+			if err := writeConfigSample(os.Stdout, DefaultConfig()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(exitFailure)
+			}
+			return
+		}
+		if err := checkConfig(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFailure)
+		}
+		fmt.Println("config is valid")
+		return
+	case "replay", "bench":
+		run := runReplay
+		if cmd == "bench" {
+			run = runBench
+		}
+		if err := run(args, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFailure)
+		}
+		return
+	case "serve", "migrate", "seed", "restore", "token", "routes":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFailure)
+	}
+	var logLevel slog.LevelVar
+	logger, err := newLogger(cfg.Log, &logLevel, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFailure)
+	}
+	slog.SetDefault(logger)
+
+	switch cmd {
+	case "serve":
+		err = runServe(cfg, *configPath, logger, &logLevel)
+		if err != nil {
+			logger.Error("exiting", "error", err, "exit_code", exitCode(err))
+		}
+	case "migrate":
+		err = runMigrate(context.Background(), cfg, logger, args)
+		if err != nil {
+			logger.Error("migration failed", "error", err)
+		}
+	case "seed":
+		err = runSeed(context.Background(), cfg, logger, args)
+		if err != nil {
+			logger.Error("seeding failed", "error", err)
+		}
+	case "restore":
+		err = runRestore(context.Background(), cfg, logger, args)
+		if err != nil {
+			logger.Error("restore failed", "error", err)
+		}
+	case "token":
+		err = runToken(cfg, args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	case "routes":
+		err = runRoutes(cfg, *configPath, logger, &logLevel, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns the exit status for err, a listen failure taking
+// precedence over the shutdown problems that may follow it.
+func exitCode(err error) int {
+	var listenErr *ListenError
+	var shutdownErr *ShutdownError
+	switch {
+	case errors.As(err, &listenErr):
+		return exitListen
+	case errors.As(err, &shutdownErr):
+		return exitShutdown
+	}
+	return exitFailure
+}
+
+// runServe implements the serve command, running the server until it
+// receives SIGINT or SIGTERM.
+func runServe(cfg Config, configPath string, logger *slog.Logger, logLevel *slog.LevelVar) error {
+	b := buildInfo()
+	logger.Info("starting pebble-api", "version", b.Version, "commit", b.Commit, "build_date", b.BuildDate, "go_version", b.GoVersion)
+	a, err := newApp(cfg, configPath, systemClock{}, logger, logLevel)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return a.lc.Run(ctx)
+}
+
+// runRoutes implements the routes command, which prints the middleware
+// every request passes through and the route table the configuration
+// produces, with the permission and middleware of each route.
+func runRoutes(cfg Config, configPath string, logger *slog.Logger, logLevel *slog.LevelVar, w io.Writer) error {
+	a, err := newApp(cfg, configPath, systemClock{}, logger, logLevel)
+	if err != nil {
+		return err
+	}
+	permission := func(pattern string) string {
+		if p, ok := a.perms[pattern]; ok && cfg.Auth.Mode != "none" {
+			return string(p)
+		}
+		return "-"
+	}
+	fmt.Fprintf(w, "every request: %s\n\n", strings.Join(a.middleware, " > "))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tPATH\tPERMISSION\tMIDDLEWARE\tSUMMARY")
+	for _, r := range a.router.Routes() {
+		method, pattern := r.Method, r.Method+" "+r.Path
+		if method == "" {
+			method, pattern = "*", r.Path
+		}
+		mws := strings.Join(r.Middleware, ",")
+		if mws == "" {
+			mws = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", method, r.Path, permission(pattern), mws, r.Doc.Summary)
+	}
+	if cfg.GRPC.Port != 0 {
+		names := slices.Sorted(maps.Keys(a.grpc.methods))
+		for _, name := range names {
+			fmt.Fprintf(tw, "GRPC\t%s\t%s\t-\t\n", name, permission("POST "+name))
+		}
+	}
+	return tw.Flush()
+}
+
+// printVersion implements the version command.
+func printVersion(w io.Writer) {
+	b := buildInfo()
+	fmt.Fprintf(w, "pebble-api %s\n", b.Version)
+	if b.Commit != "" {
+		fmt.Fprintf(w, "commit:     %s\n", b.Commit)
+	}
+	if b.BuildDate != "" {
+		fmt.Fprintf(w, "built:      %s\n", b.BuildDate)
+	}
+	fmt.Fprintf(w, "go version: %s\n", b.GoVersion)
+}
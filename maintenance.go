@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const CodeMaintenance = "maintenance"
+
+// defaultMaintenanceMessage is the message of 503 responses when none was
+// given.
+const defaultMaintenanceMessage = "the service is down for maintenance"
+
+// MaintenanceStatus is whether the API is in maintenance mode, since when,
+// and what clients are told while it is.
+type MaintenanceStatus struct {
+	Enabled           bool       `json:"enabled"`
+	Message           string     `json:"message,omitempty"`
+	RetryAfterSeconds int        `json:"retry_after_seconds"`
+	Since             *time.Time `json:"since,omitempty"`
+}
+
+// Maintenance switches the API in and out of maintenance mode, in which
+// requests get a 503 response telling clients when to retry.
+type Maintenance struct {
+	clock  Clock
+	status atomic.Pointer[MaintenanceStatus]
+}
+
+// NewMaintenance returns the switch set as cfg says, which tells the time
+// maintenance mode was entered by clock.
+func NewMaintenance(cfg MaintenanceConfig, clock Clock) *Maintenance {
+	m := &Maintenance{clock: clock}
+	m.Configure(cfg)
+	return m
+}
+
+// Configure sets the mode to the one in cfg.
+func (m *Maintenance) Configure(cfg MaintenanceConfig) {
+	m.Set(cfg.Enabled, cfg.Message, int(cfg.RetryAfter.Seconds()))
+}
+
+// Set enters maintenance mode if enabled is set and leaves it otherwise.
+// A mode already entered keeps the time it was entered.
+func (m *Maintenance) Set(enabled bool, message string, retryAfterSeconds int) {
+	st := &MaintenanceStatus{Enabled: enabled, Message: message, RetryAfterSeconds: retryAfterSeconds}
+	if enabled {
+		since := m.clock.Now().UTC()
+		if prev := m.status.Load(); prev != nil && prev.Enabled {
+			since = *prev.Since
+		}
+		st.Since = &since
+	}
+	m.status.Store(st)
+}
+
+// Status returns the current mode.
+func (m *Maintenance) Status() MaintenanceStatus {
+	return *m.status.Load()
+}
+
+// Middleware answers requests with a 503 response while in maintenance
+// mode, except those to the paths in exempt, which end in / to exempt
+// everything under them, so that probes can still tell the instance is
+// alive and operators can leave maintenance mode.
+func (m *Maintenance) Middleware(exempt []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			st := m.status.Load()
+			if !st.Enabled || slices.ContainsFunc(exempt, func(p string) bool {
+				return r.URL.Path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p)
+			}) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			msg := st.Message
+			if msg == "" {
+				msg = defaultMaintenanceMessage
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(max(st.RetryAfterSeconds, 1)))
+			WriteError(w, r, NewAPIError(http.StatusServiceUnavailable, CodeMaintenance, msg))
+		})
+	}
+}
+
+// maintenanceRequest is the body of PUT /admin/maintenance.
+type maintenanceRequest struct {
+	Enabled           *bool  `json:"enabled" validate:"required"`
+	Message           string `json:"message" validate:"max=500"`
+	RetryAfterSeconds int    `json:"retry_after_seconds" validate:"min=0"`
+}
+
+// register adds the admin endpoints showing and switching the mode.
+// Leaving RetryAfterSeconds out of a request keeps the current value.
+func (m *Maintenance) register(rt *Router) {
+	rt.Get("/admin/maintenance", func(w http.ResponseWriter, r *http.Request) error {
+		respond(w, r, http.StatusOK, m.Status())
+		return nil
+	})
+	rt.Document("GET", "/admin/maintenance", Operation{Summary: "Show whether the API is in maintenance mode", Tag: "admin", Response: MaintenanceStatus{}})
+	rt.Put("/admin/maintenance", func(w http.ResponseWriter, r *http.Request) error {
+		var in maintenanceRequest
+		if err := Bind(r, &in); err != nil {
+			return err
+		}
+		retryAfter := in.RetryAfterSeconds
+		if retryAfter == 0 {
+			retryAfter = m.Status().RetryAfterSeconds
+		}
+		m.Set(*in.Enabled, in.Message, retryAfter)
+		respond(w, r, http.StatusOK, m.Status())
+		return nil
+	})
+	rt.Document("PUT", "/admin/maintenance", Operation{Summary: "Enter or leave maintenance mode", Tag: "admin", Request: maintenanceRequest{}, Response: MaintenanceStatus{}})
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry holds metrics and serves them in the Prometheus text exposition
+// format.
+type Registry struct {
+	constLabels string
+	mu          sync.Mutex
+	collectors  map[string]collector
+}
+
+// collector writes its metric families. labels are the registry's constant
+// labels, rendered as name="value" pairs, which every sample must carry.
+type collector interface {
+	write(w io.Writer, labels string)
+}
+
+// NewRegistry returns a registry whose samples all carry constLabels, such
+// as the version of the binary.
+func NewRegistry(constLabels map[string]string) *Registry {
+	var pairs []string
+	for _, name := range sortedKeys(constLabels) {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(constLabels[name])))
+	}
+	return &Registry{constLabels: strings.Join(pairs, ","), collectors: make(map[string]collector)}
+}
+
+func (reg *Registry) register(name string, c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.collectors[name]; ok {
+		panic("metric already registered: " + name)
+	}
+	reg.collectors[name] = c
+}
+
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg.mu.Lock()
+		names := make([]string, 0, len(reg.collectors))
+		for name := range reg.collectors {
+			names = append(names, name)
+		}
+		collectors := make([]collector, 0, len(names))
+		sort.Strings(names)
+		for _, name := range names {
+			collectors = append(collectors, reg.collectors[name])
+		}
+		reg.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, c := range collectors {
+			c.write(bw, reg.constLabels)
+		}
+		bw.Flush()
+	})
+}
+
+// desc describes a metric family and the series within it.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, d.typ)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", d.name, len(values), len(d.labels)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w io.Writer, name string, names, values []string, extra string, v float64) {
+	io.WriteString(w, name)
+	if len(names) > 0 || extra != "" {
+		io.WriteString(w, "{")
+		for i, n := range names {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, n, labelValueEscaper.Replace(values[i]))
+		}
+		if extra != "" {
+			if len(names) > 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, extra)
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(v))
+}
+
+// joinLabels joins rendered label lists, either of which may be empty.
+func joinLabels(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "," + b
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type series struct {
+	labels []string
+	value  float64
+}
+
+// valueVec is the shared implementation of counters and gauges.
+type valueVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (v *valueVec) add(delta float64, values []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).value += delta
+}
+
+func (v *valueVec) set(x float64, values []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).value = x
+}
+
+func (v *valueVec) get(values []string) *series {
+	k := v.key(values)
+	s, ok := v.series[k]
+	if !ok {
+		s = &series{labels: slices.Clone(values)}
+		v.series[k] = s
+	}
+	return s
+}
+
+func (v *valueVec) write(w io.Writer, labels string) {
+	v.writeHeader(w)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, k := range sortedKeys(v.series) {
+		s := v.series[k]
+		writeSample(w, v.name, v.labels, s.labels, labels, s.value)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type CounterVec struct {
+	valueVec
+}
+
+func (reg *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{valueVec{desc: desc{name, help, "counter", labels}, series: make(map[string]*series)}}
+	if len(labels) == 0 {
+		c.get(nil)
+	}
+	reg.register(name, c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counter cannot decrease")
+	}
+	c.add(delta, labelValues)
+}
+
+type GaugeVec struct {
+	valueVec
+}
+
+func (reg *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{valueVec{desc: desc{name, help, "gauge", labels}, series: make(map[string]*series)}}
+	if len(labels) == 0 {
+		g.get(nil)
+	}
+	reg.register(name, g)
+	return g
+}
+
+func (g *GaugeVec) Set(x float64, labelValues ...string) {
+	g.set(x, labelValues)
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.add(1, labelValues)
+}
+
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.add(-1, labelValues)
+}
+
+// funcMetric reports the value returned by fn at scrape time.
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+func (f *funcMetric) write(w io.Writer, labels string) {
+	f.writeHeader(w)
+	writeSample(w, f.name, nil, nil, labels, f.fn())
+}
+
+func (reg *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	reg.register(name, &funcMetric{desc{name, help, "gauge", nil}, fn})
+}
+
+func (reg *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	reg.register(name, &funcMetric{desc{name, help, "counter", nil}, fn})
+}
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+func (reg *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	reg.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.key(labelValues)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{labels: slices.Clone(labelValues), counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer, labels string) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		for i, upper := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, s.labels, joinLabels(labels, `le="`+formatFloat(upper)+`"`), float64(s.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labels, joinLabels(labels, `le="+Inf"`), float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labels, labels, s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labels, labels, float64(s.count))
+	}
+}
+
+// runtimeCollector reports Go runtime metrics, reading the memory
+// statistics once per scrape.
+type runtimeCollector struct {
+	start time.Time
+}
+
+func (c runtimeCollector) write(w io.Writer, labels string) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	for _, m := range []struct {
+		name, help, typ string
+		value           float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine())},
+		{"go_gomaxprocs", "Value of GOMAXPROCS.", "gauge", float64(runtime.GOMAXPROCS(0))},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge", float64(ms.Alloc)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", "gauge", float64(ms.HeapObjects)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from the system.", "gauge", float64(ms.Sys)},
+		{"go_gc_cycles_total", "Number of completed GC cycles.", "counter", float64(ms.NumGC)},
+		{"go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", "counter", float64(ms.PauseTotalNs) / 1e9},
+		{"process_start_time_seconds", "Start time of the process since the Unix epoch in seconds.", "gauge", float64(c.start.Unix())},
+	} {
+		d := desc{name: m.name, help: m.help, typ: m.typ}
+		d.writeHeader(w)
+		writeSample(w, m.name, nil, nil, labels, m.value)
+	}
+	d := desc{name: "go_info", help: "Information about the Go environment.", typ: "gauge"}
+	d.writeHeader(w)
+	// go_info keeps its conventional version label, which the constant
+	// labels would clash with.
+	writeSample(w, "go_info", []string{"version"}, []string{runtime.Version()}, "", 1)
+}
+
+// RegisterRuntimeMetrics adds the Go runtime and process metrics to reg.
+func (reg *Registry) RegisterRuntimeMetrics() {
+	reg.register("go_", runtimeCollector{start: time.Now()})
+}
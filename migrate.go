@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds one directory per dialect with files named
+// NNNN_description.up.sql and NNNN_description.down.sql.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), ".")
+		if !ok || !strings.HasSuffix(e.Name(), ".sql") {
+			return nil, fmt.Errorf("unexpected migration file %s", e.Name())
+		}
+		num, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s has no version number", e.Name())
+		}
+		body, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		switch direction {
+		case "up":
+			m.up = string(body)
+		case "down":
+			m.down = string(body)
+		default:
+			return nil, fmt.Errorf("migration file %s is neither up nor down", e.Name())
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d has no up file", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts schema migrations, recording the applied
+// versions in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	rebind     func(string) string
+	migrations []migration
+	logger     *slog.Logger
+}
+
+func (s *sqlStore) Migrator(logger *slog.Logger) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, path.Join("migrations", s.dialect.name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load migrations: %w", err)
+	}
+	return &Migrator{db: s.db, rebind: s.rebind, migrations: migrations, logger: logger}, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]bool, error) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create schema_migrations: %w", err)
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// Up applies all pending migrations in version order.
+func (m *Migrator) Up(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, mig := range m.migrations {
+		if applied[mig.version] {
+			continue
+		}
+		pending++
+		err := m.inTx(ctx, mig.up,
+			"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			mig.version, mig.name, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("cannot apply migration %d %s: %w", mig.version, mig.name, err)
+		}
+		m.logger.Info("applied migration", "version", mig.version, "name", mig.name)
+	}
+	if pending == 0 {
+		m.logger.Debug("database schema is up to date")
+	}
+	return nil
+}
+
+// Down reverts the most recently applied steps migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		mig := m.migrations[i]
+		if !applied[mig.version] {
+			continue
+		}
+		if mig.down == "" {
+			return fmt.Errorf("migration %d %s cannot be reverted", mig.version, mig.name)
+		}
+		err := m.inTx(ctx, mig.down, "DELETE FROM schema_migrations WHERE version = ?", mig.version)
+		if err != nil {
+			return fmt.Errorf("cannot revert migration %d %s: %w", mig.version, mig.name, err)
+		}
+		m.logger.Info("reverted migration", "version", mig.version, "name", mig.name)
+		steps--
+	}
+	return nil
+}
+
+// inTx runs the migration script and the bookkeeping statement in one
+// transaction.
+func (m *Migrator) inTx(ctx context.Context, script, record string, args ...any) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.rebind(record), args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrate implements the migrate command: "migrate up" or
+// "migrate down [steps]".
+func runMigrate(ctx context.Context, cfg Config, logger *slog.Logger, args []string) error {
+	if cfg.Storage.Backend == "memory" {
+		return fmt.Errorf("migrate requires a sqlite or postgres storage backend")
+	}
+	store, err := newSQLStore(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	m, err := store.Migrator(logger)
+	if err != nil {
+		return err
+	}
+	direction := "up"
+	if len(args) > 0 {
+		direction = args[0]
+	}
+	switch direction {
+	case "up":
+		return m.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		return m.Down(ctx, steps)
+	}
+	return fmt.Errorf("unknown migrate direction %q, want up or down", direction)
+}
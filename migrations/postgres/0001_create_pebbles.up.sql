@@ -0,0 +1,8 @@
+CREATE TABLE pebbles (
+	id UUID PRIMARY KEY,
+	name TEXT NOT NULL,
+	color TEXT NOT NULL,
+	weight_grams INTEGER NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,22 @@
+CREATE TABLE webhooks (
+	id UUID PRIMARY KEY,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE webhook_deliveries (
+	id UUID PRIMARY KEY,
+	webhook_id UUID NOT NULL,
+	event_id BIGINT NOT NULL,
+	event_type TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	response_status INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, created_at);
@@ -0,0 +1,21 @@
+CREATE TABLE audit_log (
+	id UUID PRIMARY KEY,
+	time TIMESTAMPTZ NOT NULL,
+	request_id TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	method TEXT NOT NULL,
+	resource TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	changes JSONB NOT NULL
+);
+
+CREATE INDEX audit_log_time ON audit_log (time);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END
+$$;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
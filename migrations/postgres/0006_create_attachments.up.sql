@@ -0,0 +1,11 @@
+CREATE TABLE attachments (
+	id UUID PRIMARY KEY,
+	pebble_id UUID NOT NULL,
+	filename TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	sha256 TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX attachments_pebble_id ON attachments (pebble_id, created_at);
@@ -0,0 +1,3 @@
+DROP INDEX pebbles_tenant_id;
+ALTER TABLE api_keys DROP COLUMN tenant_id;
+ALTER TABLE pebbles DROP COLUMN tenant_id;
@@ -0,0 +1,5 @@
+CREATE TABLE outbox (
+	id BIGSERIAL PRIMARY KEY,
+	event JSONB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
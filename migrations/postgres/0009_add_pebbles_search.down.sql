@@ -0,0 +1,2 @@
+DROP INDEX pebbles_search;
+ALTER TABLE pebbles DROP COLUMN search;
@@ -0,0 +1,5 @@
+ALTER TABLE pebbles ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+	setweight(to_tsvector('simple', name), 'A') || setweight(to_tsvector('simple', color), 'B')
+) STORED;
+
+CREATE INDEX pebbles_search ON pebbles USING GIN (search);
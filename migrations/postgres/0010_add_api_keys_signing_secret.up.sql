@@ -0,0 +1 @@
+ALTER TABLE api_keys ADD COLUMN signing_secret TEXT NOT NULL DEFAULT '';
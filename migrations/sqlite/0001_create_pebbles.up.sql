@@ -0,0 +1,8 @@
+CREATE TABLE pebbles (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	color TEXT NOT NULL,
+	weight_grams INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
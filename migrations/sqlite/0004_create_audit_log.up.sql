@@ -0,0 +1,22 @@
+CREATE TABLE audit_log (
+	id TEXT PRIMARY KEY,
+	time TIMESTAMP NOT NULL,
+	request_id TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	method TEXT NOT NULL,
+	resource TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	changes TEXT NOT NULL
+);
+
+CREATE INDEX audit_log_time ON audit_log (time);
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
@@ -0,0 +1,2 @@
+DROP INDEX pebbles_deleted_at;
+ALTER TABLE pebbles DROP COLUMN deleted_at;
@@ -0,0 +1,3 @@
+ALTER TABLE pebbles ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX pebbles_deleted_at ON pebbles (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,4 @@
+ALTER TABLE pebbles ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_keys ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX pebbles_tenant_id ON pebbles (tenant_id, created_at);
@@ -0,0 +1,5 @@
+CREATE TABLE outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,4 @@
+DROP TRIGGER pebbles_search_delete;
+DROP TRIGGER pebbles_search_update;
+DROP TRIGGER pebbles_search_insert;
+DROP TABLE pebbles_search;
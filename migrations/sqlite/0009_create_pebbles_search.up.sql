@@ -0,0 +1,18 @@
+CREATE VIRTUAL TABLE pebbles_search USING fts5(id UNINDEXED, name, color);
+
+INSERT INTO pebbles_search (id, name, color) SELECT id, name, color FROM pebbles;
+
+CREATE TRIGGER pebbles_search_insert AFTER INSERT ON pebbles
+BEGIN
+	INSERT INTO pebbles_search (id, name, color) VALUES (NEW.id, NEW.name, NEW.color);
+END;
+
+CREATE TRIGGER pebbles_search_update AFTER UPDATE OF name, color ON pebbles
+BEGIN
+	UPDATE pebbles_search SET name = NEW.name, color = NEW.color WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER pebbles_search_delete AFTER DELETE ON pebbles
+BEGIN
+	DELETE FROM pebbles_search WHERE id = OLD.id;
+END;
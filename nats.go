@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPublisher is a Publisher sending events to a NATS server as
+// <prefix>.<event type> subjects, speaking just enough of the NATS client
+// protocol to publish. Events are queued and sent by run, which
+// reconnects when the connection is lost; events that arrive while the
+// queue is full are dropped.
+type natsPublisher struct {
+	url    *url.URL
+	prefix string
+	queue  chan Event
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	connected bool
+}
+
+func newNATSPublisher(rawURL, prefix string, queue int, logger *slog.Logger) (*natsPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q", rawURL)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return &natsPublisher{url: u, prefix: prefix, queue: make(chan Event, queue), logger: logger}, nil
+}
+
+var errNATSQueueFull = errors.New("nats: publish queue is full")
+
+func (p *natsPublisher) Publish(ctx context.Context, e Event) error {
+	select {
+	case p.queue <- e:
+		return nil
+	default:
+		return errNATSQueueFull
+	}
+}
+
+// Check reports whether the publisher is connected, for readiness checks.
+func (p *natsPublisher) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected {
+		return errors.New("not connected to NATS")
+	}
+	return nil
+}
+
+func (p *natsPublisher) setConnected(v bool) {
+	p.mu.Lock()
+	p.connected = v
+	p.mu.Unlock()
+}
+
+// run keeps a connection to the server and publishes queued events until
+// ctx is done, backing off between failed connection attempts.
+func (p *natsPublisher) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := p.session(ctx)
+		p.setConnected(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		p.logger.Warn("NATS connection lost", "server", p.url.Host, "error", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+}
+
+// session connects, handshakes and publishes until the connection fails
+// or ctx is done.
+func (p *natsPublisher) session(ctx context.Context) error {
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	conn, err := d.DialContext(dialCtx, "tcp", p.url.Host)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	c := natsConnect{Name: "pebble-api", Lang: "go", Version: "1.0.0", Protocol: 1}
+	if u := p.url.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			c.User, c.Pass = u.Username(), pass
+		} else {
+			c.Token = u.Username()
+		}
+	}
+	b, _ := json.Marshal(c)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", b); err != nil {
+		return err
+	}
+	// The server answers PING with PONG once it has accepted CONNECT, or
+	// with -ERR if it has not.
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			return fmt.Errorf("nats: %s", line)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	p.setConnected(true)
+	p.logger.Info("connected to NATS", "server", p.url.Host)
+
+	var wmu sync.Mutex
+	write := func(s string) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Write([]byte(s))
+		return err
+	}
+
+	// Answer the server's keepalive pings and notice errors.
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				readErr <- err
+				return
+			}
+			switch line = strings.TrimSpace(line); {
+			case line == "PING":
+				if err := write("PONG\r\n"); err != nil {
+					readErr <- err
+					return
+				}
+			case strings.HasPrefix(line, "-ERR"):
+				readErr <- fmt.Errorf("nats: %s", line)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			return err
+		case e := <-p.queue:
+			b, _ := json.Marshal(e)
+			subject := p.prefix + "." + e.Type
+			if err := write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(b), b)); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcFlowCookie holds the state of a login between /auth/login and
+// /auth/callback.
+const oidcFlowCookie = "pebble_oidc"
+
+// oidcFlowTTL is how long a user has to log in at the provider.
+const oidcFlowTTL = 10 * time.Minute
+
+// oidcProvider is the part of an OIDC discovery document a login needs.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcFlow is what the flow cookie holds: the state and nonce that tie
+// the callback to the login, the PKCE code verifier and where to send the
+// user once logged in.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+	Expires  int64  `json:"exp"`
+}
+
+// oidcLogin logs users of the frontend in with the authorization code flow
+// and PKCE against an OIDC provider, and starts a session for them that
+// its sessions then authenticate. The provider's discovery document is
+// read on the first login.
+type oidcLogin struct {
+	cfg      OIDCConfig
+	client   *http.Client
+	sealer   *cookieSealer
+	sessions *sessionManager
+	secure   bool
+	clock    Clock
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	verifier *JWTVerifier
+}
+
+func newOIDCLogin(cfg OIDCConfig, store SessionStore, clock Clock, logger *slog.Logger) *oidcLogin {
+	redirect, _ := url.Parse(cfg.RedirectURL)
+	secure := redirect.Scheme == "https"
+	return &oidcLogin{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		sealer: newCookieSealer(cfg.SessionKey),
+		sessions: &sessionManager{
+			store:  store,
+			ttl:    cfg.SessionTTL.Duration,
+			maxAge: cfg.SessionMaxAge.Duration,
+			origin: redirect.Scheme + "://" + redirect.Host,
+			csrf:   newCSRFTokens(cfg.SessionKey),
+			secure: secure,
+			logger: logger,
+			now:    clock.Now,
+		},
+		secure: secure,
+		clock:  clock,
+		logger: logger,
+	}
+}
+
+func (o *oidcLogin) register(rt *Router) {
+	rt.Get("/auth/login", o.login)
+	rt.Get("/auth/callback", o.callback)
+	rt.Post("/auth/logout", o.logout)
+	rt.Get("/auth/me", o.me)
+	rt.Get("/auth/csrf", o.csrf)
+
+	rt.Document("GET", "/auth/login", Operation{Summary: "Log in with the OIDC provider", Tag: "auth", Status: http.StatusFound})
+	rt.Document("GET", "/auth/callback", Operation{Summary: "Finish logging in with the OIDC provider", Tag: "auth", Status: http.StatusFound})
+	rt.Document("POST", "/auth/logout", Operation{Summary: "Log out", Tag: "auth", Status: http.StatusNoContent})
+	rt.Document("GET", "/auth/me", Operation{Summary: "Show the logged in user", Tag: "auth", Response: sessionUser{}})
+	rt.Document("GET", "/auth/csrf", Operation{Summary: "Get the CSRF token of the session", Tag: "auth", Response: csrfToken{}})
+}
+
+// discover returns the provider and a verifier of its ID tokens, reading
+// its discovery document the first time.
+func (o *oidcLogin) discover(ctx context.Context) (*oidcProvider, *JWTVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return o.provider, o.verifier, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(o.cfg.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot fetch OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("cannot fetch OIDC discovery document: %s", resp.Status)
+	}
+	var p oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode OIDC discovery document: %w", err)
+	}
+	if p.Issuer != o.cfg.Issuer {
+		return nil, nil, fmt.Errorf("OIDC discovery document is for issuer %q", p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, nil, errors.New("OIDC discovery document lacks an endpoint")
+	}
+	// The keys are fetched when a token names one that is not loaded, so
+	// they need no refreshing in the background.
+	keys := newJWKSet(p.JWKSURI, o.clock, o.logger)
+	o.provider = &p
+	o.verifier = &JWTVerifier{keys: keys.Key, issuer: p.Issuer, audience: o.cfg.ClientID, leeway: time.Minute, now: o.clock.Now}
+	return o.provider, o.verifier, nil
+}
+
+// randomToken returns n random bytes in base64url.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// localPath reports whether p is a path on this server, so that return_to
+// cannot send users elsewhere.
+func localPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+// login sends the user to the provider to log in, to come back to
+// /auth/callback and then to the return_to path.
+func (o *oidcLogin) login(w http.ResponseWriter, r *http.Request) error {
+	p, _, err := o.discover(r.Context())
+	if err != nil {
+		o.logger.ErrorContext(r.Context(), "cannot reach the OIDC provider", "error", err)
+		return NewAPIError(http.StatusBadGateway, CodeBadGateway, "the identity provider could not be reached")
+	}
+	flow := oidcFlow{
+		State:    randomToken(16),
+		Nonce:    randomToken(16),
+		Verifier: randomToken(32),
+		ReturnTo: r.URL.Query().Get("return_to"),
+		Expires:  o.clock.Now().Add(oidcFlowTTL).Unix(),
+	}
+	if !localPath(flow.ReturnTo) {
+		flow.ReturnTo = "/"
+	}
+	value, err := o.sealer.seal(oidcFlowCookie, flow)
+	if err != nil {
+		return Internal(err)
+	}
+	setSessionCookie(w, oidcFlowCookie, "/", value, int(oidcFlowTTL/time.Second), o.secure)
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	u, err := url.Parse(p.AuthorizationEndpoint)
+	if err != nil {
+		return Internal(err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", o.cfg.ClientID)
+	q.Set("redirect_uri", o.cfg.RedirectURL)
+	q.Set("scope", strings.Join(o.cfg.Scopes, " "))
+	q.Set("state", flow.State)
+	q.Set("nonce", flow.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return nil
+}
+
+// callback exchanges the code the provider sent the user back with for an
+// ID token, checks it and starts the session.
+func (o *oidcLogin) callback(w http.ResponseWriter, r *http.Request) error {
+	var flow oidcFlow
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err == nil {
+		err = o.sealer.open(oidcFlowCookie, cookie.Value, &flow)
+	}
+	if err != nil || o.clock.Now().Unix() >= flow.Expires {
+		return Unauthorized("the login has expired or was started in another browser; log in again")
+	}
+	setSessionCookie(w, oidcFlowCookie, "/", "", -1, o.secure)
+	q := r.URL.Query()
+	if q.Get("state") != flow.State {
+		return Unauthorized("the login state does not match; log in again")
+	}
+	if e := q.Get("error"); e != "" {
+		return Unauthorized("the identity provider refused the login: " + strings.TrimSpace(e+" "+q.Get("error_description")))
+	}
+	code := q.Get("code")
+	if code == "" {
+		return Invalid(ValidationErrors{{Field: "code", Message: "is required"}}, "invalid callback parameters")
+	}
+
+	p, verifier, err := o.discover(r.Context())
+	if err != nil {
+		o.logger.ErrorContext(r.Context(), "cannot reach the OIDC provider", "error", err)
+		return NewAPIError(http.StatusBadGateway, CodeBadGateway, "the identity provider could not be reached")
+	}
+	idToken, err := o.exchange(r.Context(), p, code, flow.Verifier)
+	if err != nil {
+		o.logger.WarnContext(r.Context(), "OIDC code exchange failed", "error", err)
+		return NewAPIError(http.StatusBadGateway, CodeBadGateway, "the identity provider did not issue a token")
+	}
+	claims, err := verifier.Verify(idToken)
+	if err != nil {
+		o.logger.WarnContext(r.Context(), "OIDC ID token rejected", "error", err)
+		return Unauthorized("the identity provider issued an invalid token")
+	}
+	if nonce, _ := claims.Raw["nonce"].(string); nonce != flow.Nonce {
+		return Unauthorized("the ID token was not issued for this login")
+	}
+
+	if err := o.sessions.start(w, r, claims, slices.Concat(o.cfg.SessionScopes, claims.Scopes)); err != nil {
+		return Internal(err)
+	}
+	slog.InfoContext(r.Context(), "user logged in", "subject", claims.Subject)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, flow.ReturnTo, http.StatusFound)
+	return nil
+}
+
+// exchange trades code for an ID token at the provider's token endpoint,
+// proving with verifier that it is the client that started the login.
+func (o *oidcLogin) exchange(ctx context.Context, p *oidcProvider, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if o.cfg.ClientSecret == "" {
+		form.Set("client_id", o.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded with %s: %s", resp.Status, abbreviate(body))
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("cannot decode token response: %w", err)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return token.IDToken, nil
+}
+
+func (o *oidcLogin) logout(w http.ResponseWriter, r *http.Request) error {
+	if err := o.sessions.end(w, r); err != nil {
+		return Internal(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// sessionUser is the body of GET /auth/me.
+type sessionUser struct {
+	Subject   string    `json:"subject"`
+	Name      string    `json:"name,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// me shows the user of the session, whatever other credentials the
+// request carries.
+func (o *oidcLogin) me(w http.ResponseWriter, r *http.Request) error {
+	s := o.sessions.session(r.Context())
+	if s == nil {
+		return Unauthorized("not logged in")
+	}
+	u := sessionUser{Subject: s.Subject, Scopes: s.Scopes, ExpiresAt: s.Expires}
+	u.Name, _ = s.Claims["name"].(string)
+	u.Email, _ = s.Claims["email"].(string)
+	if u.Scopes == nil {
+		u.Scopes = []string{}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respond(w, r, http.StatusOK, u)
+	return nil
+}
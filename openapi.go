@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openAPI builds an OpenAPI 3 document from the routes registered on a
+// Router, deriving the schemas of request and response bodies from their
+// Go types.
+type openAPI struct {
+	title    string
+	version  string
+	authMode string
+	perms    map[string]Permission
+	schemas  map[string]any
+}
+
+var pathParam = regexp.MustCompile(`\{([^}.$]+)(\.\.\.)?\}`)
+
+// OpenAPIHandler serves the OpenAPI document for the routes of rt, which
+// require perms, as JSON. The document is built on the first request, once
+// every route has been registered. rootPaths are the paths and path
+// prefixes that stay at the root when the API is mounted under a base path.
+func OpenAPIHandler(rt *Router, perms map[string]Permission, title, version, authMode string, rootPaths []string) http.Handler {
+	doc := sync.OnceValue(func() map[string]any {
+		b := &openAPI{title: title, version: version, authMode: authMode, perms: perms}
+		return b.document(rt.Routes())
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The document only changes with a new release.
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		d := doc()
+		if base := BasePath(r.Context()); base != "" {
+			paths := map[string]map[string]any{}
+			for p, ops := range d["paths"].(map[string]map[string]any) {
+				atRoot := slices.ContainsFunc(rootPaths, func(root string) bool {
+					return p == root || strings.HasSuffix(root, "/") && strings.HasPrefix(p, root)
+				})
+				if !atRoot && !apiVersionPath.MatchString(p) {
+					p = base + p
+				}
+				paths[p] = ops
+			}
+			d = maps.Clone(d)
+			d["paths"] = paths
+		}
+		writeJSON(w, http.StatusOK, d)
+	})
+}
+
+func (b *openAPI) document(routes []Route) map[string]any {
+	b.schemas = map[string]any{}
+	errorRef := b.schema(reflect.TypeFor[errorResponse]())
+	paths := map[string]map[string]any{}
+	for _, route := range routes {
+		if route.Method == "" || route.Method == http.MethodHead {
+			continue
+		}
+		path := strings.TrimSuffix(route.Path, "{$}")
+		if path == "" {
+			path = "/"
+		}
+		path = pathParam.ReplaceAllString(path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(route.Method)] = b.operation(route, errorRef)
+	}
+
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": b.title, "version": b.version},
+		"paths":   paths,
+	}
+	components := map[string]any{"schemas": b.schemas}
+	switch b.authMode {
+	case "jwt":
+		components["securitySchemes"] = map[string]any{
+			"bearer": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+		}
+	case "api_key":
+		components["securitySchemes"] = map[string]any{
+			"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+		}
+	}
+	doc["components"] = components
+	return doc
+}
+
+func (b *openAPI) operation(route Route, errorRef map[string]any) map[string]any {
+	op := map[string]any{}
+	if route.Doc.Summary != "" {
+		op["summary"] = route.Doc.Summary
+	}
+	if route.Doc.Tag != "" {
+		op["tags"] = []string{route.Doc.Tag}
+	}
+	var params []any
+	for _, m := range pathParam.FindAllStringSubmatch(route.Path, -1) {
+		params = append(params, map[string]any{
+			"name": m[1], "in": "path", "required": true,
+			"schema": map[string]any{"type": "string"},
+		})
+	}
+	hasPathParams := params != nil
+	if l := route.Doc.List; l != nil {
+		params = append(params, listParameters(*l)...)
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if route.Doc.Request != nil {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content":  jsonContent(b.schema(reflect.TypeOf(route.Doc.Request))),
+		}
+	}
+
+	status := route.Doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]any{"description": http.StatusText(status)}
+	if route.Doc.Response != nil {
+		ok["content"] = jsonContent(b.schema(reflect.TypeOf(route.Doc.Response)))
+	}
+	responses := map[string]any{strconv.Itoa(status): ok}
+	errorResp := func(status int) {
+		responses[strconv.Itoa(status)] = map[string]any{
+			"description": http.StatusText(status),
+			"content":     jsonContent(errorRef),
+		}
+	}
+	if params != nil || route.Doc.Request != nil {
+		errorResp(http.StatusBadRequest)
+	}
+	if hasPathParams {
+		errorResp(http.StatusNotFound)
+	}
+	if route.Doc.Request != nil {
+		errorResp(http.StatusRequestEntityTooLarge)
+		errorResp(http.StatusUnsupportedMediaType)
+	}
+	if perm, ok := b.perms[route.Method+" "+route.Path]; ok && b.authMode != "none" {
+		errorResp(http.StatusUnauthorized)
+		errorResp(http.StatusForbidden)
+		scheme := "bearer"
+		if b.authMode == "api_key" {
+			scheme = "apiKey"
+		}
+		op["security"] = []any{map[string]any{scheme: []string{}}}
+		op["description"] = "Requires the " + string(perm) + " permission."
+	}
+	errorResp(http.StatusInternalServerError)
+	op["responses"] = responses
+	return op
+}
+
+func listParameters(l ListParams) []any {
+	typeSchema := func(t FieldType) map[string]any {
+		switch t {
+		case IntField:
+			return map[string]any{"type": "integer"}
+		case TimeField:
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		return map[string]any{"type": "string"}
+	}
+	var sorts []string
+	for field := range l.Sortable {
+		sorts = append(sorts, field, field+":asc", field+":desc")
+	}
+	slices.Sort(sorts)
+	params := []any{
+		map[string]any{"name": "limit", "in": "query", "schema": map[string]any{
+			"type": "integer", "minimum": 1, "maximum": l.MaxLimit, "default": l.DefaultLimit}},
+		map[string]any{"name": "cursor", "in": "query", "description": "next_cursor of the previous page",
+			"schema": map[string]any{"type": "string"}},
+		map[string]any{"name": "sort", "in": "query", "schema": map[string]any{
+			"type": "string", "enum": sorts, "default": l.DefaultSort.String()}},
+	}
+	for _, field := range slices.Sorted(maps.Keys(l.Filterable)) {
+		params = append(params, map[string]any{
+			"name": field, "in": "query", "description": "only items whose " + field + " equals the value",
+			"schema": typeSchema(l.Filterable[field]),
+		})
+	}
+	return params
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// schema returns the schema for t, adding named struct types to the
+// components and referring to them.
+func (b *openAPI) schema(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		s := b.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := b.schemas[name]; !ok {
+			b.schemas[name] = nil // guards against recursive types
+			b.schemas[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+func (b *openAPI) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	b.fields(t, props, &required)
+	obj := map[string]any{"type": "object", "properties": props}
+	if required != nil {
+		obj["required"] = required
+	}
+	return obj
+}
+
+// fields adds the JSON fields of struct t to props, flattening embedded
+// structs as encoding/json does, and records the fields whose validate
+// tag makes them required.
+func (b *openAPI) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.fields(f.Type, props, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := b.schema(f.Type)
+		for _, r := range parseRules(f.Tag.Get("validate")) {
+			if r.name == "required" {
+				*required = append(*required, name)
+				continue
+			}
+			constrain(s, r)
+		}
+		props[name] = s
+	}
+}
+
+// constrain adds the schema keyword matching a validation rule to s.
+func constrain(s map[string]any, r rule) {
+	n, _ := strconv.ParseFloat(r.arg, 64)
+	switch t := s["type"]; {
+	case r.name == "min" && t == "string":
+		s["minLength"] = n
+	case r.name == "max" && t == "string":
+		s["maxLength"] = n
+	case r.name == "min" && t == "array":
+		s["minItems"] = n
+	case r.name == "max" && t == "array":
+		s["maxItems"] = n
+	case r.name == "min":
+		s["minimum"] = n
+	case r.name == "max":
+		s["maximum"] = n
+	case r.name == "email", r.name == "uuid":
+		s["format"] = r.name
+	case r.name == "oneof":
+		s["enum"] = strings.Fields(r.arg)
+	}
+}
+
+// schemaName turns a Go type name such as listResponse[main.Pebble] into a
+// component name such as PebbleList.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if base, arg, ok := strings.Cut(name, "["); ok {
+		arg = strings.TrimSuffix(arg, "]")
+		arg = arg[strings.LastIndex(arg, ".")+1:]
+		switch base {
+		case "listResponse":
+			return arg + "List"
+		}
+		return fmt.Sprintf("%s%s", arg, strings.ToUpper(base[:1])+base[1:])
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// swaggerUI is a page that renders the document at openapi.json, next to
+// the page wherever the API is mounted, with Swagger UI loaded from a CDN.
+const swaggerUI = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>API documentation</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// swaggerUIContentSecurityPolicy replaces that of the security headers on
+// the page, letting it load Swagger UI from the CDN, run the script that
+// starts it and fetch the document.
+const swaggerUIContentSecurityPolicy = "default-src 'none'; script-src https://unpkg.com 'unsafe-inline'; style-src https://unpkg.com; img-src 'self' data:; connect-src 'self'; frame-ancestors 'none'"
+
+func swaggerUIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", swaggerUIContentSecurityPolicy)
+		w.Write([]byte(swaggerUI))
+	})
+}
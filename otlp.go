@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// otlpExporter sends finished spans to an OpenTelemetry collector using
+// OTLP over HTTP with JSON encoding. Spans are queued and sent in batches
+// by run; when the queue is full new spans are dropped rather than slowing
+// down requests.
+type otlpExporter struct {
+	url      string
+	headers  map[string]string
+	service  string
+	batch    int
+	interval time.Duration
+	client   *http.Client
+	logger   *slog.Logger
+
+	queue   chan *Span
+	dropped atomic.Int64
+}
+
+// newOTLPExporter returns an exporter posting to the /v1/traces path of
+// endpoint. headers are "key=value" pairs sent with every export, as read
+// from OTEL_EXPORTER_OTLP_HEADERS.
+func newOTLPExporter(endpoint string, headers []string, service string, batch int, interval time.Duration, logger *slog.Logger) (*otlpExporter, error) {
+	e := &otlpExporter{
+		url:      strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers:  make(map[string]string),
+		service:  service,
+		batch:    batch,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+		queue:    make(chan *Span, 8*batch),
+	}
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("tracing header %q is not key=value", h)
+		}
+		e.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return e, nil
+}
+
+func (e *otlpExporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// run exports queued spans whenever a batch is full or interval has
+// passed, until ctx is cancelled. It then exports what is left, giving the
+// collector a few seconds.
+func (e *otlpExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var spans []*Span
+	flush := func(ctx context.Context) {
+		if n := e.dropped.Swap(0); n > 0 {
+			e.logger.Warn("dropped spans because the export queue was full", "spans", n)
+		}
+		if len(spans) == 0 {
+			return
+		}
+		if err := e.export(ctx, spans); err != nil {
+			e.logger.Warn("cannot export spans", "spans", len(spans), "error", err)
+		}
+		spans = spans[:0]
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			spans = append(spans, s)
+			if len(spans) >= e.batch {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			for len(e.queue) > 0 {
+				spans = append(spans, <-e.queue)
+			}
+			stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			flush(stopCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+func (e *otlpExporter) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding, as defined by the opentelemetry-proto
+// repository. Trace and span IDs are hex strings and times are decimal
+// strings of nanoseconds.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	// Code is 0 for unset and 2 for error.
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func (e *otlpExporter) request(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			TraceState:        s.TraceState,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.Parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		if s.failed {
+			o.Status = otlpStatus{Code: 2, Message: s.errorDesc}
+		}
+		s.mu.Unlock()
+		out[i] = o
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{otlpAttr("service.name", e.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "pebble-api"}, Spans: out}},
+	}}}
+}
+
+func otlpAttr(key string, v any) otlpKeyValue {
+	var value map[string]any
+	switch v := v.(type) {
+	case string:
+		value = map[string]any{"stringValue": v}
+	case bool:
+		value = map[string]any{"boolValue": v}
+	case int:
+		value = map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		value = map[string]any{"doubleValue": v}
+	default:
+		value = map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpKeyValue{Key: key, Value: value}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Outbox keeps the events of changes in the database that holds the
+// changes, so that an event is kept exactly when its change commits.
+// AppendOutbox adds an event within the transaction of ctx, and
+// RelayOutbox hands the oldest events to publish and removes those it
+// published.
+type Outbox interface {
+	AppendOutbox(ctx context.Context, e Event) error
+	RelayOutbox(ctx context.Context, limit int, publish func(ctx context.Context, e Event) error) (int, error)
+}
+
+// outboxStore is the publishingStore of stores with an outbox: every
+// change to the pebbles is made in a transaction together with adding its
+// event to the outbox, and the relay is woken once it commits. An event is
+// then never lost to a crash between the change and its publishing, nor
+// published for a change that was rolled back.
+type outboxStore struct {
+	Store
+	outbox Outbox
+	relay  *OutboxRelay
+	clock  Clock
+}
+
+// change runs fn and adds the event it returns to the outbox, in one
+// transaction.
+func (s outboxStore) change(ctx context.Context, fn func(ctx context.Context) (Event, error)) error {
+	return transact(ctx, s.Store, func(ctx context.Context) error {
+		e, err := fn(ctx)
+		if err != nil {
+			return err
+		}
+		e.Time = s.clock.Now().UTC()
+		if err := s.outbox.AppendOutbox(ctx, e); err != nil {
+			return err
+		}
+		afterCommit(ctx, s.relay.Notify)
+		return nil
+	})
+}
+
+func (s outboxStore) Create(ctx context.Context, p Pebble) error {
+	return s.change(ctx, func(ctx context.Context) (Event, error) {
+		return Event{Type: EventPebbleCreated, PebbleID: p.ID, Pebble: &p, Tenant: p.Tenant}, s.Store.Create(ctx, p)
+	})
+}
+
+func (s outboxStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	return s.change(ctx, func(ctx context.Context) (Event, error) {
+		return Event{Type: EventPebbleUpdated, PebbleID: p.ID, Pebble: &p, Tenant: p.Tenant}, s.Store.Update(ctx, p, prev)
+	})
+}
+
+func (s outboxStore) Delete(ctx context.Context, id string, at time.Time) error {
+	return s.change(ctx, func(ctx context.Context) (Event, error) {
+		return Event{Type: EventPebbleDeleted, PebbleID: id, Tenant: TenantFromContext(ctx)}, s.Store.Delete(ctx, id, at)
+	})
+}
+
+func (s outboxStore) Restore(ctx context.Context, id string) error {
+	return s.change(ctx, func(ctx context.Context) (Event, error) {
+		if err := s.Store.Restore(ctx, id); err != nil {
+			return Event{}, err
+		}
+		p, err := s.Store.Get(ctx, id)
+		return Event{Type: EventPebbleRestored, PebbleID: id, Pebble: &p, Tenant: p.Tenant}, err
+	})
+}
+
+// OutboxRelay publishes the events of an outbox, oldest first, whenever it
+// is notified of new ones and every interval in case it was not, such as
+// for events left by another instance or before a restart. An event is
+// only removed once published, and one that fails is tried again with
+// those after it at the next interval, so every event is published at
+// least once, and some more than once.
+type OutboxRelay struct {
+	outbox   Outbox
+	pub      Publisher
+	interval time.Duration
+	batch    int
+	wake     chan struct{}
+	logger   *slog.Logger
+}
+
+// NewOutboxRelay returns a relay publishing the events of outbox to pub,
+// in batches of up to cfg.BatchSize.
+func NewOutboxRelay(outbox Outbox, pub Publisher, cfg OutboxConfig, logger *slog.Logger) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:   outbox,
+		pub:      pub,
+		interval: cfg.PollInterval.Duration,
+		batch:    cfg.BatchSize,
+		wake:     make(chan struct{}, 1),
+		logger:   logger,
+	}
+}
+
+// Notify wakes the relay up to publish new events. It never blocks.
+func (r *OutboxRelay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run relays events until ctx is done.
+func (r *OutboxRelay) run(ctx context.Context) {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		r.relay(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// relay publishes batches of events until the outbox is empty or
+// publishing fails.
+func (r *OutboxRelay) relay(ctx context.Context) {
+	for {
+		n, err := r.outbox.RelayOutbox(ctx, r.batch, r.pub.Publish)
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.WarnContext(ctx, "cannot relay events from the outbox", "published", n, "error", err)
+			}
+			return
+		}
+		if n < r.batch {
+			return
+		}
+	}
+}
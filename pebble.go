@@ -0,0 +1,87 @@
+package main
+
+import "time"
+
+// Pebble is the demo resource served under /pebbles. DeletedAt is set
+// once it has been deleted, until it is restored or purged. Tenant is the
+// tenant it belongs to when tenancy is enabled.
+type Pebble struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Color       string     `json:"color"`
+	WeightGrams int        `json:"weight_grams"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Tenant      string     `json:"tenant,omitempty"`
+}
+
+// pebbleInput is the request body for creating or replacing a pebble.
+type pebbleInput struct {
+	Name        string `json:"name" validate:"required,max=100"`
+	Color       string `json:"color" validate:"max=30"`
+	WeightGrams int    `json:"weight_grams" validate:"min=0"`
+}
+
+// pebblePatch is the request body for a partial update. Fields left out of
+// the body are not changed.
+type pebblePatch struct {
+	Name        *string `json:"name" validate:"min=1,max=100"`
+	Color       *string `json:"color" validate:"max=30"`
+	WeightGrams *int    `json:"weight_grams" validate:"min=0"`
+}
+
+func (in pebbleInput) apply(p *Pebble) {
+	p.Name = in.Name
+	p.Color = in.Color
+	p.WeightGrams = in.WeightGrams
+}
+
+func (in pebblePatch) apply(p *Pebble) {
+	if in.Name != nil {
+		p.Name = *in.Name
+	}
+	if in.Color != nil {
+		p.Color = *in.Color
+	}
+	if in.WeightGrams != nil {
+		p.WeightGrams = *in.WeightGrams
+	}
+}
+
+// pebbleListParams are the sort and filter fields of GET /pebbles.
+var pebbleListParams = ListParams{
+	Sortable: map[string]FieldType{
+		"name":         StringField,
+		"color":        StringField,
+		"weight_grams": IntField,
+		"created_at":   TimeField,
+		"updated_at":   TimeField,
+	},
+	Filterable: map[string]FieldType{
+		"name":         StringField,
+		"color":        StringField,
+		"weight_grams": IntField,
+	},
+	DefaultSort:  Sort{Field: "created_at"},
+	DefaultLimit: 50,
+	MaxLimit:     200,
+}
+
+// field returns the value of the named field in the form FieldType.parse
+// produces.
+func (p Pebble) field(name string) any {
+	switch name {
+	case "name":
+		return p.Name
+	case "color":
+		return p.Color
+	case "weight_grams":
+		return int64(p.WeightGrams)
+	case "created_at":
+		return p.CreatedAt
+	case "updated_at":
+		return p.UpdatedAt
+	}
+	panic("pebble: unknown field " + name)
+}
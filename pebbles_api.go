@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxBodyBytes bounds the bodies that the HTTP middleware does not, such
+// as gRPC messages and the responses kept for idempotent replays.
+const maxBodyBytes = 1 << 20
+
+// pebblesAPI serves the /pebbles collection over HTTP, in every version of
+// the API.
+type pebblesAPI struct {
+	svc      *PebbleService
+	maxBatch int
+}
+
+func (api *pebblesAPI) register(rt *Router) {
+	rt.Get("/pebbles", api.list)
+	rt.Post("/pebbles", api.create)
+	rt.Get("/pebbles/search", WithFlag(flagPebblesSearch, api.search, nil))
+	// Exports run for as long as the client takes to read them.
+	rt.Without("timeout", "slow_requests").Get("/pebbles/export", api.export)
+	rt.Without("timeout", "slow_requests").Post("/pebbles/import", api.importPebbles)
+	rt.Get("/pebbles/{id}", api.get)
+	rt.Put("/pebbles/{id}", api.replace)
+	rt.Patch("/pebbles/{id}", api.update)
+	rt.Delete("/pebbles/{id}", api.delete)
+	rt.Post("/pebbles/{id}", api.method)
+	rt.Post("/pebbles:batch", api.batch)
+
+	rt.Document("GET", "/pebbles", Operation{Summary: "List pebbles", Tag: "pebbles", Response: listResponse[Pebble]{}, List: &pebbleListParams})
+	rt.Document("POST", "/pebbles", Operation{Summary: "Create a pebble", Tag: "pebbles", Request: pebbleInput{}, Response: Pebble{}, Status: http.StatusCreated})
+	rt.Document("GET", "/pebbles/search", Operation{Summary: "Search pebbles by name and color", Tag: "pebbles", Response: listResponse[SearchHit]{}})
+	rt.Document("GET", "/pebbles/export", Operation{Summary: "Stream all the pebbles as NDJSON or CSV", Tag: "pebbles"})
+	rt.Document("POST", "/pebbles/import", Operation{Summary: "Create pebbles from the rows of an NDJSON or CSV body", Tag: "pebbles", Response: importResponse{}})
+	rt.Document("GET", "/pebbles/{id}", Operation{Summary: "Fetch a pebble", Tag: "pebbles", Response: Pebble{}})
+	rt.Document("PUT", "/pebbles/{id}", Operation{Summary: "Replace a pebble", Tag: "pebbles", Request: pebbleInput{}, Response: Pebble{}})
+	rt.Document("PATCH", "/pebbles/{id}", Operation{Summary: "Change some fields of a pebble", Tag: "pebbles", Request: pebblePatch{}, Response: Pebble{}})
+	rt.Document("DELETE", "/pebbles/{id}", Operation{Summary: "Delete a pebble", Tag: "pebbles", Status: http.StatusNoContent})
+	rt.Document("POST", "/pebbles:batch", Operation{Summary: "Create, change and delete several pebbles", Tag: "pebbles", Request: batchRequest{}, Response: batchResponse{}})
+	rt.Document("POST", "/pebbles/{id}", Operation{Summary: "Restore a deleted pebble, as POST /pebbles/{id}:restore", Tag: "pebbles", Response: Pebble{}})
+}
+
+type listResponse[T any] struct {
+	Items []T       `json:"items"`
+	Page  *pageInfo `json:"page,omitempty"`
+}
+
+// includeDeleted reads the include_deleted parameter of r, which only
+// callers allowed to administer pebbles may set.
+func includeDeleted(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("include_deleted")
+	if v == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, Invalid(ValidationErrors{{Field: "include_deleted", Message: "must be true or false"}}, "invalid parameters")
+	}
+	if include {
+		return true, checkIncludeDeleted(r.Context())
+	}
+	return false, nil
+}
+
+// checkIncludeDeleted returns an error unless the caller may see deleted
+// pebbles, which needs the pebbles:admin permission.
+func checkIncludeDeleted(ctx context.Context) error {
+	VaryByCaller(ctx)
+	if c := ClaimsFromContext(ctx); c != nil && !hasPermission(c, PermPebblesAdmin) {
+		return Forbidden("include_deleted requires the %q permission", PermPebblesAdmin)
+	}
+	return nil
+}
+
+func (api *pebblesAPI) list(w http.ResponseWriter, r *http.Request) error {
+	include, err := includeDeleted(r)
+	if err != nil {
+		return err
+	}
+	values := r.URL.Query()
+	values.Del("include_deleted")
+	q, err := parseListValues(values, pebbleListParams)
+	if err != nil {
+		return err
+	}
+	q.IncludeDeleted = include
+	page, err := api.svc.List(r.Context(), q)
+	if err != nil {
+		return err
+	}
+	respond(w, r, http.StatusOK, listResponse[Pebble]{
+		Items: page.Items,
+		Page:  &pageInfo{Limit: page.Limit, NextCursor: page.NextCursor},
+	})
+	return nil
+}
+
+func (api *pebblesAPI) create(w http.ResponseWriter, r *http.Request) error {
+	var in pebbleInput
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	p, err := api.svc.Create(r.Context(), in)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", APIPath(r.Context(), "/pebbles/"+p.ID))
+	writeResource(w, r, http.StatusCreated, p)
+	return nil
+}
+
+func (api *pebblesAPI) get(w http.ResponseWriter, r *http.Request) error {
+	id, err := PathUUID(r, "id")
+	if err != nil {
+		return err
+	}
+	include, err := includeDeleted(r)
+	if err != nil {
+		return err
+	}
+	p, err := api.svc.Get(r.Context(), id, include)
+	if err != nil {
+		return err
+	}
+	writeResource(w, r, http.StatusOK, p)
+	return nil
+}
+
+func (api *pebblesAPI) replace(w http.ResponseWriter, r *http.Request) error {
+	id, err := PathUUID(r, "id")
+	if err != nil {
+		return err
+	}
+	var in pebbleInput
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	p, err := api.svc.Replace(r.Context(), id, in, r.Header.Get("If-Match"))
+	if err != nil {
+		return err
+	}
+	writeResource(w, r, http.StatusOK, p)
+	return nil
+}
+
+func (api *pebblesAPI) update(w http.ResponseWriter, r *http.Request) error {
+	id, err := PathUUID(r, "id")
+	if err != nil {
+		return err
+	}
+	var in pebblePatch
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	p, err := api.svc.Update(r.Context(), id, in, r.Header.Get("If-Match"))
+	if err != nil {
+		return err
+	}
+	writeResource(w, r, http.StatusOK, p)
+	return nil
+}
+
+func (api *pebblesAPI) delete(w http.ResponseWriter, r *http.Request) error {
+	id, err := PathUUID(r, "id")
+	if err != nil {
+		return err
+	}
+	if err := api.svc.Delete(r.Context(), id, r.Header.Get("If-Match")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// method serves the custom methods of a pebble, POST /pebbles/{id}:verb,
+// of which there is only restore.
+func (api *pebblesAPI) method(w http.ResponseWriter, r *http.Request) error {
+	raw, verb, _ := strings.Cut(r.PathValue("id"), ":")
+	if verb != "restore" {
+		return NotFound("no such method %q", verb)
+	}
+	id, err := parseUUID(raw)
+	if err != nil {
+		return Invalid(nil, "path parameter %q must be a UUID", "id")
+	}
+	p, err := api.svc.Restore(r.Context(), id, r.Header.Get("If-Match"))
+	if err != nil {
+		return err
+	}
+	writeResource(w, r, http.StatusOK, p)
+	return nil
+}
+
+// batchRequest is the body of POST /pebbles:batch. With Atomic set either
+// every operation succeeds or none takes effect.
+type batchRequest struct {
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations" validate:"required"`
+}
+
+type batchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+func (api *pebblesAPI) batch(w http.ResponseWriter, r *http.Request) error {
+	var in batchRequest
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	if len(in.Operations) > api.maxBatch {
+		return ValidationErrors{{Field: "operations", Message: fmt.Sprintf("must have at most %d items", api.maxBatch)}}.apiError()
+	}
+	results, err := api.svc.Batch(r.Context(), in.Operations, in.Atomic)
+	if err != nil {
+		return err
+	}
+	respond(w, r, http.StatusOK, batchResponse{Results: results})
+	return nil
+}
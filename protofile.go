@@ -0,0 +1,523 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file parses the subset of the protocol buffers language used by
+// proto/pebbles/v1/pebbles.proto: proto3 messages with scalar and message
+// fields, and services of unary RPCs with google.api.http rules. It lets
+// the gateway follow the definitions without protoc or generated code.
+
+// protoFile is a parsed .proto file.
+type protoFile struct {
+	Package  string
+	Messages map[string]*protoMessage
+	Services []*protoService
+}
+
+type protoMessage struct {
+	Name   string
+	Fields []*protoFieldDesc
+}
+
+// field returns the field with the given proto or JSON name, or nil.
+func (m *protoMessage) field(name string) *protoFieldDesc {
+	for _, f := range m.Fields {
+		if f.Name == name || f.JSONName() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+type protoFieldDesc struct {
+	Name     string
+	Number   int
+	Type     string // a scalar type like int32, or a message name
+	Repeated bool
+	Optional bool
+}
+
+// JSONName is the lowerCamelCase name of the field in the proto3 JSON
+// mapping.
+func (f *protoFieldDesc) JSONName() string {
+	var b strings.Builder
+	upper := false
+	for _, c := range f.Name {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			c = unicode.ToUpper(c)
+			upper = false
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// protoScalars are the scalar types the wire format code supports.
+var protoScalars = map[string]bool{
+	"string": true,
+	"bool":   true,
+	"int32":  true,
+	"int64":  true,
+	"uint32": true,
+	"uint64": true,
+}
+
+type protoService struct {
+	Name string
+	RPCs []*protoRPC
+}
+
+type protoRPC struct {
+	Name   string
+	Input  string
+	Output string
+	HTTP   *httpRule
+}
+
+// httpRule is the google.api.http option of an RPC.
+type httpRule struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+// parseProtoFile parses src, which must use proto3 syntax.
+func parseProtoFile(src string) (*protoFile, error) {
+	p := &protoParser{toks: tokenizeProto(src)}
+	f, err := p.file()
+	if err != nil {
+		return nil, fmt.Errorf("proto: line %d: %w", p.line(), err)
+	}
+	return f, nil
+}
+
+type protoToken struct {
+	text string
+	str  bool // a string literal, with text unquoted
+	line int
+}
+
+func tokenizeProto(src string) []protoToken {
+	var toks []protoToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src) - i - 4
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			var b strings.Builder
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				b.WriteByte(src[j])
+				j++
+			}
+			toks = append(toks, protoToken{text: b.String(), str: true, line: line})
+			i = j + 1
+		case isProtoIdent(c) || c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (isProtoIdent(src[j]) || src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, protoToken{text: src[i:j], line: line})
+			i = j
+		default:
+			toks = append(toks, protoToken{text: string(c), line: line})
+			i++
+		}
+	}
+	return toks
+}
+
+func isProtoIdent(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type protoParser struct {
+	toks []protoToken
+	pos  int
+}
+
+func (p *protoParser) line() int {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos].line
+	}
+	if len(p.toks) > 0 {
+		return p.toks[len(p.toks)-1].line
+	}
+	return 1
+}
+
+func (p *protoParser) peek() string {
+	if p.pos < len(p.toks) && !p.toks[p.pos].str {
+		return p.toks[p.pos].text
+	}
+	return ""
+}
+
+func (p *protoParser) next() (protoToken, error) {
+	if p.pos >= len(p.toks) {
+		return protoToken{}, fmt.Errorf("unexpected end of file")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *protoParser) expect(text string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.str || t.text != text {
+		return fmt.Errorf("expected %q, found %q", text, t.text)
+	}
+	return nil
+}
+
+func (p *protoParser) ident() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if t.str || !isProtoIdent(t.text[0]) {
+		return "", fmt.Errorf("expected a name, found %q", t.text)
+	}
+	return t.text, nil
+}
+
+func (p *protoParser) stringLit() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if !t.str {
+		return "", fmt.Errorf("expected a string, found %q", t.text)
+	}
+	return t.text, nil
+}
+
+// skipStatement skips to the end of the current statement.
+func (p *protoParser) skipStatement() error {
+	for {
+		t, err := p.next()
+		if err != nil {
+			return err
+		}
+		if !t.str && t.text == ";" {
+			return nil
+		}
+	}
+}
+
+func (p *protoParser) file() (*protoFile, error) {
+	f := &protoFile{Messages: make(map[string]*protoMessage)}
+	for p.pos < len(p.toks) {
+		kw, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		switch kw {
+		case "syntax":
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			s, err := p.stringLit()
+			if err != nil {
+				return nil, err
+			}
+			if s != "proto3" {
+				return nil, fmt.Errorf("syntax %q is not supported", s)
+			}
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		case "package":
+			if f.Package, err = p.ident(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		case "import", "option":
+			if err := p.skipStatement(); err != nil {
+				return nil, err
+			}
+		case "message":
+			m, err := p.message()
+			if err != nil {
+				return nil, err
+			}
+			f.Messages[m.Name] = m
+		case "service":
+			s, err := p.service()
+			if err != nil {
+				return nil, err
+			}
+			f.Services = append(f.Services, s)
+		default:
+			return nil, fmt.Errorf("%s is not supported", kw)
+		}
+	}
+	return f, f.resolve()
+}
+
+func (p *protoParser) message() (*protoMessage, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	m := &protoMessage{Name: name}
+	for p.peek() != "}" {
+		fd := &protoFieldDesc{}
+		typ, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "option", "reserved":
+			if err := p.skipStatement(); err != nil {
+				return nil, err
+			}
+			continue
+		case "message", "enum", "oneof", "map":
+			return nil, fmt.Errorf("%s in messages is not supported", typ)
+		case "repeated", "optional":
+			fd.Repeated = typ == "repeated"
+			fd.Optional = typ == "optional"
+			if typ, err = p.ident(); err != nil {
+				return nil, err
+			}
+		}
+		fd.Type = typ
+		if fd.Name, err = p.ident(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		num, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if fd.Number, err = strconv.Atoi(num.text); err != nil || fd.Number < 1 {
+			return nil, fmt.Errorf("invalid field number %q", num.text)
+		}
+		if err := p.skipStatement(); err != nil { // field options
+			return nil, err
+		}
+		m.Fields = append(m.Fields, fd)
+	}
+	return m, p.expect("}")
+}
+
+func (p *protoParser) service() (*protoService, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	s := &protoService{Name: name}
+	for p.peek() != "}" {
+		kw, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if kw == "option" {
+			if err := p.skipStatement(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if kw != "rpc" {
+			return nil, fmt.Errorf("%s in services is not supported", kw)
+		}
+		rpc, err := p.rpc()
+		if err != nil {
+			return nil, err
+		}
+		s.RPCs = append(s.RPCs, rpc)
+	}
+	return s, p.expect("}")
+}
+
+func (p *protoParser) rpc() (*protoRPC, error) {
+	var rpc protoRPC
+	var err error
+	if rpc.Name, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if rpc.Input, err = p.rpcType(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("returns"); err != nil {
+		return nil, err
+	}
+	if rpc.Output, err = p.rpcType(); err != nil {
+		return nil, err
+	}
+	if p.peek() == ";" {
+		p.pos++
+		return &rpc, nil
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for p.peek() != "}" {
+		if err := p.expect("option"); err != nil {
+			return nil, err
+		}
+		if p.peek() != "(" {
+			if err := p.skipStatement(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		p.pos++
+		opt, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		if opt != "google.api.http" {
+			if err := p.skipStatement(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if rpc.HTTP, err = p.httpRule(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+	p.pos++
+	if p.peek() == ";" {
+		p.pos++
+	}
+	return &rpc, nil
+}
+
+func (p *protoParser) rpcType() (string, error) {
+	if err := p.expect("("); err != nil {
+		return "", err
+	}
+	name, err := p.ident()
+	if err != nil {
+		return "", err
+	}
+	if name == "stream" {
+		return "", fmt.Errorf("streaming RPCs are not supported")
+	}
+	return name, p.expect(")")
+}
+
+// httpRule parses the value of a google.api.http option, such as
+// { get: "/v1/items/{id}" }.
+func (p *protoParser) httpRule() (*httpRule, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	rule := &httpRule{}
+	for p.peek() != "}" {
+		key, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.stringLit()
+		if err != nil {
+			return nil, fmt.Errorf("google.api.http: %s: %w", key, err)
+		}
+		switch key {
+		case "get", "put", "post", "delete", "patch":
+			rule.Method = strings.ToUpper(key)
+			rule.Path = value
+		case "body":
+			rule.Body = value
+		default:
+			return nil, fmt.Errorf("google.api.http: %s is not supported", key)
+		}
+		if p.peek() == "," || p.peek() == ";" {
+			p.pos++
+		}
+	}
+	p.pos++
+	if rule.Method == "" {
+		return nil, fmt.Errorf("google.api.http: no method and path")
+	}
+	if rule.Body != "" && rule.Body != "*" {
+		return nil, fmt.Errorf("google.api.http: only body \"*\" is supported")
+	}
+	return rule, nil
+}
+
+// resolve strips the package from type names and checks that every type
+// is known.
+func (f *protoFile) resolve() error {
+	local := func(name string) (string, error) {
+		name = strings.TrimPrefix(name, f.Package+".")
+		if protoScalars[name] || f.Messages[name] != nil {
+			return name, nil
+		}
+		return "", fmt.Errorf("proto: type %s is not supported", name)
+	}
+	var err error
+	for _, m := range f.Messages {
+		for _, fd := range m.Fields {
+			if fd.Type, err = local(fd.Type); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range f.Services {
+		for _, rpc := range s.RPCs {
+			if rpc.Input, err = local(rpc.Input); err != nil {
+				return err
+			}
+			if rpc.Output, err = local(rpc.Output); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// This file implements the parts of the protocol buffers wire format the
+// gRPC messages need: varints and length-delimited fields. It keeps the
+// binary free of generated code and the protobuf runtime.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoEncoder appends fields to b. Following proto3, the plain methods
+// leave out fields with the zero value; the opt variants always write
+// theirs, for fields declared optional.
+type protoEncoder struct {
+	b []byte
+}
+
+func (e *protoEncoder) tag(num, typ int) {
+	e.b = binary.AppendUvarint(e.b, uint64(num)<<3|uint64(typ))
+}
+
+func (e *protoEncoder) string(num int, s string) {
+	if s != "" {
+		e.optString(num, s)
+	}
+}
+
+func (e *protoEncoder) optString(num int, s string) {
+	e.tag(num, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *protoEncoder) int32(num int, v int32) {
+	if v != 0 {
+		e.optInt32(num, v)
+	}
+}
+
+// optInt32 writes v sign-extended to 64 bits, as int32 fields require.
+func (e *protoEncoder) optInt32(num int, v int32) {
+	e.optVarint(num, uint64(int64(v)))
+}
+
+func (e *protoEncoder) optVarint(num int, v uint64) {
+	e.tag(num, wireVarint)
+	e.b = binary.AppendUvarint(e.b, v)
+}
+
+// message writes an embedded message, which is written even when empty so
+// that repeated fields keep their length.
+func (e *protoEncoder) message(num int, m []byte) {
+	e.tag(num, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(m)))
+	e.b = append(e.b, m...)
+}
+
+var errProtoTruncated = errors.New("protobuf: message is truncated")
+
+// protoField is a decoded field. Varint holds the value of varint fields
+// and Bytes that of length-delimited ones.
+type protoField struct {
+	Num    int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+func (f protoField) int32() (int32, error) {
+	if f.Type != wireVarint {
+		return 0, f.wrongType()
+	}
+	return int32(f.Varint), nil
+}
+
+func (f protoField) string() (string, error) {
+	if f.Type != wireBytes {
+		return "", f.wrongType()
+	}
+	if !utf8.Valid(f.Bytes) {
+		return "", fmt.Errorf("protobuf: field %d is not valid UTF-8", f.Num)
+	}
+	return string(f.Bytes), nil
+}
+
+func (f protoField) wrongType() error {
+	return fmt.Errorf("protobuf: field %d has wire type %d", f.Num, f.Type)
+}
+
+// decodeProto calls fn for each field of the message b, in order. Fields
+// fn does not know about should be ignored, so that older servers accept
+// messages from newer clients.
+func decodeProto(b []byte, fn func(protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{Num: int(key >> 3), Type: int(key & 7)}
+		if f.Num < 1 {
+			return errors.New("protobuf: invalid field number")
+		}
+		switch f.Type {
+		case wireVarint:
+			f.Varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if f.Type == wireFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return errProtoTruncated
+			}
+			f.Bytes, b = b[:size], b[size:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errProtoTruncated
+			}
+			b = b[n:]
+			f.Bytes, b = b[:size], b[size:]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", f.Type)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
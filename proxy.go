@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const CodeBadGateway = "bad_gateway"
+
+// Headers telling the upstream who the proxy authenticated the request as.
+// Those sent by clients are removed, so the upstream can trust them.
+const (
+	proxySubjectHeader = "X-Auth-Subject"
+	proxyScopesHeader  = "X-Auth-Scopes"
+)
+
+// proxyRewrite is a ProxyRewrite with its expression compiled.
+type proxyRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// NewProxy returns a handler forwarding requests under route.Prefix to
+// route.Upstream, with the prefix replaced by the path of the upstream URL
+// after the rest of the path is rewritten by the first of route.Rewrite
+// that matches it. The credentials of the request are not forwarded; the
+// subject and scopes they were verified as are, in X-Auth-Subject and
+// X-Auth-Scopes. Requests that fail to reach the upstream, or get a 502,
+// 503 or 504 response from it, are retried as for retryTransport, and
+// count against breaker.
+func NewProxy(route ProxyRoute, retry RetryPolicy, breaker *CircuitBreaker, logger *slog.Logger) (http.Handler, error) {
+	upstream, err := url.Parse(route.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	rewrites := make([]proxyRewrite, len(route.Rewrite))
+	for i, rw := range route.Rewrite {
+		re, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return nil, err
+		}
+		rewrites[i] = proxyRewrite{match: re, replace: rw.Replace}
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			path := "/" + strings.TrimPrefix(pr.In.URL.Path, route.Prefix)
+			for _, rw := range rewrites {
+				if rw.match.MatchString(path) {
+					path = rw.match.ReplaceAllString(path, rw.replace)
+					break
+				}
+			}
+			pr.Out.URL.Path = path
+			pr.Out.URL.RawPath = ""
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+			h := pr.Out.Header
+			h.Del("Authorization")
+			h.Del(apiKeyHeader)
+			h.Del(proxySubjectHeader)
+			h.Del(proxyScopesHeader)
+			if id := RequestIDFromContext(pr.In.Context()); id != "" {
+				h.Set(requestIDHeader, id)
+			}
+			if c := ClaimsFromContext(pr.In.Context()); c != nil {
+				h.Set(proxySubjectHeader, c.Subject)
+				h.Set(proxyScopesHeader, strings.Join(c.Scopes, " "))
+			}
+		},
+		Transport: &retryTransport{
+			next:    http.DefaultTransport,
+			retry:   retry,
+			breaker: breaker,
+			logger:  logger,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			switch {
+			case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+				// The client went away.
+			case errors.Is(err, context.DeadlineExceeded):
+				WriteError(w, r, Internal(err))
+			case errors.Is(err, ErrCircuitOpen):
+				WriteError(w, r, NewAPIError(http.StatusServiceUnavailable, CodeUnavailable, "the upstream service is unavailable"))
+			default:
+				logger.WarnContext(r.Context(), "upstream request failed", "upstream", route.Upstream, "path", r.URL.Path, "error", err)
+				WriteError(w, r, NewAPIError(http.StatusBadGateway, CodeBadGateway, "the upstream service could not be reached"))
+			}
+		},
+	}, nil
+}
+
+// retryTransport sends requests again as retry says while they fail to
+// reach the upstream or it answers 502, 503 or 504, which count against
+// breaker. Only requests that are harmless to repeat are retried: those
+// with an idempotent method or an Idempotency-Key. Their bodies are kept
+// in memory to be sent again; the body policy bounds them.
+type retryTransport struct {
+	next    http.RoundTripper
+	retry   RetryPolicy
+	breaker *CircuitBreaker
+	logger  *slog.Logger
+}
+
+// errRetryableResponse marks an attempt answered with a status worth
+// retrying.
+var errRetryableResponse = errors.New("upstream responded with a retryable status")
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.retry.Retries == 0 || !idempotentRequest(req) {
+		return t.roundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var resp *http.Response
+	err := t.retry.Do(req.Context(), func(error) bool { return true }, func(attempt int) error {
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+			resp = nil
+		}
+		if attempt > 0 {
+			t.logger.DebugContext(req.Context(), "retrying upstream request", "url", req.URL.String(), "attempt", attempt)
+		}
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		var err error
+		resp, err = t.roundTrip(req)
+		if err == nil && retryableResponse(resp, nil) {
+			return errRetryableResponse
+		}
+		return err
+	})
+	switch {
+	case errors.Is(err, errRetryableResponse):
+		return resp, nil
+	case err != nil && resp != nil:
+		// The wait for the next attempt was cut short.
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, err
+}
+
+// roundTrip makes one attempt at req through the breaker.
+func (t *retryTransport) roundTrip(req *http.Request) (resp *http.Response, err error) {
+	err = t.breaker.Do(func() (bool, error) {
+		var err error
+		resp, err = t.next.RoundTrip(req)
+		return retryableResponse(resp, err) && !errors.Is(err, context.Canceled), err
+	})
+	return resp, err
+}
+
+func idempotentRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get(idempotencyHeader) != ""
+}
+
+func retryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature starts the binary header of version 2 of the PROXY
+// protocol.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest a version 1 header can be, its CRLF
+// included.
+const proxyV1MaxLength = 107
+
+// proxyListener accepts connections whose peers, if they are trusted, are
+// load balancers that start each with a PROXY protocol header, version 1
+// or 2, saying which client the connection is for. The connections of
+// trusted peers report that client as their RemoteAddr; those of others
+// are served as they are, so their headers are not believed.
+type proxyListener struct {
+	net.Listener
+	trusted ipSet
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+// newProxyListener returns ln reading the PROXY protocol headers of the
+// connections from trusted, each of which must send one within timeout.
+func newProxyListener(ln net.Listener, trusted ipSet, timeout time.Duration, logger *slog.Logger) net.Listener {
+	return &proxyListener{Listener: ln, trusted: trusted, timeout: timeout, logger: logger}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.trusted.contains(peer.AddrPort().Addr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), timeout: l.timeout, logger: l.logger}, nil
+}
+
+// proxyConn is a connection from a trusted load balancer. Its header is
+// read by the first call to RemoteAddr or Read, which the server makes on
+// the connection's own goroutine, so that a peer slow to send it only
+// holds up its own connection.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	logger  *slog.Logger
+
+	once   sync.Once
+	client net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		client, err := readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("PROXY protocol: %w", err)
+			c.logger.Warn("refusing connection without a valid PROXY protocol header", "peer", c.Conn.RemoteAddr().String(), "error", err)
+			return
+		}
+		c.client = client
+	})
+}
+
+// RemoteAddr returns the client the header names, or the peer if it names
+// none, as health checks of the load balancer do.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.client != nil {
+		return c.client
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// readProxyHeader reads a PROXY protocol header from r and returns the
+// address of the client it names, nil for one that names no client.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, errors.New("the connection does not start with a header")
+}
+
+// readProxyV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errors.New("the version 1 header is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("%q is not a version 1 header", strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	port, perr := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil || perr != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%q is not a version 1 header", strings.TrimSpace(string(line)))
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads a binary header, whose addresses follow its 16 fixed
+// bytes.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("version %d is not supported", fixed[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch cmd := fixed[12] & 0xf; {
+	case cmd == 0:
+		// LOCAL: the load balancer's own connection, such as a health check.
+		return nil, nil
+	case cmd != 1:
+		return nil, fmt.Errorf("command %d is not supported", cmd)
+	}
+	var ip netip.Addr
+	var port []byte
+	switch fixed[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("the IPv4 addresses are cut short")
+		}
+		ip, port = netip.AddrFrom4([4]byte(body[:4])), body[8:10]
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("the IPv6 addresses are cut short")
+		}
+		ip, port = netip.AddrFrom16([16]byte(body[:16])), body[32:34]
+	default:
+		// UNSPEC, UDP and Unix sockets name no TCP client.
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port))), nil
+}
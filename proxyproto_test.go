@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a version 2 header with the version and command byte
+// verCmd, the family and protocol byte fam and the address block body.
+func proxyV2(verCmd, fam byte, body []byte) string {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, verCmd, fam)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return string(append(h, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	ipv6[0], ipv6[1], ipv6[15] = 0x20, 0x01, 0x01 // 2001::1
+	ipv6[16], ipv6[17], ipv6[31] = 0x20, 0x01, 0x02
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+	binary.BigEndian.PutUint16(ipv6[34:], 443)
+	// A type-length-value after the addresses, which is skipped.
+	withTLV := append(append([]byte{}, ipv4...), 0x04, 0x00, 0x02, 'o', 'k')
+
+	tests := []struct {
+		name   string
+		header string
+		want   string // the client address, or "" for none
+		err    string // the error, or "" for none
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", want: "192.0.2.1:56324"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", want: "[2001:db8::1]:56324"},
+		{name: "v1 longest", header: "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n", want: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", header: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 443\r\n"},
+		{name: "v1 TCP4 with an IPv6 address", header: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", err: "is not a version 1 header"},
+		{name: "v1 port out of range", header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", err: "is not a version 1 header"},
+		{name: "v1 missing a field", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", err: "is not a version 1 header"},
+		{name: "v1 UDP", header: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", err: "is not a version 1 header"},
+		{name: "v1 bare newline", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n" + strings.Repeat("x", 100), err: "too long"},
+		{name: "v1 oversized", header: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", err: "too long"},
+		{name: "v1 truncated", header: "PROXY TCP4 192.0.2.1", err: io.EOF.Error()},
+
+		{name: "v2 TCP4", header: proxyV2(0x21, 0x11, ipv4), want: "192.0.2.1:56324"},
+		{name: "v2 TCP6", header: proxyV2(0x21, 0x21, ipv6), want: "[2001::1]:56324"},
+		{name: "v2 with a TLV", header: proxyV2(0x21, 0x11, withTLV), want: "192.0.2.1:56324"},
+		{name: "v2 LOCAL", header: proxyV2(0x20, 0x11, ipv4)},
+		{name: "v2 LOCAL without addresses", header: proxyV2(0x20, 0x00, nil)},
+		{name: "v2 UNSPEC", header: proxyV2(0x21, 0x00, nil)},
+		{name: "v2 UDP", header: proxyV2(0x21, 0x12, ipv4)},
+		{name: "v2 Unix socket", header: proxyV2(0x21, 0x31, make([]byte, 216))},
+		{name: "v2 version 1", header: proxyV2(0x11, 0x11, ipv4), err: "version 1 is not supported"},
+		{name: "v2 unknown command", header: proxyV2(0x22, 0x11, ipv4), err: "command 2 is not supported"},
+		{name: "v2 IPv4 cut short", header: proxyV2(0x21, 0x11, ipv4[:8]), err: "IPv4 addresses are cut short"},
+		{name: "v2 IPv6 cut short", header: proxyV2(0x21, 0x21, ipv4), err: "IPv6 addresses are cut short"},
+		{name: "v2 truncated fixed part", header: proxyV2(0x21, 0x11, nil)[:14], err: io.ErrUnexpectedEOF.Error()},
+		{name: "v2 truncated body", header: proxyV2(0x21, 0x11, ipv4)[:20], err: io.ErrUnexpectedEOF.Error()},
+
+		{name: "no header", header: "GET / HTTP/1.1\r\n\r\n", err: "does not start with a header"},
+		{name: "too short for a header", header: "PROXY", err: io.EOF.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "GET /"))
+			if tt.err != "" {
+				// Nothing follows a truncated header.
+				r = bufio.NewReader(strings.NewReader(tt.header))
+			}
+			addr, err := readProxyHeader(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one saying %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v, want none", err)
+			}
+			var got string
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("got address %q, want %q", got, tt.want)
+			}
+			// The header is consumed, and nothing past it.
+			if rest, _ := io.ReadAll(r); string(rest) != "GET /" {
+				t.Errorf("got %q after the header, want the request", rest)
+			}
+		})
+	}
+}
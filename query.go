@@ -0,0 +1,207 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldType says how the values of a sortable or filterable field are
+// parsed from query parameters and cursors.
+type FieldType int
+
+const (
+	StringField FieldType = iota
+	IntField
+	TimeField
+)
+
+// parse converts s to the Go type used for fields of type t: string, int64
+// or time.Time.
+func (t FieldType) parse(s string) (any, error) {
+	switch t {
+	case IntField:
+		return strconv.ParseInt(s, 10, 64)
+	case TimeField:
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return s, nil
+}
+
+// ListParams describes what the list endpoint of a resource supports.
+type ListParams struct {
+	// Sortable and Filterable map field names to their types.
+	Sortable     map[string]FieldType
+	Filterable   map[string]FieldType
+	DefaultSort  Sort
+	DefaultLimit int
+	MaxLimit     int
+}
+
+// Sort orders a list by Field, then by ID in the same direction so the
+// order is total.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+func (s Sort) String() string {
+	if s.Desc {
+		return s.Field + ":desc"
+	}
+	return s.Field + ":asc"
+}
+
+// Filter keeps only the items whose Field equals Value.
+type Filter struct {
+	Field string
+	Value any
+}
+
+// Cursor is the position after which the next page starts: the sort value
+// and ID of the last item of the previous page.
+type Cursor struct {
+	Value any
+	ID    string
+}
+
+// ListQuery is a parsed list request.
+type ListQuery struct {
+	Limit   int
+	Sort    Sort
+	Filters []Filter
+	After   *Cursor
+	// IncludeDeleted lists soft-deleted items too.
+	IncludeDeleted bool
+	// Tenant, if set, lists only the items of that tenant.
+	Tenant string
+}
+
+// cursorJSON is the encoded form of a cursor. It records the sort so that
+// a cursor cannot be reused with a different order.
+type cursorJSON struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// encodeCursor returns the opaque cursor for the page after the item with
+// the given id and sort value.
+func encodeCursor(s Sort, value any, id string) string {
+	var v string
+	switch value := value.(type) {
+	case time.Time:
+		v = value.Format(time.RFC3339Nano)
+	default:
+		v = fmt.Sprint(value)
+	}
+	b, _ := json.Marshal(cursorJSON{Sort: s.String(), Value: v, ID: id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var errBadCursor = errors.New("cursor is not valid for this list")
+
+func decodeCursor(s string, sort Sort, t FieldType) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c cursorJSON
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort.String() {
+		return nil, errBadCursor
+	}
+	v, err := t.parse(c.Value)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	return &Cursor{Value: v, ID: c.ID}, nil
+}
+
+// ParseListQuery reads ?limit, ?cursor, ?sort=field[:asc|:desc] and
+// field=value filters from r. Unknown parameters are rejected so typos
+// do not silently return everything.
+func ParseListQuery(r *http.Request, p ListParams) (ListQuery, error) {
+	return parseListValues(r.URL.Query(), p)
+}
+
+// parseListValues is ParseListQuery for parameters that did not come from
+// a URL, such as the fields of a gRPC list request.
+func parseListValues(values url.Values, p ListParams) (ListQuery, error) {
+	q := ListQuery{Limit: p.DefaultLimit, Sort: p.DefaultSort}
+	var errs ValidationErrors
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		v := values.Get(name)
+		switch name {
+		case "limit":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > p.MaxLimit {
+				errs = append(errs, FieldError{Field: "limit", Message: fmt.Sprintf("must be a number from 1 to %d", p.MaxLimit)})
+				continue
+			}
+			q.Limit = n
+		case "sort":
+			field, dir, _ := strings.Cut(v, ":")
+			if _, ok := p.Sortable[field]; !ok {
+				errs = append(errs, FieldError{Field: "sort", Message: fmt.Sprintf("cannot sort by %q", field)})
+				continue
+			}
+			if dir != "" && dir != "asc" && dir != "desc" {
+				errs = append(errs, FieldError{Field: "sort", Message: "direction must be asc or desc"})
+				continue
+			}
+			q.Sort = Sort{Field: field, Desc: dir == "desc"}
+		case "cursor":
+		default:
+			t, ok := p.Filterable[name]
+			if !ok {
+				errs = append(errs, FieldError{Field: name, Message: "is not a known parameter"})
+				continue
+			}
+			value, err := t.parse(v)
+			if err != nil {
+				errs = append(errs, FieldError{Field: name, Message: "is not a valid value"})
+				continue
+			}
+			q.Filters = append(q.Filters, Filter{Field: name, Value: value})
+		}
+	}
+	if errs == nil && values.Get("cursor") != "" {
+		c, err := decodeCursor(values.Get("cursor"), q.Sort, p.Sortable[q.Sort.Field])
+		if err != nil {
+			errs = append(errs, FieldError{Field: "cursor", Message: err.Error()})
+		}
+		q.After = c
+	}
+	if errs != nil {
+		return ListQuery{}, Invalid(errs, "invalid list parameters")
+	}
+	return q, nil
+}
+
+// compareValues orders two values produced by FieldType.parse.
+func compareValues(a, b any) int {
+	switch a := a.(type) {
+	case string:
+		return cmp.Compare(a, b.(string))
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	panic(fmt.Sprintf("query: cannot compare %T", a))
+}
+
+// pageInfo is the pagination metadata of a list response.
+type pageInfo struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
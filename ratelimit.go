@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const CodeRateLimited = "rate_limited"
+
+// LimiterStore keeps the rate limit state of every client. Allow takes one
+// token from the bucket for key and, if none was left, reports how long
+// the client should wait before trying again. Implementations shared
+// between server instances, such as one backed by Redis, can be swapped in
+// for the in-memory store.
+type LimiterStore interface {
+	Allow(ctx context.Context, key string) (ok bool, retryAfter time.Duration, err error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryLimiter is a LimiterStore holding a token bucket per key in
+// memory. Buckets that have not been used for ttl are evicted by run.
+type memoryLimiter struct {
+	clock Clock
+
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	ttl     time.Duration
+	buckets map[string]*bucket
+}
+
+// newMemoryLimiter allows rate requests per second per key with bursts of
+// up to burst requests, measuring time by clock.
+func newMemoryLimiter(rate float64, burst int, ttl time.Duration, clock Clock) *memoryLimiter {
+	return &memoryLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		ttl:     ttl,
+		clock:   clock,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *memoryLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait, nil
+}
+
+// SetLimits changes the allowance of every client. Buckets keep their
+// tokens, capped at the new burst.
+func (l *memoryLimiter) SetLimits(rate float64, burst int, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = float64(burst)
+	l.ttl = ttl
+}
+
+// evict removes the buckets that have been idle for longer than the ttl.
+// An idle bucket is full again, so dropping it does not change behaviour.
+func (l *memoryLimiter) evict() {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := now.Add(-l.ttl)
+	for key, b := range l.buckets {
+		if b.last.Before(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// run evicts idle buckets until ctx is done. It checks at the ttl the
+// limiter was created with, even if SetLimits changes it later.
+func (l *memoryLimiter) run(ctx context.Context) {
+	l.mu.Lock()
+	interval := l.ttl
+	l.mu.Unlock()
+	every(ctx, l.clock, interval, func(time.Time) { l.evict() })
+}
+
+// rateLimitKey identifies the client of r: the API key it presents, if
+// any, or else its IP address as resolved by RealIP. Keys are hashed so
+// they are not kept in memory in the clear.
+func rateLimitKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return "key:" + hashAPIKey(key)
+	}
+	return "ip:" + clientAddr(r)
+}
+
+// RateLimit rejects requests with 429 once the client identified by key
+// has used up its allowance, telling it when to retry in the Retry-After
+// header. If the store fails the request is let through.
+func RateLimit(store LimiterStore, key func(*http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, retryAfter, err := store.Allow(r.Context(), key(r))
+			if err != nil {
+				slog.ErrorContext(r.Context(), "rate limiter failed", "error", err)
+			} else if !ok {
+				secs := int(math.Ceil(retryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+				WriteError(w, r, NewAPIError(http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
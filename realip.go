@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipSet is a set of IP addresses, given as single addresses and CIDR
+// prefixes such as 10.0.0.0/8.
+type ipSet []netip.Prefix
+
+func parseIPSet(entries []string) (ipSet, error) {
+	set := make(ipSet, 0, len(entries))
+	for _, e := range entries {
+		if p, err := netip.ParsePrefix(e); err == nil {
+			set = append(set, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR prefix", e)
+		}
+		a = a.WithZone("").Unmap()
+		set = append(set, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return set, nil
+}
+
+func (s ipSet) contains(a netip.Addr) bool {
+	a = a.WithZone("").Unmap()
+	for _, p := range s {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxies are the proxies whose forwarding headers are believed:
+// those at addrs and, if unix is set, those connecting over a Unix socket.
+type TrustedProxies struct {
+	addrs ipSet
+	unix  bool
+}
+
+// ParseTrustedProxies parses entries that are IP addresses, CIDR prefixes
+// or the word unix, which trusts every client of a Unix socket.
+func ParseTrustedProxies(entries []string) (TrustedProxies, error) {
+	var t TrustedProxies
+	var addrs []string
+	for _, e := range entries {
+		if e == "unix" {
+			t.unix = true
+			continue
+		}
+		addrs = append(addrs, e)
+	}
+	var err error
+	t.addrs, err = parseIPSet(addrs)
+	return t, err
+}
+
+// trustsPeer reports whether the peer that sent r, from addr if it has an
+// IP address, is a trusted proxy.
+func (t TrustedProxies) trustsPeer(r *http.Request, addr netip.Addr) bool {
+	if addr.IsValid() {
+		return t.addrs.contains(addr)
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return t.unix && local != nil && local.Network() == "unix"
+}
+
+// parseIP parses an address as it appears in RemoteAddr and forwarding
+// headers: with or without a port, and with IPv6 addresses in brackets if
+// there is one.
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	return a.Unmap(), err == nil
+}
+
+// forwardedParam returns the name= parameters, such as for=, of the
+// elements of Forwarded headers (RFC 7239), in order, with "" for elements
+// that have none.
+func forwardedParam(values []string, name string) []string {
+	var params []string
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			param := ""
+			for _, pair := range splitQuoted(elem, ';') {
+				k, val, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(k, name) {
+					param = strings.Trim(val, `"`)
+				}
+			}
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
+// splitQuoted splits s at each sep outside a quoted string.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// resolveClientIP returns the address of the client that sent r. That is
+// the peer's address unless the peer is a trusted proxy, in which case it
+// is the last hop in the Forwarded headers, or else X-Forwarded-For, that
+// is not a trusted proxy. X-Real-IP is used if the proxy sent neither. The
+// result is not valid for a peer without an IP address, such as a Unix
+// socket client, that is not trusted.
+func resolveClientIP(r *http.Request, trusted TrustedProxies) netip.Addr {
+	addr, _ := parseIP(r.RemoteAddr)
+	if !trusted.trustsPeer(r, addr) {
+		return addr
+	}
+	var hops []string
+	if v := r.Header.Values("Forwarded"); len(v) > 0 {
+		hops = forwardedParam(v, "for")
+	} else {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	}
+	if len(hops) == 0 {
+		if a, ok := parseIP(r.Header.Get("X-Real-IP")); ok {
+			return a
+		}
+		return addr
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		a, ok := parseIP(hops[i])
+		if !ok {
+			// An obfuscated or unknown hop, and whatever was written
+			// before it, cannot be checked against the trusted set.
+			break
+		}
+		addr = a
+		if !trusted.addrs.contains(a) {
+			break
+		}
+	}
+	return addr
+}
+
+// resolveHTTPS reports whether the client sent r over HTTPS: whether r
+// came over TLS or, if the peer is a trusted proxy, whether the last
+// proto= of the Forwarded headers, or else the last X-Forwarded-Proto, the
+// one the proxy itself added, is https.
+func resolveHTTPS(r *http.Request, trusted TrustedProxies) bool {
+	if r.TLS != nil {
+		return true
+	}
+	addr, _ := parseIP(r.RemoteAddr)
+	if !trusted.trustsPeer(r, addr) {
+		return false
+	}
+	var protos []string
+	if v := r.Header.Values("Forwarded"); len(v) > 0 {
+		protos = forwardedParam(v, "proto")
+	} else {
+		for _, v := range r.Header.Values("X-Forwarded-Proto") {
+			protos = append(protos, strings.Split(v, ",")...)
+		}
+	}
+	return len(protos) > 0 && strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+}
+
+type (
+	clientIPKey struct{}
+	httpsKey    struct{}
+)
+
+// RealIP resolves the address of the client of every request once, from
+// the forwarding headers set by trusted proxies, for ClientIP, and
+// whether it was sent over HTTPS, for IsHTTPS. It must be the outermost
+// middleware, so that logging, rate limiting and IP filtering all see the
+// same address.
+func RealIP(trusted TrustedProxies) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPKey{}, resolveClientIP(r, trusted))
+			ctx = context.WithValue(ctx, httpsKey{}, resolveHTTPS(r, trusted))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// IsHTTPS reports whether the client sent r over HTTPS as resolved by
+// RealIP, or whether r came over TLS if RealIP has not seen r.
+func IsHTTPS(r *http.Request) bool {
+	if https, ok := r.Context().Value(httpsKey{}).(bool); ok {
+		return https
+	}
+	return r.TLS != nil
+}
+
+// ClientIP returns the address of the client that sent r as resolved by
+// RealIP, or the peer's address if RealIP has not seen r. It is not valid
+// for clients without an IP address.
+func ClientIP(r *http.Request) netip.Addr {
+	if a, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return a
+	}
+	a, _ := parseIP(r.RemoteAddr)
+	return a
+}
+
+// clientAddr returns ClientIP as a string, or the peer's address as the
+// server sees it if the client has no IP address, for logs and rate limit
+// keys.
+func clientAddr(r *http.Request) string {
+	if a := ClientIP(r); a.IsValid() {
+		return a.String()
+	}
+	if r.RemoteAddr == "" {
+		return "@"
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recover turns a panicking handler into a 500 response, logging the panic
+// with its stack and counting it in m if metrics are enabled. With repanic
+// set, the panic is raised again after logging, which is useful during
+// development.
+func Recover(logger *slog.Logger, m *httpMetrics, repanic bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := newResponseRecorder(w)
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logger.ErrorContext(r.Context(), "handler panicked",
+					"panic", fmt.Sprint(v),
+					"method", r.Method,
+					"path", r.URL.Path,
+					"stack", string(debug.Stack()),
+				)
+				if m != nil {
+					m.panics.Inc()
+				}
+				if repanic {
+					panic(v)
+				}
+				if !rw.wroteHeader {
+					WriteError(rw, r, Internal(nil))
+				}
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
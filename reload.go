@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Reloader re-reads the configuration when the process receives SIGHUP.
+// Settings that components registered with OnChange are applied in place;
+// any other change is logged and ignored until the next restart.
+type Reloader struct {
+	path   string
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	current  Config
+	tunables []tunable
+}
+
+type tunable struct {
+	keys  []string
+	apply func(Config)
+}
+
+// NewReloader returns a reloader for the config file at path, which may
+// be empty to reload only the environment, starting from cfg.
+func NewReloader(path string, cfg Config, logger *slog.Logger) *Reloader {
+	return &Reloader{path: path, current: cfg, logger: logger}
+}
+
+// OnChange registers apply to be called with the new configuration when a
+// reload changes any of the settings named by keys. A key is a dotted path
+// such as "log.level" and covers all the settings below it, so "cors"
+// covers "cors.admin.allowed_origins".
+func (r *Reloader) OnChange(apply func(Config), keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tunables = append(r.tunables, tunable{keys: keys, apply: apply})
+}
+
+// Config returns the configuration in effect: the one the server started
+// with, updated by the changes that reloads applied.
+func (r *Reloader) Config() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads and validates the configuration again and applies it. An
+// invalid configuration is rejected as a whole.
+func (r *Reloader) Reload() error {
+	cfg, err := LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next := r.current
+	var apply []func(Config)
+	seen := make(map[int]bool)
+	var changed []string
+	diffConfig("", reflect.ValueOf(&next).Elem(), reflect.ValueOf(cfg), func(key string, cur, v reflect.Value) {
+		i := r.tunableFor(key)
+		if i < 0 {
+			r.logger.Warn("config setting cannot change without a restart", "key", key)
+			return
+		}
+		cur.Set(v)
+		changed = append(changed, key)
+		if !seen[i] {
+			seen[i] = true
+			apply = append(apply, r.tunables[i].apply)
+		}
+	})
+	for _, fn := range apply {
+		fn(next)
+	}
+	r.current = next
+	r.logger.Info("config reloaded", "changed", changed)
+	return nil
+}
+
+func (r *Reloader) tunableFor(key string) int {
+	for i, t := range r.tunables {
+		for _, k := range t.keys {
+			if key == k || strings.HasPrefix(key, k+".") {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// run reloads the configuration on every SIGHUP until ctx is done.
+func (r *Reloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	defer notifyReload(hup)()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.logger.Info("reloading config", "path", r.path)
+			if err := r.Reload(); err != nil {
+				r.logger.Error("cannot reload config, keeping the current one", "error", err)
+			}
+		}
+	}
+}
+
+// diffConfig calls fn for every setting that differs between cur and next,
+// named by the dotted path of its JSON keys. cur is addressable so that fn
+// can update it.
+func diffConfig(prefix string, cur, next reflect.Value, fn func(key string, cur, next reflect.Value)) {
+	t := cur.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+		cv, nv := cur.Field(i), next.Field(i)
+		if f.Type.Kind() == reflect.Struct && !f.Type.Implements(textMarshalerType) {
+			diffConfig(key+".", cv, nv, fn)
+			continue
+		}
+		if !reflect.DeepEqual(cv.Interface(), nv.Interface()) {
+			fn(key, cv, nv)
+		}
+	}
+}
+
+var textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
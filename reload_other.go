@@ -0,0 +1,11 @@
+//go:build js || wasip1
+
+package main
+
+import "os"
+
+// notifyReload relays nothing: there is no SIGHUP on this system, so the
+// configuration is only read at startup.
+func notifyReload(c chan<- os.Signal) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,15 @@
+//go:build !js && !wasip1
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload relays SIGHUP to c, and returns a function that stops it.
+func notifyReload(c chan<- os.Signal) (stop func()) {
+	signal.Notify(c, syscall.SIGHUP)
+	return func() { signal.Stop(c) }
+}
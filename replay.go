@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// replayResult is the outcome of sending a captured request again.
+type replayResult struct {
+	skipped bool
+	status  int
+	latency time.Duration
+	err     error
+}
+
+// headerFlag is a repeatable flag of "Name: value" headers.
+type headerFlag http.Header
+
+func (h headerFlag) String() string { return "" }
+
+func (h headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return errors.New(`must be "Name: value"`)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+// runReplay implements the replay command, which sends the requests of a
+// capture file again to a server, reports those that get another status
+// than they got when captured, and compares the latencies.
+func runReplay(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8080", "URL of the server to send the requests to")
+	concurrency := fs.Int("concurrency", 1, "requests to send at once; with more than one they are not sent in order")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long each request may take")
+	headers := headerFlag{}
+	fs.Var(headers, "header", `header, such as "X-API-Key: key", to send in place of the one captured, which is redacted; can be repeated`)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *concurrency < 1 {
+		return errors.New("usage: replay [-target url] [-concurrency n] [-timeout d] [-header 'Name: value']... file")
+	}
+	if u, err := url.Parse(*target); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid target %q", *target)
+	}
+	reqs, err := readCapture(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	base := strings.TrimSuffix(*target, "/")
+	results := make([]replayResult, len(reqs))
+	start := time.Now()
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = replayRequest(client, base, http.Header(headers), reqs[i])
+			}
+		}()
+	}
+	for i := range reqs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var same, different, failed, skipped int
+	var captured, replayed []time.Duration
+	for i, res := range results {
+		c := reqs[i]
+		switch {
+		case res.skipped:
+			skipped++
+			continue
+		case res.err != nil:
+			failed++
+			fmt.Fprintf(w, "%s %s: %v\n", c.Method, c.URL, res.err)
+			continue
+		case res.status != c.Status:
+			different++
+			fmt.Fprintf(w, "%s %s: got %d, captured %d\n", c.Method, c.URL, res.status, c.Status)
+		default:
+			same++
+		}
+		captured = append(captured, time.Duration(c.LatencyMS*float64(time.Millisecond)))
+		replayed = append(replayed, res.latency)
+	}
+	fmt.Fprintf(w, "%d requests in %s: %d as captured, %d different, %d failed, %d skipped for lack of a body\n",
+		len(reqs), elapsed.Round(time.Millisecond), same, different, failed, skipped)
+	if len(replayed) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "LATENCY\tP50\tP95\tP99\tMAX")
+		for _, row := range []struct {
+			name string
+			d    []time.Duration
+		}{{"captured", captured}, {"replayed", replayed}} {
+			slices.Sort(row.d)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", row.name, percentile(row.d, 0.5), percentile(row.d, 0.95), percentile(row.d, 0.99), percentile(row.d, 1))
+		}
+		tw.Flush()
+	}
+	if different+failed > 0 {
+		return fmt.Errorf("%d of %d requests did not get the captured status", different+failed, len(reqs)-skipped)
+	}
+	return nil
+}
+
+// percentile returns the p quantile of sorted, which must not be empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	return sorted[max(0, min(i, len(sorted)-1))].Round(10 * time.Microsecond)
+}
+
+// readCapture reads the requests of a capture file.
+func readCapture(path string) ([]CapturedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var reqs []CapturedRequest
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var c CapturedRequest
+			if err := json.Unmarshal(line, &c); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			reqs = append(reqs, c)
+		}
+		if err == io.EOF {
+			return reqs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replayRequest sends c to base, with those of headers that c had in place
+// of its own. Its other redacted headers are left out.
+func replayRequest(client *http.Client, base string, headers http.Header, c CapturedRequest) replayResult {
+	if c.BodyOmitted {
+		return replayResult{skipped: true}
+	}
+	req, err := http.NewRequest(c.Method, base+c.URL, strings.NewReader(c.Body))
+	if err != nil {
+		return replayResult{err: err}
+	}
+	for k, vs := range c.Header {
+		switch {
+		case headers[k] != nil:
+			req.Header[k] = headers[k]
+		case !slices.Equal(vs, []string{redactedValue}):
+			req.Header[k] = vs
+		}
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return replayResult{err: err}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return replayResult{status: resp.StatusCode, latency: time.Since(start)}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CodeUnavailable = "unavailable"
+
+// PermBreakersRead lets callers see the state of the circuit breakers.
+const PermBreakersRead Permission = "circuit_breakers:read"
+
+// ErrCircuitOpen is returned instead of calling a target whose circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// breakerState is the state of a circuit breaker. Its value is that of
+// the circuit_breaker_state metric.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker stops calls to a target that keeps failing, so that
+// callers fail fast instead of waiting on it and it is given time to
+// recover. After threshold failures in a row the breaker opens and calls
+// fail with ErrCircuitOpen; once cooldown has passed it lets one call
+// through, and closes again if that call succeeds or opens for another
+// cooldown if it fails. A nil breaker lets every call through.
+type CircuitBreaker struct {
+	target    string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	metrics   *breakerMetrics
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	lastError string
+}
+
+// Do calls fn unless the breaker is open. fn reports whether its call
+// failed in a way that counts against the target, which is not the same as
+// returning an error: a 404 response from a healthy service does not.
+func (b *CircuitBreaker) Do(fn func() (failed bool, err error)) error {
+	if b == nil {
+		_, err := fn()
+		return err
+	}
+	if !b.allow() {
+		if b.metrics != nil {
+			b.metrics.rejected.Inc(b.target)
+		}
+		return ErrCircuitOpen
+	}
+	failed, err := fn()
+	b.record(failed, err)
+	return err
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *CircuitBreaker) record(failed bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+	if !failed {
+		// A call let through before the breaker opened does not close it.
+		if b.state != breakerOpen {
+			b.failures = 0
+			if b.state == breakerHalfOpen {
+				b.setState(breakerClosed)
+			}
+		}
+		return
+	}
+	b.failures++
+	if err != nil {
+		b.lastError = err.Error()
+	}
+	if b.state == breakerHalfOpen || b.state == breakerClosed && b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *CircuitBreaker) setState(s breakerState) {
+	b.state = s
+	if b.metrics != nil {
+		b.metrics.state.Set(float64(s), b.target)
+		b.metrics.transitions.Inc(b.target, s.String())
+	}
+}
+
+// BreakerStatus is the state of the circuit breaker of a target, as shown
+// by GET /admin/circuit-breakers.
+type BreakerStatus struct {
+	Target    string     `json:"target"`
+	State     string     `json:"state"`
+	Failures  int        `json:"consecutive_failures"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+func (b *CircuitBreaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStatus{Target: b.target, State: b.state.String(), Failures: b.failures, LastError: b.lastError}
+	if b.state != breakerClosed {
+		at := b.openedAt.UTC()
+		st.OpenedAt = &at
+	}
+	return st
+}
+
+type breakerMetrics struct {
+	state       *GaugeVec
+	transitions *CounterVec
+	rejected    *CounterVec
+}
+
+// Breakers holds a circuit breaker for each target called, such as the
+// storage backend or the host of a webhook, created on first use. A nil
+// Breakers hands out nil breakers, which never open.
+type Breakers struct {
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+	metrics   *breakerMetrics
+
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewBreakers returns the breakers configured by cfg, whose cooldowns are
+// measured by clock. reg, if not nil, gets their metrics.
+func NewBreakers(cfg ResilienceConfig, clock Clock, reg *Registry) *Breakers {
+	b := &Breakers{
+		threshold: cfg.FailureThreshold,
+		cooldown:  cfg.OpenTimeout.Duration,
+		clock:     clock,
+		breakers:  make(map[string]*CircuitBreaker),
+	}
+	if reg != nil {
+		b.metrics = &breakerMetrics{
+			state:       reg.NewGaugeVec("circuit_breaker_state", "State of the circuit breaker of each target: 0 closed, 1 half-open, 2 open.", "target"),
+			transitions: reg.NewCounterVec("circuit_breaker_transitions_total", "Number of times circuit breakers changed state, by target and new state.", "target", "state"),
+			rejected:    reg.NewCounterVec("circuit_breaker_rejected_total", "Number of calls refused by an open circuit breaker, by target.", "target"),
+		}
+	}
+	return b
+}
+
+// Get returns the breaker of target.
+func (b *Breakers) Get(target string) *CircuitBreaker {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cb, ok := b.breakers[target]
+	if !ok {
+		cb = &CircuitBreaker{target: target, threshold: b.threshold, cooldown: b.cooldown, now: b.clock.Now, metrics: b.metrics}
+		b.breakers[target] = cb
+		if b.metrics != nil {
+			b.metrics.state.Set(float64(breakerClosed), target)
+		}
+	}
+	return cb
+}
+
+// Status returns the state of every breaker, by target.
+func (b *Breakers) Status() []BreakerStatus {
+	b.mu.Lock()
+	list := make([]*CircuitBreaker, 0, len(b.breakers))
+	for _, cb := range b.breakers {
+		list = append(list, cb)
+	}
+	b.mu.Unlock()
+	statuses := make([]BreakerStatus, len(list))
+	for i, cb := range list {
+		statuses[i] = cb.status()
+	}
+	slices.SortFunc(statuses, func(a, b BreakerStatus) int { return strings.Compare(a.Target, b.Target) })
+	return statuses
+}
+
+// register adds GET /admin/circuit-breakers, listing the breakers.
+func (b *Breakers) register(rt *Router) {
+	rt.Get("/admin/circuit-breakers", func(w http.ResponseWriter, r *http.Request) error {
+		respond(w, r, http.StatusOK, listResponse[BreakerStatus]{Items: b.Status()})
+		return nil
+	})
+	rt.Document("GET", "/admin/circuit-breakers", Operation{Summary: "Show the state of the circuit breakers of outbound calls", Tag: "admin", Response: listResponse[BreakerStatus]{}})
+}
+
+// RetryPolicy sends failed calls again up to Retries times, waiting a
+// random time of up to Backoff, doubled for every attempt, before each, as
+// measured by Clock.
+type RetryPolicy struct {
+	Retries int
+	Backoff time.Duration
+	Clock   Clock
+}
+
+// Do calls fn, with the number of the attempt counting from 0, until it
+// succeeds, fails with an error that retryable rejects, that is Permanent
+// or ErrCircuitOpen, or the retries are used up, and returns its last
+// error. If ctx is done while waiting to retry, it returns ctx's error.
+func (p RetryPolicy) Do(ctx context.Context, retryable func(error) bool, fn func(attempt int) error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		var perm permanentError
+		if err == nil || attempt >= p.Retries || ctx.Err() != nil || errors.As(err, &perm) ||
+			errors.Is(err, ErrCircuitOpen) || !retryable(err) {
+			return err
+		}
+		if p.Backoff <= 0 {
+			continue
+		}
+		timer := p.Clock.NewTimer(rand.N(p.Backoff<<min(attempt, 20)) + 1)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C():
+		}
+	}
+}
+
+// storeFailure reports whether err, returned by a store call, means that
+// the backend failed, rather than that it answered as it should, as with
+// ErrNotFound, or that the caller gave up.
+func storeFailure(err error) bool {
+	return err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrConflict) &&
+		!errors.Is(err, ErrStale) && !errors.Is(err, context.Canceled)
+}
+
+// resilientStore guards the wrapped store with a circuit breaker, so that
+// calls fail fast with ErrCircuitOpen while the backend is down, and
+// retries the reads that fail. Writes are not retried, since one that
+// failed may still have been applied, and neither are calls within a
+// transaction, which a failed statement aborts.
+type resilientStore struct {
+	Store
+	breaker *CircuitBreaker
+	retry   RetryPolicy
+}
+
+func (s resilientStore) read(ctx context.Context, fn func() error) error {
+	if inTransaction(ctx) {
+		return s.write(fn)
+	}
+	return s.retry.Do(ctx, storeFailure, func(int) error { return s.write(fn) })
+}
+
+func (s resilientStore) write(fn func() error) error {
+	return s.breaker.Do(func() (bool, error) {
+		err := fn()
+		return storeFailure(err), err
+	})
+}
+
+func (s resilientStore) List(ctx context.Context, q ListQuery) (list []Pebble, err error) {
+	err = s.read(ctx, func() error { list, err = s.Store.List(ctx, q); return err })
+	return list, err
+}
+
+func (s resilientStore) Search(ctx context.Context, q SearchQuery) (hits []SearchHit, err error) {
+	err = s.read(ctx, func() error { hits, err = s.Store.Search(ctx, q); return err })
+	return hits, err
+}
+
+func (s resilientStore) Get(ctx context.Context, id string) (p Pebble, err error) {
+	err = s.read(ctx, func() error { p, err = s.Store.Get(ctx, id); return err })
+	return p, err
+}
+
+func (s resilientStore) Create(ctx context.Context, p Pebble) error {
+	return s.write(func() error { return s.Store.Create(ctx, p) })
+}
+
+func (s resilientStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	return s.write(func() error { return s.Store.Update(ctx, p, prev) })
+}
+
+func (s resilientStore) Delete(ctx context.Context, id string, at time.Time) error {
+	return s.write(func() error { return s.Store.Delete(ctx, id, at) })
+}
+
+func (s resilientStore) Restore(ctx context.Context, id string) error {
+	return s.write(func() error { return s.Store.Restore(ctx, id) })
+}
+
+func (s resilientStore) Purge(ctx context.Context, before time.Time) (ids []string, err error) {
+	err = s.write(func() error { ids, err = s.Store.Purge(ctx, before); return err })
+	return ids, err
+}
+
+func (s resilientStore) CreateAPIKey(ctx context.Context, k APIKey) error {
+	return s.write(func() error { return s.Store.CreateAPIKey(ctx, k) })
+}
+
+func (s resilientStore) ListAPIKeys(ctx context.Context) (keys []APIKey, err error) {
+	err = s.read(ctx, func() error { keys, err = s.Store.ListAPIKeys(ctx); return err })
+	return keys, err
+}
+
+func (s resilientStore) GetAPIKey(ctx context.Context, id string) (k APIKey, err error) {
+	err = s.read(ctx, func() error { k, err = s.Store.GetAPIKey(ctx, id); return err })
+	return k, err
+}
+
+func (s resilientStore) GetAPIKeyByHash(ctx context.Context, hash string) (k APIKey, err error) {
+	err = s.read(ctx, func() error { k, err = s.Store.GetAPIKeyByHash(ctx, hash); return err })
+	return k, err
+}
+
+func (s resilientStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return s.write(func() error { return s.Store.RevokeAPIKey(ctx, id, at) })
+}
+
+func (s resilientStore) CreateWebhook(ctx context.Context, w Webhook) error {
+	return s.write(func() error { return s.Store.CreateWebhook(ctx, w) })
+}
+
+func (s resilientStore) ListWebhooks(ctx context.Context) (hooks []Webhook, err error) {
+	err = s.read(ctx, func() error { hooks, err = s.Store.ListWebhooks(ctx); return err })
+	return hooks, err
+}
+
+func (s resilientStore) GetWebhook(ctx context.Context, id string) (w Webhook, err error) {
+	err = s.read(ctx, func() error { w, err = s.Store.GetWebhook(ctx, id); return err })
+	return w, err
+}
+
+func (s resilientStore) DeleteWebhook(ctx context.Context, id string) error {
+	return s.write(func() error { return s.Store.DeleteWebhook(ctx, id) })
+}
+
+func (s resilientStore) SaveWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	return s.write(func() error { return s.Store.SaveWebhookDelivery(ctx, d) })
+}
+
+func (s resilientStore) ListWebhookDeliveries(ctx context.Context, webhookID, status string, limit int) (list []WebhookDelivery, err error) {
+	err = s.read(ctx, func() error { list, err = s.Store.ListWebhookDeliveries(ctx, webhookID, status, limit); return err })
+	return list, err
+}
+
+func (s resilientStore) AppendAuditEntry(ctx context.Context, e AuditEntry) error {
+	return s.write(func() error { return s.Store.AppendAuditEntry(ctx, e) })
+}
+
+func (s resilientStore) ListAuditEntries(ctx context.Context, q AuditQuery) (list []AuditEntry, err error) {
+	err = s.read(ctx, func() error { list, err = s.Store.ListAuditEntries(ctx, q); return err })
+	return list, err
+}
+
+func (s resilientStore) CreateAttachment(ctx context.Context, a Attachment) error {
+	return s.write(func() error { return s.Store.CreateAttachment(ctx, a) })
+}
+
+func (s resilientStore) ListAttachments(ctx context.Context, pebbleIDs ...string) (list []Attachment, err error) {
+	err = s.read(ctx, func() error { list, err = s.Store.ListAttachments(ctx, pebbleIDs...); return err })
+	return list, err
+}
+
+func (s resilientStore) GetAttachment(ctx context.Context, id string) (a Attachment, err error) {
+	err = s.read(ctx, func() error { a, err = s.Store.GetAttachment(ctx, id); return err })
+	return a, err
+}
+
+func (s resilientStore) DeleteAttachment(ctx context.Context, id string) error {
+	return s.write(func() error { return s.Store.DeleteAttachment(ctx, id) })
+}
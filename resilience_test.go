@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerCooldownByClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	cfg := ResilienceConfig{FailureThreshold: 2, OpenTimeout: Duration{30 * time.Second}}
+	cb := NewBreakers(cfg, clock, nil).Get("storage")
+	fail := func() (bool, error) { return true, errors.New("down") }
+	ok := func() (bool, error) { return false, nil }
+
+	for range cfg.FailureThreshold {
+		cb.Do(fail)
+	}
+	if err := cb.Do(ok); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got error %v after %d failures, want ErrCircuitOpen", err, cfg.FailureThreshold)
+	}
+	if st := cb.status(); st.OpenedAt == nil || !st.OpenedAt.Equal(clock.Now()) {
+		t.Errorf("got opened at %v, want %s", st.OpenedAt, clock.Now())
+	}
+
+	clock.Advance(cfg.OpenTimeout.Duration - time.Second)
+	if err := cb.Do(ok); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("the breaker let a call through a second before its cooldown ended: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := cb.Do(ok); err != nil {
+		t.Fatalf("the breaker refused the probe once its cooldown ended: %v", err)
+	}
+	if st := cb.status(); st.State != "closed" {
+		t.Errorf("got state %s after a successful probe, want closed", st.State)
+	}
+}
+
+func TestRetryPolicyBacksOffByClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	p := RetryPolicy{Retries: 1, Backoff: time.Second, Clock: clock}
+	attempts := make(chan int, 2)
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Do(context.Background(), func(error) bool { return true }, func(attempt int) error {
+			attempts <- attempt
+			if attempt == 0 {
+				return errors.New("not yet")
+			}
+			return nil
+		})
+	}()
+
+	<-attempts
+	waitFor(t, "the backoff timer", func() bool { return clock.Waiting() == 1 })
+	select {
+	case <-attempts:
+		t.Fatal("the call was retried before the backoff passed")
+	default:
+	}
+	// The backoff is random, but at most Backoff for the first retry.
+	clock.Advance(p.Backoff)
+	if attempt := <-attempts; attempt != 1 {
+		t.Errorf("got attempt %d, want 1", attempt)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("got error %v, want the retry's success", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// responseBufferMax is the capacity past which a response buffer is not
+// put back in the pool, so that one large response does not keep its
+// memory for the life of the process.
+const responseBufferMax = 64 << 10
+
+// chunkedBodySize is the size past which net/http sends a body without a
+// Content-Length, in chunks, unless the handler sets one. It works out the
+// length of smaller bodies itself.
+const chunkedBodySize = 2048
+
+// responseBuffer is a buffer that response bodies are encoded into before
+// they are written, with a JSON encoder of its own.
+type responseBuffer struct {
+	bytes.Buffer
+	json *json.Encoder
+}
+
+// responseBuffers pools response buffers, sparing most requests the
+// allocations of growing one and of a JSON encoder.
+var responseBuffers = sync.Pool{
+	New: func() any {
+		buf := &responseBuffer{}
+		buf.Grow(4 << 10)
+		buf.json = json.NewEncoder(&buf.Buffer)
+		return buf
+	},
+}
+
+func getResponseBuffer() *responseBuffer {
+	return responseBuffers.Get().(*responseBuffer)
+}
+
+func putResponseBuffer(buf *responseBuffer) {
+	if buf.Cap() > responseBufferMax {
+		return
+	}
+	buf.Reset()
+	responseBuffers.Put(buf)
+}
+
+// encode appends v in the format of c.
+func (buf *responseBuffer) encode(c *Codec, v any) error {
+	if c == jsonCodec {
+		return buf.json.Encode(v)
+	}
+	return c.Encode(&buf.Buffer, v)
+}
+
+// contentTypes holds the Content-Type header values of the codecs, so that
+// setting one does not allocate.
+var contentTypes = map[*Codec][]string{
+	jsonCodec:    {jsonCodec.MediaType()},
+	xmlCodec:     {xmlCodec.MediaType()},
+	msgpackCodec: {msgpackCodec.MediaType()},
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	buf := getResponseBuffer()
+	defer putResponseBuffer(buf)
+	buf.json.Encode(v)
+	writeBody(w, jsonCodec, status, buf.Bytes())
+}
+
+// respond writes v as the response body with the given status, in the
+// format Negotiate picked for r. The body is encoded in full before
+// anything is written, so that a value that cannot be encoded gets a 500
+// response rather than half a body.
+func respond(w http.ResponseWriter, r *http.Request, status int, v any) {
+	c := responseCodec(r.Context())
+	buf := getResponseBuffer()
+	defer putResponseBuffer(buf)
+	if err := buf.encode(c, v); err != nil {
+		WriteError(w, r, fmt.Errorf("encode response: %w", err))
+		return
+	}
+	writeBody(w, c, status, buf.Bytes())
+}
+
+// writeBody writes body, encoded by c, in one write, with its length if
+// net/http would otherwise send it in chunks.
+func writeBody(w http.ResponseWriter, c *Codec, status int, body []byte) {
+	h := w.Header()
+	h["Content-Type"] = contentTypes[c]
+	if len(body) > chunkedBodySize {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
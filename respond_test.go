@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// discardWriter is a ResponseWriter that keeps its header map between
+// requests and discards the body, so that the allocations measured are
+// those of encoding and writing the response.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header { return w.header }
+
+func (w *discardWriter) WriteHeader(status int) { w.status = status }
+
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (w *discardWriter) reset() {
+	for k := range w.header {
+		delete(w.header, k)
+	}
+	w.status = 0
+}
+
+func benchPebble(i int) Pebble {
+	at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	return Pebble{ID: fmt.Sprintf("3028cc7c-70a7-4c3f-b695-a11fb8bd%04d", i), Name: "Flint", Color: "grey", WeightGrams: 30, CreatedAt: at, UpdatedAt: at}
+}
+
+func benchPebbles(n int) listResponse[Pebble] {
+	var list listResponse[Pebble]
+	for i := range n {
+		list.Items = append(list.Items, benchPebble(i))
+	}
+	return list
+}
+
+// Allocation budgets of the JSON response path, per response, as
+// go test -bench -memprofile shows them: the value put in an interface,
+// one inside encoding/json, and the ETag and its header, or the list's
+// Content-Length. A change that goes over them should say why.
+const (
+	writeResourceAllocs = 4
+	respondListAllocs   = 4
+)
+
+func TestWriteResourceAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	w := &discardWriter{header: make(http.Header)}
+	r := httptest.NewRequest(http.MethodGet, "/pebbles/1", nil)
+	p := benchPebble(1)
+	allocs := testing.AllocsPerRun(100, func() {
+		w.reset()
+		writeResource(w, r, http.StatusOK, p)
+	})
+	if allocs > writeResourceAllocs {
+		t.Errorf("writeResource allocates %.0f times per response, over the budget of %d", allocs, writeResourceAllocs)
+	}
+	if w.status != http.StatusOK || w.header.Get("ETag") == "" {
+		t.Errorf("got status %d and ETag %q, want 200 and a tag", w.status, w.header.Get("ETag"))
+	}
+}
+
+func TestRespondListAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	w := &discardWriter{header: make(http.Header)}
+	r := httptest.NewRequest(http.MethodGet, "/pebbles", nil)
+	list := benchPebbles(20)
+	allocs := testing.AllocsPerRun(100, func() {
+		w.reset()
+		respond(w, r, http.StatusOK, list)
+	})
+	if allocs > respondListAllocs {
+		t.Errorf("respond allocates %.0f times per 20-pebble list, over the budget of %d", allocs, respondListAllocs)
+	}
+}
+
+func BenchmarkWriteResource(b *testing.B) {
+	w := &discardWriter{header: make(http.Header)}
+	r := httptest.NewRequest(http.MethodGet, "/pebbles/1", nil)
+	p := benchPebble(1)
+	b.ReportAllocs()
+	for b.Loop() {
+		w.reset()
+		writeResource(w, r, http.StatusOK, p)
+	}
+}
+
+func BenchmarkWriteResourceNotModified(b *testing.B) {
+	w := &discardWriter{header: make(http.Header)}
+	r := httptest.NewRequest(http.MethodGet, "/pebbles/1", nil)
+	p := benchPebble(1)
+	r.Header.Set("If-None-Match", computeETag(p))
+	b.ReportAllocs()
+	for b.Loop() {
+		w.reset()
+		writeResource(w, r, http.StatusOK, p)
+	}
+}
+
+func BenchmarkRespondList(b *testing.B) {
+	w := &discardWriter{header: make(http.Header)}
+	r := httptest.NewRequest(http.MethodGet, "/pebbles", nil)
+	list := benchPebbles(20)
+	b.ReportAllocs()
+	for b.Loop() {
+		w.reset()
+		respond(w, r, http.StatusOK, list)
+	}
+}
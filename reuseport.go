@@ -0,0 +1,22 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// reusePortSupported reports whether listeners can be bound with
+// SO_REUSEPORT on this system.
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound, for
+// net.ListenConfig.Control.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,8 @@
+//go:build linux && (386 || amd64 || arm)
+
+package main
+
+// soReusePort is SO_REUSEPORT, which package syscall does not define on
+// these architectures. Its value is 15 on all of them; MIPS, whose value
+// differs, gets it from package syscall.
+const soReusePort = 0xf
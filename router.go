@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Route is an entry in the router's route table. Middleware names the
+// middleware that wraps its handler, outermost first.
+type Route struct {
+	Method     string
+	Path       string
+	Doc        Operation
+	Middleware []string
+
+	group *Router
+}
+
+// Operation describes a route for the OpenAPI document. Request and
+// Response are values of the body types, such as Pebble{}; a nil Response
+// means the route returns no body.
+type Operation struct {
+	Summary  string
+	Tag      string
+	Request  any
+	Response any
+	// Status is the status of a successful response, 200 if zero.
+	Status int
+	// List, if set, describes the query parameters of a list endpoint.
+	List *ListParams
+}
+
+// Router dispatches requests by method and path using http.ServeMux
+// patterns, so paths may capture values such as /items/{id}. Requests for a
+// known path with an unregistered method get a 405 response.
+//
+// Every route is wrapped in the middleware added with Use, except those
+// its group leaves out with Without, and then in that of its group, added
+// with With:
+//
+//	streams := rt.Group("").Without("compress", "timeout")
+//	admin := rt.Group("/admin").With("audit", Audit(store, clock, logger))
+type Router struct {
+	mux     *http.ServeMux
+	routes  *[]Route
+	stack   *[]namedMiddleware
+	prefix  string
+	mws     []namedMiddleware
+	without []string
+}
+
+type namedMiddleware struct {
+	name string
+	mw   Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{mux: http.NewServeMux(), routes: new([]Route), stack: new([]namedMiddleware)}
+}
+
+// Use adds mw under name to the middleware wrapping every route, inside
+// the middleware added before it and outside that of the route's group.
+// It applies to the routes registered already too, but must be called
+// before the router serves requests.
+func (rt *Router) Use(name string, mw Middleware) {
+	*rt.stack = append(*rt.stack, namedMiddleware{name, mw})
+}
+
+// Group returns a router that registers its routes on rt, with prefix
+// added to their paths and the middleware of rt.
+func (rt *Router) Group(prefix string) *Router {
+	g := *rt
+	g.prefix = rt.prefix + prefix
+	return &g
+}
+
+// With returns a router like rt whose routes are also wrapped in mw, known
+// as name, inside the middleware of rt's routes.
+func (rt *Router) With(name string, mw Middleware) *Router {
+	g := *rt
+	g.mws = append(slices.Clone(rt.mws), namedMiddleware{name, mw})
+	return &g
+}
+
+// Without returns a router like rt whose routes skip the middleware added
+// with Use under names, such as compression for streams.
+func (rt *Router) Without(names ...string) *Router {
+	g := *rt
+	g.without = append(slices.Clone(rt.without), names...)
+	return &g
+}
+
+// middleware returns the middleware wrapping the routes of rt, outermost
+// first.
+func (rt *Router) middleware() []namedMiddleware {
+	var mws []namedMiddleware
+	for _, m := range *rt.stack {
+		if !slices.Contains(rt.without, m.name) {
+			mws = append(mws, m)
+		}
+	}
+	return append(mws, rt.mws...)
+}
+
+// Handle registers h for method and path. An empty method matches any
+// method.
+func (rt *Router) Handle(method, path string, h http.Handler) {
+	path = rt.prefix + path
+	pattern := path
+	if method != "" {
+		pattern = method + " " + path
+	}
+	rt.mux.Handle(pattern, &routeHandler{group: rt, h: h})
+	*rt.routes = append(*rt.routes, Route{Method: method, Path: path, group: rt})
+}
+
+// routeHandler wraps the handler of a route in its middleware when it
+// serves its first request, once every call to Use has been made.
+type routeHandler struct {
+	group   *Router
+	h       http.Handler
+	once    sync.Once
+	wrapped http.Handler
+}
+
+func (rh *routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.once.Do(func() {
+		rh.wrapped = rh.h
+		mws := rh.group.middleware()
+		for i := len(mws) - 1; i >= 0; i-- {
+			rh.wrapped = mws[i].mw(rh.wrapped)
+		}
+	})
+	rh.wrapped.ServeHTTP(w, r)
+}
+
+func (rt *Router) HandleFunc(method, path string, fn http.HandlerFunc) {
+	rt.Handle(method, path, fn)
+}
+
+func (rt *Router) Get(path string, fn APIHandlerFunc) {
+	rt.Handle(http.MethodGet, path, fn)
+}
+
+func (rt *Router) Post(path string, fn APIHandlerFunc) {
+	rt.Handle(http.MethodPost, path, fn)
+}
+
+func (rt *Router) Put(path string, fn APIHandlerFunc) {
+	rt.Handle(http.MethodPut, path, fn)
+}
+
+func (rt *Router) Patch(path string, fn APIHandlerFunc) {
+	rt.Handle(http.MethodPatch, path, fn)
+}
+
+func (rt *Router) Delete(path string, fn APIHandlerFunc) {
+	rt.Handle(http.MethodDelete, path, fn)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+// Handler returns the handler and pattern that would serve r.
+func (rt *Router) Handler(r *http.Request) (http.Handler, string) {
+	return rt.mux.Handler(r)
+}
+
+// Document attaches op to the route registered for method and path.
+func (rt *Router) Document(method, path string, op Operation) {
+	path = rt.prefix + path
+	for i, route := range *rt.routes {
+		if route.Method == method && route.Path == path {
+			(*rt.routes)[i].Doc = op
+			return
+		}
+	}
+	panic("router: no route " + method + " " + path + " to document")
+}
+
+// Routes returns the registered routes in registration order.
+func (rt *Router) Routes() []Route {
+	routes := append([]Route(nil), *rt.routes...)
+	for i, route := range routes {
+		for _, m := range route.group.middleware() {
+			routes[i].Middleware = append(routes[i].Middleware, m.name)
+		}
+	}
+	return routes
+}
+
+// PathInt returns the path value name parsed as an integer. If it is not
+// one the error is an invalid request error, so returning it from an
+// APIHandlerFunc produces a 400 response.
+func PathInt(r *http.Request, name string) (int64, error) {
+	n, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil {
+		return 0, Invalid(nil, "path parameter %q must be an integer", name)
+	}
+	return n, nil
+}
+
+// PathUUID returns the path value name as a lower-case UUID. Like PathInt
+// it returns an invalid request error if the value is not one.
+func PathUUID(r *http.Request, name string) (string, error) {
+	id, err := parseUUID(r.PathValue(name))
+	if err != nil {
+		return "", Invalid(nil, "path parameter %q must be a UUID", name)
+	}
+	return id, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The jobs the server schedules, by the name scheduler.jobs knows them by.
+const (
+	jobJWKSRefresh  = "jwks_refresh"
+	jobPurgeDeleted = "purge_deleted"
+)
+
+// scheduledJobNames are the names of the jobs scheduler.jobs may set.
+var scheduledJobNames = []string{jobJWKSRefresh, jobPurgeDeleted}
+
+// scheduleOff is the schedule of a job that does not run.
+const scheduleOff = "off"
+
+// ScheduledFunc is the work of a scheduled job. Its context is cancelled
+// if the job is still running when the scheduler's stop times out.
+type ScheduledFunc func(ctx context.Context) error
+
+// Scheduler runs jobs on their schedules in the background. A job that is
+// still running when it is due again skips that run rather than running
+// twice at once, and each run of an exclusive job takes the job's lock
+// from locker first, skipping the run if another instance holds it. The
+// lock is kept for at least minHold, or half the time to the next run if
+// that is shorter, so that instances whose clocks differ a little do not
+// each run the job. On stop no more runs start, and the ones running are
+// waited for.
+type Scheduler struct {
+	loc       *time.Location
+	overrides map[string]string
+	locker    JobLocker
+	minHold   time.Duration
+	logger    *slog.Logger
+	metrics   *schedulerMetrics
+	clock     Clock
+
+	jobs   []*scheduledJob
+	wg     sync.WaitGroup
+	stop   context.CancelFunc
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type scheduledJob struct {
+	name     string
+	spec     string
+	schedule Schedule
+	// exclusive jobs take their lock for each run.
+	exclusive bool
+	fn        ScheduledFunc
+
+	mu      sync.Mutex
+	running bool
+	status  ScheduledJobStatus
+}
+
+// ScheduledJobStatus is the state of a scheduled job, for /admin/scheduler.
+type ScheduledJobStatus struct {
+	Name      string     `json:"name"`
+	Schedule  string     `json:"schedule"`
+	Exclusive bool       `json:"exclusive"`
+	Running   bool       `json:"running"`
+	NextRun   *time.Time `json:"next_run,omitempty"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Runs      int        `json:"runs"`
+	Failures  int        `json:"failures"`
+	Skipped   int        `json:"skipped"`
+	// HeldElsewhere counts the runs left to the instance holding the lock.
+	HeldElsewhere int         `json:"held_elsewhere"`
+	Lock          *LockHolder `json:"lock,omitempty"`
+}
+
+type schedulerMetrics struct {
+	runs        *CounterVec
+	duration    *HistogramVec
+	lastSuccess *GaugeVec
+}
+
+// NewScheduler returns a scheduler configured by cfg, which has been
+// validated, whose runs take their locks from locker and fall due by
+// clock. reg, if not nil, receives its metrics.
+func NewScheduler(cfg SchedulerConfig, locker JobLocker, clock Clock, logger *slog.Logger, reg *Registry) *Scheduler {
+	loc, _ := time.LoadLocation(cfg.Timezone)
+	s := &Scheduler{loc: loc, overrides: cfg.Jobs, locker: locker, minHold: cfg.LockMinHold.Duration, logger: logger, clock: clock}
+	if reg != nil {
+		s.metrics = &schedulerMetrics{
+			runs: reg.NewCounterVec("scheduler_runs_total",
+				"Number of scheduled job runs, by job and result.", "job", "result"),
+			duration: reg.NewHistogramVec("scheduler_run_duration_seconds",
+				"Time taken by scheduled job runs.", DefBuckets, "job"),
+			lastSuccess: reg.NewGaugeVec("scheduler_last_success_timestamp_seconds",
+				"Unix time of the last successful run of each scheduled job.", "job"),
+		}
+	}
+	return s
+}
+
+// Add schedules fn as the job name on spec, unless scheduler.jobs sets
+// another schedule for it, for every instance to run, as for work on
+// what each keeps in memory. It must be called before the scheduler is
+// started, and panics if the schedule does not parse, which Validate
+// rules out for those of scheduler.jobs.
+func (s *Scheduler) Add(name, spec string, fn ScheduledFunc) {
+	s.add(name, spec, false, fn)
+}
+
+// AddExclusive is like Add but for jobs that one instance runs at a time,
+// as for work on the database, each run taking the job's lock.
+func (s *Scheduler) AddExclusive(name, spec string, fn ScheduledFunc) {
+	s.add(name, spec, true, fn)
+}
+
+func (s *Scheduler) add(name, spec string, exclusive bool, fn ScheduledFunc) {
+	if override, ok := s.overrides[name]; ok {
+		spec = override
+	}
+	if spec == scheduleOff {
+		s.logger.Info("scheduled job is off", "job", name)
+		return
+	}
+	schedule, err := parseSchedule(spec, s.loc)
+	if err != nil {
+		panic(fmt.Sprintf("cannot schedule %s: %v", name, err))
+	}
+	s.jobs = append(s.jobs, &scheduledJob{
+		name:      name,
+		spec:      spec,
+		schedule:  schedule,
+		exclusive: exclusive,
+		fn:        fn,
+		status:    ScheduledJobStatus{Name: name, Schedule: spec, Exclusive: exclusive},
+	})
+}
+
+// Hook returns the lifecycle hook that starts and stops the scheduler.
+func (s *Scheduler) Hook() Hook {
+	return Hook{
+		Name: "scheduler",
+		OnStart: func(context.Context) error {
+			var loop, run context.Context
+			loop, s.stop = context.WithCancel(context.Background())
+			run, s.cancel = context.WithCancel(context.Background())
+			var loops sync.WaitGroup
+			for _, job := range s.jobs {
+				loops.Add(1)
+				go func() {
+					defer loops.Done()
+					s.loop(loop, run, job)
+				}()
+			}
+			s.done = make(chan struct{})
+			go func() {
+				loops.Wait()
+				s.wg.Wait()
+				close(s.done)
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			s.stop()
+			select {
+			case <-s.done:
+				s.cancel()
+				return nil
+			case <-ctx.Done():
+				// Cancel the runs still going and say which.
+				var running []string
+				for _, st := range s.Status() {
+					if st.Running {
+						running = append(running, st.Name)
+					}
+				}
+				s.cancel()
+				<-s.done
+				return fmt.Errorf("scheduler: stopped with %v cancelled while running", running)
+			}
+		},
+	}
+}
+
+// loop starts the runs of job as they fall due until ctx is done. Each run
+// gets runCtx, which outlives ctx so that stopping waits for it.
+func (s *Scheduler) loop(ctx, runCtx context.Context, job *scheduledJob) {
+	for {
+		now := s.clock.Now()
+		next := job.schedule.Next(now)
+		if next.IsZero() {
+			return
+		}
+		job.mu.Lock()
+		job.status.NextRun = &next
+		job.mu.Unlock()
+		t := s.clock.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+		job.mu.Lock()
+		if job.running {
+			job.status.Skipped++
+			job.mu.Unlock()
+			s.logger.Warn("scheduled job is still running, skipping this run", "job", job.name)
+			if s.metrics != nil {
+				s.metrics.runs.Inc(job.name, "skipped")
+			}
+			continue
+		}
+		job.running = true
+		job.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.run(runCtx, job)
+		}()
+	}
+}
+
+// run runs job once, if it gets the job's lock when it is exclusive,
+// recording the outcome. A panic fails the run rather than the server.
+func (s *Scheduler) run(ctx context.Context, job *scheduledJob) {
+	start := s.clock.Now()
+	if job.exclusive {
+		unlock, ok := s.lock(ctx, job, start)
+		if !ok {
+			return
+		}
+		defer unlock()
+	}
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		return job.fn(ctx)
+	}()
+	elapsed := s.clock.Now().Sub(start)
+
+	job.mu.Lock()
+	job.running = false
+	job.status.Runs++
+	job.status.LastRun = &start
+	job.status.LastError = ""
+	if err != nil {
+		job.status.Failures++
+		job.status.LastError = err.Error()
+	}
+	job.mu.Unlock()
+
+	result := "success"
+	if err != nil {
+		result = "error"
+		if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+			result = "cancelled"
+		}
+		s.logger.Error("scheduled job failed", "job", job.name, "error", err, "duration", elapsed)
+	} else {
+		s.logger.Debug("scheduled job ran", "job", job.name, "duration", elapsed)
+	}
+	if s.metrics != nil {
+		s.metrics.runs.Inc(job.name, result)
+		s.metrics.duration.Observe(elapsed.Seconds(), job.name)
+		if err == nil {
+			s.metrics.lastSuccess.Set(float64(start.Unix()), job.name)
+		}
+	}
+}
+
+// lock takes the lock of job for the run starting at start, returning
+// the function releasing it, or records why the run is skipped.
+func (s *Scheduler) lock(ctx context.Context, job *scheduledJob, start time.Time) (unlock func(), ok bool) {
+	lock, err := s.locker.Lock(ctx, job.name)
+	if err != nil {
+		job.mu.Lock()
+		job.running = false
+		result := "locked"
+		if errors.Is(err, ErrLockHeld) {
+			job.status.HeldElsewhere++
+			s.logger.Debug("scheduled job is running on another instance", "job", job.name)
+		} else {
+			result = "lock_error"
+			job.status.Failures++
+			job.status.LastError = "cannot take the lock: " + err.Error()
+			s.logger.Error("cannot take the lock of a scheduled job", "job", job.name, "error", err)
+		}
+		job.mu.Unlock()
+		if s.metrics != nil {
+			s.metrics.runs.Inc(job.name, result)
+		}
+		return nil, false
+	}
+	hold := s.minHold
+	if next := job.schedule.Next(start); !next.IsZero() {
+		hold = min(hold, next.Sub(start)/2)
+	}
+	// The lock backends go by the system clock, which need not be the
+	// scheduler's.
+	return func() { lock.Unlock(time.Now().Add(start.Add(hold).Sub(s.clock.Now()))) }, true
+}
+
+// Status returns the state of every scheduled job, by name.
+func (s *Scheduler) Status() []ScheduledJobStatus {
+	statuses := make([]ScheduledJobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		st := job.status
+		st.Running = job.running
+		job.mu.Unlock()
+		statuses = append(statuses, st)
+	}
+	slices.SortFunc(statuses, func(a, b ScheduledJobStatus) int { return cmp.Compare(a.Name, b.Name) })
+	return statuses
+}
+
+// SchedulerHandler serves the state of the scheduled jobs, with the
+// instance holding the lock of each.
+func SchedulerHandler(s *Scheduler) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		statuses := s.Status()
+		for i := range statuses {
+			if !statuses[i].Exclusive {
+				continue
+			}
+			h, err := s.locker.Holder(r.Context(), statuses[i].Name)
+			if err != nil {
+				return Internal(fmt.Errorf("cannot find the holder of the lock of %s: %w", statuses[i].Name, err))
+			}
+			statuses[i].Lock = h
+		}
+		respond(w, r, http.StatusOK, statuses)
+		return nil
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonSchemaDialect is the JSON Schema version of the registry's schemas.
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// RouteSchema is the contract of a route: the Go types of its request and
+// response bodies and the JSON Schemas of their JSON encoding, each a
+// document of its own so that consumers can check bodies with any JSON
+// Schema library. Response describes the successful response, whose
+// status is Status; errors have the registry's Error schema.
+type RouteSchema struct {
+	Method       string         `json:"method"`
+	Path         string         `json:"path"`
+	Status       int            `json:"status"`
+	RequestType  string         `json:"request_type,omitempty"`
+	ResponseType string         `json:"response_type,omitempty"`
+	Request      map[string]any `json:"request,omitempty"`
+	Response     map[string]any `json:"response,omitempty"`
+}
+
+// schemasResponse is the body of GET /schemas.
+type schemasResponse struct {
+	Items []RouteSchema  `json:"items"`
+	Error map[string]any `json:"error"`
+}
+
+// SchemaRegistry maps the documented routes of a Router to their
+// contracts, for consumer-driven contract tests: consumers fetch the
+// schemas from /schemas and check what they send and expect against them,
+// and the server's tests check its real responses with AssertConforms.
+// The registry is built on first use, once every route has been
+// registered.
+type SchemaRegistry struct {
+	rt    *Router
+	build func() schemaIndex
+}
+
+type schemaIndex struct {
+	routes  []RouteSchema
+	byRoute map[string]RouteSchema
+	error   map[string]any
+}
+
+func NewSchemaRegistry(rt *Router) *SchemaRegistry {
+	s := &SchemaRegistry{rt: rt}
+	s.build = sync.OnceValue(func() schemaIndex {
+		idx := schemaIndex{byRoute: map[string]RouteSchema{}, error: buildJSONSchema(reflect.TypeFor[errorResponse](), true)}
+		for _, route := range rt.Routes() {
+			if route.Method == "" || route.Method == http.MethodHead || route.Doc.Request == nil && route.Doc.Response == nil {
+				continue
+			}
+			rs := RouteSchema{Method: route.Method, Path: route.Path, Status: route.Doc.Status}
+			if rs.Status == 0 {
+				rs.Status = http.StatusOK
+			}
+			if route.Doc.Request != nil {
+				t := reflect.TypeOf(route.Doc.Request)
+				rs.RequestType, rs.Request = t.String(), buildJSONSchema(t, false)
+			}
+			if route.Doc.Response != nil {
+				t := reflect.TypeOf(route.Doc.Response)
+				rs.ResponseType, rs.Response = t.String(), buildJSONSchema(t, true)
+			}
+			idx.routes = append(idx.routes, rs)
+			idx.byRoute[route.Method+" "+route.Path] = rs
+		}
+		return idx
+	})
+	return s
+}
+
+// Routes returns the contracts of the documented routes in registration
+// order.
+func (s *SchemaRegistry) Routes() []RouteSchema {
+	return slices.Clone(s.build().routes)
+}
+
+// Lookup returns the contract of the route with the router pattern, such
+// as "GET /pebbles/{id}".
+func (s *SchemaRegistry) Lookup(pattern string) (RouteSchema, bool) {
+	rs, ok := s.build().byRoute[pattern]
+	return rs, ok
+}
+
+// CheckRequest returns an error unless body conforms to the request schema
+// of the route with pattern.
+func (s *SchemaRegistry) CheckRequest(pattern string, body []byte) error {
+	rs, ok := s.Lookup(pattern)
+	if !ok || rs.Request == nil {
+		return fmt.Errorf("%s has no documented request body", pattern)
+	}
+	return checkJSONSchema(rs.Request, body)
+}
+
+// CheckResponse returns an error unless a response of the route with
+// pattern with status and body conforms to its contract: the documented
+// status with the response schema, or no body if it has none, or an error
+// status with the error schema.
+func (s *SchemaRegistry) CheckResponse(pattern string, status int, body []byte) error {
+	rs, ok := s.Lookup(pattern)
+	if !ok {
+		return fmt.Errorf("%s is not a documented route", pattern)
+	}
+	switch {
+	case status >= 400:
+		return checkJSONSchema(s.build().error, body)
+	case status != rs.Status:
+		return fmt.Errorf("%s responded with %d rather than %d", pattern, status, rs.Status)
+	case rs.Response == nil:
+		if len(body) > 0 {
+			return fmt.Errorf("%s is documented without a body but responded with %d bytes", pattern, len(body))
+		}
+		return nil
+	}
+	return checkJSONSchema(rs.Response, body)
+}
+
+// contractT is the part of *testing.T that AssertConforms uses, so that
+// the helper does not pull the testing package into the server.
+type contractT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// AssertConforms serves r with the registry's router and fails t unless
+// the response conforms to the contract of the route r matches, returning
+// the response's status and body for further checks:
+//
+//	schemas := NewSchemaRegistry(a.router)
+//	req := httptest.NewRequest("GET", "/pebbles/"+id, nil)
+//	req.Header.Set(apiKeyHeader, key)
+//	status, body := schemas.AssertConforms(t, req)
+func (s *SchemaRegistry) AssertConforms(t contractT, r *http.Request) (int, []byte) {
+	t.Helper()
+	_, pattern := s.rt.Handler(r)
+	w := &contractRecorder{header: http.Header{}}
+	s.rt.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	body := w.body.Bytes()
+	if mt, _, _ := mime.ParseMediaType(w.header.Get("Content-Type")); len(body) > 0 && mt != "application/json" && mt != "application/problem+json" {
+		t.Errorf("%s %s: response is %s rather than JSON", r.Method, r.URL.Path, mt)
+		return w.status, body
+	}
+	if err := s.CheckResponse(pattern, w.status, body); err != nil {
+		t.Errorf("%s %s: response does not conform to %s: %v", r.Method, r.URL.Path, pattern, err)
+	}
+	return w.status, body
+}
+
+// contractRecorder keeps the response AssertConforms serves.
+type contractRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *contractRecorder) Header() http.Header { return w.header }
+
+func (w *contractRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *contractRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// SchemasHandler serves the contracts of the routes of s.
+func SchemasHandler(s *SchemaRegistry) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// The schemas only change with a new release.
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		respond(w, r, http.StatusOK, schemasResponse{Items: s.Routes(), Error: s.build().error})
+		return nil
+	}
+}
+
+var (
+	rawMessageType    = reflect.TypeFor[json.RawMessage]()
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+)
+
+// jsonSchemas builds the JSON Schema of what encoding/json makes of a Go
+// type, with the named structs under $defs. Unlike the OpenAPI document,
+// which describes what clients may send, response schemas require every
+// field that is not omitempty, since encoding/json always writes it, and
+// allow no others.
+type jsonSchemas struct {
+	defs     map[string]any
+	response bool
+}
+
+// buildJSONSchema returns the schema document of t, of a response body if
+// response is set and of a request body otherwise.
+func buildJSONSchema(t reflect.Type, response bool) map[string]any {
+	b := &jsonSchemas{defs: map[string]any{}, response: response}
+	doc := maps.Clone(b.schema(t))
+	doc["$schema"] = jsonSchemaDialect
+	if len(b.defs) > 0 {
+		doc["$defs"] = b.defs
+	}
+	return doc
+}
+
+func (b *jsonSchemas) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{}
+	case t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType):
+		return map[string]any{}
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		return map[string]any{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return map[string]any{"anyOf": []any{b.schema(t.Elem()), map[string]any{"type": "null"}}}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		// Nil slices and maps are written as null.
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": []string{"string", "null"}, "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": []string{"array", "null"}, "items": b.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return map[string]any{"type": []string{"object", "null"}, "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.defs[name]; !ok {
+			b.defs[name] = nil // guards against recursive types
+			b.defs[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + name}
+	}
+	return map[string]any{}
+}
+
+func (b *jsonSchemas) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	b.fields(t, props, &required)
+	obj := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		slices.Sort(required)
+		obj["required"] = required
+	}
+	if b.response {
+		obj["additionalProperties"] = false
+	}
+	return obj
+}
+
+// fields adds the JSON fields of struct t to props as openAPI.fields does,
+// recording those a body must have.
+func (b *jsonSchemas) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.fields(f.Type, props, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := b.schema(f.Type)
+		if b.response && !slices.Contains(strings.Split(opts, ","), "omitempty") {
+			*required = append(*required, name)
+		}
+		for _, r := range parseRules(f.Tag.Get("validate")) {
+			if r.name == "required" {
+				if !b.response {
+					*required = append(*required, name)
+				}
+				continue
+			}
+			constrainJSONSchema(s, r)
+		}
+		props[name] = s
+	}
+}
+
+// constrainJSONSchema adds the keyword matching a validation rule to s, or
+// to the schema of the value for a pointer.
+func constrainJSONSchema(s map[string]any, r rule) {
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		s = anyOf[0].(map[string]any)
+	}
+	if types, ok := s["type"].([]string); ok {
+		s["type"] = types[0]
+		defer func() { s["type"] = types }()
+	}
+	constrain(s, r)
+}
+
+// checkJSONSchema returns an error unless body is JSON conforming to the
+// schema document doc, made by buildJSONSchema.
+func checkJSONSchema(doc map[string]any, body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("body is not JSON: %w", err)
+	}
+	defs, _ := doc["$defs"].(map[string]any)
+	c := schemaChecker{defs: defs}
+	c.check(doc, v, "body")
+	return errors.Join(c.errs...)
+}
+
+type schemaChecker struct {
+	defs map[string]any
+	errs []error
+}
+
+func (c *schemaChecker) fail(path, format string, args ...any) {
+	c.errs = append(c.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+// check adds an error for each way v, found at path, does not conform to
+// s.
+func (c *schemaChecker) check(s map[string]any, v any, path string) {
+	if ref, ok := s["$ref"].(string); ok {
+		def, _ := c.defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]any)
+		if def == nil {
+			c.fail(path, "schema refers to unknown %s", ref)
+			return
+		}
+		c.check(def, v, path)
+		return
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		for _, alt := range anyOf {
+			sub := schemaChecker{defs: c.defs}
+			if sub.check(alt.(map[string]any), v, path); len(sub.errs) == 0 {
+				return
+			}
+		}
+		c.fail(path, "matches none of its alternatives")
+		return
+	}
+	var types []string
+	switch t := s["type"].(type) {
+	case string:
+		types = []string{t}
+	case []string:
+		types = t
+	}
+	if len(types) > 0 && !slices.Contains(types, jsonType(v)) && !(jsonType(v) == "integer" && slices.Contains(types, "number")) {
+		c.fail(path, "is %s rather than %s", jsonType(v), strings.Join(types, " or "))
+		return
+	}
+	switch v := v.(type) {
+	case string:
+		if enum, ok := s["enum"].([]string); ok && !slices.Contains(enum, v) {
+			c.fail(path, "%q is not one of %s", v, strings.Join(enum, ", "))
+		}
+		n := utf8.RuneCountInString(v)
+		if min, ok := schemaNumber(s["minLength"]); ok && float64(n) < min {
+			c.fail(path, "is shorter than %v", min)
+		}
+		if max, ok := schemaNumber(s["maxLength"]); ok && float64(n) > max {
+			c.fail(path, "is longer than %v", max)
+		}
+		if s["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				c.fail(path, "%q is not a date-time", v)
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if min, ok := schemaNumber(s["minimum"]); ok && n < min {
+			c.fail(path, "is less than %v", min)
+		}
+		if max, ok := schemaNumber(s["maximum"]); ok && n > max {
+			c.fail(path, "is more than %v", max)
+		}
+	case []any:
+		if min, ok := schemaNumber(s["minItems"]); ok && float64(len(v)) < min {
+			c.fail(path, "has fewer than %v items", min)
+		}
+		if max, ok := schemaNumber(s["maxItems"]); ok && float64(len(v)) > max {
+			c.fail(path, "has more than %v items", max)
+		}
+		if items, ok := s["items"].(map[string]any); ok {
+			for i, item := range v {
+				c.check(items, item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case map[string]any:
+		props, _ := s["properties"].(map[string]any)
+		required, _ := s["required"].([]string)
+		for _, name := range required {
+			if _, ok := v[name]; !ok {
+				c.fail(path, "has no %s", name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			if p, ok := props[name].(map[string]any); ok {
+				c.check(p, v[name], path+"."+name)
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					c.fail(path, "has %s, which is not in its schema", name)
+				}
+			case map[string]any:
+				c.check(extra, v[name], path+"."+name)
+			}
+		}
+	}
+}
+
+// jsonType returns the JSON Schema type of a value decoded with UseNumber.
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+func schemaNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// flagPebblesSearch turns GET /pebbles/search on.
+const flagPebblesSearch = "pebbles_search"
+
+// searchMaxTerms is the most words a search may have.
+const searchMaxTerms = 10
+
+// The marks around the matching words in search highlights. Clients should
+// escape the rest of the text before rendering them as HTML.
+const (
+	highlightStart = "<mark>"
+	highlightEnd   = "</mark>"
+)
+
+// SearchQuery is a parsed search request. It matches the pebbles whose
+// name or color has, for every term, a word starting with it, so that
+// "fl gr" finds "Flint" in grey.
+type SearchQuery struct {
+	Terms  []string
+	Limit  int
+	Offset int
+	// Tenant, if set, searches only the pebbles of that tenant.
+	Tenant string
+}
+
+// SearchHit is a pebble found by a search. Score ranks the hits of one
+// search, higher first; it has no meaning across searches or backends.
+// Highlights holds the name and color with the matching words between
+// highlightStart and highlightEnd.
+type SearchHit struct {
+	Pebble     Pebble            `json:"pebble"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+// searchTerms splits s into the lower case words a search matches,
+// dropping punctuation, the way the backends split the text they index.
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// matchTerm returns how well word matches term: 1 for the whole word, 0.5
+// for its start and 0 otherwise.
+func matchTerm(word, term string) float64 {
+	switch {
+	case word == term:
+		return 1
+	case strings.HasPrefix(word, term):
+		return 0.5
+	}
+	return 0
+}
+
+// searchPebbles is the search of stores without a text index: it scores
+// each of pebbles against q, weighting the name twice the color, and
+// returns the page of hits q asks for.
+func searchPebbles(pebbles []Pebble, q SearchQuery) []SearchHit {
+	var hits []SearchHit
+next:
+	for _, p := range pebbles {
+		name, color := searchTerms(p.Name), searchTerms(p.Color)
+		var score float64
+		for _, term := range q.Terms {
+			var s float64
+			for _, w := range name {
+				s += 2 * matchTerm(w, term)
+			}
+			for _, w := range color {
+				s += matchTerm(w, term)
+			}
+			if s == 0 {
+				continue next
+			}
+			score += s
+		}
+		hits = append(hits, SearchHit{Pebble: p, Score: score, Highlights: map[string]string{
+			"name":  highlight(p.Name, q.Terms),
+			"color": highlight(p.Color, q.Terms),
+		}})
+	}
+	slices.SortFunc(hits, func(a, b SearchHit) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.Pebble.ID, b.Pebble.ID))
+	})
+	if q.Offset >= len(hits) {
+		return []SearchHit{}
+	}
+	hits = hits[q.Offset:]
+	if len(hits) > q.Limit {
+		hits = hits[:q.Limit]
+	}
+	return hits
+}
+
+// highlight marks the words of text that start with one of terms.
+func highlight(text string, terms []string) string {
+	var b strings.Builder
+	word := -1
+	mark := func(end int) {
+		w := strings.ToLower(text[word:end])
+		if slices.ContainsFunc(terms, func(t string) bool { return strings.HasPrefix(w, t) }) {
+			b.WriteString(highlightStart + text[word:end] + highlightEnd)
+		} else {
+			b.WriteString(text[word:end])
+		}
+		word = -1
+	}
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if word < 0 {
+				word = i
+			}
+			continue
+		}
+		if word >= 0 {
+			mark(i)
+		}
+		b.WriteRune(r)
+	}
+	if word >= 0 {
+		mark(len(text))
+	}
+	return b.String()
+}
+
+// searchCursor is the encoded form of a search cursor. It records the
+// terms so that a cursor cannot be reused with a different search.
+type searchCursor struct {
+	Terms  string `json:"q"`
+	Offset int    `json:"o"`
+}
+
+func encodeSearchCursor(q SearchQuery) string {
+	b, _ := json.Marshal(searchCursor{Terms: strings.Join(q.Terms, " "), Offset: q.Offset})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSearchCursor(s string, terms []string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, errBadCursor
+	}
+	var c searchCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Terms != strings.Join(terms, " ") || c.Offset < 0 {
+		return 0, errBadCursor
+	}
+	return c.Offset, nil
+}
+
+// parseSearchQuery reads ?q, ?limit and ?cursor from r, taking the limits
+// of GET /pebbles.
+func parseSearchQuery(r *http.Request) (SearchQuery, error) {
+	p := pebbleListParams
+	q := SearchQuery{Limit: p.DefaultLimit}
+	values := r.URL.Query()
+	var errs ValidationErrors
+	for name := range values {
+		switch name {
+		case "q", "cursor":
+		case "limit":
+			n, err := strconv.Atoi(values.Get(name))
+			if err != nil || n < 1 || n > p.MaxLimit {
+				errs = append(errs, FieldError{Field: "limit", Message: fmt.Sprintf("must be a number from 1 to %d", p.MaxLimit)})
+				continue
+			}
+			q.Limit = n
+		default:
+			errs = append(errs, FieldError{Field: name, Message: "is not a known parameter"})
+		}
+	}
+	q.Terms = searchTerms(values.Get("q"))
+	switch {
+	case len(q.Terms) == 0:
+		errs = append(errs, FieldError{Field: "q", Message: "must have at least one word"})
+	case len(q.Terms) > searchMaxTerms:
+		errs = append(errs, FieldError{Field: "q", Message: fmt.Sprintf("must have at most %d words", searchMaxTerms)})
+	}
+	if errs == nil && values.Get("cursor") != "" {
+		offset, err := decodeSearchCursor(values.Get("cursor"), q.Terms)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "cursor", Message: err.Error()})
+		}
+		q.Offset = offset
+	}
+	if errs != nil {
+		slices.SortFunc(errs, func(a, b FieldError) int { return cmp.Compare(a.Field, b.Field) })
+		return SearchQuery{}, Invalid(errs, "invalid search parameters")
+	}
+	return q, nil
+}
+
+func (api *pebblesAPI) search(w http.ResponseWriter, r *http.Request) error {
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		return err
+	}
+	page, err := api.svc.Search(r.Context(), q)
+	if err != nil {
+		return err
+	}
+	respond(w, r, http.StatusOK, listResponse[SearchHit]{
+		Items: page.Items,
+		Page:  &pageInfo{Limit: page.Limit, NextCursor: page.NextCursor},
+	})
+	return nil
+}
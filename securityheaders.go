@@ -0,0 +1,74 @@
+package main
+
+import "net/http"
+
+// SecurityHeaders are the values of the security headers of responses by
+// header name.
+type SecurityHeaders map[string]string
+
+// securityHeaderSettings are the security_headers settings naming a
+// header, with the header they set.
+var securityHeaderSettings = map[string]string{
+	"strict_transport_security":        "Strict-Transport-Security",
+	"content_security_policy":          "Content-Security-Policy",
+	"frontend_content_security_policy": "Content-Security-Policy",
+	"content_type_options":             "X-Content-Type-Options",
+	"referrer_policy":                  "Referrer-Policy",
+	"permissions_policy":               "Permissions-Policy",
+}
+
+// securityHeaders returns the headers of the API's responses, or of the
+// frontend's if frontend is set, with the overrides of Development in
+// development. It returns none unless cfg is enabled.
+func securityHeaders(cfg SecurityHeadersConfig, development, frontend bool) SecurityHeaders {
+	if !cfg.Enabled {
+		return nil
+	}
+	settings := map[string]string{
+		"strict_transport_security": cfg.StrictTransportSecurity,
+		"content_security_policy":   cfg.ContentSecurityPolicy,
+		"content_type_options":      cfg.ContentTypeOptions,
+		"referrer_policy":           cfg.ReferrerPolicy,
+		"permissions_policy":        cfg.PermissionsPolicy,
+	}
+	if frontend {
+		delete(settings, "content_security_policy")
+		settings["frontend_content_security_policy"] = cfg.FrontendContentSecurityPolicy
+	}
+	if development {
+		for name, v := range cfg.Development {
+			if _, ok := settings[name]; ok {
+				settings[name] = v
+			}
+		}
+	}
+	h := make(SecurityHeaders, len(settings))
+	for name, v := range settings {
+		if v != "" {
+			h[securityHeaderSettings[name]] = v
+		}
+	}
+	return h
+}
+
+// SecureHeaders sets the headers that headers returns on every response,
+// before the handler runs, so that a handler serving a page with other
+// needs, such as the documentation, can replace them. headers is called
+// for every request, so the headers can be replaced while the server
+// runs. Strict-Transport-Security is only sent on responses to requests
+// IsHTTPS reports, as browsers ignore it over plain HTTP (RFC 6797 §7.2).
+func SecureHeaders(headers func() SecurityHeaders) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			https := IsHTTPS(r)
+			for name, v := range headers() {
+				if name == "Strict-Transport-Security" && !https {
+					continue
+				}
+				h.Set(name, v)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecureHeadersHSTS(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := SecurityHeaders{"Strict-Transport-Security": "max-age=63072000", "X-Content-Type-Options": "nosniff"}
+	h := RealIP(trusted)(SecureHeaders(func() SecurityHeaders { return headers })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		name   string
+		remote string
+		tls    bool
+		header http.Header
+		want   bool
+	}{
+		{name: "over TLS", remote: "203.0.113.7:4000", tls: true, want: true},
+		{name: "over HTTP", remote: "203.0.113.7:4000"},
+		{name: "from a trusted proxy over HTTPS", remote: "10.0.0.1:4000", header: http.Header{"X-Forwarded-Proto": {"https"}}, want: true},
+		{name: "from a trusted proxy over HTTP", remote: "10.0.0.1:4000", header: http.Header{"X-Forwarded-Proto": {"http"}}},
+		{name: "from a trusted proxy without a header", remote: "10.0.0.1:4000"},
+		{name: "from a trusted proxy that appended http", remote: "10.0.0.1:4000", header: http.Header{"X-Forwarded-Proto": {"https, http"}}},
+		{name: "from a trusted proxy that appended https", remote: "10.0.0.1:4000", header: http.Header{"X-Forwarded-Proto": {"http", "HTTPS"}}, want: true},
+		{name: "with Forwarded", remote: "10.0.0.1:4000", header: http.Header{"Forwarded": {`for=203.0.113.7;proto=https`}}, want: true},
+		{name: "with Forwarded over HTTP", remote: "10.0.0.1:4000", header: http.Header{"Forwarded": {"proto=https, for=10.0.0.2;proto=http"}, "X-Forwarded-Proto": {"https"}}},
+		{name: "from a client claiming HTTPS", remote: "203.0.113.7:4000", header: http.Header{"X-Forwarded-Proto": {"https"}, "Forwarded": {"proto=https"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/pebbles", nil)
+			r.RemoteAddr = tt.remote
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for name, v := range tt.header {
+				r.Header[name] = v
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if got := w.Header().Get("Strict-Transport-Security") != ""; got != tt.want {
+				t.Errorf("got Strict-Transport-Security %q, want it sent: %t", w.Header().Get("Strict-Transport-Security"), tt.want)
+			}
+			if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+				t.Error("the other headers were not sent")
+			}
+		})
+	}
+}
@@ -2,41 +2,595 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-func main() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, "Hello, world!")
+// Server is an HTTP server configured with functional options, built
+// by newApp for each listener and started with Run.
+type Server struct {
+	host              string
+	network           string
+	port              int
+	handler           http.Handler
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	shutdownTimeout   time.Duration
+	shutdownDelay     time.Duration
+	beforeShutdown    []func()
+	logger            *slog.Logger
+
+	certFile       string
+	keyFile        string
+	reloadInterval time.Duration
+	redirectPort   int
+	h2c            bool
+	reusePort      bool
+	proxyTrusted   ipSet
+	proxyTimeout   time.Duration
+
+	unixPath    string
+	unixMode    fs.FileMode
+	systemd     bool
+	systemdName string
+
+	srv       *http.Server
+	redirect  *http.Server
+	certs     *certReloader
+	stopWatch context.CancelFunc
+	conns     *connTracker
+	inFlight  atomic.Int64
+	gauge     *GaugeVec
+	gaugeName string
+	failed    chan error
+	done      chan struct{}
+}
+
+// ListenError reports that a server could not bind its listener, for
+// example because another process already uses the port.
+type ListenError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ListenError) Error() string {
+	reason := e.Err.Error()
+	switch {
+	case errors.Is(e.Err, syscall.EADDRINUSE):
+		reason = "the address is already in use by another process"
+	case errors.Is(e.Err, syscall.EACCES):
+		reason = "permission denied; ports below 1024 need privileges"
+	case errors.Is(e.Err, syscall.EADDRNOTAVAIL):
+		reason = "the address is not one of this host's"
+	}
+	return fmt.Sprintf("cannot listen on %s: %s", e.Addr, reason)
+}
+
+func (e *ListenError) Unwrap() error { return e.Err }
+
+// ShutdownError reports that a server did not finish its in-flight
+// requests before its shutdown timeout, and how many connections it then
+// closed on them.
+type ShutdownError struct {
+	Addr     string
+	Requests int64
+	Active   int
+	Idle     int
+	Err      error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("shutdown of %s did not complete, cut off %d requests and closed %d active and %d idle connections: %v",
+		e.Addr, e.Requests, e.Active, e.Idle, e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error { return e.Err }
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithPort makes the server listen on TCP port, instead of on a Unix or
+// systemd socket set by an earlier option.
+func WithPort(port int) Option {
+	return func(s *Server) {
+		s.port = port
+		s.unixPath = ""
+		s.systemd = false
+	}
+}
+
+// WithUnixSocket makes the server listen on a Unix socket at path, with
+// the permissions in mode, instead of on a TCP port.
+func WithUnixSocket(path string, mode fs.FileMode) Option {
+	return func(s *Server) {
+		s.unixPath = path
+		s.unixMode = mode
+		s.systemd = false
+	}
+}
+
+// WithSystemdSocket makes the server accept connections on a socket passed
+// by systemd socket activation, the one named name if several are passed,
+// instead of listening itself.
+func WithSystemdSocket(name string) Option {
+	return func(s *Server) {
+		s.systemd = true
+		s.systemdName = name
+		s.unixPath = ""
+	}
+}
+
+// WithHost makes the server listen only on the given address, such as
+// 127.0.0.1, instead of on all interfaces.
+func WithHost(host string) Option {
+	return func(s *Server) { s.host = host }
+}
+
+// WithAddressFamily makes the TCP listeners use only IPv4 for "ipv4" or
+// IPv6 for "ipv6", and either for anything else, so that a wildcard host
+// is dual-stack.
+func WithAddressFamily(family string) Option {
+	return func(s *Server) { s.network = tcpNetwork(family) }
+}
+
+// tcpNetwork returns the network of the net package for TCP in family.
+func tcpNetwork(family string) string {
+	switch family {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+func WithHandler(h http.Handler) Option {
+	return func(s *Server) { s.handler = h }
+}
+
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) { s.readHeaderTimeout = d }
+}
+
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) { s.readTimeout = d }
+}
+
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) { s.writeTimeout = d }
+}
+
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) { s.idleTimeout = d }
+}
+
+func WithMaxHeaderBytes(n int) Option {
+	return func(s *Server) { s.maxHeaderBytes = n }
+}
+
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) { s.shutdownTimeout = d }
+}
+
+// WithShutdownDelay makes Stop wait for d after the before-shutdown hooks
+// have run and before it stops accepting connections, giving load balancers
+// time to notice the server is going away.
+func WithShutdownDelay(d time.Duration) Option {
+	return func(s *Server) { s.shutdownDelay = d }
+}
+
+// WithBeforeShutdown registers fn to be called by Stop as soon as shutdown
+// begins.
+func WithBeforeShutdown(fn func()) Option {
+	return func(s *Server) { s.beforeShutdown = append(s.beforeShutdown, fn) }
+}
+
+// WithInFlightGauge makes the server keep the number of requests it is
+// serving, until they are drained at shutdown, in the series of g labelled
+// with name.
+func WithInFlightGauge(g *GaugeVec, name string) Option {
+	return func(s *Server) {
+		s.gauge = g
+		s.gaugeName = name
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) { s.logger = l }
+}
+
+// WithTLS makes the server serve HTTPS using the given certificate and key
+// files, which are reloaded when they change on disk.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+func WithCertReloadInterval(d time.Duration) Option {
+	return func(s *Server) { s.reloadInterval = d }
+}
+
+// WithRedirectPort starts a second plain HTTP listener on port that
+// redirects every request to HTTPS. It only has an effect together with
+// WithTLS.
+func WithRedirectPort(port int) Option {
+	return func(s *Server) { s.redirectPort = port }
+}
+
+// WithH2C makes the server accept HTTP/2 without TLS from clients that
+// know it supports it, as gRPC clients expect. With TLS, HTTP/2 is always
+// negotiated.
+func WithH2C() Option {
+	return func(s *Server) { s.h2c = true }
+}
+
+// WithReusePort binds the TCP listeners with SO_REUSEPORT, so that
+// another process can listen on the same port, taking over from this one.
+func WithReusePort() Option {
+	return func(s *Server) { s.reusePort = true }
+}
+
+// WithProxyProtocol makes the listeners read a PROXY protocol header
+// from each connection of the load balancers at trusted, addresses and
+// CIDR prefixes that must be valid, within timeout, and take the client
+// it names as the connection's remote address. Without trusted entries
+// it turns the protocol off.
+func WithProxyProtocol(trusted []string, timeout time.Duration) Option {
+	return func(s *Server) {
+		s.proxyTrusted, _ = parseIPSet(trusted)
+		s.proxyTimeout = timeout
+	}
+}
+
+// WithConfig applies the server settings from cfg. Options given after it
+// override individual values.
+func WithConfig(cfg Config) Option {
+	return func(s *Server) {
+		s.host = cfg.Listen.Host
+		s.network = tcpNetwork(cfg.Listen.Family)
+		s.port = cfg.Port
+		s.readHeaderTimeout = cfg.ReadHeaderTimeout.Duration
+		s.readTimeout = cfg.ReadTimeout.Duration
+		s.writeTimeout = cfg.WriteTimeout.Duration
+		s.idleTimeout = cfg.IdleTimeout.Duration
+		s.maxHeaderBytes = cfg.MaxHeaderBytes
+		s.shutdownTimeout = cfg.ShutdownTimeout.Duration
+		s.shutdownDelay = cfg.ShutdownDelay.Duration
+		s.certFile = cfg.TLS.CertFile
+		s.keyFile = cfg.TLS.KeyFile
+		s.reloadInterval = cfg.TLS.ReloadInterval.Duration
+		s.redirectPort = cfg.TLS.RedirectPort
+		s.h2c = cfg.H2C
+		s.reusePort = cfg.ReusePort
+		if pp := cfg.ProxyProtocol; pp.Enabled {
+			WithProxyProtocol(pp.TrustedSources, pp.HeaderTimeout.Duration)(s)
+		}
+		switch l := cfg.Listen; l.Network {
+		case "unix":
+			mode, _ := l.FileMode()
+			WithUnixSocket(l.Path, mode)(s)
+		case "systemd":
+			WithSystemdSocket(l.Name)(s)
+		}
+	}
+}
+
+// NewServer returns a server with the given options applied. Without
+// options it uses conservative timeouts so that slow clients cannot hold
+// connections open indefinitely.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		network:           "tcp",
+		port:              8080,
+		handler:           http.NotFoundHandler(),
+		readHeaderTimeout: 5 * time.Second,
+		readTimeout:       15 * time.Second,
+		writeTimeout:      30 * time.Second,
+		idleTimeout:       2 * time.Minute,
+		maxHeaderBytes:    64 << 10,
+		shutdownTimeout:   10 * time.Second,
+		reloadInterval:    time.Minute,
+		logger:            slog.Default(),
+		conns:             newConnTracker(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.srv = &http.Server{
+		Addr:              net.JoinHostPort(s.host, strconv.Itoa(s.port)),
+		Handler:           s.countInFlight(s.handler),
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		ReadTimeout:       s.readTimeout,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       s.idleTimeout,
+		MaxHeaderBytes:    s.maxHeaderBytes,
+		ConnState:         s.conns.track,
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelError),
+	}
+	if s.h2c {
+		s.srv.Protocols = new(http.Protocols)
+		s.srv.Protocols.SetHTTP1(true)
+		s.srv.Protocols.SetHTTP2(true)
+		s.srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if s.tlsEnabled() && s.redirectPort != 0 {
+		s.redirect = &http.Server{
+			Addr:              net.JoinHostPort(s.host, strconv.Itoa(s.redirectPort)),
+			Handler:           redirectHandler(s.port),
+			ReadHeaderTimeout: 5 * time.Second,
+			ConnState:         s.conns.track,
+			ErrorLog:          s.srv.ErrorLog,
+		}
+	}
+	return s
+}
+
+// countInFlight counts the requests that next is serving, so that Stop
+// can report how many are left to drain.
+func (s *Server) countInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		if s.gauge != nil {
+			s.gauge.Inc(s.gaugeName)
+		}
+		defer func() {
+			s.inFlight.Add(-1)
+			if s.gauge != nil {
+				s.gauge.Dec(s.gaugeName)
+			}
+		}()
+		next.ServeHTTP(w, r)
 	})
+}
+
+// InFlight returns the number of requests the server is serving.
+func (s *Server) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+func (s *Server) tlsEnabled() bool {
+	return s.certFile != ""
+}
+
+// Addr returns the address the server listens on: a host and port, a
+// socket path or "systemd".
+func (s *Server) Addr() string {
+	switch {
+	case s.unixPath != "":
+		return s.unixPath
+	case s.systemd:
+		return "systemd"
+	}
+	return s.srv.Addr
+}
+
+func (s *Server) listen(ctx context.Context) (net.Listener, error) {
+	switch {
+	case s.unixPath != "":
+		return listenUnix(ctx, s.unixPath, s.unixMode)
+	case s.systemd:
+		return systemdListener(s.systemdName)
+	}
+	return s.listenTCP(ctx, s.srv.Addr)
+}
+
+func (s *Server) listenTCP(ctx context.Context, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if s.reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(ctx, s.network, addr)
+}
+
+// listenAttrs describes the listener for the "listening" log message.
+func (s *Server) listenAttrs() []any {
+	switch {
+	case s.unixPath != "":
+		return []any{"socket", s.unixPath}
+	case s.systemd:
+		return []any{"socket", "systemd"}
+	case s.host != "":
+		return []any{"host", s.host, "port", s.port}
+	}
+	return []any{"port", s.port}
+}
+
+func (s *Server) loadCerts() error {
+	if s.certs != nil {
+		return nil
+	}
+	certs, err := newCertReloader(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	s.certs = certs
+	s.srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	return nil
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// Start binds the listeners and begins serving in the background. Errors
+// that stop a listener afterwards are reported on Err.
+func (s *Server) Start(ctx context.Context) error {
+	if s.tlsEnabled() {
+		if err := s.loadCerts(); err != nil {
+			return err
+		}
+	}
+	ln, err := s.listen(ctx)
+	if err != nil {
+		return &ListenError{Addr: s.Addr(), Err: err}
 	}
-	srv := http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+	var redirectLn net.Listener
+	if s.redirect != nil {
+		redirectLn, err = s.listenTCP(ctx, s.redirect.Addr)
+		if err != nil {
+			ln.Close()
+			return &ListenError{Addr: s.redirect.Addr, Err: err}
+		}
+	}
+	if len(s.proxyTrusted) > 0 {
+		// Inside TLS, which the header comes before.
+		ln = newProxyListener(ln, s.proxyTrusted, s.proxyTimeout, s.logger)
+		if redirectLn != nil {
+			redirectLn = newProxyListener(redirectLn, s.proxyTrusted, s.proxyTimeout, s.logger)
+		}
 	}
 
+	s.failed = make(chan error, 2)
+	s.done = make(chan struct{})
+	var wg sync.WaitGroup
+	serve := func(fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); !errors.Is(err, http.ErrServerClosed) {
+				s.failed <- err
+			}
+		}()
+	}
+
+	if s.tlsEnabled() {
+		watchCtx, cancel := context.WithCancel(context.Background())
+		s.stopWatch = cancel
+		go s.certs.watch(watchCtx, s.reloadInterval, s.logger)
+		s.logger.Info("listening", append(s.listenAttrs(), "tls", true)...)
+		serve(func() error { return s.srv.ServeTLS(ln, "", "") })
+	} else {
+		s.logger.Info("listening", s.listenAttrs()...)
+		serve(func() error { return s.srv.Serve(ln) })
+	}
+	if redirectLn != nil {
+		s.logger.Info("redirecting to https", "port", s.redirectPort)
+		serve(func() error { return s.redirect.Serve(redirectLn) })
+	}
 	go func() {
-		log.Printf("listening on port: %s\n", port)
-		srv.ListenAndServe()
+		wg.Wait()
+		close(s.done)
 	}()
+	return nil
+}
 
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	<-ch
-	log.Println("received interrupt")
+// Err returns a channel that receives an error if a listener stops
+// serving for any reason other than Stop.
+func (s *Server) Err() <-chan error {
+	return s.failed
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	srv.Shutdown(ctx)
+// drainLogInterval is how often Stop logs the requests left to drain.
+const drainLogInterval = time.Second
 
+// Stop runs the before-shutdown hooks, waits for the shutdown delay and then
+// gracefully shuts down the listeners, waiting for in-flight requests until
+// ctx is done and logging how many remain every drainLogInterval.
+// Connections still open then are closed, and the error is a
+// *ShutdownError counting them. The delay is skipped if another component
+// failed to start.
+func (s *Server) Stop(ctx context.Context) error {
+	for _, fn := range s.beforeShutdown {
+		fn()
+	}
+	if s.shutdownDelay > 0 && !startFailed(ctx) {
+		s.logger.Info("waiting before closing listeners", "delay", s.shutdownDelay)
+		select {
+		case <-time.After(s.shutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	err := s.drain(ctx)
+	if s.redirect != nil {
+		err = errors.Join(err, s.redirect.Shutdown(ctx))
+	}
+	if err == nil {
+		return nil
+	}
+	requests := s.inFlight.Load()
+	active, idle := s.conns.counts()
+	s.logger.Warn("shutdown timed out, closing open connections",
+		append(s.listenAttrs(), "requests", requests, "active_connections", active, "idle_connections", idle)...)
+	s.srv.Close()
+	if s.redirect != nil {
+		s.redirect.Close()
+	}
+	return &ShutdownError{Addr: s.Addr(), Requests: requests, Active: active, Idle: idle, Err: err}
+}
+
+// drain stops accepting connections and waits for the requests in flight
+// to finish, logging how many remain while there are any.
+func (s *Server) drain(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- s.srv.Shutdown(ctx) }()
+	if n := s.inFlight.Load(); n > 0 {
+		s.logger.Info("draining requests", append(s.listenAttrs(), "remaining", n)...)
+	}
+	tick := time.NewTicker(drainLogInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-tick.C:
+			if n := s.inFlight.Load(); n > 0 {
+				s.logger.Info("draining requests", append(s.listenAttrs(), "remaining", n)...)
+			}
+		}
+	}
+}
+
+// StopTimeout is the longest Stop should be given to complete.
+func (s *Server) StopTimeout() time.Duration {
+	return s.shutdownDelay + s.shutdownTimeout
+}
+
+// ListenAndServe serves requests until Stop is called, in which case it
+// returns nil.
+func (s *Server) ListenAndServe() error {
+	if err := s.Start(context.Background()); err != nil {
+		return err
+	}
+	<-s.done
+	select {
+	case err := <-s.failed:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Run serves requests until ctx is cancelled and then stops the server,
+// allowing in-flight requests up to the shutdown timeout to complete.
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	select {
+	case err := <-s.failed:
+		return errors.Join(err, s.Stop(context.Background()))
+	case <-ctx.Done():
+	}
+	s.logger.Info("shutting down")
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), s.StopTimeout())
+	defer cancel()
+	return s.Stop(stopCtx)
 }
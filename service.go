@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// PebbleService holds the rules for reading and changing pebbles. Both
+// the HTTP and the gRPC transport call it, so they behave the same; its
+// errors are *APIError values, which each transport maps to its own
+// status codes. Its timestamps are read from clock.
+type PebbleService struct {
+	store PebbleStore
+	clock Clock
+}
+
+// PebblePage is one page of a pebble list.
+type PebblePage struct {
+	Items      []Pebble
+	Limit      int
+	NextCursor string
+}
+
+func (s *PebbleService) List(ctx context.Context, q ListQuery) (PebblePage, error) {
+	limit := q.Limit
+	q.Limit++ // one more to tell whether there is a next page
+	pebbles, err := s.store.List(ctx, q)
+	if err != nil {
+		return PebblePage{}, storeError(err)
+	}
+	page := PebblePage{Items: pebbles, Limit: limit}
+	if len(pebbles) > limit {
+		page.Items = pebbles[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = encodeCursor(q.Sort, last.field(q.Sort.Field), last.ID)
+	}
+	return page, nil
+}
+
+// SearchPage is one page of search hits, best first.
+type SearchPage struct {
+	Items      []SearchHit
+	Limit      int
+	NextCursor string
+}
+
+func (s *PebbleService) Search(ctx context.Context, q SearchQuery) (SearchPage, error) {
+	limit := q.Limit
+	q.Limit++ // one more to tell whether there is a next page
+	hits, err := s.store.Search(ctx, q)
+	if err != nil {
+		return SearchPage{}, storeError(err)
+	}
+	page := SearchPage{Items: hits, Limit: limit}
+	if len(hits) > limit {
+		page.Items = hits[:limit]
+		q.Offset += limit
+		page.NextCursor = encodeSearchCursor(q)
+	}
+	return page, nil
+}
+
+// Get returns pebble id, or a not found error if it has been deleted and
+// includeDeleted is not set.
+func (s *PebbleService) Get(ctx context.Context, id string, includeDeleted bool) (Pebble, error) {
+	p, err := s.store.Get(ctx, id)
+	if err != nil {
+		return Pebble{}, storeError(err)
+	}
+	if p.DeletedAt != nil && !includeDeleted {
+		return Pebble{}, storeError(ErrNotFound)
+	}
+	return p, nil
+}
+
+func (s *PebbleService) Create(ctx context.Context, in pebbleInput) (Pebble, error) {
+	if errs := Validate(in); errs != nil {
+		return Pebble{}, errs.apiError()
+	}
+	now := s.clock.Now().UTC()
+	p := Pebble{ID: newUUID(), Tenant: TenantFromContext(ctx), CreatedAt: now, UpdatedAt: now}
+	in.apply(&p)
+	if err := s.store.Create(ctx, p); err != nil {
+		return Pebble{}, storeError(err)
+	}
+	return p, nil
+}
+
+// Replace sets all the fields of pebble id. ifMatch is the list of ETags
+// the caller based the change on, as in an If-Match header.
+func (s *PebbleService) Replace(ctx context.Context, id string, in pebbleInput, ifMatch string) (Pebble, error) {
+	if errs := Validate(in); errs != nil {
+		return Pebble{}, errs.apiError()
+	}
+	return s.modify(ctx, id, ifMatch, in.apply)
+}
+
+// Update changes the fields of pebble id that are set in in. ifMatch is
+// as for Replace.
+func (s *PebbleService) Update(ctx context.Context, id string, in pebblePatch, ifMatch string) (Pebble, error) {
+	if errs := Validate(in); errs != nil {
+		return Pebble{}, errs.apiError()
+	}
+	return s.modify(ctx, id, ifMatch, func(p *Pebble) { in.apply(p) })
+}
+
+// modify loads the pebble, checks ifMatch against it, applies the change
+// and stores the result.
+func (s *PebbleService) modify(ctx context.Context, id, ifMatch string, apply func(*Pebble)) (Pebble, error) {
+	p, err := s.Get(ctx, id, false)
+	if err != nil {
+		return Pebble{}, err
+	}
+	if err := checkIfMatch(ifMatch, computeETag(p)); err != nil {
+		return Pebble{}, err
+	}
+	prev := p.UpdatedAt
+	apply(&p)
+	p.UpdatedAt = s.clock.Now().UTC()
+	if err := s.store.Update(ctx, p, prev); err != nil {
+		return Pebble{}, storeError(err)
+	}
+	return p, nil
+}
+
+// Delete marks pebble id deleted. It can be restored until it is purged.
+func (s *PebbleService) Delete(ctx context.Context, id, ifMatch string) error {
+	p, err := s.Get(ctx, id, false)
+	if err != nil {
+		return err
+	}
+	if err := checkIfMatch(ifMatch, computeETag(p)); err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, id, s.clock.Now().UTC()); err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+// Restore undoes the deletion of pebble id. ifMatch is as for Replace,
+// against the deleted pebble.
+func (s *PebbleService) Restore(ctx context.Context, id, ifMatch string) (Pebble, error) {
+	p, err := s.store.Get(ctx, id)
+	if err != nil {
+		return Pebble{}, storeError(err)
+	}
+	if p.DeletedAt == nil {
+		return Pebble{}, Conflict("pebble is not deleted")
+	}
+	if err := checkIfMatch(ifMatch, computeETag(p)); err != nil {
+		return Pebble{}, err
+	}
+	if err := s.store.Restore(ctx, id); err != nil {
+		return Pebble{}, storeError(err)
+	}
+	p.DeletedAt = nil
+	return p, nil
+}
+
+// storeError maps the errors returned by a PebbleStore to API errors.
+func storeError(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return NotFound("pebble not found")
+	case errors.Is(err, ErrConflict):
+		return Conflict("pebble already exists")
+	case errors.Is(err, ErrStale):
+		return NewAPIError(http.StatusPreconditionFailed, CodePreconditionFailed, "pebble has changed since it was fetched")
+	}
+	return Internal(err)
+}
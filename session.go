@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sessionCookie holds the session of a user logged in with OIDC.
+const sessionCookie = "pebble_session"
+
+// cookieSealer encrypts cookie values with AES-256-GCM, so that clients
+// can neither read nor forge them. The name of the cookie is sealed with
+// its value, so that one cookie cannot stand in for another.
+type cookieSealer struct {
+	aead cipher.AEAD
+}
+
+// newCookieSealer returns a sealer whose key is derived from secret.
+func newCookieSealer(secret string) *cookieSealer {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &cookieSealer{aead: aead}
+}
+
+// seal returns the value of the cookie name holding v as JSON.
+func (s *cookieSealer) seal(name string, v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(b)+s.aead.Overhead())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, b, []byte(name))), nil
+}
+
+// open decodes into v the value of the cookie name made by seal.
+func (s *cookieSealer) open(name, value string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) < s.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+	n := s.aead.NonceSize()
+	plain, err := s.aead.Open(nil, b[:n], b[n:], []byte(name))
+	if err != nil {
+		return errors.New("cookie was not sealed with this key")
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// Session is the session of a user logged in with OIDC: the claims of
+// the ID token they logged in with, the scopes the session grants, when
+// it started and when it ends unless it is used.
+type Session struct {
+	ID      string         `json:"id"`
+	Subject string         `json:"sub"`
+	Claims  map[string]any `json:"claims"`
+	Scopes  []string       `json:"scopes"`
+	Created time.Time      `json:"created"`
+	Expires time.Time      `json:"expires"`
+}
+
+// SessionStore keeps sessions, each known to the browser by the token in
+// its session cookie. Load returns ErrNotFound for a token of no live
+// session. Refresh stores s, an extension of the session of token, and
+// returns the token to use from then on. DeleteSubject ends every session
+// of subject.
+type SessionStore interface {
+	Create(ctx context.Context, s Session) (token string, err error)
+	Load(ctx context.Context, token string) (Session, error)
+	Refresh(ctx context.Context, token string, s Session) (string, error)
+	Delete(ctx context.Context, token string) error
+	DeleteSubject(ctx context.Context, subject string) error
+}
+
+// newSessionStore returns the SessionStore selected by cfg.SessionStore.
+// Cookie sessions record their revocations in revocations, which should
+// be shared by every instance, and Redis ones are kept on the server of
+// redis. Sessions expire by clock.
+func newSessionStore(cfg OIDCConfig, redis RedisConfig, revocations Cache, clock Clock) (SessionStore, error) {
+	if cfg.SessionStore == "redis" {
+		rc, err := newRedisCache(redis.URL, redis.MaxIdleConns, redis.Timeout.Duration)
+		if err != nil {
+			return nil, err
+		}
+		return &redisSessionStore{redis: rc, maxAge: cfg.SessionMaxAge.Duration, clock: clock}, nil
+	}
+	return &cookieSessionStore{sealer: newCookieSealer(cfg.SessionKey), revoked: revocations, maxAge: cfg.SessionMaxAge.Duration, clock: clock}, nil
+}
+
+// cookieSessionStore keeps each session in its cookie, sealed, so that
+// the server keeps nothing but the sessions that were ended early, until
+// they would have ended anyway: single ones by ID and, for logging out
+// everywhere, the time before which the sessions of a subject started.
+type cookieSessionStore struct {
+	sealer  *cookieSealer
+	revoked Cache
+	maxAge  time.Duration
+	clock   Clock
+}
+
+func (c *cookieSessionStore) Create(ctx context.Context, s Session) (string, error) {
+	s.ID = randomToken(16)
+	return c.sealer.seal(sessionCookie, s)
+}
+
+func (c *cookieSessionStore) Load(ctx context.Context, token string) (Session, error) {
+	var s Session
+	if err := c.sealer.open(sessionCookie, token, &s); err != nil || !c.clock.Now().Before(s.Expires) {
+		return Session{}, ErrNotFound
+	}
+	if _, err := c.revoked.Get(ctx, "session:revoked:"+s.ID); err == nil {
+		return Session{}, ErrNotFound
+	} else if !errors.Is(err, ErrCacheMiss) {
+		return Session{}, err
+	}
+	before, err := c.revoked.Get(ctx, "session:subject:"+s.Subject)
+	if err == nil {
+		if ns, _ := strconv.ParseInt(string(before), 10, 64); !s.Created.After(time.Unix(0, ns)) {
+			return Session{}, ErrNotFound
+		}
+	} else if !errors.Is(err, ErrCacheMiss) {
+		return Session{}, err
+	}
+	return s, nil
+}
+
+func (c *cookieSessionStore) Refresh(ctx context.Context, token string, s Session) (string, error) {
+	return c.sealer.seal(sessionCookie, s)
+}
+
+func (c *cookieSessionStore) Delete(ctx context.Context, token string) error {
+	s, err := c.Load(ctx, token)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.revoked.Set(ctx, "session:revoked:"+s.ID, []byte("1"), s.Created.Add(c.maxAge).Sub(c.clock.Now()))
+}
+
+func (c *cookieSessionStore) DeleteSubject(ctx context.Context, subject string) error {
+	now := strconv.FormatInt(c.clock.Now().UnixNano(), 10)
+	return c.revoked.Set(ctx, "session:subject:"+subject, []byte(now), c.maxAge)
+}
+
+// redisSessionStore keeps sessions on a Redis server, under a hash of
+// their token so that the keys are no use to whoever reads them, with the
+// set of each subject's sessions for logging out everywhere.
+type redisSessionStore struct {
+	redis  *redisCache
+	maxAge time.Duration
+	clock  Clock
+}
+
+func redisSessionKey(id string) string {
+	return "session:" + id
+}
+
+func (c *redisSessionStore) set(ctx context.Context, id string, s Session, onlyIfExists bool) (bool, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return false, err
+	}
+	args := []string{"SET", redisSessionKey(id), string(b), "PX", strconv.FormatInt(max(s.Expires.Sub(c.clock.Now()).Milliseconds(), 1), 10)}
+	if onlyIfExists {
+		args = append(args, "XX")
+	}
+	v, err := c.redis.do(ctx, args...)
+	return v != nil, err
+}
+
+func (c *redisSessionStore) Create(ctx context.Context, s Session) (string, error) {
+	token := randomToken(32)
+	s.ID = hashAPIKey(token)
+	if _, err := c.set(ctx, s.ID, s, false); err != nil {
+		return "", err
+	}
+	subject := "sessions:" + s.Subject
+	if _, err := c.redis.do(ctx, "SADD", subject, s.ID); err != nil {
+		return "", err
+	}
+	if _, err := c.redis.do(ctx, "PEXPIRE", subject, strconv.FormatInt(c.maxAge.Milliseconds(), 10)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (c *redisSessionStore) Load(ctx context.Context, token string) (Session, error) {
+	v, err := c.redis.do(ctx, "GET", redisSessionKey(hashAPIKey(token)))
+	if err != nil {
+		return Session{}, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	var s Session
+	if err := json.Unmarshal(b, &s); err != nil {
+		return Session{}, err
+	}
+	if !c.clock.Now().Before(s.Expires) {
+		return Session{}, ErrNotFound
+	}
+	return s, nil
+}
+
+// Refresh only stores s if the session still exists, so that one ended
+// while it was in use stays ended.
+func (c *redisSessionStore) Refresh(ctx context.Context, token string, s Session) (string, error) {
+	ok, err := c.set(ctx, hashAPIKey(token), s, true)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrNotFound
+	}
+	return token, nil
+}
+
+func (c *redisSessionStore) Delete(ctx context.Context, token string) error {
+	_, err := c.redis.do(ctx, "DEL", redisSessionKey(hashAPIKey(token)))
+	return err
+}
+
+func (c *redisSessionStore) DeleteSubject(ctx context.Context, subject string) error {
+	v, err := c.redis.do(ctx, "SMEMBERS", "sessions:"+subject)
+	if err != nil {
+		return err
+	}
+	members, _ := v.([]any)
+	args := []string{"DEL", "sessions:" + subject}
+	for _, m := range members {
+		if id, ok := m.([]byte); ok {
+			args = append(args, redisSessionKey(string(id)))
+		}
+	}
+	_, err = c.redis.do(ctx, args...)
+	return err
+}
+
+func (c *redisSessionStore) Close(ctx context.Context) error {
+	return c.redis.Close(ctx)
+}
+
+type sessionKey struct{}
+
+// activeSession is the session of a request and the token it came with.
+type activeSession struct {
+	Session
+	token string
+}
+
+// sessionManager starts and ends the sessions of a SessionStore, keeping
+// their tokens in the session cookie. A session lasts ttl from its last
+// use, since one used in the second half of that is extended, but at most
+// maxAge from its start. Requests that change something with a session
+// must carry its CSRF token and come from origin, the origin of the
+// redirect URL, if the browser says where they come from.
+type sessionManager struct {
+	store  SessionStore
+	ttl    time.Duration
+	maxAge time.Duration
+	origin string
+	csrf   *csrfTokens
+	secure bool
+	logger *slog.Logger
+	now    func() time.Time
+}
+
+// expiry returns when the session s ends if it is used at now.
+func (m *sessionManager) expiry(s Session, now time.Time) time.Time {
+	if end := s.Created.Add(m.maxAge); end.Before(now.Add(m.ttl)) {
+		return end
+	}
+	return now.Add(m.ttl)
+}
+
+// Middleware puts the session of the request's cookie, if it is live, in
+// the context for Authenticate, extending it as it goes. A stale or
+// unreadable cookie is no session, so that it does not break public
+// routes.
+func (m *sessionManager) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cookie, err := r.Cookie(sessionCookie)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := r.Context()
+			token := cookie.Value
+			s, err := m.store.Load(ctx, token)
+			if err != nil {
+				if !errors.Is(err, ErrNotFound) {
+					m.logger.WarnContext(ctx, "cannot load session", "error", err)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			now := m.now()
+			if expires := m.expiry(s, now); s.Expires.Sub(now) < m.ttl/2 && expires.After(s.Expires) {
+				s.Expires = expires
+				refreshed, err := m.store.Refresh(ctx, token, s)
+				if errors.Is(err, ErrNotFound) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if err != nil {
+					m.logger.WarnContext(ctx, "cannot extend session", "error", err)
+				} else {
+					token = refreshed
+					m.setCookie(w, token, s.Expires)
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, sessionKey{}, &activeSession{Session: s, token: token})))
+		})
+	}
+}
+
+func (m *sessionManager) session(ctx context.Context) *activeSession {
+	s, _ := ctx.Value(sessionKey{}).(*activeSession)
+	return s
+}
+
+func (m *sessionManager) Authenticate(r *http.Request) (*Claims, error) {
+	s := m.session(r.Context())
+	if s == nil {
+		return nil, nil
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if origin := r.Header.Get("Origin"); origin != "" && origin != m.origin {
+			return nil, Unauthorized("session cookies are not accepted from " + origin)
+		}
+		if err := m.csrf.check(r, s.Session); err != nil {
+			return nil, err
+		}
+	}
+	claims, err := parseClaims(s.Claims)
+	if err != nil {
+		return nil, Unauthorized("the session is not valid: " + err.Error())
+	}
+	claims.Scopes = s.Scopes
+	claims.ExpiresAt = s.Expires
+	return claims, nil
+}
+
+// Challenge is empty, since sessions are started by /auth/login rather
+// than by the client on a 401.
+func (m *sessionManager) Challenge() string {
+	return ""
+}
+
+// start starts a session for the user of the ID token claims.
+func (m *sessionManager) start(w http.ResponseWriter, r *http.Request, claims *Claims, scopes []string) error {
+	now := m.now()
+	s := Session{Subject: claims.Subject, Claims: claims.Raw, Scopes: scopes, Created: now}
+	s.Expires = m.expiry(s, now)
+	token, err := m.store.Create(r.Context(), s)
+	if err != nil {
+		return err
+	}
+	m.setCookie(w, token, s.Expires)
+	return nil
+}
+
+// end ends the session of the request, if it has one.
+func (m *sessionManager) end(w http.ResponseWriter, r *http.Request) error {
+	setSessionCookie(w, sessionCookie, "/", "", -1, m.secure)
+	if s := m.session(r.Context()); s != nil {
+		return m.store.Delete(r.Context(), s.token)
+	}
+	return nil
+}
+
+func (m *sessionManager) setCookie(w http.ResponseWriter, token string, expires time.Time) {
+	setSessionCookie(w, sessionCookie, "/", token, int(expires.Sub(m.now())/time.Second), m.secure)
+}
+
+// setSessionCookie sets the cookie name to value for maxAge seconds, or
+// deletes it if maxAge is negative. It is only readable by the server and
+// only sent over HTTPS if secure is set.
+func setSessionCookie(w http.ResponseWriter, name, path, value string, maxAge int, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionsAPI serves the admin endpoint that ends sessions.
+type sessionsAPI struct {
+	store SessionStore
+}
+
+func (api *sessionsAPI) register(rt *Router) {
+	rt.Delete("/admin/sessions/{subject}", api.deleteSubject)
+	rt.Document("DELETE", "/admin/sessions/{subject}", Operation{Summary: "Log a user out everywhere", Tag: "admin", Status: http.StatusNoContent})
+}
+
+func (api *sessionsAPI) deleteSubject(w http.ResponseWriter, r *http.Request) error {
+	subject := r.PathValue("subject")
+	if err := api.store.DeleteSubject(r.Context(), subject); err != nil {
+		return Internal(err)
+	}
+	slog.InfoContext(r.Context(), "sessions ended", "subject", subject)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
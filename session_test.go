@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionsExpireByClock(t *testing.T) {
+	ctx := context.Background()
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	cfg := OIDCConfig{SessionKey: "test session key", SessionMaxAge: Duration{24 * time.Hour}}
+	store, err := newSessionStore(cfg, RedisConfig{}, newMemoryCache(clock), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := clock.Now()
+	token, err := store.Create(ctx, Session{Subject: "ada", Created: now, Expires: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour - time.Second)
+	if _, err := store.Load(ctx, token); err != nil {
+		t.Fatalf("the session ended a second before it expires: %v", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := store.Load(ctx, token); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got error %v loading an expired session, want ErrNotFound", err)
+	}
+}
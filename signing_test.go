@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshwizzy/pebble-api-demo/client"
+)
+
+// signingStore returns a store with three API keys: signed, whose signing
+// secret is secret; revoked, revoked at revokedAt with the same secret;
+// and unsigned, which has none.
+func signingStore(t *testing.T, secret string, revokedAt time.Time) *memoryStore {
+	t.Helper()
+	store := newMemoryStore()
+	for _, k := range []APIKey{
+		{ID: "signed", SigningSecret: secret, Scopes: []string{"pebbles:read"}, Tenant: "acme"},
+		{ID: "revoked", SigningSecret: secret, RevokedAt: &revokedAt},
+		{ID: "unsigned", Hash: "unused"},
+	} {
+		if err := store.CreateAPIKey(context.Background(), k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestSignedRequestRoundTrip(t *testing.T) {
+	secret := generateSigningSecret()
+	a := newSignedRequestAuth(signingStore(t, secret, time.Now()), 5*time.Minute, systemClock{})
+	srv := httptest.NewServer(Authenticate(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The handler still gets the body that was signed.
+		var in client.PebbleInput
+		if r.Method == http.MethodPost {
+			json.NewDecoder(r.Body).Decode(&in)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			fmt.Fprintf(w, `{"items":[{"id":%q,"name":%q}]}`, ClaimsFromContext(r.Context()).Subject, r.URL.RawQuery)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":%q,"name":%q}`, ClaimsFromContext(r.Context()).Subject, in.Name)
+	})))
+	defer srv.Close()
+
+	c, err := client.New(srv.URL, client.WithSigningKey("signed", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.CreatePebble(context.Background(), client.PebbleInput{Name: "Flint", Color: "grey", WeightGrams: 12})
+	if err != nil {
+		t.Fatalf("the server refused a request the client signed: %v", err)
+	}
+	if p.ID != "apikey:signed" || p.Name != "Flint" {
+		t.Errorf("got pebble %+v, want the signed key's subject and the body sent", p)
+	}
+	page, err := c.ListPebbles(context.Background(), client.ListOptions{Limit: 5, Filters: map[string]string{"color": "grey"}})
+	if err != nil {
+		t.Fatalf("the server refused a signed request with a query: %v", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != "apikey:signed" || !strings.Contains(page.Items[0].Name, "limit=5") {
+		t.Errorf("got page %+v, want the signed key's subject and the query sent", page)
+	}
+
+	c, err = client.New(srv.URL, client.WithSigningKey("signed", "pbs_guessed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *client.Error
+	if _, err := c.CreatePebble(context.Background(), client.PebbleInput{Name: "Flint"}); !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Errorf("got error %v for the wrong secret, want a 401", err)
+	}
+}
+
+func TestSignedRequestAuthErrors(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	secret := generateSigningSecret()
+	a := newSignedRequestAuth(signingStore(t, secret, clock.Now()), 5*time.Minute, clock)
+	const nonce = "0123456789abcdef"
+
+	type request struct {
+		key, ts, nonce, sig string
+		method, uri, body   string
+	}
+	// signed returns a request signed with secret, then changed by change.
+	signed := func(change func(*request)) request {
+		r := request{key: "signed", ts: strconv.FormatInt(clock.Now().Unix(), 10), nonce: nonce, method: http.MethodPost, uri: "/pebbles?dry_run=true", body: `{"name":"Flint"}`}
+		r.sig = requestSignature(secret, r.ts, r.nonce, r.method, r.uri, []byte(r.body))
+		if change != nil {
+			change(&r)
+		}
+		return r
+	}
+	resign := func(r *request) { r.sig = requestSignature(secret, r.ts, r.nonce, r.method, r.uri, []byte(r.body)) }
+	ts := func(d time.Duration) string { return strconv.FormatInt(clock.Now().Add(d).Unix(), 10) }
+
+	tests := []struct {
+		name string
+		req  request
+		want string // the error, or "" for none
+	}{
+		{name: "signed", req: signed(nil)},
+		{name: "at the edge of the window", req: signed(func(r *request) { r.ts, r.nonce = ts(-5*time.Minute), "edge-of-the-window"; resign(r) })},
+		{name: "a nonce used again", req: signed(nil), want: "request nonce has already been used"},
+		{name: "a nonce used again with another body", req: signed(func(r *request) { r.body = `{"name":"Chalk"}`; resign(r) }), want: "request nonce has already been used"},
+
+		{name: "no timestamp", req: signed(func(r *request) { r.ts = "" }), want: "signed requests need the Pebble-Timestamp, Pebble-Nonce and Pebble-Signature headers"},
+		{name: "no nonce", req: signed(func(r *request) { r.nonce = "" }), want: "signed requests need"},
+		{name: "no signature", req: signed(func(r *request) { r.sig = "" }), want: "signed requests need"},
+		{name: "timestamp not a number", req: signed(func(r *request) { r.ts = clock.Now().Format(time.RFC3339); resign(r) }), want: "Pebble-Timestamp must be a Unix time in seconds"},
+		{name: "too old", req: signed(func(r *request) { r.ts = ts(-5*time.Minute - time.Second); resign(r) }), want: "request was signed more than 5m0s from the server's time"},
+		{name: "too far ahead", req: signed(func(r *request) { r.ts = ts(5*time.Minute + time.Second); resign(r) }), want: "request was signed more than 5m0s"},
+		{name: "nonce too short", req: signed(func(r *request) { r.nonce = "0123456789abcde"; resign(r) }), want: "Pebble-Nonce must be 16 to 128 letters"},
+		{name: "nonce with a newline", req: signed(func(r *request) { r.nonce = "0123456789abcdef\nx"; resign(r) }), want: "Pebble-Nonce must be 16 to 128 letters"},
+		{name: "unknown key", req: signed(func(r *request) { r.key = "missing"; r.nonce = "unknown-key-nonce" }), want: "unknown API key"},
+		{name: "revoked key", req: signed(func(r *request) { r.key = "revoked"; r.nonce = "revoked-key-nonce"; resign(r) }), want: "API key has been revoked"},
+		{name: "key without a secret", req: signed(func(r *request) { r.key = "unsigned"; r.nonce = "unsigned-key-nonce"; resign(r) }), want: "API key has no signing secret"},
+
+		{name: "body changed", req: signed(func(r *request) { r.nonce = "body-changed-nonce"; resign(r); r.body = `{"name":"Chalk"}` }), want: "request signature does not match"},
+		{name: "query changed", req: signed(func(r *request) { r.nonce = "query-changed-nonce"; resign(r); r.uri = "/pebbles?dry_run=false" }), want: "request signature does not match"},
+		{name: "method changed", req: signed(func(r *request) { r.nonce = "method-changed-nonce"; resign(r); r.method = http.MethodPut }), want: "request signature does not match"},
+		{name: "timestamp changed", req: signed(func(r *request) { r.nonce = "timestamp-changed-nonce"; resign(r); r.ts = ts(time.Second) }), want: "request signature does not match"},
+		{name: "signature without its version", req: signed(func(r *request) { r.nonce = "no-version-nonce"; resign(r); r.sig = strings.TrimPrefix(r.sig, "v1=") }), want: "request signature does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.req.method, tt.req.uri, strings.NewReader(tt.req.body))
+			for name, v := range map[string]string{signatureKeyHeader: tt.req.key, signatureTimestampHeader: tt.req.ts, signatureNonceHeader: tt.req.nonce, signatureHeader: tt.req.sig} {
+				if v != "" {
+					r.Header.Set(name, v)
+				}
+			}
+			claims, err := a.Authenticate(r)
+			if tt.want != "" {
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized || !strings.Contains(apiErr.Message, tt.want) {
+					t.Fatalf("got %v, want a 401 saying %q", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "apikey:signed" || claims.Tenant != "acme" {
+				t.Errorf("got claims %+v, want those of the signed key", claims)
+			}
+			if body, _ := io.ReadAll(r.Body); string(body) != tt.req.body {
+				t.Errorf("got body %q after authenticating, want %q", body, tt.req.body)
+			}
+		})
+	}
+
+	// A request without a key ID is left to the other authenticators.
+	if claims, err := a.Authenticate(httptest.NewRequest(http.MethodGet, "/pebbles", nil)); claims != nil || err != nil {
+		t.Errorf("got %v, %v for an unsigned request, want nothing", claims, err)
+	}
+	// Once its timestamp is out of the window a nonce is forgotten, and
+	// the request is refused for its age instead.
+	old := signed(nil)
+	clock.Advance(5*time.Minute + time.Second)
+	r := httptest.NewRequest(old.method, old.uri, strings.NewReader(old.body))
+	r.Header.Set(signatureKeyHeader, old.key)
+	r.Header.Set(signatureTimestampHeader, old.ts)
+	r.Header.Set(signatureNonceHeader, old.nonce)
+	r.Header.Set(signatureHeader, old.sig)
+	if _, err := a.Authenticate(r); err == nil || !strings.Contains(err.Error(), "from the server's time") {
+		t.Errorf("got %v for a replay after the window, want it refused for its age", err)
+	}
+}
+
+func TestNonceCacheForgetsExpired(t *testing.T) {
+	now := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	c := newNonceCache()
+	for i := range 1024 {
+		if !c.add(strconv.Itoa(i), now.Add(time.Minute), now) {
+			t.Fatalf("nonce %d was taken as seen", i)
+		}
+	}
+	if c.add("7", now.Add(time.Minute), now.Add(59*time.Second)) {
+		t.Error("a nonce was accepted twice within its window")
+	}
+	later := now.Add(time.Minute)
+	if !c.add("7", later.Add(time.Minute), later) {
+		t.Error("a nonce was refused once its window ended")
+	}
+	if len(c.seen) != 1 {
+		t.Errorf("%d nonces are remembered, want only the one added since they expired", len(c.seen))
+	}
+}
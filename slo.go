@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PermSLORead lets callers see the state of the service level objectives.
+const PermSLORead Permission = "slo:read"
+
+// sloBucketsPerAlertWindow is the number of buckets the requests of the
+// alert window are counted in, and so how finely the windows slide.
+const sloBucketsPerAlertWindow = 60
+
+// sloShortWindows is how many times longer the alert window is than the
+// short window an alert also needs the burn to show in, so that an alert
+// stops soon after the burn does.
+const sloShortWindows = 12
+
+// SLOs tracks how well the routes with objectives meet them over a
+// rolling window, counting their requests in buckets a fraction of the
+// alert window wide. An objective's error budget is the share of requests
+// that may fail it, and its burn rate how many times faster than the
+// budget allows they have been failing it: at 1 the budget runs out just
+// as the window ends. An objective alerts while its burn rate is at least
+// the alert burn rate over both the alert window and the last twelfth of
+// it.
+type SLOs struct {
+	window   time.Duration
+	long     time.Duration
+	short    time.Duration
+	width    time.Duration
+	burnRate float64
+	routes   routeMatcher
+	clock    Clock
+	logger   *slog.Logger
+	trackers []*sloTracker
+	byRoute  map[string]*sloTracker
+	metrics  *sloMetrics
+}
+
+// sloTracker counts the requests of one route for its objectives.
+type sloTracker struct {
+	route      string
+	latency    time.Duration
+	indicators []*sloIndicator
+
+	mu      sync.Mutex
+	buckets []sloBucket
+}
+
+// sloIndicator is one objective of a route: the share of its requests
+// that are to succeed, for "availability", or be served within the
+// latency threshold, for "latency".
+type sloIndicator struct {
+	name   string
+	target float64
+	// firingSince is when the objective started alerting, zero while it
+	// is not.
+	firingSince time.Time
+}
+
+// sloBucket holds the counts of the requests served in the interval of
+// its epoch, the number of bucket widths since the Unix epoch.
+type sloBucket struct {
+	epoch  int64
+	total  int64
+	errors int64
+	slow   int64
+}
+
+func (b *sloBucket) add(o sloBucket) {
+	b.total += o.total
+	b.errors += o.errors
+	b.slow += o.slow
+}
+
+// bad returns the number of requests that failed the objective named sli.
+func (b sloBucket) bad(sli string) int64 {
+	if sli == "latency" {
+		return b.slow
+	}
+	return b.errors
+}
+
+type sloMetrics struct {
+	compliance *GaugeVec
+	budget     *GaugeVec
+	burnRate   *GaugeVec
+	firing     *GaugeVec
+}
+
+// NewSLOs returns the tracker of the objectives of cfg, which must name
+// routes of rt. reg, if not nil, gets its metrics.
+func NewSLOs(cfg SLOConfig, rt *Router, clock Clock, reg *Registry, logger *slog.Logger) (*SLOs, error) {
+	known := make(map[string]bool)
+	for _, route := range rt.Routes() {
+		known[strings.TrimSpace(route.Method+" "+route.Path)] = true
+	}
+	s := &SLOs{
+		window:   cfg.Window.Duration,
+		long:     cfg.AlertWindow.Duration,
+		short:    cfg.AlertWindow.Duration / sloShortWindows,
+		width:    cfg.AlertWindow.Duration / sloBucketsPerAlertWindow,
+		burnRate: cfg.AlertBurnRate,
+		routes:   rt,
+		clock:    clock,
+		logger:   logger,
+		byRoute:  make(map[string]*sloTracker),
+	}
+	n := int((s.window + s.width - 1) / s.width)
+	for _, route := range slices.Sorted(maps.Keys(cfg.Objectives)) {
+		if !known[route] {
+			return nil, fmt.Errorf("slo.objectives: there is no route %q", route)
+		}
+		o := cfg.Objectives[route]
+		t := &sloTracker{route: route, latency: o.Latency.Duration, buckets: make([]sloBucket, n)}
+		if o.Availability > 0 {
+			t.indicators = append(t.indicators, &sloIndicator{name: "availability", target: o.Availability})
+		}
+		if o.LatencyTarget > 0 {
+			t.indicators = append(t.indicators, &sloIndicator{name: "latency", target: o.LatencyTarget})
+		}
+		s.trackers = append(s.trackers, t)
+		s.byRoute[route] = t
+	}
+	if reg != nil {
+		s.metrics = &sloMetrics{
+			compliance: reg.NewGaugeVec("slo_compliance_ratio",
+				"Share of the requests of the SLO window that met the objective.", "route", "sli"),
+			budget: reg.NewGaugeVec("slo_error_budget_remaining_ratio",
+				"Share of the error budget of the SLO window left, negative once it is overspent.", "route", "sli"),
+			burnRate: reg.NewGaugeVec("slo_burn_rate",
+				"Rate the error budget is spent at over the short and long alert windows, 1 spending it exactly over the SLO window.", "route", "sli", "window"),
+			firing: reg.NewGaugeVec("slo_alert_firing",
+				"Whether the error budget burn alert of the objective is firing.", "route", "sli"),
+		}
+	}
+	return s, nil
+}
+
+// epoch returns the epoch of the bucket counting the requests at t.
+func (s *SLOs) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(s.width)
+}
+
+// Middleware counts the requests of the routes with objectives, and
+// whether they failed or were slower than the latency threshold.
+func (s *SLOs) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, route := s.routes.Handler(r)
+			t, ok := s.byRoute[route]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := s.clock.Now()
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r)
+			end := s.clock.Now()
+			t.record(s.epoch(end), rw.status >= 500, t.latency > 0 && end.Sub(start) > t.latency)
+		})
+	}
+}
+
+func (t *sloTracker) record(epoch int64, failed, slow bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[epoch%int64(len(t.buckets))]
+	if b.epoch != epoch {
+		*b = sloBucket{epoch: epoch}
+	}
+	b.total++
+	if failed {
+		b.errors++
+	}
+	if slow {
+		b.slow++
+	}
+}
+
+// sums returns the counts of the last short, long and all buckets up to
+// and including that of epoch now.
+func (t *sloTracker) sums(now int64, short, long int64) (s, l, all sloBucket) {
+	for _, b := range t.buckets {
+		if b.epoch > now || b.total == 0 {
+			continue
+		}
+		age := now - b.epoch
+		if age >= int64(len(t.buckets)) {
+			continue
+		}
+		all.add(b)
+		if age < long {
+			l.add(b)
+		}
+		if age < short {
+			s.add(b)
+		}
+	}
+	return s, l, all
+}
+
+// burnRate returns how many times faster than target allows bad of total
+// requests failed an objective.
+func burnRate(bad, total int64, target float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - target)
+}
+
+// SLOStatus is the state of an objective of a route, over the SLO window
+// for its counts, compliance and error budget.
+type SLOStatus struct {
+	Route                string     `json:"route"`
+	SLI                  string     `json:"sli"`
+	Target               float64    `json:"target"`
+	Latency              *Duration  `json:"latency,omitempty"`
+	Requests             int64      `json:"requests"`
+	BadRequests          int64      `json:"bad_requests"`
+	Compliance           float64    `json:"compliance"`
+	ErrorBudgetRemaining float64    `json:"error_budget_remaining"`
+	ShortBurnRate        float64    `json:"short_burn_rate"`
+	LongBurnRate         float64    `json:"long_burn_rate"`
+	Alerting             bool       `json:"alerting"`
+	AlertingSince        *time.Time `json:"alerting_since,omitempty"`
+}
+
+// Status returns the state of every objective at now, updating the
+// metrics and logging the alerts that started or stopped since the last
+// call.
+func (s *SLOs) Status(now time.Time) []SLOStatus {
+	epoch := s.epoch(now)
+	var statuses []SLOStatus
+	for _, t := range s.trackers {
+		t.mu.Lock()
+		short, long, all := t.sums(epoch, int64(s.short/s.width), int64(s.long/s.width))
+		for _, ind := range t.indicators {
+			st := SLOStatus{
+				Route:         t.route,
+				SLI:           ind.name,
+				Target:        ind.target,
+				Requests:      all.total,
+				BadRequests:   all.bad(ind.name),
+				Compliance:    1,
+				ShortBurnRate: burnRate(short.bad(ind.name), short.total, ind.target),
+				LongBurnRate:  burnRate(long.bad(ind.name), long.total, ind.target),
+			}
+			if ind.name == "latency" {
+				st.Latency = &Duration{t.latency}
+			}
+			if all.total > 0 {
+				st.Compliance = 1 - float64(st.BadRequests)/float64(all.total)
+			}
+			st.ErrorBudgetRemaining = 1 - burnRate(st.BadRequests, all.total, ind.target)
+			alerting := st.ShortBurnRate >= s.burnRate && st.LongBurnRate >= s.burnRate
+			switch {
+			case alerting && ind.firingSince.IsZero():
+				ind.firingSince = now
+				s.logger.Warn("SLO error budget is burning fast", "route", t.route, "sli", ind.name,
+					"short_burn_rate", st.ShortBurnRate, "long_burn_rate", st.LongBurnRate, "error_budget_remaining", st.ErrorBudgetRemaining)
+			case !alerting && !ind.firingSince.IsZero():
+				s.logger.Info("SLO error budget burn has stopped", "route", t.route, "sli", ind.name,
+					"alerted_for", now.Sub(ind.firingSince), "error_budget_remaining", st.ErrorBudgetRemaining)
+				ind.firingSince = time.Time{}
+			}
+			if alerting {
+				st.Alerting = true
+				since := ind.firingSince.UTC()
+				st.AlertingSince = &since
+			}
+			if m := s.metrics; m != nil {
+				m.compliance.Set(st.Compliance, t.route, ind.name)
+				m.budget.Set(st.ErrorBudgetRemaining, t.route, ind.name)
+				m.burnRate.Set(st.ShortBurnRate, t.route, ind.name, "short")
+				m.burnRate.Set(st.LongBurnRate, t.route, ind.name, "long")
+				firing := 0.0
+				if alerting {
+					firing = 1
+				}
+				m.firing.Set(firing, t.route, ind.name)
+			}
+			statuses = append(statuses, st)
+		}
+		t.mu.Unlock()
+	}
+	return statuses
+}
+
+// run brings the metrics and alerts up to date every bucket width until
+// ctx is done.
+func (s *SLOs) run(ctx context.Context) {
+	every(ctx, s.clock, s.width, func(now time.Time) { s.Status(now) })
+}
+
+// register adds GET /admin/slo, listing the state of the objectives.
+func (s *SLOs) register(rt *Router) {
+	rt.Get("/admin/slo", func(w http.ResponseWriter, r *http.Request) error {
+		respond(w, r, http.StatusOK, listResponse[SLOStatus]{Items: s.Status(s.clock.Now())})
+		return nil
+	})
+	rt.Document("GET", "/admin/slo", Operation{Summary: "Show how well the routes meet their service level objectives", Tag: "admin", Response: listResponse[SLOStatus]{}})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"sync"
+	"time"
+)
+
+// slowTraceInterval is the least time between the starts of two traces of
+// slow requests, so that a server slowing down as a whole does not fill its
+// disk with them.
+const slowTraceInterval = time.Minute
+
+// SlowRequests logs the requests that take longer than a threshold, with
+// the detail needed to find out why, and counts them by route. With a trace
+// directory it also writes an execution trace of the process while one
+// runs on past the threshold: from the moment it crosses it until it ends
+// or the trace duration is up, whichever comes first.
+type SlowRequests struct {
+	threshold     time.Duration
+	traceDir      string
+	traceDuration time.Duration
+	routes        routeMatcher
+	logger        *slog.Logger
+	slow          *CounterVec
+
+	mu        sync.Mutex
+	lastTrace time.Time
+}
+
+// NewSlowRequests returns the detector of cfg for the routes of routes.
+// reg, if not nil, gets its metrics.
+func NewSlowRequests(cfg SlowRequestsConfig, routes routeMatcher, reg *Registry, logger *slog.Logger) *SlowRequests {
+	s := &SlowRequests{
+		threshold:     cfg.Threshold.Duration,
+		traceDir:      cfg.TraceDir,
+		traceDuration: cfg.TraceDuration.Duration,
+		routes:        routes,
+		logger:        logger,
+	}
+	if reg != nil {
+		s.slow = reg.NewCounterVec("http_slow_requests_total", "Number of HTTP requests slower than the slow request threshold.", "route")
+	}
+	return s
+}
+
+// Middleware times each request and logs it at warn level if it is slow.
+// Long-lived requests, such as streams, should skip it.
+func (s *SlowRequests) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			var traced chan string
+			done := make(chan struct{})
+			if s.traceDir != "" {
+				traced = make(chan string, 1)
+				t := time.AfterFunc(s.threshold, func() { s.trace(r, done, traced) })
+				defer t.Stop()
+			}
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r)
+			close(done)
+			latency := time.Since(start)
+			if latency < s.threshold {
+				return
+			}
+			_, route := s.routes.Handler(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			if s.slow != nil {
+				s.slow.Inc(route)
+			}
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("route", route),
+				slog.String("path", r.URL.Path),
+				slog.String("query", r.URL.RawQuery),
+				slog.Int("status", rw.status),
+				slog.Duration("latency", latency),
+				slog.Duration("threshold", s.threshold),
+				slog.String("client_ip", clientAddr(r)),
+			}
+			select {
+			case file := <-traced:
+				attrs = append(attrs, slog.String("trace", file))
+			default:
+			}
+			s.logger.LogAttrs(r.Context(), slog.LevelWarn, "slow request", attrs...)
+		})
+	}
+}
+
+// trace writes an execution trace while r runs on past the threshold,
+// until done is closed or the trace duration is up, and sends the file it
+// wrote to on traced before it stops. It does nothing if a trace, this one
+// or one taken through pprof, is already running, or was started less than
+// slowTraceInterval ago.
+func (s *SlowRequests) trace(r *http.Request, done <-chan struct{}, traced chan<- string) {
+	select {
+	case <-done:
+		return
+	default:
+	}
+	now := time.Now()
+	s.mu.Lock()
+	if now.Sub(s.lastTrace) < slowTraceInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastTrace = now
+	s.mu.Unlock()
+
+	// Not named after the request ID, which clients may choose.
+	file := filepath.Join(s.traceDir, "slow-"+now.UTC().Format("20060102T150405")+"-"+newRequestID()+".trace")
+	f, err := os.Create(file)
+	if err != nil {
+		s.logger.WarnContext(r.Context(), "cannot trace slow request", "error", err)
+		return
+	}
+	if err := trace.Start(f); err != nil {
+		f.Close()
+		os.Remove(file)
+		s.logger.DebugContext(r.Context(), "cannot trace slow request", "error", err)
+		return
+	}
+	traced <- file
+	t := time.NewTimer(s.traceDuration)
+	select {
+	case <-done:
+	case <-t.C:
+	}
+	t.Stop()
+	trace.Stop()
+	if err := f.Close(); err != nil {
+		s.logger.WarnContext(r.Context(), "cannot write trace of slow request", "file", file, "error", err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const PermSnapshot Permission = "storage:snapshot"
+
+// Snapshots takes consistent copies of the database of a SQL store and
+// loads them into an empty one, for backups and for moving the data of
+// one instance to a fresh one. Restore must only be given snapshots of
+// the same backend.
+type Snapshots interface {
+	// Snapshot writes a copy of the database as it stood at one moment.
+	Snapshot(ctx context.Context, w io.Writer) error
+	// Restore loads the snapshot read from r into the database, which
+	// must have no tables.
+	Restore(ctx context.Context, r io.Reader) error
+	// MediaType and Ext are the media type and file name extension of
+	// snapshots.
+	MediaType() string
+	Ext() string
+}
+
+// newSnapshots returns the Snapshots of db, configured by cfg.
+func newSnapshots(cfg StorageConfig, db *sqlStore) (Snapshots, error) {
+	switch cfg.Backend {
+	case "sqlite":
+		path, err := sqlitePath(cfg.DSN)
+		if err != nil {
+			return nil, err
+		}
+		return &sqliteSnapshots{db: db, path: path}, nil
+	case "postgres":
+		return &postgresSnapshots{db: db, dsn: cfg.DSN, dump: cfg.PgDump, restore: cfg.PgRestore, command: exec.CommandContext}, nil
+	}
+	return nil, fmt.Errorf("the %s backend has no snapshots", cfg.Backend)
+}
+
+// emptyDatabase reports an error unless the database of db has no tables,
+// so that a restore cannot mix a snapshot into existing data.
+func emptyDatabase(ctx context.Context, db *sqlStore, query string) error {
+	var n int
+	if err := db.db.QueryRowContext(ctx, query).Scan(&n); err != nil {
+		return fmt.Errorf("cannot list the tables of the database: %w", err)
+	}
+	if n > 0 {
+		return fmt.Errorf("the database already has %d tables; restore into an empty one", n)
+	}
+	return nil
+}
+
+// sqlitePath returns the file of the SQLite database named by dsn, a path
+// or a file: URI with optional parameters.
+func sqlitePath(dsn string) (string, error) {
+	path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if p, err := url.PathUnescape(path); err == nil {
+		path = p
+	}
+	if path == "" || path == ":memory:" {
+		return "", fmt.Errorf("storage.dsn %q names no database file", dsn)
+	}
+	return path, nil
+}
+
+// sqliteSnapshots copies a SQLite database with VACUUM INTO, which reads
+// it in one transaction, so writers carry on while it runs.
+type sqliteSnapshots struct {
+	db   *sqlStore
+	path string
+}
+
+func (s *sqliteSnapshots) MediaType() string { return "application/vnd.sqlite3" }
+
+func (s *sqliteSnapshots) Ext() string { return "db" }
+
+func (s *sqliteSnapshots) Snapshot(ctx context.Context, w io.Writer) error {
+	dir, err := os.MkdirTemp("", "pebbles-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// VACUUM INTO needs a file that does not exist yet.
+	tmp := filepath.Join(dir, "snapshot.db")
+	if _, err := s.db.db.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		return fmt.Errorf("cannot copy the database: %w", err)
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore writes the snapshot next to the database file and renames it
+// into place, so an interrupted restore leaves no half database behind.
+func (s *sqliteSnapshots) Restore(ctx context.Context, r io.Reader) error {
+	if err := emptyDatabase(ctx, s.db, "SELECT count(*) FROM sqlite_master WHERE type = 'table'"); err != nil {
+		return err
+	}
+	// The pool holds the file open, and would keep reading the old one.
+	s.db.Close()
+	f, err := os.CreateTemp(filepath.Dir(s.path), ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	head := make([]byte, 16)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		f.Close()
+		return err
+	}
+	if string(head[:n]) != "SQLite format 3\x00" {
+		f.Close()
+		return errors.New("the snapshot is not a SQLite database")
+	}
+	_, err = io.Copy(f, io.MultiReader(bytes.NewReader(head), r))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	// Journals of the empty database would be replayed into the snapshot.
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		os.Remove(s.path + suffix)
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// postgresSnapshots runs pg_dump and pg_restore, or the commands
+// configured in their place, with the database's DSN. Snapshots are in
+// the custom format of pg_dump, which takes them in one transaction.
+type postgresSnapshots struct {
+	db      *sqlStore
+	dsn     string
+	dump    string
+	restore string
+	command func(ctx context.Context, name string, arg ...string) *exec.Cmd
+}
+
+func (s *postgresSnapshots) MediaType() string { return "application/octet-stream" }
+
+func (s *postgresSnapshots) Ext() string { return "dump" }
+
+func (s *postgresSnapshots) Snapshot(ctx context.Context, w io.Writer) error {
+	cmd := s.command(ctx, s.dump, "--format=custom", "--dbname="+s.dsn)
+	cmd.Stdout = w
+	return runSnapshotCommand(cmd)
+}
+
+func (s *postgresSnapshots) Restore(ctx context.Context, r io.Reader) error {
+	if err := emptyDatabase(ctx, s.db, "SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema()"); err != nil {
+		return err
+	}
+	cmd := s.command(ctx, s.restore, "--no-owner", "--exit-on-error", "--single-transaction", "--dbname="+s.dsn)
+	cmd.Stdin = r
+	return runSnapshotCommand(cmd)
+}
+
+// runSnapshotCommand runs cmd, reporting the end of what it wrote to
+// stderr if it fails.
+func runSnapshotCommand(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 512 {
+			msg = "..." + msg[len(msg)-512:]
+		}
+		return fmt.Errorf("%s: %w: %s", filepath.Base(cmd.Path), err, msg)
+	}
+	return nil
+}
+
+// SnapshotHandler streams a snapshot of the database as a download. The
+// response only starts once the first bytes of the snapshot are ready,
+// so a snapshot that cannot be taken gets an error response; one that
+// fails later cuts the download short.
+func SnapshotHandler(snaps Snapshots, clock Clock, logger *slog.Logger) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		start := clock.Now()
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := snaps.Snapshot(r.Context(), pw)
+			pw.CloseWithError(err)
+			done <- err
+		}()
+		body := bufio.NewReaderSize(pr, 64<<10)
+		if _, err := body.Peek(1); err != nil {
+			pr.Close()
+			if err := <-done; err != nil {
+				return Internal(fmt.Errorf("cannot take snapshot: %w", err))
+			}
+			return Internal(errors.New("cannot take snapshot: it is empty"))
+		}
+		name := "pebbles-" + start.UTC().Format("20060102T150405Z") + "." + snaps.Ext()
+		h := w.Header()
+		h.Set("Content-Type", snaps.MediaType())
+		h.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		h.Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		n, err := body.WriteTo(w)
+		pr.Close()
+		if err := cmp.Or(<-done, err); err != nil {
+			logger.ErrorContext(r.Context(), "snapshot failed", "bytes", n, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		logger.InfoContext(r.Context(), "snapshot taken", "bytes", n, "duration", clock.Now().Sub(start))
+		return nil
+	}
+}
+
+// runRestore implements the restore command, loading the snapshot in the
+// file args[0], or standard input for "-", into the empty database of
+// cfg. The server then migrates it to its own schema when it starts.
+func runRestore(ctx context.Context, cfg Config, logger *slog.Logger, args []string) error {
+	if cfg.Storage.Backend == "memory" {
+		return fmt.Errorf("restore requires a sqlite or postgres storage backend")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("restore takes the snapshot file, or - for standard input")
+	}
+	in := io.Reader(os.Stdin)
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	db, err := newSQLStore(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Check(ctx); err != nil {
+		return err
+	}
+	snaps, err := newSnapshots(cfg.Storage, db)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := snaps.Restore(ctx, in); err != nil {
+		return err
+	}
+	logger.Info("snapshot restored", "backend", cfg.Storage.Backend, "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// purgeDeleted removes the pebbles deleted more than retention ago by clock
+// from store, calling purged, if it is not nil, with the ID of each.
+func purgeDeleted(ctx context.Context, store PebbleStore, retention time.Duration, clock Clock, logger *slog.Logger, purged func(ctx context.Context, id string)) error {
+	ids, err := store.Purge(ctx, clock.Now().UTC().Add(-retention))
+	if err != nil {
+		return fmt.Errorf("cannot purge deleted pebbles: %w", err)
+	}
+	if len(ids) > 0 {
+		logger.InfoContext(ctx, "purged deleted pebbles", "count", len(ids))
+	}
+	if purged != nil {
+		for _, id := range ids {
+			purged(ctx, id)
+		}
+	}
+	return nil
+}
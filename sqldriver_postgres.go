@@ -0,0 +1,7 @@
+//go:build !nopostgres
+
+package main
+
+// The PostgreSQL driver, registered as "postgres", for the postgres
+// backend. Build with -tags nopostgres to leave it out.
+import _ "github.com/lib/pq"
@@ -0,0 +1,8 @@
+//go:build !nosqlite && !js && !wasip1 && !plan9 && !aix && !solaris && !illumos && !mips && !mipsle && !mips64 && !mips64le && !ppc64
+
+package main
+
+// The pure Go SQLite driver, registered as "sqlite", for the sqlite
+// backend. Build with -tags nosqlite to leave it out; it is left out on
+// its own on the platforms it does not support.
+import _ "modernc.org/sqlite"
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlDialect holds what differs between the supported databases.
+type sqlDialect struct {
+	// name of the directory holding the dialect's migrations
+	name   string
+	driver string
+	// numbered placeholders ($1, $2, ...) rather than ?
+	numbered bool
+	// rows can be locked with FOR UPDATE SKIP LOCKED
+	skipLocked bool
+	// search builds the query of a search, selecting the pebble columns
+	// followed by the score and the highlighted name and color
+	search func(q SearchQuery) (string, []any)
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite":   {name: "sqlite", driver: "sqlite", search: sqliteSearch},
+	"postgres": {name: "postgres", driver: "postgres", numbered: true, skipLocked: true, search: postgresSearch},
+}
+
+// sqlStore is a PebbleStore backed by a database/sql connection pool. The
+// drivers of both backends are linked in by sqldriver_sqlite.go and
+// sqldriver_postgres.go; one named by storage.driver instead must be
+// linked in too.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func newSQLStore(cfg StorageConfig) (*sqlStore, error) {
+	dialect := sqlDialects[cfg.Backend]
+	driver := cfg.Driver
+	if driver == "" {
+		driver = dialect.driver
+	}
+	dsn := cfg.DSN
+	if cfg.Backend == "sqlite" && driver == "sqlite" {
+		dsn = sqliteDSN(dsn)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s database: %w", cfg.Backend, err)
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime.Duration)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime.Duration)
+	return &sqlStore{db: db, dialect: dialect}, nil
+}
+
+// sqliteDSN adds to dsn, for the sqlite driver, what lets the connections of
+// the pool share the database: a busy timeout, so that a writer waits for
+// the one before it rather than fail with SQLITE_BUSY; the WAL journal, so
+// that readers do not wait for writers; and immediate transactions, which
+// take the write lock when they begin, since a transaction that reads and
+// then writes, as the outbox relay's does, fails at once if another wrote
+// in between. The settings dsn has itself are kept.
+func sqliteDSN(dsn string) string {
+	path, query, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return dsn
+	}
+	pragmas := map[string]string{"busy_timeout": "busy_timeout(5000)", "journal_mode": "journal_mode(WAL)"}
+	for _, p := range params["_pragma"] {
+		name, _, _ := strings.Cut(p, "(")
+		delete(pragmas, strings.ToLower(strings.TrimSpace(name)))
+	}
+	for _, name := range slices.Sorted(maps.Keys(pragmas)) {
+		params.Add("_pragma", pragmas[name])
+	}
+	if !params.Has("_txlock") {
+		params.Set("_txlock", "immediate")
+	}
+	return path + "?" + params.Encode()
+}
+
+// Check pings the database so the store can be used as a readiness check.
+func (s *sqlStore) Check(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+type sqlTxKey struct{}
+
+// sqlConn is what *sql.DB and *sql.Tx have in common.
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// conn returns the transaction of ctx if it is in one and the pool
+// otherwise.
+func (s *sqlStore) conn(ctx context.Context) sqlConn {
+	if tx, ok := ctx.Value(sqlTxKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.db
+}
+
+func (s *sqlStore) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(sqlTxKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(context.WithValue(ctx, sqlTxKey{}, tx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebind rewrites the ? placeholders in query for the dialect.
+func (s *sqlStore) rebind(query string) string {
+	if !s.dialect.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+const pebbleColumns = "id, name, color, weight_grams, created_at, updated_at, deleted_at, tenant_id"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPebble scans the pebbleColumns of row, and then the columns after
+// them into extra.
+func scanPebble(row rowScanner, extra ...any) (Pebble, error) {
+	var p Pebble
+	var created, updated, deleted sqlTime
+	dest := []any{&p.ID, &p.Name, &p.Color, &p.WeightGrams, &created, &updated, &deleted, &p.Tenant}
+	err := row.Scan(append(dest, extra...)...)
+	p.CreatedAt = created.Time
+	p.UpdatedAt = updated.Time
+	if !deleted.IsZero() {
+		p.DeletedAt = &deleted.Time
+	}
+	return p, err
+}
+
+// List builds its query from q. The field names in q have been checked
+// against pebbleListParams and match the column names, so they can be
+// used in the SQL directly.
+func (s *sqlStore) List(ctx context.Context, q ListQuery) ([]Pebble, error) {
+	var where []string
+	var args []any
+	if !q.IncludeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+	if q.Tenant != "" {
+		where = append(where, "tenant_id = ?")
+		args = append(args, q.Tenant)
+	}
+	for _, f := range q.Filters {
+		where = append(where, f.Field+" = ?")
+		args = append(args, f.Value)
+	}
+	dir, op := "ASC", ">"
+	if q.Sort.Desc {
+		dir, op = "DESC", "<"
+	}
+	if q.After != nil {
+		where = append(where, "("+q.Sort.Field+", id) "+op+" (?, ?)")
+		args = append(args, q.After.Value, q.After.ID)
+	}
+	query := "SELECT " + pebbleColumns + " FROM pebbles"
+	if where != nil {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY " + q.Sort.Field + " " + dir + ", id " + dir + " LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := s.conn(ctx).QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Pebble{}
+	for rows.Next() {
+		p, err := scanPebble(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) Search(ctx context.Context, q SearchQuery) ([]SearchHit, error) {
+	query, args := s.dialect.search(q)
+	rows, err := s.conn(ctx).QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hits := []SearchHit{}
+	for rows.Next() {
+		var h SearchHit
+		var name, color string
+		h.Pebble, err = scanPebble(rows, &h.Score, &name, &color)
+		if err != nil {
+			return nil, err
+		}
+		h.Highlights = map[string]string{"name": name, "color": color}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// sqliteSearch searches the pebbles_search FTS5 table, which triggers keep
+// in step with the pebbles, ranking by BM25 with the name weighing twice
+// the color. The table keeps its own copy of the text, keyed by ID, since
+// external content tables follow rowids, which VACUUM may renumber. Every term is a prefix query; searchTerms leaves nothing in
+// them that FTS5 would read as syntax.
+func sqliteSearch(q SearchQuery) (string, []any) {
+	match := make([]string, len(q.Terms))
+	for i, t := range q.Terms {
+		match[i] = `"` + t + `"*`
+	}
+	const bm25 = "bm25(pebbles_search, 0, 2, 1)"
+	query := "SELECT p." + strings.ReplaceAll(pebbleColumns, ", ", ", p.") + ", -" + bm25 +
+		", highlight(pebbles_search, 1, '" + highlightStart + "', '" + highlightEnd + "')" +
+		", highlight(pebbles_search, 2, '" + highlightStart + "', '" + highlightEnd + "')" +
+		" FROM pebbles_search JOIN pebbles p ON p.id = pebbles_search.id" +
+		" WHERE pebbles_search MATCH ? AND p.deleted_at IS NULL"
+	args := []any{strings.Join(match, " AND ")}
+	if q.Tenant != "" {
+		query += " AND p.tenant_id = ?"
+		args = append(args, q.Tenant)
+	}
+	query += " ORDER BY " + bm25 + ", p.id LIMIT ? OFFSET ?"
+	return query, append(args, q.Limit, q.Offset)
+}
+
+// postgresSearch matches the generated search column, a tsvector of the
+// name and color with the name weighted higher, ranking by ts_rank. Every
+// term is a prefix query; searchTerms leaves nothing in them that
+// to_tsquery would read as syntax.
+func postgresSearch(q SearchQuery) (string, []any) {
+	match := make([]string, len(q.Terms))
+	for i, t := range q.Terms {
+		match[i] = t + ":*"
+	}
+	const headline = "'StartSel=" + highlightStart + ", StopSel=" + highlightEnd + ", HighlightAll=true'"
+	query := "SELECT " + pebbleColumns + ", ts_rank(search, q)" +
+		", ts_headline('simple', name, q, " + headline + ")" +
+		", ts_headline('simple', color, q, " + headline + ")" +
+		" FROM pebbles, to_tsquery('simple', ?) q" +
+		" WHERE search @@ q AND deleted_at IS NULL"
+	args := []any{strings.Join(match, " & ")}
+	if q.Tenant != "" {
+		query += " AND tenant_id = ?"
+		args = append(args, q.Tenant)
+	}
+	query += " ORDER BY ts_rank(search, q) DESC, id LIMIT ? OFFSET ?"
+	return query, append(args, q.Limit, q.Offset)
+}
+
+func (s *sqlStore) Get(ctx context.Context, id string) (Pebble, error) {
+	row := s.conn(ctx).QueryRowContext(ctx, s.rebind("SELECT "+pebbleColumns+" FROM pebbles WHERE id = ?"), id)
+	p, err := scanPebble(row)
+	if err == sql.ErrNoRows {
+		return Pebble{}, ErrNotFound
+	}
+	return p, err
+}
+
+func (s *sqlStore) Create(ctx context.Context, p Pebble) error {
+	res, err := s.conn(ctx).ExecContext(ctx, s.rebind(
+		"INSERT INTO pebbles ("+pebbleColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING"),
+		p.ID, p.Name, p.Color, p.WeightGrams, p.CreatedAt, p.UpdatedAt, p.DeletedAt, p.Tenant)
+	return affectedOne(res, err, ErrConflict)
+}
+
+func (s *sqlStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	res, err := s.conn(ctx).ExecContext(ctx, s.rebind(
+		"UPDATE pebbles SET name = ?, color = ?, weight_grams = ?, updated_at = ? WHERE id = ? AND updated_at = ?"),
+		p.Name, p.Color, p.WeightGrams, p.UpdatedAt, p.ID, prev)
+	err = affectedOne(res, err, ErrStale)
+	if err == ErrStale {
+		// Tell a pebble that changed apart from one that is gone.
+		if _, getErr := s.Get(ctx, p.ID); getErr != nil {
+			return getErr
+		}
+	}
+	return err
+}
+
+func (s *sqlStore) Delete(ctx context.Context, id string, at time.Time) error {
+	res, err := s.conn(ctx).ExecContext(ctx, s.rebind("UPDATE pebbles SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL"), at, id)
+	return affectedOne(res, err, ErrNotFound)
+}
+
+func (s *sqlStore) Restore(ctx context.Context, id string) error {
+	res, err := s.conn(ctx).ExecContext(ctx, s.rebind("UPDATE pebbles SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL"), id)
+	return affectedOne(res, err, ErrNotFound)
+}
+
+func (s *sqlStore) Purge(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := s.conn(ctx).QueryContext(ctx, s.rebind("DELETE FROM pebbles WHERE deleted_at < ? RETURNING id"), before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+const apiKeyColumns = "id, name, prefix, key_hash, scopes, created_at, revoked_at, tenant_id, signing_secret"
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	var scopes string
+	var created, revoked sqlTime
+	if err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Hash, &scopes, &created, &revoked, &k.Tenant, &k.SigningSecret); err != nil {
+		return APIKey{}, err
+	}
+	k.Scopes = strings.Fields(scopes)
+	k.CreatedAt = created.Time
+	if !revoked.IsZero() {
+		k.RevokedAt = &revoked.Time
+	}
+	return k, nil
+}
+
+func (s *sqlStore) CreateAPIKey(ctx context.Context, k APIKey) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(
+		"INSERT INTO api_keys ("+apiKeyColumns+") VALUES (?, ?, ?, ?, ?, ?, NULL, ?, ?) ON CONFLICT (id) DO NOTHING"),
+		k.ID, k.Name, k.Prefix, k.Hash, strings.Join(k.Scopes, " "), k.CreatedAt, k.Tenant, k.SigningSecret)
+	return affectedOne(res, err, ErrConflict)
+}
+
+func (s *sqlStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, k)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?"), id)
+	k, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrNotFound
+	}
+	return k, err
+}
+
+func (s *sqlStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?"), hash)
+	k, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrNotFound
+	}
+	return k, err
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?"), at, id)
+	return affectedOne(res, err, ErrNotFound)
+}
+
+const webhookColumns = "id, url, events, secret, created_at"
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var w Webhook
+	var events string
+	var created sqlTime
+	if err := row.Scan(&w.ID, &w.URL, &events, &w.Secret, &created); err != nil {
+		return Webhook{}, err
+	}
+	w.Events = strings.Fields(events)
+	w.CreatedAt = created.Time
+	return w, nil
+}
+
+func (s *sqlStore) CreateWebhook(ctx context.Context, w Webhook) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(
+		"INSERT INTO webhooks ("+webhookColumns+") VALUES (?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING"),
+		w.ID, w.URL, strings.Join(w.Events, " "), w.Secret, w.CreatedAt)
+	return affectedOne(res, err, ErrConflict)
+}
+
+func (s *sqlStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+webhookColumns+" FROM webhooks ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, w)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?"), id)
+	w, err := scanWebhook(row)
+	if err == sql.ErrNoRows {
+		return Webhook{}, ErrNotFound
+	}
+	return w, err
+}
+
+func (s *sqlStore) DeleteWebhook(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, s.rebind("DELETE FROM webhook_deliveries WHERE webhook_id = ?"), id); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, s.rebind("DELETE FROM webhooks WHERE id = ?"), id)
+	if err := affectedOne(res, err, ErrNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = "id, webhook_id, event_id, event_type, status, attempts, response_status, error, created_at, updated_at"
+
+func (s *sqlStore) SaveWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(
+		"INSERT INTO webhook_deliveries ("+webhookDeliveryColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"+
+			" ON CONFLICT (id) DO UPDATE SET status = excluded.status, attempts = excluded.attempts,"+
+			" response_status = excluded.response_status, error = excluded.error, updated_at = excluded.updated_at"),
+		d.ID, d.WebhookID, int64(d.EventID), d.EventType, d.Status, d.Attempts, d.ResponseStatus, d.Error, d.CreatedAt, d.UpdatedAt)
+	return err
+}
+
+func (s *sqlStore) ListWebhookDeliveries(ctx context.Context, webhookID, status string, limit int) ([]WebhookDelivery, error) {
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE webhook_id = ?"
+	args := []any{webhookID}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var eventID int64
+		var created, updated sqlTime
+		if err := rows.Scan(&d.ID, &d.WebhookID, &eventID, &d.EventType, &d.Status, &d.Attempts,
+			&d.ResponseStatus, &d.Error, &created, &updated); err != nil {
+			return nil, err
+		}
+		d.EventID = uint64(eventID)
+		d.CreatedAt, d.UpdatedAt = created.Time, updated.Time
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+const auditColumns = "id, time, request_id, actor, method, resource, status, changes"
+
+func (s *sqlStore) AppendAuditEntry(ctx context.Context, e AuditEntry) error {
+	changes, err := json.Marshal(e.Changes)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind("INSERT INTO audit_log ("+auditColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+		e.ID, e.Time, e.RequestID, e.Actor, e.Method, e.Resource, e.Status, string(changes))
+	return err
+}
+
+func (s *sqlStore) ListAuditEntries(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	query := "SELECT " + auditColumns + " FROM audit_log WHERE 1 = 1"
+	var args []any
+	if q.Actor != "" {
+		query += " AND actor = ?"
+		args = append(args, q.Actor)
+	}
+	if q.Resource != "" {
+		query += " AND resource = ?"
+		args = append(args, q.Resource)
+	}
+	if !q.Since.IsZero() {
+		query += " AND time >= ?"
+		args = append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		query += " AND time < ?"
+		args = append(args, q.Until.UTC())
+	}
+	query += " ORDER BY time DESC, id DESC LIMIT ?"
+	args = append(args, q.Limit)
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var at sqlTime
+		var changes string
+		if err := rows.Scan(&e.ID, &at, &e.RequestID, &e.Actor, &e.Method, &e.Resource, &e.Status, &changes); err != nil {
+			return nil, err
+		}
+		e.Time = at.Time
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+const attachmentColumns = "id, pebble_id, filename, content_type, size, sha256, created_at"
+
+func scanAttachment(row rowScanner) (Attachment, error) {
+	var a Attachment
+	var created sqlTime
+	err := row.Scan(&a.ID, &a.PebbleID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &created)
+	a.CreatedAt = created.Time
+	return a, err
+}
+
+func (s *sqlStore) CreateAttachment(ctx context.Context, a Attachment) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(
+		"INSERT INTO attachments ("+attachmentColumns+") VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING"),
+		a.ID, a.PebbleID, a.Filename, a.ContentType, a.Size, a.SHA256, a.CreatedAt)
+	return affectedOne(res, err, ErrConflict)
+}
+
+func (s *sqlStore) ListAttachments(ctx context.Context, pebbleIDs ...string) ([]Attachment, error) {
+	if len(pebbleIDs) == 0 {
+		return []Attachment{}, nil
+	}
+	args := make([]any, len(pebbleIDs))
+	for i, id := range pebbleIDs {
+		args[i] = id
+	}
+	marks := strings.Repeat(", ?", len(pebbleIDs))[2:]
+	rows, err := s.db.QueryContext(ctx, s.rebind("SELECT "+attachmentColumns+" FROM attachments WHERE pebble_id IN ("+marks+") ORDER BY created_at, id"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Attachment{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) GetAttachment(ctx context.Context, id string) (Attachment, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?"), id)
+	a, err := scanAttachment(row)
+	if err == sql.ErrNoRows {
+		return Attachment{}, ErrNotFound
+	}
+	return a, err
+}
+
+func (s *sqlStore) DeleteAttachment(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM attachments WHERE id = ?"), id)
+	return affectedOne(res, err, ErrNotFound)
+}
+
+// AppendOutbox adds e to the outbox, in the transaction of ctx if it is
+// in one.
+func (s *sqlStore) AppendOutbox(ctx context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn(ctx).ExecContext(ctx, s.rebind("INSERT INTO outbox (event, created_at) VALUES (?, ?)"), string(b), time.Now().UTC())
+	return err
+}
+
+// RelayOutbox passes the oldest events of the outbox, up to limit, to
+// publish in order, stopping at the first it fails on, and removes those
+// it published. It all happens in one transaction, in which Postgres locks
+// the rows so that the relays of other instances skip them.
+func (s *sqlStore) RelayOutbox(ctx context.Context, limit int, publish func(ctx context.Context, e Event) error) (int, error) {
+	var published int
+	var pubErr error
+	err := s.Transact(ctx, func(ctx context.Context) error {
+		query := "SELECT id, event FROM outbox ORDER BY id LIMIT ?"
+		if s.dialect.skipLocked {
+			query += " FOR UPDATE SKIP LOCKED"
+		}
+		rows, err := s.conn(ctx).QueryContext(ctx, s.rebind(query), limit)
+		if err != nil {
+			return err
+		}
+		type entry struct {
+			id    int64
+			event string
+		}
+		var entries []entry
+		for rows.Next() {
+			var e entry
+			if err := rows.Scan(&e.id, &e.event); err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		var done []any
+		for _, entry := range entries {
+			var e Event
+			if err := json.Unmarshal([]byte(entry.event), &e); err != nil {
+				return fmt.Errorf("outbox entry %d: %w", entry.id, err)
+			}
+			if pubErr = publish(ctx, e); pubErr != nil {
+				break
+			}
+			done = append(done, entry.id)
+		}
+		if len(done) == 0 {
+			return nil
+		}
+		published = len(done)
+		marks := strings.Repeat(", ?", len(done))[2:]
+		_, err = s.conn(ctx).ExecContext(ctx, s.rebind("DELETE FROM outbox WHERE id IN ("+marks+")"), done...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return published, pubErr
+}
+
+// affectedOne returns errNone if the statement changed no rows.
+func affectedOne(res sql.Result, err error, errNone error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNone
+	}
+	return nil
+}
+
+// sqlTime scans timestamps from drivers that return them either as
+// time.Time or as text. NULL scans as the zero time.
+type sqlTime struct {
+	time.Time
+}
+
+func (t *sqlTime) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = v.UTC()
+		return nil
+	case string:
+		return t.parse(v)
+	case []byte:
+		return t.parse(string(v))
+	}
+	return fmt.Errorf("cannot scan %T into time", src)
+}
+
+func (t *sqlTime) parse(s string) error {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05.999999999"} {
+		if v, err := time.Parse(layout, s); err == nil {
+			t.Time = v.UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse time %q", s)
+}
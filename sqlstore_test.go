@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postgresDSNEnv names a Postgres database for the SQL store tests to run
+// against as well as SQLite, such as
+// "postgres://postgres@localhost/pebbles_test?sslmode=disable". Its tables
+// are dropped by the tests.
+const postgresDSNEnv = "PEBBLE_TEST_POSTGRES_DSN"
+
+// newTestSQLStore returns a store of backend with every migration applied,
+// on a database of its own for sqlite and on the one of postgresDSNEnv,
+// emptied first, for postgres.
+func newTestSQLStore(t *testing.T, backend string) *sqlStore {
+	t.Helper()
+	cfg := DefaultConfig().Storage
+	cfg.Backend = backend
+	switch backend {
+	case "sqlite":
+		cfg.DSN = filepath.Join(t.TempDir(), "pebbles.db")
+	case "postgres":
+		if cfg.DSN = os.Getenv(postgresDSNEnv); cfg.DSN == "" {
+			t.Skipf("set %s to test against Postgres", postgresDSNEnv)
+		}
+	}
+	s, err := newSQLStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	m, err := s.Migrator(slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := m.Down(ctx, len(m.migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// forEachSQLBackend runs fn as a subtest against a store of each backend.
+func forEachSQLBackend(t *testing.T, fn func(t *testing.T, s *sqlStore)) {
+	for _, backend := range []string{"sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) { fn(t, newTestSQLStore(t, backend)) })
+	}
+}
+
+func testPebble(name, color string, at time.Time) Pebble {
+	return Pebble{ID: newUUID(), Name: name, Color: color, WeightGrams: 30, CreatedAt: at, UpdatedAt: at}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	tests := []struct{ dsn, want string }{
+		{"pebbles.db", "pebbles.db?_pragma=busy_timeout%285000%29&_pragma=journal_mode%28WAL%29&_txlock=immediate"},
+		{"file:pebbles.db?mode=rwc", "file:pebbles.db?_pragma=busy_timeout%285000%29&_pragma=journal_mode%28WAL%29&_txlock=immediate&mode=rwc"},
+		{"pebbles.db?_pragma=busy_timeout(100)&_txlock=deferred", "pebbles.db?_pragma=busy_timeout%28100%29&_pragma=journal_mode%28WAL%29&_txlock=deferred"},
+		{"pebbles.db?_pragma=JOURNAL_MODE(delete)", "pebbles.db?_pragma=JOURNAL_MODE%28delete%29&_pragma=busy_timeout%285000%29&_txlock=immediate"},
+	}
+	for _, tt := range tests {
+		if got := sqliteDSN(tt.dsn); got != tt.want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestSQLMigrations(t *testing.T) {
+	forEachSQLBackend(t, func(t *testing.T, s *sqlStore) {
+		ctx := context.Background()
+		m, err := s.Migrator(slog.New(slog.DiscardHandler))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Up(ctx); err != nil {
+			t.Fatalf("applying the migrations again: %v", err)
+		}
+		applied, err := m.applied(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != len(m.migrations) {
+			t.Fatalf("%d migrations applied, want %d", len(applied), len(m.migrations))
+		}
+		if err := m.Down(ctx, len(m.migrations)); err != nil {
+			t.Fatalf("reverting every migration: %v", err)
+		}
+		if _, err := s.Get(ctx, newUUID()); err == nil || errors.Is(err, ErrNotFound) {
+			t.Fatalf("got error %v reading pebbles with every migration reverted, want no table", err)
+		}
+		if err := m.Up(ctx); err != nil {
+			t.Fatalf("applying the migrations after reverting them: %v", err)
+		}
+	})
+}
+
+func TestSQLStorePebbles(t *testing.T) {
+	forEachSQLBackend(t, func(t *testing.T, s *sqlStore) {
+		ctx := context.Background()
+		at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+		flint, basalt, jasper := testPebble("Flint", "grey", at), testPebble("Basalt", "black", at), testPebble("Jasper", "red", at)
+		for _, p := range []Pebble{flint, basalt, jasper} {
+			if err := s.Create(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Create(ctx, flint); !errors.Is(err, ErrConflict) {
+			t.Errorf("got error %v creating a pebble twice, want ErrConflict", err)
+		}
+		got, err := s.Get(ctx, flint.ID)
+		if err != nil || got != flint {
+			t.Fatalf("got %+v and error %v, want %+v", got, err, flint)
+		}
+
+		later := at.Add(time.Minute)
+		changed := flint
+		changed.Color, changed.UpdatedAt = "white", later
+		if err := s.Update(ctx, changed, later); !errors.Is(err, ErrStale) {
+			t.Errorf("got error %v updating from a stale version, want ErrStale", err)
+		}
+		if err := s.Update(ctx, changed, at); err != nil {
+			t.Fatal(err)
+		}
+		missing := testPebble("Quartz", "white", at)
+		if err := s.Update(ctx, missing, at); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got error %v updating a missing pebble, want ErrNotFound", err)
+		}
+
+		q := ListQuery{Limit: 2, Sort: Sort{Field: "name"}}
+		page, err := s.List(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := pebbleNames(page); names != "Basalt Flint" {
+			t.Errorf("got the first page %s, want Basalt Flint", names)
+		}
+		q.After = &Cursor{Value: page[1].Name, ID: page[1].ID}
+		if page, err = s.List(ctx, q); err != nil || pebbleNames(page) != "Jasper" {
+			t.Errorf("got the second page %s and error %v, want Jasper", pebbleNames(page), err)
+		}
+		filtered, err := s.List(ctx, ListQuery{Limit: 10, Sort: Sort{Field: "name"}, Filters: []Filter{{Field: "color", Value: "white"}}})
+		if err != nil || pebbleNames(filtered) != "Flint" {
+			t.Errorf("got the white pebbles %s and error %v, want Flint", pebbleNames(filtered), err)
+		}
+
+		if err := s.Delete(ctx, basalt.ID, later); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(ctx, basalt.ID, later); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got error %v deleting a deleted pebble, want ErrNotFound", err)
+		}
+		if got, err := s.Get(ctx, basalt.ID); err != nil || got.DeletedAt == nil || !got.DeletedAt.Equal(later) {
+			t.Errorf("got %+v and error %v, want the pebble deleted at %s", got, err, later)
+		}
+		if list, _ := s.List(ctx, ListQuery{Limit: 10, Sort: Sort{Field: "name"}}); pebbleNames(list) != "Flint Jasper" {
+			t.Errorf("got %s listing after a delete, want Flint Jasper", pebbleNames(list))
+		}
+		if err := s.Restore(ctx, basalt.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(ctx, basalt.ID, later); err != nil {
+			t.Fatal(err)
+		}
+		if ids, err := s.Purge(ctx, later); err != nil || len(ids) != 0 {
+			t.Errorf("purging before the delete removed %v, error %v", ids, err)
+		}
+		if ids, err := s.Purge(ctx, later.Add(time.Second)); err != nil || len(ids) != 1 || ids[0] != basalt.ID {
+			t.Errorf("got purged %v and error %v, want [%s]", ids, err, basalt.ID)
+		}
+		if _, err := s.Get(ctx, basalt.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got error %v reading a purged pebble, want ErrNotFound", err)
+		}
+	})
+}
+
+func pebbleNames(list []Pebble) string {
+	names := make([]string, len(list))
+	for i, p := range list {
+		names[i] = p.Name
+	}
+	return strings.Join(names, " ")
+}
+
+func TestSQLStoreSearch(t *testing.T) {
+	forEachSQLBackend(t, func(t *testing.T, s *sqlStore) {
+		ctx := context.Background()
+		at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+		flint, flinty, basalt := testPebble("Flint", "grey", at), testPebble("Flinty Rock", "red", at), testPebble("Basalt", "flint grey", at)
+		flinty.Tenant = "acme"
+		for _, p := range []Pebble{flint, flinty, basalt} {
+			if err := s.Create(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hits, err := s.Search(ctx, SearchQuery{Terms: []string{"flin"}, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 3 {
+			t.Fatalf("got %d hits for a prefix of every pebble, want 3", len(hits))
+		}
+		if hits[2].Pebble.ID != basalt.ID {
+			t.Errorf("the pebble matching by color ranked %s, above one matching by name", hits[2].Pebble.Name)
+		}
+		for _, h := range hits {
+			if !strings.Contains(h.Highlights["name"]+h.Highlights["color"], highlightStart) {
+				t.Errorf("hit %s has no highlight: %v", h.Pebble.Name, h.Highlights)
+			}
+		}
+		if hits, err := s.Search(ctx, SearchQuery{Terms: []string{"flint", "grey"}, Limit: 10}); err != nil || len(hits) != 2 {
+			t.Errorf("got %d hits and error %v matching both terms, want 2", len(hits), err)
+		}
+		if hits, err := s.Search(ctx, SearchQuery{Terms: []string{"flin"}, Limit: 10, Tenant: "acme"}); err != nil || len(hits) != 1 || hits[0].Pebble.ID != flinty.ID {
+			t.Errorf("got %d hits and error %v searching one tenant, want Flinty Rock", len(hits), err)
+		}
+		if hits, err := s.Search(ctx, SearchQuery{Terms: []string{"flin"}, Limit: 1, Offset: 1}); err != nil || len(hits) != 1 {
+			t.Errorf("got %d hits and error %v for the second page, want 1", len(hits), err)
+		}
+		if err := s.Delete(ctx, flint.ID, at); err != nil {
+			t.Fatal(err)
+		}
+		if hits, err := s.Search(ctx, SearchQuery{Terms: []string{"flint"}, Limit: 10}); err != nil || len(hits) != 2 {
+			t.Errorf("got %d hits and error %v after a delete, want 2", len(hits), err)
+		}
+	})
+}
+
+// recordingPublisher keeps the events published to it, failing once fail
+// of them have been.
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []Event
+	fail   int
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail > 0 && len(p.events) >= p.fail {
+		return errors.New("the broker is down")
+	}
+	p.events = append(p.events, e)
+	return nil
+}
+
+func (p *recordingPublisher) published() []Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Event(nil), p.events...)
+}
+
+func TestSQLOutbox(t *testing.T) {
+	forEachSQLBackend(t, func(t *testing.T, s *sqlStore) {
+		ctx := context.Background()
+		at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+		var ids []string
+		for i := range 5 {
+			p := testPebble("pebble "+strconv.Itoa(i), "grey", at)
+			ids = append(ids, p.ID)
+			if err := s.AppendOutbox(ctx, Event{Type: EventPebbleCreated, PebbleID: p.ID}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// An event added in a transaction that rolls back is not kept.
+		rollback := errors.New("rollback")
+		err := s.Transact(ctx, func(ctx context.Context) error {
+			if err := s.AppendOutbox(ctx, Event{Type: EventPebbleCreated, PebbleID: "rolled back"}); err != nil {
+				return err
+			}
+			return rollback
+		})
+		if !errors.Is(err, rollback) {
+			t.Fatal(err)
+		}
+
+		pub := &recordingPublisher{fail: 2}
+		if n, err := s.RelayOutbox(ctx, 10, pub.Publish); n != 2 || err == nil {
+			t.Fatalf("got %d published and error %v with a broker failing after 2, want 2 and its error", n, err)
+		}
+		pub.fail = 0
+		if n, err := s.RelayOutbox(ctx, 2, pub.Publish); n != 2 || err != nil {
+			t.Fatalf("got %d published and error %v in a batch of 2, want 2", n, err)
+		}
+		if n, err := s.RelayOutbox(ctx, 10, pub.Publish); n != 1 || err != nil {
+			t.Fatalf("got %d published and error %v for the rest, want 1", n, err)
+		}
+		if n, err := s.RelayOutbox(ctx, 10, pub.Publish); n != 0 || err != nil {
+			t.Fatalf("got %d published and error %v from an empty outbox", n, err)
+		}
+		var got []string
+		for _, e := range pub.published() {
+			got = append(got, e.PebbleID)
+		}
+		if strings.Join(got, " ") != strings.Join(ids, " ") {
+			t.Errorf("got the events of %v, want those of %v in order", got, ids)
+		}
+	})
+}
+
+// TestSQLiteConcurrentWrites changes pebbles through the outbox from
+// several goroutines while relays drain it, as the server does under load,
+// which shared the database file badly enough for SQLITE_BUSY errors
+// before the store's connections were given a busy timeout and immediate
+// transactions.
+func TestSQLiteConcurrentWrites(t *testing.T) {
+	s := newTestSQLStore(t, "sqlite")
+	pub := &recordingPublisher{}
+	relay := NewOutboxRelay(s, pub, OutboxConfig{PollInterval: Duration{10 * time.Millisecond}, BatchSize: 10}, slog.New(slog.DiscardHandler))
+	store := outboxStore{Store: s, outbox: s, relay: relay, clock: systemClock{}}
+	ctx := context.Background()
+	const writers, writes = 8, 25
+	errs := make(chan error, writers*writes+2*writes)
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Go(func() {
+			at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+			for i := range writes {
+				p := testPebble("pebble "+strconv.Itoa(w*writes+i), "grey", at)
+				if err := store.Create(ctx, p); err != nil {
+					errs <- err
+					continue
+				}
+				p.Color, p.UpdatedAt = "red", at.Add(time.Second)
+				if err := store.Update(ctx, p, at); err != nil {
+					errs <- err
+				}
+			}
+		})
+	}
+	for range 2 {
+		wg.Go(func() {
+			for range writes {
+				if _, err := s.RelayOutbox(ctx, 10, pub.Publish); err != nil {
+					errs <- err
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for {
+		n, err := s.RelayOutbox(ctx, 100, pub.Publish)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if n := len(pub.published()); n != 2*writers*writes {
+		t.Errorf("%d events published, want %d", n, 2*writers*writes)
+	}
+}
+
+func TestSQLiteSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	open := func(name string) (*sqlStore, Snapshots) {
+		cfg := DefaultConfig().Storage
+		cfg.Backend, cfg.DSN = "sqlite", filepath.Join(dir, name)
+		s, err := newSQLStore(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		snaps, err := newSnapshots(cfg, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, snaps
+	}
+	src, snaps := open("source.db")
+	m, _ := src.Migrator(slog.New(slog.DiscardHandler))
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	flint := testPebble("Flint", "grey", time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+	if err := src.Create(ctx, flint); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := snaps.Snapshot(ctx, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := snaps.Restore(ctx, bytes.NewReader(snapshot.Bytes())); err == nil {
+		t.Error("restored into a database that has tables")
+	}
+
+	// Restore closes the store it restores into, as the restore command
+	// exits after it.
+	_, rejecting := open("rejected.db")
+	if err := rejecting.Restore(ctx, strings.NewReader("not a database")); err == nil {
+		t.Error("restored a snapshot that is not a SQLite database")
+	}
+	_, restoreInto := open("restored.db")
+	if err := restoreInto.Restore(ctx, bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := open("restored.db")
+	if got, err := restored.Get(ctx, flint.ID); err != nil || got != flint {
+		t.Errorf("got %+v and error %v from the restored database, want %+v", got, err, flint)
+	}
+}
+
+func TestPostgresJobLocks(t *testing.T) {
+	s := newTestSQLStore(t, "postgres")
+	ctx := context.Background()
+	logger := slog.New(slog.DiscardHandler)
+	a, err := newJobLocker(SchedulerConfig{Lock: "postgres", Instance: "a"}, s, RedisConfig{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newJobLocker(SchedulerConfig{Lock: "postgres", Instance: "b"}, s, RedisConfig{}, logger)
+	lock, err := a.Lock(ctx, jobPurgeDeleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Lock(ctx, jobPurgeDeleted); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("got error %v taking a held lock, want ErrLockHeld", err)
+	}
+	if h, err := b.Holder(ctx, jobPurgeDeleted); err != nil || h == nil || h.Instance != "a" {
+		t.Errorf("got holder %+v and error %v, want instance a", h, err)
+	}
+	lock.Unlock(time.Time{})
+	lock, err = b.Lock(ctx, jobPurgeDeleted)
+	if err != nil {
+		t.Fatalf("cannot take a released lock: %v", err)
+	}
+	lock.Unlock(time.Time{})
+}
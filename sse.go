@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	sseHeartbeat  = 15 * time.Second
+	sseRetry      = 3 * time.Second
+	sseSendBuffer = 64
+)
+
+// EventsHandler streams hub events as Server-Sent Events. A client that
+// reconnects with Last-Event-ID first gets the events it missed; if some
+// of them are no longer remembered it gets a resync event and should
+// fetch the current state again.
+func EventsHandler(hub *Hub, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		// The stream lives longer than the server's write timeout.
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			logger.DebugContext(r.Context(), "cannot clear write deadline", "error", err)
+		}
+
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("last_event_id")
+		}
+		var missed []Event
+		complete := true
+		var sub *Subscription
+		if lastID != "" {
+			after, err := strconv.ParseUint(lastID, 10, 64)
+			if err != nil {
+				WriteError(w, r, Invalid(nil, "Last-Event-ID must be an event ID"))
+				return
+			}
+			missed, complete, sub = hub.SubscribeAfter(after, sseSendBuffer)
+		} else {
+			sub = hub.Subscribe(sseSendBuffer)
+		}
+		defer sub.Close()
+
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+		if !complete {
+			fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+		}
+		for _, e := range missed {
+			if tenantSees(r.Context(), e) {
+				writeSSE(w, e)
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					// Lagging clients reconnect and catch up from the
+					// history; on shutdown they find another server.
+					return
+				}
+				if tenantSees(r.Context(), e) {
+					writeSSE(w, e)
+				}
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func writeSSE(w http.ResponseWriter, e Event) {
+	b, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// waitForDependency calls check until the dependency it checks, named
+// name, is reachable, as cfg says: with a wait timeout it tries again with
+// a capped exponential backoff, logging every failed attempt, and returns
+// the last error once the timeout is up or ctx is done; without one it
+// tries once.
+func waitForDependency(ctx context.Context, cfg StartupConfig, logger *slog.Logger, name string, check func(context.Context) error) error {
+	if cfg.WaitTimeout.Duration <= 0 {
+		return check(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.WaitTimeout.Duration)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	backoff := cfg.InitialBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		err := check(ctx)
+		if err == nil {
+			if attempt > 1 {
+				logger.InfoContext(ctx, "dependency is reachable", "dependency", name, "attempts", attempt)
+			}
+			return nil
+		}
+		// Without time for another attempt after the backoff, give up
+		// now with the error of this one.
+		if ctx.Err() != nil || backoff >= time.Until(deadline) {
+			return fmt.Errorf("%s still unreachable after %d attempts in %s: %w", name, attempt, cfg.WaitTimeout.Duration, err)
+		}
+		logger.WarnContext(ctx, "waiting for dependency", "dependency", name, "attempt", attempt, "retry_in", backoff, "error", err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+		}
+		t.Stop()
+		backoff = min(2*backoff, cfg.MaxBackoff.Duration)
+	}
+}
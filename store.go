@@ -0,0 +1,619 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"hash/maphash"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("already exists")
+	ErrStale    = errors.New("changed concurrently")
+)
+
+// PebbleStore persists pebbles. List returns at most q.Limit pebbles
+// matching q in its order. Get, Update and Delete return ErrNotFound for
+// unknown IDs and Create returns ErrConflict if the ID is taken. Update
+// only succeeds if the stored pebble was last updated at prev, returning
+// ErrStale otherwise, so read-modify-write cycles cannot lose changes.
+//
+// Delete only marks a pebble deleted at the given time; Get still returns
+// it, but List leaves it out unless asked to include deleted pebbles.
+// Delete returns ErrNotFound for pebbles already deleted and Restore for
+// pebbles that are not. Purge removes the pebbles deleted before a time
+// for good and returns their IDs.
+//
+// Search returns the pebbles that are not deleted matching q, best first.
+// Backends with a text index keep it in step with the pebbles as they
+// change.
+//
+// Transact runs fn in a transaction: the changes made through the context
+// passed to fn are all kept if it returns nil and all undone otherwise.
+// Called within a transaction it joins it. Use transact rather than
+// calling it directly, so that the wrappers around the store hold back
+// effects such as events until the transaction commits.
+type PebbleStore interface {
+	List(ctx context.Context, q ListQuery) ([]Pebble, error)
+	Search(ctx context.Context, q SearchQuery) ([]SearchHit, error)
+	Get(ctx context.Context, id string) (Pebble, error)
+	Create(ctx context.Context, p Pebble) error
+	Update(ctx context.Context, p Pebble, prev time.Time) error
+	Delete(ctx context.Context, id string, at time.Time) error
+	Restore(ctx context.Context, id string) error
+	Purge(ctx context.Context, before time.Time) ([]string, error)
+	Transact(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type txHooksKey struct{}
+
+// txHooks is the work to do once a transaction commits.
+type txHooks struct {
+	mu  sync.Mutex
+	fns []func()
+}
+
+// transact runs fn in a transaction of store and then does the work
+// registered with afterCommit while it ran, unless it failed.
+func transact(ctx context.Context, store PebbleStore, fn func(ctx context.Context) error) error {
+	if inTransaction(ctx) {
+		return store.Transact(ctx, fn)
+	}
+	hooks := &txHooks{}
+	if err := store.Transact(context.WithValue(ctx, txHooksKey{}, hooks), fn); err != nil {
+		return err
+	}
+	for _, f := range hooks.fns {
+		f()
+	}
+	return nil
+}
+
+// inTransaction reports whether ctx belongs to a call to transact.
+func inTransaction(ctx context.Context) bool {
+	return ctx.Value(txHooksKey{}) != nil
+}
+
+// afterCommit runs fn once the transaction of ctx commits, or straight
+// away if ctx is not in one. A transaction that fails never runs it.
+func afterCommit(ctx context.Context, fn func()) {
+	hooks, ok := ctx.Value(txHooksKey{}).(*txHooks)
+	if !ok {
+		fn()
+		return
+	}
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	hooks.fns = append(hooks.fns, fn)
+}
+
+// Store is everything the server keeps in its storage backend.
+type Store interface {
+	PebbleStore
+	APIKeyStore
+	WebhookStore
+	AuditStore
+	AttachmentStore
+}
+
+// newStore returns the Store selected by cfg.Backend.
+func newStore(cfg StorageConfig) (Store, error) {
+	if cfg.Backend == "memory" {
+		return newMemoryStore(), nil
+	}
+	return newSQLStore(cfg)
+}
+
+// memoryShards is the number of shards the pebbles of a memoryStore are
+// split into by ID, so that reads and writes of different pebbles seldom
+// wait for one another.
+const memoryShards = 32
+
+// memoryShard holds the pebbles whose IDs hash to it.
+type memoryShard struct {
+	mu      sync.RWMutex
+	pebbles map[string]Pebble
+}
+
+// memoryStore is a Store that keeps everything in memory. Get and the
+// writes of single pebbles lock only the shard of the pebble, while List
+// and Search read a snapshot of all the pebbles without locking, taking a
+// new one only after they change.
+type memoryStore struct {
+	shards [memoryShards]memoryShard
+	seed   maphash.Seed
+	// version counts the changes to the pebbles, so that a snapshot taken
+	// at an older version is not read.
+	version  atomic.Uint64
+	snapshot atomic.Pointer[memorySnapshot]
+
+	// mu guards the rest.
+	mu          sync.RWMutex
+	apiKeys     map[string]APIKey
+	webhooks    map[string]Webhook
+	deliveries  map[string]WebhookDelivery
+	audit       []AuditEntry
+	attachments map[string]Attachment
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{
+		seed:        maphash.MakeSeed(),
+		apiKeys:     make(map[string]APIKey),
+		webhooks:    make(map[string]Webhook),
+		deliveries:  make(map[string]WebhookDelivery),
+		attachments: make(map[string]Attachment),
+	}
+	for i := range s.shards {
+		s.shards[i].pebbles = make(map[string]Pebble)
+	}
+	return s
+}
+
+// memorySnapshot is a copy of all the pebbles of a memoryStore at a
+// version. It is never changed once taken, but for the orders sortedBy
+// adds to it.
+type memorySnapshot struct {
+	version uint64
+	pebbles []Pebble
+
+	mu     sync.Mutex
+	sorted map[string][]Pebble
+}
+
+// sortedBy returns the pebbles of the snapshot by field and then ID, in
+// ascending order, sorting them the first time it is asked.
+func (snap *memorySnapshot) sortedBy(field string) []Pebble {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if list, ok := snap.sorted[field]; ok {
+		return list
+	}
+	list := slices.Clone(snap.pebbles)
+	slices.SortFunc(list, func(a, b Pebble) int {
+		return cmp.Or(compareValues(a.field(field), b.field(field)), cmp.Compare(a.ID, b.ID))
+	})
+	snap.sorted[field] = list
+	return list
+}
+
+// pebbleSnapshot returns a snapshot of the pebbles as they are, reusing the
+// last one unless they changed since it was taken.
+func (s *memoryStore) pebbleSnapshot(ctx context.Context) *memorySnapshot {
+	version := s.version.Load()
+	if snap := s.snapshot.Load(); snap != nil && snap.version == version {
+		return snap
+	}
+	snap := &memorySnapshot{version: version, sorted: make(map[string][]Pebble)}
+	unlock := s.rlockAll(ctx)
+	for i := range s.shards {
+		for _, p := range s.shards[i].pebbles {
+			snap.pebbles = append(snap.pebbles, p)
+		}
+	}
+	unlock()
+	// One taken within a transaction may hold changes that are undone.
+	if !s.inTransaction(ctx) {
+		s.snapshot.Store(snap)
+	}
+	return snap
+}
+
+func (s *memoryStore) shard(id string) *memoryShard {
+	return &s.shards[maphash.String(s.seed, id)%memoryShards]
+}
+
+func (s *memoryStore) List(ctx context.Context, q ListQuery) ([]Pebble, error) {
+	sorted := s.pebbleSnapshot(ctx).sortedBy(q.Sort.Field)
+	i, step, end := 0, 1, len(sorted)
+	if q.Sort.Desc {
+		i, step, end = len(sorted)-1, -1, -1
+	}
+	if q.After != nil {
+		// n is where the cursor is, or would be, in ascending order.
+		n, found := slices.BinarySearchFunc(sorted, q.After, func(p Pebble, c *Cursor) int {
+			return cmp.Or(compareValues(p.field(q.Sort.Field), c.Value), cmp.Compare(p.ID, c.ID))
+		})
+		switch {
+		case q.Sort.Desc:
+			i = n - 1
+		case found:
+			i = n + 1
+		default:
+			i = n
+		}
+	}
+
+	list := make([]Pebble, 0, min(q.Limit, len(sorted)))
+next:
+	for ; i != end && len(list) < q.Limit; i += step {
+		p := sorted[i]
+		if p.DeletedAt != nil && !q.IncludeDeleted || q.Tenant != "" && p.Tenant != q.Tenant {
+			continue
+		}
+		for _, f := range q.Filters {
+			if compareValues(p.field(f.Field), f.Value) != 0 {
+				continue next
+			}
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// Search scores every pebble, as the memory store has no text index.
+func (s *memoryStore) Search(ctx context.Context, q SearchQuery) ([]SearchHit, error) {
+	snap := s.pebbleSnapshot(ctx)
+	list := make([]Pebble, 0, len(snap.pebbles))
+	for _, p := range snap.pebbles {
+		if p.DeletedAt == nil && (q.Tenant == "" || p.Tenant == q.Tenant) {
+			list = append(list, p)
+		}
+	}
+	return searchPebbles(list, q), nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Pebble, error) {
+	sh := s.shard(id)
+	defer s.rlock(ctx, sh)()
+	p, ok := sh.pebbles[id]
+	if !ok {
+		return Pebble{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryStore) Create(ctx context.Context, p Pebble) error {
+	sh := s.shard(p.ID)
+	defer s.lock(ctx, sh)()
+	if _, ok := sh.pebbles[p.ID]; ok {
+		return ErrConflict
+	}
+	sh.pebbles[p.ID] = p
+	s.version.Add(1)
+	return nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	sh := s.shard(p.ID)
+	defer s.lock(ctx, sh)()
+	old, ok := sh.pebbles[p.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if !old.UpdatedAt.Equal(prev) {
+		return ErrStale
+	}
+	sh.pebbles[p.ID] = p
+	s.version.Add(1)
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string, at time.Time) error {
+	sh := s.shard(id)
+	defer s.lock(ctx, sh)()
+	p, ok := sh.pebbles[id]
+	if !ok || p.DeletedAt != nil {
+		return ErrNotFound
+	}
+	p.DeletedAt = &at
+	sh.pebbles[id] = p
+	s.version.Add(1)
+	return nil
+}
+
+func (s *memoryStore) Restore(ctx context.Context, id string) error {
+	sh := s.shard(id)
+	defer s.lock(ctx, sh)()
+	p, ok := sh.pebbles[id]
+	if !ok || p.DeletedAt == nil {
+		return ErrNotFound
+	}
+	p.DeletedAt = nil
+	sh.pebbles[id] = p
+	s.version.Add(1)
+	return nil
+}
+
+func (s *memoryStore) Purge(ctx context.Context, before time.Time) ([]string, error) {
+	defer s.lockAll(ctx)()
+	var ids []string
+	for i := range s.shards {
+		for id, p := range s.shards[i].pebbles {
+			if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+				delete(s.shards[i].pebbles, id)
+				ids = append(ids, id)
+			}
+		}
+	}
+	if ids != nil {
+		s.version.Add(1)
+	}
+	return ids, nil
+}
+
+type memoryTxKey struct{}
+
+// Transact holds the locks of all the shards for the whole of fn, so
+// transactions are serialized, and puts the pebbles back as they were if
+// fn fails.
+func (s *memoryStore) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	if s.inTransaction(ctx) {
+		return fn(ctx)
+	}
+	defer s.lockAll(ctx)()
+	var saved [memoryShards]map[string]Pebble
+	for i := range s.shards {
+		saved[i] = maps.Clone(s.shards[i].pebbles)
+	}
+	if err := fn(context.WithValue(ctx, memoryTxKey{}, s)); err != nil {
+		for i := range s.shards {
+			s.shards[i].pebbles = saved[i]
+		}
+		s.version.Add(1)
+		return err
+	}
+	return nil
+}
+
+// inTransaction reports whether ctx is in one of the store's transactions,
+// which holds the locks of all its shards.
+func (s *memoryStore) inTransaction(ctx context.Context) bool {
+	return ctx.Value(memoryTxKey{}) == s
+}
+
+// lock takes the lock of sh unless ctx is in one of the store's
+// transactions, and returns the function releasing it.
+func (s *memoryStore) lock(ctx context.Context, sh *memoryShard) func() {
+	if s.inTransaction(ctx) {
+		return func() {}
+	}
+	sh.mu.Lock()
+	return sh.mu.Unlock
+}
+
+// rlock is lock for reading.
+func (s *memoryStore) rlock(ctx context.Context, sh *memoryShard) func() {
+	if s.inTransaction(ctx) {
+		return func() {}
+	}
+	sh.mu.RLock()
+	return sh.mu.RUnlock
+}
+
+// lockAll is lock for all the shards, which it takes in order so that it
+// cannot deadlock with another call.
+func (s *memoryStore) lockAll(ctx context.Context) func() {
+	if s.inTransaction(ctx) {
+		return func() {}
+	}
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+	}
+	return func() {
+		for i := range s.shards {
+			s.shards[i].mu.Unlock()
+		}
+	}
+}
+
+// rlockAll is lockAll for reading.
+func (s *memoryStore) rlockAll(ctx context.Context) func() {
+	if s.inTransaction(ctx) {
+		return func() {}
+	}
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+	}
+	return func() {
+		for i := range s.shards {
+			s.shards[i].mu.RUnlock()
+		}
+	}
+}
+
+func (s *memoryStore) CreateAPIKey(ctx context.Context, k APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.apiKeys[k.ID]; ok {
+		return ErrConflict
+	}
+	s.apiKeys[k.ID] = k
+	return nil
+}
+
+func (s *memoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]APIKey, 0, len(s.apiKeys))
+	for _, k := range s.apiKeys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func (s *memoryStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.apiKeys[id]
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+	return k, nil
+}
+
+func (s *memoryStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.apiKeys {
+		if k.Hash == hash {
+			return k, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (s *memoryStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if k.RevokedAt == nil {
+		k.RevokedAt = &at
+		s.apiKeys[id] = k
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateWebhook(ctx context.Context, w Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.webhooks[w.ID]; ok {
+		return ErrConflict
+	}
+	s.webhooks[w.ID] = w
+	return nil
+}
+
+func (s *memoryStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Webhook, 0, len(s.webhooks))
+	for _, w := range s.webhooks {
+		list = append(list, w)
+	}
+	slices.SortFunc(list, func(a, b Webhook) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return list, nil
+}
+
+func (s *memoryStore) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w, ok := s.webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNotFound
+	}
+	return w, nil
+}
+
+func (s *memoryStore) DeleteWebhook(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.webhooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.webhooks, id)
+	for did, d := range s.deliveries {
+		if d.WebhookID == id {
+			delete(s.deliveries, did)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SaveWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[d.ID] = d
+	return nil
+}
+
+func (s *memoryStore) ListWebhookDeliveries(ctx context.Context, webhookID, status string, limit int) ([]WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []WebhookDelivery{}
+	for _, d := range s.deliveries {
+		if d.WebhookID == webhookID && (status == "" || d.Status == status) {
+			list = append(list, d)
+		}
+	}
+	slices.SortFunc(list, func(a, b WebhookDelivery) int {
+		return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), cmp.Compare(b.ID, a.ID))
+	})
+	return list[:min(len(list), limit)], nil
+}
+
+func (s *memoryStore) AppendAuditEntry(ctx context.Context, e AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *memoryStore) ListAuditEntries(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []AuditEntry{}
+	for _, e := range slices.Backward(s.audit) {
+		if len(list) == q.Limit {
+			break
+		}
+		if (q.Actor == "" || e.Actor == q.Actor) && (q.Resource == "" || e.Resource == q.Resource) &&
+			(q.Since.IsZero() || !e.Time.Before(q.Since)) && (q.Until.IsZero() || e.Time.Before(q.Until)) {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) CreateAttachment(ctx context.Context, a Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attachments[a.ID]; ok {
+		return ErrConflict
+	}
+	s.attachments[a.ID] = a
+	return nil
+}
+
+func (s *memoryStore) ListAttachments(ctx context.Context, pebbleIDs ...string) ([]Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []Attachment{}
+	for _, a := range s.attachments {
+		if slices.Contains(pebbleIDs, a.PebbleID) {
+			list = append(list, a)
+		}
+	}
+	slices.SortFunc(list, func(a, b Attachment) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return list, nil
+}
+
+func (s *memoryStore) GetAttachment(ctx context.Context, id string) (Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.attachments[id]
+	if !ok {
+		return Attachment{}, ErrNotFound
+	}
+	return a, nil
+}
+
+func (s *memoryStore) DeleteAttachment(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attachments[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.attachments, id)
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchStorePebbles is the number of pebbles the memory store benchmarks
+// start with.
+const benchStorePebbles = 10000
+
+// benchMemoryStore returns a memory store holding benchStorePebbles
+// pebbles, and their IDs.
+func benchMemoryStore(b *testing.B) (*memoryStore, []string) {
+	b.Helper()
+	ctx := context.Background()
+	s := newMemoryStore()
+	colors := []string{"grey", "red", "black", "white", "blue"}
+	at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	ids := make([]string, benchStorePebbles)
+	for i := range ids {
+		ids[i] = newUUID()
+		p := Pebble{ID: ids[i], Name: "pebble " + strconv.Itoa(i), Color: colors[i%len(colors)], WeightGrams: i % 100,
+			CreatedAt: at, UpdatedAt: at}
+		if err := s.Create(ctx, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s, ids
+}
+
+func BenchmarkMemoryStoreGet(b *testing.B) {
+	s, ids := benchMemoryStore(b)
+	ctx := context.Background()
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(7919))
+		for pb.Next() {
+			i++
+			if _, err := s.Get(ctx, ids[i%len(ids)]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkMemoryStoreList(b *testing.B) {
+	s, _ := benchMemoryStore(b)
+	ctx := context.Background()
+	q := ListQuery{Limit: 20, Sort: Sort{Field: "name"}, Filters: []Filter{{Field: "color", Value: "red"}}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if list, err := s.List(ctx, q); err != nil || len(list) != q.Limit {
+				b.Errorf("got %d pebbles and error %v, want %d", len(list), err, q.Limit)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkMemoryStoreCreate(b *testing.B) {
+	s, _ := benchMemoryStore(b)
+	ctx := context.Background()
+	at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p := Pebble{ID: "bench-" + strconv.FormatInt(next.Add(1), 10), Name: "Flint", Color: "grey", CreatedAt: at, UpdatedAt: at}
+			if err := s.Create(ctx, p); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkMemoryStoreMixed reads as the API mostly does, with one
+// create in every 20 operations, so that lists see the store change under
+// them.
+func BenchmarkMemoryStoreMixed(b *testing.B) {
+	s, ids := benchMemoryStore(b)
+	ctx := context.Background()
+	at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	q := ListQuery{Limit: 20, Sort: Sort{Field: "name"}}
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := next.Add(1)
+			var err error
+			switch {
+			case n%20 == 0:
+				err = s.Create(ctx, Pebble{ID: "bench-" + strconv.FormatInt(n, 10), Name: "Flint", Color: "grey", CreatedAt: at, UpdatedAt: at})
+			case n%4 == 0:
+				_, err = s.List(ctx, q)
+			default:
+				_, err = s.Get(ctx, ids[int(n)%len(ids)])
+			}
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const CodeTenantRequired = "tenant_required"
+
+// PermTenantsAny lets callers without a tenant of their own act for any
+// tenant by naming it in the tenancy header.
+const PermTenantsAny Permission = "tenants:any"
+
+// tenantIDRule describes the tenant IDs validTenant accepts.
+const tenantIDRule = "must be 1 to 64 letters, digits, dots, dashes or underscores"
+
+// validTenant reports whether id can name a tenant. IDs are limited so
+// that they are safe as metric labels and rate limit keys.
+func validTenant(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type tenantKey struct{}
+
+// TenantFromContext returns the tenant the request with context ctx acts
+// for, or "" outside tenant-scoped requests, such as in background jobs,
+// which see every tenant.
+func TenantFromContext(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+func contextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantScoped reports whether routes needing permission p act on the data
+// of a tenant: those of the pebbles, with their attachments and events.
+func tenantScoped(p Permission) bool {
+	switch p {
+	case PermPebblesRead, PermPebblesWrite, PermPebblesAdmin:
+		return true
+	}
+	return false
+}
+
+// seedTenant returns the tenant of the pebbles created outside requests,
+// by the demo data and fixtures.
+func (c TenancyConfig) seedTenant() string {
+	if c.Enabled {
+		return c.Default
+	}
+	return ""
+}
+
+// Tenancy works out the tenant of each request, limits the rate of the
+// requests of each tenant and counts them by tenant.
+type Tenancy struct {
+	header   string
+	claim    string
+	def      string
+	limiter  LimiterStore
+	requests *CounterVec
+}
+
+// NewTenancy returns the tenancy of cfg. limiter, if not nil, limits the
+// requests of each tenant; reg, if not nil, gets the tenant_requests_total
+// metric.
+func NewTenancy(cfg TenancyConfig, limiter LimiterStore, reg *Registry) *Tenancy {
+	t := &Tenancy{header: cfg.Header, claim: cfg.Claim, def: cfg.Default, limiter: limiter}
+	if reg != nil {
+		t.requests = reg.NewCounterVec("tenant_requests_total",
+			"Number of tenant-scoped requests served, by tenant and status.", "tenant", "status")
+	}
+	return t
+}
+
+// Resolve returns the tenant that r, made with claims c, acts for: that of
+// its credentials, or else the one it names in the tenancy header, or
+// else the default. Only callers whose credentials have no tenant may name
+// one, and, once authenticated, only with the tenants:any permission.
+func (t *Tenancy) Resolve(r *http.Request, c *Claims) (string, error) {
+	var own string
+	if c != nil {
+		own = c.Tenant
+		if own == "" {
+			own, _ = c.Raw[t.claim].(string)
+		}
+	}
+	named := r.Header.Get(t.header)
+	switch {
+	case named != "" && !validTenant(named):
+		return "", Invalid(nil, "%s "+tenantIDRule, t.header)
+	case own != "" && !validTenant(own):
+		return "", Forbidden("the credentials name an invalid tenant")
+	case named != "" && own != "" && named != own:
+		return "", Forbidden("the credentials are for tenant %q, not %q", own, named)
+	case named != "" && own == "" && c != nil && !hasPermission(c, PermTenantsAny):
+		return "", Forbidden("naming a tenant with %s requires the %q permission", t.header, PermTenantsAny)
+	}
+	if tenant := cmp.Or(own, named, t.def); tenant != "" {
+		return tenant, nil
+	}
+	return "", NewAPIError(http.StatusBadRequest, CodeTenantRequired,
+		fmt.Sprintf("the request names no tenant; send the %s header", t.header))
+}
+
+// Middleware scopes the requests for tenant-scoped routes, by the
+// permission in perms of the route pattern that routes resolves, to their
+// tenant. It must run after Authenticate.
+func (t *Tenancy) Middleware(perms map[string]Permission, routes routeMatcher) Middleware {
+	return func(next http.Handler) http.Handler {
+		inner := next
+		if t.limiter != nil {
+			inner = RateLimit(t.limiter, func(r *http.Request) string {
+				return "tenant:" + TenantFromContext(r.Context())
+			})(next)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pattern := routes.Handler(r)
+			if !tenantScoped(perms[pattern]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", t.header)
+			tenant, err := t.Resolve(r, ClaimsFromContext(r.Context()))
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			rw := newResponseRecorder(w)
+			inner.ServeHTTP(rw, r.WithContext(contextWithTenant(r.Context(), tenant)))
+			if t.requests != nil {
+				t.requests.Inc(tenant, statusClass(rw.status))
+			}
+		})
+	}
+}
+
+// tenantSees reports whether the request with context ctx may see event
+// e, which is of another tenant's pebble if the tenants differ.
+func tenantSees(ctx context.Context, e Event) bool {
+	t := TenantFromContext(ctx)
+	return t == "" || e.Tenant == t
+}
+
+// tenantStore scopes the pebbles of the wrapped store to the tenant of the
+// context: those of other tenants are neither listed nor found, and new
+// pebbles belong to it. Without a tenant in the context every pebble can
+// be reached.
+type tenantStore struct {
+	Store
+}
+
+func (s tenantStore) List(ctx context.Context, q ListQuery) ([]Pebble, error) {
+	if t := TenantFromContext(ctx); t != "" {
+		q.Tenant = t
+	}
+	return s.Store.List(ctx, q)
+}
+
+func (s tenantStore) Search(ctx context.Context, q SearchQuery) ([]SearchHit, error) {
+	if t := TenantFromContext(ctx); t != "" {
+		q.Tenant = t
+	}
+	return s.Store.Search(ctx, q)
+}
+
+func (s tenantStore) Get(ctx context.Context, id string) (Pebble, error) {
+	p, err := s.Store.Get(ctx, id)
+	if t := TenantFromContext(ctx); err == nil && t != "" && p.Tenant != t {
+		return Pebble{}, ErrNotFound
+	}
+	return p, err
+}
+
+func (s tenantStore) Create(ctx context.Context, p Pebble) error {
+	if t := TenantFromContext(ctx); t != "" {
+		p.Tenant = t
+	}
+	return s.Store.Create(ctx, p)
+}
+
+func (s tenantStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	if err := s.check(ctx, p.ID); err != nil {
+		return err
+	}
+	return s.Store.Update(ctx, p, prev)
+}
+
+func (s tenantStore) Delete(ctx context.Context, id string, at time.Time) error {
+	if err := s.check(ctx, id); err != nil {
+		return err
+	}
+	return s.Store.Delete(ctx, id, at)
+}
+
+func (s tenantStore) Restore(ctx context.Context, id string) error {
+	if err := s.check(ctx, id); err != nil {
+		return err
+	}
+	return s.Store.Restore(ctx, id)
+}
+
+// check returns ErrNotFound if pebble id is not of the tenant of ctx.
+func (s tenantStore) check(ctx context.Context, id string) error {
+	if TenantFromContext(ctx) == "" {
+		return nil
+	}
+	_, err := s.Get(ctx, id)
+	return err
+}
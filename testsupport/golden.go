@@ -0,0 +1,127 @@
+package testsupport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// updateEnv, set to 1, makes ExpectGolden write the golden files rather
+// than compare against them:
+//
+//	PEBBLE_UPDATE_GOLDEN=1 go test ./...
+const updateEnv = "PEBBLE_UPDATE_GOLDEN"
+
+// masked replaces the values of masked fields in golden files.
+const masked = "<masked>"
+
+// ExpectGolden fails the test unless the JSON body matches the golden file
+// testdata/name.json of the test's package, once the values at masks are
+// replaced with "<masked>". A mask is a path of member names and array
+// indexes separated by dots, in which * stands for every member or item,
+// such as "id" or "items.*.created_at"; use masks for the IDs, times and
+// other values that differ from run to run. Bodies are compared as JSON,
+// so the order of members and spacing do not matter.
+func (r *Response) ExpectGolden(t testing.TB, name string, masks ...string) {
+	t.Helper()
+	got, err := goldenJSON(r.Body, masks)
+	if err != nil {
+		t.Fatalf("%s: the body is not JSON: %v; body: %s", r.request, err, r.Body)
+	}
+	path := filepath.Join("testdata", name+".json")
+	if os.Getenv(updateEnv) == "1" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("testsupport: %v", err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("testsupport: %v", err)
+		}
+		return
+	}
+	golden, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("%s: there is no golden file %s; run the test with %s=1 to write it", r.request, path, updateEnv)
+	} else if err != nil {
+		t.Fatalf("testsupport: %v", err)
+	}
+	want, err := goldenJSON(golden, nil)
+	if err != nil {
+		t.Fatalf("testsupport: the golden file %s is not JSON: %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: the body does not match %s\n%s\ngot:\n%s", r.request, path, firstDifference(want, got), got)
+	}
+}
+
+// goldenJSON returns the JSON document b indented, with its members in
+// order by name and the values at masks replaced.
+func goldenJSON(b []byte, masks []string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	for _, m := range masks {
+		v = mask(v, strings.Split(m, "."))
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// mask returns v with the values at path replaced by "<masked>". Paths
+// that lead nowhere are left alone, so that a mask fits every response of
+// a kind, whether or not it has the field.
+func mask(v any, path []string) any {
+	if len(path) == 0 {
+		return masked
+	}
+	key, rest := path[0], path[1:]
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			if key == "*" || key == k {
+				v[k] = mask(item, rest)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			if key == "*" || key == strconv.Itoa(i) {
+				v[i] = mask(item, rest)
+			}
+		}
+	}
+	return v
+}
+
+// firstDifference describes the first line where got differs from want.
+func firstDifference(want, got []byte) string {
+	wl := strings.Split(string(want), "\n")
+	gl := strings.Split(string(got), "\n")
+	for i := 0; i < len(wl) || i < len(gl); i++ {
+		var w, g string
+		if i < len(wl) {
+			w = wl[i]
+		}
+		if i < len(gl) {
+			g = gl[i]
+		}
+		if w != g {
+			return fmt.Sprintf("line %d: want %q, got %q", i+1, w, g)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,211 @@
+package testsupport
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// recorder is a testing.TB that records the failures of the tests it is
+// passed to, rather than failing the test running them.
+type recorder struct {
+	testing.TB
+	failures []string
+	fatal    bool
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...any) {
+	r.Errorf(format, args...)
+	r.fatal = true
+	runtime.Goexit()
+}
+
+// record runs f with a recorder, in a goroutine of its own so that Fatalf
+// can end it.
+func record(t *testing.T, f func(testing.TB)) *recorder {
+	r := &recorder{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f(r)
+	}()
+	<-done
+	return r
+}
+
+func TestGoldenJSON(t *testing.T) {
+	body := `{"page":{"next_cursor":"abc"},"items":[{"id":"p1","name":"Flint","weight":1.50,"tags":{"a":"<b>"}},{"id":"p2","name":"Chalk"}],"total":2}`
+	tests := []struct {
+		masks []string
+		want  string
+	}{
+		{nil, `{
+  "items": [
+    {
+      "id": "p1",
+      "name": "Flint",
+      "tags": {
+        "a": "<b>"
+      },
+      "weight": 1.50
+    },
+    {
+      "id": "p2",
+      "name": "Chalk"
+    }
+  ],
+  "page": {
+    "next_cursor": "abc"
+  },
+  "total": 2
+}
+`},
+		{[]string{"items.*.id", "page.next_cursor", "missing", "items.5.name", "total.deeper"}, `{
+  "items": [
+    {
+      "id": "<masked>",
+      "name": "Flint",
+      "tags": {
+        "a": "<b>"
+      },
+      "weight": 1.50
+    },
+    {
+      "id": "<masked>",
+      "name": "Chalk"
+    }
+  ],
+  "page": {
+    "next_cursor": "<masked>"
+  },
+  "total": 2
+}
+`},
+		{[]string{"items.1", "items.0.tags.*"}, `{
+  "items": [
+    {
+      "id": "p1",
+      "name": "Flint",
+      "tags": {
+        "a": "<masked>"
+      },
+      "weight": 1.50
+    },
+    "<masked>"
+  ],
+  "page": {
+    "next_cursor": "abc"
+  },
+  "total": 2
+}
+`},
+	}
+	for _, tt := range tests {
+		got, err := goldenJSON([]byte(body), tt.masks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("masks %q: got\n%s\nwant\n%s", tt.masks, got, tt.want)
+		}
+	}
+	if _, err := goldenJSON([]byte("not json"), nil); err == nil {
+		t.Error("got no error for a body that is not JSON")
+	}
+}
+
+func TestFirstDifference(t *testing.T) {
+	tests := []struct{ want, got, diff string }{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\n", "a\nc\n", `line 2: want "b", got "c"`},
+		{"a\n", "a\nb\n", `line 2: want "", got "b"`},
+		{"a\nb\n", "a\n", `line 2: want "b", got ""`},
+	}
+	for _, tt := range tests {
+		if diff := firstDifference([]byte(tt.want), []byte(tt.got)); diff != tt.diff {
+			t.Errorf("%q and %q: got %q, want %q", tt.want, tt.got, diff, tt.diff)
+		}
+	}
+}
+
+func TestExpectGolden(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// Unset even when the package's own golden files are being updated.
+	t.Setenv(updateEnv, "")
+	resp := &Response{Status: 200, Body: []byte(`{"id":"p1","name":"Flint"}`), request: "GET /pebbles/p1"}
+
+	// Without a golden file the test fails, saying how to write one.
+	r := record(t, func(tb testing.TB) { resp.ExpectGolden(tb, "pebble", "id") })
+	if !r.fatal || len(r.failures) != 1 || !strings.Contains(r.failures[0], "there is no golden file testdata/pebble.json; run the test with PEBBLE_UPDATE_GOLDEN=1") {
+		t.Fatalf("got failures %q without a golden file", r.failures)
+	}
+
+	// With PEBBLE_UPDATE_GOLDEN=1 it is written, masked, and the test
+	// passes.
+	t.Setenv(updateEnv, "1")
+	if r := record(t, func(tb testing.TB) { resp.ExpectGolden(tb, "pebble", "id") }); len(r.failures) != 0 {
+		t.Fatalf("got failures %q writing the golden file", r.failures)
+	}
+	b, err := os.ReadFile(filepath.Join("testdata", "pebble.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\n  \"id\": \"<masked>\",\n  \"name\": \"Flint\"\n}\n"; string(b) != want {
+		t.Errorf("got golden file %q, want %q", b, want)
+	}
+	// Names may have directories of testdata in them, made as needed.
+	changed := &Response{Status: 200, Body: []byte(`{"name":"Chalk"}`), request: "GET /pebbles/p1"}
+	if r := record(t, func(tb testing.TB) { changed.ExpectGolden(tb, "nested/pebble") }); len(r.failures) != 0 {
+		t.Fatalf("got failures %q writing a golden file in a new directory", r.failures)
+	}
+	if _, err := os.Stat(filepath.Join("testdata", "nested", "pebble.json")); err != nil {
+		t.Error(err)
+	}
+
+	t.Setenv(updateEnv, "")
+	tests := []struct {
+		name  string
+		body  string
+		masks []string
+		want  string // the failure, or "" for none
+	}{
+		{name: "the same", body: `{"id":"p2","name":"Flint"}`, masks: []string{"id"}},
+		{name: "in another order", body: `{ "name": "Flint",  "id": "p9" }`, masks: []string{"id"}},
+		{name: "a value changed", body: `{"id":"p2","name":"Chalk"}`, masks: []string{"id"}, want: "GET /pebbles/p1: the body does not match testdata/pebble.json\n" + `line 3: want "  \"name\": \"Flint\"", got "  \"name\": \"Chalk\""`},
+		{name: "a mask forgotten", body: `{"id":"p2","name":"Flint"}`, want: `line 2: want "  \"id\": \"<masked>\",", got "  \"id\": \"p2\","`},
+		{name: "a field added", body: `{"id":"p2","name":"Flint","weight":3}`, masks: []string{"id"}, want: `line 3: want "  \"name\": \"Flint\"", got "  \"name\": \"Flint\","`},
+		{name: "not JSON", body: `<pebble/>`, want: "GET /pebbles/p1: the body is not JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &Response{Status: 200, Body: []byte(tt.body), request: "GET /pebbles/p1"}
+			r := record(t, func(tb testing.TB) { resp.ExpectGolden(tb, "pebble", tt.masks...) })
+			if tt.want == "" {
+				if len(r.failures) != 0 {
+					t.Errorf("got failures %q, want none", r.failures)
+				}
+				return
+			}
+			if len(r.failures) != 1 || !strings.Contains(r.failures[0], tt.want) {
+				t.Errorf("got failures %q, want one saying %q", r.failures, tt.want)
+			}
+		})
+	}
+
+	if err := os.WriteFile(filepath.Join("testdata", "broken.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r = record(t, func(tb testing.TB) { resp.ExpectGolden(tb, "broken") })
+	if !r.fatal || len(r.failures) != 1 || !strings.Contains(r.failures[0], "the golden file testdata/broken.json is not JSON") {
+		t.Errorf("got failures %q for a broken golden file", r.failures)
+	}
+}
@@ -0,0 +1,157 @@
+package testsupport
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Request is a request to a Server being built, sent by Do:
+//
+//	srv.Post("/pebbles").JSON(map[string]any{"name": "Flint", "color": "grey"}).Do(t)
+type Request struct {
+	srv    *Server
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+	// bodyErr is the error of encoding a JSON body, reported by Do.
+	bodyErr error
+}
+
+// NewRequest returns a request for method and path, such as "/pebbles",
+// authenticated with the demo API key and accepting JSON.
+func (s *Server) NewRequest(method, path string) *Request {
+	return &Request{
+		srv:    s,
+		method: method,
+		path:   path,
+		query:  url.Values{},
+		header: http.Header{"Accept": {"application/json"}, "X-Api-Key": {DemoAPIKey}},
+	}
+}
+
+// Get, Post, Put, Patch and Delete return a NewRequest of their method.
+func (s *Server) Get(path string) *Request { return s.NewRequest(http.MethodGet, path) }
+
+func (s *Server) Post(path string) *Request { return s.NewRequest(http.MethodPost, path) }
+
+func (s *Server) Put(path string) *Request { return s.NewRequest(http.MethodPut, path) }
+
+func (s *Server) Patch(path string) *Request { return s.NewRequest(http.MethodPatch, path) }
+
+func (s *Server) Delete(path string) *Request { return s.NewRequest(http.MethodDelete, path) }
+
+// Query adds the query parameter key with value.
+func (r *Request) Query(key, value string) *Request {
+	r.query.Add(key, value)
+	return r
+}
+
+// Header sets the header key to value.
+func (r *Request) Header(key, value string) *Request {
+	r.header.Set(key, value)
+	return r
+}
+
+// Anonymous sends the request without credentials.
+func (r *Request) Anonymous() *Request {
+	r.header.Del("X-Api-Key")
+	r.header.Del("Authorization")
+	return r
+}
+
+// APIKey authenticates the request with key instead of the demo API key.
+func (r *Request) APIKey(key string) *Request {
+	r.header.Del("Authorization")
+	r.header.Set("X-Api-Key", key)
+	return r
+}
+
+// Token authenticates the request with a JWT bearer token instead of the
+// demo API key.
+func (r *Request) Token(token string) *Request {
+	r.header.Del("X-Api-Key")
+	r.header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// JSON sends v encoded as JSON as the body.
+func (r *Request) JSON(v any) *Request {
+	r.body, r.bodyErr = json.Marshal(v)
+	r.header.Set("Content-Type", "application/json")
+	return r
+}
+
+// Body sends body, of the given media type, as it is.
+func (r *Request) Body(contentType string, body []byte) *Request {
+	r.body = body
+	r.header.Set("Content-Type", contentType)
+	return r
+}
+
+// Do sends the request and reads the response, failing the test if it
+// cannot.
+func (r *Request) Do(t testing.TB) *Response {
+	t.Helper()
+	if r.bodyErr != nil {
+		t.Fatalf("testsupport: cannot encode the body of %s %s: %v", r.method, r.path, r.bodyErr)
+	}
+	u := r.srv.URL + r.path
+	if len(r.query) > 0 {
+		sep := "?"
+		if strings.Contains(r.path, "?") {
+			sep = "&"
+		}
+		u += sep + r.query.Encode()
+	}
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequest(r.method, u, body)
+	if err != nil {
+		t.Fatalf("testsupport: %v", err)
+	}
+	req.Header = r.header.Clone()
+	resp, err := r.srv.client.Do(req)
+	if err != nil {
+		t.Fatalf("testsupport: %s %s: %v", r.method, r.path, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("testsupport: %s %s: cannot read the response: %v", r.method, r.path, err)
+	}
+	return &Response{Status: resp.StatusCode, Header: resp.Header, Body: b, request: r.method + " " + r.path}
+}
+
+// Response is a response of a Server, read whole.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// request is the method and path of the request, for messages.
+	request string
+}
+
+// ExpectStatus fails the test unless the response has status.
+func (r *Response) ExpectStatus(t testing.TB, status int) {
+	t.Helper()
+	if r.Status != status {
+		t.Fatalf("%s: got status %d, want %d; body: %s", r.request, r.Status, status, r.Body)
+	}
+}
+
+// Decode decodes the JSON body into v, failing the test if it cannot.
+func (r *Response) Decode(t testing.TB, v any) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("%s: cannot decode the body: %v; body: %s", r.request, err, r.Body)
+	}
+}
@@ -0,0 +1,254 @@
+// Package testsupport runs the pebble-api server for integration tests of
+// the code that calls it, and checks its responses against golden files.
+//
+//	func TestListPebbles(t *testing.T) {
+//		srv := testsupport.Start(t)
+//		resp := srv.Get("/pebbles").Query("sort", "name").Do(t)
+//		resp.ExpectStatus(t, http.StatusOK)
+//		resp.ExpectGolden(t, "list_pebbles", "items.*.id", "items.*.created_at", "items.*.updated_at", "page.next_cursor")
+//	}
+//
+// Each server is a process of its own, in demo mode: its storage, cache
+// and event publisher are in memory, so every test that starts one gets an
+// empty API but for the demo pebbles, and the demo API key, with the admin
+// role, is accepted.
+package testsupport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// DemoAPIKey is the API key of the admin the servers accept.
+const DemoAPIKey = "pebble-demo-key-not-for-production"
+
+// Environment variables that point the package at the server: a binary
+// built already, or the directory of the server's source to build one from
+// instead of the one this package sits in.
+const (
+	binaryEnv = "PEBBLE_SERVER_BINARY"
+	sourceEnv = "PEBBLE_SERVER_SOURCE"
+)
+
+// Server is a running server. Its requests are sent with the demo API key
+// unless they are made Anonymous.
+type Server struct {
+	// URL is the base URL of the server, such as "http://127.0.0.1:41234".
+	URL    string
+	client *http.Client
+	cmd    *exec.Cmd
+	done   chan error
+	output *syncBuffer
+}
+
+type options struct {
+	env     []string
+	config  []byte
+	timeout time.Duration
+}
+
+// Option configures a Server.
+type Option func(*options)
+
+// WithEnv sets the environment variable key of the server, such as
+// "RATE_LIMIT_ENABLED", to value, overriding the default and the config
+// file.
+func WithEnv(key, value string) Option {
+	return func(o *options) { o.env = append(o.env, key+"="+value) }
+}
+
+// WithConfig gives the server a config file holding the JSON document
+// config, for the settings the environment cannot set, such as
+// proxy.routes.
+func WithConfig(config string) Option {
+	return func(o *options) { o.config = []byte(config) }
+}
+
+// WithStartTimeout sets how long the server has to become ready, 30
+// seconds by default.
+func WithStartTimeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// Start starts a server on a free port of the loopback interface and
+// waits until /readyz reports it ready. The server is stopped when the
+// test and its subtests finish; if the test failed, what it logged is
+// added to the test's log.
+func Start(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+	o := options{timeout: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	bin, err := serverBinary()
+	if err != nil {
+		t.Fatalf("testsupport: %v", err)
+	}
+	port, err := freePort()
+	if err != nil {
+		t.Fatalf("testsupport: cannot find a free port: %v", err)
+	}
+	args := []string{"-demo"}
+	if o.config != nil {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, o.config, 0o600); err != nil {
+			t.Fatalf("testsupport: %v", err)
+		}
+		args = append(args, "-config", path)
+	}
+	s := &Server{
+		URL:    "http://127.0.0.1:" + strconv.Itoa(port),
+		client: &http.Client{Timeout: 30 * time.Second},
+		done:   make(chan error, 1),
+		output: &syncBuffer{},
+	}
+	s.cmd = exec.Command(bin, args...)
+	s.cmd.Env = append(os.Environ(), "PORT="+strconv.Itoa(port), "LISTEN_HOST=127.0.0.1", "CONFIG_FILE=")
+	s.cmd.Env = append(s.cmd.Env, o.env...)
+	s.cmd.Stdout = s.output
+	s.cmd.Stderr = s.output
+	if err := s.cmd.Start(); err != nil {
+		t.Fatalf("testsupport: cannot start the server: %v", err)
+	}
+	go func() { s.done <- s.cmd.Wait() }()
+	t.Cleanup(func() {
+		s.stop()
+		if t.Failed() {
+			t.Logf("server output:\n%s", s.output.String())
+		}
+	})
+	if err := s.waitReady(o.timeout); err != nil {
+		t.Fatalf("testsupport: %v\nserver output:\n%s", err, s.output.String())
+	}
+	return s
+}
+
+// Output returns what the server has logged so far.
+func (s *Server) Output() string {
+	return s.output.String()
+}
+
+// waitReady polls /readyz until it answers 200, the server exits or
+// timeout passes.
+func (s *Server) waitReady(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/readyz", nil)
+		if resp, err := s.client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case err := <-s.done:
+			s.done <- err
+			return fmt.Errorf("the server exited before it was ready: %v", err)
+		case <-ctx.Done():
+			return fmt.Errorf("the server was not ready within %s", timeout)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// stop asks the server to shut down, and kills it if it has not within
+// ten seconds.
+func (s *Server) stop() {
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		// Windows has no SIGTERM.
+		s.cmd.Process.Kill()
+	}
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+}
+
+var build struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// serverBinary returns the server binary named by PEBBLE_SERVER_BINARY, or
+// else builds one, once per test binary, from the server's source.
+func serverBinary() (string, error) {
+	if bin := os.Getenv(binaryEnv); bin != "" {
+		return bin, nil
+	}
+	build.once.Do(func() {
+		src := os.Getenv(sourceEnv)
+		if src == "" {
+			_, file, _, ok := runtime.Caller(0)
+			if !ok {
+				build.err = fmt.Errorf("cannot locate the server's source; set %s", sourceEnv)
+				return
+			}
+			src = filepath.Dir(filepath.Dir(file))
+		}
+		dir, err := os.MkdirTemp("", "pebble-testsupport-*")
+		if err != nil {
+			build.err = err
+			return
+		}
+		build.path = filepath.Join(dir, "server")
+		var stderr bytes.Buffer
+		cmd := exec.Command("go", "build", "-o", build.path, ".")
+		cmd.Dir = src
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			build.err = fmt.Errorf("cannot build the server in %s: %w\n%s", src, err, stderr.Bytes())
+		}
+	})
+	return build.path, build.err
+}
+
+// freePort returns a TCP port of the loopback interface that nothing was
+// listening on when it was called.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0, errors.New("the listener has no TCP address")
+	}
+	return addr.Port, nil
+}
+
+// syncBuffer collects the output of the server, which its stdout and
+// stderr write from goroutines of their own.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
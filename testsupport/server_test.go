@@ -0,0 +1,48 @@
+package testsupport
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	srv := Start(t, WithEnv("LOG_FORMAT", "text"))
+
+	resp := srv.Get("/pebbles").Query("sort", "name").Do(t)
+	resp.ExpectStatus(t, http.StatusOK)
+	resp.ExpectGolden(t, "list_pebbles", "items.*.id", "items.*.created_at", "items.*.updated_at", "page.next_cursor")
+
+	resp = srv.Post("/pebbles").JSON(map[string]any{"name": "Flint", "color": "grey", "weight_grams": 12}).Do(t)
+	resp.ExpectStatus(t, http.StatusCreated)
+	var created struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	resp.Decode(t, &created)
+	if created.ID == "" || created.Name != "Flint" {
+		t.Fatalf("got %+v, want the pebble created", created)
+	}
+	resp = srv.Get("/pebbles/" + created.ID).Do(t)
+	resp.ExpectStatus(t, http.StatusOK)
+	resp.ExpectGolden(t, "get_pebble", "id", "created_at", "updated_at")
+
+	srv.Get("/pebbles").Anonymous().Do(t).ExpectStatus(t, http.StatusUnauthorized)
+	srv.Get("/pebbles").APIKey("not-a-key").Do(t).ExpectStatus(t, http.StatusUnauthorized)
+	srv.Post("/pebbles").Body("application/json", []byte(`{"name":`)).Do(t).ExpectStatus(t, http.StatusBadRequest)
+	srv.Delete("/pebbles/"+created.ID).Do(t).ExpectStatus(t, http.StatusPreconditionRequired)
+	srv.Delete("/pebbles/"+created.ID).Header("If-Match", resp.Header.Get("ETag")).Do(t).ExpectStatus(t, http.StatusNoContent)
+	srv.Get("/pebbles/"+created.ID).Do(t).ExpectStatus(t, http.StatusNotFound)
+
+	if out := srv.Output(); !strings.Contains(out, "/pebbles") {
+		t.Errorf("the server logged no requests:\n%s", out)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	// A server that cannot start fails the test with what it logged.
+	r := record(t, func(tb testing.TB) { Start(tb, WithConfig("{")) })
+	if !r.fatal || len(r.failures) != 1 || !strings.Contains(r.failures[0], "the server exited before it was ready") || !strings.Contains(r.failures[0], "server output:") {
+		t.Errorf("got failures %q for a server with a broken config file", r.failures)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// certReloader serves a certificate loaded from disk and replaces it when
+// the certificate or key file changes, so rotated certificates are picked
+// up without restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert    atomic.Pointer[tls.Certificate]
+	version string
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.version, _ = r.fileVersion()
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load certificate: %w", err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// fileVersion returns a string that changes whenever either file is
+// modified or replaced.
+func (r *certReloader) fileVersion() (string, error) {
+	var version string
+	for _, p := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%d:%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	return version, nil
+}
+
+// watch polls the certificate files every interval until ctx is done. A
+// certificate that fails to load is logged and the previous one is kept.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		version, err := r.fileVersion()
+		if err != nil || version == r.version {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			logger.Error("cannot reload certificate", "error", err)
+			continue
+		}
+		r.version = version
+		logger.Info("reloaded certificate", "cert_file", r.certFile)
+	}
+}
+
+// redirectHandler sends clients to the same URL over HTTPS on tlsPort.
+func redirectHandler(tlsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
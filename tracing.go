@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind says what a span represents, using the OpenTelemetry values.
+type SpanKind int
+
+const (
+	SpanInternal SpanKind = 1
+	SpanServer   SpanKind = 2
+	SpanClient   SpanKind = 3
+)
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+	// TraceState is the tracestate header received with the trace, which
+	// is exported with its spans.
+	TraceState string
+}
+
+func (sc SpanContext) valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// parseTraceparent parses a W3C traceparent header value. Versions other
+// than 00 are read as 00, as the specification asks.
+func parseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.valid()
+}
+
+// Span is an operation being traced. Its methods are safe to call on a
+// nil span, which is what StartSpan returns when tracing is off.
+type Span struct {
+	tracer *Tracer
+	Name   string
+	Kind   SpanKind
+	SpanContext
+	Parent [8]byte
+	Start  time.Time
+
+	mu        sync.Mutex
+	end       time.Time
+	attrs     map[string]any
+	errorDesc string
+	failed    bool
+}
+
+// SetAttr records an attribute of the span. Values should be strings,
+// bools, ints or float64s.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]any)
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(description string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.errorDesc = description
+}
+
+// End finishes the span and, if it is sampled, queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.Sampled {
+		s.tracer.exporter.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+type remoteSpanKey struct{}
+
+// contextWithRemoteSpan records that the parent of the spans started from
+// ctx is sc, which was received from another process.
+func contextWithRemoteSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanKey{}, sc)
+}
+
+// Tracer starts spans and hands the sampled ones to an exporter.
+type Tracer struct {
+	exporter *otlpExporter
+	// ratio of root spans that are sampled; spans with a parent follow
+	// its decision.
+	ratio float64
+}
+
+func NewTracer(exporter *otlpExporter, ratio float64) *Tracer {
+	return &Tracer{exporter: exporter, ratio: ratio}
+}
+
+// StartSpan starts a span that is a child of the span in ctx, or of the
+// remote parent recorded by contextWithRemoteSpan, and returns a context
+// holding it. A nil tracer returns ctx and a nil span.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, Name: name, Kind: kind, Start: time.Now()}
+	parent, ok := SpanContext{}, false
+	if p := SpanFromContext(ctx); p != nil {
+		parent, ok = p.SpanContext, true
+	} else if p, found := ctx.Value(remoteSpanKey{}).(SpanContext); found {
+		parent, ok = p, true
+	}
+	if ok {
+		s.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+		s.Sampled = parent.Sampled
+		s.TraceState = parent.TraceState
+	} else {
+		rand.Read(s.TraceID[:])
+		// The low 8 bytes of the trace ID are random, so they can decide
+		// sampling consistently for all spans of a trace.
+		s.Sampled = float64(binary.BigEndian.Uint64(s.TraceID[8:])>>11)/(1<<53) < t.ratio
+	}
+	rand.Read(s.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Trace starts a server span for each request, continuing the trace of
+// the client if the request carries a traceparent header. name returns
+// the span name for a request. It should run outside Logging so that the
+// request log line carries the trace ID.
+func Trace(t *Tracer, name func(*http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if sc, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+				sc.TraceState = r.Header.Get("tracestate")
+				ctx = contextWithRemoteSpan(ctx, sc)
+			}
+			ctx, span := t.StartSpan(ctx, name(r), SpanServer)
+			defer span.End()
+			span.SetAttr("http.request.method", r.Method)
+			span.SetAttr("url.path", r.URL.Path)
+			span.SetAttr("user_agent.original", r.UserAgent())
+
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+			span.SetAttr("http.response.status_code", rw.status)
+			if rw.status >= 500 {
+				span.SetError(http.StatusText(rw.status))
+			}
+		})
+	}
+}
+
+// routeSpanName names spans after the route pattern, such as
+// "GET /pebbles/{id}", so that requests for different IDs group together.
+func routeSpanName(routes routeMatcher) func(*http.Request) string {
+	return func(r *http.Request) string {
+		if _, pattern := routes.Handler(r); pattern != "" {
+			return pattern
+		}
+		return r.Method
+	}
+}
+
+// tracingStore records a client span for every call to the wrapped store.
+type tracingStore struct {
+	Store
+	tracer  *Tracer
+	backend string
+}
+
+func (s tracingStore) span(ctx context.Context, op string) (context.Context, *Span) {
+	ctx, span := s.tracer.StartSpan(ctx, "store."+op, SpanClient)
+	span.SetAttr("db.system", s.backend)
+	span.SetAttr("db.operation", op)
+	return ctx, span
+}
+
+// end finishes span, marking it failed if err is an unexpected error.
+// Missing and conflicting records are answers, not failures.
+func (s tracingStore) end(span *Span, err error) {
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrConflict) && !errors.Is(err, ErrStale) {
+		span.SetError(err.Error())
+	}
+	span.End()
+}
+
+func (s tracingStore) List(ctx context.Context, q ListQuery) ([]Pebble, error) {
+	ctx, span := s.span(ctx, "List")
+	pebbles, err := s.Store.List(ctx, q)
+	s.end(span, err)
+	return pebbles, err
+}
+
+func (s tracingStore) Search(ctx context.Context, q SearchQuery) ([]SearchHit, error) {
+	ctx, span := s.span(ctx, "Search")
+	hits, err := s.Store.Search(ctx, q)
+	s.end(span, err)
+	return hits, err
+}
+
+func (s tracingStore) Get(ctx context.Context, id string) (Pebble, error) {
+	ctx, span := s.span(ctx, "Get")
+	p, err := s.Store.Get(ctx, id)
+	s.end(span, err)
+	return p, err
+}
+
+func (s tracingStore) Create(ctx context.Context, p Pebble) error {
+	ctx, span := s.span(ctx, "Create")
+	err := s.Store.Create(ctx, p)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) Update(ctx context.Context, p Pebble, prev time.Time) error {
+	ctx, span := s.span(ctx, "Update")
+	err := s.Store.Update(ctx, p, prev)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) Delete(ctx context.Context, id string, at time.Time) error {
+	ctx, span := s.span(ctx, "Delete")
+	err := s.Store.Delete(ctx, id, at)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) Restore(ctx context.Context, id string) error {
+	ctx, span := s.span(ctx, "Restore")
+	err := s.Store.Restore(ctx, id)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, span := s.span(ctx, "Transact")
+	err := s.Store.Transact(ctx, fn)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) Purge(ctx context.Context, before time.Time) ([]string, error) {
+	ctx, span := s.span(ctx, "Purge")
+	ids, err := s.Store.Purge(ctx, before)
+	s.end(span, err)
+	return ids, err
+}
+
+func (s tracingStore) CreateAPIKey(ctx context.Context, k APIKey) error {
+	ctx, span := s.span(ctx, "CreateAPIKey")
+	err := s.Store.CreateAPIKey(ctx, k)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, span := s.span(ctx, "ListAPIKeys")
+	keys, err := s.Store.ListAPIKeys(ctx)
+	s.end(span, err)
+	return keys, err
+}
+
+func (s tracingStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	ctx, span := s.span(ctx, "GetAPIKey")
+	k, err := s.Store.GetAPIKey(ctx, id)
+	s.end(span, err)
+	return k, err
+}
+
+func (s tracingStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	ctx, span := s.span(ctx, "GetAPIKeyByHash")
+	k, err := s.Store.GetAPIKeyByHash(ctx, hash)
+	s.end(span, err)
+	return k, err
+}
+
+func (s tracingStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	ctx, span := s.span(ctx, "RevokeAPIKey")
+	err := s.Store.RevokeAPIKey(ctx, id, at)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) CreateWebhook(ctx context.Context, w Webhook) error {
+	ctx, span := s.span(ctx, "CreateWebhook")
+	err := s.Store.CreateWebhook(ctx, w)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	ctx, span := s.span(ctx, "ListWebhooks")
+	hooks, err := s.Store.ListWebhooks(ctx)
+	s.end(span, err)
+	return hooks, err
+}
+
+func (s tracingStore) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	ctx, span := s.span(ctx, "GetWebhook")
+	w, err := s.Store.GetWebhook(ctx, id)
+	s.end(span, err)
+	return w, err
+}
+
+func (s tracingStore) DeleteWebhook(ctx context.Context, id string) error {
+	ctx, span := s.span(ctx, "DeleteWebhook")
+	err := s.Store.DeleteWebhook(ctx, id)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) SaveWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	ctx, span := s.span(ctx, "SaveWebhookDelivery")
+	err := s.Store.SaveWebhookDelivery(ctx, d)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) ListWebhookDeliveries(ctx context.Context, webhookID, status string, limit int) ([]WebhookDelivery, error) {
+	ctx, span := s.span(ctx, "ListWebhookDeliveries")
+	list, err := s.Store.ListWebhookDeliveries(ctx, webhookID, status, limit)
+	s.end(span, err)
+	return list, err
+}
+
+func (s tracingStore) AppendAuditEntry(ctx context.Context, e AuditEntry) error {
+	ctx, span := s.span(ctx, "AppendAuditEntry")
+	err := s.Store.AppendAuditEntry(ctx, e)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) ListAuditEntries(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	ctx, span := s.span(ctx, "ListAuditEntries")
+	list, err := s.Store.ListAuditEntries(ctx, q)
+	s.end(span, err)
+	return list, err
+}
+
+func (s tracingStore) CreateAttachment(ctx context.Context, a Attachment) error {
+	ctx, span := s.span(ctx, "CreateAttachment")
+	err := s.Store.CreateAttachment(ctx, a)
+	s.end(span, err)
+	return err
+}
+
+func (s tracingStore) ListAttachments(ctx context.Context, pebbleIDs ...string) ([]Attachment, error) {
+	ctx, span := s.span(ctx, "ListAttachments")
+	list, err := s.Store.ListAttachments(ctx, pebbleIDs...)
+	s.end(span, err)
+	return list, err
+}
+
+func (s tracingStore) GetAttachment(ctx context.Context, id string) (Attachment, error) {
+	ctx, span := s.span(ctx, "GetAttachment")
+	a, err := s.Store.GetAttachment(ctx, id)
+	s.end(span, err)
+	return a, err
+}
+
+func (s tracingStore) DeleteAttachment(ctx context.Context, id string) error {
+	ctx, span := s.span(ctx, "DeleteAttachment")
+	err := s.Store.DeleteAttachment(ctx, id)
+	s.end(span, err)
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// parseUUID checks that s is a UUID in the 8-4-4-4-12 hex form and returns
+// it in lower case.
+func parseUUID(s string) (string, error) {
+	if len(s) != 36 {
+		return "", fmt.Errorf("invalid UUID %q", s)
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return "", fmt.Errorf("invalid UUID %q", s)
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return "", fmt.Errorf("invalid UUID %q", s)
+			}
+		}
+	}
+	return strings.ToLower(s), nil
+}
+
+// nameUUID returns the name-based (version 5) UUID of name in the
+// namespace with UUID namespace, which is the same every time.
+func nameUUID(namespace, name string) string {
+	ns, _ := hex.DecodeString(strings.ReplaceAll(namespace, "-", ""))
+	h := sha1.Sum(append(ns, name...))
+	b := h[:16]
+	b[6] = b[6]&0x0f | 0x50
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
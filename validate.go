@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const CodeValidation = "validation_failed"
+
+// FieldError is a problem with one field of a request body. Field is the
+// JSON name of the field, with nested fields separated by dots.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every problem found in a request body.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// apiError reports the problems to the client as a 422 response.
+func (v ValidationErrors) apiError() *APIError {
+	e := NewAPIError(http.StatusUnprocessableEntity, CodeValidation, "validation failed")
+	e.Details = v
+	return e
+}
+
+// Bind decodes the request body into v in the format its Content-Type
+// names, JSON if it names none Negotiate allows, rejecting unknown fields
+// unless BodyPolicy allows them for the route, and then validates it.
+// Malformed bodies give a 400 error, listing the members of the wrong type
+// or unknown by their path, bodies over the limit set by BodyPolicy a 413
+// error and invalid ones a 422 error listing the fields at fault.
+func Bind(r *http.Request, v any) error {
+	if err := requestCodec(r).decodeBody(r.Body, v, requestDecodeRules(r)); err != nil {
+		return bodyError(err)
+	}
+	if errs := Validate(v); errs != nil {
+		return errs.apiError()
+	}
+	return nil
+}
+
+// Validate checks the fields of the struct v, or pointer to one, against
+// the rules in their validate tags, for example
+//
+//	Name string `json:"name" validate:"required,max=100"`
+//
+// The rules are required, min=n and max=n (characters for strings, items
+// for slices and maps, and the value for numbers), email, uuid and
+// oneof=a b c. Nil pointer fields are only checked for required, so they
+// suit partial updates. Validate returns nil if there are no problems.
+func Validate(v any) ValidationErrors {
+	var errs ValidationErrors
+	validateStruct(reflect.Indirect(reflect.ValueOf(v)), "", &errs)
+	return errs
+}
+
+func validateStruct(v reflect.Value, prefix string, errs *ValidationErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		name := jsonFieldName(f)
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			validateStruct(fv, prefix, errs)
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		for _, rule := range parseRules(f.Tag.Get("validate")) {
+			if msg := rule.check(fv); msg != "" {
+				*errs = append(*errs, FieldError{Field: name, Message: msg})
+				break
+			}
+		}
+		for fv.Kind() == reflect.Pointer && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && fv.Type() != timeType {
+			validateStruct(fv, name, errs)
+		}
+	}
+}
+
+func jsonFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+type rule struct {
+	name string
+	arg  string
+}
+
+func parseRules(tag string) []rule {
+	var rules []rule
+	for _, part := range strings.Split(tag, ",") {
+		if part == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(part, "=")
+		rules = append(rules, rule{name: name, arg: arg})
+	}
+	return rules
+}
+
+// check returns a message describing how v breaks the rule, or "" if it
+// does not.
+func (r rule) check(v reflect.Value) string {
+	if r.name == "required" {
+		if v.IsZero() {
+			return "is required"
+		}
+		return ""
+	}
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch r.name {
+	case "min", "max":
+		n, err := strconv.ParseFloat(r.arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("validate: bad %s argument %q", r.name, r.arg))
+		}
+		size, unit := measure(v)
+		if unit != "" && n != 1 {
+			unit += "s"
+		}
+		if r.name == "min" && size < n {
+			return fmt.Sprintf("must be at least %s%s", r.arg, unit)
+		}
+		if r.name == "max" && size > n {
+			return fmt.Sprintf("must be at most %s%s", r.arg, unit)
+		}
+	case "email":
+		if s := v.String(); s != "" {
+			if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+				return "must be an email address"
+			}
+		}
+	case "uuid":
+		if s := v.String(); s != "" {
+			if _, err := parseUUID(s); err != nil {
+				return "must be a UUID"
+			}
+		}
+	case "oneof":
+		options := strings.Fields(r.arg)
+		if s := fmt.Sprint(v.Interface()); !slices.Contains(options, s) {
+			return "must be one of " + strings.Join(options, ", ")
+		}
+	default:
+		panic("validate: unknown rule " + r.name)
+	}
+	return ""
+}
+
+// measure returns the quantity min and max compare against for v, and
+// the unit to name in messages.
+func measure(v reflect.Value) (float64, string) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), " character"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), " item"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), ""
+	}
+	panic("validate: min and max do not apply to " + v.Type().String())
+}
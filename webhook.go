@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webhookSignatureHeader = "Pebble-Signature"
+	webhookEventHeader     = "Pebble-Event"
+	webhookDeliveryHeader  = "Pebble-Delivery"
+
+	jobWebhookDispatch = "webhook.dispatch"
+	jobWebhookDeliver  = "webhook.deliver"
+)
+
+// Delivery statuses. A delivery is dead once it has failed as many times as
+// it may.
+const (
+	DeliveryPending   = "pending"
+	DeliveryRetrying  = "retrying"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+// webhookEvents are the event types webhooks can subscribe to.
+var webhookEvents = []string{EventPebbleCreated, EventPebbleUpdated, EventPebbleDeleted, EventPebbleRestored}
+
+// Webhook is a URL that is sent the events it subscribes to. Unlike an API
+// key, the secret is kept as is, since it is needed to sign deliveries; it
+// is shown once when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery records sending one event to one webhook. Attempts,
+// ResponseStatus and Error describe the latest attempt.
+type WebhookDelivery struct {
+	ID             string    `json:"id"`
+	WebhookID      string    `json:"webhook_id"`
+	EventID        uint64    `json:"event_id"`
+	EventType      string    `json:"event_type"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	ResponseStatus int       `json:"response_status,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// WebhookStore persists webhooks and their deliveries. GetWebhook and
+// DeleteWebhook return ErrNotFound for unknown webhooks, and deleting a
+// webhook deletes its deliveries. SaveWebhookDelivery creates or replaces
+// a delivery. ListWebhookDeliveries returns the newest deliveries first,
+// only those with the given status unless it is empty.
+type WebhookStore interface {
+	CreateWebhook(ctx context.Context, w Webhook) error
+	ListWebhooks(ctx context.Context) ([]Webhook, error)
+	GetWebhook(ctx context.Context, id string) (Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	SaveWebhookDelivery(ctx context.Context, d WebhookDelivery) error
+	ListWebhookDeliveries(ctx context.Context, webhookID, status string, limit int) ([]WebhookDelivery, error)
+}
+
+// Webhooks delivers events to the registered webhooks on the job queue.
+// Every event is first fanned out to the subscribed webhooks by a dispatch
+// job, and each delivery is then a job of its own, retried with the
+// queue's backoff until it succeeds or has been attempted the configured
+// number of times, after which it is dead.
+type Webhooks struct {
+	store    WebhookStore
+	jobs     *JobQueue
+	client   *http.Client
+	breakers *Breakers
+	retry    RetryPolicy
+	clock    Clock
+	logger   *slog.Logger
+}
+
+// webhookJob is the payload of a delivery job.
+type webhookJob struct {
+	Delivery WebhookDelivery `json:"delivery"`
+	Event    Event           `json:"event"`
+}
+
+// NewWebhooks returns the webhook deliverer and registers its job types
+// with jobs. Each attempt at a delivery is guarded by the breaker in
+// breakers of the endpoint's host, and sent again as retry says. Deliveries
+// are stamped and signed with the time of clock.
+func NewWebhooks(cfg WebhooksConfig, store WebhookStore, jobs *JobQueue, breakers *Breakers, retry RetryPolicy, clock Clock, logger *slog.Logger) *Webhooks {
+	wh := &Webhooks{
+		store:    store,
+		jobs:     jobs,
+		breakers: breakers,
+		retry:    retry,
+		clock:    clock,
+		client: &http.Client{
+			Timeout: cfg.Timeout.Duration,
+			// A redirect counts as a failure, so that endpoints are not
+			// sent somewhere they did not register.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		logger: logger,
+	}
+	jobs.Register(jobWebhookDispatch, wh.dispatch)
+	jobs.RegisterAttempts(jobWebhookDeliver, wh.deliver, cfg.MaxAttempts)
+	return wh
+}
+
+// Publish queues e for delivery to the webhooks subscribed to it.
+func (wh *Webhooks) Publish(ctx context.Context, e Event) error {
+	_, err := wh.jobs.Enqueue(ctx, jobWebhookDispatch, e)
+	return err
+}
+
+func (wh *Webhooks) dispatch(ctx context.Context, job Job) error {
+	var e Event
+	if err := json.Unmarshal(job.Payload, &e); err != nil {
+		return Permanent(err)
+	}
+	hooks, err := wh.store.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if !slices.Contains(hook.Events, e.Type) {
+			continue
+		}
+		now := wh.clock.Now().UTC()
+		d := WebhookDelivery{
+			ID:        newUUID(),
+			WebhookID: hook.ID,
+			EventID:   e.ID,
+			EventType: e.Type,
+			Status:    DeliveryPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		// Saved before the job is queued, so that it cannot overwrite the
+		// outcome of the first attempt.
+		wh.save(ctx, d)
+		if _, err := wh.jobs.Enqueue(ctx, jobWebhookDeliver, webhookJob{Delivery: d, Event: e}); err != nil {
+			// Not returned, since retrying the dispatch would deliver the
+			// event again to the webhooks already queued.
+			d.Status, d.Error = DeliveryDead, err.Error()
+			wh.save(ctx, d)
+		}
+	}
+	return nil
+}
+
+func (wh *Webhooks) deliver(ctx context.Context, job Job) error {
+	var p webhookJob
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return Permanent(err)
+	}
+	d := p.Delivery
+	hook, err := wh.store.GetWebhook(ctx, d.WebhookID)
+	if errors.Is(err, ErrNotFound) {
+		return Permanent(errors.New("webhook has been deleted"))
+	}
+	if err != nil {
+		return err
+	}
+	d.ResponseStatus, err = wh.post(ctx, hook, d.ID, p.Event)
+	d.Attempts = job.Attempt
+	d.UpdatedAt = wh.clock.Now().UTC()
+	d.Status, d.Error = DeliverySucceeded, ""
+	if err != nil {
+		d.Status, d.Error = DeliveryRetrying, err.Error()
+		var perm permanentError
+		if job.Attempt >= job.MaxAttempts || errors.As(err, &perm) {
+			d.Status = DeliveryDead
+		}
+	}
+	wh.save(ctx, d)
+	return err
+}
+
+// save stores d, logging rather than returning errors so that a storage
+// problem does not make the event be delivered again.
+func (wh *Webhooks) save(ctx context.Context, d WebhookDelivery) {
+	if err := wh.store.SaveWebhookDelivery(ctx, d); err != nil {
+		wh.logger.Error("cannot save webhook delivery", "delivery_id", d.ID, "webhook_id", d.WebhookID, "error", err)
+	}
+}
+
+// post sends e to hook and returns the response status. Any status other
+// than 2xx is an error. Failing to reach the endpoint, and 429 and 5xx
+// responses, count against the breaker of its host and are retried.
+func (wh *Webhooks) post(ctx context.Context, hook Webhook, deliveryID string, e Event) (int, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, Permanent(err)
+	}
+	target := hook.URL
+	if u, err := url.Parse(hook.URL); err == nil {
+		target = u.Host
+	}
+	breaker := wh.breakers.Get("webhook:" + target)
+	var status int
+	failed := func(error) bool {
+		return status == 0 || status == http.StatusTooManyRequests || status >= 500
+	}
+	err = wh.retry.Do(ctx, failed, func(int) error {
+		return breaker.Do(func() (bool, error) {
+			var err error
+			status, err = wh.send(ctx, hook, deliveryID, e.Type, body)
+			return err != nil && failed(err), err
+		})
+	})
+	return status, err
+}
+
+// send makes one attempt at posting body to hook.
+func (wh *Webhooks) send(ctx context.Context, hook Webhook, deliveryID, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pebble-api-webhooks/"+buildInfo().Version)
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookDeliveryHeader, deliveryID)
+	req.Header.Set(webhookSignatureHeader, signWebhook(hook.Secret, wh.clock.Now(), body))
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the signature header for body sent at t: the Unix
+// time and the hex HMAC-SHA256 of "<time>.<body>" keyed with secret.
+// Signing the time lets receivers reject old deliveries that are replayed.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + webhookMAC(secret, ts+".", body)
+}
+
+// webhookMAC returns the hex HMAC-SHA256 of prefix and body keyed with
+// secret.
+func webhookMAC(secret, prefix string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(prefix))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generateWebhookSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// webhooksAPI serves the endpoints for registering webhooks and inspecting
+// their deliveries.
+type webhooksAPI struct {
+	store WebhookStore
+	clock Clock
+}
+
+// register adds the webhook resource routes to rt, which is given one
+// version of the API.
+func (api *webhooksAPI) register(rt *Router) {
+	rt.Get("/webhooks", api.list)
+	rt.Post("/webhooks", api.create)
+	rt.Delete("/webhooks/{id}", api.delete)
+
+	rt.Document("GET", "/webhooks", Operation{Summary: "List webhooks", Tag: "webhooks", Response: listResponse[Webhook]{}})
+	rt.Document("POST", "/webhooks", Operation{Summary: "Register a webhook", Tag: "webhooks", Request: createWebhookRequest{}, Response: createWebhookResponse{}, Status: http.StatusCreated})
+	rt.Document("DELETE", "/webhooks/{id}", Operation{Summary: "Delete a webhook", Tag: "webhooks", Status: http.StatusNoContent})
+}
+
+// registerAdmin adds the unversioned admin routes to rt.
+func (api *webhooksAPI) registerAdmin(rt *Router) {
+	rt.Get("/admin/webhooks/{id}/deliveries", api.deliveries)
+	rt.Document("GET", "/admin/webhooks/{id}/deliveries", Operation{Summary: "List the deliveries of a webhook", Tag: "admin", Response: listResponse[WebhookDelivery]{}})
+}
+
+func (api *webhooksAPI) list(w http.ResponseWriter, r *http.Request) error {
+	hooks, err := api.store.ListWebhooks(r.Context())
+	if err != nil {
+		return Internal(err)
+	}
+	respond(w, r, http.StatusOK, listResponse[Webhook]{Items: hooks})
+	return nil
+}
+
+type createWebhookRequest struct {
+	URL    string   `json:"url" validate:"required,max=2000"`
+	Events []string `json:"events" validate:"min=1"`
+}
+
+type createWebhookResponse struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+func (api *webhooksAPI) create(w http.ResponseWriter, r *http.Request) error {
+	var in createWebhookRequest
+	if err := Bind(r, &in); err != nil {
+		return err
+	}
+	var errs ValidationErrors
+	if u, err := url.Parse(in.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, FieldError{Field: "url", Message: "must be an http or https URL"})
+	}
+	for _, e := range in.Events {
+		if !slices.Contains(webhookEvents, e) {
+			errs = append(errs, FieldError{Field: "events", Message: fmt.Sprintf("%q is not one of %s", e, strings.Join(webhookEvents, ", "))})
+		}
+	}
+	if errs != nil {
+		return errs.apiError()
+	}
+	hook := Webhook{
+		ID:        newUUID(),
+		URL:       in.URL,
+		Events:    slices.Compact(slices.Sorted(slices.Values(in.Events))),
+		Secret:    generateWebhookSecret(),
+		CreatedAt: api.clock.Now().UTC(),
+	}
+	if err := api.store.CreateWebhook(r.Context(), hook); err != nil {
+		return Internal(err)
+	}
+	respond(w, r, http.StatusCreated, createWebhookResponse{Webhook: hook, Secret: hook.Secret})
+	return nil
+}
+
+func (api *webhooksAPI) delete(w http.ResponseWriter, r *http.Request) error {
+	id, err := PathUUID(r, "id")
+	if err != nil {
+		return err
+	}
+	err = api.store.DeleteWebhook(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		return NotFound("webhook not found")
+	}
+	if err != nil {
+		return Internal(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// deliveries lists the deliveries of a webhook, newest first. ?status
+// selects the deliveries with that status and ?limit caps their number.
+func (api *webhooksAPI) deliveries(w http.ResponseWriter, r *http.Request) error {
+	id, err := PathUUID(r, "id")
+	if err != nil {
+		return err
+	}
+	status, limit := "", 50
+	var errs ValidationErrors
+	for name, vs := range r.URL.Query() {
+		switch v := vs[0]; name {
+		case "status":
+			options := []string{DeliveryPending, DeliveryRetrying, DeliverySucceeded, DeliveryDead}
+			if !slices.Contains(options, v) {
+				errs = append(errs, FieldError{Field: "status", Message: "must be one of " + strings.Join(options, ", ")})
+			}
+			status = v
+		case "limit":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 500 {
+				errs = append(errs, FieldError{Field: "limit", Message: "must be a number from 1 to 500"})
+			}
+			limit = n
+		default:
+			errs = append(errs, FieldError{Field: name, Message: "is not a known parameter"})
+		}
+	}
+	if errs != nil {
+		return Invalid(errs, "invalid list parameters")
+	}
+	if _, err := api.store.GetWebhook(r.Context(), id); errors.Is(err, ErrNotFound) {
+		return NotFound("webhook not found")
+	} else if err != nil {
+		return Internal(err)
+	}
+	list, err := api.store.ListWebhookDeliveries(r.Context(), id, status, limit)
+	if err != nil {
+		return Internal(err)
+	}
+	respond(w, r, http.StatusOK, listResponse[WebhookDelivery]{Items: list})
+	return nil
+}
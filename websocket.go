@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal server side of the WebSocket protocol (RFC 6455), enough to
+// push events to clients: no extensions, and client data messages are
+// read but ignored.
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsClosePolicy      = 1008
+	wsCloseTooBig      = 1009
+	wsMaxMessageBytes  = 64 << 10
+	wsPingInterval     = 30 * time.Second
+	wsPongWait         = 2 * wsPingInterval
+	wsWriteWait        = 10 * time.Second
+	wsSendBuffer       = 64
+	wsHandshakeGUID    = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsSupportedVersion = "13"
+)
+
+var errWSClosed = errors.New("websocket: connection closed")
+
+// headerHasToken reports whether the comma-separated header contains
+// token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu sync.Mutex
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection. If the request is not a valid handshake it writes an error
+// response and returns an error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !isWebSocketUpgrade(r) {
+		w.Header().Set("Upgrade", "websocket")
+		err := NewAPIError(http.StatusUpgradeRequired, CodeInvalid, "this endpoint requires a WebSocket upgrade")
+		WriteError(w, r, err)
+		return nil, err
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != wsSupportedVersion {
+		w.Header().Set("Sec-WebSocket-Version", wsSupportedVersion)
+		err := NewAPIError(http.StatusUpgradeRequired, CodeInvalid, "unsupported WebSocket version")
+		WriteError(w, r, err)
+		return nil, err
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		err := Invalid(nil, "invalid Sec-WebSocket-Key")
+		WriteError(w, r, err)
+		return nil, err
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		WriteError(w, r, Internal(err))
+		return nil, err
+	}
+	// Drop the deadlines the server set for the HTTP request.
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsHandshakeGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// writeFrame sends a single unfragmented frame. Server frames are not
+// masked.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeFrame(wsOpClose, append(payload, reason...))
+}
+
+// readFrame reads one frame from the client, unmasking its payload.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.br, h[:]); err != nil {
+		return
+	}
+	fin = h[0]&0x80 != 0
+	op = h[0] & 0x0F
+	if h[0]&0x70 != 0 {
+		return fin, op, nil, wsProtocolError("reserved bits set")
+	}
+	if op > 0x2 && op < wsOpClose || op > wsOpPong {
+		return fin, op, nil, wsProtocolError("reserved opcode")
+	}
+	if h[1]&0x80 == 0 {
+		return fin, op, nil, wsProtocolError("client frames must be masked")
+	}
+	n := uint64(h[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (n > 125 || !fin) {
+		return fin, op, nil, wsProtocolError("invalid control frame")
+	}
+	if n > wsMaxMessageBytes {
+		return fin, op, nil, errWSTooBig
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+type wsProtocolError string
+
+func (e wsProtocolError) Error() string { return "websocket: " + string(e) }
+
+var errWSTooBig = errors.New("websocket: message too big")
+
+// readLoop handles the frames sent by the client until the connection
+// fails or the client closes it: pings are answered, and every frame
+// extends the read deadline that keepalive pings rely on.
+func (c *wsConn) readLoop() error {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		_, op, payload, err := c.readFrame()
+		var protoErr wsProtocolError
+		switch {
+		case errors.As(err, &protoErr):
+			c.writeClose(wsCloseProtocol, protoErr.Error())
+			return err
+		case errors.Is(err, errWSTooBig):
+			c.writeClose(wsCloseTooBig, "message too big")
+			return err
+		case err != nil:
+			return err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		case wsOpClose:
+			if len(payload) == 1 || len(payload) >= 2 && !validWSCloseCode(binary.BigEndian.Uint16(payload)) {
+				err := wsProtocolError("invalid close code")
+				c.writeClose(wsCloseProtocol, err.Error())
+				return err
+			}
+			// Echo the status code, as the protocol asks.
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsOpClose, payload)
+			return errWSClosed
+		}
+	}
+}
+
+// validWSCloseCode reports whether a client may close with code: one that
+// RFC 6455 defines for sending, or one for libraries or applications.
+// Those meant only for reporting, such as 1006, may not be sent.
+func validWSCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// WebSocketHandler streams hub events as JSON text messages. Requests whose
+// Origin header is present must either match the Host or be accepted by
+// allowOrigin, so other sites cannot open connections with a user's
+// credentials.
+func WebSocketHandler(hub *Hub, allowOrigin func(string) bool, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r.Host) && !allowOrigin(origin) {
+			WriteError(w, r, Forbidden("origin %q is not allowed", origin))
+			return
+		}
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.conn.Close()
+
+		sub := hub.Subscribe(wsSendBuffer)
+		defer sub.Close()
+
+		readDone := make(chan error, 1)
+		go func() { readDone <- ws.readLoop() }()
+
+		ping := time.NewTicker(wsPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					if sub.Lagged() {
+						ws.writeClose(wsClosePolicy, "client too slow")
+					} else {
+						ws.writeClose(wsCloseGoingAway, "server shutting down")
+					}
+					return
+				}
+				if !tenantSees(r.Context(), e) {
+					continue
+				}
+				b, _ := json.Marshal(e)
+				if err := ws.writeFrame(wsOpText, b); err != nil {
+					logger.DebugContext(r.Context(), "websocket write failed", "error", err)
+					return
+				}
+			case <-ping.C:
+				if err := ws.writeFrame(wsOpPing, nil); err != nil {
+					return
+				}
+			case err := <-readDone:
+				if !errors.Is(err, errWSClosed) {
+					logger.DebugContext(r.Context(), "websocket closed", "error", err)
+				}
+				return
+			}
+		}
+	})
+}
+
+// sameOrigin reports whether origin, such as https://example.com:8443,
+// names host.
+func sameOrigin(origin, host string) bool {
+	_, rest, ok := strings.Cut(origin, "://")
+	return ok && strings.EqualFold(rest, host)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// wsFrame returns a client frame with the first byte b0 and payload,
+// masked unless unmasked is set. length, if not negative, is put in the
+// header instead of the payload's length.
+func wsFrame(b0 byte, payload []byte, unmasked bool, length int64) []byte {
+	n := int64(len(payload))
+	if length >= 0 {
+		n = length
+	}
+	mask := byte(0x80)
+	if unmasked {
+		mask = 0
+	}
+	var f []byte
+	switch {
+	case n < 126:
+		f = []byte{b0, mask | byte(n)}
+	case n <= 0xFFFF:
+		f = binary.BigEndian.AppendUint16([]byte{b0, mask | 126}, uint16(n))
+	default:
+		f = binary.BigEndian.AppendUint64([]byte{b0, mask | 127}, uint64(n))
+	}
+	if unmasked {
+		return append(f, payload...)
+	}
+	key := []byte{0x37, 0xfa, 0x21, 0x3d}
+	f = append(f, key...)
+	for i, b := range payload {
+		f = append(f, b^key[i%4])
+	}
+	return f
+}
+
+func TestWSReadFrame(t *testing.T) {
+	hello := []byte("Hello")
+	big := bytes.Repeat([]byte("a"), 300)
+	tests := []struct {
+		name    string
+		frame   []byte
+		fin     bool
+		op      byte
+		payload []byte
+		err     error
+	}{
+		{name: "text", frame: wsFrame(0x80|wsOpText, hello, false, -1), fin: true, op: wsOpText, payload: hello},
+		{name: "first fragment", frame: wsFrame(wsOpText, hello, false, -1), op: wsOpText, payload: hello},
+		{name: "continuation", frame: wsFrame(0x80, hello, false, -1), fin: true, op: 0, payload: hello},
+		{name: "16-bit length", frame: wsFrame(0x80|wsOpText, big, false, -1), fin: true, op: wsOpText, payload: big},
+		{name: "empty ping", frame: wsFrame(0x80|wsOpPing, nil, false, -1), fin: true, op: wsOpPing, payload: []byte{}},
+		{name: "close with a code", frame: wsFrame(0x80|wsOpClose, []byte{0x03, 0xe8, 'b', 'y', 'e'}, false, -1), fin: true, op: wsOpClose, payload: []byte{0x03, 0xe8, 'b', 'y', 'e'}},
+
+		{name: "unmasked", frame: wsFrame(0x80|wsOpText, hello, true, -1), err: wsProtocolError("client frames must be masked")},
+		{name: "reserved bit", frame: wsFrame(0xC0|wsOpText, hello, false, -1), err: wsProtocolError("reserved bits set")},
+		{name: "reserved data opcode", frame: wsFrame(0x83, hello, false, -1), err: wsProtocolError("reserved opcode")},
+		{name: "reserved control opcode", frame: wsFrame(0x8B, hello, false, -1), err: wsProtocolError("reserved opcode")},
+		{name: "fragmented ping", frame: wsFrame(wsOpPing, hello, false, -1), err: wsProtocolError("invalid control frame")},
+		{name: "fragmented close", frame: wsFrame(wsOpClose, []byte{0x03, 0xe8}, false, -1), err: wsProtocolError("invalid control frame")},
+		{name: "control frame over 125 bytes", frame: wsFrame(0x80|wsOpPing, big, false, -1), err: wsProtocolError("invalid control frame")},
+		{name: "over the message limit", frame: wsFrame(0x80|wsOpText, nil, false, wsMaxMessageBytes+1), err: errWSTooBig},
+		{name: "64-bit length", frame: wsFrame(0x80|wsOpText, nil, false, 1<<40), err: errWSTooBig},
+		{name: "length with the top bit set", frame: []byte{0x81, 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 5}, err: errWSTooBig},
+
+		{name: "cut in the header", frame: []byte{0x81}, err: io.ErrUnexpectedEOF},
+		{name: "cut in the length", frame: []byte{0x81, 0x80 | 127, 0, 0}, err: io.ErrUnexpectedEOF},
+		{name: "cut in the mask", frame: wsFrame(0x80|wsOpText, hello, false, -1)[:4], err: io.ErrUnexpectedEOF},
+		{name: "cut in the payload", frame: wsFrame(0x80|wsOpText, hello, false, -1)[:8], err: io.ErrUnexpectedEOF},
+		{name: "no frame", frame: nil, err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &wsConn{br: bufio.NewReader(bytes.NewReader(tt.frame))}
+			fin, op, payload, err := c.readFrame()
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v, want none", err)
+			}
+			if fin != tt.fin || op != tt.op || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("got fin %t, op %#x and %q, want %t, %#x and %q", fin, op, payload, tt.fin, tt.op, tt.payload)
+			}
+		})
+	}
+}
+
+func TestWSReadLoopReplies(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		op    byte
+		reply []byte // the payload of the frame sent back
+		err   error
+	}{
+		{name: "ping", frame: wsFrame(0x80|wsOpPing, []byte("are you there"), false, -1), op: wsOpPong, reply: []byte("are you there")},
+		{name: "close", frame: wsFrame(0x80|wsOpClose, []byte{0x03, 0xe8, 'b', 'y', 'e'}, false, -1), op: wsOpClose, reply: []byte{0x03, 0xe8}, err: errWSClosed},
+		{name: "close without a code", frame: wsFrame(0x80|wsOpClose, nil, false, -1), op: wsOpClose, reply: []byte{}, err: errWSClosed},
+		{name: "close with an application code", frame: wsFrame(0x80|wsOpClose, []byte{0x0f, 0xa0}, false, -1), op: wsOpClose, reply: []byte{0x0f, 0xa0}, err: errWSClosed},
+		{name: "close with half a code", frame: wsFrame(0x80|wsOpClose, []byte{0x03}, false, -1), op: wsOpClose, reply: append([]byte{0x03, 0xea}, "websocket: invalid close code"...), err: wsProtocolError("invalid close code")},
+		{name: "close with a reserved code", frame: wsFrame(0x80|wsOpClose, []byte{0x03, 0xee}, false, -1), op: wsOpClose, reply: append([]byte{0x03, 0xea}, "websocket: invalid close code"...), err: wsProtocolError("invalid close code")},
+		{name: "close with a code below 1000", frame: wsFrame(0x80|wsOpClose, []byte{0x00, 0x01}, false, -1), op: wsOpClose, reply: append([]byte{0x03, 0xea}, "websocket: invalid close code"...), err: wsProtocolError("invalid close code")},
+		{name: "unmasked", frame: wsFrame(0x80|wsOpText, []byte("hi"), true, -1), op: wsOpClose, reply: append([]byte{0x03, 0xea}, "websocket: client frames must be masked"...), err: wsProtocolError("client frames must be masked")},
+		{name: "too big", frame: wsFrame(0x80|wsOpText, nil, false, wsMaxMessageBytes+1), op: wsOpClose, reply: append([]byte{0x03, 0xf1}, "message too big"...), err: errWSTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			c := &wsConn{conn: server, br: bufio.NewReader(server)}
+			done := make(chan error, 1)
+			go func() {
+				done <- c.readLoop()
+				server.Close()
+			}()
+			// The server may stop reading part way through the frame.
+			go client.Write(tt.frame)
+
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var h [2]byte
+			if _, err := io.ReadFull(client, h[:]); err != nil {
+				t.Fatalf("no reply: %v", err)
+			}
+			reply := make([]byte, h[1]&0x7F)
+			if _, err := io.ReadFull(client, reply); err != nil {
+				t.Fatal(err)
+			}
+			if h[0] != 0x80|tt.op || h[1]&0x80 != 0 {
+				t.Errorf("got a reply starting %#x %#x, want an unmasked, final %#x frame", h[0], h[1], tt.op)
+			}
+			if !bytes.Equal(reply, tt.reply) {
+				t.Errorf("got reply %q, want %q", reply, tt.reply)
+			}
+			if tt.err == nil {
+				client.Close()
+				<-done
+				return
+			}
+			if err := <-done; !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
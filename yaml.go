@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// decodeYAML decodes the YAML document data into v through its JSON
+// encoding, as the XML and MessagePack codecs do, so v needs only json
+// tags.
+func decodeYAML(data []byte, v any) error {
+	b, err := yamlToJSON(data)
+	if err != nil {
+		return err
+	}
+	return jsonCodec.Decode(bytes.NewReader(b), v)
+}
+
+// yamlToJSON returns the JSON encoding of the YAML document data. It
+// understands the block subset of YAML that fixture and config files need:
+// nested mappings and sequences, plain and quoted scalars, empty [] and {}
+// collections and comments. Anchors, tags, flow collections with items,
+// multi-line scalars and streams of several documents are not supported.
+func yamlToJSON(data []byte) ([]byte, error) {
+	lines, err := yamlLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	p := &yamlParser{lines: lines}
+	var tree any
+	if len(lines) > 0 {
+		if tree, err = p.block(lines[0].indent); err != nil {
+			return nil, err
+		}
+		if p.pos < len(p.lines) {
+			return nil, p.errorf("unexpected indentation")
+		}
+	}
+	return json.Marshal(tree)
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// yamlLines returns the lines of src that hold something, without their
+// comments and indentation.
+func yamlLines(src string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(src, "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		if i == 0 {
+			raw = strings.TrimPrefix(raw, "\ufeff")
+		}
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs cannot indent", i+1)
+		}
+		text = strings.TrimSpace(stripYAMLComment(text))
+		if text == "---" && len(lines) > 0 {
+			return nil, fmt.Errorf("yaml: line %d: only one document is supported", i+1)
+		}
+		if text == "" || text == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment removes a # comment from s, unless it is inside quotes.
+func stripYAMLComment(s string) string {
+	var quote rune
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	num := 0
+	if p.pos < len(p.lines) {
+		num = p.lines[p.pos].num
+	} else if len(p.lines) > 0 {
+		num = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("yaml: line %d: %s", num, fmt.Sprintf(format, args...))
+}
+
+// block parses the sequence or mapping whose lines start at indent.
+func (p *yamlParser) block(indent int) (any, error) {
+	if isYAMLItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	list := []any{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		rest := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		switch _, _, isKey := cutYAMLKey(rest); {
+		case rest == "":
+			p.pos++
+			v, err := p.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		case isKey:
+			// A mapping starting on the item's line continues on the
+			// lines indented like its first key.
+			p.lines[p.pos] = yamlLine{num: line.num, indent: indent + len(line.text) - len(rest), text: rest}
+			v, err := p.mapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		default:
+			v, err := yamlScalar(rest)
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			list = append(list, v)
+			p.pos++
+		}
+	}
+	return list, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	obj := map[string]any{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		key, rest, ok := cutYAMLKey(line.text)
+		if !ok {
+			return nil, p.errorf("expected a key: value pair")
+		}
+		if _, dup := obj[key]; dup {
+			return nil, p.errorf("key %q appears twice", key)
+		}
+		p.pos++
+		if rest != "" {
+			v, err := yamlScalar(rest)
+			if err != nil {
+				p.pos--
+				return nil, p.errorf("%v", err)
+			}
+			obj[key] = v
+			continue
+		}
+		// A sequence under a key may be indented as much as the key.
+		if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text) {
+			v, err := p.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = v
+			continue
+		}
+		v, err := p.nested(indent)
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = v
+	}
+	return obj, nil
+}
+
+// nested parses the block indented deeper than indent at the current
+// line, or returns nil if there is none.
+func (p *yamlParser) nested(indent int) (any, error) {
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+		return nil, nil
+	}
+	return p.block(p.lines[p.pos].indent)
+}
+
+// cutYAMLKey splits a key: value line, reporting whether it is one.
+func cutYAMLKey(text string) (key, rest string, ok bool) {
+	var quote rune
+	for i, c := range text {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case i == 0 && (c == '"' || c == '\''):
+			quote = c
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			key = strings.TrimSpace(text[:i])
+			if unquoted, err := yamlString(key); err == nil {
+				key = unquoted
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// yamlScalar returns the value of a scalar: null, a boolean, a number for
+// plain scalars that look like one, and a string otherwise.
+func yamlScalar(s string) (any, error) {
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "[]":
+		return []any{}, nil
+	case "{}":
+		return map[string]any{}, nil
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		return yamlString(s)
+	}
+	if s[0] == '[' || s[0] == '{' || s[0] == '&' || s[0] == '*' || s[0] == '!' || s[0] == '|' || s[0] == '>' {
+		return nil, fmt.Errorf("%q uses YAML that is not supported", s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xXpP_") && json.Valid([]byte(s)) {
+		return json.Number(s), nil
+	}
+	return s, nil
+}
+
+// yamlString unquotes a double-quoted string, with JSON escapes, or a
+// single-quoted one, in which a doubled quote stands for one.
+func yamlString(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		var out string
+		if err := json.Unmarshal([]byte(s), &out); err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return out, nil
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, fmt.Errorf("%s is not quoted", s)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{name: "empty", src: "", want: "null"},
+		{name: "only comments", src: "# nothing\n\n---\n", want: "null"},
+		{name: "scalars", src: `
+null: ~
+also_null: null
+yes: true
+no: FALSE
+int: 42
+negative: -7
+float: 1.5e3
+octal_looking: 007
+hex: 0x1F
+underscored: 1_000
+half: .5
+plus: +1
+not_a_number: NaN
+word: yes
+spaced: two words
+`, want: `{"also_null":null,"float":1.5e3,"half":".5","hex":"0x1F","int":42,"negative":-7,"no":false,"not_a_number":"NaN","null":null,"octal_looking":"007","plus":"+1","spaced":"two words","underscored":"1_000","word":"yes","yes":true}`},
+		{name: "quoted", src: `
+double: "a \"quoted\" \u00e9 # not a comment"
+single: 'it''s # not a comment either'
+number: "42"
+empty: ""
+"quoted key": 1
+'key: with a colon': 2
+url: http://example.com/a#b
+`, want: `{"double":"a \"quoted\" é # not a comment","empty":"","key: with a colon":2,"number":"42","quoted key":1,"single":"it's # not a comment either","url":"http://example.com/a#b"}`},
+		{name: "comments", src: "# heading\na: 1 # trailing\n  # indented\nb: x#not a comment\n", want: `{"a":1,"b":"x#not a comment"}`},
+		{name: "nested", src: `
+server:
+  addr: :8080
+  tls:
+    enabled: false
+  empty:
+other: {}
+list: []
+`, want: `{"list":[],"other":{},"server":{"addr":":8080","empty":null,"tls":{"enabled":false}}}`},
+		{name: "sequences", src: `
+indented:
+  - a
+  - 1
+level:
+- b
+nested:
+  -
+    - c
+`, want: `{"indented":["a",1],"level":["b"],"nested":[["c"]]}`},
+		{name: "mappings in sequences", src: `
+pebbles:
+  - name: Flint
+    color: grey
+    tags:
+      - round
+  -   name: Chalk
+      weight_grams: 3
+  - id: p1
+`, want: `{"pebbles":[{"color":"grey","name":"Flint","tags":["round"]},{"name":"Chalk","weight_grams":3},{"id":"p1"}]}`},
+		{name: "top-level sequence", src: "- 1\n- two\n", want: `[1,"two"]`},
+		{name: "byte order mark and CRLF", src: "\ufeffa: 1\r\nb: two\r\n", want: `{"a":1,"b":"two"}`},
+		{name: "document start", src: "---\na: 1\n", want: `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := yamlToJSON([]byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotV, wantV any
+			if err := json.Unmarshal(got, &gotV); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantV); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotV, wantV) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestYAMLToJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{name: "tab indentation", src: "a:\n\tb: 1\n", want: "yaml: line 2: tabs cannot indent"},
+		{name: "a scalar document", src: "just words\n", want: "yaml: line 1: expected a key: value pair"},
+		{name: "no space after the colon", src: "a:1\n", want: "yaml: line 1: expected a key: value pair"},
+		{name: "empty key", src: ": 1\n", want: "yaml: line 1: expected a key: value pair"},
+		{name: "duplicate key", src: "a: 1\nb: 2\na: 3\n", want: `yaml: line 3: key "a" appears twice`},
+		{name: "duplicate quoted key", src: "a: 1\n'a': 2\n", want: `yaml: line 2: key "a" appears twice`},
+		{name: "indented after a scalar", src: "a: 1\n  b: 2\n", want: "yaml: line 2: unexpected indentation"},
+		{name: "dedented into nothing", src: "a:\n    b: 1\n  c: 2\n", want: "yaml: line 3: unexpected indentation"},
+		{name: "multi-line plain scalar", src: "a: hello\n  world\n", want: "yaml: line 2: unexpected indentation"},
+		{name: "key after a top-level sequence", src: "- 1\nb: 2\n", want: "yaml: line 2: unexpected indentation"},
+		{name: "flow sequence", src: "a: [1, 2]\n", want: `yaml: line 1: "[1, 2]" uses YAML that is not supported`},
+		{name: "flow mapping", src: "a: {b: 1}\n", want: `yaml: line 1: "{b: 1}" uses YAML that is not supported`},
+		{name: "flow item", src: "- [1]\n", want: `yaml: line 1: "[1]" uses YAML that is not supported`},
+		{name: "anchor", src: "a: &x 1\n", want: "uses YAML that is not supported"},
+		{name: "alias", src: "a: 1\nb: *x\n", want: `yaml: line 2: "*x" uses YAML that is not supported`},
+		{name: "tag", src: "a: !!str 1\n", want: "uses YAML that is not supported"},
+		{name: "literal block", src: "a: |\n  text\n", want: `yaml: line 1: "|" uses YAML that is not supported`},
+		{name: "folded block", src: "a: >\n  text\n", want: `yaml: line 1: ">" uses YAML that is not supported`},
+		{name: "unterminated double quote", src: "a: \"open\n", want: "yaml: line 1: \"open is not quoted"},
+		{name: "text after a quote", src: "a: 'closed' and more\n", want: "is not quoted"},
+		{name: "bad escape", src: `a: "\q"` + "\n", want: `yaml: line 1: invalid string "\q"`},
+		{name: "second document", src: "a: 1\n---\nb: 2\n", want: "yaml: line 2: only one document is supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := yamlToJSON([]byte(tt.src))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %s, %v, want an error saying %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	type server struct {
+		Addr  string   `json:"addr"`
+		Ports []int    `json:"ports"`
+		Debug *bool    `json:"debug"`
+		Tags  []string `json:"tags"`
+	}
+	var s server
+	src := "addr: \":8080\"\nports:\n  - 80\n  - 443\ntags: []\n"
+	if err := decodeYAML([]byte(src), &s); err != nil {
+		t.Fatal(err)
+	}
+	if want := (server{Addr: ":8080", Ports: []int{80, 443}, Tags: []string{}}); !reflect.DeepEqual(s, want) {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+
+	// Documents are checked as JSON bodies are.
+	for src, want := range map[string]string{
+		"adress: x\n":     "body.adress: unknown field",
+		"ports: 80\n":     "body.ports: expected array",
+		"ports:\n- x\n":   "body.ports[0]: expected integer",
+		"addr:\n  a: 1\n": "body.addr: expected string",
+	} {
+		var s server
+		if err := decodeYAML([]byte(src), &s); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want an error saying %q", src, err, want)
+		}
+	}
+}